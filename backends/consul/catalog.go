@@ -0,0 +1,193 @@
+// Copyright (c) 2014 The SkyDNS Authors. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package consul
+
+import (
+	"context"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/skynetservices/skydns/msg"
+
+	"github.com/miekg/dns"
+)
+
+// healthEntry is an instance of a service, as returned by the health endpoint.
+type healthEntry struct {
+	Node struct {
+		Node    string
+		Address string
+	}
+	Service struct {
+		ID      string
+		Service string
+		Address string
+		Port    int
+		Tags    []string
+		Meta    map[string]string
+	}
+}
+
+// catalogRecords returns the healthy instances of the services in the catalog.
+// Service web is web.<Domain>, with the instances of it under it: instance id of
+// web is <id>.web.<Domain>. The tags of an instance are its tags, its metadata
+// is added to its TXT record.
+func (g *Backend) catalogRecords(name string, exact bool) ([]msg.Service, error) {
+	name = strings.ToLower(name)
+	domain := dns.Fqdn(strings.ToLower(g.config.Domain))
+	if !dns.IsSubDomain(domain, name) {
+		return nil, msg.ErrNotFound
+	}
+	labels := dns.SplitDomainName(name)
+	labels = labels[:len(labels)-dns.CountLabel(domain)]
+
+	var service, id string
+	switch len(labels) {
+	case 0:
+		if exact {
+			return nil, nil
+		}
+	case 1:
+		service = labels[0]
+		if exact && !isWildcard(service) {
+			// A service is a directory of its instances.
+			sx, err := g.instances(g.ctx, service)
+			if err != nil || len(sx) == 0 {
+				return nil, msg.ErrNotFound
+			}
+			return nil, nil
+		}
+	case 2:
+		id, service = labels[0], labels[1]
+	default:
+		return nil, msg.ErrNotFound
+	}
+
+	var sx []msg.Service
+	if service == "" || isWildcard(service) {
+		services, _, err := g.services(g.ctx, 0)
+		if err != nil {
+			return nil, err
+		}
+		for _, s := range services {
+			ix, err := g.instances(g.ctx, s)
+			if err != nil {
+				return nil, err
+			}
+			sx = append(sx, ix...)
+		}
+	} else {
+		var err error
+		if sx, err = g.instances(g.ctx, service); err != nil {
+			return nil, err
+		}
+	}
+	if id != "" && !isWildcard(id) {
+		ret := sx[:0]
+		for _, serv := range sx {
+			if msg.Domain(serv.Key) == name {
+				ret = append(ret, serv)
+			}
+		}
+		sx = ret
+	}
+	if len(sx) == 0 {
+		return nil, msg.ErrNotFound
+	}
+	return sx, nil
+}
+
+// catalogWait is how long a blocking query of the catalog waits for a change.
+// An instance that starts or stops passing its health checks doesn't change the
+// catalog, Watch sees it after at most catalogWait.
+const catalogWait = "30s"
+
+// services returns the names of the services in the catalog, sorted, and the
+// index of the catalog. With an index, it waits until the catalog changed after
+// it.
+func (g *Backend) services(ctx context.Context, index uint64) ([]string, uint64, error) {
+	var q url.Values
+	if index > 0 {
+		q = url.Values{"index": {strconv.FormatUint(index, 10)}, "wait": {catalogWait}}
+	}
+	var services map[string][]string
+	next, err := g.get(ctx, "/v1/catalog/services", q, &services)
+	if err != nil {
+		return nil, 0, err
+	}
+	names := make([]string, 0, len(services))
+	for s := range services {
+		// Consul itself is a service too.
+		if s != "consul" {
+			names = append(names, s)
+		}
+	}
+	sort.Strings(names)
+	return names, next, nil
+}
+
+// instances returns the instances of service that pass their health checks. The
+// address of an instance defaults to that of its node.
+func (g *Backend) instances(ctx context.Context, service string) ([]msg.Service, error) {
+	var entries []healthEntry
+	if _, err := g.get(ctx, "/v1/health/service/"+url.PathEscape(service), url.Values{"passing": {""}}, &entries); err != nil {
+		return nil, err
+	}
+	sx := make([]msg.Service, 0, len(entries))
+	for _, e := range entries {
+		host := e.Service.Address
+		if host == "" {
+			host = e.Node.Address
+		}
+		name := label(e.Service.ID) + "." + label(e.Service.Service) + "." + dns.Fqdn(g.config.Domain)
+		sx = append(sx, msg.Service{
+			Host:     host,
+			Port:     e.Service.Port,
+			Priority: int(g.config.Priority),
+			Ttl:      g.config.Ttl,
+			Tags:     e.Service.Tags,
+			Meta:     e.Service.Meta,
+			Key:      g.path(strings.ToLower(name)),
+		})
+	}
+	return sx, nil
+}
+
+// catalogSnapshot is snapshot for the catalog.
+func (g *Backend) catalogSnapshot(ctx context.Context, index uint64) (map[string]*msg.Service, uint64, error) {
+	services, next, err := g.services(ctx, index)
+	if err != nil {
+		return nil, 0, err
+	}
+	sx := make(map[string]*msg.Service)
+	for _, s := range services {
+		ix, err := g.instances(ctx, s)
+		if err != nil {
+			return nil, 0, err
+		}
+		for i := range ix {
+			sx[ix[i].Key] = &ix[i]
+		}
+	}
+	return sx, next, nil
+}
+
+// label returns s as a DNS label, the characters that are not letters, digits,
+// hyphens or underscores are replaced by hyphens.
+func label(s string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '-', r == '_':
+			return r
+		}
+		return '-'
+	}, s)
+}
+
+func isWildcard(l string) bool {
+	return l == "*" || l == "any"
+}
@@ -0,0 +1,460 @@
+// Copyright (c) 2014 The SkyDNS Authors. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+// Package consul provides a SkyDNS server Backend that looks up the services in
+// Consul, in its KV store under the same keys as in etcd, or in its service
+// catalog. It uses Consul's HTTP API.
+package consul
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/skynetservices/skydns/msg"
+	"github.com/skynetservices/skydns/singleflight"
+)
+
+// Config represents configuration for the Consul backend - Ttl, Priority and
+// Domain should be taken directly from server.Config.
+type Config struct {
+	Ttl      uint32
+	Priority uint16
+	// PathPrefix is the root the data is stored under in the KV store, defaults to
+	// msg.PathPrefix.
+	PathPrefix string
+	// Catalog, look up the healthy instances of the services in the catalog, not
+	// the KV store, see catalogRecords.
+	Catalog bool
+	// Domain the services of the catalog are under.
+	Domain string
+	// Addr is the URL of the Consul agent, defaults to http://127.0.0.1:8500.
+	Addr string
+	// Token is the ACL token sent with every request.
+	Token string
+}
+
+type Backend struct {
+	client   *http.Client
+	ctx      context.Context
+	config   *Config
+	inflight *singleflight.Group
+}
+
+// NewBackend returns a new Backend for SkyDNS, backed by Consul.
+func NewBackend(client *http.Client, ctx context.Context, config *Config) *Backend {
+	return &Backend{
+		client:   client,
+		ctx:      ctx,
+		config:   config,
+		inflight: &singleflight.Group{},
+	}
+}
+
+// watchWait is how long a blocking query of Watch waits for a change.
+const watchWait = "5m"
+
+var errReadOnly = errors.New("the consul catalog is read-only")
+
+func (g *Backend) HasSynced() bool {
+	return true
+}
+
+// kvPair is a key of the KV store, as returned by the HTTP API. Keys have no
+// leading slash, the Value of a folder is null.
+type kvPair struct {
+	Key         string
+	Value       []byte
+	ModifyIndex uint64
+}
+
+func (g *Backend) Records(name string, exact bool) ([]msg.Service, error) {
+	if g.config.Catalog {
+		return g.catalogRecords(name, exact)
+	}
+	path, star := g.pathWithWildcard(name)
+	var kv []kvPair
+	if _, err := g.get(g.ctx, "/v1/kv"+path, url.Values{"recurse": {""}}, &kv); err != nil {
+		return nil, err
+	}
+	// The keys under path, or path itself when it is a service. Recurse returns
+	// every key with path as prefix, /a/bc for /a/b too.
+	var leaf *kvPair
+	var ns []kvPair
+	for i, p := range kv {
+		key := "/" + p.Key
+		switch {
+		case p.Value == nil || strings.HasSuffix(key, "/"):
+		case key == path:
+			leaf = &kv[i]
+		case strings.HasPrefix(key, path+"/"):
+			ns = append(ns, p)
+		}
+	}
+	segments := strings.Split(g.path(name), "/")
+	switch {
+	case leaf != nil:
+		return g.loopPairs([]kvPair{*leaf}, segments, false)
+	case len(ns) == 0:
+		return nil, msg.ErrNotFound
+	case exact:
+		return nil, nil
+	default:
+		return g.loopPairs(ns, segments, star)
+	}
+}
+
+func (g *Backend) ReverseRecord(name string) (*msg.Service, error) {
+	if g.config.Catalog {
+		return nil, msg.ErrNotFound
+	}
+	path, star := g.pathWithWildcard(name)
+	if star {
+		return nil, fmt.Errorf("reverse can not contain wildcards")
+	}
+	var kv []kvPair
+	if _, err := g.get(g.ctx, "/v1/kv"+path, nil, &kv); err != nil {
+		return nil, err
+	}
+	if len(kv) != 1 || kv[0].Value == nil {
+		return nil, fmt.Errorf("reverse must not be a directory")
+	}
+	records, err := g.loopPairs(kv, nil, false)
+	if err != nil {
+		return nil, err
+	}
+	if len(records) != 1 {
+		return nil, fmt.Errorf("must be only one service record")
+	}
+	return &records[0], nil
+}
+
+// Revision returns the revision of the keys under name. For the catalog it is
+// the index of the catalog, which changes with every service.
+func (g *Backend) Revision(name string) (msg.Revision, error) {
+	if g.config.Catalog {
+		services, index, err := g.services(g.ctx, 0)
+		if err != nil {
+			return msg.Revision{}, err
+		}
+		return msg.Revision{Current: index, Modified: index, Keys: len(services)}, nil
+	}
+	var kv []kvPair
+	index, err := g.get(g.ctx, "/v1/kv"+g.path(name), url.Values{"recurse": {""}}, &kv)
+	if err != nil {
+		return msg.Revision{}, err
+	}
+	rev := msg.Revision{Current: index}
+	for _, p := range kv {
+		if p.ModifyIndex > rev.Modified {
+			rev.Modified = p.ModifyIndex
+		}
+		if p.Value != nil {
+			rev.Keys++
+		}
+	}
+	return rev, nil
+}
+
+// Quorum fails when the Consul servers have no leader, they don't answer our
+// reads then.
+func (g *Backend) Quorum(ctx context.Context) error {
+	var leader string
+	if _, err := g.get(ctx, "/v1/status/leader", nil, &leader); err != nil {
+		return err
+	}
+	if leader == "" {
+		return &msg.UnavailableError{Err: fmt.Errorf("consul has no leader")}
+	}
+	return nil
+}
+
+// Put stores serv under name, in a key of its own named id.
+func (g *Backend) Put(name, id string, serv *msg.Service) error {
+	if g.config.Catalog {
+		return errReadOnly
+	}
+	b, err := json.Marshal(serv)
+	if err != nil {
+		return err
+	}
+	return g.send("PUT", "/v1/kv"+g.path(name)+"/"+id, b)
+}
+
+// Delete removes the service stored at key, the Key of a service.
+func (g *Backend) Delete(key string) error {
+	if g.config.Catalog {
+		return errReadOnly
+	}
+	return g.send("DELETE", "/v1/kv"+key, nil)
+}
+
+// Value returns the value of key in the KV store, such as /skydns/config.
+func (g *Backend) Value(key string) ([]byte, error) {
+	var kv []kvPair
+	if _, err := g.get(g.ctx, "/v1/kv"+key, nil, &kv); err != nil {
+		return nil, err
+	}
+	if len(kv) != 1 {
+		return nil, msg.ErrNotFound
+	}
+	return kv[0].Value, nil
+}
+
+// Watch calls f for every service added, changed or removed under our root, or
+// in the catalog, until the watch fails or ctx is done. It does blocking queries
+// and compares the services with those of the previous one, Consul doesn't
+// report what changed.
+func (g *Backend) Watch(ctx context.Context, f func(msg.Change)) error {
+	var (
+		index uint64
+		seen  map[string]*msg.Service
+	)
+	for {
+		sx, next, err := g.snapshot(ctx, index)
+		if err != nil {
+			return err
+		}
+		if seen != nil {
+			changes(seen, sx, f)
+		}
+		seen = sx
+		// The index can go backwards, the next query must not block on it then.
+		if next < index {
+			next = 0
+		}
+		index = next
+	}
+}
+
+// snapshot returns the services under our root, or in the catalog, by key. With
+// an index, it waits until the services changed after it.
+func (g *Backend) snapshot(ctx context.Context, index uint64) (map[string]*msg.Service, uint64, error) {
+	if g.config.Catalog {
+		return g.catalogSnapshot(ctx, index)
+	}
+	root := g.root()
+	q := url.Values{"recurse": {""}}
+	if index > 0 {
+		q.Set("index", strconv.FormatUint(index, 10))
+		q.Set("wait", watchWait)
+	}
+	var kv []kvPair
+	next, err := g.get(ctx, "/v1/kv"+root, q, &kv)
+	if err != nil && err != msg.ErrNotFound {
+		return nil, 0, err
+	}
+	sx := make(map[string]*msg.Service, len(kv))
+	for _, p := range kv {
+		key := "/" + p.Key
+		if p.Value == nil || key == root+"/config" {
+			continue
+		}
+		serv := new(msg.Service)
+		if err := msg.Decode(p.Value, serv); err != nil {
+			continue
+		}
+		serv.Key = key
+		sx[key] = serv
+	}
+	return sx, next, nil
+}
+
+// changes calls f for the services added, changed and removed in now, compared
+// to seen, in the order of their keys.
+func changes(seen, now map[string]*msg.Service, f func(msg.Change)) {
+	keys := make([]string, 0, len(now))
+	for key := range now {
+		keys = append(keys, key)
+	}
+	for key := range seen {
+		if _, ok := now[key]; !ok {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		c := msg.Change{Name: msg.Domain(key), Key: key, Service: now[key]}
+		old, ok := seen[key]
+		switch {
+		case c.Service == nil:
+			c.Type = msg.Removed
+		case !ok:
+			c.Type = msg.Added
+		case !reflect.DeepEqual(old, c.Service):
+			c.Type = msg.Changed
+		default:
+			continue
+		}
+		f(c)
+	}
+}
+
+// root returns the key our data is stored under.
+func (g *Backend) root() string {
+	if g.config.PathPrefix == "" {
+		return "/" + msg.PathPrefix
+	}
+	return "/" + g.config.PathPrefix
+}
+
+// path is msg.Path for our PathPrefix.
+func (g *Backend) path(name string) string {
+	if g.config.PathPrefix == "" {
+		return msg.Path(name)
+	}
+	return msg.PathIn(g.config.PathPrefix, name)
+}
+
+// pathWithWildcard is msg.PathWithWildcard for our PathPrefix.
+func (g *Backend) pathWithWildcard(name string) (string, bool) {
+	if g.config.PathPrefix == "" {
+		return msg.PathWithWildcard(name)
+	}
+	return msg.PathWithWildcardIn(g.config.PathPrefix, name)
+}
+
+// addr returns the URL of the agent, without a trailing slash.
+func (g *Backend) addr() string {
+	if g.config.Addr == "" {
+		return "http://127.0.0.1:8500"
+	}
+	return strings.TrimSuffix(g.config.Addr, "/")
+}
+
+type reply struct {
+	body  []byte
+	index uint64
+}
+
+// get does a GET of path with the query q on the agent, and decodes the JSON it
+// returns into v. It returns the index of the data (X-Consul-Index). Queries that
+// don't block use SingleInflight to suppress multiple outstanding queries. When a
+// read fails because the servers lost their leader, the agent's server is asked
+// for its own (stale) copy of the data instead.
+func (g *Backend) get(ctx context.Context, path string, q url.Values, v interface{}) (uint64, error) {
+	u := g.addr() + path
+	if len(q) > 0 {
+		u += "?" + q.Encode()
+	}
+	do := func() (interface{}, error) {
+		b, resp, err := g.do(ctx, "GET", u, nil)
+		if err != nil && resp != nil && resp.StatusCode >= 500 {
+			sep := "?"
+			if len(q) > 0 {
+				sep = "&"
+			}
+			b, resp, err = g.do(ctx, "GET", u+sep+"stale", nil)
+		}
+		if resp == nil {
+			return nil, err
+		}
+		index, _ := strconv.ParseUint(resp.Header.Get("X-Consul-Index"), 10, 64)
+		return reply{b, index}, err
+	}
+	var (
+		r   interface{}
+		err error
+	)
+	if q.Get("index") == "" {
+		r, err = g.inflight.Do(u, do)
+	} else {
+		r, err = do()
+	}
+	if r == nil {
+		return 0, err
+	}
+	// A key that is not found has an index too, to wait for it.
+	if err != nil {
+		return r.(reply).index, err
+	}
+	return r.(reply).index, json.Unmarshal(r.(reply).body, v)
+}
+
+// send does a PUT or DELETE of path on the agent.
+func (g *Backend) send(method, path string, body []byte) error {
+	_, _, err := g.do(g.ctx, method, g.addr()+path, body)
+	return err
+}
+
+// do does the request and returns the body of the reply. A key that is not
+// found is msg.ErrNotFound, an agent that can't be reached, or servers without a
+// leader, a *msg.UnavailableError. The reply is returned with the errors of the
+// agent.
+func (g *Backend) do(ctx context.Context, method, u string, body []byte) ([]byte, *http.Response, error) {
+	req, err := http.NewRequest(method, u, bytes.NewReader(body))
+	if err != nil {
+		return nil, nil, err
+	}
+	req = req.WithContext(ctx)
+	if g.config.Token != "" {
+		req.Header.Set("X-Consul-Token", g.config.Token)
+	}
+	resp, err := g.client.Do(req)
+	if err != nil {
+		return nil, nil, &msg.UnavailableError{Err: err}
+	}
+	defer resp.Body.Close()
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, nil, err
+	}
+	switch {
+	case resp.StatusCode == http.StatusNotFound:
+		return nil, resp, msg.ErrNotFound
+	case resp.StatusCode >= 500:
+		return nil, resp, &msg.UnavailableError{Err: fmt.Errorf("consul: %s: %s", resp.Status, bytes.TrimSpace(b))}
+	case resp.StatusCode != http.StatusOK:
+		return nil, nil, fmt.Errorf("consul: %s: %s", resp.Status, bytes.TrimSpace(b))
+	}
+	return b, resp, nil
+}
+
+// loopPairs returns the services of the keys in kv. The keys will be matched
+// against the wildcards of nameParts when star is true.
+func (g *Backend) loopPairs(kv []kvPair, nameParts []string, star bool) ([]msg.Service, error) {
+	sx := make([]msg.Service, 0, len(kv))
+Pairs:
+	for _, p := range kv {
+		key := "/" + p.Key
+		if star {
+			keyParts := strings.Split(key, "/")
+			for i, n := range nameParts {
+				if i > len(keyParts)-1 {
+					// name is longer than key
+					continue Pairs
+				}
+				if n == "*" || n == "any" {
+					continue
+				}
+				if keyParts[i] != n {
+					continue Pairs
+				}
+			}
+		}
+		serv := new(msg.Service)
+		if err := msg.Decode(p.Value, serv); err != nil {
+			return nil, err
+		}
+		serv.Key = key
+		if serv.Ttl == 0 {
+			// The KV store has no TTLs of its own.
+			serv.Ttl = g.config.Ttl
+		}
+		if serv.Priority == 0 {
+			serv.Priority = int(g.config.Priority)
+		}
+		sx = append(sx, *serv)
+	}
+	return sx, nil
+}
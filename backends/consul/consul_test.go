@@ -0,0 +1,178 @@
+// Copyright (c) 2014 The SkyDNS Authors. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package consul
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/skynetservices/skydns/msg"
+)
+
+// noLeader makes fakeConsul answer only stale reads.
+var noLeader bool
+
+// fakeConsul serves the parts of Consul's HTTP API the backend uses, from kv and
+// the instances of the services in health.
+func fakeConsul(t *testing.T, kv map[string]string, health map[string][]healthEntry) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Consul-Token") != "token" {
+			http.Error(w, "ACL not found", http.StatusForbidden)
+			return
+		}
+		if _, stale := r.URL.Query()["stale"]; noLeader && !stale {
+			http.Error(w, "No cluster leader", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("X-Consul-Index", "42")
+		var reply interface{}
+		switch {
+		case strings.HasPrefix(r.URL.Path, "/v1/kv/"):
+			key := strings.TrimPrefix(r.URL.Path, "/v1/kv/")
+			var pairs []kvPair
+			for k, v := range kv {
+				if k == key || (r.URL.Query()["recurse"] != nil && strings.HasPrefix(k, key)) {
+					pairs = append(pairs, kvPair{Key: k, Value: []byte(v), ModifyIndex: 7})
+				}
+			}
+			if len(pairs) == 0 {
+				http.NotFound(w, r)
+				return
+			}
+			sort.Slice(pairs, func(i, j int) bool { return pairs[i].Key < pairs[j].Key })
+			reply = pairs
+		case r.URL.Path == "/v1/catalog/services":
+			services := map[string][]string{"consul": nil}
+			for s := range health {
+				services[s] = nil
+			}
+			reply = services
+		case strings.HasPrefix(r.URL.Path, "/v1/health/service/"):
+			reply = health[strings.TrimPrefix(r.URL.Path, "/v1/health/service/")]
+			if reply == nil {
+				reply = []healthEntry{}
+			}
+		default:
+			t.Errorf("unexpected request %s", r.URL)
+			http.NotFound(w, r)
+			return
+		}
+		json.NewEncoder(w).Encode(reply)
+	}))
+}
+
+func TestKV(t *testing.T) {
+	ts := fakeConsul(t, map[string]string{
+		"skydns/test/skydns/www/1":  `{"host": "10.0.0.1"}`,
+		"skydns/test/skydns/www/2":  `{"host": "10.0.0.2", "ttl": 60}`,
+		"skydns/test/skydns/www2":   `{"host": "10.0.0.3"}`,
+		"skydns/test/skydns/db":     `{"host": "10.0.0.4"}`,
+		"skydns/arpa/in-addr/10/0/": "",
+	}, nil)
+	defer ts.Close()
+	g := NewBackend(http.DefaultClient, context.Background(), &Config{Ttl: 3600, Priority: 10, Addr: ts.URL, Token: "token"})
+
+	sx, err := g.Records("www.skydns.test.", false)
+	if err != nil || len(sx) != 2 {
+		t.Fatalf("expected the 2 services of www, got %v, %v", sx, err)
+	}
+	if sx[0].Key != "/skydns/test/skydns/www/1" || sx[0].Ttl != 3600 || sx[0].Priority != 10 || sx[1].Ttl != 60 {
+		t.Errorf("expected the defaults for the services of www, got %v", sx)
+	}
+	if sx, err := g.Records("www.skydns.test.", true); err != nil || len(sx) != 0 {
+		t.Errorf("expected no services for the directory www, got %v, %v", sx, err)
+	}
+	if sx, err := g.Records("db.skydns.test.", true); err != nil || len(sx) != 1 || sx[0].Host != "10.0.0.4" {
+		t.Errorf("expected the service db, got %v, %v", sx, err)
+	}
+	if sx, err := g.Records("*.skydns.test.", false); err != nil || len(sx) != 4 {
+		t.Errorf("expected the 4 services of the domain, got %v, %v", sx, err)
+	}
+	for _, name := range []string{"nope.skydns.test.", "ww.skydns.test.", "a.db.skydns.test."} {
+		if _, err := g.Records(name, false); err != msg.ErrNotFound {
+			t.Errorf("expected msg.ErrNotFound for %s, got %v", name, err)
+		}
+	}
+
+	noLeader = true
+	if sx, err := g.Records("db.skydns.test.", false); err != nil || len(sx) != 1 {
+		t.Errorf("expected a stale read of db without a leader, got %v, %v", sx, err)
+	}
+	noLeader = false
+
+	g.config.Token = ""
+	if _, err := g.Records("www.skydns.test.", false); err == nil || err == msg.ErrNotFound {
+		t.Errorf("expected an error without a token, got %v", err)
+	}
+	g.config.Addr = "http://127.0.0.1:1"
+	if _, err := g.Records("www.skydns.test.", false); err == nil {
+		t.Errorf("expected an error for an agent that can't be reached")
+	} else if _, ok := err.(*msg.UnavailableError); !ok {
+		t.Errorf("expected a *msg.UnavailableError, got %T", err)
+	}
+}
+
+func TestCatalog(t *testing.T) {
+	entry := func(id, address, node string, tags ...string) healthEntry {
+		var e healthEntry
+		e.Node.Address = node
+		e.Service.ID, e.Service.Service, e.Service.Address, e.Service.Port, e.Service.Tags = id, "web", address, 80, tags
+		return e
+	}
+	ts := fakeConsul(t, nil, map[string][]healthEntry{
+		"web": {entry("web:1", "10.0.0.1", "10.1.0.1", "canary"), entry("web:2", "", "10.1.0.2")},
+	})
+	defer ts.Close()
+	g := NewBackend(http.DefaultClient, context.Background(), &Config{Ttl: 3600, Catalog: true, Domain: "skydns.test.", Addr: ts.URL, Token: "token"})
+
+	sx, err := g.Records("web.skydns.test.", false)
+	if err != nil || len(sx) != 2 {
+		t.Fatalf("expected the 2 instances of web, got %v, %v", sx, err)
+	}
+	if sx[0].Host != "10.0.0.1" || sx[0].Port != 80 || !sx[0].HasTag("canary") || sx[1].Host != "10.1.0.2" {
+		t.Errorf("expected the addresses of the instances, got %v", sx)
+	}
+	if sx, err := g.Records("WEB-2.web.skydns.test.", false); err != nil || len(sx) != 1 || sx[0].Host != "10.1.0.2" {
+		t.Errorf("expected instance web:2, got %v, %v", sx, err)
+	}
+	if sx, err := g.Records("skydns.test.", false); err != nil || len(sx) != 2 {
+		t.Errorf("expected every instance, got %v, %v", sx, err)
+	}
+	if sx, err := g.Records("web.skydns.test.", true); err != nil || len(sx) != 0 {
+		t.Errorf("expected no services for the directory web, got %v, %v", sx, err)
+	}
+	for _, name := range []string{"db.skydns.test.", "web-3.web.skydns.test.", "web.skydns.local."} {
+		if _, err := g.Records(name, false); err != msg.ErrNotFound {
+			t.Errorf("expected msg.ErrNotFound for %s, got %v", name, err)
+		}
+	}
+	if err := g.Put("web.skydns.test.", "1", &msg.Service{}); err != errReadOnly {
+		t.Errorf("expected the catalog to be read-only, got %v", err)
+	}
+}
+
+func TestChanges(t *testing.T) {
+	seen := map[string]*msg.Service{
+		"/skydns/test/skydns/a": {Host: "10.0.0.1"},
+		"/skydns/test/skydns/b": {Host: "10.0.0.2"},
+		"/skydns/test/skydns/c": {Host: "10.0.0.3"},
+	}
+	now := map[string]*msg.Service{
+		"/skydns/test/skydns/a": {Host: "10.0.0.1"},
+		"/skydns/test/skydns/b": {Host: "10.0.0.5"},
+		"/skydns/test/skydns/d": {Host: "10.0.0.4"},
+	}
+	var got []string
+	changes(seen, now, func(c msg.Change) { got = append(got, string(c.Type)+" "+c.Name) })
+	want := []string{"changed b.skydns.test.", "removed c.skydns.test.", "added d.skydns.test."}
+	if strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("expected %v, got %v", want, got)
+	}
+}
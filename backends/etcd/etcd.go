@@ -23,6 +23,8 @@ import (
 type Config struct {
 	Ttl      uint32
 	Priority uint16
+	// PathPrefix is the root the data is stored under, defaults to msg.PathPrefix.
+	PathPrefix string
 }
 
 type Backend struct {
@@ -47,24 +49,24 @@ func (g *Backend) HasSynced() bool {
 }
 
 func (g *Backend) Records(name string, exact bool) ([]msg.Service, error) {
-	path, star := msg.PathWithWildcard(name)
+	path, star := g.pathWithWildcard(name)
 	r, err := g.get(path, true)
 	if err != nil {
 		return nil, err
 	}
-	segments := strings.Split(msg.Path(name), "/")
+	segments := strings.Split(g.path(name), "/")
 	switch {
 	case exact && r.Node.Dir:
 		return nil, nil
 	case r.Node.Dir:
-		return g.loopNodes(r.Node.Nodes, segments, star, nil)
+		return g.loopNodes(r.Node.Nodes, segments, star)
 	default:
-		return g.loopNodes([]*etcd.Node{r.Node}, segments, false, nil)
+		return g.loopNodes([]*etcd.Node{r.Node}, segments, false)
 	}
 }
 
 func (g *Backend) ReverseRecord(name string) (*msg.Service, error) {
-	path, star := msg.PathWithWildcard(name)
+	path, star := g.pathWithWildcard(name)
 	if star {
 		return nil, fmt.Errorf("reverse can not contain wildcards")
 	}
@@ -75,8 +77,8 @@ func (g *Backend) ReverseRecord(name string) (*msg.Service, error) {
 	if r.Node.Dir {
 		return nil, fmt.Errorf("reverse must not be a directory")
 	}
-	segments := strings.Split(msg.Path(name), "/")
-	records, err := g.loopNodes([]*etcd.Node{r.Node}, segments, false, nil)
+	segments := strings.Split(g.path(name), "/")
+	records, err := g.loopNodes([]*etcd.Node{r.Node}, segments, false)
 	if err != nil {
 		return nil, err
 	}
@@ -86,6 +88,116 @@ func (g *Backend) ReverseRecord(name string) (*msg.Service, error) {
 	return &records[0], nil
 }
 
+// Revision returns the revision of the keys under name.
+func (g *Backend) Revision(name string) (msg.Revision, error) {
+	r, err := g.get(g.path(name), true)
+	if err != nil {
+		return msg.Revision{}, err
+	}
+	rev := msg.Revision{Current: r.Index}
+	revisionNodes([]*etcd.Node{r.Node}, &rev)
+	return rev, nil
+}
+
+// Quorum does a quorum read of our root, it fails when the etcd cluster lost its
+// quorum. Our own reads are not quorum reads, and are still answered by a member.
+func (g *Backend) Quorum(ctx context.Context) error {
+	_, err := g.client.Get(ctx, g.root(), &etcd.GetOptions{Quorum: true})
+	if etcd.IsKeyNotFound(err) {
+		return nil
+	}
+	return err
+}
+
+// Put stores serv under name, in a key of its own named id.
+func (g *Backend) Put(name, id string, serv *msg.Service) error {
+	b, err := json.Marshal(serv)
+	if err != nil {
+		return err
+	}
+	_, err = g.client.Set(g.ctx, g.path(name)+"/"+id, string(b), nil)
+	return err
+}
+
+// Delete removes the service stored at key, the Key of a service.
+func (g *Backend) Delete(key string) error {
+	_, err := g.client.Delete(g.ctx, key, nil)
+	return err
+}
+
+func revisionNodes(ns []*etcd.Node, rev *msg.Revision) {
+	for _, n := range ns {
+		if n.ModifiedIndex > rev.Modified {
+			rev.Modified = n.ModifiedIndex
+		}
+		if n.Dir {
+			revisionNodes(n.Nodes, rev)
+			continue
+		}
+		rev.Keys++
+	}
+}
+
+// Watch calls f for every service added, changed or removed under our root, until
+// the watch fails or ctx is done.
+func (g *Backend) Watch(ctx context.Context, f func(msg.Change)) error {
+	root := g.root()
+	w := g.client.Watcher(root, &etcd.WatcherOptions{Recursive: true})
+	for {
+		r, err := w.Next(ctx)
+		if err != nil {
+			return err
+		}
+		if r.Node == nil || r.Node.Key == root+"/config" {
+			continue
+		}
+		c := msg.Change{Name: msg.Domain(r.Node.Key), Key: r.Node.Key}
+		switch r.Action {
+		case "delete", "expire", "compareAndDelete":
+			c.Type = msg.Removed
+		default:
+			if r.Node.Dir {
+				continue
+			}
+			c.Type = msg.Added
+			if r.PrevNode != nil {
+				c.Type = msg.Changed
+			}
+			serv := new(msg.Service)
+			if err := msg.DecodeString(r.Node.Value, serv); err != nil {
+				continue
+			}
+			serv.Key = r.Node.Key
+			c.Service = serv
+		}
+		f(c)
+	}
+}
+
+// root returns the key our data is stored under.
+func (g *Backend) root() string {
+	if g.config.PathPrefix == "" {
+		return "/" + msg.PathPrefix
+	}
+	return "/" + g.config.PathPrefix
+}
+
+// path is msg.Path for our PathPrefix.
+func (g *Backend) path(name string) string {
+	if g.config.PathPrefix == "" {
+		return msg.Path(name)
+	}
+	return msg.PathIn(g.config.PathPrefix, name)
+}
+
+// pathWithWildcard is msg.PathWithWildcard for our PathPrefix.
+func (g *Backend) pathWithWildcard(name string) (string, bool) {
+	if g.config.PathPrefix == "" {
+		return msg.PathWithWildcard(name)
+	}
+	return msg.PathWithWildcardIn(g.config.PathPrefix, name)
+}
+
 // get is a wrapper for client.Get that uses SingleInflight to suppress multiple
 // outstanding queries.
 func (g *Backend) get(path string, recursive bool) (*etcd.Response, error) {
@@ -97,17 +209,24 @@ func (g *Backend) get(path string, recursive bool) (*etcd.Response, error) {
 		return r, e
 	})
 	if err != nil {
-		return nil, err
+		return nil, backendError(err)
 	}
 	return resp.(*etcd.Response), err
 }
 
-type bareService struct {
-	Host     string
-	Port     int
-	Priority int
-	Weight   int
-	Text     string
+// backendError returns the error of msg for err, the server doesn't know the
+// errors of etcd. A key that is not found, or a key below a service (a file in
+// etcd), is msg.ErrNotFound.
+func backendError(err error) error {
+	switch e := err.(type) {
+	case etcd.Error:
+		if e.Code == etcd.ErrorCodeKeyNotFound || e.Code == etcd.ErrorCodeNotDir {
+			return msg.ErrNotFound
+		}
+	case *etcd.ClusterError:
+		return &msg.UnavailableError{Err: e}
+	}
+	return err
 }
 
 // skydns/local/skydns/east/staging/web
@@ -118,14 +237,12 @@ type bareService struct {
 
 // loopNodes recursively loops through the nodes and returns all the values. The nodes' keyname
 // will be match against any wildcards when star is true.
-func (g *Backend) loopNodes(ns []*etcd.Node, nameParts []string, star bool, bx map[bareService]bool) (sx []msg.Service, err error) {
-	if bx == nil {
-		bx = make(map[bareService]bool)
-	}
+func (g *Backend) loopNodes(ns []*etcd.Node, nameParts []string, star bool) (sx []msg.Service, err error) {
+	sx = make([]msg.Service, 0, len(ns))
 Nodes:
 	for _, n := range ns {
 		if n.Dir {
-			nodes, err := g.loopNodes(n.Nodes, nameParts, star, bx)
+			nodes, err := g.loopNodes(n.Nodes, nameParts, star)
 			if err != nil {
 				return nil, err
 			}
@@ -148,17 +265,14 @@ Nodes:
 			}
 		}
 		serv := new(msg.Service)
-		if err := json.Unmarshal([]byte(n.Value), serv); err != nil {
+		if err := msg.DecodeString(n.Value, serv); err != nil {
 			return nil, err
 		}
-		b := bareService{serv.Host, serv.Port, serv.Priority, serv.Weight, serv.Text}
-		if _, ok := bx[b]; ok {
-			continue
-		}
-		bx[b] = true
-
 		serv.Key = n.Key
 		serv.Ttl = g.calculateTtl(n, serv)
+		if n.TTL > 0 {
+			serv.CapTtl(uint32(n.TTL))
+		}
 		if serv.Priority == 0 {
 			serv.Priority = int(g.config.Priority)
 		}
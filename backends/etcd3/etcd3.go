@@ -11,17 +11,24 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"strconv"
 	"strings"
+	"time"
 
 	etcdv3 "github.com/coreos/etcd/clientv3"
+	"github.com/coreos/etcd/etcdserver/api/v3rpc/rpctypes"
 	"github.com/coreos/etcd/mvcc/mvccpb"
 	"github.com/skynetservices/skydns/msg"
 	"github.com/skynetservices/skydns/singleflight"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 )
 
 type Config struct {
 	Ttl      uint32
 	Priority uint16
+	// PathPrefix is the root the data is stored under, defaults to msg.PathPrefix.
+	PathPrefix string
 }
 
 type Backendv3 struct {
@@ -46,18 +53,29 @@ func (g *Backendv3) HasSynced() bool {
 }
 
 func (g *Backendv3) Records(name string, exact bool) ([]msg.Service, error) {
-	path, star := msg.PathWithWildcard(name)
+	path, star := g.pathWithWildcard(name)
 	r, err := g.get(path, true)
 	if err != nil {
 		return nil, err
 	}
-	segments := strings.Split(msg.Path(name), "/")
+	segments := strings.Split(g.path(name), "/")
 
-	return g.loopNodes(r.Kvs, segments, star, nil)
+	kvs := r.Kvs
+	if !star {
+		// A prefix get for /skydns/test/a also returns /skydns/test/ab, only keep
+		// the name itself and the names below it.
+		kvs = kvs[:0:0]
+		for _, kv := range r.Kvs {
+			if k := string(kv.Key); k == path || strings.HasPrefix(k, path+"/") {
+				kvs = append(kvs, kv)
+			}
+		}
+	}
+	return g.loopNodes(kvs, segments, star)
 }
 
 func (g *Backendv3) ReverseRecord(name string) (*msg.Service, error) {
-	path, star := msg.PathWithWildcard(name)
+	path, star := g.pathWithWildcard(name)
 	if star {
 		return nil, fmt.Errorf("reverse can not contain wildcards")
 	}
@@ -67,8 +85,8 @@ func (g *Backendv3) ReverseRecord(name string) (*msg.Service, error) {
 		return nil, err
 	}
 
-	segments := strings.Split(msg.Path(name), "/")
-	records, err := g.loopNodes(r.Kvs, segments, false, nil)
+	segments := strings.Split(g.path(name), "/")
+	records, err := g.loopNodes(r.Kvs, segments, false)
 	if err != nil {
 		return nil, err
 	}
@@ -78,41 +96,167 @@ func (g *Backendv3) ReverseRecord(name string) (*msg.Service, error) {
 	return &records[0], nil
 }
 
-func (g *Backendv3) get(path string, recursive bool) (*etcdv3.GetResponse, error) {
-	resp, err := g.inflight.Do(path, func() (interface{}, error) {
-		if recursive == true {
-			r, e := g.client.Get(g.ctx, path, etcdv3.WithPrefix())
-			if e != nil {
-				return nil, e
+// Revision returns the revision of the keys under name.
+func (g *Backendv3) Revision(name string) (msg.Revision, error) {
+	path := g.path(name)
+	r, err := g.client.Get(g.ctx, path, etcdv3.WithPrefix(), etcdv3.WithKeysOnly())
+	if err != nil {
+		return msg.Revision{}, backendError(err)
+	}
+	rev := msg.Revision{Current: uint64(r.Header.Revision)}
+	for _, kv := range r.Kvs {
+		if k := string(kv.Key); k != path && !strings.HasPrefix(k, path+"/") {
+			continue
+		}
+		if uint64(kv.ModRevision) > rev.Modified {
+			rev.Modified = uint64(kv.ModRevision)
+		}
+		rev.Keys++
+	}
+	return rev, nil
+}
+
+// path is msg.Path for our PathPrefix.
+func (g *Backendv3) path(name string) string {
+	if g.config.PathPrefix == "" {
+		return msg.Path(name)
+	}
+	return msg.PathIn(g.config.PathPrefix, name)
+}
+
+// pathWithWildcard is msg.PathWithWildcard for our PathPrefix.
+func (g *Backendv3) pathWithWildcard(name string) (string, bool) {
+	if g.config.PathPrefix == "" {
+		return msg.PathWithWildcard(name)
+	}
+	return msg.PathWithWildcardIn(g.config.PathPrefix, name)
+}
+
+// Quorum does a linearizable read of our root, it fails when the etcd cluster lost
+// its quorum.
+func (g *Backendv3) Quorum(ctx context.Context) error {
+	_, err := g.client.Get(ctx, g.root(), etcdv3.WithPrefix(), etcdv3.WithCountOnly())
+	return err
+}
+
+// Put stores serv under name, in a key of its own named id. A service that is
+// only served until some time is ephemeral: its key is attached to a lease that
+// expires then, so etcd removes it.
+func (g *Backendv3) Put(name, id string, serv *msg.Service) error {
+	b, err := json.Marshal(serv)
+	if err != nil {
+		return err
+	}
+	var opts []etcdv3.OpOption
+	if until := serv.Until(); until != nil {
+		ttl := int64(time.Until(*until)/time.Second) + 1
+		if ttl < 1 {
+			ttl = 1
+		}
+		lease, err := g.client.Grant(g.ctx, ttl)
+		if err != nil {
+			return err
+		}
+		opts = append(opts, etcdv3.WithLease(lease.ID))
+	}
+	_, err = g.client.Put(g.ctx, g.path(name)+"/"+id, string(b), opts...)
+	return err
+}
+
+// Delete removes the service stored at key, the Key of a service.
+func (g *Backendv3) Delete(key string) error {
+	_, err := g.client.Delete(g.ctx, key)
+	return err
+}
+
+// Watch calls f for every service added, changed or removed under our root, until
+// the watch fails or ctx is done.
+func (g *Backendv3) Watch(ctx context.Context, f func(msg.Change)) error {
+	root := g.root()
+	for wresp := range g.client.Watch(ctx, root+"/", etcdv3.WithPrefix()) {
+		if err := wresp.Err(); err != nil {
+			return err
+		}
+		for _, ev := range wresp.Events {
+			key := string(ev.Kv.Key)
+			if key == root+"/config" {
+				continue
 			}
-			return r, e
-		} else {
-			r, e := g.client.Get(g.ctx, path)
-			if e != nil {
-				return nil, e
+			c := msg.Change{Name: msg.Domain(key), Key: key}
+			switch {
+			case ev.Type == mvccpb.DELETE:
+				c.Type = msg.Removed
+			default:
+				c.Type = msg.Changed
+				if ev.IsCreate() {
+					c.Type = msg.Added
+				}
+				serv := new(msg.Service)
+				if err := msg.Decode(ev.Kv.Value, serv); err != nil {
+					continue
+				}
+				serv.Key = key
+				c.Service = serv
 			}
-			return r, e
+			f(c)
 		}
+	}
+	return ctx.Err()
+}
+
+// root returns the key our data is stored under.
+func (g *Backendv3) root() string {
+	if g.config.PathPrefix == "" {
+		return "/" + msg.PathPrefix
+	}
+	return "/" + g.config.PathPrefix
+}
+
+// get reads path. When a linearizable read fails, because the cluster lost its
+// quorum, the member's own (serializable) copy of the data is read instead.
+func (g *Backendv3) get(path string, recursive bool) (*etcdv3.GetResponse, error) {
+	resp, err := g.inflight.Do(path, func() (interface{}, error) {
+		opts := []etcdv3.OpOption{}
+		if recursive {
+			opts = append(opts, etcdv3.WithPrefix())
+		}
+		r, e := g.client.Get(g.ctx, path, opts...)
+		if e != nil {
+			r, e = g.client.Get(g.ctx, path, append(opts, etcdv3.WithSerializable())...)
+		}
+		if e != nil {
+			return nil, e
+		}
+		return r, e
 	})
 
 	if err != nil {
-		return nil, err
+		return nil, backendError(err)
 	}
 	return resp.(*etcdv3.GetResponse), err
 }
 
-type bareService struct {
-	Host     string
-	Port     int
-	Priority int
-	Weight   int
-	Text     string
+// backendError returns the error of msg for err, the server doesn't know the
+// errors of etcd. A member that can't be reached, or that has no leader, is
+// *msg.UnavailableError, as is a request that timed out.
+func backendError(err error) error {
+	switch err {
+	case context.DeadlineExceeded, rpctypes.ErrNoLeader, rpctypes.ErrTimeout,
+		rpctypes.ErrTimeoutDueToLeaderFail, rpctypes.ErrTimeoutDueToConnectionLost:
+		return &msg.UnavailableError{Err: err}
+	}
+	if s, ok := status.FromError(err); ok {
+		switch s.Code() {
+		case codes.Unavailable, codes.DeadlineExceeded:
+			return &msg.UnavailableError{Err: err}
+		}
+	}
+	return err
 }
 
-func (g *Backendv3) loopNodes(kv []*mvccpb.KeyValue, nameParts []string, star bool, bx map[bareService]bool) (sx []msg.Service, err error) {
-	if bx == nil {
-		bx = make(map[bareService]bool)
-	}
+func (g *Backendv3) loopNodes(kv []*mvccpb.KeyValue, nameParts []string, star bool) (sx []msg.Service, err error) {
+	sx = make([]msg.Service, 0, len(kv))
+	leases := make(map[int64]uint32)
 Nodes:
 	for _, item := range kv {
 
@@ -133,20 +277,24 @@ Nodes:
 		}
 
 		serv := new(msg.Service)
-		if err := json.Unmarshal(item.Value, serv); err != nil {
+		if err := msg.Decode(item.Value, serv); err != nil {
 			return nil, err
 		}
 
-		b := bareService{serv.Host,
-			serv.Port,
-			serv.Priority,
-			serv.Weight,
-			serv.Text}
-
-		bx[b] = true
 		serv.Key = string(item.Key)
-		//TODO: another call (LeaseRequest) for TTL when RPC in etcdv3 is ready
-		serv.Ttl = g.calculateTtl(item, serv)
+		var leaseTtl uint32
+		if item.Lease != 0 {
+			ttl, ok := leases[item.Lease]
+			if !ok {
+				ttl = g.leaseTtl(item.Lease)
+				leases[item.Lease] = ttl
+			}
+			leaseTtl = ttl
+		}
+		serv.Ttl = g.calculateTtl(leaseTtl, serv)
+		if leaseTtl > 0 {
+			serv.CapTtl(leaseTtl)
+		}
 
 		if serv.Priority == 0 {
 			serv.Priority = int(g.config.Priority)
@@ -157,8 +305,24 @@ Nodes:
 	return sx, nil
 }
 
-func (g *Backendv3) calculateTtl(kv *mvccpb.KeyValue, serv *msg.Service) uint32 {
-	etcdTtl := uint32(kv.Lease) //TODO: default value for now, should be an rpc call for least request when it becomes available in etcdv3's api
+// leaseTtl returns the seconds the lease with id has left, the TTL of the keys
+// attached to it. It is 0 when that can't be found out.
+func (g *Backendv3) leaseTtl(id int64) uint32 {
+	resp, err := g.inflight.Do("lease/"+strconv.FormatInt(id, 10), func() (interface{}, error) {
+		return g.client.TimeToLive(g.ctx, etcdv3.LeaseID(id))
+	})
+	if err != nil {
+		return 0
+	}
+	if ttl := resp.(*etcdv3.LeaseTimeToLiveResponse).TTL; ttl > 0 {
+		return uint32(ttl)
+	}
+	return 0
+}
+
+// calculateTtl returns the smaller of the lease TTL and the service's TTL. If
+// neither of these are set (have a zero value), the server default is used.
+func (g *Backendv3) calculateTtl(etcdTtl uint32, serv *msg.Service) uint32 {
 
 	if etcdTtl == 0 && serv.Ttl == 0 {
 		return g.config.Ttl
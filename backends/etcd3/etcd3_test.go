@@ -0,0 +1,38 @@
+// Copyright (c) 2014 The SkyDNS Authors. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package etcd3
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/coreos/etcd/etcdserver/api/v3rpc/rpctypes"
+	"github.com/skynetservices/skydns/msg"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestBackendError(t *testing.T) {
+	tests := []struct {
+		err         error
+		unavailable bool
+	}{
+		{context.DeadlineExceeded, true},
+		{rpctypes.ErrNoLeader, true},
+		{rpctypes.ErrTimeout, true},
+		{status.Error(codes.Unavailable, "all SubConns are in TransientFailure"), true},
+		{status.Error(codes.DeadlineExceeded, "context deadline exceeded"), true},
+		{rpctypes.ErrPermissionDenied, false},
+		{status.Error(codes.InvalidArgument, "etcdserver: key is not provided"), false},
+		{errors.New("failure"), false},
+	}
+	for i, tc := range tests {
+		err := backendError(tc.err)
+		if _, ok := err.(*msg.UnavailableError); ok != tc.unavailable {
+			t.Errorf("test %d: expected unavailable %t for %q, got %T", i, tc.unavailable, tc.err, err)
+		}
+	}
+}
@@ -0,0 +1,510 @@
+// Copyright (c) 2014 The SkyDNS Authors. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+// Package file provides a SkyDNS server Backend that serves the records of RFC
+// 1035 zone files and the services in JSON files, for static zones and for
+// running without etcd. The files are checked for changes every fileReload and
+// read again when they changed.
+package file
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/skynetservices/skydns/msg"
+
+	"github.com/miekg/dns"
+)
+
+// fileReload is how often the files are checked for changes.
+const fileReload = 5 * time.Second
+
+// Config represents configuration for the file backend - Ttl and Priority should
+// be taken directly from server.Config.
+type Config struct {
+	Ttl      uint32
+	Priority uint16
+	// PathPrefix is the prefix of the keys of our services, defaults to
+	// msg.PathPrefix.
+	PathPrefix string
+	// Path is a file, or a directory of files, which are read in order. A file
+	// whose name ends in .json has services, other files are zone files.
+	Path string
+	// Origin is the origin of a zone file without $ORIGIN, and of the names in the
+	// JSON files that don't end in a dot.
+	Origin string
+}
+
+type Backend struct {
+	ctx    context.Context
+	config *Config
+
+	mu    sync.Mutex       // serializes load
+	files map[string]*file // by file name, protected by mu
+
+	sync.RWMutex
+	services map[string]entry // by etcd key
+	rev      uint64
+	watchers map[int]func(msg.Change)
+	watcher  int
+}
+
+// file is a file we read, and the services in it.
+type file struct {
+	mtime    time.Time
+	size     int64
+	services map[string]*msg.Service
+}
+
+// entry is a service from a file.
+type entry struct {
+	serv *msg.Service
+	mod  uint64 // the revision it was last changed at
+}
+
+// NewBackend returns a new Backend for SkyDNS, serving the services in the files
+// of config. The files are read before it returns, and checked for changes until
+// ctx is done.
+func NewBackend(ctx context.Context, config *Config) *Backend {
+	g := &Backend{
+		ctx:    ctx,
+		config: config,
+		files:  make(map[string]*file),
+		// The revision must not go back when we are restarted, see Revision.
+		rev:      uint64(time.Now().Unix()),
+		services: make(map[string]entry),
+		watchers: make(map[int]func(msg.Change)),
+	}
+	g.load()
+	go g.run()
+	return g
+}
+
+// HasSynced returns true, the files are read by NewBackend.
+func (g *Backend) HasSynced() bool {
+	return true
+}
+
+func (g *Backend) Records(name string, exact bool) ([]msg.Service, error) {
+	path, star := g.pathWithWildcard(name)
+	segments := strings.Split(g.path(name), "/")
+
+	g.RLock()
+	defer g.RUnlock()
+	if e, ok := g.services[path]; ok {
+		return g.loopEntries([]entry{e}, segments, false), nil
+	}
+	var keys []string
+	for key := range g.services {
+		if strings.HasPrefix(key, path+"/") {
+			keys = append(keys, key)
+		}
+	}
+	switch {
+	case len(keys) == 0:
+		return nil, msg.ErrNotFound
+	case exact:
+		return nil, nil
+	}
+	sort.Strings(keys)
+	es := make([]entry, len(keys))
+	for i, key := range keys {
+		es[i] = g.services[key]
+	}
+	return g.loopEntries(es, segments, star), nil
+}
+
+func (g *Backend) ReverseRecord(name string) (*msg.Service, error) {
+	path, star := g.pathWithWildcard(name)
+	if star {
+		return nil, fmt.Errorf("reverse can not contain wildcards")
+	}
+	g.RLock()
+	e, ok := g.services[path]
+	g.RUnlock()
+	if !ok {
+		return nil, msg.ErrNotFound
+	}
+	records := g.loopEntries([]entry{e}, nil, false)
+	return &records[0], nil
+}
+
+// Revision returns the revision of the services under name. Files have no
+// revisions, ours is the time we started plus the number of changes seen since
+// then.
+func (g *Backend) Revision(name string) (msg.Revision, error) {
+	path := g.path(name)
+	g.RLock()
+	defer g.RUnlock()
+	rev := msg.Revision{Current: g.rev}
+	for key, e := range g.services {
+		if key != path && !strings.HasPrefix(key, path+"/") {
+			continue
+		}
+		if e.mod > rev.Modified {
+			rev.Modified = e.mod
+		}
+		rev.Keys++
+	}
+	return rev, nil
+}
+
+// Watch calls f for every service added, changed or removed in the files, until
+// ctx is done.
+func (g *Backend) Watch(ctx context.Context, f func(msg.Change)) error {
+	g.Lock()
+	id := g.watcher
+	g.watcher++
+	g.watchers[id] = f
+	g.Unlock()
+
+	<-ctx.Done()
+
+	g.Lock()
+	delete(g.watchers, id)
+	g.Unlock()
+	return ctx.Err()
+}
+
+// run checks the files for changes every fileReload, until our ctx is done.
+func (g *Backend) run() {
+	tick := time.NewTicker(fileReload)
+	defer tick.Stop()
+	for {
+		select {
+		case <-tick.C:
+			g.load()
+		case <-g.ctx.Done():
+			return
+		}
+	}
+}
+
+// load reads the files that changed since they were last read, and updates the
+// services. A file that can't be read keeps the services it had, a file that is
+// gone has none.
+func (g *Backend) load() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	names, err := g.fileNames()
+	if err != nil {
+		log.Printf("skydns: file: failure to list %s: %s", g.config.Path, err)
+		return
+	}
+	files := make(map[string]*file, len(names))
+	changed := len(names) != len(g.files)
+	for _, name := range names {
+		old := g.files[name]
+		fi, err := os.Stat(name)
+		if err != nil {
+			log.Printf("skydns: file: failure to load %s: %s", name, err)
+			if old != nil {
+				files[name] = old
+			}
+			continue
+		}
+		if old != nil && old.mtime.Equal(fi.ModTime()) && old.size == fi.Size() {
+			files[name] = old
+			continue
+		}
+		services, err := g.parse(name)
+		if err != nil {
+			log.Printf("skydns: file: failure to load %s: %s", name, err)
+			if old != nil {
+				files[name] = old
+			}
+			continue
+		}
+		log.Printf("skydns: file: loaded %d services from %s", len(services), name)
+		files[name] = &file{mtime: fi.ModTime(), size: fi.Size(), services: services}
+		changed = true
+	}
+	if !changed {
+		return
+	}
+	g.files = files
+
+	// Later files win when they have services with the same key.
+	services := make(map[string]*msg.Service)
+	for _, name := range names {
+		if f, ok := files[name]; ok {
+			for key, serv := range f.services {
+				services[key] = serv
+			}
+		}
+	}
+	g.notify(g.replace(services))
+}
+
+// fileNames returns the names of our files, in order. The hidden files of a
+// directory and its backup files, ending in a tilde, are skipped.
+func (g *Backend) fileNames() ([]string, error) {
+	fi, err := os.Stat(g.config.Path)
+	if err != nil {
+		return nil, err
+	}
+	if !fi.IsDir() {
+		return []string{g.config.Path}, nil
+	}
+	fis, err := ioutil.ReadDir(g.config.Path)
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, fi := range fis {
+		if fi.IsDir() || strings.HasPrefix(fi.Name(), ".") || strings.HasSuffix(fi.Name(), "~") {
+			continue
+		}
+		names = append(names, filepath.Join(g.config.Path, fi.Name()))
+	}
+	return names, nil
+}
+
+// parse returns the services in the file name, by key. A name with a single
+// service has it in its own key, like a key in etcd, the services of a name with
+// more are in keys below it.
+func (g *Backend) parse(name string) (map[string]*msg.Service, error) {
+	b, err := ioutil.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	var names map[string][]*msg.Service
+	if strings.HasSuffix(name, ".json") {
+		names, err = g.parseJSON(b)
+	} else {
+		names, err = g.parseZone(b, name)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	services := make(map[string]*msg.Service)
+	for n, sx := range names {
+		key := g.path(n)
+		if len(sx) == 1 {
+			sx[0].Key = key
+			services[key] = sx[0]
+			continue
+		}
+		for _, serv := range sx {
+			// The same service gets the same key when the file is read again.
+			b, _ := json.Marshal(serv)
+			h := fnv.New64a()
+			h.Write(b)
+			serv.Key = fmt.Sprintf("%s/%016x", key, h.Sum64())
+			services[serv.Key] = serv
+		}
+	}
+	return services, nil
+}
+
+// parseJSON parses a JSON object of names and their service, or an array of
+// their services, with the same JSON as in etcd:
+//
+//	{"rails.production.east.skydns.local.": {"host": "service5.example.com"}}
+func (g *Backend) parseJSON(b []byte) (map[string][]*msg.Service, error) {
+	var values map[string]json.RawMessage
+	if err := json.Unmarshal(b, &values); err != nil {
+		return nil, err
+	}
+	names := make(map[string][]*msg.Service, len(values))
+	for n, v := range values {
+		n = g.absolute(n)
+		if _, ok := dns.IsDomainName(n); !ok {
+			return nil, fmt.Errorf("invalid name %q", n)
+		}
+		vs := []json.RawMessage{v}
+		if v = bytes.TrimSpace(v); len(v) > 0 && v[0] == '[' {
+			if err := json.Unmarshal(v, &vs); err != nil {
+				return nil, fmt.Errorf("%s: %s", n, err)
+			}
+		}
+		for _, v := range vs {
+			serv := new(msg.Service)
+			if err := msg.Decode(v, serv); err != nil {
+				return nil, fmt.Errorf("%s: %s", n, err)
+			}
+			names[n] = append(names[n], serv)
+		}
+	}
+	return names, nil
+}
+
+// parseZone parses a zone file. The SOA and NS records are left out, SkyDNS has
+// its own and delegations are stored under ns.dns, see Referral. A record that
+// can't be a service is skipped.
+func (g *Backend) parseZone(b []byte, name string) (map[string][]*msg.Service, error) {
+	var (
+		names = make(map[string][]*msg.Service)
+		err   error
+	)
+	// The tokens after an error are read too, so the parser stops.
+	for t := range dns.ParseZone(bytes.NewReader(b), g.absolute(""), name) {
+		if t.Error != nil {
+			if err == nil {
+				err = t.Error
+			}
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		var serv *msg.Service
+		switch r := t.RR.(type) {
+		case *dns.SOA, *dns.NS:
+			continue
+		case *dns.PTR:
+			serv = &msg.Service{Host: strings.TrimSuffix(r.Ptr, "."), Ttl: r.Hdr.Ttl}
+		default:
+			var err1 error
+			if serv, err1 = msg.FromRR(r); err1 != nil {
+				log.Printf("skydns: file: skipping %q in %s: %s", r, name, err1)
+				continue
+			}
+		}
+		n := strings.ToLower(t.RR.Header().Name)
+		names[n] = append(names[n], serv)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return names, nil
+}
+
+// absolute returns name below our origin, unless it ends in a dot.
+func (g *Backend) absolute(name string) string {
+	origin := dns.Fqdn(g.config.Origin)
+	switch {
+	case name == "" || name == "@":
+		return origin
+	case dns.IsFqdn(name):
+		return strings.ToLower(name)
+	case origin == ".":
+		return strings.ToLower(name) + "."
+	}
+	return strings.ToLower(name) + "." + origin
+}
+
+// replace replaces our services by services, it returns the changes.
+func (g *Backend) replace(services map[string]*msg.Service) []msg.Change {
+	g.Lock()
+	defer g.Unlock()
+	keys := make([]string, 0, len(services)+len(g.services))
+	for key := range services {
+		keys = append(keys, key)
+	}
+	for key := range g.services {
+		if _, ok := services[key]; !ok {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	var changes []msg.Change
+	for _, key := range keys {
+		serv := services[key]
+		old, ok := g.services[key]
+		c := msg.Change{Name: msg.Domain(key), Key: key, Service: serv}
+		switch {
+		case serv == nil:
+			c.Type = msg.Removed
+		case !ok:
+			c.Type = msg.Added
+		case !reflect.DeepEqual(old.serv, serv):
+			c.Type = msg.Changed
+		default:
+			continue
+		}
+		g.rev++
+		if serv == nil {
+			delete(g.services, key)
+		} else {
+			g.services[key] = entry{serv: serv, mod: g.rev}
+		}
+		changes = append(changes, c)
+	}
+	return changes
+}
+
+// notify calls the watchers with the changes. The lock must not be held, they
+// may look up services.
+func (g *Backend) notify(changes []msg.Change) {
+	if len(changes) == 0 {
+		return
+	}
+	g.RLock()
+	watchers := make([]func(msg.Change), 0, len(g.watchers))
+	for _, f := range g.watchers {
+		watchers = append(watchers, f)
+	}
+	g.RUnlock()
+	for _, c := range changes {
+		for _, f := range watchers {
+			f(c)
+		}
+	}
+}
+
+// loopEntries returns copies of the services in es. The keys will be matched
+// against the wildcards of nameParts when star is true. The read lock must be
+// held.
+func (g *Backend) loopEntries(es []entry, nameParts []string, star bool) []msg.Service {
+	sx := make([]msg.Service, 0, len(es))
+Entries:
+	for _, e := range es {
+		serv := *e.serv
+		if star {
+			keyParts := strings.Split(serv.Key, "/")
+			for i, n := range nameParts {
+				if i > len(keyParts)-1 {
+					// name is longer than key
+					continue Entries
+				}
+				if n == "*" || n == "any" {
+					continue
+				}
+				if keyParts[i] != n {
+					continue Entries
+				}
+			}
+		}
+		if serv.Ttl == 0 {
+			serv.Ttl = g.config.Ttl
+		}
+		if serv.Priority == 0 {
+			serv.Priority = int(g.config.Priority)
+		}
+		sx = append(sx, serv)
+	}
+	return sx
+}
+
+// path is msg.Path for our PathPrefix.
+func (g *Backend) path(name string) string {
+	if g.config.PathPrefix == "" {
+		return msg.Path(name)
+	}
+	return msg.PathIn(g.config.PathPrefix, name)
+}
+
+// pathWithWildcard is msg.PathWithWildcard for our PathPrefix.
+func (g *Backend) pathWithWildcard(name string) (string, bool) {
+	if g.config.PathPrefix == "" {
+		return msg.PathWithWildcard(name)
+	}
+	return msg.PathWithWildcardIn(g.config.PathPrefix, name)
+}
@@ -0,0 +1,126 @@
+// Copyright (c) 2014 The SkyDNS Authors. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package file
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/skynetservices/skydns/msg"
+)
+
+const testZone = `$ORIGIN skydns.test.
+$TTL 60
+@       IN SOA ns1 hostmaster 1 3600 600 86400 60
+        IN NS  ns1
+www     IN A     10.0.0.1
+        IN A     10.0.0.2
+        IN AAAA  ::1
+ftp     IN CNAME www
+_sip._udp IN SRV 10 20 5060 sip
+info    IN TXT   "hello" "world"
+host    IN HINFO "amd64" "linux"
+1.0.0.10.in-addr.arpa. IN PTR www.skydns.test.
+`
+
+func TestFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "skydns-file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	// Every content of a file has another size, a change may otherwise be missed
+	// within the resolution of the modification time.
+	write := func(name, content string) {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("skydns.test.zone", testZone)
+	write("services.json", `{
+		"db": {"host": "10.0.0.3", "port": 5432},
+		"rails.production.east": [{"host": "10.0.0.4"}, {"host": "10.0.0.5", "priority": 20}]
+	}`)
+	write(".hidden", "not a zone")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	g := NewBackend(ctx, &Config{Ttl: 3600, Priority: 10, Path: dir, Origin: "skydns.test."})
+
+	sx, err := g.Records("www.skydns.test.", false)
+	if err != nil || len(sx) != 3 {
+		t.Fatalf("expected the 3 addresses of www, got %v, %v", sx, err)
+	}
+	if sx[0].Ttl != 60 || sx[0].Priority != 10 {
+		t.Errorf("expected the TTL of the zone and the default priority, got %v", sx[0])
+	}
+	if sx, err := g.Records("ftp.skydns.test.", true); err != nil || len(sx) != 1 || sx[0].Host != "www.skydns.test" {
+		t.Errorf("expected the CNAME of ftp, got %v, %v", sx, err)
+	}
+	if sx, err := g.Records("_sip._udp.skydns.test.", true); err != nil || len(sx) != 1 || sx[0].Port != 5060 || sx[0].Weight != 20 {
+		t.Errorf("expected the SRV record of sip, got %v, %v", sx, err)
+	}
+	if sx, err := g.Records("info.skydns.test.", true); err != nil || len(sx) != 1 || sx[0].Text != "helloworld" {
+		t.Errorf("expected the TXT record of info, got %v, %v", sx, err)
+	}
+	if sx, err := g.Records("host.skydns.test.", true); err != nil || len(sx) != 1 || sx[0].Raw == "" {
+		t.Errorf("expected the raw HINFO record of host, got %v, %v", sx, err)
+	}
+	if serv, err := g.ReverseRecord("1.0.0.10.in-addr.arpa."); err != nil || serv.Host != "www.skydns.test" {
+		t.Errorf("expected the PTR record, got %v, %v", serv, err)
+	}
+	if sx, err := g.Records("db.skydns.test.", true); err != nil || len(sx) != 1 || sx[0].Port != 5432 || sx[0].Key != "/skydns/test/skydns/db" {
+		t.Errorf("expected the service db, got %v, %v", sx, err)
+	}
+	if sx, err := g.Records("east.skydns.test.", false); err != nil || len(sx) != 2 {
+		t.Errorf("expected the 2 services of rails, got %v, %v", sx, err)
+	}
+	if _, err := g.Records("ns1.skydns.test.", false); err != msg.ErrNotFound {
+		t.Errorf("expected the NS records to be left out, got %v", err)
+	}
+
+	changes := make(chan msg.Change, 10)
+	go g.Watch(ctx, func(c msg.Change) { changes <- c })
+	time.Sleep(10 * time.Millisecond)
+
+	write("services.json", `{"db": {"host": "10.0.0.6", "port": 5432}, "cache.": {"host": "10.0.0.7"}}`)
+	g.load()
+	got := make(map[string]int)
+	for len(changes) > 0 {
+		c := <-changes
+		if c.Type == msg.Removed {
+			got["removed"]++
+		} else {
+			got[string(c.Type)+" "+c.Name]++
+		}
+	}
+	if got["changed db.skydns.test."] != 1 || got["added cache."] != 1 || got["removed"] != 2 || len(got) != 3 {
+		t.Errorf("expected db to change, cache to be added and the 2 services of rails to be removed, got %v", got)
+	}
+	if sx, err := g.Records("db.skydns.test.", true); err != nil || len(sx) != 1 || sx[0].Host != "10.0.0.6" {
+		t.Errorf("expected the changed service db, got %v, %v", sx, err)
+	}
+	if _, err := g.Records("rails.production.east.skydns.test.", false); err != msg.ErrNotFound {
+		t.Errorf("expected rails to be removed, got %v", err)
+	}
+
+	write("services.json", `{"db": `)
+	g.load()
+	if sx, err := g.Records("db.skydns.test.", true); err != nil || len(sx) != 1 {
+		t.Errorf("expected a file that doesn't parse to keep its services, got %v, %v", sx, err)
+	}
+	os.Remove(filepath.Join(dir, "services.json"))
+	g.load()
+	if _, err := g.Records("db.skydns.test.", true); err != msg.ErrNotFound {
+		t.Errorf("expected the services of a removed file to be gone, got %v", err)
+	}
+	if rev, _ := g.Revision("skydns.test."); rev.Keys != 7 || rev.Modified == 0 {
+		t.Errorf("expected the revision of the services of the zone, got %+v", rev)
+	}
+}
@@ -0,0 +1,589 @@
+// Copyright (c) 2014 The SkyDNS Authors. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+// Package redis provides a SkyDNS server Backend that keeps the services stored
+// in Redis in memory. A service is the JSON of an etcd key in a string key named
+// <prefix>:<path>, e.g. skydns:local/skydns/east/production/rails for
+// /skydns/local/skydns/east/production/rails. Keyspace notifications tell it
+// which keys changed.
+package redis
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/skynetservices/skydns/msg"
+)
+
+// Config represents configuration for the Redis backend - Ttl and Priority
+// should be taken directly from server.Config.
+type Config struct {
+	Ttl      uint32
+	Priority uint16
+	// PathPrefix is the prefix of our keys, defaults to msg.PathPrefix.
+	PathPrefix string
+	// Addr is the address of Redis, defaults to 127.0.0.1:6379.
+	Addr string
+	// Password, to AUTH with.
+	Password string
+	// DB is the number of the database our keys are in.
+	DB int
+}
+
+// addr returns the address of Redis.
+func (c *Config) addr() string {
+	if c.Addr == "" {
+		return "127.0.0.1:6379"
+	}
+	return c.Addr
+}
+
+// redisRetry is how long we wait before connecting to Redis again, after the
+// connection that receives the keyspace notifications failed.
+const redisRetry = 5 * time.Second
+
+// loadBatch is the number of keys read from Redis at a time.
+const loadBatch = 100
+
+type Backend struct {
+	ctx    context.Context
+	config *Config
+	synced int32
+
+	sync.RWMutex
+	services map[string]entry // by etcd key
+	rev      uint64
+	watchers map[int]func(msg.Change)
+	watcher  int
+
+	mu   sync.Mutex // protects conn
+	conn *conn
+}
+
+// entry is a service stored in Redis.
+type entry struct {
+	serv    *msg.Service
+	expires time.Time // zero when the key has no TTL
+	mod     uint64    // the revision it was last changed at
+}
+
+// NewBackend returns a new Backend for SkyDNS, backed by Redis. It loads our keys
+// and then follows the changes to them, until ctx is done. Until the keys are
+// loaded it hasn't synced, and SkyDNS refuses queries.
+func NewBackend(ctx context.Context, config *Config) *Backend {
+	g := &Backend{
+		ctx:      ctx,
+		config:   config,
+		services: make(map[string]entry),
+		// The revision must not go back when we are restarted, see Revision.
+		rev:      uint64(time.Now().Unix()),
+		watchers: make(map[int]func(msg.Change)),
+	}
+	go g.run()
+	return g
+}
+
+func (g *Backend) HasSynced() bool {
+	return atomic.LoadInt32(&g.synced) == 1
+}
+
+func (g *Backend) Records(name string, exact bool) ([]msg.Service, error) {
+	path, star := g.pathWithWildcard(name)
+	segments := strings.Split(g.path(name), "/")
+	now := time.Now()
+
+	g.RLock()
+	defer g.RUnlock()
+	if e, ok := g.services[path]; ok {
+		return g.loopEntries([]entry{e}, segments, false, now), nil
+	}
+	var keys []string
+	for key := range g.services {
+		if strings.HasPrefix(key, path+"/") {
+			keys = append(keys, key)
+		}
+	}
+	switch {
+	case len(keys) == 0:
+		return nil, msg.ErrNotFound
+	case exact:
+		return nil, nil
+	}
+	sort.Strings(keys)
+	es := make([]entry, len(keys))
+	for i, key := range keys {
+		es[i] = g.services[key]
+	}
+	return g.loopEntries(es, segments, star, now), nil
+}
+
+func (g *Backend) ReverseRecord(name string) (*msg.Service, error) {
+	path, star := g.pathWithWildcard(name)
+	if star {
+		return nil, fmt.Errorf("reverse can not contain wildcards")
+	}
+	g.RLock()
+	e, ok := g.services[path]
+	g.RUnlock()
+	if !ok {
+		return nil, msg.ErrNotFound
+	}
+	records := g.loopEntries([]entry{e}, nil, false, time.Now())
+	return &records[0], nil
+}
+
+// Revision returns the revision of the keys under name. Redis has no revisions,
+// ours is the time we started plus the number of changes seen since then.
+func (g *Backend) Revision(name string) (msg.Revision, error) {
+	path := g.path(name)
+	g.RLock()
+	defer g.RUnlock()
+	rev := msg.Revision{Current: g.rev}
+	for key, e := range g.services {
+		if key != path && !strings.HasPrefix(key, path+"/") {
+			continue
+		}
+		if e.mod > rev.Modified {
+			rev.Modified = e.mod
+		}
+		rev.Keys++
+	}
+	return rev, nil
+}
+
+// Put stores serv under name, in a key of its own named id. A service that is
+// only served until some time gets a key that expires then.
+func (g *Backend) Put(name, id string, serv *msg.Service) error {
+	b, err := json.Marshal(serv)
+	if err != nil {
+		return err
+	}
+	args := []string{"SET", g.redisKey(g.path(name) + "/" + id), string(b)}
+	if until := serv.Until(); until != nil {
+		ms := int64(time.Until(*until)/time.Millisecond) + 1
+		if ms < 1 {
+			ms = 1
+		}
+		args = append(args, "PX", strconv.FormatInt(ms, 10))
+	}
+	_, err = g.do(args...)
+	return err
+}
+
+// Delete removes the service stored at key, the Key of a service.
+func (g *Backend) Delete(key string) error {
+	_, err := g.do("DEL", g.redisKey(key))
+	return err
+}
+
+// Value returns the value of key, such as /skydns/config.
+func (g *Backend) Value(key string) ([]byte, error) {
+	r, err := g.do("GET", g.redisKey(key))
+	if err != nil {
+		return nil, err
+	}
+	if r == nil {
+		return nil, msg.ErrNotFound
+	}
+	return []byte(str(r)), nil
+}
+
+// Watch calls f for every service added, changed or removed under our root,
+// until ctx is done. The changes are those of the keyspace notifications, and
+// those found when we load our keys again after the connection to Redis failed.
+func (g *Backend) Watch(ctx context.Context, f func(msg.Change)) error {
+	g.Lock()
+	id := g.watcher
+	g.watcher++
+	g.watchers[id] = f
+	g.Unlock()
+
+	<-ctx.Done()
+
+	g.Lock()
+	delete(g.watchers, id)
+	g.Unlock()
+	return ctx.Err()
+}
+
+// run follows the changes to our keys, connecting again when the connection
+// fails, until our ctx is done.
+func (g *Backend) run() {
+	for {
+		err := g.follow()
+		if g.ctx.Err() != nil {
+			return
+		}
+		log.Printf("skydns: redis: following the changes to the keys %s failed, retrying in %s: %s", g.redisKey(g.root())+"*", redisRetry, err)
+		select {
+		case <-time.After(redisRetry):
+		case <-g.ctx.Done():
+			return
+		}
+	}
+}
+
+// follow subscribes to the keyspace notifications of our keys, loads them, and
+// then updates the services for every notification until the connection fails.
+// The notifications of the changes during the load are queued, so none are
+// lost.
+func (g *Backend) follow() error {
+	sub, err := dial(g.ctx, g.config)
+	if err != nil {
+		return err
+	}
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-g.ctx.Done():
+		case <-done:
+		}
+		sub.Close()
+	}()
+
+	channel := "__keyspace@" + strconv.Itoa(g.config.DB) + "__:"
+	if _, err := sub.do("PSUBSCRIBE", channel+g.redisKey(g.root())+"*"); err != nil {
+		return err
+	}
+	g.checkNotifications()
+	services, err := g.load()
+	if err != nil {
+		return err
+	}
+	g.replace(services)
+	atomic.StoreInt32(&g.synced, 1)
+
+	for {
+		r, err := sub.receive()
+		if err != nil {
+			return err
+		}
+		// A pmessage is the pattern, the channel of the key and the event.
+		a, ok := r.([]interface{})
+		if !ok || len(a) != 4 || str(a[0]) != "pmessage" {
+			continue
+		}
+		key := g.etcdKey(strings.TrimPrefix(str(a[2]), channel))
+		if err := g.reload(key); err != nil {
+			return err
+		}
+	}
+}
+
+// checkNotifications logs a warning when Redis doesn't send the keyspace
+// notifications we need: K (keyspace) and $ (string commands) or A (all), g
+// (DEL, EXPIRE) and x (expired).
+func (g *Backend) checkNotifications() {
+	r, err := g.do("CONFIG", "GET", "notify-keyspace-events")
+	if err != nil {
+		// CONFIG may be disabled, as it is in managed Redis.
+		return
+	}
+	a, ok := r.([]interface{})
+	if !ok || len(a) != 2 {
+		return
+	}
+	flags := str(a[1])
+	if !strings.Contains(flags, "K") || !(strings.Contains(flags, "A") || strings.Contains(flags, "$") && strings.Contains(flags, "g") && strings.Contains(flags, "x")) {
+		log.Printf("skydns: redis: notify-keyspace-events is %q, changes are not seen without \"K$gx\"", flags)
+	}
+}
+
+// load reads all our keys.
+func (g *Backend) load() (map[string]entry, error) {
+	var keys []string
+	cursor := "0"
+	for {
+		r, err := g.do("SCAN", cursor, "MATCH", g.redisKey(g.root())+"*", "COUNT", "1000")
+		if err != nil {
+			return nil, err
+		}
+		a, ok := r.([]interface{})
+		if !ok || len(a) != 2 {
+			return nil, errProtocol
+		}
+		batch, _ := a[1].([]interface{})
+		for _, k := range batch {
+			keys = append(keys, str(k))
+		}
+		if cursor = str(a[0]); cursor == "0" {
+			break
+		}
+	}
+
+	services := make(map[string]entry, len(keys))
+	for i := 0; i < len(keys); i += loadBatch {
+		batch := keys[i:]
+		if len(batch) > loadBatch {
+			batch = batch[:loadBatch]
+		}
+		es, err := g.get(batch)
+		if err != nil {
+			return nil, err
+		}
+		for j, e := range es {
+			if e.serv != nil {
+				services[g.etcdKey(batch[j])] = e
+			}
+		}
+	}
+	return services, nil
+}
+
+// get reads the services of the keys, and their TTLs. The service of a key that
+// doesn't exist, or isn't a service, is nil.
+func (g *Backend) get(keys []string) ([]entry, error) {
+	cmds := make([][]string, 0, 2*len(keys))
+	for _, k := range keys {
+		cmds = append(cmds, []string{"GET", k}, []string{"PTTL", k})
+	}
+	replies, err := g.pipeline(cmds)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	es := make([]entry, len(keys))
+	for i, k := range keys {
+		b, ok := replies[2*i].([]byte)
+		if !ok {
+			// Not found, or not a string.
+			continue
+		}
+		serv := new(msg.Service)
+		if err := msg.Decode(b, serv); err != nil {
+			continue
+		}
+		serv.Key = g.etcdKey(k)
+		es[i].serv = serv
+		if ms, ok := replies[2*i+1].(int64); ok && ms > 0 {
+			es[i].expires = now.Add(time.Duration(ms) * time.Millisecond)
+		}
+	}
+	return es, nil
+}
+
+// reload reads key again after a notification for it.
+func (g *Backend) reload(key string) error {
+	if key == g.root()+"/config" {
+		return nil
+	}
+	es, err := g.get([]string{g.redisKey(key)})
+	if err != nil {
+		return err
+	}
+	g.Lock()
+	c, ok := g.apply(key, es[0])
+	g.Unlock()
+	if ok {
+		g.notify([]msg.Change{c})
+	}
+	return nil
+}
+
+// replace replaces all services by those loaded, the differences are changes.
+// Those of the first load aren't, like the other backends we watch from the
+// services there are when we start.
+func (g *Backend) replace(services map[string]entry) {
+	var changes []msg.Change
+	if g.HasSynced() {
+		defer func() { g.notify(changes) }()
+	}
+	g.Lock()
+	defer g.Unlock()
+	keys := make([]string, 0, len(services)+len(g.services))
+	for key := range services {
+		keys = append(keys, key)
+	}
+	for key := range g.services {
+		if _, ok := services[key]; !ok {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		if key == g.root()+"/config" {
+			continue
+		}
+		if c, ok := g.apply(key, services[key]); ok {
+			changes = append(changes, c)
+		}
+	}
+}
+
+// apply updates the service at key to that of e, nil when it is removed. It
+// returns the change, if there is one. The lock must be held.
+func (g *Backend) apply(key string, e entry) (msg.Change, bool) {
+	old, ok := g.services[key]
+	c := msg.Change{Name: msg.Domain(key), Key: key, Service: e.serv}
+	switch {
+	case e.serv == nil && !ok:
+		return c, false
+	case e.serv == nil:
+		c.Type = msg.Removed
+	case !ok:
+		c.Type = msg.Added
+	case !reflect.DeepEqual(old.serv, e.serv):
+		c.Type = msg.Changed
+	default:
+		// Only the TTL of the key changed, if anything.
+		old.expires = e.expires
+		g.services[key] = old
+		return c, false
+	}
+	g.rev++
+	if e.serv == nil {
+		delete(g.services, key)
+	} else {
+		e.mod = g.rev
+		g.services[key] = e
+	}
+	return c, true
+}
+
+// notify calls the watchers with the changes. The lock must not be held, they
+// may look up services.
+func (g *Backend) notify(changes []msg.Change) {
+	if len(changes) == 0 {
+		return
+	}
+	g.RLock()
+	watchers := make([]func(msg.Change), 0, len(g.watchers))
+	for _, f := range g.watchers {
+		watchers = append(watchers, f)
+	}
+	g.RUnlock()
+	for _, c := range changes {
+		for _, f := range watchers {
+			f(c)
+		}
+	}
+}
+
+// loopEntries returns copies of the services in es. The keys will be matched
+// against the wildcards of nameParts when star is true. The TTL of a service
+// whose key expires is at most the time it has left. The read lock must be
+// held.
+func (g *Backend) loopEntries(es []entry, nameParts []string, star bool, now time.Time) []msg.Service {
+	sx := make([]msg.Service, 0, len(es))
+Entries:
+	for _, e := range es {
+		serv := *e.serv
+		if star {
+			keyParts := strings.Split(serv.Key, "/")
+			for i, n := range nameParts {
+				if i > len(keyParts)-1 {
+					// name is longer than key
+					continue Entries
+				}
+				if n == "*" || n == "any" {
+					continue
+				}
+				if keyParts[i] != n {
+					continue Entries
+				}
+			}
+		}
+		if serv.Ttl == 0 {
+			serv.Ttl = g.config.Ttl
+		}
+		if !e.expires.IsZero() {
+			serv.CapTtl(uint32(e.expires.Sub(now)/time.Second) + 1)
+		}
+		if serv.Priority == 0 {
+			serv.Priority = int(g.config.Priority)
+		}
+		sx = append(sx, serv)
+	}
+	return sx
+}
+
+// root returns the etcd key our data is stored under.
+func (g *Backend) root() string {
+	if g.config.PathPrefix == "" {
+		return "/" + msg.PathPrefix
+	}
+	return "/" + g.config.PathPrefix
+}
+
+// path is msg.Path for our PathPrefix.
+func (g *Backend) path(name string) string {
+	if g.config.PathPrefix == "" {
+		return msg.Path(name)
+	}
+	return msg.PathIn(g.config.PathPrefix, name)
+}
+
+// pathWithWildcard is msg.PathWithWildcard for our PathPrefix.
+func (g *Backend) pathWithWildcard(name string) (string, bool) {
+	if g.config.PathPrefix == "" {
+		return msg.PathWithWildcard(name)
+	}
+	return msg.PathWithWildcardIn(g.config.PathPrefix, name)
+}
+
+// redisKey returns the Redis key of the etcd key: /skydns/local/skydns/a is
+// skydns:local/skydns/a.
+func (g *Backend) redisKey(key string) string {
+	key = strings.TrimPrefix(key, "/")
+	if i := strings.IndexByte(key, '/'); i >= 0 {
+		return key[:i] + ":" + key[i+1:]
+	}
+	return key + ":"
+}
+
+// etcdKey is the opposite of redisKey.
+func (g *Backend) etcdKey(key string) string {
+	return "/" + strings.Replace(key, ":", "/", 1)
+}
+
+// do sends a command on our connection for commands, connecting first when it
+// is not there or failed before.
+func (g *Backend) do(args ...string) (interface{}, error) {
+	var r interface{}
+	err := g.withConn(func(c *conn) (err error) {
+		r, err = c.do(args...)
+		return err
+	})
+	return r, err
+}
+
+// pipeline is do for several commands.
+func (g *Backend) pipeline(cmds [][]string) ([]interface{}, error) {
+	var replies []interface{}
+	err := g.withConn(func(c *conn) (err error) {
+		replies, err = c.pipeline(cmds)
+		return err
+	})
+	return replies, err
+}
+
+func (g *Backend) withConn(f func(*conn) error) error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.conn == nil {
+		c, err := dial(g.ctx, g.config)
+		if err != nil {
+			return &msg.UnavailableError{Err: err}
+		}
+		g.conn = c
+	}
+	err := f(g.conn)
+	if _, ok := err.(Error); err != nil && !ok {
+		// The connection is broken, not the command.
+		g.conn.Close()
+		g.conn = nil
+		return &msg.UnavailableError{Err: err}
+	}
+	return err
+}
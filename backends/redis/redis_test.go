@@ -0,0 +1,210 @@
+// Copyright (c) 2014 The SkyDNS Authors. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package redis
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/skynetservices/skydns/msg"
+)
+
+// fakeRedis serves the commands the backend uses from a map of string keys, and
+// sends keyspace notifications for SET and DEL to its subscribers.
+type fakeRedis struct {
+	net.Listener
+
+	sync.Mutex
+	keys        map[string]string
+	subscribers []*bufio.Writer
+}
+
+func newFakeRedis(t *testing.T, keys map[string]string) *fakeRedis {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := &fakeRedis{Listener: l, keys: keys}
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go f.serve(c)
+		}
+	}()
+	return f
+}
+
+func (f *fakeRedis) serve(nc net.Conn) {
+	defer nc.Close()
+	c := &conn{Conn: nc, r: bufio.NewReader(nc), w: bufio.NewWriter(nc)}
+	authed := false
+	for {
+		r, err := c.receive()
+		if err != nil {
+			return
+		}
+		a, _ := r.([]interface{})
+		args := make([]string, len(a))
+		for i := range a {
+			args[i] = str(a[i])
+		}
+		f.Lock()
+		switch cmd := strings.ToUpper(args[0]); {
+		case cmd == "AUTH":
+			authed = args[1] == "secret"
+			fmt.Fprint(c.w, "+OK\r\n")
+		case !authed:
+			fmt.Fprint(c.w, "-NOAUTH Authentication required.\r\n")
+		case cmd == "SELECT":
+			fmt.Fprint(c.w, "+OK\r\n")
+		case cmd == "PSUBSCRIBE":
+			writeArray(c.w, "psubscribe", args[1], 1)
+			f.subscribers = append(f.subscribers, c.w)
+		case cmd == "CONFIG":
+			writeArray(c.w, "notify-keyspace-events", "K$gx")
+		case cmd == "SCAN":
+			var keys []interface{}
+			for k := range f.keys {
+				if strings.HasPrefix(k, strings.TrimSuffix(args[3], "*")) {
+					keys = append(keys, k)
+				}
+			}
+			writeArray(c.w, "0", keys)
+		case cmd == "GET":
+			if v, ok := f.keys[args[1]]; ok {
+				fmt.Fprintf(c.w, "$%d\r\n%s\r\n", len(v), v)
+			} else {
+				fmt.Fprint(c.w, "$-1\r\n")
+			}
+		case cmd == "PTTL":
+			fmt.Fprint(c.w, ":-1\r\n")
+		case cmd == "SET":
+			f.keys[args[1]] = args[2]
+			fmt.Fprint(c.w, "+OK\r\n")
+			f.notify(args[1], "set")
+		case cmd == "DEL":
+			delete(f.keys, args[1])
+			fmt.Fprint(c.w, ":1\r\n")
+			f.notify(args[1], "del")
+		default:
+			fmt.Fprintf(c.w, "-ERR unknown command '%s'\r\n", args[0])
+		}
+		c.w.Flush()
+		f.Unlock()
+	}
+}
+
+// notify sends the keyspace notification of event for key. The lock must be
+// held.
+func (f *fakeRedis) notify(key, event string) {
+	for _, w := range f.subscribers {
+		writeArray(w, "pmessage", "__keyspace@0__:skydns:*", "__keyspace@0__:"+key, event)
+		w.Flush()
+	}
+}
+
+func writeArray(w *bufio.Writer, a ...interface{}) {
+	fmt.Fprintf(w, "*%d\r\n", len(a))
+	for _, v := range a {
+		switch v := v.(type) {
+		case string:
+			fmt.Fprintf(w, "$%d\r\n%s\r\n", len(v), v)
+		case int:
+			fmt.Fprintf(w, ":%s\r\n", strconv.Itoa(v))
+		case []interface{}:
+			writeArray(w, v...)
+		}
+	}
+}
+
+func TestRedis(t *testing.T) {
+	f := newFakeRedis(t, map[string]string{
+		"skydns:test/skydns/www/1": `{"host": "10.0.0.1"}`,
+		"skydns:test/skydns/www/2": `{"host": "10.0.0.2", "ttl": 60}`,
+		"skydns:test/skydns/db":    `{"host": "10.0.0.3"}`,
+		"skydns:config":            `{"domain": "skydns.test."}`,
+		"other:test/skydns/www/3":  `{"host": "10.0.0.4"}`,
+	})
+	defer f.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	g := NewBackend(ctx, &Config{Ttl: 3600, Priority: 10, Addr: f.Addr().String(), Password: "secret"})
+
+	changes := make(chan msg.Change, 10)
+	go g.Watch(ctx, func(c msg.Change) { changes <- c })
+	for i := 0; !g.HasSynced(); i++ {
+		if i == 100 {
+			t.Fatal("expected the backend to sync")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	sx, err := g.Records("www.skydns.test.", false)
+	if err != nil || len(sx) != 2 {
+		t.Fatalf("expected the 2 services of www, got %v, %v", sx, err)
+	}
+	if sx[0].Key != "/skydns/test/skydns/www/1" || sx[0].Ttl != 3600 || sx[0].Priority != 10 || sx[1].Ttl != 60 {
+		t.Errorf("expected the defaults for the services of www, got %v", sx)
+	}
+	if sx, err := g.Records("www.skydns.test.", true); err != nil || len(sx) != 0 {
+		t.Errorf("expected no services for the directory www, got %v, %v", sx, err)
+	}
+	if sx, err := g.Records("*.skydns.test.", false); err != nil || len(sx) != 3 {
+		t.Errorf("expected the 3 services of the domain, got %v, %v", sx, err)
+	}
+	if _, err := g.Records("nope.skydns.test.", false); err != msg.ErrNotFound {
+		t.Errorf("expected msg.ErrNotFound, got %v", err)
+	}
+	if b, err := g.Value("/skydns/config"); err != nil || string(b) != `{"domain": "skydns.test."}` {
+		t.Errorf("expected the config, got %s, %v", b, err)
+	}
+
+	wait := func(typ msg.ChangeType, name string) {
+		select {
+		case c := <-changes:
+			if c.Type != typ || c.Name != name {
+				t.Errorf("expected %s %s, got %s %s", typ, name, c.Type, c.Name)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("expected %s %s", typ, name)
+		}
+	}
+	if err := g.Put("www.skydns.test.", "3", &msg.Service{Host: "10.0.0.5"}); err != nil {
+		t.Fatal(err)
+	}
+	wait(msg.Added, "3.www.skydns.test.")
+	if sx, err := g.Records("3.www.skydns.test.", true); err != nil || len(sx) != 1 || sx[0].Host != "10.0.0.5" {
+		t.Errorf("expected the new service, got %v, %v", sx, err)
+	}
+	if err := g.Delete("/skydns/test/skydns/db"); err != nil {
+		t.Fatal(err)
+	}
+	wait(msg.Removed, "db.skydns.test.")
+	if _, err := g.Records("db.skydns.test.", false); err != msg.ErrNotFound {
+		t.Errorf("expected msg.ErrNotFound for the removed service, got %v", err)
+	}
+	if rev, _ := g.Revision("www.skydns.test."); rev.Keys != 3 || rev.Modified == 0 || rev.Modified > rev.Current {
+		t.Errorf("expected the revision of the 3 services of www, got %+v", rev)
+	}
+
+	g.config.Password = "wrong"
+	g.mu.Lock()
+	g.conn.Close()
+	g.conn = nil
+	g.mu.Unlock()
+	if _, err := g.Value("/skydns/config"); err == nil || err == msg.ErrNotFound {
+		t.Errorf("expected an error with the wrong password, got %v", err)
+	}
+}
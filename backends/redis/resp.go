@@ -0,0 +1,164 @@
+// Copyright (c) 2014 The SkyDNS Authors. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package redis
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"time"
+)
+
+// dialTimeout is how long connecting to Redis may take.
+const dialTimeout = 5 * time.Second
+
+// Error is an error reply of Redis.
+type Error string
+
+func (e Error) Error() string { return string(e) }
+
+var errProtocol = errors.New("redis: invalid reply")
+
+// conn is a connection to Redis, speaking RESP. Replies are a string (simple
+// strings), an int64, a []byte or nil (bulk strings), an []interface{} (arrays)
+// or an Error.
+type conn struct {
+	net.Conn
+	r *bufio.Reader
+	w *bufio.Writer
+}
+
+// dial connects to the Redis of config, authenticates and selects its database.
+func dial(ctx context.Context, config *Config) (*conn, error) {
+	d := net.Dialer{Timeout: dialTimeout}
+	nc, err := d.DialContext(ctx, "tcp", config.addr())
+	if err != nil {
+		return nil, err
+	}
+	c := &conn{Conn: nc, r: bufio.NewReader(nc), w: bufio.NewWriter(nc)}
+	if config.Password != "" {
+		if _, err := c.do("AUTH", config.Password); err != nil {
+			c.Close()
+			return nil, err
+		}
+	}
+	if config.DB != 0 {
+		if _, err := c.do("SELECT", strconv.Itoa(config.DB)); err != nil {
+			c.Close()
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// do sends a command and returns its reply. An error reply is returned as the
+// error.
+func (c *conn) do(args ...string) (interface{}, error) {
+	c.send(args...)
+	if err := c.w.Flush(); err != nil {
+		return nil, err
+	}
+	r, err := c.receive()
+	if err != nil {
+		return nil, err
+	}
+	if e, ok := r.(Error); ok {
+		return nil, e
+	}
+	return r, nil
+}
+
+// send buffers a command, flushing the buffer sends it. Several commands may be
+// sent before their replies are received, see pipeline.
+func (c *conn) send(args ...string) {
+	fmt.Fprintf(c.w, "*%d\r\n", len(args))
+	for _, a := range args {
+		fmt.Fprintf(c.w, "$%d\r\n%s\r\n", len(a), a)
+	}
+}
+
+// pipeline sends the commands and returns their replies, error replies
+// included.
+func (c *conn) pipeline(cmds [][]string) ([]interface{}, error) {
+	for _, cmd := range cmds {
+		c.send(cmd...)
+	}
+	if err := c.w.Flush(); err != nil {
+		return nil, err
+	}
+	replies := make([]interface{}, len(cmds))
+	for i := range cmds {
+		r, err := c.receive()
+		if err != nil {
+			return nil, err
+		}
+		replies[i] = r
+	}
+	return replies, nil
+}
+
+// receive reads a reply.
+func (c *conn) receive() (interface{}, error) {
+	line, err := c.r.ReadSlice('\n')
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 3 || line[len(line)-2] != '\r' {
+		return nil, errProtocol
+	}
+	kind, rest := line[0], string(line[1:len(line)-2])
+	switch kind {
+	case '+':
+		return rest, nil
+	case '-':
+		return Error(rest), nil
+	case ':':
+		return strconv.ParseInt(rest, 10, 64)
+	case '$':
+		n, err := strconv.Atoi(rest)
+		if err != nil || n < -1 {
+			return nil, errProtocol
+		}
+		if n == -1 {
+			return nil, nil
+		}
+		b := make([]byte, n+2)
+		if _, err := io.ReadFull(c.r, b); err != nil {
+			return nil, err
+		}
+		return b[:n], nil
+	case '*':
+		n, err := strconv.Atoi(rest)
+		if err != nil || n < -1 {
+			return nil, errProtocol
+		}
+		if n == -1 {
+			return nil, nil
+		}
+		a := make([]interface{}, n)
+		for i := range a {
+			if a[i], err = c.receive(); err != nil {
+				return nil, err
+			}
+		}
+		return a, nil
+	}
+	return nil, errProtocol
+}
+
+// str returns the reply r as a string, for simple and bulk strings.
+func str(r interface{}) string {
+	switch r := r.(type) {
+	case string:
+		return r
+	case []byte:
+		return string(r)
+	}
+	return ""
+}
@@ -11,6 +11,8 @@ package cache
 
 import (
 	"crypto/sha1"
+	"hash/fnv"
+	"strings"
 	"sync"
 	"time"
 
@@ -24,43 +26,108 @@ type elem struct {
 	msg        *dns.Msg
 }
 
-// Cache is a cache that holds on the a number of RRs or DNS messages. The cache
-// eviction is randomized.
-type Cache struct {
+// shard is a part of the cache with its own lock, members and capacity.
+type shard struct {
 	sync.RWMutex
 
 	capacity int
 	m        map[string]*elem
+}
+
+// Cache is a cache that holds on the a number of RRs or DNS messages. The cache
+// eviction is randomized. The cache is split in shards, each with their own lock,
+// a key always ends up in the same shard.
+type Cache struct {
+	capacity int
+	shards   []*shard
 	ttl      time.Duration
 }
 
 // New returns a new cache with the capacity and the ttl specified.
 func New(capacity, ttl int) *Cache {
+	return NewSharded(capacity, ttl, 1)
+}
+
+// NewSharded returns a new cache with the capacity and the ttl specified. The
+// cache is split into n shards, each holding (about) capacity/n elements, and
+// together exactly capacity.
+func NewSharded(capacity, ttl, n int) *Cache {
+	if n < 1 {
+		n = 1
+	}
 	c := new(Cache)
-	c.m = make(map[string]*elem)
 	c.capacity = capacity
 	c.ttl = time.Duration(ttl) * time.Second
+	c.shards = make([]*shard, n)
+	for i := range c.shards {
+		sc := capacity / n
+		if i < capacity%n {
+			sc++
+		}
+		c.shards[i] = &shard{capacity: sc, m: make(map[string]*elem)}
+	}
 	return c
 }
 
 func (c *Cache) Capacity() int { return c.capacity }
 
+// Shards returns the number of shards in the cache.
+func (c *Cache) Shards() int { return len(c.shards) }
+
+// shard returns the shard responsible for key s.
+func (c *Cache) shard(s string) *shard {
+	if len(c.shards) == 1 {
+		return c.shards[0]
+	}
+	h := fnv.New32a()
+	h.Write([]byte(s))
+	return c.shards[h.Sum32()%uint32(len(c.shards))]
+}
+
 func (c *Cache) Remove(s string) {
-	c.Lock()
-	delete(c.m, s)
-	c.Unlock()
+	sh := c.shard(s)
+	sh.Lock()
+	delete(sh.m, s)
+	sh.Unlock()
 }
 
-// EvictRandom removes a random member a the cache.
-// Must be called under a write lock.
+// RemoveFunc removes the messages for which f returns true and returns how many
+// were removed.
+func (c *Cache) RemoveFunc(f func(*dns.Msg) bool) int {
+	n := 0
+	for _, sh := range c.shards {
+		sh.Lock()
+		for k, e := range sh.m {
+			if f(e.msg) {
+				delete(sh.m, k)
+				n++
+			}
+		}
+		sh.Unlock()
+	}
+	return n
+}
+
+// EvictRandom removes random members of the cache until every shard is within
+// its capacity. It takes the lock of each shard itself.
 func (c *Cache) EvictRandom() {
-	clen := len(c.m)
-	if clen <= c.capacity {
+	for _, sh := range c.shards {
+		sh.Lock()
+		sh.evictRandom()
+		sh.Unlock()
+	}
+}
+
+// evictRandom removes random members of the shard until it is within its capacity.
+// Must be called under a write lock.
+func (sh *shard) evictRandom() {
+	clen := len(sh.m)
+	if clen <= sh.capacity {
 		return
 	}
-	i := clen - c.capacity
-	for k, _ := range c.m {
-		delete(c.m, k)
+	i := clen - sh.capacity
+	for k := range sh.m {
+		delete(sh.m, k)
 		i--
 		if i == 0 {
 			break
@@ -75,13 +142,14 @@ func (c *Cache) InsertMessage(s string, msg *dns.Msg) {
 		return
 	}
 
-	c.Lock()
-	if _, ok := c.m[s]; !ok {
-		c.m[s] = &elem{time.Now().UTC().Add(c.ttl), msg.Copy()}
+	sh := c.shard(s)
+	sh.Lock()
+	if _, ok := sh.m[s]; !ok {
+		sh.m[s] = &elem{time.Now().UTC().Add(c.ttl), msg.Copy()}
 
 	}
-	c.EvictRandom()
-	c.Unlock()
+	sh.evictRandom()
+	sh.Unlock()
 }
 
 // InsertSignature inserts a signature, the expiration time is used as the cache ttl.
@@ -89,18 +157,19 @@ func (c *Cache) InsertSignature(s string, sig *dns.RRSIG) {
 	if c.capacity <= 0 {
 		return
 	}
-	c.Lock()
+	sh := c.shard(s)
+	sh.Lock()
 
-	if _, ok := c.m[s]; !ok {
+	if _, ok := sh.m[s]; !ok {
 		m := ((int64(sig.Expiration) - time.Now().Unix()) / (1 << 31)) - 1
 		if m < 0 {
 			m = 0
 		}
 		t := time.Unix(int64(sig.Expiration)-(m*(1<<31)), 0).UTC()
-		c.m[s] = &elem{t, &dns.Msg{Answer: []dns.RR{dns.Copy(sig)}}}
+		sh.m[s] = &elem{t, &dns.Msg{Answer: []dns.RR{dns.Copy(sig)}}}
 	}
-	c.EvictRandom()
-	c.Unlock()
+	sh.evictRandom()
+	sh.Unlock()
 }
 
 // Search returns a dns.Msg, the expiration time and a boolean indicating if we found something
@@ -109,21 +178,23 @@ func (c *Cache) Search(s string) (*dns.Msg, time.Time, bool) {
 	if c.capacity <= 0 {
 		return nil, time.Time{}, false
 	}
-	c.RLock()
-	if e, ok := c.m[s]; ok {
+	sh := c.shard(s)
+	sh.RLock()
+	if e, ok := sh.m[s]; ok {
 		e1 := e.msg.Copy()
-		c.RUnlock()
+		sh.RUnlock()
 		return e1, e.expiration, true
 	}
-	c.RUnlock()
+	sh.RUnlock()
 	return nil, time.Time{}, false
 }
 
 // Key creates a hash key from a question section. It creates a different key
-// for requests with DNSSEC.
+// for requests with DNSSEC. The name is lowercased, so queries differing only
+// in case share an entry.
 func Key(q dns.Question, dnssec, tcp bool) string {
 	h := sha1.New()
-	i := append([]byte(q.Name), packUint16(q.Qtype)...)
+	i := append([]byte(strings.ToLower(q.Name)), packUint16(q.Qtype)...)
 	if dnssec {
 		i = append(i, byte(255))
 	}
@@ -133,35 +204,32 @@ func Key(q dns.Question, dnssec, tcp bool) string {
 	return string(h.Sum(i))
 }
 
-// Key uses the name, type and rdata, which is serialized and then hashed as the key for the lookup.
+// KeySubnet is Key for a message that only holds for the clients in subnet, the
+// network of an EDNS Client Subnet option (RFC 7871), e.g. "192.0.2.0/24".
+func KeySubnet(q dns.Question, dnssec, tcp bool, subnet string) string {
+	return Key(q, dnssec, tcp) + "/" + subnet
+}
+
+// KeyRRset uses the name, type and rdata of every RR, which is packed and then
+// hashed as the key for the lookup. The TTL is left out, it is the same for the
+// RRs of a set, and a signature holds its original TTL.
 func KeyRRset(rrs []dns.RR) string {
 	h := sha1.New()
 	i := []byte(rrs[0].Header().Name)
 	i = append(i, packUint16(rrs[0].Header().Rrtype)...)
 	for _, r := range rrs {
-		switch t := r.(type) { // we only do a few type, serialize these manually
-		case *dns.SOA:
-			// We only fiddle with the serial so store that.
-			i = append(i, packUint32(t.Serial)...)
-		case *dns.SRV:
-			i = append(i, packUint16(t.Priority)...)
-			i = append(i, packUint16(t.Weight)...)
-			i = append(i, packUint16(t.Weight)...)
-			i = append(i, []byte(t.Target)...)
-		case *dns.A:
-			i = append(i, []byte(t.A)...)
-		case *dns.AAAA:
-			i = append(i, []byte(t.AAAA)...)
-		case *dns.NSEC3:
-			i = append(i, []byte(t.NextDomain)...)
-			// Bitmap does not differentiate in SkyDNS.
-		case *dns.DNSKEY:
-		case *dns.NS:
-		case *dns.TXT:
+		r = dns.Copy(r)
+		r.Header().Ttl = 0
+		buf := make([]byte, dns.Len(r))
+		off, err := dns.PackRR(r, buf, 0, nil, false)
+		if err != nil {
+			// Can't be packed, so can't be signed either, but keep the key unique.
+			i = append(i, []byte(r.String())...)
+			continue
 		}
+		i = append(i, buf[:off]...)
 	}
 	return string(h.Sum(i))
 }
 
 func packUint16(i uint16) []byte { return []byte{byte(i >> 8), byte(i)} }
-func packUint32(i uint32) []byte { return []byte{byte(i >> 24), byte(i >> 16), byte(i >> 8), byte(i)} }
@@ -5,6 +5,7 @@
 package cache
 
 import (
+	"strconv"
 	"testing"
 	"time"
 
@@ -83,3 +84,273 @@ func TestExpireMessage(t *testing.T) {
 		t.Fatalf("bad Qtype, expected %s, got %s:", tc.m.Question[0].Name, m1.Question[0].Name)
 	}
 }
+
+func TestHitCase(t *testing.T) {
+	c := New(10, testTTL)
+
+	m := newMsg("miek.nl.", dns.TypeA)
+	a, _ := dns.NewRR("miek.nl. 3600 IN A 127.0.0.1")
+	ns, _ := dns.NewRR("nl. 3600 IN NS ns.nl.")
+	m.Answer = []dns.RR{a}
+	m.Ns = []dns.RR{ns}
+	c.InsertMessage(Key(m.Question[0], false, false), m)
+
+	q := dns.Question{Name: "MieK.nL.", Qtype: dns.TypeA, Qclass: dns.ClassINET}
+	m1 := c.Hit(q, false, false, 1)
+	if m1 == nil {
+		t.Fatalf("bad cache hit, expected message for %s, got <nil>", q.Name)
+	}
+	if m1.Question[0].Name != q.Name {
+		t.Fatalf("bad question name, expected %s, got %s", q.Name, m1.Question[0].Name)
+	}
+	if m1.Answer[0].Header().Name != q.Name {
+		t.Fatalf("bad owner name, expected %s, got %s", q.Name, m1.Answer[0].Header().Name)
+	}
+	if m1.Ns[0].Header().Name != "nl." {
+		t.Fatalf("bad owner name, expected %s, got %s", "nl.", m1.Ns[0].Header().Name)
+	}
+	// The cached message itself must stay untouched.
+	if m1 = c.Hit(m.Question[0], false, false, 1); m1.Answer[0].Header().Name != "miek.nl." {
+		t.Fatalf("bad owner name, expected %s, got %s", "miek.nl.", m1.Answer[0].Header().Name)
+	}
+}
+
+func TestHitSubnet(t *testing.T) {
+	c := New(10, testTTL)
+
+	m := newMsg("miek.nl.", dns.TypeA)
+	c.InsertMessage(KeySubnet(m.Question[0], false, false, "10.1.2.0/24"), m)
+
+	if m1 := c.HitSubnet(m.Question[0], false, false, "10.1.2.0/24", 1, 0); m1 == nil {
+		t.Fatalf("bad cache hit, expected message for 10.1.2.0/24, got <nil>")
+	}
+	if m1 := c.HitSubnet(m.Question[0], false, false, "10.9.9.0/24", 1, 0); m1 != nil {
+		t.Fatalf("bad cache hit, expected no message for 10.9.9.0/24, got %s", m1)
+	}
+	if m1 := c.Hit(m.Question[0], false, false, 1); m1 != nil {
+		t.Fatalf("bad cache hit, expected no message without a subnet, got %s", m1)
+	}
+}
+
+func TestHitDecay(t *testing.T) {
+	c := New(10, 10)
+
+	m := newMsg("miek.nl.", dns.TypeA)
+	a, _ := dns.NewRR("miek.nl. 3600 IN A 127.0.0.1")
+	m.Answer = []dns.RR{a}
+	c.InsertMessage(Key(m.Question[0], false, false), m)
+
+	short := newMsg("short.miek.nl.", dns.TypeA)
+	a, _ = dns.NewRR("short.miek.nl. 0 IN A 127.0.0.1")
+	short.Answer = []dns.RR{a}
+	c.InsertMessage(Key(short.Question[0], false, false), short)
+
+	time.Sleep(1100 * time.Millisecond)
+
+	m1 := c.Hit(m.Question[0], false, false, 1)
+	if m1 == nil {
+		t.Fatalf("bad cache hit, expected message for %s, got <nil>", m.Question[0].Name)
+	}
+	if ttl := m1.Answer[0].Header().Ttl; ttl != 3599 {
+		t.Fatalf("bad TTL, expected %d, got %d", 3599, ttl)
+	}
+	if m1 = c.Hit(short.Question[0], false, false, 1); m1 != nil {
+		t.Fatalf("bad cache hit, expected <nil>, got %s:", m1)
+	}
+}
+
+func TestHitStale(t *testing.T) {
+	c := New(10, 10)
+
+	m := newMsg("miek.nl.", dns.TypeA)
+	a, _ := dns.NewRR("miek.nl. 0 IN A 127.0.0.1")
+	b, _ := dns.NewRR("miek.nl. 3600 IN A 127.0.0.2")
+	m.Answer = []dns.RR{a, b}
+	c.InsertMessage(Key(m.Question[0], false, false), m)
+
+	time.Sleep(1100 * time.Millisecond)
+
+	m1 := c.HitStale(m.Question[0], false, false, 1, 30)
+	if m1 == nil {
+		t.Fatalf("bad cache hit, expected message for %s, got <nil>", m.Question[0].Name)
+	}
+	if ttl := m1.Answer[0].Header().Ttl; ttl != 0 {
+		t.Fatalf("bad TTL, expected %d, got %d", 0, ttl)
+	}
+	if ttl := m1.Answer[1].Header().Ttl; ttl != 30 {
+		t.Fatalf("bad TTL, expected %d, got %d", 30, ttl)
+	}
+	// The stale message is kept, until a Hit removes it.
+	if m1 = c.Hit(m.Question[0], false, false, 1); m1 != nil {
+		t.Fatalf("bad cache hit, expected <nil>, got %s:", m1)
+	}
+	if m1 = c.HitStale(m.Question[0], false, false, 1, 30); m1 != nil {
+		t.Fatalf("bad cache hit, expected <nil>, got %s:", m1)
+	}
+}
+
+func TestShards(t *testing.T) {
+	c := NewSharded(64, testTTL, 8)
+	if c.Shards() != 8 {
+		t.Fatalf("expected %d shards, got %d", 8, c.Shards())
+	}
+	for i := 0; i < 256; i++ {
+		m := newMsg(strconv.Itoa(i)+".miek.nl.", dns.TypeA)
+		c.InsertMessage(Key(m.Question[0], false, false), m)
+	}
+	n := 0
+	for _, sh := range c.shards {
+		if len(sh.m) > sh.capacity {
+			t.Fatalf("shard holds %d elements, capacity is %d", len(sh.m), sh.capacity)
+		}
+		n += len(sh.m)
+	}
+	if n > c.Capacity() {
+		t.Fatalf("cache holds %d elements, capacity is %d", n, c.Capacity())
+	}
+}
+
+func TestShardCapacity(t *testing.T) {
+	for _, tc := range [][2]int{{64, 8}, {10, 4}, {3, 8}, {1000, 7}} {
+		c := NewSharded(tc[0], testTTL, tc[1])
+		n := 0
+		for _, sh := range c.shards {
+			n += sh.capacity
+		}
+		if n != tc[0] {
+			t.Errorf("expected the shards of a cache of %d to hold %d elements, got %d", tc[0], tc[0], n)
+		}
+	}
+}
+
+func TestEvictRandom(t *testing.T) {
+	c := NewSharded(10, testTTL, 4)
+	// Fill the shards past their capacity, behind the back of InsertMessage.
+	for i, sh := range c.shards {
+		for j := 0; j < 10; j++ {
+			sh.m[strconv.Itoa(i)+"/"+strconv.Itoa(j)] = &elem{msg: new(dns.Msg)}
+		}
+	}
+	c.EvictRandom()
+	n := 0
+	for _, sh := range c.shards {
+		if len(sh.m) != sh.capacity {
+			t.Fatalf("expected a shard to hold %d elements after EvictRandom, got %d", sh.capacity, len(sh.m))
+		}
+		n += len(sh.m)
+	}
+	if n != c.Capacity() {
+		t.Fatalf("expected the cache to hold %d elements after EvictRandom, got %d", c.Capacity(), n)
+	}
+}
+
+func benchmarkCacheParallel(b *testing.B, shards int) {
+	c := NewSharded(10000, 60, shards)
+	qs := make([]dns.Question, 1000)
+	for i := range qs {
+		qs[i] = newMsg(strconv.Itoa(i)+".miek.nl.", dns.TypeA).Question[0]
+		c.InsertMessage(Key(qs[i], false, false), newMsg(qs[i].Name, qs[i].Qtype))
+	}
+
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		i := 0
+		for pb.Next() {
+			q := qs[i%len(qs)]
+			if i%10 == 0 {
+				c.InsertMessage(Key(q, true, false), newMsg(q.Name, q.Qtype))
+			} else {
+				c.Hit(q, false, false, 1)
+			}
+			i++
+		}
+	})
+}
+
+func BenchmarkCacheParallel1Shard(b *testing.B)   { benchmarkCacheParallel(b, 1) }
+func BenchmarkCacheParallel16Shards(b *testing.B) { benchmarkCacheParallel(b, 16) }
+
+func TestPacked(t *testing.T) {
+	p := NewPacked(10, testTTL, 2)
+
+	req := newMsg("Miek.nl.", dns.TypeMX)
+	req.Id = 1
+	reply := new(dns.Msg).SetReply(req)
+	b, err := reply.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := PackedKey(req, 512, false)
+	p.Insert(key, b)
+
+	b1 := p.Hit(key, 2)
+	m := new(dns.Msg)
+	if err := m.Unpack(b1); err != nil {
+		t.Fatal(err)
+	}
+	if m.Id != 2 || m.Question[0].Name != "Miek.nl." {
+		t.Fatalf("bad cache hit, expected ID 2 and Miek.nl., got %s", m)
+	}
+	if b[0] != 0 || b[1] != 1 {
+		t.Fatal("cached reply changed by hit")
+	}
+
+	// Everything the reply depends on is in the key.
+	for _, k := range []string{
+		PackedKey(newMsg("miek.nl.", dns.TypeMX), 512, false),
+		PackedKey(req, 1232, false),
+		PackedKey(req, 512, true),
+		PackedKey(req.Copy().SetEdns0(512, true), 512, false),
+	} {
+		if p.Hit(k, 2) != nil {
+			t.Fatalf("bad cache hit for key %q", k)
+		}
+	}
+
+	if n := p.RemoveFunc(func(name string) bool { return name == "miek.nl." }); n != 1 {
+		t.Fatalf("expected 1 reply removed, got %d", n)
+	}
+	if p.Hit(key, 2) != nil {
+		t.Fatal("bad cache hit after removal")
+	}
+
+	p.Insert(key, b)
+	time.Sleep(testTTL * time.Second)
+	if p.Hit(key, 2) != nil {
+		t.Fatal("bad cache hit after expiration")
+	}
+}
+
+func TestKeyRRset(t *testing.T) {
+	// Every pair differs in its rdata only, so needs a signature of its own.
+	tests := [][2]string{
+		{"a.skydns.test. 3600 IN A 10.0.0.1", "a.skydns.test. 3600 IN A 10.0.0.2"},
+		{"a.skydns.test. 3600 IN SRV 10 10 8080 b.skydns.test.", "a.skydns.test. 3600 IN SRV 10 20 8080 b.skydns.test."},
+		{"a.skydns.test. 3600 IN NAPTR 100 10 \"S\" \"SIP+D2U\" \"\" _sip._udp.skydns.test.", "a.skydns.test. 3600 IN NAPTR 100 20 \"S\" \"SIP+D2U\" \"\" _sip._udp.skydns.test."},
+		{"a.skydns.test. 3600 IN CAA 0 issue \"ca.test\"", "a.skydns.test. 3600 IN CAA 0 issue \"other.test\""},
+		{"_443._tcp.a.skydns.test. 3600 IN TLSA 3 1 1 0102", "_443._tcp.a.skydns.test. 3600 IN TLSA 3 1 1 0103"},
+		{"a.skydns.test. 3600 IN TYPE64 \\# 3 000100", "a.skydns.test. 3600 IN TYPE64 \\# 3 000200"},
+		{"a.skydns.test. 3600 IN DS 1 8 2 0102", "a.skydns.test. 3600 IN DS 2 8 2 0102"},
+		{"_http._tcp.a.skydns.test. 3600 IN URI 10 1 \"http://a.test/\"", "_http._tcp.a.skydns.test. 3600 IN URI 10 1 \"http://b.test/\""},
+		{"a.skydns.test. 3600 IN DNAME b.skydns.test.", "a.skydns.test. 3600 IN DNAME c.skydns.test."},
+		{"a.skydns.test. 3600 IN TYPE65280 \\# 2 0102", "a.skydns.test. 3600 IN TYPE65280 \\# 2 0103"},
+	}
+	for i, tc := range tests {
+		r1, err := dns.NewRR(tc[0])
+		if err != nil {
+			t.Fatalf("test %d: %s", i, err)
+		}
+		r2, err := dns.NewRR(tc[1])
+		if err != nil {
+			t.Fatalf("test %d: %s", i, err)
+		}
+		if KeyRRset([]dns.RR{r1}) == KeyRRset([]dns.RR{r2}) {
+			t.Errorf("test %d: expected different keys for %s and %s", i, r1, r2)
+		}
+		r3 := dns.Copy(r1)
+		r3.Header().Ttl = 60
+		if KeyRRset([]dns.RR{r1}) != KeyRRset([]dns.RR{r3}) {
+			t.Errorf("test %d: expected the same key for a different TTL of %s", i, r1)
+		}
+	}
+}
@@ -5,27 +5,102 @@
 package cache
 
 import (
+	"strings"
 	"time"
 
 	"github.com/miekg/dns"
 )
 
 // Hit returns a dns message from the cache. If the message's TTL is expired nil
-// is returned and the message is removed from the cache.
+// is returned and the message is removed from the cache. The TTLs of the records
+// in the message are decremented by the time it spent in the cache.
 func (c *Cache) Hit(question dns.Question, dnssec, tcp bool, msgid uint16) *dns.Msg {
-	key := Key(question, dnssec, tcp)
+	return c.hit(Key(question, dnssec, tcp), question, msgid, 0)
+}
+
+// HitStale is Hit, but returns an expired message too, instead of removing it. The
+// TTLs in an expired message are lowered to at most ttl.
+func (c *Cache) HitStale(question dns.Question, dnssec, tcp bool, msgid uint16, ttl uint32) *dns.Msg {
+	return c.hit(Key(question, dnssec, tcp), question, msgid, ttl)
+}
+
+// HitSubnet is Hit, or HitStale when ttl isn't 0, for a message that only holds
+// for the clients in subnet, see KeySubnet.
+func (c *Cache) HitSubnet(question dns.Question, dnssec, tcp bool, subnet string, msgid uint16, ttl uint32) *dns.Msg {
+	return c.hit(KeySubnet(question, dnssec, tcp, subnet), question, msgid, ttl)
+}
+
+func (c *Cache) hit(key string, question dns.Question, msgid uint16, stale uint32) *dns.Msg {
 	m1, exp, hit := c.Search(key)
-	if hit {
-		// Cache hit! \o/
-		if time.Since(exp) < 0 {
-			m1.Id = msgid
-			m1.Compress = true
-			// Even if something ended up with the TC bit *in* the cache, set it to off
-			m1.Truncated = false
-			return m1
-		}
+	if !hit {
+		return nil
+	}
+	if time.Since(exp) >= 0 || !decayTTL(m1, time.Since(exp.Add(-c.ttl))) {
 		// Expired! /o\
-		c.Remove(key)
+		if stale == 0 {
+			c.Remove(key)
+			return nil
+		}
+		staleTTL(m1, stale)
+	}
+	// Cache hit! \o/
+	m1.Id = msgid
+	m1.Compress = true
+	// Even if something ended up with the TC bit *in* the cache, set it to off
+	m1.Truncated = false
+	setCase(m1, question.Name)
+	return m1
+}
+
+// decayTTL subtracts age from the TTLs in m. It returns false, and leaves m
+// alone, when a record outlived its TTL in the cache.
+func decayTTL(m *dns.Msg, age time.Duration) bool {
+	if age < 0 {
+		return true
+	}
+	sec := uint32(age / time.Second)
+	for _, rrs := range [][]dns.RR{m.Answer, m.Ns, m.Extra} {
+		for _, r := range rrs {
+			if h := r.Header(); h.Rrtype != dns.TypeOPT && h.Ttl < sec {
+				return false
+			}
+		}
+	}
+	for _, rrs := range [][]dns.RR{m.Answer, m.Ns, m.Extra} {
+		for _, r := range rrs {
+			if h := r.Header(); h.Rrtype != dns.TypeOPT {
+				h.Ttl -= sec
+			}
+		}
+	}
+	return true
+}
+
+// staleTTL lowers the TTLs in m to at most ttl.
+func staleTTL(m *dns.Msg, ttl uint32) {
+	for _, rrs := range [][]dns.RR{m.Answer, m.Ns, m.Extra} {
+		for _, r := range rrs {
+			if h := r.Header(); h.Rrtype != dns.TypeOPT && h.Ttl > ttl {
+				h.Ttl = ttl
+			}
+		}
+	}
+}
+
+// setCase rewrites the question and the owner names equal to it to the case used
+// in name. Keys are case insensitive, so the cached message may carry the case
+// of an earlier query, which resolvers doing 0x20 verification reject.
+func setCase(m *dns.Msg, name string) {
+	if len(m.Question) == 0 || m.Question[0].Name == name {
+		return
+	}
+	cached := m.Question[0].Name
+	m.Question[0].Name = name
+	for _, rrs := range [][]dns.RR{m.Answer, m.Ns, m.Extra} {
+		for _, r := range rrs {
+			if h := r.Header(); strings.EqualFold(h.Name, cached) {
+				h.Name = name
+			}
+		}
 	}
-	return nil
 }
@@ -0,0 +1,164 @@
+// Copyright (c) 2014 The SkyDNS Authors. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package cache
+
+import (
+	"hash/fnv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// packed is a reply in wire format.
+type packed struct {
+	expiration time.Time
+	name       string // lowercased qname, for RemoveFunc
+	b          []byte
+}
+
+type packedShard struct {
+	sync.RWMutex
+
+	capacity int
+	m        map[string]*packed
+}
+
+// Packed is a cache of replies in wire format. Clients asking the same question,
+// with the same header bits and OPT record, get byte-identical replies except for
+// the ID: no EDNS0 options, like client subnet, are echoed. So a hit is only
+// copied and given the ID of the query, it is not packed again. Because the TTLs
+// and the order of the records are those of the packed reply, replies are only
+// kept for a short time.
+type Packed struct {
+	capacity int
+	shards   []*packedShard
+	ttl      time.Duration
+}
+
+// NewPacked returns a new packed cache with the capacity and the ttl specified,
+// split in n shards.
+func NewPacked(capacity, ttl, n int) *Packed {
+	if n < 1 {
+		n = 1
+	}
+	p := &Packed{capacity: capacity, ttl: time.Duration(ttl) * time.Second}
+	p.shards = make([]*packedShard, n)
+	for i := range p.shards {
+		p.shards[i] = &packedShard{capacity: (capacity + n - 1) / n, m: make(map[string]*packed)}
+	}
+	return p
+}
+
+func (p *Packed) shard(s string) *packedShard {
+	if len(p.shards) == 1 {
+		return p.shards[0]
+	}
+	h := fnv.New32a()
+	h.Write([]byte(s))
+	return p.shards[h.Sum32()%uint32(len(p.shards))]
+}
+
+// Insert inserts the packed reply b in the cache, it must not be changed
+// afterwards.
+func (p *Packed) Insert(s string, b []byte) {
+	if p.capacity <= 0 || len(b) < 2 {
+		return
+	}
+	// The question starts after the 12 octet header.
+	name := ""
+	if q, _, err := dns.UnpackDomainName(b, 12); err == nil {
+		name = strings.ToLower(q)
+	}
+	sh := p.shard(s)
+	sh.Lock()
+	sh.m[s] = &packed{time.Now().UTC().Add(p.ttl), name, b}
+	if clen := len(sh.m); clen > sh.capacity {
+		i := clen - sh.capacity
+		for k := range sh.m {
+			delete(sh.m, k)
+			if i--; i == 0 {
+				break
+			}
+		}
+	}
+	sh.Unlock()
+}
+
+// Hit returns a copy of the packed reply for s with its ID set to id, or nil when
+// there is none or it expired.
+func (p *Packed) Hit(s string, id uint16) []byte {
+	if p.capacity <= 0 {
+		return nil
+	}
+	sh := p.shard(s)
+	sh.RLock()
+	e, ok := sh.m[s]
+	sh.RUnlock()
+	if !ok {
+		return nil
+	}
+	if time.Since(e.expiration) >= 0 {
+		sh.Lock()
+		if sh.m[s] == e {
+			delete(sh.m, s)
+		}
+		sh.Unlock()
+		return nil
+	}
+	b := make([]byte, len(e.b))
+	copy(b, e.b)
+	b[0], b[1] = byte(id>>8), byte(id)
+	return b
+}
+
+// RemoveFunc removes the replies to the (lowercased) names for which f returns
+// true and returns how many were removed.
+func (p *Packed) RemoveFunc(f func(name string) bool) int {
+	n := 0
+	for _, sh := range p.shards {
+		sh.Lock()
+		for k, e := range sh.m {
+			if f(e.name) {
+				delete(sh.m, k)
+				n++
+			}
+		}
+		sh.Unlock()
+	}
+	return n
+}
+
+// PackedKey returns the key of the reply to req in the packed cache. Everything in
+// the query that our reply depends on is in it: the question, in the case the
+// client used, the RD, CD and AD bits, whether the client uses EDNS0 and with what
+// DO bit, the UDP payload size the reply must fit in and the transport.
+func PackedKey(req *dns.Msg, bufsize uint16, tcp bool) string {
+	q := req.Question[0]
+	i := append([]byte(q.Name), packUint16(q.Qtype)...)
+	i = append(i, packUint16(q.Qclass)...)
+	i = append(i, packUint16(bufsize)...)
+	flags := byte(0)
+	if req.RecursionDesired {
+		flags |= 1 << 0
+	}
+	if req.CheckingDisabled {
+		flags |= 1 << 1
+	}
+	if req.AuthenticatedData {
+		flags |= 1 << 2
+	}
+	if o := req.IsEdns0(); o != nil {
+		flags |= 1 << 3
+		if o.Do() {
+			flags |= 1 << 4
+		}
+	}
+	if tcp {
+		flags |= 1 << 5
+	}
+	return string(append(i, flags))
+}
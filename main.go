@@ -18,8 +18,11 @@ import (
 	"strings"
 	"time"
 
+	backendconsul "github.com/skynetservices/skydns/backends/consul"
 	backendetcd "github.com/skynetservices/skydns/backends/etcd"
 	backendetcdv3 "github.com/skynetservices/skydns/backends/etcd3"
+	backendfile "github.com/skynetservices/skydns/backends/file"
+	backendredis "github.com/skynetservices/skydns/backends/redis"
 	"github.com/skynetservices/skydns/metrics"
 	"github.com/skynetservices/skydns/msg"
 	"github.com/skynetservices/skydns/server"
@@ -38,9 +41,44 @@ var (
 	password   = ""
 	config     = &server.Config{ReadTimeout: 0, Domain: "", DnsAddr: "", DNSSEC: ""}
 	nameserver = ""
+	interfaces = ""
+	recursion  = ""
+	notify     = ""
+	transfer   = ""
+	secondary  = ""
+	tsigKeys   = ""
+	acme       = ""
+	acmeNames  = ""
+	query      = ""
+	family     = ""
+	middleware = ""
+	faults     = ""
+	weights    = ""
+	subnet     = ""
+	cookies    = ""
+	dns64      = ""
+	proxy      = ""
+	mdns       = server.MDNS{}
 	machine    = ""
 	stub       = false
 	ctx        = context.Background()
+
+	migrate       = false
+	backendName   = ""
+	consulAddr    = ""
+	consulToken   = ""
+	consulCatalog = false
+	redisAddr     = ""
+	redisPassword = ""
+	redisDB       = 0
+	filePath      = ""
+
+	standalone        = false
+	standaloneDir     = ""
+	standaloneName    = ""
+	standalonePeers   = ""
+	standaloneCluster = ""
+	standaloneState   = ""
 )
 
 func env(key, def string) string {
@@ -70,10 +108,60 @@ func boolEnv(key string, def bool) bool {
 
 func init() {
 	flag.StringVar(&config.Domain, "domain", env("SKYDNS_DOMAIN", "skydns.local."), "domain to anchor requests to (SKYDNS_DOMAIN)")
-	flag.StringVar(&config.DnsAddr, "addr", env("SKYDNS_ADDR", "127.0.0.1:53"), "ip:port to bind to (SKYDNS_ADDR)")
+	flag.StringVar(&config.DnsAddr, "addr", env("SKYDNS_ADDR", net.JoinHostPort(server.Loopback(), "53")), "ip:port to bind to (SKYDNS_ADDR)")
+	flag.StringVar(&interfaces, "interfaces", env("SKYDNS_INTERFACES", ""), "network interface(s) to bind to every address of, at the port of -addr, e.g. eth0,eth1")
 	flag.StringVar(&nameserver, "nameservers", env("SKYDNS_NAMESERVERS", ""), "nameserver address(es) to forward (non-local) queries to e.g. 8.8.8.8:53,8.8.4.4:53")
 	flag.BoolVar(&config.NoRec, "no-rec", false, "do not provide a recursive service")
-	flag.StringVar(&machine, "machines", env("ETCD_MACHINES", "http://127.0.0.1:2379"), "machine address(es) running etcd")
+	flag.StringVar(&config.ChaosVersion, "chaos-version", env("SKYDNS_CHAOS_VERSION", ""), "answer to version.bind CH TXT queries, defaults to the version of SkyDNS")
+	flag.StringVar(&config.ChaosID, "chaos-id", env("SKYDNS_CHAOS_ID", ""), "answer to id.server CH TXT queries, defaults to the host name")
+	flag.BoolVar(&config.NoChaos, "no-chaos", false, "refuse CHAOS class queries")
+	flag.StringVar(&recursion, "recursion-acl", env("SKYDNS_RECURSION_ACL", ""), "networks of clients allowed to use the recursive service e.g. 10.0.0.0/8,192.168.1.1")
+	flag.StringVar(&notify, "notify-acl", env("SKYDNS_NOTIFY_ACL", ""), "networks of masters allowed to send NOTIFY to flush cached responses e.g. 10.0.0.53")
+	flag.StringVar(&transfer, "transfer-acl", env("SKYDNS_TRANSFER_ACL", ""), "networks of secondaries allowed to transfer the domain with AXFR e.g. 10.0.0.53")
+	flag.IntVar(&config.IxfrJournal, "ixfr-journal", 0, "number of changes to the domain kept to answer IXFR, 0 answers with full transfers")
+	flag.StringVar(&secondary, "secondaries", env("SKYDNS_SECONDARIES", ""), "secondaries to send a NOTIFY when the domain changes e.g. 10.0.0.54:53")
+	flag.StringVar(&tsigKeys, "tsig-keys", env("SKYDNS_TSIG_KEYS", ""), "TSIG keys requests may be signed with, [algorithm:]name:secret e.g. hmac-sha256:dhcp.key.:c2VjcmV0")
+	flag.StringVar(&config.AcmeAddr, "acme-addr", env("SKYDNS_ACME_ADDR", ""), "ip:port of the HTTP API to place ACME DNS-01 challenges on e.g. 127.0.0.1:8053")
+	flag.StringVar(&acme, "acme-acl", env("SKYDNS_ACME_ACL", ""), "networks of clients allowed to use the ACME API, defaults to 127.0.0.1,::1")
+	flag.StringVar(&config.AcmeDirectory, "acme-directory", env("SKYDNS_ACME_DIRECTORY", ""), "directory URL of the ACME CA to obtain the certificate of the DNS-over-HTTPS endpoint from e.g. https://acme-v02.api.letsencrypt.org/directory")
+	flag.StringVar(&config.AcmeEmail, "acme-email", env("SKYDNS_ACME_EMAIL", ""), "contact email of the ACME account")
+	flag.StringVar(&acmeNames, "acme-names", env("SKYDNS_ACME_NAMES", ""), "names in the domain of the certificate of the DNS-over-HTTPS endpoint e.g. doh.skydns.local")
+	flag.StringVar(&config.AcmeCache, "acme-cache", env("SKYDNS_ACME_CACHE", ""), "directory to keep the ACME account key and the certificate in")
+	flag.StringVar(&config.DoHAddr, "doh-addr", env("SKYDNS_DOH_ADDR", ""), "ip:port of the DNS-over-HTTPS endpoint e.g. 0.0.0.0:443, or metrics to share the metrics listener")
+	flag.StringVar(&config.DoHCert, "doh-cert", env("SKYDNS_DOH_CERT", ""), "TLS certificate file of the DNS-over-HTTPS endpoint")
+	flag.StringVar(&config.DoHKey, "doh-key", env("SKYDNS_DOH_KEY", ""), "TLS key file of the DNS-over-HTTPS endpoint")
+	flag.StringVar(&config.GRPCAddr, "grpc-addr", env("SKYDNS_GRPC_ADDR", ""), "ip:port of the gRPC endpoint e.g. 0.0.0.0:8443")
+	flag.StringVar(&config.GRPCCert, "grpc-cert", env("SKYDNS_GRPC_CERT", ""), "TLS certificate file of the gRPC endpoint")
+	flag.StringVar(&config.GRPCKey, "grpc-key", env("SKYDNS_GRPC_KEY", ""), "TLS key file of the gRPC endpoint")
+	flag.StringVar(&config.GRPCCA, "grpc-ca", env("SKYDNS_GRPC_CA", ""), "CA certificate file of the clients of the gRPC endpoint, enables mutual TLS")
+	flag.StringVar(&config.DoQAddr, "doq-addr", env("SKYDNS_DOQ_ADDR", ""), "ip:port of the DNS-over-QUIC endpoint e.g. 0.0.0.0:853")
+	flag.StringVar(&config.DoQCert, "doq-cert", env("SKYDNS_DOQ_CERT", ""), "TLS certificate file of the DNS-over-QUIC endpoint")
+	flag.StringVar(&config.DoQKey, "doq-key", env("SKYDNS_DOQ_KEY", ""), "TLS key file of the DNS-over-QUIC endpoint")
+	flag.BoolVar(&config.DoQ0RTT, "doq-0rtt", false, "accept queries in 0-RTT data over DNS-over-QUIC")
+	flag.StringVar(&query, "query-acl", env("SKYDNS_QUERY_ACL", ""), "networks of clients allowed to query e.g. 10.0.0.0/8,192.168.1.1")
+	flag.StringVar(&middleware, "middleware", env("SKYDNS_MIDDLEWARE", ""), "stages in front of the server, outermost first e.g. recover,logging,acl")
+	flag.BoolVar(&config.LogQueries, "log-queries", false, "log every query and its rcode (with the logging middleware)")
+	flag.StringVar(&family, "address-policy", env("SKYDNS_ADDRESS_POLICY", ""), "address records to serve for the domain: prefer-ipv6 or ipv6-only, defaults to all")
+	flag.StringVar(&config.Policy, "policy", env("SKYDNS_POLICY", ""), "name of the compiled in query policy to apply")
+	flag.StringVar(&mdns.Export, "mdns-export", env("SKYDNS_MDNS_EXPORT", ""), "zone whose names are answered over mDNS as NAME.local. e.g. lab.skydns.local.")
+	flag.StringVar(&mdns.Import, "mdns-import", env("SKYDNS_MDNS_IMPORT", ""), "zone to serve the hosts discovered over mDNS in e.g. devices.skydns.local.")
+	flag.StringVar(&mdns.Interface, "mdns-interface", env("SKYDNS_MDNS_INTERFACE", ""), "network interface to bridge mDNS on, defaults to the system's multicast interface")
+	flag.BoolVar(&mdns.Announce, "mdns-announce", boolEnv("SKYDNS_MDNS_ANNOUNCE", false), "announce the services with mdns set on the link over mDNS")
+	flag.StringVar(&config.HostsFile, "hosts-file", env("SKYDNS_HOSTS_FILE", ""), "file in hosts format with addresses overriding the backend and forwarding, reloaded on changes")
+	flag.BoolVar(&config.SynthesizePTR, "synthesize-ptr", false, "answer PTR queries for the addresses of services that have no reverse record")
+	flag.StringVar(&weights, "adaptive-weights", env("SKYDNS_ADAPTIVE_WEIGHTS", ""), "adapt the weights of SRV endpoints to their health, as JSON e.g. {\"check_interval\": 10}")
+	flag.StringVar(&subnet, "client-subnet", env("SKYDNS_CLIENT_SUBNET", ""), "use and forward the EDNS client subnet, as JSON e.g. {\"trusted\": [\"10.0.0.53\"]}")
+	flag.StringVar(&cookies, "cookies", env("SKYDNS_COOKIES", ""), "use DNS cookies, as JSON e.g. {\"require\": \"load\"}")
+	flag.StringVar(&dns64, "dns64", env("SKYDNS_DNS64", ""), "synthesize AAAA records from A records for IPv6-only clients, as JSON e.g. {\"prefix\": \"64:ff9b::/96\"}")
+	flag.StringVar(&proxy, "proxy-protocol", env("SKYDNS_PROXY_PROTOCOL", ""), "read the PROXY protocol header of connections from load balancers, as JSON e.g. {\"from\": [\"10.0.0.0/24\"]}")
+	flag.StringVar(&faults, "faults", "", "faults to inject for testing, as JSON e.g. {\"packet_loss\": 0.1} (only in builds with -tags faults)")
+	flag.StringVar(&machine, "machines", env("ETCD_MACHINES", "http://"+net.JoinHostPort(server.Loopback(), "2379")), "machine address(es) running etcd")
+	flag.BoolVar(&standalone, "standalone", boolEnv("SKYDNS_STANDALONE", false), "run etcd embedded in SkyDNS, serving clients on -machines")
+	flag.StringVar(&standaloneDir, "standalone-dir", env("SKYDNS_STANDALONE_DIR", "skydns.etcd"), "data directory of the embedded etcd")
+	flag.StringVar(&standaloneName, "standalone-name", env("SKYDNS_STANDALONE_NAME", "skydns"), "member name of the embedded etcd")
+	flag.StringVar(&standalonePeers, "standalone-peers", env("SKYDNS_STANDALONE_PEERS", ""), "URL(s) the embedded etcd talks to its peers on e.g. http://10.0.0.1:2380, defaults to http://localhost:2380")
+	flag.StringVar(&standaloneCluster, "standalone-cluster", env("SKYDNS_STANDALONE_CLUSTER", ""), "members of the embedded etcd's cluster e.g. dns1=http://10.0.0.1:2380,dns2=http://10.0.0.2:2380")
+	flag.StringVar(&standaloneState, "standalone-state", env("SKYDNS_STANDALONE_STATE", "new"), "state of the embedded etcd's cluster: new, or existing when joining it")
 	flag.StringVar(&config.DNSSEC, "dnssec", "", "basename of DNSSEC key file e.q. Kskydns.local.+005+38250")
 	flag.StringVar(&config.Local, "local", "", "optional unique value for this skydns instance")
 	flag.StringVar(&tlskey, "tls-key", env("ETCD_TLSKEY", ""), "SSL key file used to secure etcd communication")
@@ -84,9 +172,30 @@ func init() {
 	flag.DurationVar(&config.ReadTimeout, "rtimeout", 2*time.Second, "read timeout")
 	flag.BoolVar(&config.RoundRobin, "round-robin", true, "round robin A/AAAA replies")
 	flag.BoolVar(&config.NSRotate, "ns-rotate", true, "round robin selection of nameservers from among those listed")
+	flag.IntVar(&config.RaceDelay, "race-delay", 0, "milliseconds after which a forwarded query is sent to the next nameserver too, e.g. 50 (0 is no racing)")
+	flag.BoolVar(&config.Dns0x20, "dns0x20", false, "randomize the case of forwarded query names and drop replies that don't match it")
 	flag.BoolVar(&stub, "stubzones", false, "support stub zones")
 	flag.BoolVar(&config.Verbose, "verbose", false, "log queries")
 	flag.BoolVar(&config.Systemd, "systemd", boolEnv("SKYDNS_SYSTEMD", false), "bind to socket(s) activated by systemd (ignore -addr)")
+	flag.StringVar(&config.Additional, "additional", server.AdditionalAll, "add addresses of SRV and MX targets to the additional section: all, internal or none")
+	flag.BoolVar(&config.ExtendedErrors, "extended-errors", false, "add the reason for an error response as an Extended DNS Error (RFC 8914)")
+	flag.BoolVar(&config.MinimalAny, "minimal-any", false, "answer ANY queries with a single HINFO record (RFC 8482)")
+	flag.BoolVar(&config.PriorityFailover, "priority-failover", false, "only return addresses of the services with the lowest priority, the others are standbys")
+	flag.IntVar(&config.EdnsUDPSize, "edns-udp-size", server.EdnsUDPSize, "UDP payload size advertised in our EDNS0 OPT record")
+	flag.IntVar(&config.MaxUDPSize, "max-udp-size", 0, "largest UDP response to send, regardless of the client's buffer size (0 is no limit)")
+	flag.IntVar(&config.MaxAnswers, "max-answers", 0, "most records of the queried type in a reply (0 is no limit)")
+	flag.StringVar(&config.AnswerSubset, "answer-subset", server.SubsetRandom, "records kept when a reply has too many: random or first")
+	flag.IntVar(&config.PaddingBlock, "padding-block", 0, "pad DNS-over-HTTPS, DNS-over-QUIC and gRPC replies to a multiple of this size, 468 is recommended (0 is no padding)")
+	flag.IntVar(&config.UDPBatch, "udp-batch", 0, "number of UDP packets to read and write per system call (Linux only)")
+	flag.IntVar(&config.TCPPipeline, "tcp-pipeline", 0, "number of queries on a TCP connection handled at the same time, e.g. 32 (0 is one at a time)")
+	flag.BoolVar(&config.Preload, "preload", false, "query all services once at startup to warm the backend and the response cache")
+	flag.StringVar(&config.PopularFile, "popular-file", "", "file to save the most popular names to, and to warm the response cache from at startup")
+	flag.IntVar(&config.PopularCount, "popular-count", server.PopularCount, "number of popular names to save")
+	flag.IntVar(&config.Workers, "workers", 0, "number of goroutines handling queries, 0 is a goroutine per query")
+	flag.IntVar(&config.WorkerQueue, "worker-queue", 0, "number of queries waiting for a worker before shedding load")
+	flag.BoolVar(&config.ShedDrop, "shed-drop", false, "drop queries when shedding load instead of refusing them")
+	flag.BoolVar(&config.Strict, "strict", false, "strictly validate queries and rate limit FORMERR replies")
+	flag.IntVar(&config.FormErrRate, "formerr-rate", server.FormErrRate, "FORMERR replies per second to a single source when running strict")
 
 	// Version
 	flag.BoolVar(&config.Version, "version", false, "Print the version and exit.")
@@ -97,13 +206,26 @@ func init() {
 	flag.IntVar(&config.SCache, "scache", server.SCacheCapacity, "capacity of the signature cache")
 	flag.IntVar(&config.RCache, "rcache", 0, "capacity of the response cache") // default to 0 for now
 	flag.IntVar(&config.RCacheTtl, "rcache-ttl", server.RCacheTtl, "TTL of the response cache")
+	flag.IntVar(&config.RCacheShards, "rcache-shards", server.RCacheShards, "number of shards in the response cache")
+	flag.IntVar(&config.PCacheTtl, "pcache-ttl", 0, "seconds replies from the response cache are kept packed, 0 to disable")
 
 	// Ndots
 	flag.IntVar(&config.Ndots, "ndots", intEnv("SKYDNS_NDOTS", server.Ndots), "How many labels a name should have before we allow forwarding")
+	flag.IntVar(&config.CNAMEDepth, "cname-depth", server.CNAMEDepth, "number of CNAMEs in our domain to follow for an address query")
+	flag.StringVar(&config.TagLabel, "tag-label", server.TagLabel, "label that starts a query for the services of a name with a tag: <label>.<tag>.<name>")
 
 	flag.StringVar(&msg.PathPrefix, "path-prefix", env("SKYDNS_PATH_PREFIX", "skydns"), "backend(etcd) path prefix, default: skydns")
 
 	flag.BoolVar(&config.Etcd3, "etcd3", false, "flag that denotes the etcd version to be supported by skydns during runtime. Defaults to false.")
+	flag.BoolVar(&migrate, "migrate-etcd2", false, "copy the keys under -path-prefix from the etcd v2 API to the v3 API, for -etcd3, and exit")
+	flag.StringVar(&backendName, "backend", env("SKYDNS_BACKEND", "etcd"), "store to look up the services in: etcd, etcd3, consul, redis or file")
+	flag.StringVar(&consulAddr, "consul", env("CONSUL_HTTP_ADDR", "http://127.0.0.1:8500"), "address of the Consul agent, with -backend=consul")
+	flag.StringVar(&consulToken, "consul-token", env("CONSUL_HTTP_TOKEN", ""), "ACL token sent to Consul")
+	flag.BoolVar(&consulCatalog, "consul-catalog", boolEnv("SKYDNS_CONSUL_CATALOG", false), "serve the healthy instances of the services in Consul's catalog, not the services in its KV store")
+	flag.StringVar(&redisAddr, "redis", env("SKYDNS_REDIS", "127.0.0.1:6379"), "address of Redis, with -backend=redis")
+	flag.StringVar(&redisPassword, "redis-password", env("REDIS_PASSWORD", ""), "password to AUTH with to Redis")
+	flag.IntVar(&redisDB, "redis-db", 0, "number of the Redis database the keys are in")
+	flag.StringVar(&filePath, "file", env("SKYDNS_FILE", ""), "zone file, JSON file of services, or directory of them, with -backend=file")
 }
 
 func main() {
@@ -114,17 +236,63 @@ func main() {
 		os.Exit(0)
 	}
 
+	switch backendName {
+	case "etcd":
+	case "etcd3":
+		config.Etcd3 = true
+	case "consul":
+		if config.Etcd3 || standalone {
+			log.Fatalf("skydns: backend consul can't be used with -etcd3 or -standalone")
+		}
+		if stub && consulCatalog {
+			log.Fatalf("skydns: stub zones are stored in Consul's KV store, not its catalog")
+		}
+		if !strings.Contains(consulAddr, "://") {
+			consulAddr = "http://" + consulAddr
+		}
+	case "redis":
+		if config.Etcd3 || standalone {
+			log.Fatalf("skydns: backend redis can't be used with -etcd3 or -standalone")
+		}
+	case "file":
+		if config.Etcd3 || standalone {
+			log.Fatalf("skydns: backend file can't be used with -etcd3 or -standalone")
+		}
+		if filePath == "" {
+			log.Fatalf("skydns: backend file needs -file")
+		}
+	default:
+		log.Fatalf("skydns: backend is invalid: %q", backendName)
+	}
+	consul := backendName == "consul"
+	redis := backendName == "redis"
+	file := backendName == "file"
+
 	machines := strings.Split(machine, ",")
+	if standalone {
+		if err := startEtcd(machines); err != nil {
+			log.Fatalf("skydns: %s", err)
+		}
+	}
+
+	if migrate {
+		if err := migrateEtcd(machines); err != nil {
+			log.Fatalf("skydns: migration to etcd v3 failed: %s", err)
+		}
+		return
+	}
 
 	var clientptr *etcdv3.Client
 	var err error
 	var clientv3 etcdv3.Client
 	var clientv2 etcd.KeysAPI
 
-	if config.Etcd3 {
+	switch {
+	case consul, redis, file:
+	case config.Etcd3:
 		clientptr, err = newEtcdV3Client(machines, tlspem, tlskey, cacert)
 		clientv3 = *clientptr
-	} else {
+	default:
 		clientv2, err = newEtcdV2Client(machines, tlspem, tlskey, cacert, username, password)
 	}
 
@@ -140,15 +308,114 @@ func main() {
 			config.Nameservers = append(config.Nameservers, hostPort)
 		}
 	}
+	if interfaces != "" {
+		config.Interfaces = append(config.Interfaces, strings.Split(interfaces, ",")...)
+	}
+	if recursion != "" {
+		config.RecursionACL = append(config.RecursionACL, strings.Split(recursion, ",")...)
+	}
+	if notify != "" {
+		config.NotifyACL = append(config.NotifyACL, strings.Split(notify, ",")...)
+	}
+	if transfer != "" {
+		config.TransferACL = append(config.TransferACL, strings.Split(transfer, ",")...)
+	}
+	if secondary != "" {
+		config.Secondaries = append(config.Secondaries, strings.Split(secondary, ",")...)
+	}
+	if tsigKeys != "" {
+		for _, k := range strings.Split(tsigKeys, ",") {
+			parts := strings.Split(k, ":")
+			switch len(parts) {
+			case 2:
+				config.TsigKeys = append(config.TsigKeys, server.TsigKey{Name: parts[0], Secret: parts[1]})
+			case 3:
+				config.TsigKeys = append(config.TsigKeys, server.TsigKey{Algorithm: parts[0], Name: parts[1], Secret: parts[2]})
+			default:
+				log.Fatalf("skydns: tsig key is invalid: %q", k)
+			}
+		}
+	}
+	if acme != "" {
+		config.AcmeACL = append(config.AcmeACL, strings.Split(acme, ",")...)
+	}
+	if acmeNames != "" {
+		config.AcmeNames = append(config.AcmeNames, strings.Split(acmeNames, ",")...)
+	}
+	if query != "" {
+		config.QueryACL = append(config.QueryACL, strings.Split(query, ",")...)
+	}
+	if family != "" {
+		config.AddressPolicies = append(config.AddressPolicies, server.AddressPolicy{Policy: family})
+	}
+	if middleware != "" {
+		config.Middleware = strings.Split(middleware, ",")
+	}
+	if mdns.Export != "" || mdns.Import != "" || mdns.Announce {
+		config.MDNS = &mdns
+	}
+	if weights != "" {
+		config.AdaptiveWeights = new(server.AdaptiveWeights)
+		if err := json.Unmarshal([]byte(weights), config.AdaptiveWeights); err != nil {
+			log.Fatalf("skydns: adaptive weights are invalid: %s", err)
+		}
+	}
+	if subnet != "" {
+		config.ClientSubnet = new(server.ClientSubnet)
+		if err := json.Unmarshal([]byte(subnet), config.ClientSubnet); err != nil {
+			log.Fatalf("skydns: client subnet is invalid: %s", err)
+		}
+	}
+	if cookies != "" {
+		config.Cookies = new(server.Cookies)
+		if err := json.Unmarshal([]byte(cookies), config.Cookies); err != nil {
+			log.Fatalf("skydns: cookies are invalid: %s", err)
+		}
+	}
+	if dns64 != "" {
+		config.DNS64 = new(server.DNS64)
+		if err := json.Unmarshal([]byte(dns64), config.DNS64); err != nil {
+			log.Fatalf("skydns: dns64 is invalid: %s", err)
+		}
+	}
+	if proxy != "" {
+		config.ProxyProtocol = new(server.ProxyProtocol)
+		if err := json.Unmarshal([]byte(proxy), config.ProxyProtocol); err != nil {
+			log.Fatalf("skydns: proxy-protocol is invalid: %s", err)
+		}
+	}
+	if faults != "" {
+		config.Faults = new(server.Faults)
+		if err := json.Unmarshal([]byte(faults), config.Faults); err != nil {
+			log.Fatalf("skydns: faults are invalid: %s", err)
+		}
+	}
 	if err := validateHostPort(config.DnsAddr); err != nil {
 		log.Fatalf("skydns: addr is invalid: %s", err)
 	}
 
-	if config.Etcd3 {
+	switch {
+	case consul:
+		kv := backendconsul.NewBackend(http.DefaultClient, ctx, &backendconsul.Config{Addr: consulAddr, Token: consulToken})
+		if err := loadConsulConfig(kv, config); err != nil {
+			log.Fatalf("skydns: %s", err)
+		}
+	case redis:
+		// Only to read the config, it stops following the changes when done.
+		kctx, cancel := context.WithCancel(ctx)
+		kv := backendredis.NewBackend(kctx, &backendredis.Config{Addr: redisAddr, Password: redisPassword, DB: redisDB})
+		err := loadRedisConfig(kv, config)
+		cancel()
+		if err != nil {
+			log.Fatalf("skydns: %s", err)
+		}
+	case file:
+		// The configuration is in the flags and environment only.
+	case config.Etcd3:
 		if err := loadEtcdV3Config(clientv3, config); err != nil {
 			log.Fatalf("skydns: %s", err)
 		}
-	} else {
+	default:
 		if err := loadEtcdV2Config(clientv2, config); err != nil {
 			log.Fatalf("skydns: %s", err)
 		}
@@ -162,31 +429,89 @@ func main() {
 		config.Local = dns.Fqdn(config.Local)
 	}
 
-	var backend server.Backend
-	if config.Etcd3 {
-		backend = backendetcdv3.NewBackendv3(clientv3, ctx, &backendetcdv3.Config{
-			Ttl:      config.Ttl,
-			Priority: config.Priority,
-		})
-	} else {
-		backend = backendetcd.NewBackend(clientv2, ctx, &backendetcd.Config{
-			Ttl:      config.Ttl,
-			Priority: config.Priority,
+	newBackend := func(prefix string) server.Backend {
+		if consul {
+			return backendconsul.NewBackend(http.DefaultClient, ctx, &backendconsul.Config{
+				Ttl:        config.Ttl,
+				Priority:   config.Priority,
+				PathPrefix: prefix,
+				// The tenants and views have their own keys in the KV store.
+				Catalog: consulCatalog && prefix == "",
+				Domain:  config.Domain,
+				Addr:    consulAddr,
+				Token:   consulToken,
+			})
+		}
+		if redis {
+			return backendredis.NewBackend(ctx, &backendredis.Config{
+				Ttl:        config.Ttl,
+				Priority:   config.Priority,
+				PathPrefix: prefix,
+				Addr:       redisAddr,
+				Password:   redisPassword,
+				DB:         redisDB,
+			})
+		}
+		if file {
+			return backendfile.NewBackend(ctx, &backendfile.Config{
+				Ttl:        config.Ttl,
+				Priority:   config.Priority,
+				PathPrefix: prefix,
+				Path:       filePath,
+				Origin:     config.Domain,
+			})
+		}
+		if config.Etcd3 {
+			return backendetcdv3.NewBackendv3(clientv3, ctx, &backendetcdv3.Config{
+				Ttl:        config.Ttl,
+				Priority:   config.Priority,
+				PathPrefix: prefix,
+			})
+		}
+		return backendetcd.NewBackend(clientv2, ctx, &backendetcd.Config{
+			Ttl:        config.Ttl,
+			Priority:   config.Priority,
+			PathPrefix: prefix,
 		})
 	}
 
+	backend := newBackend("")
 	s := server.New(backend, config)
+	for _, t := range config.Tenants {
+		if err := s.AddTenant(t, newBackend(t.PathPrefix())); err != nil {
+			log.Fatalf("skydns: tenant %s: %s", t.Name, err)
+		}
+	}
+	for _, v := range config.Views {
+		s.AddView(v, newBackend(v.PathPrefix()))
+	}
 	if stub {
 		s.UpdateStubZones()
 		go func() {
 			duration := 1 * time.Second
 
-			if config.Etcd3 {
+			if consul || redis || file {
+				for {
+					err := backend.(server.Watcher).Watch(ctx, func(c msg.Change) {
+						if strings.Contains(c.Key, "/dns/stub/") {
+							s.UpdateStubZones()
+							log.Printf("skydns: stubzone update")
+							duration = 1 * time.Second // reset
+						}
+					})
+					log.Printf("skydns: stubzone update failed: %s, sleeping %s + ~3s", err, duration)
+					time.Sleep(duration + (time.Duration(rand.Float32() * 3e9)))
+					duration *= 2
+					if duration > 32*time.Second {
+						duration = 32 * time.Second
+					}
+				}
+			} else if config.Etcd3 {
 				var watcher etcdv3.WatchChan
 				watcher = clientv3.Watch(ctx, msg.Path(config.Domain)+"/dns/stub/", etcdv3.WithPrefix())
 
 				for wresp := range watcher {
-					if wresp.Err() != nil {
+					if wresp.Err() != nil || s.DropWatch() {
 						log.Printf("skydns: stubzone update failed, sleeping %s + ~3s", duration)
 						time.Sleep(duration + (time.Duration(rand.Float32() * 3e9)))
 						duration *= 2
@@ -206,6 +531,9 @@ func main() {
 
 				for {
 					_, err := watcher.Next(ctx)
+					if err == nil && s.DropWatch() {
+						err = fmt.Errorf("watch event dropped")
+					}
 
 					if err != nil {
 						//
@@ -250,6 +578,30 @@ func loadEtcdV2Config(client etcd.KeysAPI, config *server.Config) error {
 	return nil
 }
 
+func loadConsulConfig(kv *backendconsul.Backend, config *server.Config) error {
+	b, err := kv.Value("/" + msg.PathPrefix + "/config")
+	if err != nil {
+		log.Printf("skydns: falling back to default configuration, could not read from consul: %s", err)
+		return nil
+	}
+	if err := json.Unmarshal(b, config); err != nil {
+		return fmt.Errorf("failed to unmarshal config: %s", err.Error())
+	}
+	return nil
+}
+
+func loadRedisConfig(kv *backendredis.Backend, config *server.Config) error {
+	b, err := kv.Value("/" + msg.PathPrefix + "/config")
+	if err != nil {
+		log.Printf("skydns: falling back to default configuration, could not read from redis: %s", err)
+		return nil
+	}
+	if err := json.Unmarshal(b, config); err != nil {
+		return fmt.Errorf("failed to unmarshal config: %s", err.Error())
+	}
+	return nil
+}
+
 func loadEtcdV3Config(client etcdv3.Client, config *server.Config) error {
 	configPath := "/" + msg.PathPrefix + "/config"
 	resp, err := client.Get(ctx, configPath)
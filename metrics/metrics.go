@@ -9,6 +9,8 @@ import (
 	"net/http"
 	"os"
 	"strconv"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/miekg/dns"
@@ -24,22 +26,42 @@ var (
 	requestCount    *prometheus.CounterVec
 	requestDuration *prometheus.HistogramVec
 	responseSize    *prometheus.HistogramVec
+	responseSizeRaw *prometheus.HistogramVec
 	errorCount      *prometheus.CounterVec
 	cacheMiss       *prometheus.CounterVec
+	shedCount       prometheus.Counter
+	loopCount       *prometheus.CounterVec
+	tenantCount     *prometheus.CounterVec
+	tenantQuota     *prometheus.CounterVec
+	stageDuration   *prometheus.HistogramVec
+	degradedGauge   prometheus.Gauge
+	weightFactor    *prometheus.GaugeVec
+
+	degraded int32 // 1 in degraded mode, for readyz
+
+	// hooks holds the []Hook called by ReportStage, it is copied on write so
+	// reading it on the hot path takes no lock.
+	hooks   atomic.Value
+	hooksMu sync.Mutex // serializes AddHook
 )
 
 type (
 	System    string
 	Cause     string
 	CacheType string
+	Stage     string
 )
 
 var (
-	Auth    System = "auth"
-	Cache   System = "cache"
-	Rec     System = "recursive"
-	Reverse System = "reverse"
-	Stub    System = "stub"
+	Auth     System = "auth"
+	Cache    System = "cache"
+	Rec      System = "recursive"
+	Reverse  System = "reverse"
+	Stub     System = "stub"
+	Notify   System = "notify"
+	Hosts    System = "hosts"
+	Transfer System = "transfer"
+	Update   System = "update"
 
 	Nxdomain  Cause = "nxdomain"
 	Nodata    Cause = "nodata"
@@ -48,10 +70,35 @@ var (
 	Overflow  Cause = "overflow"
 	Fail      Cause = "servfail"
 
+	// Causes for tenant requests refused by their quotas.
+	ACL     Cause = "acl"
+	QPS     Cause = "qps"
+	Records Cause = "records"
+
 	Response  CacheType = "response"
 	Signature CacheType = "signature"
+
+	StageParse   Stage = "parse"
+	StageCache   Stage = "cache"
+	StageBackend Stage = "backend"
+	StageGroup   Stage = "group"
+	StageSign    Stage = "sign"
+	StageWrite   Stage = "write"
 )
 
+// Hook is called with the duration of every stage of handling a query. Hooks run
+// on the hot path, they must be cheap and must not block.
+type Hook func(st Stage, d time.Duration)
+
+// AddHook adds h to the hooks called by ReportStage. It is safe to call while
+// queries are served.
+func AddHook(h Hook) {
+	hooksMu.Lock()
+	defer hooksMu.Unlock()
+	hx, _ := hooks.Load().([]Hook)
+	hooks.Store(append(hx[:len(hx):len(hx)], h))
+}
+
 func defineMetrics() {
 	requestCount = prometheus.NewCounterVec(prometheus.CounterOpts{
 		Namespace: Namespace,
@@ -79,6 +126,17 @@ func defineMetrics() {
 		},
 	}, []string{"system"})
 
+	responseSizeRaw = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: Namespace,
+		Subsystem: Subsystem,
+		Name:      "dns_response_uncompressed_size_bytes",
+		Help:      "Size of the returned response in bytes before name compression.",
+		Buckets: []float64{0, 512, 1024, 1500, 2048, 4096,
+			8192, 12288, 16384, 20480, 24576, 28672, 32768, 36864,
+			40960, 45056, 49152, 53248, 57344, 61440, 65536,
+		},
+	}, []string{"system"})
+
 	errorCount = prometheus.NewCounterVec(prometheus.CounterOpts{
 		Namespace: Namespace,
 		Subsystem: Subsystem,
@@ -92,6 +150,56 @@ func defineMetrics() {
 		Name:      "dns_cachemiss_count_total",
 		Help:      "Counter of DNS requests that result in a cache miss.",
 	}, []string{"cache"})
+
+	shedCount = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: Namespace,
+		Subsystem: Subsystem,
+		Name:      "dns_shed_count_total",
+		Help:      "Counter of DNS requests shed because all workers were busy.",
+	})
+
+	loopCount = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: Namespace,
+		Subsystem: Subsystem,
+		Name:      "dns_loop_count_total",
+		Help:      "Counter of DNS requests not forwarded because they would loop.",
+	}, []string{"system"})
+
+	tenantCount = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: Namespace,
+		Subsystem: Subsystem,
+		Name:      "dns_tenant_request_count_total",
+		Help:      "Counter of DNS requests made for a tenant's zone.",
+	}, []string{"tenant"})
+
+	tenantQuota = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: Namespace,
+		Subsystem: Subsystem,
+		Name:      "dns_tenant_quota_count_total",
+		Help:      "Counter of DNS requests for a tenant's zone refused by its ACL or quotas.",
+	}, []string{"tenant", "cause"})
+
+	degradedGauge = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: Namespace,
+		Subsystem: Subsystem,
+		Name:      "dns_degraded",
+		Help:      "1 when the backend lost its quorum and stale cached responses are served.",
+	})
+
+	weightFactor = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: Namespace,
+		Subsystem: Subsystem,
+		Name:      "dns_srv_weight_factor",
+		Help:      "Factor the weight of an SRV endpoint is multiplied with, from its error rate and latency.",
+	}, []string{"endpoint"})
+
+	stageDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: Namespace,
+		Subsystem: Subsystem,
+		Name:      "dns_stage_duration_seconds",
+		Help:      "Histogram of the time (in seconds) each stage of handling a request took.",
+		Buckets:   prometheus.ExponentialBuckets(0.000001, 4, 12), // 1µs up to 4s
+	}, []string{"stage"})
 }
 
 // Metrics registers the DNS metrics to Prometheus, and starts the internal metrics
@@ -113,10 +221,19 @@ func Metrics() error {
 	prometheus.MustRegister(requestCount)
 	prometheus.MustRegister(requestDuration)
 	prometheus.MustRegister(responseSize)
+	prometheus.MustRegister(responseSizeRaw)
 	prometheus.MustRegister(errorCount)
 	prometheus.MustRegister(cacheMiss)
+	prometheus.MustRegister(shedCount)
+	prometheus.MustRegister(loopCount)
+	prometheus.MustRegister(tenantCount)
+	prometheus.MustRegister(tenantQuota)
+	prometheus.MustRegister(stageDuration)
+	prometheus.MustRegister(degradedGauge)
+	prometheus.MustRegister(weightFactor)
 
 	http.Handle(Path, prometheus.Handler())
+	http.HandleFunc("/readyz", readyz)
 	go func() {
 		fmt.Errorf("%s", http.ListenAndServe(":"+Port, nil))
 	}()
@@ -136,6 +253,21 @@ func ReportDuration(resp *dns.Msg, start time.Time, sys System) {
 	responseSize.WithLabelValues(string(sys)).Observe(rlen)
 }
 
+// ReportCompression reports the size of resp without name compression. Together
+// with dns_response_size_bytes this shows how much compression saves.
+func ReportCompression(resp *dns.Msg, sys System) {
+	if resp == nil || responseSizeRaw == nil {
+		return
+	}
+
+	compress := resp.Compress
+	resp.Compress = false
+	rlen := resp.Len()
+	resp.Compress = compress
+
+	responseSizeRaw.WithLabelValues(string(sys)).Observe(float64(rlen))
+}
+
 func ReportRequestCount(req *dns.Msg, sys System) {
 	if requestCount == nil {
 		return
@@ -177,6 +309,86 @@ func ReportCacheMiss(ca CacheType) {
 	cacheMiss.WithLabelValues(string(ca)).Inc()
 }
 
+func ReportShedCount() {
+	if shedCount == nil {
+		return
+	}
+	shedCount.Inc()
+}
+
+func ReportLoopCount(sys System) {
+	if loopCount == nil {
+		return
+	}
+	loopCount.WithLabelValues(string(sys)).Inc()
+}
+
+// ReportWeightFactor reports the factor the weight of an SRV endpoint is multiplied
+// with. A negative factor removes the endpoint.
+func ReportWeightFactor(endpoint string, f float64) {
+	if weightFactor == nil {
+		return
+	}
+	if f < 0 {
+		weightFactor.DeleteLabelValues(endpoint)
+		return
+	}
+	weightFactor.WithLabelValues(endpoint).Set(f)
+}
+
+func ReportTenantRequestCount(tenant string) {
+	if tenantCount == nil {
+		return
+	}
+	tenantCount.WithLabelValues(tenant).Inc()
+}
+
+func ReportTenantQuotaCount(tenant string, c Cause) {
+	if tenantQuota == nil {
+		return
+	}
+	tenantQuota.WithLabelValues(tenant, string(c)).Inc()
+}
+
+// ReportDegraded reports if we are in degraded mode, because the backend lost its
+// quorum.
+func ReportDegraded(d bool) {
+	v := int32(0)
+	if d {
+		v = 1
+	}
+	atomic.StoreInt32(&degraded, v)
+	if degradedGauge == nil {
+		return
+	}
+	degradedGauge.Set(float64(v))
+}
+
+// readyz answers readiness probes. In degraded mode queries are still answered,
+// so we are ready, but the body says degraded.
+func readyz(w http.ResponseWriter, r *http.Request) {
+	if atomic.LoadInt32(&degraded) == 1 {
+		fmt.Fprintln(w, "degraded: backend lost its quorum")
+		return
+	}
+	fmt.Fprintln(w, "ok")
+}
+
+// ReportStage reports the time since start as the duration of stage st.
+func ReportStage(st Stage, start time.Time) {
+	hx, _ := hooks.Load().([]Hook)
+	if stageDuration == nil && len(hx) == 0 {
+		return
+	}
+	d := time.Since(start)
+	if stageDuration != nil {
+		stageDuration.WithLabelValues(string(st)).Observe(d.Seconds())
+	}
+	for _, h := range hx {
+		h(st, d)
+	}
+}
+
 func envOrDefault(env, def string) string {
 	e := os.Getenv(env)
 	if e != "" {
@@ -0,0 +1,85 @@
+// Copyright (c) 2014 The SkyDNS Authors. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package main
+
+import (
+	"log"
+
+	"github.com/skynetservices/skydns/msg"
+
+	etcd "github.com/coreos/etcd/client"
+	etcdv3 "github.com/coreos/etcd/clientv3"
+)
+
+// migrateEtcd copies the keys under our path prefix from etcd's v2 API to its v3
+// API, to move to -etcd3. The two APIs don't share their data. A key with a TTL
+// is attached to a lease of that TTL, keys with the same TTL share a lease. Keys
+// that are already in v3 are left alone, so it can be run again.
+func migrateEtcd(machines []string) error {
+	v2, err := newEtcdV2Client(machines, tlspem, tlskey, cacert, username, password)
+	if err != nil {
+		return err
+	}
+	v3, err := newEtcdV3Client(machines, tlspem, tlskey, cacert)
+	if err != nil {
+		return err
+	}
+	defer v3.Close()
+
+	resp, err := v2.Get(ctx, "/"+msg.PathPrefix, &etcd.GetOptions{Recursive: true})
+	if err != nil {
+		return err
+	}
+	var (
+		copied, skipped int
+		leases          = make(map[int64]etcdv3.LeaseID)
+	)
+	var walk func(n *etcd.Node, ttl int64) error
+	walk = func(n *etcd.Node, ttl int64) error {
+		// The keys in a directory with a TTL expire with it.
+		if n.TTL > 0 && (ttl == 0 || n.TTL < ttl) {
+			ttl = n.TTL
+		}
+		if n.Dir {
+			for _, c := range n.Nodes {
+				if err := walk(c, ttl); err != nil {
+					return err
+				}
+			}
+			return nil
+		}
+		var opts []etcdv3.OpOption
+		if ttl > 0 {
+			id, ok := leases[ttl]
+			if !ok {
+				lease, err := v3.Grant(ctx, ttl)
+				if err != nil {
+					return err
+				}
+				id = lease.ID
+				leases[ttl] = id
+			}
+			opts = append(opts, etcdv3.WithLease(id))
+		}
+		txn, err := v3.Txn(ctx).
+			If(etcdv3.Compare(etcdv3.CreateRevision(n.Key), "=", 0)).
+			Then(etcdv3.OpPut(n.Key, n.Value, opts...)).
+			Commit()
+		if err != nil {
+			return err
+		}
+		if txn.Succeeded {
+			copied++
+		} else {
+			skipped++
+		}
+		return nil
+	}
+	if err := walk(resp.Node, 0); err != nil {
+		return err
+	}
+	log.Printf("skydns: copied %d keys under /%s to etcd v3, %d were already there", copied, msg.PathPrefix, skipped)
+	return nil
+}
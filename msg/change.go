@@ -0,0 +1,24 @@
+// Copyright (c) 2014 The SkyDNS Authors. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package msg
+
+// ChangeType is the type of a Change.
+type ChangeType string
+
+const (
+	Added   ChangeType = "added"
+	Changed ChangeType = "changed"
+	Removed ChangeType = "removed"
+)
+
+// Change is a service added, changed or removed in the backend. When a directory
+// is removed, a single Change is seen for it.
+type Change struct {
+	Type ChangeType `json:"type"`
+	Name string     `json:"name"`
+	Key  string     `json:"key"`
+	// Service is the new service, nil when it is removed.
+	Service *Service `json:"service,omitempty"`
+}
@@ -0,0 +1,104 @@
+// Copyright (c) 2014 The SkyDNS Authors. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package msg
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// bareService is a Service without its Key and TTLs, two services with the same
+// bareService give the same records and are served the same way.
+type bareService struct {
+	Host          string
+	Hosts         string
+	Port          int
+	Priority      int
+	Weight        int
+	Text          string
+	Mail          bool
+	Meta          string
+	Tags          string
+	TargetStrip   int
+	TargetRewrite TargetRewrite
+	Srv           string
+	Proto         string
+	Mdns          bool
+	Alias         bool
+	Group         string
+	GroupWeight   int
+	ActiveFrom    int64
+	ActiveUntil   int64
+	Expires       int64
+	Naptr         NAPTR
+	Caa           CAA
+	Tlsa          TLSA
+	Ds            DS
+	Uri           string
+	Svcb          *SVCB // never equal, SVCB isn't comparable
+	Dname         string
+	Raw           string
+}
+
+func newBareService(s *Service) bareService {
+	b := bareService{
+		Host: s.Host, Hosts: strings.Join(s.Hosts, ","), Port: s.Port, Priority: s.Priority, Weight: s.Weight,
+		Text: s.Text, Mail: s.Mail, Tags: strings.Join(s.Tags, ","), TargetStrip: s.TargetStrip,
+		Srv: s.Srv, Proto: s.Proto, Mdns: s.Mdns, Alias: s.Alias, Group: s.Group, GroupWeight: s.GroupWeight,
+		Uri: s.Uri, Svcb: s.Svcb, Dname: s.Dname, Raw: s.Raw,
+	}
+	if len(s.Meta) > 0 {
+		b.Meta = fmt.Sprint(s.Meta) // sorted by key
+	}
+	if s.TargetRewrite != nil {
+		b.TargetRewrite = *s.TargetRewrite
+	}
+	b.ActiveFrom, b.ActiveUntil = unixNano(s.ActiveFrom), unixNano(s.ActiveUntil)
+	if s.Expires != nil {
+		b.Expires = unixNano(&s.Expires.Time)
+	}
+	if s.Naptr != nil {
+		b.Naptr = *s.Naptr
+	}
+	if s.Caa != nil {
+		b.Caa = *s.Caa
+	}
+	if s.Tlsa != nil {
+		b.Tlsa = *s.Tlsa
+	}
+	if s.Ds != nil {
+		b.Ds = *s.Ds
+	}
+	return b
+}
+
+func unixNano(t *time.Time) int64 {
+	if t == nil {
+		return 0
+	}
+	return t.UnixNano()
+}
+
+// Dedup returns sx without the services that are the same as a service before
+// them, but for their Key and TTLs, in place. As services that are the same are
+// also active at the same time, it doesn't matter if the services that are not
+// active are left out first.
+func Dedup(sx []Service) []Service {
+	if len(sx) < 2 {
+		return sx
+	}
+	seen := make(map[bareService]bool, len(sx))
+	ret := sx[:0]
+	for _, s := range sx {
+		b := newBareService(&s)
+		if seen[b] {
+			continue
+		}
+		seen[b] = true
+		ret = append(ret, s)
+	}
+	return ret
+}
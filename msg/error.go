@@ -0,0 +1,19 @@
+// Copyright (c) 2014 The SkyDNS Authors. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package msg
+
+import "errors"
+
+// ErrNotFound is returned by a backend for a name it has no services for, or a
+// name below a service. The server answers NXDOMAIN for it.
+var ErrNotFound = errors.New("name not found")
+
+// UnavailableError is returned by a backend that can't reach its store, as
+// opposed to a store that fails a request.
+type UnavailableError struct {
+	Err error
+}
+
+func (e *UnavailableError) Error() string { return e.Err.Error() }
@@ -0,0 +1,66 @@
+// Copyright (c) 2014 The SkyDNS Authors. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package msg
+
+import (
+	"encoding/json"
+	"sync"
+	"sync/atomic"
+)
+
+// maxInterned caps the number of strings Intern keeps.
+const maxInterned = 1 << 16
+
+var (
+	interned  sync.Map
+	ninterned int64
+
+	decodeBuf = sync.Pool{New: func() interface{} { return new([]byte) }}
+)
+
+// Intern returns a canonical copy of str. Host names and groups are shared by
+// many services and decoded again on every query, interning them lets the
+// decoded copies be collected right away. Once maxInterned strings are kept,
+// new strings are returned as is.
+func Intern(str string) string {
+	if v, ok := interned.Load(str); ok {
+		return v.(string)
+	}
+	if atomic.LoadInt64(&ninterned) >= maxInterned {
+		return str
+	}
+	if v, loaded := interned.LoadOrStore(str, str); loaded {
+		return v.(string)
+	}
+	atomic.AddInt64(&ninterned, 1)
+	return str
+}
+
+// Decode decodes the JSON service in b into s, the Host, Hosts, Tags and Group
+// of s are interned.
+func Decode(b []byte, s *Service) error {
+	if err := json.Unmarshal(b, s); err != nil {
+		return err
+	}
+	s.Host = Intern(s.Host)
+	for i := range s.Hosts {
+		s.Hosts[i] = Intern(s.Hosts[i])
+	}
+	for i := range s.Tags {
+		s.Tags[i] = Intern(s.Tags[i])
+	}
+	s.Group = Intern(s.Group)
+	return nil
+}
+
+// DecodeString is like Decode, but copies value into a reused buffer instead
+// of a freshly allocated one.
+func DecodeString(value string, s *Service) error {
+	b := decodeBuf.Get().(*[]byte)
+	*b = append((*b)[:0], value...)
+	err := Decode(*b, s)
+	decodeBuf.Put(b)
+	return err
+}
@@ -0,0 +1,13 @@
+// Copyright (c) 2014 The SkyDNS Authors. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package msg
+
+// Revision describes the state of the keys under a name in the backend. Keys
+// added or updated raise Modified, keys deleted lower Keys (or Modified).
+type Revision struct {
+	Modified uint64 // Highest modification revision of the keys under the name.
+	Keys     int    // Number of keys under the name.
+	Current  uint64 // Current revision of the whole store, this never decreases.
+}
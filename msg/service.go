@@ -5,9 +5,14 @@
 package msg
 
 import (
+	"fmt"
+	"math/rand"
 	"net"
 	"path"
+	"sort"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/miekg/dns"
 )
@@ -24,13 +29,27 @@ var PathPrefix string = "skydns"
 // Host (Target in SRV) must be a domain name, but if it looks like an IP
 // address (4/6), we will treat it like an IP address.
 type Service struct {
-	Host     string `json:"host,omitempty"`
-	Port     int    `json:"port,omitempty"`
-	Priority int    `json:"priority,omitempty"`
-	Weight   int    `json:"weight,omitempty"`
-	Text     string `json:"text,omitempty"`
-	Mail     bool   `json:"mail,omitempty"` // Be an MX record. Priority becomes Preference.
-	Ttl      uint32 `json:"ttl,omitempty"`
+	Host     string   `json:"host,omitempty"`
+	Hosts    []string `json:"hosts,omitempty"` // More hosts, each served as the Host of a service of its own under the same key.
+	Port     int      `json:"port,omitempty"`
+	Priority int      `json:"priority,omitempty"`
+	Weight   int      `json:"weight,omitempty"`
+	Text     string   `json:"text,omitempty"`
+	Mail     bool     `json:"mail,omitempty"` // Be an MX record. Priority becomes Preference.
+	Ttl      uint32   `json:"ttl,omitempty"`
+
+	// TtlA, TtlSRV and TtlTXT override Ttl for the A and AAAA, the SRV and the
+	// TXT records of the service, when set.
+	TtlA   uint32 `json:"ttla,omitempty"`
+	TtlSRV uint32 `json:"ttlsrv,omitempty"`
+	TtlTXT uint32 `json:"ttltxt,omitempty"`
+
+	// Meta is added to the TXT record of the service, after Text, as key=value
+	// strings (RFC 1464) sorted by key.
+	Meta map[string]string `json:"meta,omitempty"`
+	// Tags, like a datacenter, version or tier, select the service in a query
+	// for _tag.<tag>.<name>, which only returns the services of name with that tag.
+	Tags []string `json:"tags,omitempty"`
 
 	// When a SRV record with a "Host: IP-address" is added, we synthesize
 	// a srv.Target domain name.  Normally we convert the full Key where
@@ -38,40 +57,297 @@ type Service struct {
 	// TargetStrip > 0 we strip the left most TargetStrip labels from the
 	// DNS name.
 	TargetStrip int `json:"targetstrip,omitempty"`
+	// TargetRewrite rewrites the target, after TargetStrip, for instance into a
+	// name that resolves outside of SkyDNS, see TargetRewrite.
+	TargetRewrite *TargetRewrite `json:"targetrewrite,omitempty"`
+
+	// Srv and Proto are the RFC 2782 service and protocol names, without the
+	// leading underscore, e.g. "http" and "tcp". When set, an SRV query for
+	// _http._tcp.<name> also returns this service if it lives under <name>.
+	Srv   string `json:"srv,omitempty"`
+	Proto string `json:"proto,omitempty"`
+
+	// Mdns announces the service on the local link over multicast DNS, as
+	// NAME.local. and, with Srv and Proto, as a DNS-SD instance, when SkyDNS
+	// bridges mDNS with announce set. NAME is the first label of its key.
+	Mdns bool `json:"mdns,omitempty"`
+
+	// Alias makes a Host that is a name an alias instead of a CNAME: queries for
+	// addresses are answered with the addresses of Host, so it can be used at
+	// the apex of a zone.
+	Alias bool `json:"alias,omitempty"`
 
 	// Group is used to group (or *not* to group) different services
 	// together. Services with an identical Group are returned in the same
 	// answer.
 	Group string `json:"group,omitempty"`
+	// GroupWeight is the weight of the service's Group when several groups are
+	// found for a name, see Group.
+	GroupWeight int `json:"groupweight,omitempty"`
+
+	// ActiveFrom and ActiveUntil limit the time the service is served, for
+	// instance to stage a change before a cutover. Either may be unset.
+	ActiveFrom  *time.Time `json:"activefrom,omitempty"`
+	ActiveUntil *time.Time `json:"activeuntil,omitempty"`
+	// Expires is when the service is no longer served, even if its key is still
+	// there, for instance because the etcd TTL is coarser. It is RFC 3339 or
+	// seconds since the Unix epoch.
+	Expires *Time `json:"expires,omitempty"`
+
+	// Naptr makes the service *also* a NAPTR record, for instance to map an
+	// E.164 number to a SIP URI, see NAPTR.
+	Naptr *NAPTR `json:"naptr,omitempty"`
+	// Caa makes the service *also* a CAA record, which tells certificate
+	// authorities if they may issue certificates for the name, see CAA.
+	Caa *CAA `json:"caa,omitempty"`
+	// Tlsa gives the service a TLSA record for DANE, served for
+	// _<port>._<proto>.<name>, with the Port and Proto of the service, see TLSA.
+	Tlsa *TLSA `json:"tlsa,omitempty"`
+	// Ds makes the service a DS record of a delegated zone, when it is stored
+	// under dns/ds in that zone, see DS.
+	Ds *DS `json:"ds,omitempty"`
+	// Uri makes the service *also* a URI record (RFC 7553) with this target
+	// URI, e.g. "https://www.example.com/api", and the Priority and Weight of
+	// the service.
+	Uri string `json:"uri,omitempty"`
+	// Svcb makes the service *also* an SVCB and HTTPS record, see SVCB.
+	Svcb *SVCB `json:"svcb,omitempty"`
+	// Dname makes the service a DNAME record, aliasing the names below the name
+	// of the service to the names below Dname.
+	Dname string `json:"dname,omitempty"`
+	// Raw makes the service *also* a record of a type we don't model, in zone
+	// file format, e.g. `HINFO "amd64" "linux"`, see NewRaw.
+	Raw string `json:"raw,omitempty"`
 
 	// Etcd key where we found this service and ignored from json un-/marshalling
 	Key string `json:"-"`
 }
 
+// NAPTR is the rdata of a NAPTR record (RFC 3403). Either Regexp or Replacement
+// is set, an empty Replacement becomes ".".
+type NAPTR struct {
+	Order       int    `json:"order,omitempty"`
+	Preference  int    `json:"preference,omitempty"`
+	Flags       string `json:"flags,omitempty"`
+	Service     string `json:"service,omitempty"`
+	Regexp      string `json:"regexp,omitempty"`
+	Replacement string `json:"replacement,omitempty"`
+}
+
+// CAA is the rdata of a CAA record (RFC 8659). Tag is "issue", "issuewild" or
+// "iodef", a Flag of 128 marks the record critical.
+type CAA struct {
+	Flag  int    `json:"flag,omitempty"`
+	Tag   string `json:"tag,omitempty"`
+	Value string `json:"value,omitempty"`
+}
+
+// TLSA is the rdata of a TLSA record (RFC 6698), Certificate is the hex encoded
+// certificate association data.
+type TLSA struct {
+	Usage        int    `json:"usage,omitempty"`
+	Selector     int    `json:"selector,omitempty"`
+	MatchingType int    `json:"matchingtype,omitempty"`
+	Certificate  string `json:"certificate,omitempty"`
+}
+
+// DS is the rdata of a DS record (RFC 4034), the digest of a key of a delegated
+// zone. Digest is hex encoded.
+type DS struct {
+	KeyTag     int    `json:"keytag,omitempty"`
+	Algorithm  int    `json:"algorithm,omitempty"`
+	DigestType int    `json:"digesttype,omitempty"`
+	Digest     string `json:"digest,omitempty"`
+}
+
+// Time is a time in JSON as an RFC 3339 string, or as a number of seconds since
+// the Unix epoch.
+type Time struct {
+	time.Time
+}
+
+// UnmarshalJSON implements json.Unmarshaler.
+func (t *Time) UnmarshalJSON(b []byte) error {
+	if len(b) > 0 && b[0] == '"' {
+		return t.Time.UnmarshalJSON(b)
+	}
+	sec, err := strconv.ParseInt(string(b), 10, 64)
+	if err != nil {
+		return fmt.Errorf("time %s is not RFC 3339 or seconds since the epoch", b)
+	}
+	t.Time = time.Unix(sec, 0).UTC()
+	return nil
+}
+
+// Active returns true if the service is to be served at t.
+func (s *Service) Active(t time.Time) bool {
+	if s.ActiveFrom != nil && t.Before(*s.ActiveFrom) {
+		return false
+	}
+	until := s.Until()
+	return until == nil || t.Before(*until)
+}
+
+// Until returns the time the service is no longer served, the earlier of
+// ActiveUntil and Expires, or nil if it is served indefinitely.
+func (s *Service) Until() *time.Time {
+	if s.Expires == nil || s.ActiveUntil != nil && s.ActiveUntil.Before(s.Expires.Time) {
+		return s.ActiveUntil
+	}
+	return &s.Expires.Time
+}
+
+// HasTag returns true if the service has tag, tags are compared case
+// insensitively as they are part of a name.
+func (s *Service) HasTag(tag string) bool {
+	for _, t := range s.Tags {
+		if strings.EqualFold(t, tag) {
+			return true
+		}
+	}
+	return false
+}
+
+// CapTtl lowers Ttl, and the overrides of it that are set, to max.
+func (s *Service) CapTtl(max uint32) {
+	if s.Ttl == 0 || max < s.Ttl {
+		s.Ttl = max
+	}
+	for _, ttl := range []*uint32{&s.TtlA, &s.TtlSRV, &s.TtlTXT} {
+		if *ttl != 0 && max < *ttl {
+			*ttl = max
+		}
+	}
+}
+
+// ttl returns override if it is set, Ttl otherwise.
+func (s *Service) ttl(override uint32) uint32 {
+	if override != 0 {
+		return override
+	}
+	return s.Ttl
+}
+
 // NewSRV returns a new SRV record based on the Service.
 func (s *Service) NewSRV(name string, weight uint16) *dns.SRV {
-	host := targetStrip(dns.Fqdn(s.Host), s.TargetStrip)
+	host := s.target()
 
-	return &dns.SRV{Hdr: dns.RR_Header{Name: name, Rrtype: dns.TypeSRV, Class: dns.ClassINET, Ttl: s.Ttl},
+	return &dns.SRV{Hdr: dns.RR_Header{Name: name, Rrtype: dns.TypeSRV, Class: dns.ClassINET, Ttl: s.ttl(s.TtlSRV)},
 		Priority: uint16(s.Priority), Weight: weight, Port: uint16(s.Port), Target: host}
 }
 
 // NewMX returns a new MX record based on the Service.
 func (s *Service) NewMX(name string) *dns.MX {
-	host := targetStrip(dns.Fqdn(s.Host), s.TargetStrip)
+	host := s.target()
 
 	return &dns.MX{Hdr: dns.RR_Header{Name: name, Rrtype: dns.TypeMX, Class: dns.ClassINET, Ttl: s.Ttl},
 		Preference: uint16(s.Priority), Mx: host}
 }
 
+// NewNAPTR returns a new NAPTR record based on the Service, which must have Naptr set.
+func (s *Service) NewNAPTR(name string) *dns.NAPTR {
+	replacement := "."
+	if s.Naptr.Replacement != "" {
+		replacement = Target(s.Naptr.Replacement)
+	}
+
+	return &dns.NAPTR{Hdr: dns.RR_Header{Name: name, Rrtype: dns.TypeNAPTR, Class: dns.ClassINET, Ttl: s.Ttl},
+		Order: uint16(s.Naptr.Order), Preference: uint16(s.Naptr.Preference), Flags: s.Naptr.Flags,
+		Service: s.Naptr.Service, Regexp: s.Naptr.Regexp, Replacement: replacement}
+}
+
+// NewCAA returns a new CAA record based on the Service, which must have Caa set.
+func (s *Service) NewCAA(name string) *dns.CAA {
+	return &dns.CAA{Hdr: dns.RR_Header{Name: name, Rrtype: dns.TypeCAA, Class: dns.ClassINET, Ttl: s.Ttl},
+		Flag: uint8(s.Caa.Flag), Tag: strings.ToLower(s.Caa.Tag), Value: s.Caa.Value}
+}
+
+// NewTLSA returns a new TLSA record based on the Service, which must have Tlsa set.
+func (s *Service) NewTLSA(name string) *dns.TLSA {
+	return &dns.TLSA{Hdr: dns.RR_Header{Name: name, Rrtype: dns.TypeTLSA, Class: dns.ClassINET, Ttl: s.Ttl},
+		Usage: uint8(s.Tlsa.Usage), Selector: uint8(s.Tlsa.Selector), MatchingType: uint8(s.Tlsa.MatchingType),
+		Certificate: strings.ToLower(s.Tlsa.Certificate)}
+}
+
+// NewDS returns a new DS record based on the Service, which must have Ds set.
+func (s *Service) NewDS(name string) *dns.DS {
+	return &dns.DS{Hdr: dns.RR_Header{Name: name, Rrtype: dns.TypeDS, Class: dns.ClassINET, Ttl: s.Ttl},
+		KeyTag: uint16(s.Ds.KeyTag), Algorithm: uint8(s.Ds.Algorithm), DigestType: uint8(s.Ds.DigestType),
+		Digest: strings.ToUpper(s.Ds.Digest)}
+}
+
+// NewURI returns a new URI record based on the Service, which must have Uri set.
+// Like for SRV records, a Weight of zero is a weight of 100.
+func (s *Service) NewURI(name string) *dns.URI {
+	weight := s.Weight
+	if weight == 0 {
+		weight = 100
+	}
+	return &dns.URI{Hdr: dns.RR_Header{Name: name, Rrtype: dns.TypeURI, Class: dns.ClassINET, Ttl: s.Ttl},
+		Priority: uint16(s.Priority), Weight: uint16(weight), Target: s.Uri}
+}
+
+// FromRR returns the service for the record r, such as a record added by a
+// dynamic update. Records of the types we don't model are stored as Raw.
+func FromRR(r dns.RR) (*Service, error) {
+	serv := &Service{Ttl: r.Header().Ttl}
+	switch r := r.(type) {
+	case *dns.A:
+		serv.Host = r.A.String()
+	case *dns.AAAA:
+		serv.Host = r.AAAA.String()
+	case *dns.CNAME:
+		serv.Host = strings.TrimSuffix(r.Target, ".")
+	case *dns.MX:
+		serv.Host, serv.Mail, serv.Priority = strings.TrimSuffix(r.Mx, "."), true, int(r.Preference)
+	case *dns.SRV:
+		serv.Host, serv.Port = strings.TrimSuffix(r.Target, "."), int(r.Port)
+		serv.Priority, serv.Weight = int(r.Priority), int(r.Weight)
+	case *dns.TXT:
+		serv.Text = strings.Join(r.Txt, "")
+	default:
+		hdr := r.Header()
+		serv.Raw = dns.TypeToString[hdr.Rrtype] + " " + strings.TrimPrefix(r.String(), hdr.String())
+		if _, err := serv.NewRaw(hdr.Name); err != nil {
+			return nil, err
+		}
+	}
+	return serv, nil
+}
+
+// NewRaw returns the record in Raw, with owner name and the TTL of the Service.
+// Raw may have an owner name, TTL and class, they are ignored. Records of the
+// types SkyDNS synthesizes itself are refused, they have fields of their own.
+func (s *Service) NewRaw(name string) (dns.RR, error) {
+	rr, err := dns.NewRR(". " + s.Raw)
+	if err != nil {
+		var err1 error
+		if rr, err1 = dns.NewRR(s.Raw); err1 != nil {
+			return nil, err
+		}
+	}
+	if rr == nil {
+		return nil, fmt.Errorf("no record in %q", s.Raw)
+	}
+	switch rr.Header().Rrtype {
+	case dns.TypeA, dns.TypeAAAA, dns.TypeSRV, dns.TypeTXT, dns.TypeMX, dns.TypeNAPTR, dns.TypeCAA, dns.TypeTLSA,
+		dns.TypeURI, TypeSVCB, TypeHTTPS, dns.TypePTR, dns.TypeNS, dns.TypeCNAME, dns.TypeDNAME, dns.TypeSOA,
+		dns.TypeRRSIG, dns.TypeNSEC, dns.TypeNSEC3, dns.TypeDNSKEY, dns.TypeDS:
+		return nil, fmt.Errorf("raw %s records are not allowed", dns.TypeToString[rr.Header().Rrtype])
+	}
+	hdr := rr.Header()
+	hdr.Name, hdr.Class, hdr.Ttl = name, dns.ClassINET, s.Ttl
+	return rr, nil
+}
+
 // NewA returns a new A record based on the Service.
 func (s *Service) NewA(name string, ip net.IP) *dns.A {
-	return &dns.A{Hdr: dns.RR_Header{Name: name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: s.Ttl}, A: ip}
+	return &dns.A{Hdr: dns.RR_Header{Name: name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: s.ttl(s.TtlA)}, A: ip}
 }
 
 // NewAAAA returns a new AAAA record based on the Service.
 func (s *Service) NewAAAA(name string, ip net.IP) *dns.AAAA {
-	return &dns.AAAA{Hdr: dns.RR_Header{Name: name, Rrtype: dns.TypeAAAA, Class: dns.ClassINET, Ttl: s.Ttl}, AAAA: ip}
+	return &dns.AAAA{Hdr: dns.RR_Header{Name: name, Rrtype: dns.TypeAAAA, Class: dns.ClassINET, Ttl: s.ttl(s.TtlA)}, AAAA: ip}
 }
 
 // NewCNAME returns a new CNAME record based on the Service.
@@ -79,14 +355,46 @@ func (s *Service) NewCNAME(name string, target string) *dns.CNAME {
 	return &dns.CNAME{Hdr: dns.RR_Header{Name: name, Rrtype: dns.TypeCNAME, Class: dns.ClassINET, Ttl: s.Ttl}, Target: target}
 }
 
+// NewDNAME returns a new DNAME record based on the Service, which must have Dname set.
+func (s *Service) NewDNAME(name string) *dns.DNAME {
+	return &dns.DNAME{Hdr: dns.RR_Header{Name: name, Rrtype: dns.TypeDNAME, Class: dns.ClassINET, Ttl: s.Ttl}, Target: Target(s.Dname)}
+}
+
 // NewNS returns a new NS record based on the Service.
 func (s *Service) NewNS(name string, target string) *dns.NS {
 	return &dns.NS{Hdr: dns.RR_Header{Name: name, Rrtype: dns.TypeNS, Class: dns.ClassINET, Ttl: s.Ttl}, Ns: target}
 }
 
-// NewTXT returns a new TXT record based on the Service.
+// NewTXT returns a new TXT record based on the Service, with the strings of Text
+// and Meta.
 func (s *Service) NewTXT(name string) *dns.TXT {
-	return &dns.TXT{Hdr: dns.RR_Header{Name: name, Rrtype: dns.TypeTXT, Class: dns.ClassINET, Ttl: s.Ttl}, Txt: split255(s.Text)}
+	var txt []string
+	if s.Text != "" || len(s.Meta) == 0 {
+		txt = split255(s.Text)
+	}
+	keys := make([]string, 0, len(s.Meta))
+	for k := range s.Meta {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		txt = append(txt, split255(metaKey(k)+"="+s.Meta[k])...)
+	}
+	return &dns.TXT{Hdr: dns.RR_Header{Name: name, Rrtype: dns.TypeTXT, Class: dns.ClassINET, Ttl: s.ttl(s.TtlTXT)}, Txt: txt}
+}
+
+// metaKey escapes the characters in key RFC 1464 requires to be quoted with a
+// backquote: backquotes, equal signs and leading and trailing spaces.
+func metaKey(key string) string {
+	key = strings.NewReplacer("`", "``", "=", "`=").Replace(key)
+	i, j := 0, len(key)
+	for i < j && key[i] == ' ' {
+		i++
+	}
+	for j > i && key[j-1] == ' ' {
+		j--
+	}
+	return strings.Repeat("` ", i) + key[i:j] + strings.Repeat("` ", len(key)-j)
 }
 
 // NewPTR returns a new PTR record based on the Service.
@@ -94,32 +402,62 @@ func (s *Service) NewPTR(name string, ttl uint32) *dns.PTR {
 	return &dns.PTR{Hdr: dns.RR_Header{Name: name, Rrtype: dns.TypePTR, Class: dns.ClassINET, Ttl: ttl}, Ptr: dns.Fqdn(s.Host)}
 }
 
+// Target returns the canonical (lower cased and fully qualified) form of
+// host. Name compression in the DNS is case sensitive, so using the canonical
+// form for all synthesized targets lets the targets and the owner names in the
+// additional section share compression pointers.
+func Target(host string) string {
+	return dns.Fqdn(strings.ToLower(host))
+}
+
+// Wildcard is the label used to look up the RFC 4592 wildcard stored under "*".
+// A plain "*" in a name is a search pattern, see PathWithWildcard.
+const Wildcard = `\*`
+
 // As Path, but if a name contains wildcards (* or any), the name will be
 // chopped of before the (first) wildcard, and we do a highler evel search and
 // later find the matching names.  So service.*.skydns.local, will look for all
 // services under skydns.local and will later check for names that match
 // service.*.skydns.local.  If a wildcard is found the returned bool is true.
 func PathWithWildcard(s string) (string, bool) {
+	return PathWithWildcardIn(PathPrefix, s)
+}
+
+// PathWithWildcardIn is PathWithWildcard for data stored under prefix instead of PathPrefix.
+func PathWithWildcardIn(prefix, s string) (string, bool) {
 	l := dns.SplitDomainName(s)
 	for i, j := 0, len(l)-1; i < j; i, j = i+1, j-1 {
 		l[i], l[j] = l[j], l[i]
 	}
 	for i, k := range l {
 		if k == "*" || k == "any" {
-			return path.Join(append([]string{"/" + PathPrefix + "/"}, l[:i]...)...), true
+			return path.Join(append([]string{"/" + prefix + "/"}, l[:i]...)...), true
+		}
+		if k == Wildcard {
+			l[i] = "*"
 		}
 	}
-	return path.Join(append([]string{"/" + PathPrefix + "/"}, l...)...), false
+	return path.Join(append([]string{"/" + prefix + "/"}, l...)...), false
 }
 
 // Path converts a domainname to an etcd path. If s looks like service.staging.skydns.local.,
 // the resulting key will be /skydns/local/skydns/staging/service .
 func Path(s string) string {
+	return PathIn(PathPrefix, s)
+}
+
+// PathIn is Path for data stored under prefix instead of PathPrefix.
+func PathIn(prefix, s string) string {
 	l := dns.SplitDomainName(s)
 	for i, j := 0, len(l)-1; i < j; i, j = i+1, j-1 {
 		l[i], l[j] = l[j], l[i]
 	}
-	return path.Join(append([]string{"/" + PathPrefix + "/"}, l...)...)
+	for i, k := range l {
+		if k == Wildcard {
+			l[i] = "*"
+		}
+	}
+	return path.Join(append([]string{"/" + prefix + "/"}, l...)...)
 }
 
 // Domain is the opposite of Path.
@@ -135,11 +473,17 @@ func Domain(s string) string {
 // Group checks the services in sx, it looks for a Group attribute on the shortest
 // keys. If there are multiple shortest keys *and* the group attribute disagrees (and
 // is not empty), we don't consider it a group.
-// If a group is found, only services with *that* group (or no group) will be returned.
+// If a group is found, only services with *that* group (or no group) will be returned,
+// the returned slice shares its backing array with sx.
+// When services have a GroupWeight, a single group is picked at random instead, using
+// the highest GroupWeight of a group's services as its weight.
 func Group(sx []Service) []Service {
 	if len(sx) == 0 {
 		return sx
 	}
+	if group, ok := weightedGroup(sx); ok {
+		return filterGroup(sx, group)
+	}
 
 	// Shortest key with group attribute sets the group for this set.
 	group := sx[0].Group
@@ -161,26 +505,57 @@ func Group(sx []Service) []Service {
 		return sx
 	}
 
-	ret := []Service{} // with slice-tricks in sx we can prolly save this allocation (TODO)
-
 	for i, s := range sx {
-		if s.Group == "" {
-			ret = append(ret, s)
-			continue
-		}
-
 		// Disagreement on the same level
-		if length[i] == slashes && s.Group != group {
+		if length[i] == slashes && s.Group != "" && s.Group != group {
 			return sx
 		}
+	}
 
-		if s.Group == group {
+	return filterGroup(sx, group)
+}
+
+// filterGroup returns the services in group, or without a group. Filtering is
+// done in place, this reuses the backing array of sx.
+func filterGroup(sx []Service, group string) []Service {
+	ret := sx[:0]
+	for _, s := range sx {
+		if s.Group == "" || s.Group == group {
 			ret = append(ret, s)
 		}
 	}
 	return ret
 }
 
+// weightedGroup picks a group from sx at random, by weight. It returns false if
+// no group has a weight.
+func weightedGroup(sx []Service) (string, bool) {
+	weights := make(map[string]int)
+	for _, s := range sx {
+		if s.Group != "" && s.GroupWeight > weights[s.Group] {
+			weights[s.Group] = s.GroupWeight
+		}
+	}
+	groups := make([]string, 0, len(weights))
+	total := 0
+	for g, w := range weights {
+		groups = append(groups, g)
+		total += w
+	}
+	if total == 0 {
+		return "", false
+	}
+	sort.Strings(groups)
+	r := rand.Intn(total)
+	for _, g := range groups {
+		if r < weights[g] {
+			return g, true
+		}
+		r -= weights[g]
+	}
+	return "", false
+}
+
 // Split255 splits a string into 255 byte chunks.
 func split255(s string) []string {
 	if len(s) < 255 {
@@ -202,6 +577,50 @@ func split255(s string) []string {
 	return sx
 }
 
+// TargetRewrite rewrites a target that matches Pattern into Replacement. Pattern
+// is a name in which a "*" label matches any label, $1 to $9 in Replacement are
+// the labels matched by the first to the ninth "*". For instance the pattern
+// "*.*.skydns.local." and replacement "$1-$2.example.com." rewrite
+// "4.rails.skydns.local." into "4-rails.example.com.".
+type TargetRewrite struct {
+	Pattern     string `json:"pattern,omitempty"`
+	Replacement string `json:"replacement,omitempty"`
+}
+
+// Rewrite returns name, which is canonical, rewritten or as is when it doesn't
+// match Pattern.
+func (r *TargetRewrite) Rewrite(name string) string {
+	pattern := dns.SplitDomainName(strings.ToLower(r.Pattern))
+	labels := dns.SplitDomainName(name)
+	if len(pattern) == 0 || len(pattern) != len(labels) {
+		return name
+	}
+	var captured []string
+	for i, p := range pattern {
+		switch {
+		case p == "*":
+			captured = append(captured, labels[i])
+		case p != labels[i]:
+			return name
+		}
+	}
+	replacement := r.Replacement
+	for i := len(captured); i > 0; i-- {
+		replacement = strings.Replace(replacement, "$"+strconv.Itoa(i), captured[i-1], -1)
+	}
+	return Target(replacement)
+}
+
+// target returns the target of the SRV or MX record of the Service, Host with
+// TargetStrip and TargetRewrite applied.
+func (s *Service) target() string {
+	name := targetStrip(Target(s.Host), s.TargetStrip)
+	if s.TargetRewrite != nil {
+		name = s.TargetRewrite.Rewrite(name)
+	}
+	return name
+}
+
 // targetStrip strips "targetstrip" labels from the left side of the fully qualified name.
 func targetStrip(name string, targetStrip int) string {
 	if targetStrip == 0 {
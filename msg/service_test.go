@@ -4,7 +4,12 @@
 
 package msg
 
-import "testing"
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
 
 func TestPath(t *testing.T) {
 	PathPrefix = "mydns"
@@ -24,6 +29,26 @@ func TestPath(t *testing.T) {
 	}
 }
 
+func TestPathWildcard(t *testing.T) {
+	PathPrefix = "skydns"
+	for _, tc := range []struct {
+		name string
+		path string
+		star bool
+	}{
+		{"*.wild.skydns.local.", "/skydns/local/skydns/wild", true},
+		{Wildcard + ".wild.skydns.local.", "/skydns/local/skydns/wild/*", false},
+		{"a." + Wildcard + ".wild.skydns.local.", "/skydns/local/skydns/wild/*/a", false},
+	} {
+		if p, star := PathWithWildcard(tc.name); p != tc.path || star != tc.star {
+			t.Errorf("PathWithWildcard(%q): expected %s, %t, got %s, %t", tc.name, tc.path, tc.star, p, star)
+		}
+	}
+	if p := Path(Wildcard + ".wild.skydns.local."); p != "/skydns/local/skydns/wild/*" {
+		t.Errorf("Path: expected %s, got %s", "/skydns/local/skydns/wild/*", p)
+	}
+}
+
 func TestSplit255(t *testing.T) {
 	xs := split255("abc")
 	if len(xs) != 1 && xs[0] != "abc" {
@@ -58,6 +83,69 @@ func TestSplit255(t *testing.T) {
 	}
 }
 
+func TestNewTXTMeta(t *testing.T) {
+	tests := []struct {
+		text string
+		meta map[string]string
+		txt  []string
+	}{
+		{"", nil, []string{""}},
+		{"text", nil, []string{"text"}},
+		{"", map[string]string{"version": "2", "color": "blue"}, []string{"color=blue", "version=2"}},
+		{"text", map[string]string{"a=b": "c=d", " pad": "x", "`q": ""}, []string{"text", "` pad=x", "``q=", "a`=b=c=d"}},
+		{"", map[string]string{"long": strings.Repeat("x", 300)}, []string{"long=" + strings.Repeat("x", 250), strings.Repeat("x", 50)}},
+	}
+	for i, tc := range tests {
+		serv := &Service{Text: tc.text, Meta: tc.meta}
+		if txt := serv.NewTXT("a.skydns.local.").Txt; !reflect.DeepEqual(txt, tc.txt) {
+			t.Errorf("test %d: expected %q, got %q", i, tc.txt, txt)
+		}
+	}
+}
+
+func TestTtlOverrides(t *testing.T) {
+	serv := &Service{Host: "server1", Text: "text", Ttl: 300, TtlA: 30, TtlSRV: 3600}
+	if ttl := serv.NewA("a.skydns.local.", nil).Hdr.Ttl; ttl != 30 {
+		t.Errorf("expected TTL 30 for A, got %d", ttl)
+	}
+	if ttl := serv.NewAAAA("a.skydns.local.", nil).Hdr.Ttl; ttl != 30 {
+		t.Errorf("expected TTL 30 for AAAA, got %d", ttl)
+	}
+	if ttl := serv.NewSRV("a.skydns.local.", 100).Hdr.Ttl; ttl != 3600 {
+		t.Errorf("expected TTL 3600 for SRV, got %d", ttl)
+	}
+	if ttl := serv.NewTXT("a.skydns.local.").Hdr.Ttl; ttl != 300 {
+		t.Errorf("expected TTL 300 for TXT, got %d", ttl)
+	}
+
+	serv.CapTtl(60)
+	if serv.Ttl != 60 || serv.TtlA != 30 || serv.TtlSRV != 60 || serv.TtlTXT != 0 {
+		t.Errorf("expected TTLs capped at 60, got %d, %d, %d, %d", serv.Ttl, serv.TtlA, serv.TtlSRV, serv.TtlTXT)
+	}
+}
+
+func TestDedup(t *testing.T) {
+	expired := &Time{Time: time.Unix(1, 0)}
+	sx := Dedup([]Service{
+		{Host: "10.0.0.1", Key: "/skydns/test/skydns/web/a", Expires: expired},
+		{Host: "10.0.0.1", Key: "/skydns/test/skydns/web/b"},
+		{Host: "10.0.0.1", Key: "/skydns/test/skydns/web/c", Ttl: 60},
+		{Host: "10.0.0.2", Key: "/skydns/test/skydns/grp/a", Group: "blue"},
+		{Host: "10.0.0.2", Key: "/skydns/test/skydns/grp/b", Group: "green"},
+		{Host: "10.0.0.2", Key: "/skydns/test/skydns/grp/c", Group: "green", GroupWeight: 10},
+		{Host: "mail.example.com", Key: "/skydns/test/skydns/mx/a", Mail: true},
+		{Host: "mail.example.com", Key: "/skydns/test/skydns/mx/b"},
+	})
+	var keys []string
+	for _, serv := range sx {
+		keys = append(keys, serv.Key[len("/skydns/test/skydns/"):])
+	}
+	want := "web/a web/b grp/a grp/b grp/c mx/a mx/b"
+	if got := strings.Join(keys, " "); got != want {
+		t.Errorf("expected %s, got %s", want, got)
+	}
+}
+
 func TestGroup(t *testing.T) {
 	// Key are in the wrong order, but for this test it does not matter.
 
@@ -153,3 +241,280 @@ func TestGroup(t *testing.T) {
 		t.Fatalf("failure to group seventh set: %v", sx)
 	}
 }
+
+func TestTarget(t *testing.T) {
+	serv := &Service{Host: "Server1.Example.ORG", Port: 80}
+
+	srv := serv.NewSRV("a.skydns.local.", 100)
+	if srv.Target != "server1.example.org." {
+		t.Fatalf("failure to canonicalize SRV target: %s", srv.Target)
+	}
+	mx := serv.NewMX("a.skydns.local.")
+	if mx.Mx != srv.Target {
+		t.Fatalf("failure to canonicalize MX target: %s", mx.Mx)
+	}
+}
+
+func TestNewNAPTR(t *testing.T) {
+	var serv Service
+	if err := DecodeString(`{"naptr":{"order":100,"preference":10,"flags":"u","service":"E2U+sip","regexp":"!^.*$!sip:info@example.org!"}}`, &serv); err != nil {
+		t.Fatal(err)
+	}
+	naptr := serv.NewNAPTR("4.3.2.1.5.5.5.1.e164.skydns.local.")
+	if naptr.Order != 100 || naptr.Preference != 10 || naptr.Service != "E2U+sip" || naptr.Replacement != "." {
+		t.Fatalf("failure to create NAPTR record: %s", naptr)
+	}
+
+	serv.Naptr = &NAPTR{Flags: "s", Service: "SIP+D2U", Replacement: "_SIP._udp.Example.ORG"}
+	if naptr := serv.NewNAPTR("example.org."); naptr.Replacement != "_sip._udp.example.org." {
+		t.Fatalf("failure to canonicalize NAPTR replacement: %s", naptr.Replacement)
+	}
+}
+
+func TestNewCAA(t *testing.T) {
+	var serv Service
+	if err := DecodeString(`{"caa":{"flag":128,"tag":"Issue","value":"letsencrypt.org"}}`, &serv); err != nil {
+		t.Fatal(err)
+	}
+	caa := serv.NewCAA("skydns.local.")
+	if caa.String() != "skydns.local.\t0\tIN\tCAA\t128 issue \"letsencrypt.org\"" {
+		t.Fatalf("failure to create CAA record: %s", caa)
+	}
+}
+
+func TestNewTLSA(t *testing.T) {
+	var serv Service
+	if err := DecodeString(`{"host":"10.0.0.1","port":443,"tlsa":{"usage":3,"selector":1,"matchingtype":1,"certificate":"0C72AC70"}}`, &serv); err != nil {
+		t.Fatal(err)
+	}
+	tlsa := serv.NewTLSA("_443._tcp.www.skydns.local.")
+	if tlsa.String() != "_443._tcp.www.skydns.local.\t0\tIN\tTLSA\t3 1 1 0c72ac70" {
+		t.Fatalf("failure to create TLSA record: %s", tlsa)
+	}
+}
+
+func TestNewDS(t *testing.T) {
+	var serv Service
+	if err := DecodeString(`{"ds":{"keytag":60485,"algorithm":5,"digesttype":1,"digest":"2bb183af5f22588179a53b0a98631fad1a292118"}}`, &serv); err != nil {
+		t.Fatal(err)
+	}
+	ds := serv.NewDS("team.skydns.local.")
+	if ds.String() != "team.skydns.local.\t0\tIN\tDS\t60485 5 1 2BB183AF5F22588179A53B0A98631FAD1A292118" {
+		t.Fatalf("failure to create DS record: %s", ds)
+	}
+}
+
+func TestNewURI(t *testing.T) {
+	serv := &Service{Uri: "https://www.example.com/api", Priority: 10, Ttl: 60}
+	uri := serv.NewURI("_http._tcp.www.skydns.local.")
+	if uri.String() != "_http._tcp.www.skydns.local.\t60\tIN\tURI\t10 100 \"https://www.example.com/api\"" {
+		t.Fatalf("failure to create URI record: %s", uri)
+	}
+}
+
+func TestNewSVCB(t *testing.T) {
+	serv := &Service{Host: "10.0.0.1", Port: 8443, Key: Path("a.www.skydns.local."),
+		Svcb: &SVCB{SvcPriority: 1, SvcParams: SvcParams{Alpn: []string{"h2", "h3"}}}}
+	svcb := serv.NewSVCB("www.skydns.local.", TypeHTTPS)
+	// 1 a.www.skydns.local. alpn=h2,h3 port=8443 ipv4hint=10.0.0.1
+	if svcb.Hdr.Rrtype != TypeHTTPS || svcb.Rdata != "000101610377777706736b79646e73056c6f63616c00000100060268320268330003000220fb000400040a000001" {
+		t.Fatalf("failure to create HTTPS record: %s", svcb)
+	}
+
+	// An alias has no parameters.
+	serv.Svcb = &SVCB{TargetName: "www.Example.org", SvcParams: SvcParams{Port: 443}}
+	if svcb := serv.NewSVCB("www.skydns.local.", TypeSVCB); svcb.Rdata != "000003777777076578616d706c65036f726700" {
+		t.Fatalf("failure to create SVCB alias record: %s", svcb)
+	}
+
+	serv.Svcb = &SVCB{SvcPriority: 1, TargetName: "www..example.org"}
+	if svcb := serv.NewSVCB("www.skydns.local.", TypeSVCB); svcb != nil {
+		t.Fatalf("expected no record for an invalid target, got %s", svcb)
+	}
+}
+
+func TestNewRaw(t *testing.T) {
+	tests := []struct {
+		raw string
+		rr  string // empty when refused
+	}{
+		{`HINFO "amd64" "linux"`, "a.skydns.local.\t60\tIN\tHINFO\t\"amd64\" \"linux\""},
+		{`other.example.org. 3600 IN LOC 52 22 23.000 N 4 53 32.000 E -2.00m 1m 10000m 10m`, "a.skydns.local.\t60\tIN\tLOC\t52 22 23.000 N 04 53 32.000 E -2m 1m 10000m 10m"},
+		{`A 10.0.0.1`, ""},
+		{`CNAME other.example.org.`, ""},
+		{`NOTATYPE 1 2`, ""},
+		{``, ""},
+	}
+	for i, tc := range tests {
+		serv := &Service{Raw: tc.raw, Ttl: 60}
+		rr, err := serv.NewRaw("a.skydns.local.")
+		if tc.rr == "" {
+			if err == nil {
+				t.Errorf("test %d: expected %q to be refused, got %s", i, tc.raw, rr)
+			}
+			continue
+		}
+		if err != nil || rr.String() != tc.rr {
+			t.Errorf("test %d: expected %q, got %v, %v", i, tc.rr, rr, err)
+		}
+	}
+}
+
+func TestTargetRewrite(t *testing.T) {
+	tests := []struct {
+		pattern, replacement string
+		strip                int
+		host, target         string
+	}{
+		{"*.*.skydns.local.", "$1-$2.example.com.", 0, "4.Rails.skydns.local", "4-rails.example.com."},
+		{"*.rails.skydns.local", "$1.rails.example.com", 0, "4.rails.skydns.local", "4.rails.example.com."},
+		// No match, the target is not rewritten.
+		{"*.rails.skydns.local.", "$1.example.com.", 0, "4.web.skydns.local", "4.web.skydns.local."},
+		{"*.rails.skydns.local.", "$1.example.com.", 0, "rails.skydns.local", "rails.skydns.local."},
+		// After TargetStrip.
+		{"rails.skydns.local.", "rails.example.com.", 1, "4.rails.skydns.local", "rails.example.com."},
+	}
+	for i, tc := range tests {
+		serv := &Service{Host: tc.host, TargetStrip: tc.strip, TargetRewrite: &TargetRewrite{Pattern: tc.pattern, Replacement: tc.replacement}}
+		if srv := serv.NewSRV("a.skydns.local.", 100); srv.Target != tc.target {
+			t.Errorf("test %d: expected SRV target %s, got %s", i, tc.target, srv.Target)
+		}
+		if mx := serv.NewMX("a.skydns.local."); mx.Mx != tc.target {
+			t.Errorf("test %d: expected MX target %s, got %s", i, tc.target, mx.Mx)
+		}
+	}
+}
+
+func TestDecodeString(t *testing.T) {
+	var s1, s2 Service
+	if err := DecodeString(`{"host":"server1","port":8080,"group":"g1"}`, &s1); err != nil {
+		t.Fatal(err)
+	}
+	if err := DecodeString(`{"host":"server1","port":8081,"group":"g1"}`, &s2); err != nil {
+		t.Fatal(err)
+	}
+	if s1.Host != "server1" || s1.Port != 8080 || s1.Group != "g1" || s2.Port != 8081 {
+		t.Fatalf("failure to decode services: %v, %v", s1, s2)
+	}
+	if err := DecodeString(`{"host":`, &s1); err == nil {
+		t.Fatal("expected error decoding truncated service")
+	}
+}
+
+func BenchmarkDecodeString(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		var s Service
+		DecodeString(`{"host":"server1.example.org","port":8080,"priority":10,"group":"g1"}`, &s)
+	}
+}
+
+func BenchmarkGroup(b *testing.B) {
+	sx := []Service{
+		{Host: "127.0.0.1", Group: "g1", Key: "a/dom1/skydns/test"},
+		{Host: "127.0.0.2", Group: "g2", Key: "b/sub/dom1/skydns/test"},
+		{Host: "127.0.0.3", Key: "c/sub/dom1/skydns/test"},
+		{Host: "127.0.0.4", Group: "g1", Key: "d/sub/dom1/skydns/test"},
+	}
+	tmp := make([]Service, len(sx))
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		copy(tmp, sx)
+		Group(tmp)
+	}
+}
+
+func TestActive(t *testing.T) {
+	now := time.Now()
+	before, after := now.Add(-time.Minute), now.Add(time.Minute)
+	tests := []struct {
+		from, until *time.Time
+		active      bool
+	}{
+		{nil, nil, true},
+		{&before, nil, true},
+		{&after, nil, false},
+		{nil, &after, true},
+		{nil, &before, false},
+		{&before, &after, true},
+		{&now, &after, true},
+		{&before, &now, false},
+	}
+	for i, tc := range tests {
+		s := &Service{ActiveFrom: tc.from, ActiveUntil: tc.until}
+		if a := s.Active(now); a != tc.active {
+			t.Errorf("test %d: expected active %t, got %t", i, tc.active, a)
+		}
+	}
+
+	var s Service
+	if err := DecodeString(`{"host":"server1","activefrom":"2017-01-01T00:00:00Z"}`, &s); err != nil {
+		t.Fatal(err)
+	}
+	if s.ActiveFrom == nil || !s.ActiveFrom.Equal(time.Date(2017, 1, 1, 0, 0, 0, 0, time.UTC)) {
+		t.Fatalf("failure to decode activefrom: %v", s.ActiveFrom)
+	}
+}
+
+func TestExpires(t *testing.T) {
+	for _, js := range []string{`{"expires":"2017-01-01T00:00:00Z"}`, `{"expires":1483228800}`} {
+		var s Service
+		if err := DecodeString(js, &s); err != nil {
+			t.Fatal(err)
+		}
+		if s.Expires == nil || !s.Expires.Equal(time.Date(2017, 1, 1, 0, 0, 0, 0, time.UTC)) {
+			t.Fatalf("failure to decode expires in %s: %v", js, s.Expires)
+		}
+		if s.Active(time.Date(2017, 1, 1, 0, 0, 0, 0, time.UTC)) {
+			t.Errorf("expected service to be expired for %s", js)
+		}
+	}
+	var s Service
+	if err := DecodeString(`{"expires":"tomorrow"}`, &s); err == nil {
+		t.Error("expected an error for an invalid expires")
+	}
+
+	now := time.Now()
+	before, after := now.Add(-time.Minute), now.Add(time.Minute)
+	s = Service{ActiveUntil: &after, Expires: &Time{before}}
+	if until := s.Until(); !until.Equal(before) || s.Active(now) {
+		t.Errorf("expected the service to be expired at %s, got %s", before, until)
+	}
+	s = Service{ActiveUntil: &before, Expires: &Time{after}}
+	if until := s.Until(); !until.Equal(before) {
+		t.Errorf("expected the service to stop at %s, got %s", before, until)
+	}
+}
+
+func TestGroupWeight(t *testing.T) {
+	services := func() []Service {
+		return []Service{
+			{Host: "server1", Group: "blue", GroupWeight: 100, Key: "a/dom/skydns/test"},
+			{Host: "server2", Group: "blue", Key: "b/dom/skydns/test"},
+			{Host: "server3", Group: "green", GroupWeight: 0, Key: "c/dom/skydns/test"},
+			{Host: "server4", Key: "d/dom/skydns/test"},
+		}
+	}
+	// Green has no weight, so we get blue, and the groupless service.
+	for i := 0; i < 10; i++ {
+		sx := Group(services())
+		if len(sx) != 3 || sx[0].Host != "server1" || sx[1].Host != "server2" || sx[2].Host != "server4" {
+			t.Fatalf("failure to pick the weighted group: %v", sx)
+		}
+	}
+
+	// Both have a weight, we should see both.
+	seen := make(map[string]bool)
+	for i := 0; i < 1000; i++ {
+		sx := services()
+		sx[2].GroupWeight = 100
+		sx = Group(sx)
+		if len(sx) != 2 && len(sx) != 3 {
+			t.Fatalf("failure to pick a single group: %v", sx)
+		}
+		seen[sx[0].Group] = true
+	}
+	if !seen["blue"] || !seen["green"] {
+		t.Fatalf("expected both groups to be picked, got %v", seen)
+	}
+}
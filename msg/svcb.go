@@ -0,0 +1,135 @@
+// Copyright (c) 2014 The SkyDNS Authors. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package msg
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"net"
+
+	"github.com/miekg/dns"
+)
+
+// TypeSVCB and TypeHTTPS are the types of the SVCB and HTTPS records (RFC 9460),
+// the dns package doesn't know them, so they are sent as unknown records (RFC
+// 3597) with rdata we encode ourselves.
+const (
+	TypeSVCB  uint16 = 64
+	TypeHTTPS uint16 = 65
+)
+
+// The keys of the SvcParams we support.
+const (
+	svcAlpn     = 1
+	svcPort     = 3
+	svcIpv4Hint = 4
+	svcIpv6Hint = 6
+)
+
+// SVCB is the rdata of an SVCB or HTTPS record. A SvcPriority of zero makes it
+// an alias for TargetName, which then must be set, and it has no SvcParams.
+type SVCB struct {
+	SvcPriority int       `json:"svcpriority,omitempty"`
+	TargetName  string    `json:"targetname,omitempty"`
+	SvcParams   SvcParams `json:"svcparams,omitempty"`
+}
+
+// SvcParams are the parameters of an SVCB record: the protocols, like "h2" and
+// "h3", the port, and the addresses of TargetName as hints.
+type SvcParams struct {
+	Alpn     []string `json:"alpn,omitempty"`
+	Port     int      `json:"port,omitempty"`
+	Ipv4Hint []string `json:"ipv4hint,omitempty"`
+	Ipv6Hint []string `json:"ipv6hint,omitempty"`
+}
+
+// NewSVCB returns a new SVCB or HTTPS record, depending on rrtype, based on the
+// Service, which must have Svcb set. Without a TargetName the target is Host,
+// or, if Host is an IP address, the name of the service, with Host as hint. The
+// Port of the service is the port when the SvcParams don't have one. It returns
+// nil if the target is not a valid name.
+func (s *Service) NewSVCB(name string, rrtype uint16) *dns.RFC3597 {
+	priority, target, params := s.Svcb.SvcPriority, s.Svcb.TargetName, s.Svcb.SvcParams
+	if priority > 0 {
+		ip := net.ParseIP(s.Host)
+		switch {
+		case target != "":
+		case ip == nil && s.Host != "":
+			target = s.Host
+		case ip.To4() != nil:
+			target = Domain(s.Key)
+			if len(params.Ipv4Hint) == 0 {
+				params.Ipv4Hint = []string{ip.String()}
+			}
+		case ip != nil:
+			target = Domain(s.Key)
+			if len(params.Ipv6Hint) == 0 {
+				params.Ipv6Hint = []string{ip.String()}
+			}
+		}
+		if params.Port == 0 {
+			params.Port = s.Port
+		}
+	}
+	if target == "" {
+		target = "."
+	}
+
+	buf := make([]byte, 2+256)
+	binary.BigEndian.PutUint16(buf, uint16(priority))
+	off, err := dns.PackDomainName(Target(target), buf, 2, nil, false)
+	if err != nil {
+		return nil
+	}
+	rdata := buf[:off]
+	if priority > 0 {
+		rdata = params.pack(rdata)
+	}
+	return &dns.RFC3597{Hdr: dns.RR_Header{Name: name, Rrtype: rrtype, Class: dns.ClassINET, Ttl: s.Ttl},
+		Rdata: hex.EncodeToString(rdata)}
+}
+
+// pack appends the wire format of p to b, in the order of their keys. Hints
+// that are not addresses of their family are skipped.
+func (p SvcParams) pack(b []byte) []byte {
+	param := func(key uint16, value []byte) {
+		b = append(b, byte(key>>8), byte(key), byte(len(value)>>8), byte(len(value)))
+		b = append(b, value...)
+	}
+	if len(p.Alpn) > 0 {
+		var value []byte
+		for _, a := range p.Alpn {
+			if len(a) == 0 || len(a) > 255 {
+				continue
+			}
+			value = append(value, byte(len(a)))
+			value = append(value, a...)
+		}
+		if len(value) > 0 {
+			param(svcAlpn, value)
+		}
+	}
+	if p.Port > 0 {
+		param(svcPort, []byte{byte(p.Port >> 8), byte(p.Port)})
+	}
+	var v4, v6 []byte
+	for _, h := range p.Ipv4Hint {
+		if ip := net.ParseIP(h).To4(); ip != nil {
+			v4 = append(v4, ip...)
+		}
+	}
+	for _, h := range p.Ipv6Hint {
+		if ip := net.ParseIP(h); ip != nil && ip.To4() == nil {
+			v6 = append(v6, ip.To16()...)
+		}
+	}
+	if len(v4) > 0 {
+		param(svcIpv4Hint, v4)
+	}
+	if len(v6) > 0 {
+		param(svcIpv6Hint, v6)
+	}
+	return b
+}
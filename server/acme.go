@@ -0,0 +1,274 @@
+// Copyright (c) 2014 The SkyDNS Authors. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package server
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/skynetservices/skydns/metrics"
+	"github.com/skynetservices/skydns/msg"
+
+	"github.com/miekg/dns"
+)
+
+// acmeLabel is the label the TXT records of ACME DNS-01 challenges live under.
+const acmeLabel = "_acme-challenge."
+
+// acmePrefix starts the label of the keys the challenges are stored in, below the
+// key of their name.
+const acmePrefix = "acme-"
+
+// acmeExpire is how long a challenge that is not cleaned up is served.
+const acmeExpire = time.Hour
+
+// challenges holds the TXT records of pending ACME DNS-01 challenges, placed with
+// the HTTP API on Config.AcmeAddr or to obtain our own certificate. They are
+// stored in the backend, so every SkyDNS serving it answers them, as the CA
+// validates from several places. A backend that can't store services keeps them
+// in memory, which only works with a single SkyDNS.
+type challenges struct {
+	backend Backend
+
+	sync.RWMutex
+	txt map[string][]string // lowercased name -> values, without a Writer
+}
+
+func newChallenges(backend Backend) *challenges {
+	return &challenges{backend: backend, txt: make(map[string][]string)}
+}
+
+// challengeID returns the label of the key the challenge with value is stored in.
+func challengeID(value string) string {
+	h := fnv.New64a()
+	h.Write([]byte(value))
+	return fmt.Sprintf("%s%016x", acmePrefix, h.Sum64())
+}
+
+func (c *challenges) present(name, value string) error {
+	if w, ok := c.backend.(Writer); ok {
+		until := time.Now().Add(acmeExpire)
+		return w.Put(name, challengeID(value), &msg.Service{Text: value, ActiveUntil: &until})
+	}
+	c.Lock()
+	defer c.Unlock()
+	for _, v := range c.txt[name] {
+		if v == value {
+			return nil
+		}
+	}
+	c.txt[name] = append(c.txt[name], value)
+	return nil
+}
+
+func (c *challenges) cleanup(name, value string) error {
+	if w, ok := c.backend.(Writer); ok {
+		owner := challengeID(value) + "." + name
+		for _, serv := range c.stored(name) {
+			if msg.Domain(serv.Key) == owner {
+				if err := w.Delete(serv.Key); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	}
+	c.Lock()
+	defer c.Unlock()
+	vs := c.txt[name]
+	for i, v := range vs {
+		if v == value {
+			vs = append(vs[:i:i], vs[i+1:]...)
+			break
+		}
+	}
+	if len(vs) == 0 {
+		delete(c.txt, name)
+		return nil
+	}
+	c.txt[name] = vs
+	return nil
+}
+
+func (c *challenges) values(name string) []string {
+	if _, ok := c.backend.(Writer); ok {
+		var vs []string
+		for _, serv := range active(c.stored(name), time.Now()) {
+			vs = append(vs, serv.Text)
+		}
+		return vs
+	}
+	c.RLock()
+	defer c.RUnlock()
+	return c.txt[name]
+}
+
+// stored returns the services of the challenges stored for name.
+func (c *challenges) stored(name string) []msg.Service {
+	sx, err := c.backend.Records(name, false)
+	if err != nil {
+		if err != msg.ErrNotFound {
+			logf("failure to get the ACME challenges for %s: %s", name, err)
+		}
+		return nil
+	}
+	ret := sx[:0]
+	for _, serv := range sx {
+		owner := msg.Domain(serv.Key)
+		if serv.Text != "" && strings.HasPrefix(owner, acmePrefix) && strings.SplitN(owner, ".", 2)[1] == name {
+			ret = append(ret, serv)
+		}
+	}
+	return ret
+}
+
+// acmeRequest is the body of a request to the challenge API, it is the one sent by
+// lego's (and others') "httpreq" DNS provider.
+type acmeRequest struct {
+	FQDN  string `json:"fqdn"`
+	Value string `json:"value"`
+}
+
+// serveAcme implements the challenge API: a POST to /present adds a challenge's
+// TXT record, a POST to /cleanup removes it. Only clients in the acme ACL may use
+// it, and only for names in our own domain or a tenant's. For a tenant's domain
+// the client authenticates with one of the tenant's TSIG keys, see acmeAllowed.
+// In degraded mode challenges can't be placed or cleaned up.
+func (s *server) serveAcme(w http.ResponseWriter, r *http.Request) {
+	if s.degraded() {
+		http.Error(w, "degraded: the backend lost its quorum, writes are refused", http.StatusServiceUnavailable)
+		return
+	}
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err != nil || !inNets(s.config.acmeNets, &net.TCPAddr{IP: net.ParseIP(host)}) {
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return
+	}
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	req := acmeRequest{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, fmt.Sprintf("bad request: %s", err), http.StatusBadRequest)
+		return
+	}
+	name := dns.Fqdn(strings.ToLower(req.FQDN))
+	zs := s.acmeZone(name)
+	if _, ok := dns.IsDomainName(name); !ok || !strings.HasPrefix(name, acmeLabel) || zs == nil {
+		http.Error(w, fmt.Sprintf("bad request: not a challenge in %s or a tenant's domain: %q", s.config.Domain, req.FQDN), http.StatusBadRequest)
+		return
+	}
+	if !s.acmeAllowed(r, zs) {
+		w.Header().Set("WWW-Authenticate", `Basic realm="skydns"`)
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	if req.Value == "" || len(req.Value) > 255 {
+		http.Error(w, "bad request: invalid value", http.StatusBadRequest)
+		return
+	}
+
+	var err error
+	switch r.URL.Path {
+	case "/present":
+		logf("presenting ACME challenge for %s", name)
+		err = zs.challenges.present(name, req.Value)
+	case "/cleanup":
+		logf("cleaning up ACME challenge for %s", name)
+		err = zs.challenges.cleanup(name, req.Value)
+	default:
+		http.NotFound(w, r)
+		return
+	}
+	switch {
+	case err == errQuota:
+		http.Error(w, "forbidden: the tenant's max_records is reached", http.StatusForbidden)
+	case err != nil:
+		logf("failure to store ACME challenge for %s: %s", name, err)
+		http.Error(w, "failure to store the challenge", http.StatusInternalServerError)
+	}
+}
+
+// acmeZone returns the server of the zone name is in, ours or a tenant's, or nil
+// when it is in neither.
+func (s *server) acmeZone(name string) *server {
+	for _, t := range s.tenants {
+		if dns.IsSubDomain(t.config.Domain, name) {
+			return t.server
+		}
+	}
+	if dns.IsSubDomain(s.config.Domain, name) {
+		return s
+	}
+	return nil
+}
+
+// acmeAllowed returns true if the client of r may place challenges in the zone
+// of zs. Credentials are a TSIG key, with basic authentication: the key's name
+// and secret. They are needed for a tenant's zone, and a key of a tenant can't
+// be used for other zones, see Config.ownKey.
+func (s *server) acmeAllowed(r *http.Request, zs *server) bool {
+	user, pass, ok := r.BasicAuth()
+	if !ok {
+		return zs.config.tenant == ""
+	}
+	key, ok := s.config.tsigKeys[dns.Fqdn(strings.ToLower(user))]
+	return ok && subtle.ConstantTimeCompare([]byte(pass), []byte(key.Secret)) == 1 && zs.config.ownKey(key.Name)
+}
+
+// runAcme starts the challenge API on Config.AcmeAddr.
+func (s *server) runAcme() {
+	h := http.HandlerFunc(s.serveAcme)
+	go func() {
+		if err := http.ListenAndServe(s.config.AcmeAddr, h); err != nil {
+			fatalf("%s", err)
+		}
+	}()
+	logf("ready for ACME challenges on http://%s", s.config.AcmeAddr)
+}
+
+// ServeDNSChallenge answers a TXT query for a pending ACME challenge. It returns
+// nil, and writes nothing, when there is no challenge for the name. The answer is
+// not cached, so a challenge is seen as soon as it is presented.
+func (s *server) ServeDNSChallenge(w dns.ResponseWriter, req *dns.Msg, dnssec bool, bufsize uint16) *dns.Msg {
+	q := req.Question[0]
+	values := s.challenges.values(strings.ToLower(q.Name))
+	if len(values) == 0 {
+		return nil
+	}
+	m := s.newReply(req)
+	for _, v := range values {
+		m.Answer = append(m.Answer, &dns.TXT{
+			Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypeTXT, Class: dns.ClassINET, Ttl: 0},
+			Txt: []string{v},
+		})
+	}
+	if dnssec && s.config.PubKey != nil {
+		if err := s.Sign(m, bufsize); err != nil {
+			m = s.ServerFailure(req)
+			s.explain(m, req, reasonSignFailed)
+		}
+	}
+	s.setAD(m, req, dnssec)
+	s.setEdns(m, req.IsEdns0())
+
+	if send := s.overflowOrTruncated(w, m, int(bufsize), metrics.Auth); send {
+		return m
+	}
+	metrics.ReportCompression(m, metrics.Auth)
+	written := time.Now()
+	if err := w.WriteMsg(m); err != nil {
+		logf("failure to return reply %q", err)
+	}
+	metrics.ReportStage(metrics.StageWrite, written)
+	return m
+}
@@ -0,0 +1,98 @@
+// Copyright (c) 2014 The SkyDNS Authors. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestAcme(t *testing.T) {
+	s := newTestServer(t, true)
+	defer s.Stop()
+	s.challenges = newChallenges(s.backend)
+
+	post := func(path, remote, body string) int {
+		r := httptest.NewRequest("POST", path, strings.NewReader(body))
+		r.RemoteAddr = remote
+		w := httptest.NewRecorder()
+		s.serveAcme(w, r)
+		return w.Code
+	}
+	query := func() *dns.Msg {
+		m := new(dns.Msg)
+		m.SetQuestion("_acme-challenge.www.skydns.test.", dns.TypeTXT)
+		w := &testWriter{}
+		s.ServeDNS(w, m)
+		return w.msg
+	}
+
+	const challenge = `{"fqdn": "_acme-challenge.www.skydns.test.", "value": "LHDhK3oGRvkiefQnx7OOczTY5Tic_xZ6HcMOc_gmtoM"}`
+	tests := []struct {
+		path, remote, body string
+		code               int
+	}{
+		{"/present", "192.0.2.1:1234", challenge, http.StatusForbidden},
+		{"/present", "127.0.0.1:1234", `{"fqdn": "www.skydns.test.", "value": "x"}`, http.StatusBadRequest},
+		{"/present", "127.0.0.1:1234", `{"fqdn": "_acme-challenge.example.org.", "value": "x"}`, http.StatusBadRequest},
+		{"/present", "127.0.0.1:1234", `{"fqdn": "_acme-challenge.www.skydns.test."}`, http.StatusBadRequest},
+		{"/present", "127.0.0.1:1234", challenge, http.StatusOK},
+	}
+	for i, tc := range tests {
+		if code := post(tc.path, tc.remote, tc.body); code != tc.code {
+			t.Errorf("test %d: expected status %d, got %d", i, tc.code, code)
+		}
+	}
+
+	resp := query()
+	if len(resp.Answer) != 1 || !resp.Authoritative {
+		t.Fatalf("expected the challenge's TXT record, got %s", resp)
+	}
+	if txt := resp.Answer[0].(*dns.TXT).Txt[0]; txt != "LHDhK3oGRvkiefQnx7OOczTY5Tic_xZ6HcMOc_gmtoM" {
+		t.Fatalf("expected the challenge's value, got %s", txt)
+	}
+	// Another SkyDNS serving the same backend answers it too.
+	if vs := newChallenges(s.backend).values("_acme-challenge.www.skydns.test."); len(vs) != 1 {
+		t.Fatalf("expected the challenge to be stored in the backend, got %v", vs)
+	}
+
+	if code := post("/cleanup", "[::1]:1234", challenge); code != http.StatusOK {
+		t.Fatalf("expected status %d, got %d", http.StatusOK, code)
+	}
+	if resp := query(); len(resp.Answer) != 0 {
+		t.Fatalf("expected no challenge after the cleanup, got %s", resp)
+	}
+
+	s.noQuorum = new(int32)
+	atomic.StoreInt32(s.noQuorum, 1)
+	for _, path := range []string{"/present", "/cleanup"} {
+		if code := post(path, "127.0.0.1:1234", challenge); code != http.StatusServiceUnavailable {
+			t.Errorf("expected status %d for %s in degraded mode, got %d", http.StatusServiceUnavailable, path, code)
+		}
+	}
+	if resp := query(); len(resp.Answer) != 0 {
+		t.Fatalf("expected no challenge in degraded mode, got %s", resp)
+	}
+}
+
+func TestAcmeMemory(t *testing.T) {
+	c := newChallenges(memBackend{})
+	const name = "_acme-challenge.www.skydns.test."
+	c.present(name, "a")
+	c.present(name, "b")
+	c.present(name, "a")
+	if vs := c.values(name); len(vs) != 2 {
+		t.Fatalf("expected 2 challenges kept in memory, got %v", vs)
+	}
+	c.cleanup(name, "a")
+	if vs := c.values(name); len(vs) != 1 || vs[0] != "b" {
+		t.Fatalf("expected challenge b, got %v", vs)
+	}
+}
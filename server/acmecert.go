@@ -0,0 +1,278 @@
+// Copyright (c) 2014 The SkyDNS Authors. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package server
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	"golang.org/x/crypto/acme"
+)
+
+const (
+	// acmeRenew is how long before it expires the certificate is renewed.
+	acmeRenew = 30 * 24 * time.Hour
+	// acmeCheck is how often the certificate is checked, acmeRetry how soon a
+	// failure to obtain one is retried.
+	acmeCheck = 12 * time.Hour
+	acmeRetry = 10 * time.Minute
+	// acmeTimeout limits the time it takes to obtain a certificate.
+	acmeTimeout = 5 * time.Minute
+)
+
+// The files in Config.AcmeCache.
+const (
+	acmeAccountFile = "account.key"
+	acmeCertFile    = "cert.pem"
+	acmeKeyFile     = "key.pem"
+)
+
+// certificate is the TLS certificate of the DoH endpoint, obtained from the ACME
+// CA at Config.AcmeDirectory for Config.AcmeNames. The DNS-01 challenges are
+// placed in our own domain, see challenges.
+type certificate struct {
+	client *acme.Client
+
+	sync.RWMutex
+	cert *tls.Certificate // nil until one is obtained
+}
+
+// newCertificate returns the certificate for config, with the account key and
+// the certificate in Config.AcmeCache when they are there. Without them a new
+// account key is made, and the certificate still has to be obtained.
+func newCertificate(config *Config) (*certificate, error) {
+	key, err := acmeAccountKey(config.AcmeCache)
+	if err != nil {
+		return nil, err
+	}
+	c := &certificate{client: &acme.Client{Key: key, DirectoryURL: config.AcmeDirectory}}
+	if config.AcmeCache == "" {
+		return c, nil
+	}
+	cert, err := tls.LoadX509KeyPair(filepath.Join(config.AcmeCache, acmeCertFile), filepath.Join(config.AcmeCache, acmeKeyFile))
+	if err != nil {
+		if !os.IsNotExist(err) {
+			logf("failure to load the certificate from %s: %s", config.AcmeCache, err)
+		}
+		return c, nil
+	}
+	if cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+		return nil, err
+	}
+	c.cert = &cert
+	return c, nil
+}
+
+// acmeAccountKey returns the account key in dir, which is made when it isn't
+// there yet.
+func acmeAccountKey(dir string) (crypto.Signer, error) {
+	if dir == "" {
+		return ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	}
+	file := filepath.Join(dir, acmeAccountFile)
+	b, err := ioutil.ReadFile(file)
+	if err == nil {
+		p, _ := pem.Decode(b)
+		if p == nil {
+			return nil, fmt.Errorf("no key in %s", file)
+		}
+		return x509.ParseECPrivateKey(p.Bytes)
+	}
+	if !os.IsNotExist(err) {
+		return nil, err
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	if err := writeKey(file, key); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+func writeKey(file string, key *ecdsa.PrivateKey) error {
+	b, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(file, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: b}), 0600)
+}
+
+// get returns the certificate, it is the GetCertificate of the tls.Config of
+// the DoH endpoint.
+func (c *certificate) get(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.RLock()
+	defer c.RUnlock()
+	if c.cert == nil {
+		return nil, fmt.Errorf("no certificate obtained yet")
+	}
+	return c.cert, nil
+}
+
+// due returns true when there is no certificate for names, or when it expires
+// within acmeRenew.
+func (c *certificate) due(names []string, now time.Time) bool {
+	c.RLock()
+	defer c.RUnlock()
+	if c.cert == nil || c.cert.Leaf.NotAfter.Sub(now) < acmeRenew {
+		return true
+	}
+	for _, name := range names {
+		if c.cert.Leaf.VerifyHostname(name) != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// obtain gets a new certificate for names from the CA, answering its DNS-01
+// challenges with TXT records placed in ch.
+func (c *certificate) obtain(ctx context.Context, names []string, email string, ch *challenges) (*tls.Certificate, error) {
+	account := &acme.Account{}
+	if email != "" {
+		account.Contact = []string{"mailto:" + email}
+	}
+	if _, err := c.client.Register(ctx, account, acme.AcceptTOS); err != nil && err != acme.ErrAccountAlreadyExists {
+		return nil, fmt.Errorf("registering the account: %s", err)
+	}
+	order, err := c.client.AuthorizeOrder(ctx, acme.DomainIDs(names...))
+	if err != nil {
+		return nil, fmt.Errorf("creating the order: %s", err)
+	}
+	for _, u := range order.AuthzURLs {
+		z, err := c.client.GetAuthorization(ctx, u)
+		if err != nil {
+			return nil, err
+		}
+		if z.Status == acme.StatusValid {
+			continue
+		}
+		var chal *acme.Challenge
+		for _, cz := range z.Challenges {
+			if cz.Type == "dns-01" {
+				chal = cz
+			}
+		}
+		if chal == nil {
+			return nil, fmt.Errorf("no dns-01 challenge for %s", z.Identifier.Value)
+		}
+		value, err := c.client.DNS01ChallengeRecord(chal.Token)
+		if err != nil {
+			return nil, err
+		}
+		name := acmeLabel + dns.Fqdn(strings.ToLower(z.Identifier.Value))
+		if err := ch.present(name, value); err != nil {
+			return nil, fmt.Errorf("presenting the challenge for %s: %s", name, err)
+		}
+		defer func() {
+			if err := ch.cleanup(name, value); err != nil {
+				logf("failure to clean up ACME challenge for %s: %s", name, err)
+			}
+		}()
+		if _, err := c.client.Accept(ctx, chal); err != nil {
+			return nil, fmt.Errorf("accepting the challenge for %s: %s", name, err)
+		}
+		if _, err := c.client.WaitAuthorization(ctx, z.URI); err != nil {
+			return nil, fmt.Errorf("validating the challenge for %s: %s", name, err)
+		}
+	}
+	if order, err = c.client.WaitOrder(ctx, order.URI); err != nil {
+		return nil, err
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	csr, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{DNSNames: names}, key)
+	if err != nil {
+		return nil, err
+	}
+	der, _, err := c.client.CreateOrderCert(ctx, order.FinalizeURL, csr, true)
+	if err != nil {
+		return nil, fmt.Errorf("finalizing the order: %s", err)
+	}
+	leaf, err := x509.ParseCertificate(der[0])
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Certificate{Certificate: der, PrivateKey: key, Leaf: leaf}, nil
+}
+
+// saveCertificate writes cert to the files in dir.
+func saveCertificate(dir string, cert *tls.Certificate) error {
+	var b []byte
+	for _, der := range cert.Certificate {
+		b = append(b, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})...)
+	}
+	if err := writeKey(filepath.Join(dir, acmeKeyFile), cert.PrivateKey.(*ecdsa.PrivateKey)); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(dir, acmeCertFile), b, 0644)
+}
+
+// renewCertificate obtains the certificate of the DoH endpoint when it is due.
+func (s *server) renewCertificate() error {
+	names := s.config.AcmeNames
+	if !s.cert.due(names, time.Now()) {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), acmeTimeout)
+	defer cancel()
+	cert, err := s.cert.obtain(ctx, names, s.config.AcmeEmail, s.challenges)
+	if err != nil {
+		return err
+	}
+	s.cert.Lock()
+	s.cert.cert = cert
+	s.cert.Unlock()
+	logf("obtained the certificate for %s, valid until %s", strings.Join(names, ", "), cert.Leaf.NotAfter.Format(time.RFC3339))
+	if s.config.AcmeCache != "" {
+		if err := saveCertificate(s.config.AcmeCache, cert); err != nil {
+			logf("failure to save the certificate to %s: %s", s.config.AcmeCache, err)
+		}
+	}
+	return nil
+}
+
+// runCertificate obtains the certificate of the DoH endpoint, and renews it when
+// it is due. The challenges are answered by our own listeners, so this starts
+// in the background.
+func (s *server) runCertificate() error {
+	c, err := newCertificate(s.config)
+	if err != nil {
+		return err
+	}
+	s.cert = c
+	go func() {
+		for {
+			wait := acmeCheck
+			if err := s.renewCertificate(); err != nil {
+				logf("failure to obtain the certificate for %s: %s", strings.Join(s.config.AcmeNames, ", "), err)
+				wait = acmeRetry
+			}
+			time.Sleep(wait)
+		}
+	}()
+	return nil
+}
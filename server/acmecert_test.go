@@ -0,0 +1,227 @@
+// Copyright (c) 2014 The SkyDNS Authors. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package server
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// fakeCA is an ACME CA with a single order, for a single name, that validates
+// its DNS-01 challenge by asking check for the TXT record. It doesn't verify the
+// signatures of the requests.
+type fakeCA struct {
+	*httptest.Server
+	check func(token string) bool
+
+	sync.Mutex
+	orders int
+	valid  bool
+	cert   []byte // PEM, after the order is finalized
+	key    *ecdsa.PrivateKey
+	ca     *x509.Certificate
+}
+
+func newFakeCA(t *testing.T, name string, check func(token string) bool) *fakeCA {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1), Subject: pkix.Name{CommonName: "fake CA"},
+		NotBefore: time.Now(), NotAfter: time.Now().Add(time.Hour),
+		IsCA: true, BasicConstraintsValid: true, KeyUsage: x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, key.Public(), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca, _ := x509.ParseCertificate(der)
+	f := &fakeCA{check: check, key: key, ca: ca}
+
+	mux := http.NewServeMux()
+	f.Server = httptest.NewServer(mux)
+	url := f.Server.URL
+	reply := func(w http.ResponseWriter, code int, v interface{}) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(code)
+		json.NewEncoder(w).Encode(v)
+	}
+	order := func() map[string]interface{} {
+		o := map[string]interface{}{
+			"status":         "pending",
+			"identifiers":    []map[string]string{{"type": "dns", "value": name}},
+			"authorizations": []string{url + "/authz"},
+			"finalize":       url + "/finalize",
+		}
+		switch {
+		case f.cert != nil:
+			o["status"], o["certificate"] = "valid", url+"/cert"
+		case f.valid:
+			o["status"] = "ready"
+		}
+		return o
+	}
+	handle := func(path string, h func(w http.ResponseWriter, payload []byte)) {
+		mux.HandleFunc(path, func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Replay-Nonce", fmt.Sprintf("nonce-%d", time.Now().UnixNano()))
+			var jws struct{ Payload string }
+			json.NewDecoder(r.Body).Decode(&jws)
+			payload, _ := base64.RawURLEncoding.DecodeString(jws.Payload)
+			f.Lock()
+			defer f.Unlock()
+			h(w, payload)
+		})
+	}
+
+	handle("/dir", func(w http.ResponseWriter, _ []byte) {
+		reply(w, http.StatusOK, map[string]string{
+			"newNonce": url + "/nonce", "newAccount": url + "/account", "newOrder": url + "/order",
+			"revokeCert": url + "/revoke", "keyChange": url + "/key",
+		})
+	})
+	handle("/nonce", func(w http.ResponseWriter, _ []byte) { w.WriteHeader(http.StatusOK) })
+	handle("/account", func(w http.ResponseWriter, _ []byte) {
+		w.Header().Set("Location", url+"/account/1")
+		reply(w, http.StatusCreated, map[string]string{"status": "valid"})
+	})
+	handle("/order", func(w http.ResponseWriter, _ []byte) {
+		f.orders++
+		w.Header().Set("Location", url+"/order/1")
+		reply(w, http.StatusCreated, order())
+	})
+	handle("/order/1", func(w http.ResponseWriter, _ []byte) {
+		w.Header().Set("Location", url+"/order/1")
+		reply(w, http.StatusOK, order())
+	})
+	challenge := func() map[string]string {
+		status := "pending"
+		if f.valid {
+			status = "valid"
+		}
+		return map[string]string{"type": "dns-01", "url": url + "/challenge", "token": "token", "status": status}
+	}
+	handle("/authz", func(w http.ResponseWriter, _ []byte) {
+		c := challenge()
+		reply(w, http.StatusOK, map[string]interface{}{
+			"status":     c["status"],
+			"identifier": map[string]string{"type": "dns", "value": name},
+			"challenges": []map[string]string{c},
+		})
+	})
+	handle("/challenge", func(w http.ResponseWriter, _ []byte) {
+		f.valid = f.check("token")
+		reply(w, http.StatusOK, challenge())
+	})
+	handle("/finalize", func(w http.ResponseWriter, payload []byte) {
+		var req struct{ CSR string }
+		json.Unmarshal(payload, &req)
+		b, _ := base64.RawURLEncoding.DecodeString(req.CSR)
+		csr, err := x509.ParseCertificateRequest(b)
+		if err != nil || !f.valid {
+			reply(w, http.StatusForbidden, map[string]string{"type": "urn:ietf:params:acme:error:unauthorized"})
+			return
+		}
+		tmpl := &x509.Certificate{
+			SerialNumber: big.NewInt(2), DNSNames: csr.DNSNames,
+			NotBefore: time.Now(), NotAfter: time.Now().Add(90 * 24 * time.Hour),
+		}
+		der, err := x509.CreateCertificate(rand.Reader, tmpl, f.ca, csr.PublicKey, f.key)
+		if err != nil {
+			t.Error(err)
+		}
+		f.cert = append(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+			pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: f.ca.Raw})...)
+		w.Header().Set("Location", url+"/order/1")
+		reply(w, http.StatusOK, order())
+	})
+	handle("/cert", func(w http.ResponseWriter, _ []byte) {
+		w.Header().Set("Content-Type", "application/pem-certificate-chain")
+		w.Write(f.cert)
+	})
+	return f
+}
+
+func TestAcmeCertificate(t *testing.T) {
+	s := newTestServer(t, false)
+	defer s.Stop()
+	dir, err := ioutil.TempDir("", "skydns-acme")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	const name = "doh.skydns.test"
+	f := newFakeCA(t, name, func(token string) bool {
+		want, _ := s.cert.client.DNS01ChallengeRecord(token)
+		m := new(dns.Msg)
+		m.SetQuestion(acmeLabel+name+".", dns.TypeTXT)
+		w := &testWriter{}
+		s.ServeDNS(w, m)
+		return len(w.msg.Answer) == 1 && w.msg.Answer[0].(*dns.TXT).Txt[0] == want
+	})
+	defer f.Close()
+
+	s.config.AcmeDirectory = f.URL + "/dir"
+	s.config.AcmeNames = []string{name}
+	s.config.AcmeCache = dir
+	s.challenges = newChallenges(s.backend)
+	if s.cert, err = newCertificate(s.config); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.cert.get(nil); err == nil {
+		t.Fatal("expected no certificate before one is obtained")
+	}
+	if err := s.renewCertificate(); err != nil {
+		t.Fatal(err)
+	}
+	cert, err := s.cert.get(nil)
+	if err != nil || cert.Leaf.VerifyHostname(name) != nil || len(cert.Certificate) != 2 {
+		t.Fatalf("expected the certificate for %s with its chain, got %v", name, err)
+	}
+	if vs := s.challenges.values(acmeLabel + name + "."); len(vs) != 0 {
+		t.Fatalf("expected the challenge to be cleaned up, got %v", vs)
+	}
+	for _, file := range []string{acmeAccountFile, acmeCertFile, acmeKeyFile} {
+		if _, err := os.Stat(filepath.Join(dir, file)); err != nil {
+			t.Errorf("expected %s to be saved: %s", file, err)
+		}
+	}
+
+	// After a restart the certificate in the cache is used, and not renewed yet.
+	if s.cert, err = newCertificate(s.config); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.renewCertificate(); err != nil {
+		t.Fatal(err)
+	}
+	if f.orders != 1 {
+		t.Fatalf("expected the certificate to be obtained once, got %d orders", f.orders)
+	}
+	if !s.cert.due([]string{name}, time.Now().Add(61*24*time.Hour)) {
+		t.Errorf("expected the certificate to be due a month before it expires")
+	}
+	if !s.cert.due([]string{name, "www.skydns.test"}, time.Now()) {
+		t.Errorf("expected the certificate to be due for a name it doesn't have")
+	}
+}
@@ -0,0 +1,88 @@
+// Copyright (c) 2014 The SkyDNS Authors. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package server
+
+import (
+	"time"
+
+	"github.com/skynetservices/skydns/cache"
+	"github.com/skynetservices/skydns/msg"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	// aliasCapacity is the number of targets whose addresses are cached.
+	aliasCapacity = 1024
+	// aliasTtl is how long, in seconds, the addresses of a target are cached.
+	aliasTtl = 30
+)
+
+// aliasRecords returns the address records of serv's Host, with q.Name as their
+// owner name. An alias is flattened: it is answered like its Host, without a
+// CNAME, so the apex of our domain can point to, for instance, the name of a
+// load balancer. The addresses of Host are cached for aliasTtl seconds.
+func (s *server) aliasRecords(q dns.Question, serv msg.Service, previousRecords []dns.RR, bufsize uint16, dnssec, both bool) (records []dns.RR) {
+	target := msg.Target(serv.Host)
+	if dns.Fqdn(q.Name) == target || len(previousRecords) > 7 {
+		logf("alias loop detected: %q -> %q", q.Name, target)
+		return nil
+	}
+
+	types := []uint16{q.Qtype}
+	if both {
+		types = []uint16{dns.TypeA, dns.TypeAAAA}
+	}
+	for _, t := range types {
+		for _, r := range s.aliasTarget(target, t, previousRecords, serv.NewCNAME(q.Name, target), bufsize, dnssec) {
+			if r.Header().Rrtype != t {
+				continue
+			}
+			r = dns.Copy(r)
+			r.Header().Name = q.Name
+			if serv.Ttl != 0 && serv.Ttl < r.Header().Ttl {
+				r.Header().Ttl = serv.Ttl
+			}
+			records = append(records, r)
+		}
+	}
+	return records
+}
+
+// aliasTarget returns the records for target of type t: resolved by ourselves
+// when target is in our domain, by the nameservers otherwise. The chain of
+// CNAMEs (and aliases) followed so far, with cname, is used to detect loops.
+func (s *server) aliasTarget(target string, t uint16, previousRecords []dns.RR, cname *dns.CNAME, bufsize uint16, dnssec bool) []dns.RR {
+	q := dns.Question{Name: target, Qtype: t, Qclass: dns.ClassINET}
+	key := cache.Key(q, false, false)
+	if s.acache != nil {
+		if m, exp, hit := s.acache.Search(key); hit && time.Since(exp) < 0 {
+			return m.Answer
+		}
+	}
+
+	var records []dns.RR
+	if dns.IsSubDomain(s.config.Domain, target) {
+		rrs, err := s.AddressRecords(q, target, append(previousRecords, cname), bufsize, dnssec, false)
+		if err == nil {
+			records = rrs
+		}
+	} else {
+		m, err := s.Lookup(target, t, bufsize, dnssec)
+		if err != nil {
+			logf("failure to resolve alias target %q: %s", target, err)
+		} else {
+			records = m.Answer
+		}
+	}
+
+	if s.acache != nil {
+		m := new(dns.Msg)
+		m.SetQuestion(target, t)
+		m.Answer = records
+		s.acache.InsertMessage(key, m)
+	}
+	return records
+}
@@ -0,0 +1,56 @@
+// Copyright (c) 2014 The SkyDNS Authors. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package server
+
+import (
+	"testing"
+
+	"github.com/skynetservices/skydns/msg"
+
+	"github.com/miekg/dns"
+)
+
+func TestAlias(t *testing.T) {
+	s := newTestServer(t, false)
+	defer s.Stop()
+
+	for _, serv := range []*msg.Service{
+		{Key: "apex.dns.skydns.test.", Host: "lb.alias.skydns.test.", Alias: true, Ttl: 60},
+		{Key: "1.lb.alias.skydns.test.", Host: "10.0.2.1"},
+		{Key: "2.lb.alias.skydns.test.", Host: "2001::8:1"},
+		{Key: "www.alias.skydns.test.", Host: "lb.alias.skydns.test.", Alias: true},
+		{Key: "loop.alias.skydns.test.", Host: "loop.alias.skydns.test.", Alias: true},
+	} {
+		addService(t, s, serv.Key, 0, serv)
+		defer delService(t, s, serv.Key)
+	}
+
+	tests := []struct {
+		name  string
+		qtype uint16
+		rrs   []string
+	}{
+		{"skydns.test.", dns.TypeA, []string{"skydns.test.\t60\tIN\tA\t10.0.2.1"}},
+		{"skydns.test.", dns.TypeAAAA, []string{"skydns.test.\t60\tIN\tAAAA\t2001::8:1"}},
+		{"www.alias.skydns.test.", dns.TypeA, []string{"www.alias.skydns.test.\t3600\tIN\tA\t10.0.2.1"}},
+		{"www.alias.skydns.test.", dns.TypeCNAME, nil},
+		{"loop.alias.skydns.test.", dns.TypeA, nil},
+	}
+	for i, tc := range tests {
+		m := new(dns.Msg)
+		m.SetQuestion(tc.name, tc.qtype)
+		w := &testWriter{}
+		s.ServeDNS(w, m)
+		if len(w.msg.Answer) != len(tc.rrs) {
+			t.Errorf("test %d: expected %d answers, got %s", i, len(tc.rrs), w.msg)
+			continue
+		}
+		for j, r := range w.msg.Answer {
+			if r.String() != tc.rrs[j] {
+				t.Errorf("test %d: expected %s, got %s", i, tc.rrs[j], r)
+			}
+		}
+	}
+}
@@ -0,0 +1,92 @@
+// Copyright (c) 2014 The SkyDNS Authors. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package server
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// Answers to ANY queries, see AnyPolicy.
+const (
+	// AnyHINFO answers with a single synthesized HINFO record (RFC 8482, section 4.2).
+	AnyHINFO = "hinfo"
+	// AnyRRset answers with one of the RRsets of the name (RFC 8482, section 4.1).
+	AnyRRset = "rrset"
+	// AnyAll answers with all records of the name.
+	AnyAll = "all"
+)
+
+// AnyPolicy sets how ANY queries for the names in a zone are answered. ANY answers
+// with all records of a name are costly to make and large, which makes them an
+// amplification vector.
+type AnyPolicy struct {
+	// Zone the policy applies to, defaults to Config.Domain. The policy of the most
+	// specific zone is used.
+	Zone string `json:"zone,omitempty"`
+	// Answer is hinfo, rrset or all.
+	Answer string `json:"answer"`
+}
+
+func setAnyPolicyDefaults(config *Config) error {
+	for i := range config.AnyPolicies {
+		p := &config.AnyPolicies[i]
+		if p.Zone == "" {
+			p.Zone = config.Domain
+		}
+		p.Zone = dns.Fqdn(strings.ToLower(p.Zone))
+		if _, ok := dns.IsDomainName(p.Zone); !ok {
+			return fmt.Errorf("any policy %d: invalid zone: %q", i, p.Zone)
+		}
+		switch p.Answer {
+		case AnyHINFO, AnyRRset, AnyAll:
+		default:
+			return fmt.Errorf("any policy %d: answer must be one of %q, %q or %q", i, AnyHINFO, AnyRRset, AnyAll)
+		}
+	}
+	// Most specific zone first.
+	sort.SliceStable(config.AnyPolicies, func(i, j int) bool {
+		return dns.CountLabel(config.AnyPolicies[i].Zone) > dns.CountLabel(config.AnyPolicies[j].Zone)
+	})
+	return nil
+}
+
+// anyPolicy returns how ANY queries for name are answered: by the policy of its
+// zone, otherwise with a HINFO record with MinimalAny, or with all records.
+func (c *Config) anyPolicy(name string) string {
+	for _, p := range c.AnyPolicies {
+		if dns.IsSubDomain(p.Zone, name) {
+			return p.Answer
+		}
+	}
+	if c.MinimalAny {
+		return AnyHINFO
+	}
+	return AnyAll
+}
+
+// anyHINFO returns the HINFO record that answers an ANY query for qname.
+func (s *server) anyHINFO(qname string) dns.RR {
+	hdr := dns.RR_Header{Name: qname, Rrtype: dns.TypeHINFO, Class: dns.ClassINET, Ttl: s.config.Ttl}
+	return &dns.HINFO{Hdr: hdr, Cpu: "RFC8482"}
+}
+
+// firstRRset returns the RRset of the first record in rrs.
+func firstRRset(rrs []dns.RR) []dns.RR {
+	if len(rrs) == 0 {
+		return nil
+	}
+	first := rrs[0].Header()
+	var set []dns.RR
+	for _, r := range rrs {
+		if r.Header().Rrtype == first.Rrtype && strings.EqualFold(r.Header().Name, first.Name) {
+			set = append(set, r)
+		}
+	}
+	return set
+}
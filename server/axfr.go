@@ -0,0 +1,237 @@
+// Copyright (c) 2014 The SkyDNS Authors. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package server
+
+import (
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/skynetservices/skydns/msg"
+
+	"github.com/miekg/dns"
+)
+
+// transferSize is the size a message of a zone transfer is filled up to, the
+// messages can be 64K, but smaller ones are easier on the secondaries.
+const transferSize = 16 * 1024
+
+// ServeDNSTransfer handles an AXFR (RFC 5936) for our domain: all the records of
+// the services in it, framed by the SOA, sent over TCP in as many messages as
+// needed. An IXFR (RFC 1995) gets the changes since the client's serial when
+// they are in the journal, see incremental, and a full transfer otherwise. Only
+// clients in the transfer ACL may ask for either.
+func (s *server) ServeDNSTransfer(w dns.ResponseWriter, req *dns.Msg) *dns.Msg {
+	m := new(dns.Msg)
+	m.SetReply(req)
+	m.Authoritative = true
+
+	q := req.Question[0]
+	zone := strings.ToLower(q.Name)
+	switch {
+	case len(s.config.transferNets) == 0 || !inNets(s.config.transferNets, w.RemoteAddr()):
+		logf("refusing %s for %s from %s", dns.TypeToString[q.Qtype], zone, w.RemoteAddr())
+		m.SetRcode(req, dns.RcodeRefused)
+		s.explain(m, req, reasonTransferACL)
+	case s.config.tsigRequired["transfer"] && !signed(w):
+		logf("refusing unsigned %s for %s from %s", dns.TypeToString[q.Qtype], zone, w.RemoteAddr())
+		m.SetRcode(req, dns.RcodeRefused)
+		s.explain(m, req, reasonTsigRequired)
+	case !isTCP(w) && q.Qtype == dns.TypeAXFR:
+		m.SetRcode(req, dns.RcodeRefused)
+		s.explain(m, req, reasonTransferUDP)
+	case zone != s.config.Domain && zone != s.config.CatalogZone:
+		m.SetRcode(req, dns.RcodeNotAuth)
+		s.explain(m, req, reasonTransferZone)
+	}
+	if m.Rcode != dns.RcodeSuccess {
+		s.setEdns(m, req.IsEdns0())
+		w.WriteMsg(m)
+		return m
+	}
+
+	var records []dns.RR
+	switch {
+	case zone == s.config.CatalogZone:
+		// The catalog is small, an IXFR gets all of it, over UDP only its SOA.
+		records = s.catalogRecords()
+		if isTCP(w) {
+			records = append(records, records[0])
+		} else {
+			records = records[:1]
+		}
+	case q.Qtype == dns.TypeIXFR:
+		records = s.incremental(req, !isTCP(w))
+	}
+	if records == nil {
+		all, err := s.transferRecords()
+		if err != nil {
+			logf("failure to transfer %s: %s", zone, err)
+			m := s.ServerFailure(req)
+			s.explain(m, req, backendReason(err))
+			w.WriteMsg(m)
+			return m
+		}
+		soa := s.NewSOA()
+		records = append([]dns.RR{soa}, append(all, soa)...)
+	}
+
+	if s.config.Verbose {
+		logf("%s of %s to %s, %d records", dns.TypeToString[q.Qtype], zone, w.RemoteAddr(), len(records))
+	}
+	for len(records) > 0 {
+		m = new(dns.Msg)
+		m.SetReply(req)
+		m.Authoritative = true
+		m.Compress = true
+		for len(records) > 0 && (len(m.Answer) == 0 || m.Len() < transferSize) {
+			m.Answer = append(m.Answer, records[0])
+			records = records[1:]
+		}
+		if err := w.WriteMsg(m); err != nil {
+			logf("failure to transfer %s: %s", zone, err)
+			return m
+		}
+	}
+	return m
+}
+
+// transferRecords returns the records of our domain, except the SOA, see
+// serviceRecords. Duplicates, for instance from services that only differ in
+// the fields we don't use, are left out.
+func (s *server) transferRecords() ([]dns.RR, error) {
+	services, err := s.backend.Records(s.config.Domain, false)
+	if err != nil && !isNameError(err, s) {
+		return nil, err
+	}
+	q := dns.Question{Name: s.config.Domain, Qtype: dns.TypeNS, Qclass: dns.ClassINET}
+	records := s.configNS(q)
+	for _, serv := range expandHosts(active(services, time.Now())) {
+		records = append(records, s.serviceRecords(serv)...)
+	}
+
+	seen := make(map[string]bool)
+	ret := records[:0]
+	for _, r := range records {
+		if k := strings.ToLower(r.String()); !seen[k] {
+			seen[k] = true
+			ret = append(ret, r)
+		}
+	}
+	return ret, nil
+}
+
+// serviceRecords returns the records of serv, as they are answered for queries.
+// Nameservers under ns.dns.<zone> become the NS records of the zone, with glue,
+// and services under ds.dns.<zone> its DS records. Aliases are left out, they
+// are resolved when queried and have no record type of their own.
+func (s *server) serviceRecords(serv msg.Service) (records []dns.RR) {
+	name := msg.Domain(serv.Key)
+	if zone, ok := belowLabels(name, "ns.dns"); ok {
+		switch ip := net.ParseIP(serv.Host); {
+		case ip == nil:
+			records = append(records, serv.NewNS(zone, msg.Target(serv.Host)))
+		case ip.To4() != nil:
+			records = append(records, serv.NewNS(zone, name), serv.NewA(name, ip.To4()))
+		default:
+			records = append(records, serv.NewNS(zone, name), serv.NewAAAA(name, ip.To16()))
+		}
+		return records
+	}
+	if zone, ok := belowLabels(name, "ds.dns"); ok {
+		if serv.Ds != nil {
+			records = append(records, serv.NewDS(zone))
+		}
+		return records
+	}
+
+	// The names the service is served under as SRV record.
+	srvNames := []string{name}
+	if serv.Srv != "" && serv.Proto != "" {
+		srvNames = append(srvNames, "_"+serv.Srv+"._"+serv.Proto+"."+name)
+	}
+	weight := uint16(100)
+	if serv.Weight != 0 {
+		weight = uint16(serv.Weight)
+	}
+
+	ip := net.ParseIP(serv.Host)
+	switch {
+	case ip != nil:
+		if ip.To4() != nil {
+			records = append(records, serv.NewA(name, ip.To4()))
+		} else {
+			records = append(records, serv.NewAAAA(name, ip.To16()))
+		}
+		if serv.Port != 0 {
+			serv.Host = name
+			for _, n := range srvNames {
+				records = append(records, serv.NewSRV(n, weight))
+			}
+		}
+	case serv.Host == "" || serv.Alias:
+	case serv.Mail:
+		records = append(records, serv.NewMX(name))
+	case serv.Port != 0:
+		for _, n := range srvNames {
+			records = append(records, serv.NewSRV(n, weight))
+		}
+	default:
+		// A CNAME can not have other data, see AnyRecords.
+		return []dns.RR{serv.NewCNAME(name, msg.Target(serv.Host))}
+	}
+
+	if serv.Text != "" || len(serv.Meta) > 0 {
+		records = append(records, serv.NewTXT(name))
+	}
+	if serv.Naptr != nil {
+		records = append(records, serv.NewNAPTR(name))
+	}
+	if serv.Caa != nil {
+		records = append(records, serv.NewCAA(name))
+	}
+	if serv.Tlsa != nil {
+		port, proto := serv.Port, serv.Proto
+		if port == 0 {
+			port = 443
+		}
+		if proto == "" {
+			proto = "tcp"
+		}
+		records = append(records, serv.NewTLSA("_"+strconv.Itoa(port)+"._"+proto+"."+name))
+	}
+	if serv.Uri != "" {
+		for _, n := range srvNames {
+			records = append(records, serv.NewURI(n))
+		}
+	}
+	if serv.Svcb != nil {
+		for _, t := range []uint16{msg.TypeSVCB, msg.TypeHTTPS} {
+			if svcb := serv.NewSVCB(name, t); svcb != nil {
+				records = append(records, svcb)
+			}
+		}
+	}
+	if serv.Dname != "" {
+		records = append(records, serv.NewDNAME(name))
+	}
+	if serv.Raw != "" {
+		if rr, err := serv.NewRaw(name); err == nil {
+			records = append(records, rr)
+		}
+	}
+	return records
+}
+
+// belowLabels returns the zone of name when name is below <labels>.<zone>, like
+// the nameservers of a zone under ns.dns.<zone>.
+func belowLabels(name, labels string) (string, bool) {
+	i := strings.Index(name, labels+".")
+	if i < 0 || (i > 0 && name[i-1] != '.') {
+		return "", false
+	}
+	return name[i+len(labels)+1:], true
+}
@@ -0,0 +1,92 @@
+// Copyright (c) 2014 The SkyDNS Authors. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package server
+
+import (
+	"net"
+	"testing"
+
+	"github.com/skynetservices/skydns/msg"
+
+	"github.com/miekg/dns"
+)
+
+// transferWriter keeps all the messages of a transfer, sent over TCP.
+type transferWriter struct {
+	testWriter
+	msgs []*dns.Msg
+}
+
+func (w *transferWriter) WriteMsg(m *dns.Msg) error { w.msgs = append(w.msgs, m); return nil }
+func (w *transferWriter) RemoteAddr() net.Addr      { return &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)} }
+
+func TestTransfer(t *testing.T) {
+	s := newTestServer(t, false)
+	defer s.Stop()
+
+	xfr := []*msg.Service{
+		{Host: "10.0.20.1", Key: "a.xfr.skydns.test."},
+		{Host: "10.0.20.2", Port: 8080, Key: "b.xfr.skydns.test."},
+		{Host: "a.xfr.skydns.test", Key: "c.xfr.skydns.test."},
+		{Host: "mail.example.org", Mail: true, Priority: 10, Key: "mx.xfr.skydns.test."},
+		{Text: "hello", Key: "txt.xfr.skydns.test."},
+		{Host: "10.0.20.53", Key: "ns1.ns.dns.skydns.test."},
+	}
+	for _, serv := range xfr {
+		addService(t, s, serv.Key, 0, serv)
+		defer delService(t, s, serv.Key)
+	}
+
+	transfer := func(w dns.ResponseWriter, zone string) []*dns.Msg {
+		m := new(dns.Msg)
+		m.SetAxfr(zone)
+		s.ServeDNS(w, m)
+		if tw, ok := w.(*transferWriter); ok {
+			return tw.msgs
+		}
+		return []*dns.Msg{w.(*testWriter).msg}
+	}
+
+	if resp := transfer(&transferWriter{}, "skydns.test."); len(resp) != 1 || resp[0].Rcode != dns.RcodeRefused {
+		t.Fatalf("expected REFUSED without a transfer ACL, got %v", resp)
+	}
+	_, n, _ := net.ParseCIDR("127.0.0.0/8")
+	s.config.transferNets = []*net.IPNet{n}
+	if resp := transfer(&testWriter{}, "skydns.test."); len(resp) != 1 || resp[0].Rcode != dns.RcodeRefused {
+		t.Fatalf("expected REFUSED over UDP, got %v", resp)
+	}
+	if resp := transfer(&transferWriter{}, "example.org."); len(resp) != 1 || resp[0].Rcode != dns.RcodeNotAuth {
+		t.Fatalf("expected NOTAUTH for a zone that is not ours, got %v", resp)
+	}
+
+	var records []dns.RR
+	for _, m := range transfer(&transferWriter{}, "skydns.test.") {
+		if m.Rcode != dns.RcodeSuccess || !m.Authoritative {
+			t.Fatalf("expected an authoritative reply, got %s", m)
+		}
+		records = append(records, m.Answer...)
+	}
+	if len(records) < 2 || records[0].Header().Rrtype != dns.TypeSOA || records[len(records)-1].Header().Rrtype != dns.TypeSOA {
+		t.Fatalf("expected the transfer to start and end with the SOA, got %v", records)
+	}
+	found := make(map[string]bool)
+	for _, r := range records {
+		found[r.String()] = true
+	}
+	for _, want := range []string{
+		"a.xfr.skydns.test.\t3600\tIN\tA\t10.0.20.1",
+		"b.xfr.skydns.test.\t3600\tIN\tA\t10.0.20.2",
+		"b.xfr.skydns.test.\t3600\tIN\tSRV\t10 100 8080 b.xfr.skydns.test.",
+		"c.xfr.skydns.test.\t3600\tIN\tCNAME\ta.xfr.skydns.test.",
+		"mx.xfr.skydns.test.\t3600\tIN\tMX\t10 mail.example.org.",
+		"txt.xfr.skydns.test.\t3600\tIN\tTXT\t\"hello\"",
+		"skydns.test.\t3600\tIN\tNS\tns1.ns.dns.skydns.test.",
+		"ns1.ns.dns.skydns.test.\t3600\tIN\tA\t10.0.20.53",
+	} {
+		if !found[want] {
+			t.Errorf("expected %q in the transfer", want)
+		}
+	}
+}
@@ -4,14 +4,49 @@
 
 package server
 
-import "github.com/skynetservices/skydns/msg"
+import (
+	"context"
+	"errors"
+	"strings"
+	"time"
 
+	"github.com/skynetservices/skydns/metrics"
+	"github.com/skynetservices/skydns/msg"
+
+	"github.com/miekg/dns"
+)
+
+// Backend is the store the services are looked up in. Records returns the
+// services of name, or those below it unless exact is set, ReverseRecord the
+// service of a reverse name. A name without services is msg.ErrNotFound, a store
+// that can't be reached is a *msg.UnavailableError. A backend may also be a
+// Watcher, Revisioner or Writer.
 type Backend interface {
 	HasSynced() bool
 	Records(name string, exact bool) ([]msg.Service, error)
 	ReverseRecord(name string) (*msg.Service, error)
 }
 
+// Revisioner is implemented by backends that can tell when the data under a name
+// changed. It is used for the SOA serial.
+type Revisioner interface {
+	Revision(name string) (msg.Revision, error)
+}
+
+// Watcher is implemented by backends that can report changes to their services.
+// Watch calls f for every change, until the watch fails or ctx is done.
+type Watcher interface {
+	Watch(ctx context.Context, f func(msg.Change)) error
+}
+
+// Writer is implemented by backends that can store services, for dynamic
+// updates. Put stores serv under name, in a key of its own named id, Delete
+// removes the service stored at key.
+type Writer interface {
+	Put(name, id string, serv *msg.Service) error
+	Delete(key string) error
+}
+
 // FirstBackend exposes the Backend interface over multiple Backends, returning
 // the first Backend that answers the provided record request. If no Backend answers
 // a record request, the last error seen will be returned.
@@ -50,3 +85,192 @@ func (g FirstBackend) HasSynced() bool {
 	// Stub implementation only to satisfy interface.
 	return true
 }
+
+// records calls s.backend.Records and reports how long it took. Services that
+// are not active are left out, and then the duplicates of the others.
+func (s *server) records(name string, exact bool) ([]msg.Service, error) {
+	defer metrics.ReportStage(metrics.StageBackend, time.Now())
+	if s.mdns != nil {
+		if sx, ok := s.mdns.records(name, exact, time.Now()); ok {
+			return sx, nil
+		}
+	}
+	name, tag := s.splitTag(name)
+	sx, err := s.backend.Records(name, exact)
+	sx = expandHosts(sx)
+	if !s.nameserverName(name) {
+		sx = s.withoutNameservers(sx)
+	}
+	n := len(sx)
+	if sx = active(sx, time.Now()); err == nil && n > 0 && len(sx) == 0 {
+		return nil, errNotActive
+	}
+	sx = msg.Dedup(sx)
+	if tag != "" && err == nil {
+		if sx = withTag(sx, tag); len(sx) == 0 {
+			return nil, errNoTag
+		}
+	}
+	if isWildcard(name) {
+		sx = atWildcard(sx, name)
+	}
+	return sx, err
+}
+
+var (
+	// errNotActive is returned by records when there are services for a name,
+	// but none of them is active. It is a name error, see isNameError.
+	errNotActive = errors.New("no active service")
+	// errNoTag is returned by records when none of the services for a name has
+	// the tag that was asked for. It is a name error too.
+	errNoTag = errors.New("no service with tag")
+)
+
+// splitTag returns the name and the tag of a query for the services of a name
+// with a tag: <TagLabel>.<tag>.<name>. For other names the tag is empty.
+func (s *server) splitTag(name string) (string, string) {
+	prefix := s.config.TagLabel + "."
+	if !strings.HasPrefix(name, prefix) {
+		return name, ""
+	}
+	rest := name[len(prefix):]
+	i := strings.IndexByte(rest, '.')
+	if i <= 0 || !dns.IsSubDomain(s.config.Domain, rest[i+1:]) {
+		return name, ""
+	}
+	return rest[i+1:], rest[:i]
+}
+
+// withTag filters the services in sx that have tag, in place.
+func withTag(sx []msg.Service, tag string) []msg.Service {
+	ret := sx[:0]
+	for _, serv := range sx {
+		if serv.HasTag(tag) {
+			ret = append(ret, serv)
+		}
+	}
+	return ret
+}
+
+// expandHosts returns sx with every service that has Hosts replaced by a service
+// for each of its hosts, Host first, that is otherwise the same. So a key with
+// several addresses is a name with several A and AAAA records.
+func expandHosts(sx []msg.Service) []msg.Service {
+	n := 0
+	for _, serv := range sx {
+		n += len(serv.Hosts)
+	}
+	if n == 0 {
+		return sx
+	}
+	ret := make([]msg.Service, 0, len(sx)+n)
+	for _, serv := range sx {
+		if len(serv.Hosts) == 0 {
+			ret = append(ret, serv)
+			continue
+		}
+		hosts := serv.Hosts
+		if serv.Host != "" {
+			hosts = append([]string{serv.Host}, hosts...)
+		}
+		seen := make(map[string]bool, len(hosts))
+		for _, h := range hosts {
+			if h == "" || seen[h] {
+				continue
+			}
+			seen[h] = true
+			serv1 := serv
+			serv1.Host, serv1.Hosts = h, nil
+			ret = append(ret, serv1)
+		}
+	}
+	return ret
+}
+
+// withoutNameservers filters the services under ns.dns.<zone> or ds.dns.<zone>
+// from sx, in place. They are the nameservers of our domain or the nameservers and
+// DS records of a delegated zone (see Referral), not records of the names above
+// them.
+func (s *server) withoutNameservers(sx []msg.Service) []msg.Service {
+	ret := sx[:0]
+	for _, serv := range sx {
+		if serv.Key != "" && s.nameserverName(msg.Domain(serv.Key)) {
+			continue
+		}
+		ret = append(ret, serv)
+	}
+	return ret
+}
+
+// nameserverName returns true if name is ns.dns.<zone> or ds.dns.<zone>, or below
+// them, where zone is our domain or a zone delegated from it. Only whole labels
+// below our domain are compared, fans.dns.<domain> is an ordinary name.
+func (s *server) nameserverName(name string) bool {
+	name = strings.ToLower(name)
+	if !dns.IsSubDomain(s.config.Domain, name) {
+		return false
+	}
+	rel := "." + strings.TrimSuffix(name, s.config.Domain)
+	return strings.Contains(rel, ".ns.dns.") || strings.Contains(rel, ".ds.dns.")
+}
+
+// reverseRecord calls s.backend.ReverseRecord and reports how long it took. A
+// service that is not active is not returned.
+func (s *server) reverseRecord(name string) (*msg.Service, error) {
+	defer metrics.ReportStage(metrics.StageBackend, time.Now())
+	serv, err := s.backend.ReverseRecord(name)
+	if serv == nil {
+		return nil, err
+	}
+	sx := active([]msg.Service{*serv}, time.Now())
+	if len(sx) == 0 {
+		return nil, err
+	}
+	return &sx[0], err
+}
+
+// active filters the services in sx that are active at now, in place. The TTL
+// of a service that stops being active is lowered to the time it has left, so
+// resolvers don't cache it past that.
+func active(sx []msg.Service, now time.Time) []msg.Service {
+	ret := sx[:0]
+	for _, serv := range sx {
+		if !serv.Active(now) {
+			continue
+		}
+		if until := serv.Until(); until != nil {
+			serv.CapTtl(uint32(until.Sub(now)/time.Second) + 1)
+		}
+		ret = append(ret, serv)
+	}
+	return ret
+}
+
+// group calls msg.Group and reports how long it took.
+func group(sx []msg.Service) []msg.Service {
+	defer metrics.ReportStage(metrics.StageGroup, time.Now())
+	return msg.Group(sx)
+}
+
+// failover returns the services of sx with the lowest Priority, when
+// PriorityFailover is set, the others are standbys that are only used when those
+// are gone. Services without a Host, like TXT records, take no part in it and are
+// all returned.
+func (s *server) failover(sx []msg.Service) []msg.Service {
+	if !s.config.PriorityFailover {
+		return sx
+	}
+	lowest := -1
+	for _, serv := range sx {
+		if serv.Host != "" && (lowest < 0 || serv.Priority < lowest) {
+			lowest = serv.Priority
+		}
+	}
+	ret := sx[:0]
+	for _, serv := range sx {
+		if serv.Host == "" || serv.Priority == lowest {
+			ret = append(ret, serv)
+		}
+	}
+	return ret
+}
@@ -0,0 +1,183 @@
+// Copyright (c) 2014 The SkyDNS Authors. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package server
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	backendetcdv3 "github.com/skynetservices/skydns/backends/etcd3"
+	"github.com/skynetservices/skydns/msg"
+
+	etcdv3 "github.com/coreos/etcd/clientv3"
+	"github.com/miekg/dns"
+)
+
+// memBackend is a Backend of services in memory, keyed by name, to test the
+// server without etcd.
+type memBackend map[string]msg.Service
+
+func (b memBackend) HasSynced() bool { return true }
+
+func (b memBackend) Records(name string, exact bool) ([]msg.Service, error) {
+	var sx []msg.Service
+	for n, serv := range b {
+		if n == name || (!exact && strings.HasSuffix(n, "."+name)) {
+			serv.Key = msg.Path(n)
+			sx = append(sx, serv)
+		}
+	}
+	if len(sx) == 0 {
+		return nil, msg.ErrNotFound
+	}
+	return sx, nil
+}
+
+func (b memBackend) ReverseRecord(name string) (*msg.Service, error) {
+	serv, ok := b[name]
+	if !ok {
+		return nil, msg.ErrNotFound
+	}
+	serv.Key = msg.Path(name)
+	return &serv, nil
+}
+
+func TestBackend(t *testing.T) {
+	config := &Config{Domain: "skydns.test.", Nameservers: []string{"127.0.0.1:53"}}
+	if err := SetDefaults(config); err != nil {
+		t.Fatal(err)
+	}
+	s := New(memBackend{"www.skydns.test.": {Host: "10.0.0.1", Ttl: 60}}, config)
+
+	query := func(name string) *dns.Msg {
+		m := new(dns.Msg)
+		m.SetQuestion(name, dns.TypeA)
+		w := &testWriter{}
+		s.ServeDNS(w, m)
+		return w.msg
+	}
+	if resp := query("www.skydns.test."); len(resp.Answer) != 1 || resp.Answer[0].(*dns.A).A.String() != "10.0.0.1" {
+		t.Errorf("expected the address of www, got %s", resp)
+	}
+	if resp := query("nope.skydns.test."); resp.Rcode != dns.RcodeNameError {
+		t.Errorf("expected NXDOMAIN, got %s", resp)
+	}
+
+	s.backend = FirstBackend{memBackend{}, memBackend{"www.skydns.test.": {Host: "10.0.0.2", Ttl: 60}}}
+	if resp := query("www.skydns.test."); len(resp.Answer) != 1 || resp.Answer[0].(*dns.A).A.String() != "10.0.0.2" {
+		t.Errorf("expected the address of www from the second backend, got %s", resp)
+	}
+	if !isNameError(msg.ErrNotFound, s) || isNameError(&msg.UnavailableError{Err: errors.New("down")}, s) {
+		t.Errorf("expected only msg.ErrNotFound to be a name error")
+	}
+
+	s.backend = failingBackend{memBackend{"www.skydns.test.": {Host: "10.0.0.1", Ttl: 60}}, "ds.dns."}
+	m := new(dns.Msg)
+	m.SetQuestion("www.skydns.test.", dns.TypeDS)
+	w := &testWriter{}
+	s.ServeDNS(w, m)
+	if w.msg.Rcode != dns.RcodeServerFailure {
+		t.Errorf("expected SERVFAIL when the DS records can't be read, got %s", w.msg)
+	}
+}
+
+// failingBackend is a memBackend that can't reach its store for the names that
+// start with fail.
+type failingBackend struct {
+	memBackend
+	fail string
+}
+
+func (b failingBackend) Records(name string, exact bool) ([]msg.Service, error) {
+	if strings.HasPrefix(name, b.fail) {
+		return nil, &msg.UnavailableError{Err: errors.New("down")}
+	}
+	return b.memBackend.Records(name, exact)
+}
+
+func TestNameserverName(t *testing.T) {
+	tests := []struct {
+		domain, name string
+		nameserver   bool
+	}{
+		{"skydns.test.", "ns.dns.skydns.test.", true},
+		{"skydns.test.", "a.ns.dns.skydns.test.", true},
+		{"skydns.test.", "ds.dns.delegated.skydns.test.", true},
+		{"skydns.test.", "NS.dns.skydns.test.", true},
+		{"skydns.test.", "fans.dns.skydns.test.", false},
+		{"skydns.test.", "ns.dnsx.skydns.test.", false},
+		{"skydns.test.", "ns.dns.example.org.", false},
+		{"ns.dns.test.", "www.ns.dns.test.", false},
+		{"ns.dns.test.", "a.ns.dns.ns.dns.test.", true},
+	}
+	for i, tc := range tests {
+		s := &server{config: &Config{Domain: tc.domain}}
+		if ns := s.nameserverName(tc.name); ns != tc.nameserver {
+			t.Errorf("test %d: expected %t for %s, got %t", i, tc.nameserver, tc.name, ns)
+		}
+		sx := s.withoutNameservers([]msg.Service{{Key: msg.Path(tc.name)}})
+		if (len(sx) == 0) != tc.nameserver {
+			t.Errorf("test %d: expected %s to be filtered %t", i, tc.name, tc.nameserver)
+		}
+	}
+}
+
+func TestBackendDedup(t *testing.T) {
+	config := &Config{Domain: "skydns.test.", Nameservers: []string{"127.0.0.1:53"}}
+	if err := SetDefaults(config); err != nil {
+		t.Fatal(err)
+	}
+	expired := &msg.Time{Time: time.Unix(1, 0)}
+	s := New(memBackend{
+		"a.web.skydns.test.": {Host: "10.0.0.1", Expires: expired},
+		"b.web.skydns.test.": {Host: "10.0.0.1"},
+	}, config)
+
+	// The expired service doesn't hide the one that is the same but for that.
+	sx, err := s.records("web.skydns.test.", false)
+	if err != nil || len(sx) != 1 || sx[0].Key != msg.Path("b.web.skydns.test.") {
+		t.Errorf("expected the service that didn't expire, got %v, %v", sx, err)
+	}
+}
+
+func TestEtcd3Leases(t *testing.T) {
+	client, err := etcdv3.New(etcdv3.Config{Endpoints: []string{"http://127.0.0.1:2379"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	defer client.Delete(ctx, "/skydns-v3/", etcdv3.WithPrefix())
+	b := backendetcdv3.NewBackendv3(*client, ctx, &backendetcdv3.Config{Ttl: 3600, Priority: 10, PathPrefix: "skydns-v3"})
+
+	lease, err := client.Grant(ctx, 60)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.Put(ctx, "/skydns-v3/test/skydns/lease", `{"host": "10.0.0.1"}`, etcdv3.WithLease(lease.ID)); err != nil {
+		t.Fatal(err)
+	}
+	sx, err := b.Records("lease.skydns.test.", true)
+	if err != nil || len(sx) != 1 {
+		t.Fatalf("expected the service with a lease, got %v, %v", sx, err)
+	}
+	if sx[0].Ttl == 0 || sx[0].Ttl > 60 {
+		t.Errorf("expected the TTL of the lease, got %d", sx[0].Ttl)
+	}
+
+	expires := &msg.Time{Time: time.Now().Add(30 * time.Second)}
+	if err := b.Put("ephemeral.skydns.test.", "1", &msg.Service{Host: "10.0.0.2", Expires: expires}); err != nil {
+		t.Fatal(err)
+	}
+	resp, err := client.Get(ctx, "/skydns-v3/test/skydns/ephemeral/1")
+	if err != nil || len(resp.Kvs) != 1 {
+		t.Fatalf("expected the ephemeral service, got %v, %v", resp, err)
+	}
+	ttl, err := client.TimeToLive(ctx, etcdv3.LeaseID(resp.Kvs[0].Lease))
+	if err != nil || ttl.TTL <= 0 || ttl.TTL > 31 {
+		t.Errorf("expected a lease that expires with the service, got %v, %v", ttl, err)
+	}
+}
@@ -9,6 +9,7 @@ import (
 
 	"github.com/miekg/dns"
 	"github.com/skynetservices/skydns/cache"
+	"github.com/skynetservices/skydns/msg"
 )
 
 func TestFit(t *testing.T) {
@@ -27,6 +28,40 @@ func TestFit(t *testing.T) {
 	}
 }
 
+func TestFitAdditional(t *testing.T) {
+	m := new(dns.Msg)
+	m.SetQuestion("skydns.test.", dns.TypeSRV)
+	m.SetEdns0(4096, false)
+
+	srv, _ := dns.NewRR("www.skydns.test. IN SRV 10 10 8080 server.skydns.test.")
+	a, _ := dns.NewRR("server.skydns.test. IN A 10.0.0.1")
+	for i := 0; i < 10; i++ {
+		m.Answer = append(m.Answer, srv)
+		m.Extra = append([]dns.RR{a}, m.Extra...)
+	}
+
+	// Dropping some of the additional records is enough.
+	m1, truncated := Fit(m.Copy(), 600, false)
+	if truncated || m1.Truncated {
+		t.Fatalf("expected message to fit without truncation")
+	}
+	if len(m1.Answer) != 10 || len(m1.Extra) == 0 || len(m1.Extra) > 10 || m1.IsEdns0() == nil {
+		t.Fatalf("expected 10 answers, some additional records and the OPT RR, got %d answers and %d extra", len(m1.Answer), len(m1.Extra))
+	}
+	if m1.Len() > 600 {
+		t.Fatalf("expected message to be less than %d octets, got %d", 600, m1.Len())
+	}
+
+	// Too small for all answers, so we truncate.
+	m1, truncated = Fit(m.Copy(), 300, false)
+	if !truncated || !m1.Truncated {
+		t.Fatalf("expected message to be truncated")
+	}
+	if len(m1.Answer) == 0 || m1.Len() > 300 {
+		t.Fatalf("expected at least one answer and less than %d octets, got %d answers and %d octets", 300, len(m1.Answer), m1.Len())
+	}
+}
+
 func TestCacheTruncated(t *testing.T) {
 	s := newTestServer(t, true)
 	m := &dns.Msg{}
@@ -41,6 +76,85 @@ func TestCacheTruncated(t *testing.T) {
 	}
 }
 
+// packedWriter is a testWriter that also takes packed replies.
+type packedWriter struct {
+	testWriter
+	packed []byte
+}
+
+func (w *packedWriter) Write(b []byte) (int, error) { w.packed = b; return len(b), nil }
+
+func TestCachePacked(t *testing.T) {
+	s := newTestServer(t, true)
+	defer s.Stop()
+	s.pcache = cache.NewPacked(100, 60, 1)
+
+	serv := &msg.Service{Key: "a.packed.skydns.test.", Host: "10.0.4.1"}
+	addService(t, s, serv.Key, 0, serv)
+	defer delService(t, s, serv.Key)
+
+	query := func(id uint16) *packedWriter {
+		m := new(dns.Msg)
+		m.SetQuestion("packed.skydns.test.", dns.TypeA)
+		m.Id = id
+		w := &packedWriter{}
+		s.ServeDNS(w, m)
+		return w
+	}
+
+	// Answered from the backend, then from the response cache, packed.
+	if w := query(1); w.msg == nil || w.packed != nil {
+		t.Fatal("expected an unpacked reply from the backend")
+	}
+	w := query(2)
+	if w.packed == nil {
+		t.Fatal("expected a packed reply from the response cache")
+	}
+	w = query(3)
+	if w.packed == nil || w.msg != nil {
+		t.Fatal("expected a reply from the packed cache")
+	}
+	m := new(dns.Msg)
+	if err := m.Unpack(w.packed); err != nil {
+		t.Fatal(err)
+	}
+	if m.Id != 3 || len(m.Answer) != 1 || m.Answer[0].(*dns.A).A.String() != "10.0.4.1" {
+		t.Fatalf("expected the answer with ID 3, got %s", m)
+	}
+
+	// NOTIFY removes packed replies by their lowercased name.
+	if n := s.pcache.RemoveFunc(func(name string) bool { return name == "packed.skydns.test." }); n != 1 {
+		t.Fatalf("expected 1 packed reply, got %d", n)
+	}
+}
+
+func TestCachePreload(t *testing.T) {
+	s := newTestServer(t, true)
+	defer s.Stop()
+
+	for _, serv := range services[:5] {
+		addService(t, s, serv.Key, 0, serv)
+		defer delService(t, s, serv.Key)
+	}
+
+	n, err := s.preload()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n < 5 {
+		t.Fatalf("expected at least 5 names to be preloaded, got %d", n)
+	}
+
+	for _, q := range []dns.Question{
+		{Name: services[0].Key, Qtype: dns.TypeSRV, Qclass: dns.ClassINET},
+		{Name: services[4].Key, Qtype: dns.TypeA, Qclass: dns.ClassINET},
+	} {
+		if m := s.rcache.Hit(q, false, false, 1); m == nil {
+			t.Errorf("expected %s/%d to be cached", q.Name, q.Qtype)
+		}
+	}
+}
+
 // Store a large message in the cache, then query with a smaller bufsize and check
 // we get back a smaller message.
 // TODO(miek).
@@ -0,0 +1,129 @@
+// Copyright (c) 2014 The SkyDNS Authors. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package server
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/skynetservices/skydns/metrics"
+
+	"github.com/miekg/dns"
+)
+
+// catalogVersion is the schema version of the catalog zone, RFC 9432, section 4.2.1.
+const catalogVersion = "2"
+
+func setCatalogDefaults(config *Config) error {
+	if config.CatalogZone == "" {
+		return nil
+	}
+	config.CatalogZone = dns.Fqdn(strings.ToLower(config.CatalogZone))
+	if _, ok := dns.IsDomainName(config.CatalogZone); !ok || config.CatalogZone == "." {
+		return fmt.Errorf("invalid catalog_zone: %q", config.CatalogZone)
+	}
+	if config.CatalogZone == config.Domain {
+		return fmt.Errorf("catalog_zone can't be our domain: %q", config.CatalogZone)
+	}
+	for _, t := range config.Tenants {
+		if config.CatalogZone == t.Domain {
+			return fmt.Errorf("catalog_zone can't be the domain of tenant %q: %q", t.Name, config.CatalogZone)
+		}
+	}
+	// The members only change when we are restarted with another config, a newer
+	// serial makes the secondaries transfer the catalog again.
+	config.catalogSerial = uint32(time.Now().Unix())
+	return nil
+}
+
+// catalogMembers returns the zones in the catalog: our domain and the domains
+// of the tenants.
+func (s *server) catalogMembers() []string {
+	members := []string{s.config.Domain}
+	for _, t := range s.tenants {
+		members = append(members, t.config.Domain)
+	}
+	return members
+}
+
+// catalogRecords returns the records of the catalog zone (RFC 9432), the SOA
+// first. A member zone is listed under a hash of its name, which stays the same
+// as long as the zone is in the catalog.
+func (s *server) catalogRecords() []dns.RR {
+	zone := s.config.CatalogZone
+	hdr := func(name string, rrtype uint16) dns.RR_Header {
+		return dns.RR_Header{Name: name, Rrtype: rrtype, Class: dns.ClassINET, Ttl: 0}
+	}
+	records := []dns.RR{
+		&dns.SOA{Hdr: hdr(zone, dns.TypeSOA), Ns: "invalid.", Mbox: "invalid.", Serial: s.config.catalogSerial,
+			Refresh: s.config.SOA.Refresh, Retry: s.config.SOA.Retry, Expire: s.config.SOA.Expire, Minttl: 0},
+		&dns.NS{Hdr: hdr(zone, dns.TypeNS), Ns: "invalid."},
+		&dns.TXT{Hdr: hdr("version."+zone, dns.TypeTXT), Txt: []string{catalogVersion}},
+	}
+	for _, member := range s.catalogMembers() {
+		id := sha1.Sum([]byte(member))
+		records = append(records, &dns.PTR{Hdr: hdr(hex.EncodeToString(id[:])+".zones."+zone, dns.TypePTR), Ptr: member})
+	}
+	return records
+}
+
+// ServeDNSCatalog handles the queries for the catalog zone. Like transfers they
+// are only answered for the clients in the transfer ACL, the secondaries that
+// check its SOA; the catalog is not meant for resolvers.
+func (s *server) ServeDNSCatalog(w dns.ResponseWriter, req *dns.Msg) {
+	start := time.Now()
+	q := req.Question[0]
+	if req.Opcode != dns.OpcodeQuery || q.Qtype == dns.TypeAXFR || q.Qtype == dns.TypeIXFR {
+		s.ServeDNS(w, req)
+		return
+	}
+	metrics.ReportRequestCount(req, metrics.Auth)
+
+	m := s.newReply(req)
+	if len(s.config.transferNets) == 0 || !inNets(s.config.transferNets, w.RemoteAddr()) {
+		m.SetRcode(req, dns.RcodeRefused)
+		s.explain(m, req, reasonTransferACL)
+	} else {
+		s.catalogAnswer(m, q)
+	}
+	s.setEdns(m, req.IsEdns0())
+	if err := w.WriteMsg(m); err != nil {
+		logf("failure to return reply %q", err)
+	}
+
+	metrics.ReportDuration(m, start, metrics.Auth)
+	metrics.ReportErrorCount(m, metrics.Auth)
+}
+
+// catalogAnswer adds the records of the catalog zone for q to m, or the SOA for
+// a name or type that doesn't exist.
+func (s *server) catalogAnswer(m *dns.Msg, q dns.Question) {
+	records := s.catalogRecords()
+	name := strings.ToLower(q.Name)
+	exists := false
+	for _, r := range records {
+		owner := strings.ToLower(r.Header().Name)
+		switch {
+		case owner == name:
+			exists = true
+			if q.Qtype == r.Header().Rrtype || q.Qtype == dns.TypeANY {
+				r.Header().Name = q.Name
+				m.Answer = append(m.Answer, r)
+			}
+		case dns.IsSubDomain(name, owner):
+			// An empty non-terminal, such as zones.<catalog>.
+			exists = true
+		}
+	}
+	if !exists {
+		m.Rcode = dns.RcodeNameError
+	}
+	if len(m.Answer) == 0 {
+		m.Ns = []dns.RR{records[0]}
+	}
+}
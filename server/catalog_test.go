@@ -0,0 +1,93 @@
+// Copyright (c) 2014 The SkyDNS Authors. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package server
+
+import (
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestCatalog(t *testing.T) {
+	s := newTestServer(t, false, func(s *server) {
+		s.config.CatalogZone = "Catalog.Invalid"
+		if err := setCatalogDefaults(s.config); err != nil {
+			t.Fatal(err)
+		}
+	})
+	defer s.Stop()
+
+	if err := s.AddTenant(Tenant{Name: "team", Domain: "team.test."}, s.backend); err != nil {
+		t.Fatal(err)
+	}
+
+	query := func(name string, qtype uint16) *dns.Msg {
+		m := new(dns.Msg)
+		m.SetQuestion(name, qtype)
+		w := &testWriter{}
+		s.ServeDNSCatalog(w, m)
+		return w.msg
+	}
+	if resp := query("catalog.invalid.", dns.TypeSOA); resp.Rcode != dns.RcodeRefused {
+		t.Fatalf("expected REFUSED without a transfer ACL, got %s", resp)
+	}
+
+	_, n, _ := net.ParseCIDR("127.0.0.0/8")
+	s.config.transferNets = []*net.IPNet{n}
+	if resp := query("catalog.invalid.", dns.TypeSOA); len(resp.Answer) != 1 || resp.Answer[0].(*dns.SOA).Serial != s.config.catalogSerial {
+		t.Errorf("expected the SOA of the catalog, got %s", resp)
+	}
+	if resp := query("version.catalog.invalid.", dns.TypeTXT); len(resp.Answer) != 1 || resp.Answer[0].(*dns.TXT).Txt[0] != "2" {
+		t.Errorf("expected the version of the catalog, got %s", resp)
+	}
+	if resp := query("zones.catalog.invalid.", dns.TypePTR); resp.Rcode != dns.RcodeSuccess || len(resp.Answer) != 0 || len(resp.Ns) != 1 {
+		t.Errorf("expected NODATA for an empty non-terminal, got %s", resp)
+	}
+	if resp := query("other.catalog.invalid.", dns.TypeTXT); resp.Rcode != dns.RcodeNameError {
+		t.Errorf("expected NXDOMAIN, got %s", resp)
+	}
+
+	m := new(dns.Msg)
+	m.SetAxfr("catalog.invalid.")
+	w := &transferWriter{}
+	s.ServeDNSCatalog(w, m)
+	var records []dns.RR
+	for _, m := range w.msgs {
+		records = append(records, m.Answer...)
+	}
+	if len(records) != 6 || records[0].Header().Rrtype != dns.TypeSOA || records[5].Header().Rrtype != dns.TypeSOA {
+		t.Fatalf("expected the catalog framed by its SOA, got %v", records)
+	}
+	members := make(map[string]bool)
+	for _, r := range records {
+		if ptr, ok := r.(*dns.PTR); ok {
+			members[ptr.Ptr] = true
+		}
+	}
+	if !members["skydns.test."] || !members["team.test."] {
+		t.Errorf("expected our domain and the tenant's in the catalog, got %v", records)
+	}
+}
+
+func TestCatalogConfig(t *testing.T) {
+	tests := []struct {
+		zone string
+		ok   bool
+	}{
+		{"catalog.invalid.", true},
+		{"catalog.skydns.test.", true},
+		{"skydns.test.", false},
+		{"team.test.", false},
+		{"a..b", false},
+	}
+	for i, tc := range tests {
+		config := &Config{Domain: "skydns.test.", Nameservers: []string{"127.0.0.1:53"}, CatalogZone: tc.zone,
+			Tenants: []Tenant{{Name: "team", Domain: "team.test."}}}
+		if err := SetDefaults(config); tc.ok != (err == nil) {
+			t.Errorf("test %d: expected ok %t, got error %v", i, tc.ok, err)
+		}
+	}
+}
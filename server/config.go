@@ -19,15 +19,60 @@ const (
 	SCacheCapacity = 10000
 	RCacheCapacity = 100000
 	RCacheTtl      = 60
+	RCacheShards   = 16
 	Ndots          = 2
+	CNAMEDepth     = 8
+	TagLabel       = "_tag"
+	EdnsUDPSize    = 4096
+	FormErrRate    = 10
+	PopularCount   = 100
+
+	// Values for Config.Additional.
+	AdditionalAll      = "all"
+	AdditionalInternal = "internal"
+	AdditionalNone     = "none"
 )
 
 // Config provides options to the SkyDNS resolver.
 type Config struct {
 	// The ip:port SkyDNS should be listening on for incoming DNS requests.
 	DnsAddr string `json:"dns_addr,omitempty"`
+	// Interfaces, network interfaces to listen on every address of, at the port of
+	// DnsAddr, instead of its address. Replies leave from the address the query
+	// was sent to either way.
+	Interfaces []string `json:"interfaces,omitempty"`
 	// bind to port(s) activated by systemd. If set to true, this overrides DnsAddr.
 	Systemd bool `json:"systemd,omitempty"`
+	// Query all services once at startup, before listening, to warm the backend and
+	// the response cache.
+	Preload bool `json:"preload,omitempty"`
+	// File the most popular questions are saved to every minute. On startup the
+	// response cache is warmed with these questions, before listening.
+	PopularFile string `json:"popular_file,omitempty"`
+	// Number of questions saved to PopularFile. Defaults to 100.
+	PopularCount int `json:"popular_count,omitempty"`
+	// Number of goroutines handling queries. Zero means every query is handled
+	// in its own goroutine.
+	Workers int `json:"workers,omitempty"`
+	// Number of queries that may wait for a free worker, when this queue is full
+	// queries are shed.
+	WorkerQueue int `json:"worker_queue,omitempty"`
+	// Drop shed queries instead of replying with REFUSED.
+	ShedDrop bool `json:"shed_drop,omitempty"`
+	// Strictly validate queries before handling them, see checkQuery. Bad queries
+	// get FORMERR, rate limited per source, and panics while handling a query are
+	// recovered from.
+	Strict bool `json:"strict,omitempty"`
+	// FormErrRate, the number of FORMERR replies per second we send to a single
+	// source when running strict. Defaults to 10.
+	FormErrRate int `json:"formerr_rate,omitempty"`
+	// Number of UDP packets read and written with a single system call, Linux only.
+	// Zero or one disables batching.
+	UDPBatch int `json:"udp_batch,omitempty"`
+	// Number of queries on a TCP connection that are handled at the same time,
+	// their replies are written as they are done. Zero or one handles them one
+	// after another.
+	TCPPipeline int `json:"tcp_pipeline,omitempty"`
 	// The domain SkyDNS is authoritative for, defaults to skydns.local.
 	Domain string `json:"domain,omitempty"`
 	// Domain pointing to a key where service info is stored when being queried
@@ -35,16 +80,114 @@ type Config struct {
 	Local string `json:"local,omitempty"`
 	// The hostmaster responsible for this domain, defaults to hostmaster.<Domain>.
 	Hostmaster string `json:"hostmaster,omitempty"`
-	DNSSEC     string `json:"dnssec,omitempty"`
+	// ChaosVersion, the answer to version.bind and version.server CH TXT queries,
+	// defaults to the version of SkyDNS.
+	ChaosVersion string `json:"chaos_version,omitempty"`
+	// ChaosHostname, the answer to hostname.bind CH TXT queries, defaults to the
+	// host name.
+	ChaosHostname string `json:"chaos_hostname,omitempty"`
+	// ChaosID, the answer to id.server CH TXT queries (RFC 4892), defaults to
+	// ChaosHostname.
+	ChaosID string `json:"chaos_id,omitempty"`
+	// Refuse all CHAOS class queries, so we don't tell what we are.
+	NoChaos bool `json:"no_chaos,omitempty"`
+	// SOA, the other parameters of the SOA record of the domain and more
+	// nameservers for it, see SOA.
+	SOA    *SOA   `json:"soa,omitempty"`
+	DNSSEC string `json:"dnssec,omitempty"`
 	// Round robin A/AAAA replies. Default is true.
 	RoundRobin bool `json:"round_robin,omitempty"`
 	// Round robin selection of nameservers from among those listed, rather than have all forwarded requests try the first listed server first every time.
 	NSRotate bool `json:"ns_rotate,omitempty"`
 	// List of ip:port, separated by commas of recursive nameservers to forward queries to.
 	Nameservers []string `json:"nameservers,omitempty"`
+	// RaceDelay, milliseconds after which a forwarded query that has no reply yet
+	// is sent to the next nameserver too, the first good reply is used. Zero
+	// sends it to one nameserver at a time.
+	RaceDelay int `json:"race_delay,omitempty"`
+	// Dns0x20, randomize the case of the letters of the names we send to other
+	// nameservers, and drop replies that don't have the same case as spoofed.
+	Dns0x20 bool `json:"dns0x20,omitempty"`
 	// Never provide a recursive service.
-	NoRec       bool          `json:"no_rec,omitempty"`
+	NoRec bool `json:"no_rec,omitempty"`
+	// Networks (CIDR or single address) of clients that may use the recursive
+	// service, other clients get REFUSED for names outside our domain. Empty
+	// allows everyone.
+	RecursionACL []string `json:"recursion_acl,omitempty"`
+	// Networks (CIDR or single address) of the masters that may send a NOTIFY for
+	// our domain or a stub zone, to flush the cached responses for it. Empty
+	// refuses every NOTIFY.
+	NotifyACL []string `json:"notify_acl,omitempty"`
+	// Networks (CIDR or single address) of the secondaries that may transfer our
+	// domain with AXFR. Empty refuses every transfer.
+	TransferACL []string `json:"transfer_acl,omitempty"`
+	// IxfrJournal is the number of changes to our domain kept to answer IXFR
+	// with. Zero answers every IXFR with a full transfer.
+	IxfrJournal int `json:"ixfr_journal,omitempty"`
+	// Secondaries, addresses (IP:port) of the secondaries sent a NOTIFY when our
+	// domain changes. The port defaults to 53.
+	Secondaries []string `json:"secondaries,omitempty"`
+	// TsigKeys, the TSIG keys (RFC 8945) requests may be signed with. Dynamic
+	// updates (RFC 2136) of our domain must be signed, empty refuses every update.
+	TsigKeys []TsigKey `json:"tsig_keys,omitempty"`
+	// TsigRequired, the operations that must be signed with one of TsigKeys
+	// besides updates: "transfer" (AXFR and IXFR) and "notify".
+	TsigRequired []string `json:"tsig_required,omitempty"`
+	// SecondariesKey, the name of the key in TsigKeys the NOTIFYs sent to
+	// Secondaries are signed with. Empty sends them unsigned.
+	SecondariesKey string `json:"secondaries_key,omitempty"`
+	// CatalogZone, the name of a catalog zone (RFC 9432) listing our domain and the
+	// domains of the tenants, so secondaries provision them. It is served to
+	// the clients in TransferACL. Empty serves no catalog.
+	CatalogZone string `json:"catalog_zone,omitempty"`
+	// AcmeAddr, address of the HTTP API to place the TXT records of ACME DNS-01
+	// challenges (_acme-challenge.<name>) in our domain. Empty disables the API.
+	AcmeAddr string `json:"acme_addr,omitempty"`
+	// Networks (CIDR or single address) of the clients that may use the ACME API.
+	// Defaults to the loopback addresses.
+	AcmeACL []string `json:"acme_acl,omitempty"`
+	// AcmeDirectory, directory URL of the ACME (RFC 8555) CA the certificate of
+	// the DoH endpoint is obtained from, for AcmeNames, instead of DoHCert. We
+	// answer the DNS-01 challenges ourselves, so the names must be in Domain. The
+	// certificate is renewed a month before it expires. AcmeEmail is the contact
+	// of the account, and AcmeCache a directory to keep the account key and the
+	// certificate in, so they survive a restart.
+	AcmeDirectory string   `json:"acme_directory,omitempty"`
+	AcmeEmail     string   `json:"acme_email,omitempty"`
+	AcmeNames     []string `json:"acme_names,omitempty"`
+	AcmeCache     string   `json:"acme_cache,omitempty"`
+	// DoHAddr, address of the DNS-over-HTTPS (RFC 8484) endpoint, /dns-query.
+	// DoHMetrics ("metrics") serves it on the metrics listener. Empty disables it.
+	DoHAddr string `json:"doh_addr,omitempty"`
+	// DoHCert and DoHKey, files with the TLS certificate and key of the endpoint
+	// on DoHAddr. Without them it is served over plain HTTP, for a proxy in front
+	// of it that terminates TLS.
+	DoHCert string `json:"doh_cert,omitempty"`
+	DoHKey  string `json:"doh_key,omitempty"`
+	// DoQAddr, address of the DNS-over-QUIC (RFC 9250) endpoint. Empty disables
+	// it. DoQCert and DoQKey, files with the TLS certificate and key of the
+	// endpoint, QUIC always uses TLS.
+	DoQAddr string `json:"doq_addr,omitempty"`
+	DoQCert string `json:"doq_cert,omitempty"`
+	DoQKey  string `json:"doq_key,omitempty"`
+	// DoQ0RTT accepts queries in 0-RTT data, saving a round trip when a client
+	// resumes. They can be replayed, so only queries are answered before the
+	// handshake completes.
+	DoQ0RTT bool `json:"doq_0rtt,omitempty"`
+	// GRPCAddr, address of the gRPC endpoint, with the DnsService of CoreDNS.
+	// Empty disables it.
+	GRPCAddr string `json:"grpc_addr,omitempty"`
+	// GRPCCert and GRPCKey, files with the TLS certificate and key of the gRPC
+	// endpoint. With GRPCCA, a file with CA certificates, clients must present a
+	// certificate signed by one of them. Without a certificate there is no TLS.
+	GRPCCert    string        `json:"grpc_cert,omitempty"`
+	GRPCKey     string        `json:"grpc_key,omitempty"`
+	GRPCCA      string        `json:"grpc_ca,omitempty"`
 	ReadTimeout time.Duration `json:"read_timeout,omitempty"`
+	// Tenants, zones served next to Domain from their own root in the backend.
+	Tenants []Tenant `json:"tenants,omitempty"`
+	// Views, split-horizon views on Domain selected by the client's address.
+	Views []View `json:"views,omitempty"`
 	// Default priority on SRV records when none is given. Defaults to 10.
 	Priority uint16 `json:"priority"`
 	// Default TTL, in seconds, when none is given in etcd. Defaults to 3600.
@@ -57,8 +200,90 @@ type Config struct {
 	RCache int `json:"rcache,omitempty"`
 	// RCacheTtl, how long to cache in seconds.
 	RCacheTtl int `json:"rcache_ttl,omitempty"`
+	// RCacheShards, number of shards (each with their own lock) the response cache is split in.
+	RCacheShards int `json:"rcache_shards,omitempty"`
+	// PCacheTtl, how long in seconds replies from the response cache are kept in wire
+	// format, to be sent again without packing them. Zero disables this.
+	PCacheTtl int `json:"pcache_ttl,omitempty"`
+	// Additional, which SRV and MX targets get their address records added to the
+	// additional section: "all", "internal" (only names in our domain) or "none".
+	// Defaults to "all".
+	Additional string `json:"additional,omitempty"`
+	// ExtendedErrors, add the reason for a response that is not NOERROR as an
+	// Extended DNS Error (RFC 8914) to replies to EDNS queries.
+	ExtendedErrors bool `json:"extended_errors,omitempty"`
+	// MinimalAny, answer ANY queries with a single HINFO record (RFC 8482), instead
+	// of all records we have for the name. AnyPolicies overrides it per zone.
+	MinimalAny bool `json:"minimal_any,omitempty"`
+	// PriorityFailover, only return the addresses of the services of a name with
+	// the lowest priority, the services with a higher priority are standbys.
+	PriorityFailover bool `json:"priority_failover,omitempty"`
+	// EdnsUDPSize, the UDP payload size we advertise in our OPT record. Defaults to 4096.
+	EdnsUDPSize int `json:"edns_udp_size,omitempty"`
+	// MaxUDPSize, the largest UDP response we send, regardless of what a client
+	// advertises. Larger responses are truncated. Zero means no limit.
+	MaxUDPSize int `json:"max_udp_size,omitempty"`
+	// MaxAnswers, the most records of the queried type in a reply for a name in our
+	// domain, a client has to query again for the others. Zero means no limit.
+	MaxAnswers int `json:"max_answers,omitempty"`
+	// AnswerSubset, the records kept when there are more than MaxAnswers or a reply
+	// is too large for UDP: random or first. Defaults to random.
+	AnswerSubset string `json:"answer_subset,omitempty"`
+	// PaddingBlock, pad replies over DoH, DoQ and gRPC to a multiple of this many bytes
+	// (RFC 8467). Zero means no padding.
+	PaddingBlock int `json:"padding_block,omitempty"`
 	// How many labels a name should have before we allow forwarding. Default to 2.
 	Ndots int `json:"ndot,omitempty"`
+	// CNAMEDepth, how many CNAMEs in our domain are followed for an A or AAAA
+	// query, a longer chain gets SERVFAIL. Defaults to 8.
+	CNAMEDepth int `json:"cname_depth,omitempty"`
+	// TagLabel, the label that starts a query for the services of a name with a
+	// tag: <tag_label>.<tag>.<name>. Defaults to "_tag".
+	TagLabel string `json:"tag_label,omitempty"`
+	// Webhooks, URLs that are sent every change to the services in the backend.
+	Webhooks []Webhook `json:"webhooks,omitempty"`
+	// Faults to inject, for testing only, see Faults.
+	Faults *Faults `json:"faults,omitempty"`
+	// Policy, the name of a compiled in query policy to apply, see Policy.
+	Policy string `json:"policy,omitempty"`
+	// Middleware, the stages in front of the backend, outermost first. Defaults
+	// to DefaultMiddleware, stages left out are disabled. The stages of the
+	// server itself, cache and dnssec, are last.
+	Middleware []string `json:"middleware,omitempty"`
+	// QueryACL, networks of clients allowed to query us. Defaults to everyone.
+	QueryACL []string `json:"query_acl,omitempty"`
+	// LogQueries logs every query and the rcode it was answered with.
+	LogQueries bool `json:"log_queries,omitempty"`
+	// Rewrites, rules to resolve names as other names, see Rewrite.
+	Rewrites []Rewrite `json:"rewrites,omitempty"`
+	// HostsFile, a file in hosts(5) format with addresses for names that take
+	// precedence over the backend and forwarding. It is reloaded when it changes.
+	HostsFile string `json:"hosts_file,omitempty"`
+	// SynthesizePTR, answer PTR queries for the addresses of the services in our
+	// domain, that have no reverse record of their own.
+	SynthesizePTR bool `json:"synthesize_ptr,omitempty"`
+	// AdaptiveWeights, lower the weights of failing or slow SRV endpoints, see
+	// AdaptiveWeights.
+	AdaptiveWeights *AdaptiveWeights `json:"adaptive_weights,omitempty"`
+	// MDNS, bridging to multicast DNS on the local link, see MDNS.
+	MDNS *MDNS `json:"mdns,omitempty"`
+	// AddressPolicies, the address records served per zone, see AddressPolicy.
+	AddressPolicies []AddressPolicy `json:"address_policies,omitempty"`
+	// AnyPolicies, how ANY queries are answered per zone, see AnyPolicy.
+	AnyPolicies []AnyPolicy `json:"any_policies,omitempty"`
+	// TruncationPolicies, what happens to replies too large for UDP per zone, see
+	// TruncationPolicy.
+	TruncationPolicies []TruncationPolicy `json:"truncation_policies,omitempty"`
+	// ClientSubnet, use and forward the EDNS Client Subnet option (RFC 7871), see
+	// ClientSubnet.
+	ClientSubnet *ClientSubnet `json:"client_subnet,omitempty"`
+	// Cookies, use DNS Cookies (RFC 7873), see Cookies.
+	Cookies *Cookies `json:"cookies,omitempty"`
+	// DNS64, synthesize AAAA records for IPv6-only clients (RFC 6147), see DNS64.
+	DNS64 *DNS64 `json:"dns64,omitempty"`
+	// ProxyProtocol, read the PROXY protocol header of the connections from L4 load
+	// balancers, see ProxyProtocol.
+	ProxyProtocol *ProxyProtocol `json:"proxy_protocol,omitempty"`
 	// Etcd flag that dictates if etcd version 3 is supported during skydns' run. Default to false.
 	Etcd3 bool
 
@@ -74,6 +299,28 @@ type Config struct {
 	// some predefined string "constants"
 	localDomain string // "local.dns." + config.Domain
 	dnsDomain   string // "ns.dns". + config.Domain
+	apexDomain  string // "apex.dns." + config.Domain
+	// RecursionACL, NotifyACL, TransferACL, AcmeACL and QueryACL parsed.
+	recursionNets []*net.IPNet
+	notifyNets    []*net.IPNet
+	transferNets  []*net.IPNet
+	acmeNets      []*net.IPNet
+	queryNets     []*net.IPNet
+	// The serial of the SOA record of CatalogZone.
+	catalogSerial uint32
+	// TsigKeys by name, and TsigRequired.
+	tsigKeys     map[string]TsigKey
+	tsigRequired map[string]bool
+	// The tenant owning a key in TsigKeys, see Tenant.TsigKeys, and the tenant
+	// this is the configuration of, empty for our own.
+	tenantKeys map[string]string
+	tenant     string
+	// The addresses we listen on, DnsAddr or those of Interfaces.
+	listenAddrs []string
+	// The addresses in DnsAddr, forwarding to them is a loop.
+	selfAddrs map[string]bool
+	// Policy found.
+	policy Policy
 
 	// Stub zones support. Pointer to a map that we refresh when we see
 	// an update. Map contains domainname -> nameserver:port
@@ -85,7 +332,7 @@ func SetDefaults(config *Config) error {
 		config.ReadTimeout = 2 * time.Second
 	}
 	if config.DnsAddr == "" {
-		config.DnsAddr = "127.0.0.1:53"
+		config.DnsAddr = net.JoinHostPort(Loopback(), "53")
 	}
 	if config.Domain == "" {
 		config.Domain = "skydns.local."
@@ -96,6 +343,18 @@ func SetDefaults(config *Config) error {
 	// People probably don't know that SOA's email addresses cannot
 	// contain @-signs, replace them with dots
 	config.Hostmaster = dns.Fqdn(strings.Replace(config.Hostmaster, "@", ".", -1))
+	if config.ChaosVersion == "" {
+		config.ChaosVersion = Version
+	}
+	if config.ChaosHostname == "" {
+		config.ChaosHostname, _ = os.Hostname()
+		if config.ChaosHostname == "" {
+			config.ChaosHostname = "localhost"
+		}
+	}
+	if config.ChaosID == "" {
+		config.ChaosID = config.ChaosHostname
+	}
 	if config.MinTtl == 0 {
 		config.MinTtl = 60
 	}
@@ -114,9 +373,52 @@ func SetDefaults(config *Config) error {
 	if config.RCacheTtl == 0 {
 		config.RCacheTtl = RCacheTtl
 	}
+	if config.RCacheShards <= 0 {
+		config.RCacheShards = RCacheShards
+	}
+	if config.PCacheTtl < 0 {
+		config.PCacheTtl = 0
+	}
 	if config.Ndots <= 0 {
 		config.Ndots = Ndots
 	}
+	if config.CNAMEDepth <= 0 {
+		config.CNAMEDepth = CNAMEDepth
+	}
+	if config.TagLabel == "" {
+		config.TagLabel = TagLabel
+	}
+	config.TagLabel = strings.ToLower(config.TagLabel)
+	switch config.Additional {
+	case AdditionalAll, AdditionalInternal, AdditionalNone:
+	case "":
+		config.Additional = AdditionalAll
+	default:
+		return fmt.Errorf("additional must be one of %q, %q or %q", AdditionalAll, AdditionalInternal, AdditionalNone)
+	}
+	if config.PopularCount <= 0 {
+		config.PopularCount = PopularCount
+	}
+	if config.FormErrRate <= 0 {
+		config.FormErrRate = FormErrRate
+	}
+	if config.EdnsUDPSize < 512 || config.EdnsUDPSize > dns.MaxMsgSize {
+		config.EdnsUDPSize = EdnsUDPSize
+	}
+	switch {
+	case config.MaxUDPSize < 0:
+		config.MaxUDPSize = 0
+	case config.MaxUDPSize > dns.MaxMsgSize:
+		config.MaxUDPSize = dns.MaxMsgSize
+	case config.MaxUDPSize != 0 && config.MaxUDPSize < 512:
+		config.MaxUDPSize = 512
+	}
+	if config.RaceDelay < 0 {
+		config.RaceDelay = 0
+	}
+	if config.PaddingBlock < 0 || config.PaddingBlock > dns.MaxMsgSize {
+		config.PaddingBlock = 0
+	}
 
 	if len(config.Nameservers) == 0 {
 		c, err := dns.ClientConfigFromFile("/etc/resolv.conf")
@@ -129,7 +431,147 @@ func SetDefaults(config *Config) error {
 			}
 		}
 	}
+	if err := setInterfacesDefaults(config); err != nil {
+		return err
+	}
+	config.recursionNets = nil
+	for _, a := range config.RecursionACL {
+		n, err := parseNet(a)
+		if err != nil {
+			return fmt.Errorf("invalid recursion_acl entry: %s", err)
+		}
+		config.recursionNets = append(config.recursionNets, n)
+	}
+	config.notifyNets = nil
+	for _, a := range config.NotifyACL {
+		n, err := parseNet(a)
+		if err != nil {
+			return fmt.Errorf("invalid notify_acl entry: %s", err)
+		}
+		config.notifyNets = append(config.notifyNets, n)
+	}
+	config.transferNets = nil
+	for _, a := range config.TransferACL {
+		n, err := parseNet(a)
+		if err != nil {
+			return fmt.Errorf("invalid transfer_acl entry: %s", err)
+		}
+		config.transferNets = append(config.transferNets, n)
+	}
+	if err := setTsigDefaults(config); err != nil {
+		return err
+	}
+	for i, a := range config.Secondaries {
+		if _, _, err := net.SplitHostPort(a); err != nil {
+			a = net.JoinHostPort(a, "53")
+		}
+		host, _, err := net.SplitHostPort(a)
+		if err != nil || net.ParseIP(host) == nil {
+			return fmt.Errorf("invalid secondaries entry: %q", config.Secondaries[i])
+		}
+		config.Secondaries[i] = a
+	}
+	if len(config.AcmeACL) == 0 {
+		config.AcmeACL = []string{"127.0.0.1", "::1"}
+	}
+	config.acmeNets = nil
+	for _, a := range config.AcmeACL {
+		n, err := parseNet(a)
+		if err != nil {
+			return fmt.Errorf("invalid acme_acl entry: %s", err)
+		}
+		config.acmeNets = append(config.acmeNets, n)
+	}
+	if (config.DoHCert == "") != (config.DoHKey == "") {
+		return fmt.Errorf("doh_cert and doh_key must be given together")
+	}
+	if config.DoHAddr == DoHMetrics && config.DoHCert != "" {
+		return fmt.Errorf("doh_cert can not be used with the metrics listener")
+	}
+	if (config.GRPCCert == "") != (config.GRPCKey == "") {
+		return fmt.Errorf("grpc_cert and grpc_key must be given together")
+	}
+	if config.GRPCCA != "" && config.GRPCCert == "" {
+		return fmt.Errorf("grpc_ca needs grpc_cert and grpc_key")
+	}
+	if config.DoQAddr != "" && (config.DoQCert == "" || config.DoQKey == "") {
+		return fmt.Errorf("doq_addr needs doq_cert and doq_key")
+	}
+	if config.DoQ0RTT && config.DoQAddr == "" {
+		return fmt.Errorf("doq_0rtt needs doq_addr")
+	}
 	config.Domain = dns.Fqdn(strings.ToLower(config.Domain))
+	if config.AcmeDirectory != "" {
+		switch {
+		case config.DoHAddr == "" || config.DoHAddr == DoHMetrics:
+			return fmt.Errorf("acme_directory needs doh_addr with a listener of its own")
+		case config.DoHCert != "":
+			return fmt.Errorf("acme_directory can not be used with doh_cert")
+		case len(config.AcmeNames) == 0:
+			return fmt.Errorf("acme_directory needs acme_names")
+		}
+		for i, n := range config.AcmeNames {
+			n = strings.TrimSuffix(strings.ToLower(n), ".")
+			if _, ok := dns.IsDomainName(n); !ok || !dns.IsSubDomain(config.Domain, dns.Fqdn(strings.TrimPrefix(n, "*."))) {
+				return fmt.Errorf("invalid acme_names entry, not a name in %s: %q", config.Domain, config.AcmeNames[i])
+			}
+			config.AcmeNames[i] = n
+		}
+	}
+	if err := setSOADefaults(config); err != nil {
+		return err
+	}
+	if err := setTenantDefaults(config); err != nil {
+		return err
+	}
+	if err := setCatalogDefaults(config); err != nil {
+		return err
+	}
+	if err := setViewDefaults(config); err != nil {
+		return err
+	}
+	if err := setWebhookDefaults(config); err != nil {
+		return err
+	}
+	if err := setFaultsDefaults(config); err != nil {
+		return err
+	}
+	if err := setPolicyDefaults(config); err != nil {
+		return err
+	}
+	if err := setAdaptiveWeightsDefaults(config); err != nil {
+		return err
+	}
+	if err := setClientSubnetDefaults(config); err != nil {
+		return err
+	}
+	if err := setCookiesDefaults(config); err != nil {
+		return err
+	}
+	if err := setDNS64Defaults(config); err != nil {
+		return err
+	}
+	if err := setProxyProtocolDefaults(config); err != nil {
+		return err
+	}
+	if err := setMDNSDefaults(config); err != nil {
+		return err
+	}
+	if err := setAddressPolicyDefaults(config); err != nil {
+		return err
+	}
+	if err := setAnyPolicyDefaults(config); err != nil {
+		return err
+	}
+	if err := setTruncationDefaults(config); err != nil {
+		return err
+	}
+	if err := setRewriteDefaults(config); err != nil {
+		return err
+	}
+	if err := setMiddlewareDefaults(config); err != nil {
+		return err
+	}
 	if config.DNSSEC != "" {
 		// For some reason the + are replaces by spaces in etcd. Re-replace them
 		keyfile := strings.Replace(config.DNSSEC, " ", "+", -1)
@@ -147,11 +589,28 @@ func SetDefaults(config *Config) error {
 	}
 	config.localDomain = appendDomain("local.dns", config.Domain)
 	config.dnsDomain = appendDomain("ns.dns", config.Domain)
+	config.apexDomain = appendDomain("apex.dns", config.Domain)
 	stubmap := make(map[string][]string)
 	config.stub = &stubmap
 	return nil
 }
 
+// parseNet parses a CIDR, a single address is taken as a host network.
+func parseNet(a string) (*net.IPNet, error) {
+	if !strings.Contains(a, "/") {
+		ip := net.ParseIP(a)
+		if ip == nil {
+			return nil, fmt.Errorf("not an address: %q", a)
+		}
+		if ip4 := ip.To4(); ip4 != nil {
+			return &net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)}, nil
+		}
+		return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}, nil
+	}
+	_, n, err := net.ParseCIDR(a)
+	return n, err
+}
+
 func appendDomain(s1, s2 string) string {
 	if len(s2) > 0 && s2[0] == '.' {
 		return s1 + s2
@@ -0,0 +1,293 @@
+// Copyright (c) 2014 The SkyDNS Authors. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package server
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// Cookies is how DNS Cookies (RFC 7873) are used. Clients that send a cookie get
+// a server cookie back, which proves on their next query that it comes from
+// their address. Queries we forward carry a client cookie of our own.
+type Cookies struct {
+	// Secret, the key of our server cookies as 16 bytes in hex. Servers behind
+	// one address must share it. Empty picks a random key at startup.
+	Secret string `json:"secret,omitempty"`
+	// Require, when queries over UDP must have a valid server cookie to be
+	// answered: "load", when the worker queue (see Workers) is more than half
+	// full, or "always". Empty never requires one.
+	Require string `json:"require,omitempty"`
+
+	// Secret decoded.
+	secret []byte
+}
+
+// Server cookies are made like those of RFC 9018: a version, 3 reserved bytes,
+// the time they are made and a hash, an HMAC-SHA256 cut to 8 bytes here. They
+// are valid for an hour, and renewed after half an hour.
+const (
+	cookieClientLen = 8
+	cookieServerLen = 16
+	cookieVersion   = 1
+	cookieLifetime  = time.Hour
+	cookieRenew     = 30 * time.Minute
+	cookieFuture    = 5 * time.Minute // clock skew between servers sharing Secret
+)
+
+// setCookiesDefaults checks the cookie settings in config.
+func setCookiesDefaults(config *Config) error {
+	c := config.Cookies
+	if c == nil {
+		return nil
+	}
+	switch c.Require {
+	case "", "load", "always":
+	default:
+		return fmt.Errorf("cookies: require must be \"load\" or \"always\", not %q", c.Require)
+	}
+	if c.Secret == "" {
+		c.secret = make([]byte, 16)
+		_, err := rand.Read(c.secret)
+		return err
+	}
+	secret, err := hex.DecodeString(c.Secret)
+	if err != nil || len(secret) != 16 {
+		return fmt.Errorf("cookies: secret must be 16 bytes in hex")
+	}
+	c.secret = secret
+	return nil
+}
+
+// queryCookie returns the COOKIE option of req, or nil.
+func queryCookie(req *dns.Msg) *dns.EDNS0_COOKIE {
+	o := req.IsEdns0()
+	if o == nil {
+		return nil
+	}
+	for _, e := range o.Option {
+		if e, ok := e.(*dns.EDNS0_COOKIE); ok {
+			return e
+		}
+	}
+	return nil
+}
+
+// splitCookie returns the client and server cookie in e. It returns false when
+// e is malformed, see RFC 7873, section 5.2.2.
+func splitCookie(e *dns.EDNS0_COOKIE) (client, server []byte, ok bool) {
+	b, err := hex.DecodeString(e.Cookie)
+	if err != nil || len(b) != cookieClientLen && (len(b) < 16 || len(b) > 40) {
+		return nil, nil, false
+	}
+	return b[:cookieClientLen], b[cookieClientLen:], true
+}
+
+// cookieHash returns the hash of a server cookie for client, made at the start
+// of server for ip.
+func (c *Cookies) cookieHash(client, server []byte, ip net.IP) []byte {
+	h := hmac.New(sha256.New, c.secret)
+	h.Write(client)
+	h.Write(server[:8])
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	h.Write(ip)
+	return h.Sum(nil)[:8]
+}
+
+// serverCookie returns our server cookie for client at ip: server when it is a
+// valid one of ours that is not up for renewal, otherwise a new one. Valid is
+// false when server is not a valid cookie.
+func (c *Cookies) serverCookie(client, server []byte, ip net.IP, now time.Time) (cookie []byte, valid bool) {
+	if len(server) == cookieServerLen && server[0] == cookieVersion {
+		made := time.Unix(int64(binary.BigEndian.Uint32(server[4:])), 0)
+		age := now.Sub(made)
+		if age < cookieLifetime && age > -cookieFuture && hmac.Equal(server[8:], c.cookieHash(client, server, ip)) {
+			if age < cookieRenew {
+				return server, true
+			}
+			valid = true
+		}
+	}
+	cookie = make([]byte, cookieServerLen)
+	cookie[0] = cookieVersion
+	binary.BigEndian.PutUint32(cookie[4:], uint32(now.Unix()))
+	copy(cookie[8:], c.cookieHash(client, cookie, ip))
+	return cookie, valid
+}
+
+// cookieHandler answers queries with a malformed cookie with FORMERR, and over
+// UDP, when Cookies.Require says so, queries without a valid server cookie with
+// BADCOOKIE, or when they have no cookie at all, with a truncated reply to make
+// the client retry over TCP. The cookie of other queries is replaced with the
+// client cookie and our server cookie, which setEdns echoes in the reply.
+func (s *server) cookieHandler(next dns.Handler) dns.Handler {
+	c := s.config.Cookies
+	if c == nil {
+		return next
+	}
+	return dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+		o := req.IsEdns0()
+		required := !isTCP(w) && s.cookiesRequired()
+		e := queryCookie(req)
+		if e == nil {
+			if !required {
+				next.ServeDNS(w, req)
+				return
+			}
+			m := new(dns.Msg)
+			m.SetReply(req)
+			m.Truncated = true
+			s.explain(m, req, reasonCookie)
+			s.setEdns(m, o)
+			w.WriteMsg(m)
+			return
+		}
+		client, server, ok := splitCookie(e)
+		if !ok {
+			opts := o.Option[:0:0]
+			for _, e := range o.Option {
+				if e.Option() != dns.EDNS0COOKIE {
+					opts = append(opts, e)
+				}
+			}
+			o.Option = opts
+			m := new(dns.Msg)
+			m.SetRcode(req, dns.RcodeFormatError)
+			s.setEdns(m, o)
+			w.WriteMsg(m)
+			return
+		}
+		server, valid := c.serverCookie(client, server, remoteIP(w), time.Now())
+		e.Cookie = hex.EncodeToString(client) + hex.EncodeToString(server)
+		if valid || !required {
+			next.ServeDNS(w, req)
+			return
+		}
+		m := new(dns.Msg)
+		m.SetReply(req)
+		m.Rcode = dns.RcodeBadCookie
+		// The upper 8 bits of BADCOOKIE go in the OPT's TTL, set them by hand like
+		// badVersion does.
+		opt := s.newOPT(o.Do())
+		opt.Hdr.Ttl |= uint32(dns.RcodeBadCookie>>4) << 24
+		m.Extra = []dns.RR{opt}
+		s.explain(m, req, reasonCookie)
+		s.setEdns(m, o)
+		w.WriteMsg(m)
+	})
+}
+
+// cookiesRequired returns true when queries over UDP must have a valid server
+// cookie, see Cookies.Require.
+func (s *server) cookiesRequired() bool {
+	switch s.config.Cookies.Require {
+	case "always":
+		return true
+	case "load":
+		return s.pool != nil && s.pool.busy()
+	}
+	return false
+}
+
+// isCookieEcho returns true if e is a cookie to echo in our reply: one the
+// cookie stage made, with a server cookie of ours.
+func isCookieEcho(e dns.EDNS0) bool {
+	c, ok := e.(*dns.EDNS0_COOKIE)
+	return ok && len(c.Cookie) == 2*(cookieClientLen+cookieServerLen)
+}
+
+// badCookie returns true if the rcode of the reply r is BADCOOKIE.
+func badCookie(r *dns.Msg) bool {
+	o := r.IsEdns0()
+	return o != nil && r.Rcode == dns.RcodeBadCookie&0xF && o.Hdr.Ttl>>24 == dns.RcodeBadCookie>>4
+}
+
+// cookieJar holds the server cookies of the nameservers we forward to.
+type cookieJar struct {
+	sync.Mutex
+	server map[string][]byte
+}
+
+func newCookieJar() *cookieJar {
+	return &cookieJar{server: make(map[string][]byte)}
+}
+
+// clientCookie returns our client cookie for the nameserver ns.
+func (c *Cookies) clientCookie(ns string) []byte {
+	h := hmac.New(sha256.New, c.secret)
+	h.Write([]byte("client " + ns))
+	return h.Sum(nil)[:cookieClientLen]
+}
+
+// withCookie returns a copy of m, to send to ns, with our cookie for ns as its
+// COOKIE option instead of the one of the client.
+func (s *server) withCookie(m *dns.Msg, ns string) *dns.Msg {
+	r := m.Copy()
+	o := r.IsEdns0()
+	if o == nil {
+		// Without EDNS0 the client takes no larger reply either.
+		o = &dns.OPT{Hdr: dns.RR_Header{Name: ".", Rrtype: dns.TypeOPT}}
+		o.SetUDPSize(dns.MinMsgSize)
+		r.Extra = append(r.Extra, o)
+	}
+	opts := o.Option[:0:0]
+	for _, e := range o.Option {
+		if e.Option() != dns.EDNS0COOKIE {
+			opts = append(opts, e)
+		}
+	}
+	s.cookies.Lock()
+	server := s.cookies.server[ns]
+	s.cookies.Unlock()
+	cookie := hex.EncodeToString(s.config.Cookies.clientCookie(ns)) + hex.EncodeToString(server)
+	o.Option = append(opts, &dns.EDNS0_COOKIE{Code: dns.EDNS0COOKIE, Cookie: cookie})
+	return r
+}
+
+// learnCookie saves the server cookie of ns in its reply r to our query, and
+// returns true if it is a new one.
+func (s *server) learnCookie(r *dns.Msg, ns string) bool {
+	e := queryCookie(r)
+	if e == nil {
+		return false
+	}
+	client, server, ok := splitCookie(e)
+	if !ok || len(server) == 0 || !bytes.Equal(client, s.config.Cookies.clientCookie(ns)) {
+		return false
+	}
+	s.cookies.Lock()
+	defer s.cookies.Unlock()
+	if bytes.Equal(s.cookies.server[ns], server) {
+		return false
+	}
+	s.cookies.server[ns] = server
+	return true
+}
+
+// exchangeCookie sends m to the nameserver ns with exchangeWithRetry. With cookies
+// the query has our cookie for ns, and is sent again once when it is BADCOOKIE
+// with a new server cookie, see RFC 7873, section 5.3.
+func (s *server) exchangeCookie(c *dns.Client, m *dns.Msg, ns string) (*dns.Msg, error) {
+	if s.cookies == nil {
+		return exchangeWithRetry(c, m, ns)
+	}
+	r, err := exchangeWithRetry(c, s.withCookie(m, ns), ns)
+	if err != nil || !s.learnCookie(r, ns) || !badCookie(r) {
+		return r, err
+	}
+	return exchangeWithRetry(c, s.withCookie(m, ns), ns)
+}
@@ -0,0 +1,180 @@
+// Copyright (c) 2014 The SkyDNS Authors. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package server
+
+import (
+	"bytes"
+	"encoding/hex"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/skynetservices/skydns/msg"
+
+	"github.com/miekg/dns"
+)
+
+func TestServerCookie(t *testing.T) {
+	c := &Cookies{}
+	if err := setCookiesDefaults(&Config{Cookies: c}); err != nil {
+		t.Fatal(err)
+	}
+	client, ip := []byte("abcdefgh"), net.ParseIP("10.0.0.1")
+	now := time.Now()
+	server, valid := c.serverCookie(client, nil, ip, now)
+	if valid || len(server) != cookieServerLen {
+		t.Fatalf("expected a new server cookie, got %x", server)
+	}
+
+	tests := []struct {
+		client []byte
+		ip     string
+		later  time.Duration
+		valid  bool
+		same   bool
+	}{
+		{client: client, ip: "10.0.0.1", later: time.Minute, valid: true, same: true},
+		{client: client, ip: "10.0.0.1", later: 40 * time.Minute, valid: true},
+		{client: client, ip: "10.0.0.1", later: 2 * time.Hour},
+		{client: client, ip: "10.0.0.1", later: -time.Hour},
+		{client: client, ip: "10.0.0.2", later: time.Minute},
+		{client: []byte("hgfedcba"), ip: "10.0.0.1", later: time.Minute},
+	}
+	for i, tc := range tests {
+		got, valid := c.serverCookie(tc.client, server, net.ParseIP(tc.ip), now.Add(tc.later))
+		if valid != tc.valid || bytes.Equal(got, server) != tc.same {
+			t.Errorf("test %d: expected valid %t and same %t, got %t and %x", i, tc.valid, tc.same, valid, got)
+		}
+	}
+}
+
+func TestCookies(t *testing.T) {
+	s := newTestServer(t, false, func(s *server) {
+		s.config.Cookies = &Cookies{}
+		if err := setCookiesDefaults(s.config); err != nil {
+			t.Fatal(err)
+		}
+	})
+	defer s.Stop()
+
+	serv := &msg.Service{Host: "10.0.24.1", Key: "a.cookie.skydns.test."}
+	addService(t, s, serv.Key, 0, serv)
+	defer delService(t, s, serv.Key)
+
+	h := s.cookieHandler(s)
+	query := func(cookie string) *dns.Msg {
+		m := new(dns.Msg)
+		m.SetQuestion("a.cookie.skydns.test.", dns.TypeA)
+		if cookie != "" {
+			m.SetEdns0(4096, false)
+			m.IsEdns0().Option = []dns.EDNS0{&dns.EDNS0_COOKIE{Code: dns.EDNS0COOKIE, Cookie: cookie}}
+		}
+		w := &testWriter{}
+		h.ServeDNS(w, m)
+		return w.msg
+	}
+	const client = "0102030405060708"
+
+	resp := query(client)
+	e := queryCookie(resp)
+	if len(resp.Answer) != 1 || e == nil || !strings.HasPrefix(e.Cookie, client) || len(e.Cookie) != 48 {
+		t.Fatalf("expected an answer with a server cookie, got %s", resp)
+	}
+	cookie := e.Cookie
+
+	s.config.Cookies.Require = "always"
+	if resp := query(cookie); len(resp.Answer) != 1 || queryCookie(resp).Cookie != cookie {
+		t.Errorf("expected an answer with the same cookie, got %s", resp)
+	}
+	if resp := query(client); resp.Rcode != dns.RcodeBadCookie || len(queryCookie(resp).Cookie) != 48 {
+		t.Errorf("expected BADCOOKIE with a server cookie, got %s", resp)
+	}
+	if resp := query(client + strings.Repeat("00", 16)); resp.Rcode != dns.RcodeBadCookie {
+		t.Errorf("expected BADCOOKIE for an invalid server cookie, got %s", resp)
+	}
+	if resp := query(""); !resp.Truncated || len(resp.Answer) != 0 {
+		t.Errorf("expected a truncated reply without a cookie, got %s", resp)
+	}
+	if resp := query("0102"); resp.Rcode != dns.RcodeFormatError || queryCookie(resp) != nil {
+		t.Errorf("expected FORMERR for a malformed cookie, got %s", resp)
+	}
+
+	// Under load only: a query without a cookie is answered when the pool is idle.
+	s.config.Cookies.Require = "load"
+	s.pool = &workerPool{queue: make(chan func(), 2)}
+	if resp := query(""); resp.Truncated || len(resp.Answer) != 1 {
+		t.Errorf("expected an answer without load, got %s", resp)
+	}
+	s.pool.queue <- func() {}
+	s.pool.queue <- func() {}
+	if resp := query(""); !resp.Truncated {
+		t.Errorf("expected a truncated reply under load, got %s", resp)
+	}
+}
+
+func TestCookiesForward(t *testing.T) {
+	// The upstream wants its server cookie, which is all "ff".
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	upstreamCookie := strings.Repeat("ff", 16)
+	received := make(chan string, 10)
+	upstream := &dns.Server{PacketConn: pc, Handler: dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+		e := queryCookie(req)
+		if e == nil {
+			t.Errorf("expected a cookie, got %s", req)
+			return
+		}
+		received <- e.Cookie
+		m := new(dns.Msg)
+		m.SetReply(req)
+		m.SetEdns0(dns.MinMsgSize, false)
+		o := m.IsEdns0()
+		if strings.HasSuffix(e.Cookie, upstreamCookie) {
+			a, _ := dns.NewRR(req.Question[0].Name + " 300 IN A 192.0.2.1")
+			m.Answer = []dns.RR{a}
+		} else {
+			m.Rcode = dns.RcodeBadCookie
+			o.Hdr.Ttl |= uint32(dns.RcodeBadCookie>>4) << 24
+		}
+		o.Option = []dns.EDNS0{&dns.EDNS0_COOKIE{Code: dns.EDNS0COOKIE, Cookie: e.Cookie[:16] + upstreamCookie}}
+		w.WriteMsg(m)
+	})}
+	go upstream.ActivateAndServe()
+	defer upstream.Shutdown()
+
+	ns := pc.LocalAddr().String()
+	s := newTestServer(t, false, func(s *server) {
+		s.config.Nameservers = []string{ns}
+		s.config.Cookies = &Cookies{}
+		if err := setCookiesDefaults(s.config); err != nil {
+			t.Fatal(err)
+		}
+		s.cookies = newCookieJar()
+	})
+	defer s.Stop()
+
+	m := new(dns.Msg)
+	m.SetQuestion("cookie.example.net.", dns.TypeA)
+	m.SetEdns0(4096, false)
+	m.IsEdns0().Option = []dns.EDNS0{&dns.EDNS0_COOKIE{Code: dns.EDNS0COOKIE, Cookie: "0102030405060708"}}
+	w := &testWriter{}
+	s.cookieHandler(s).ServeDNS(w, m)
+	if len(w.msg.Answer) != 1 {
+		t.Fatalf("expected an answer after BADCOOKIE, got %s", w.msg)
+	}
+	if e := queryCookie(w.msg); e == nil || !strings.HasPrefix(e.Cookie, "0102030405060708") {
+		t.Errorf("expected the client's cookie echoed, got %v", e)
+	}
+
+	ours := hex.EncodeToString(s.config.Cookies.clientCookie(ns))
+	for _, want := range []string{ours, ours + upstreamCookie} {
+		if got := <-received; got != want {
+			t.Errorf("expected cookie %s to be forwarded, got %s", want, got)
+		}
+	}
+}
@@ -0,0 +1,64 @@
+// Copyright (c) 2014 The SkyDNS Authors. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package server
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+
+	"github.com/skynetservices/skydns/metrics"
+)
+
+const (
+	// quorumCheck is the interval at which the backend's quorum is checked.
+	quorumCheck = 5 * time.Second
+	// staleTTL is the TTL of expired cached records served in degraded mode,
+	// as recommended by RFC 8767.
+	staleTTL = 30
+)
+
+// Quorumer is implemented by backends that can tell a failure to reach consensus
+// among their members apart from failing reads. Without a quorum the data can't
+// change, but reads may still be answered.
+type Quorumer interface {
+	Quorum(ctx context.Context) error
+}
+
+// degraded returns true when the backend lost its quorum. In degraded mode cached
+// responses are served after they expired, until the quorum is back. Tenants and
+// views share the mode of the server they were added to.
+func (s *server) degraded() bool {
+	return s.noQuorum != nil && atomic.LoadInt32(s.noQuorum) == 1
+}
+
+// runQuorum checks the quorum of the backend every quorumCheck, entering and
+// leaving degraded mode.
+func (s *server) runQuorum(q Quorumer) {
+	check := func() {
+		ctx, cancel := context.WithTimeout(context.Background(), s.config.ReadTimeout)
+		err := q.Quorum(ctx)
+		cancel()
+
+		degraded := err != nil
+		if degraded == s.degraded() {
+			return
+		}
+		if degraded {
+			logf("backend lost its quorum, entering degraded mode: %s", err)
+			atomic.StoreInt32(s.noQuorum, 1)
+		} else {
+			logf("backend has its quorum back, leaving degraded mode")
+			atomic.StoreInt32(s.noQuorum, 0)
+		}
+		metrics.ReportDegraded(degraded)
+	}
+	go func() {
+		check()
+		for range time.Tick(quorumCheck) {
+			check()
+		}
+	}()
+}
@@ -0,0 +1,62 @@
+// Copyright (c) 2014 The SkyDNS Authors. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package server
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/skynetservices/skydns/cache"
+
+	"github.com/miekg/dns"
+)
+
+type testQuorum struct{ lost int32 }
+
+func (q *testQuorum) Quorum(ctx context.Context) error {
+	if atomic.LoadInt32(&q.lost) == 1 {
+		return fmt.Errorf("no leader")
+	}
+	return nil
+}
+
+func TestDegraded(t *testing.T) {
+	s := newTestServer(t, true, func(s *server) {
+		s.rcache = cache.New(100, 1)
+		s.noQuorum = new(int32)
+	})
+	defer s.Stop()
+
+	q := &testQuorum{lost: 1}
+	s.runQuorum(q)
+	for i := 0; !s.degraded(); i++ {
+		if i == 100 {
+			t.Fatal("expected degraded mode when the backend has no quorum")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	m := new(dns.Msg)
+	m.SetQuestion("stale.skydns.test.", dns.TypeA)
+	resp := m.Copy()
+	resp.Response = true
+	a, _ := dns.NewRR("stale.skydns.test. 3600 IN A 10.0.0.1")
+	resp.Answer = []dns.RR{a}
+	s.rcache.InsertMessage(cache.Key(m.Question[0], false, false), resp)
+
+	time.Sleep(1100 * time.Millisecond)
+
+	w := &testWriter{}
+	s.ServeDNS(w, m)
+	if len(w.msg.Answer) != 1 {
+		t.Fatalf("expected the stale answer from the cache, got %s", w.msg)
+	}
+	if ttl := w.msg.Answer[0].Header().Ttl; ttl != staleTTL {
+		t.Fatalf("expected TTL %d for a stale answer, got %d", staleTTL, ttl)
+	}
+}
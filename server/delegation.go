@@ -0,0 +1,85 @@
+// Copyright (c) 2014 The SkyDNS Authors. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package server
+
+import (
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// Referral returns a referral response for name if it is in a zone delegated
+// away from our domain, otherwise it returns nil. Like the NS records for our
+// own domain, the nameservers of a delegated zone are stored under
+// "ns.dns.<zone>" and must be IP addresses; they are returned as glue. The DS
+// records of a signed zone are stored under "ds.dns.<zone>" and are added to
+// the NS records. A DS query for the zone itself is ours to answer, it gets no
+// referral. Only the delegation closest to our domain counts, we don't know
+// about cuts below that.
+func (s *server) Referral(req *dns.Msg, name string) *dns.Msg {
+	if name == s.config.Domain || !dns.IsSubDomain(s.config.Domain, name) {
+		return nil
+	}
+	labels := dns.SplitDomainName(name)
+	for i := len(labels) - dns.CountLabel(s.config.Domain) - 1; i >= 0; i-- {
+		zone := dns.Fqdn(strings.Join(labels[i:], "."))
+		q := dns.Question{Name: zone, Qtype: dns.TypeNS, Qclass: dns.ClassINET}
+		ns, glue, err := s.NSRecords(q, appendDomain("ns.dns", zone))
+		if err != nil || len(ns) == 0 {
+			continue
+		}
+		if zone == name && req.Question[0].Qtype == dns.TypeDS {
+			return nil
+		}
+		m := new(dns.Msg)
+		m.SetReply(req)
+		m.Ns = ns
+		if ds, err := s.DSRecords(q, zone); err == nil {
+			m.Ns = append(m.Ns, ds...)
+		}
+		m.Extra = glue
+		return m
+	}
+	return nil
+}
+
+// delegated returns true if zone is delegated, it has nameservers of its own.
+func (s *server) delegated(zone string) bool {
+	q := dns.Question{Name: zone, Qtype: dns.TypeNS, Qclass: dns.ClassINET}
+	ns, _, err := s.NSRecords(q, appendDomain("ns.dns", zone))
+	return err == nil && len(ns) > 0
+}
+
+// DSRecords returns the DS records of the delegated zone from etcd.
+func (s *server) DSRecords(q dns.Question, zone string) (records []dns.RR, err error) {
+	services, err := s.records(appendDomain("ds.dns", zone), false)
+	if err != nil {
+		return nil, err
+	}
+	for _, serv := range services {
+		if serv.Ds == nil {
+			continue
+		}
+		records = append(records, serv.NewDS(q.Name))
+	}
+	return records, nil
+}
+
+// signReferral signs the DS records in the referral m, they are ours, unlike the
+// NS records and the glue, which belong to the delegated zone.
+func (s *server) signReferral(m *dns.Msg, bufsize uint16) {
+	ds := new(dns.Msg)
+	for _, r := range m.Ns {
+		if r.Header().Rrtype == dns.TypeDS {
+			ds.Ns = append(ds.Ns, r)
+		}
+	}
+	if len(ds.Ns) == 0 {
+		return
+	}
+	n := len(ds.Ns)
+	s.Sign(ds, bufsize)
+	m.Ns = append(m.Ns, ds.Ns[n:]...)
+}
@@ -0,0 +1,104 @@
+// Copyright (c) 2014 The SkyDNS Authors. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package server
+
+import (
+	"strings"
+
+	"github.com/skynetservices/skydns/msg"
+
+	"github.com/miekg/dns"
+)
+
+// dnameDepth is the number of DNAMEs followed for a query.
+const dnameDepth = 8
+
+// dname returns the service with a Dname above name, the closest one, and its
+// owner name. The names below it don't exist in the backend, so it is only
+// looked for when name doesn't exist.
+func (s *server) dname(name string) (*msg.Service, string) {
+	if name == s.config.Domain || !dns.IsSubDomain(s.config.Domain, name) {
+		return nil, ""
+	}
+	off, end := dns.NextLabel(name, 0)
+	for ; !end; off, end = dns.NextLabel(name, off) {
+		owner := name[off:]
+		if owner == s.config.Domain {
+			break
+		}
+		services, err := s.records(owner, true)
+		if err != nil {
+			continue
+		}
+		for _, serv := range services {
+			if serv.Dname != "" && msg.Domain(serv.Key) == owner {
+				return &serv, owner
+			}
+		}
+	}
+	return nil, ""
+}
+
+// DNAMERecords returns the DNAME records of name from etcd.
+func (s *server) DNAMERecords(q dns.Question, name string) (records []dns.RR, err error) {
+	services, err := s.records(name, false)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, serv := range services {
+		if serv.Dname == "" || msg.Domain(serv.Key) != name {
+			continue
+		}
+		records = append(records, serv.NewDNAME(q.Name))
+	}
+	return records, nil
+}
+
+// dnameAnswer returns the reply to req, for name that doesn't exist, when name is
+// below a DNAME: the DNAME, the CNAME synthesized from it for the query name (RFC
+// 6672, section 3.3) and the answer for the new name, when it is in our domain.
+// It returns nil if name is not below a DNAME.
+func (s *server) dnameAnswer(req *dns.Msg, q dns.Question, name string, bufsize uint16, dnssec bool) *dns.Msg {
+	m := s.newReply(req)
+	qname := q.Name
+	for depth := 0; ; depth++ {
+		serv, owner := s.dname(name)
+		if serv == nil {
+			if depth == 0 {
+				return nil
+			}
+			q1 := dns.Question{Name: qname, Qtype: q.Qtype, Qclass: q.Qclass}
+			req1 := req.Copy()
+			req1.Question[0] = q1
+			m1 := s.answer(s.newReply(req1), req1, q1, name, bufsize, dnssec)
+			m1.Question = req.Question
+			m1.Answer = append(m.Answer, m1.Answer...)
+			return m1
+		}
+		if depth == dnameDepth {
+			logf("DNAME limit of %d exceeded for %s", dnameDepth, q.Name)
+			m := s.ServerFailure(req)
+			s.explain(m, req, reasonDnameLoop)
+			return m
+		}
+
+		dname := serv.NewDNAME(qname[len(qname)-len(owner):])
+		target := qname[:len(qname)-len(owner)] + dname.Target
+		if len(target) > 254 {
+			// RFC 6672, section 2.2, the name would be longer than 255 octets.
+			m.Rcode = dns.RcodeYXDomain
+			m.Answer = append(m.Answer, dname)
+			s.explain(m, req, reasonDnameTooLong)
+			return m
+		}
+		m.Answer = append(m.Answer, dname, serv.NewCNAME(qname, target))
+		if !dns.IsSubDomain(s.config.Domain, dname.Target) {
+			// The resolver follows the CNAME itself.
+			return m
+		}
+		qname, name = target, strings.ToLower(target)
+	}
+}
@@ -0,0 +1,88 @@
+// Copyright (c) 2014 The SkyDNS Authors. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package server
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/skynetservices/skydns/msg"
+
+	"github.com/miekg/dns"
+)
+
+func TestDNAME(t *testing.T) {
+	s := newTestServer(t, false)
+	defer s.Stop()
+
+	for _, serv := range []*msg.Service{
+		{Key: "legacy.dname.skydns.test.", Dname: "prod.dname.skydns.test.", Ttl: 60},
+		{Key: "web.prod.dname.skydns.test.", Host: "10.0.13.1"},
+		{Key: "old.dname.skydns.test.", Dname: "legacy.dname.skydns.test."},
+		{Key: "ext.dname.skydns.test.", Dname: "example.org."},
+		{Key: "loop.dname.skydns.test.", Dname: "a.loop.dname.skydns.test."},
+	} {
+		addService(t, s, serv.Key, 0, serv)
+		defer delService(t, s, serv.Key)
+	}
+
+	tests := []struct {
+		name  string
+		qtype uint16
+		rcode int
+		rrs   []string
+	}{
+		{"Web.legacy.dname.skydns.test.", dns.TypeA, dns.RcodeSuccess, []string{
+			"legacy.dname.skydns.test.\t60\tIN\tDNAME\tprod.dname.skydns.test.",
+			"Web.legacy.dname.skydns.test.\t60\tIN\tCNAME\tWeb.prod.dname.skydns.test.",
+			"Web.prod.dname.skydns.test.\t60\tIN\tA\t10.0.13.1",
+		}},
+		// Two DNAMEs.
+		{"web.old.dname.skydns.test.", dns.TypeA, dns.RcodeSuccess, []string{
+			"old.dname.skydns.test.\t60\tIN\tDNAME\tlegacy.dname.skydns.test.",
+			"web.old.dname.skydns.test.\t60\tIN\tCNAME\tweb.legacy.dname.skydns.test.",
+			"legacy.dname.skydns.test.\t60\tIN\tDNAME\tprod.dname.skydns.test.",
+			"web.legacy.dname.skydns.test.\t60\tIN\tCNAME\tweb.prod.dname.skydns.test.",
+			"web.prod.dname.skydns.test.\t60\tIN\tA\t10.0.13.1",
+		}},
+		{"db.legacy.dname.skydns.test.", dns.TypeA, dns.RcodeNameError, []string{
+			"legacy.dname.skydns.test.\t60\tIN\tDNAME\tprod.dname.skydns.test.",
+			"db.legacy.dname.skydns.test.\t60\tIN\tCNAME\tdb.prod.dname.skydns.test.",
+		}},
+		// The resolver follows names outside our domain.
+		{"www.ext.dname.skydns.test.", dns.TypeA, dns.RcodeSuccess, []string{
+			"ext.dname.skydns.test.\t3600\tIN\tDNAME\texample.org.",
+			"www.ext.dname.skydns.test.\t3600\tIN\tCNAME\twww.example.org.",
+		}},
+		{"legacy.dname.skydns.test.", dns.TypeDNAME, dns.RcodeSuccess, []string{
+			"legacy.dname.skydns.test.\t60\tIN\tDNAME\tprod.dname.skydns.test.",
+		}},
+		{"a.loop.dname.skydns.test.", dns.TypeA, dns.RcodeServerFailure, nil},
+		{strings.Repeat("a", 63) + "." + strings.Repeat("b", 63) + "." + strings.Repeat("c", 63) + "." + strings.Repeat("d", 38) + ".loop.dname.skydns.test.",
+			dns.TypeA, dns.RcodeYXDomain, nil},
+	}
+	for i, tc := range tests {
+		m := new(dns.Msg)
+		m.SetQuestion(tc.name, tc.qtype)
+		w := &testWriter{}
+		s.ServeDNS(w, m)
+		if w.msg.Rcode != tc.rcode {
+			t.Errorf("test %d: expected %s, got %s", i, dns.RcodeToString[tc.rcode], w.msg)
+			continue
+		}
+		if tc.rrs == nil {
+			continue
+		}
+		if len(w.msg.Answer) != len(tc.rrs) {
+			t.Errorf("test %d: expected %d answers, got %s", i, len(tc.rrs), w.msg)
+			continue
+		}
+		for j, r := range w.msg.Answer {
+			if r.String() != tc.rrs[j] {
+				t.Errorf("test %d: expected %s, got %s", i, tc.rrs[j], r)
+			}
+		}
+	}
+}
@@ -0,0 +1,62 @@
+// Copyright (c) 2014 The SkyDNS Authors. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package server
+
+import (
+	"crypto/rand"
+	"errors"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// errCase is returned for a reply whose question doesn't have the case of ours.
+var errCase = errors.New("reply with another case of the query name, possibly spoofed")
+
+// exchange0x20 sends m to ns with the letters of the query name in random case
+// (draft-vixie-dnsext-dns0x20). Nameservers copy the question into their reply
+// as is, so a spoofed reply has to guess the case on top of the ID and port: a
+// bit more for every letter. The reply gets the name of m back.
+func (s *server) exchange0x20(c *dns.Client, m *dns.Msg, ns string) (*dns.Msg, error) {
+	if len(m.Question) != 1 {
+		return s.exchangeCookie(c, m, ns)
+	}
+	name := m.Question[0].Name
+	m1 := *m
+	m1.Question = []dns.Question{m.Question[0]}
+	m1.Question[0].Name = randomCase(name)
+	r, err := s.exchangeCookie(c, &m1, ns)
+	if err != nil {
+		return r, err
+	}
+	if len(r.Question) != 1 || r.Question[0].Name != m1.Question[0].Name {
+		if s.config.Verbose {
+			logf("reply from %s for %s with another case: %v", ns, m1.Question[0].Name, r.Question)
+		}
+		return nil, errCase
+	}
+	r.Question[0].Name = name
+	for _, section := range [][]dns.RR{r.Answer, r.Ns, r.Extra} {
+		for _, rr := range section {
+			if strings.EqualFold(rr.Header().Name, name) {
+				rr.Header().Name = name
+			}
+		}
+	}
+	return r, nil
+}
+
+// randomCase returns name with every letter in upper or lower case at random.
+func randomCase(name string) string {
+	b := []byte(name)
+	bits := make([]byte, len(b))
+	rand.Read(bits)
+	for i, c := range b {
+		if ('a' <= c && c <= 'z' || 'A' <= c && c <= 'Z') && bits[i]&1 == 1 {
+			b[i] ^= 0x20
+		}
+	}
+	return string(b)
+}
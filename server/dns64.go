@@ -0,0 +1,249 @@
+// Copyright (c) 2014 The SkyDNS Authors. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package server
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/miekg/dns"
+)
+
+// DNS64 synthesizes AAAA records from A records (RFC 6147), for IPv6-only clients
+// that reach IPv4 services through a NAT64 gateway.
+type DNS64 struct {
+	// Prefix, the NAT64 prefix the IPv4 addresses are embedded in (RFC 6052). Its
+	// length is 32, 40, 48, 56, 64 or 96. Defaults to the well-known prefix
+	// 64:ff9b::/96.
+	Prefix string `json:"prefix,omitempty"`
+	// Exclude, ranges of addresses that are left out. AAAA records in an IPv6
+	// range count as absent, A records in an IPv4 range are not synthesized from.
+	// Defaults to the IPv4-mapped addresses, ::ffff:0:0/96.
+	Exclude []string `json:"exclude,omitempty"`
+
+	prefix   *net.IPNet
+	exclude6 []*net.IPNet
+	exclude4 []*net.IPNet
+}
+
+// dns64DefaultTtl is the TTL of synthesized records when the AAAA reply has no
+// SOA record, RFC 6147, section 5.1.7.
+const dns64DefaultTtl = 600
+
+func setDNS64Defaults(config *Config) error {
+	d := config.DNS64
+	if d == nil {
+		return nil
+	}
+	if d.Prefix == "" {
+		d.Prefix = "64:ff9b::/96"
+	}
+	ip, n, err := net.ParseCIDR(d.Prefix)
+	if err != nil || ip.To4() != nil {
+		return fmt.Errorf("dns64: invalid prefix: %q", d.Prefix)
+	}
+	switch ones, _ := n.Mask.Size(); ones {
+	case 32, 40, 48, 56, 64, 96:
+	default:
+		return fmt.Errorf("dns64: prefix length must be 32, 40, 48, 56, 64 or 96, not %d", ones)
+	}
+	if n.IP[8] != 0 {
+		return fmt.Errorf("dns64: bits 64 to 71 of the prefix must be zero: %q", d.Prefix)
+	}
+	d.prefix = n
+	if len(d.Exclude) == 0 {
+		d.Exclude = []string{"::ffff:0:0/96"}
+	}
+	d.exclude6, d.exclude4 = nil, nil
+	for _, a := range d.Exclude {
+		n, err := parseNet(a)
+		if err != nil {
+			return fmt.Errorf("dns64: invalid exclude entry: %s", err)
+		}
+		if len(n.IP) == net.IPv4len {
+			d.exclude4 = append(d.exclude4, n)
+			continue
+		}
+		d.exclude6 = append(d.exclude6, n)
+	}
+	return nil
+}
+
+// synthesize returns the IPv6 address that embeds ip4 in the prefix, see RFC 6052,
+// section 2.2. Bits 64 to 71 are skipped.
+func (d *DNS64) synthesize(ip4 net.IP) net.IP {
+	ip := make(net.IP, net.IPv6len)
+	copy(ip, d.prefix.IP)
+	ones, _ := d.prefix.Mask.Size()
+	i := ones / 8
+	for _, b := range ip4.To4() {
+		if i == 8 {
+			i++
+		}
+		ip[i] = b
+		i++
+	}
+	return ip
+}
+
+// excluded6 returns true if the AAAA record r is in an excluded range. Unlike
+// net.IPNet.Contains this matches IPv4-mapped addresses too.
+func (d *DNS64) excluded6(r *dns.AAAA) bool {
+	ip := r.AAAA.To16()
+	for _, n := range d.exclude6 {
+		if ip.Mask(n.Mask).Equal(n.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+// dns64Handler answers AAAA queries whose reply has no AAAA records, other than
+// those excluded, with AAAA records synthesized from the A records of the name.
+// The A query is resolved by next too, so local names, forwarded names and stub
+// zones are all synthesized.
+func (s *server) dns64Handler(next dns.Handler) dns.Handler {
+	d := s.config.DNS64
+	if d == nil {
+		return next
+	}
+	return dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+		if len(req.Question) != 1 || req.Question[0].Qtype != dns.TypeAAAA || req.Question[0].Qclass != dns.ClassINET {
+			next.ServeDNS(w, req)
+			return
+		}
+		// A client that validates itself would find the synthesized records bogus,
+		// RFC 6147, section 5.5.
+		if o := req.IsEdns0(); o != nil && o.Do() && req.CheckingDisabled {
+			next.ServeDNS(w, req)
+			return
+		}
+		aw := &dns64Writer{ResponseWriter: w}
+		next.ServeDNS(aw, req)
+		m := aw.msg
+		if m == nil {
+			return
+		}
+		if m.Rcode != dns.RcodeSuccess {
+			w.WriteMsg(m)
+			return
+		}
+		answer := make([]dns.RR, 0, len(m.Answer))
+		for _, r := range m.Answer {
+			if a, ok := r.(*dns.AAAA); ok && d.excluded6(a) {
+				continue
+			}
+			answer = append(answer, r)
+		}
+		if hasType(answer, dns.TypeAAAA) {
+			if len(answer) != len(m.Answer) {
+				c := *m
+				c.Answer = answer
+				m = &c
+			}
+			w.WriteMsg(m)
+			return
+		}
+
+		ttl := uint32(dns64DefaultTtl)
+		for _, r := range m.Ns {
+			if soa, ok := r.(*dns.SOA); ok {
+				ttl = soa.Hdr.Ttl
+				if soa.Minttl < ttl {
+					ttl = soa.Minttl
+				}
+			}
+		}
+		areq := req.Copy()
+		areq.Question[0].Qtype = dns.TypeA
+		aw = &dns64Writer{ResponseWriter: w}
+		next.ServeDNS(aw, areq)
+		if synth := d.synthesized(aw.msg, req, ttl); synth != nil {
+			// The AAAA records are larger than the A records they are made from.
+			if !isTCP(w) {
+				bufsize := dns.MinMsgSize
+				if o := req.IsEdns0(); o != nil && int(o.UDPSize()) > bufsize {
+					bufsize = int(o.UDPSize())
+				}
+				if s.config.MaxUDPSize != 0 && bufsize > s.config.MaxUDPSize {
+					bufsize = s.config.MaxUDPSize
+				}
+				Fit(synth, bufsize, false)
+			}
+			w.WriteMsg(synth)
+			return
+		}
+		if len(answer) != len(m.Answer) {
+			c := *m
+			c.Answer = answer
+			m = &c
+		}
+		w.WriteMsg(m)
+	})
+}
+
+// synthesized returns the reply to the AAAA query req made from a, the reply to
+// the A query for the same name, or nil when a has no A records to synthesize
+// from. The synthesized records get the TTL of the A record, but no more than
+// ttl. Signatures are dropped, they don't cover the synthesized records.
+func (d *DNS64) synthesized(a, req *dns.Msg, ttl uint32) *dns.Msg {
+	if a == nil || a.Rcode != dns.RcodeSuccess {
+		return nil
+	}
+	m := new(dns.Msg)
+	m.SetReply(req)
+	m.Authoritative = a.Authoritative
+	m.RecursionAvailable = a.RecursionAvailable
+	m.Truncated = a.Truncated
+	synth := false
+	for _, r := range a.Answer {
+		switch r := r.(type) {
+		case *dns.A:
+			if containsIP(d.exclude4, r.A) {
+				continue
+			}
+			hdr := r.Hdr
+			hdr.Rrtype = dns.TypeAAAA
+			if hdr.Ttl > ttl {
+				hdr.Ttl = ttl
+			}
+			m.Answer = append(m.Answer, &dns.AAAA{Hdr: hdr, AAAA: d.synthesize(r.A)})
+			synth = true
+		case *dns.RRSIG:
+		default:
+			m.Answer = append(m.Answer, r)
+		}
+	}
+	if !synth {
+		return nil
+	}
+	for _, r := range a.Extra {
+		if r.Header().Rrtype == dns.TypeOPT {
+			m.Extra = append(m.Extra, r)
+		}
+	}
+	return m
+}
+
+// dns64Writer keeps the reply written for dns64Handler, which writes it itself.
+type dns64Writer struct {
+	dns.ResponseWriter
+	msg *dns.Msg
+}
+
+func (w *dns64Writer) WriteMsg(m *dns.Msg) error {
+	w.msg = m
+	return nil
+}
+
+// Write is used for replies from the packed cache.
+func (w *dns64Writer) Write(b []byte) (int, error) {
+	m := new(dns.Msg)
+	if err := m.Unpack(b); err != nil {
+		return 0, err
+	}
+	w.msg = m
+	return len(b), nil
+}
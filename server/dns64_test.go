@@ -0,0 +1,106 @@
+// Copyright (c) 2014 The SkyDNS Authors. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package server
+
+import (
+	"net"
+	"testing"
+
+	"github.com/skynetservices/skydns/msg"
+
+	"github.com/miekg/dns"
+)
+
+func TestDNS64Synthesize(t *testing.T) {
+	// The examples of RFC 6052, section 2.4.
+	tests := []struct {
+		prefix string
+		ip     string
+	}{
+		{"2001:db8::/32", "2001:db8:c000:221::"},
+		{"2001:db8:100::/40", "2001:db8:1c0:2:21::"},
+		{"2001:db8:122::/48", "2001:db8:122:c000:2:2100::"},
+		{"2001:db8:122:300::/56", "2001:db8:122:3c0:0:221::"},
+		{"2001:db8:122:344::/64", "2001:db8:122:344:c0:2:2100:0"},
+		{"2001:db8:122:344::/96", "2001:db8:122:344::192.0.2.33"},
+	}
+	for _, tc := range tests {
+		config := &Config{DNS64: &DNS64{Prefix: tc.prefix}}
+		if err := setDNS64Defaults(config); err != nil {
+			t.Fatal(err)
+		}
+		if ip := config.DNS64.synthesize(net.ParseIP("192.0.2.33")); !ip.Equal(net.ParseIP(tc.ip)) {
+			t.Errorf("prefix %s: expected %s, got %s", tc.prefix, tc.ip, ip)
+		}
+	}
+
+	for _, prefix := range []string{"10.0.0.0/8", "2001:db8::/33", "2001:db8:0:0:ff00::/96", "nat64"} {
+		if err := setDNS64Defaults(&Config{DNS64: &DNS64{Prefix: prefix}}); err == nil {
+			t.Errorf("expected an error for prefix %s", prefix)
+		}
+	}
+
+	d := &DNS64{}
+	if err := setDNS64Defaults(&Config{DNS64: d}); err != nil {
+		t.Fatal(err)
+	}
+	for ip, excluded := range map[string]bool{"::ffff:192.0.2.1": true, "2001:db8::1": false} {
+		if d.excluded6(&dns.AAAA{AAAA: net.ParseIP(ip)}) != excluded {
+			t.Errorf("expected %s excluded to be %t", ip, excluded)
+		}
+	}
+}
+
+func TestDNS64(t *testing.T) {
+	s := newTestServer(t, false, func(s *server) {
+		s.config.DNS64 = &DNS64{Exclude: []string{"::ffff:0:0/96", "10.0.0.0/8"}}
+		if err := setDNS64Defaults(s.config); err != nil {
+			t.Fatal(err)
+		}
+	})
+	defer s.Stop()
+	for _, serv := range []*msg.Service{
+		{Host: "192.0.2.33", Key: "v4.dns64.skydns.test."},
+		{Host: "2001:db8::33", Key: "v6.dns64.skydns.test."},
+		{Host: "10.0.64.1", Key: "private.dns64.skydns.test."},
+	} {
+		addService(t, s, serv.Key, 0, serv)
+		defer delService(t, s, serv.Key)
+	}
+
+	h := s.dns64Handler(s)
+	query := func(name string, qtype uint16, validating bool) *dns.Msg {
+		m := new(dns.Msg)
+		m.SetQuestion(name, qtype)
+		if validating {
+			m.SetEdns0(4096, true)
+			m.CheckingDisabled = true
+		}
+		w := &testWriter{}
+		h.ServeDNS(w, m)
+		return w.msg
+	}
+
+	// The TTL is that of the SOA record of the NODATA reply to the AAAA query.
+	resp := query("v4.dns64.skydns.test.", dns.TypeAAAA, false)
+	if len(resp.Answer) != 1 || resp.Answer[0].String() != "v4.dns64.skydns.test.\t60\tIN\tAAAA\t64:ff9b::c000:221" {
+		t.Errorf("expected a synthesized AAAA record, got %s", resp)
+	}
+	if resp := query("v6.dns64.skydns.test.", dns.TypeAAAA, false); len(resp.Answer) != 1 || resp.Answer[0].(*dns.AAAA).AAAA.String() != "2001:db8::33" {
+		t.Errorf("expected the AAAA record of the name, got %s", resp)
+	}
+	if resp := query("private.dns64.skydns.test.", dns.TypeAAAA, false); len(resp.Answer) != 0 || len(resp.Ns) != 1 {
+		t.Errorf("expected NODATA for an excluded A record, got %s", resp)
+	}
+	if resp := query("v4.dns64.skydns.test.", dns.TypeAAAA, true); len(resp.Answer) != 0 {
+		t.Errorf("expected no synthesis for a validating client, got %s", resp)
+	}
+	if resp := query("v4.dns64.skydns.test.", dns.TypeA, false); len(resp.Answer) != 1 || resp.Answer[0].Header().Rrtype != dns.TypeA {
+		t.Errorf("expected the A record, got %s", resp)
+	}
+	if resp := query("nothing.dns64.skydns.test.", dns.TypeAAAA, false); resp.Rcode != dns.RcodeNameError {
+		t.Errorf("expected NXDOMAIN, got %s", resp)
+	}
+}
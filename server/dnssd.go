@@ -0,0 +1,98 @@
+// Copyright (c) 2014 The SkyDNS Authors. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package server
+
+import (
+	"strings"
+
+	"github.com/skynetservices/skydns/msg"
+
+	"github.com/miekg/dns"
+)
+
+// dnssdServices is the DNS-SD service type enumeration prefix from RFC 6763, section 9.
+const dnssdServices = "_services._dns-sd._udp."
+
+// DNSSDRecords returns PTR records for DNS-SD (RFC 6763) browsing, synthesized
+// from the services under name: those with Srv and Proto fields, and those
+// stored in the tree under an RFC 2782 name, such as the key
+// /skydns/local/skydns/rails/_tcp/_http/web. A query for
+// _services._dns-sd._udp.<name> lists the service types registered under name,
+// a query for _service._proto.<name> lists the instances of that type. The etcd
+// v2 API hides keys starting with an underscore from listings, so there only
+// the latter finds the services stored under RFC 2782 names. An
+// instance is named after the first label of its key and can be queried for
+// SRV and TXT records, see srvServices.
+func (s *server) DNSSDRecords(q dns.Question, name string) (records []dns.RR, err error) {
+	if strings.HasPrefix(name, dnssdServices) {
+		base := name[len(dnssdServices):]
+		services, err := s.records(base, false)
+		if err != nil {
+			return nil, err
+		}
+		seen := make(map[string]bool)
+		for _, serv := range services {
+			typ := dnssdType(serv, base)
+			if typ == "" || seen[typ] {
+				continue
+			}
+			seen[typ] = true
+			records = append(records, dnssdPTR(q.Name, typ, serv.Ttl))
+		}
+		return records, nil
+	}
+
+	instance, srv, proto, base, ok := splitSrvName(name)
+	if !ok || instance != "" {
+		return nil, nil
+	}
+	// The instances stored in the tree under name, and the services under base
+	// with a matching Srv and Proto.
+	services, err := s.records(name, false)
+	if sx, err1 := s.records(base, false); err1 == nil {
+		for _, serv := range sx {
+			if strings.EqualFold(serv.Srv, srv) && strings.EqualFold(serv.Proto, proto) {
+				services = append(services, serv)
+			}
+		}
+	}
+	if len(services) == 0 {
+		return nil, err
+	}
+	seen := make(map[string]bool)
+	for _, serv := range services {
+		domain := msg.Domain(serv.Key)
+		if dns.IsSubDomain(name, domain) && dns.CountLabel(domain) != dns.CountLabel(name)+1 {
+			// Stored under name itself, only direct children are instances.
+			continue
+		}
+		target := dns.SplitDomainName(domain)[0] + "." + name
+		if seen[target] {
+			continue
+		}
+		seen[target] = true
+		records = append(records, dnssdPTR(q.Name, target, serv.Ttl))
+	}
+	return records, nil
+}
+
+// dnssdType returns the service type of serv, a service under base: the type
+// its Srv and Proto fields name, or when it is stored under an instance of an
+// RFC 2782 name directly under base, the type of that name. Otherwise it
+// returns the empty string.
+func dnssdType(serv msg.Service, base string) string {
+	if serv.Srv != "" && serv.Proto != "" {
+		return strings.ToLower("_" + serv.Srv + "._" + serv.Proto + "." + base)
+	}
+	instance, srv, proto, b, ok := splitSrvName(msg.Domain(serv.Key))
+	if !ok || instance == "" || !strings.EqualFold(b, base) {
+		return ""
+	}
+	return strings.ToLower("_" + srv + "._" + proto + "." + base)
+}
+
+func dnssdPTR(name, target string, ttl uint32) *dns.PTR {
+	return &dns.PTR{Hdr: dns.RR_Header{Name: name, Rrtype: dns.TypePTR, Class: dns.ClassINET, Ttl: ttl}, Ptr: target}
+}
@@ -0,0 +1,31 @@
+// Copyright (c) 2014 The SkyDNS Authors. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package server
+
+import (
+	"testing"
+
+	"github.com/skynetservices/skydns/msg"
+)
+
+func TestDNSSDType(t *testing.T) {
+	const base = "rails.skydns.test."
+	tests := []struct {
+		serv msg.Service
+		typ  string
+	}{
+		{msg.Service{Key: "/skydns/test/skydns/rails/web", Srv: "HTTP", Proto: "tcp"}, "_http._tcp.rails.skydns.test."},
+		{msg.Service{Key: "/skydns/test/skydns/rails/_tcp/_http/web"}, "_http._tcp.rails.skydns.test."},
+		{msg.Service{Key: "/skydns/test/skydns/rails/_tcp/_http"}, ""},
+		{msg.Service{Key: "/skydns/test/skydns/rails/east/_tcp/_http/web"}, ""},
+		{msg.Service{Key: "/skydns/test/skydns/rails/_tcp/_http/web/1"}, ""},
+		{msg.Service{Key: "/skydns/test/skydns/rails/web"}, ""},
+	}
+	for i, tc := range tests {
+		if typ := dnssdType(tc.serv, base); typ != tc.typ {
+			t.Errorf("test %d: expected type %q, got %q", i, tc.typ, typ)
+		}
+	}
+}
@@ -8,7 +8,10 @@ import (
 	"crypto"
 	"crypto/ecdsa"
 	"crypto/rsa"
+	"errors"
 	"os"
+	"runtime"
+	"sync"
 	"time"
 
 	"github.com/skynetservices/skydns/cache"
@@ -17,11 +20,12 @@ import (
 
 	"github.com/miekg/dns"
 )
+
 var (
 	inflight = &singleflight.Group{}
+	errSign  = errors.New("failed to sign an RRset")
 )
 
-
 // ParseKeyFile read a DNSSEC keyfile as generated by dnssec-keygen or other
 // utilities. It add ".key" for the public key and ".private" for the private key.
 func ParseKeyFile(file string) (*dns.DNSKEY, crypto.Signer, error) {
@@ -56,64 +60,105 @@ func ParseKeyFile(file string) (*dns.DNSKEY, crypto.Signer, error) {
 // a hash of the signed data as a key.
 // We also fake the origin TTL in the signature, because we don't want to
 // throw away signatures when services decide to have longer TTL. So we just
-// set the origTTL to 60.
+// set the origTTL to 60. It returns errSign when an RRset could not be signed,
+// the others are signed anyway.
 // TODO(miek): revisit origTTL
-func (s *server) Sign(m *dns.Msg, bufsize uint16) {
+func (s *server) Sign(m *dns.Msg, bufsize uint16) error {
 	now := time.Now().UTC()
+	defer metrics.ReportStage(metrics.StageSign, now)
 	incep := uint32(now.Add(-3 * time.Hour).Unix())     // 2+1 hours, be sure to catch daylight saving time and such
 	expir := uint32(now.Add(7 * 24 * time.Hour).Unix()) // sign for a week
 
-	for _, r := range rrSets(m.Answer) {
-		if r[0].Header().Rrtype == dns.TypeRRSIG {
-			continue
-		}
-		if !dns.IsSubDomain(s.config.Domain, r[0].Header().Name) {
+	an, ns, ex := s.signable(m.Answer), s.signable(m.Ns), s.signable(m.Extra)
+	sets := make([][]dns.RR, 0, len(an)+len(ns)+len(ex))
+	sets = append(append(append(sets, an...), ns...), ex...)
+
+	var err error
+	for i, sig := range s.signSets(sets, now, incep, expir) {
+		if sig == nil {
+			err = errSign
 			continue
 		}
-		if sig, err := s.signSet(r, now, incep, expir); err == nil {
+		switch {
+		case i < len(an):
 			m.Answer = append(m.Answer, sig)
-		}
-	}
-	for _, r := range rrSets(m.Ns) {
-		if r[0].Header().Rrtype == dns.TypeRRSIG {
-			continue
-		}
-		if !dns.IsSubDomain(s.config.Domain, r[0].Header().Name) {
-			continue
-		}
-		if sig, err := s.signSet(r, now, incep, expir); err == nil {
+		case i < len(an)+len(ns):
 			m.Ns = append(m.Ns, sig)
+		default:
+			m.Extra = append(m.Extra, sig)
 		}
 	}
-	for _, r := range rrSets(m.Extra) {
+	return err
+}
+
+// signable returns the RRsets in rrs that should be signed: those in our
+// domain that are not RRSIG or OPT records.
+func (s *server) signable(rrs []dns.RR) [][]dns.RR {
+	var sets [][]dns.RR
+	for _, r := range rrSets(rrs) {
 		if r[0].Header().Rrtype == dns.TypeRRSIG || r[0].Header().Rrtype == dns.TypeOPT {
 			continue
 		}
 		if !dns.IsSubDomain(s.config.Domain, r[0].Header().Name) {
 			continue
 		}
-		if sig, err := s.signSet(r, now, incep, expir); err == nil {
-			m.Extra = append(m.Extra, sig)
+		sets = append(sets, r)
+	}
+	return sets
+}
+
+// signSets returns a signature for every RRset in sets, sigs[i] is nil when
+// sets[i] could not be signed. Signatures still in the signature cache are
+// reused, the other sets are signed concurrently on at most runtime.NumCPU()
+// goroutines.
+func (s *server) signSets(sets [][]dns.RR, now time.Time, incep, expir uint32) []*dns.RRSIG {
+	sigs := make([]*dns.RRSIG, len(sets))
+	var miss []int
+	for i, r := range sets {
+		if sig, hit := s.cachedSig(cache.KeyRRset(r), now); hit {
+			sigs[i] = sig
+			continue
 		}
+		miss = append(miss, i)
+	}
+	if len(miss) == 1 {
+		sigs[miss[0]], _ = s.signSet(sets[miss[0]], now, incep, expir)
+		return sigs
 	}
 
-	o := new(dns.OPT)
-	o.Hdr.Name = "."
-	o.Hdr.Rrtype = dns.TypeOPT
-	o.SetDo()
-	o.SetUDPSize(4096) // TODO(miek): echo client
-	m.Extra = append(m.Extra, o)
-	return
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, runtime.NumCPU())
+	for _, i := range miss {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int) {
+			defer func() { <-sem; wg.Done() }()
+			sigs[i], _ = s.signSet(sets[i], now, incep, expir)
+		}(i)
+	}
+	wg.Wait()
+	return sigs
+}
+
+// cachedSig returns the signature stored under key in the signature cache, if
+// it is still valid for at least another day.
+func (s *server) cachedSig(key string, now time.Time) (*dns.RRSIG, bool) {
+	m, exp, hit := s.scache.Search(key) // There can only be one sig in this cache.
+	if !hit {
+		return nil, false
+	}
+	// Is it still valid 24 hours from now?
+	if now.Add(+24*time.Hour).Sub(exp) < -24*time.Hour {
+		return m.Answer[0].(*dns.RRSIG), true
+	}
+	s.scache.Remove(key)
+	return nil, false
 }
 
 func (s *server) signSet(r []dns.RR, now time.Time, incep, expir uint32) (*dns.RRSIG, error) {
 	key := cache.KeyRRset(r)
-	if m, exp, hit := s.scache.Search(key); hit { // There can only be one sig in this cache.
-		// Is it still valid 24 hours from now?
-		if now.Add(+24*time.Hour).Sub(exp) < -24*time.Hour {
-			return m.Answer[0].(*dns.RRSIG), nil
-		}
-		s.scache.Remove(key)
+	if sig, hit := s.cachedSig(key, now); hit {
+		return sig, nil
 	}
 	if s.config.Verbose {
 		logf("scache miss for %s type %d", r[0].Header().Name, r[0].Header().Rrtype)
@@ -0,0 +1,106 @@
+// Copyright (c) 2014 The SkyDNS Authors. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package server
+
+import (
+	"strconv"
+	"testing"
+
+	"github.com/skynetservices/skydns/msg"
+
+	"github.com/miekg/dns"
+)
+
+func TestSignSets(t *testing.T) {
+	s := newTestServerDNSSEC(t, false)
+	defer s.Stop()
+
+	m := new(dns.Msg)
+	m.SetQuestion("skydns.test.", dns.TypeSRV)
+	for i := 0; i < 20; i++ {
+		m.Answer = append(m.Answer, newSRV("s"+strconv.Itoa(i)+".skydns.test. 3600 SRV 10 100 8080 server.skydns.test."))
+		m.Extra = append(m.Extra, newA("s"+strconv.Itoa(i)+".skydns.test. 3600 A 10.0.0.1"))
+	}
+
+	// Sign twice, the second time all signatures come from the cache.
+	for j := 0; j < 2; j++ {
+		r := m.Copy()
+		s.Sign(r, 4096)
+		for _, section := range [][]dns.RR{r.Answer, r.Extra} {
+			sets := rrSets(section)
+			for k, set := range sets {
+				if k.qtype == dns.TypeRRSIG || k.qtype == dns.TypeOPT {
+					continue
+				}
+				sigs := sets[rrset{k.qname, dns.TypeRRSIG}]
+				if len(sigs) != 1 {
+					t.Fatalf("expected 1 signature for %s/%d, got %d", k.qname, k.qtype, len(sigs))
+				}
+				if err := sigs[0].(*dns.RRSIG).Verify(s.config.PubKey, set); err != nil {
+					t.Errorf("failed to verify signature for %s/%d: %s", k.qname, k.qtype, err)
+				}
+			}
+		}
+	}
+}
+
+func TestDNSSECFlags(t *testing.T) {
+	s := newTestServerDNSSEC(t, true)
+	defer s.Stop()
+
+	addService(t, s, "a.flags.skydns.test.", 0, &msg.Service{Host: "10.0.0.1"})
+	defer delService(t, s, "a.flags.skydns.test.")
+
+	tests := []struct {
+		qname      string
+		do, ad, cd bool
+		rcode      int
+		wantAD     bool
+	}{
+		{"a.flags.skydns.test.", false, false, false, dns.RcodeSuccess, false},
+		{"a.flags.skydns.test.", false, true, false, dns.RcodeSuccess, true}, // cache hit from the query above
+		{"a.flags.skydns.test.", true, false, false, dns.RcodeSuccess, true},
+		{"a.flags.skydns.test.", true, false, true, dns.RcodeSuccess, true},
+		{"a.flags.skydns.test.", false, false, true, dns.RcodeSuccess, false},
+		{"b.flags.skydns.test.", true, false, false, dns.RcodeNameError, true},
+		{"b.flags.skydns.test.", false, false, false, dns.RcodeNameError, false},
+	}
+
+	c := new(dns.Client)
+	for i, tc := range tests {
+		m := new(dns.Msg)
+		m.SetQuestion(tc.qname, dns.TypeA)
+		m.AuthenticatedData = tc.ad
+		m.CheckingDisabled = tc.cd
+		if tc.do {
+			m.SetEdns0(4096, true)
+		}
+		r, _, err := c.Exchange(m, "127.0.0.1:"+StrPort)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if r.Rcode != tc.rcode {
+			t.Errorf("test %d: expected rcode %d, got %d", i, tc.rcode, r.Rcode)
+		}
+		if !r.Authoritative {
+			t.Errorf("test %d: expected AA to be set", i)
+		}
+		if r.AuthenticatedData != tc.wantAD {
+			t.Errorf("test %d: expected AD %t, got %t", i, tc.wantAD, r.AuthenticatedData)
+		}
+		if r.CheckingDisabled != tc.cd {
+			t.Errorf("test %d: expected CD %t, got %t", i, tc.cd, r.CheckingDisabled)
+		}
+		sigs := 0
+		for _, rr := range append(r.Answer, r.Ns...) {
+			if rr.Header().Rrtype == dns.TypeRRSIG {
+				sigs++
+			}
+		}
+		if tc.do != (sigs > 0) {
+			t.Errorf("test %d: expected signatures %t, got %d", i, tc.do, sigs)
+		}
+	}
+}
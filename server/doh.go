@@ -0,0 +1,189 @@
+// Copyright (c) 2014 The SkyDNS Authors. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package server
+
+import (
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/skynetservices/skydns/metrics"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	// dohPath is the path of the DNS-over-HTTPS endpoint, the one used in the
+	// examples of RFC 8484 and by most clients.
+	dohPath = "/dns-query"
+	// dohMime is the media type of DNS messages sent over HTTPS.
+	dohMime = "application/dns-message"
+	// DoHMetrics as Config.DoHAddr serves the DoH endpoint on the metrics listener.
+	DoHMetrics = "metrics"
+)
+
+// msgWriter is the dns.ResponseWriter for queries that come in over HTTPS or
+// gRPC, it keeps the reply so it can be sent in the response of the request.
+type msgWriter struct {
+	local  net.Addr
+	remote net.Addr
+	msg    *dns.Msg
+}
+
+func (w *msgWriter) LocalAddr() net.Addr       { return w.local }
+func (w *msgWriter) RemoteAddr() net.Addr      { return w.remote }
+func (w *msgWriter) Close() error              { return nil }
+func (w *msgWriter) TsigStatus() error         { return errTsigUnchecked }
+func (w *msgWriter) TsigTimersOnly(bool)       {}
+func (w *msgWriter) Hijack()                   {}
+func (w *msgWriter) WriteMsg(m *dns.Msg) error { w.msg = m; return nil }
+
+func (w *msgWriter) Write(b []byte) (int, error) {
+	m := new(dns.Msg)
+	if err := m.Unpack(b); err != nil {
+		return 0, err
+	}
+	w.msg = m
+	return len(b), nil
+}
+
+// dohHandler serves DNS queries over HTTPS, as described in RFC 8484: a GET with
+// the query in the dns parameter, or a POST with the query as the body. The
+// queries are handed to h, like the ones over TCP, so they are never truncated.
+type dohHandler struct {
+	h       dns.Handler
+	local   net.Addr
+	padding int // see Config.PaddingBlock
+}
+
+func (d *dohHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var (
+		buf []byte
+		err error
+	)
+	switch r.Method {
+	case http.MethodGet:
+		b64 := r.URL.Query().Get("dns")
+		if b64 == "" {
+			http.Error(w, "bad request: no dns parameter", http.StatusBadRequest)
+			return
+		}
+		// RFC 8484 uses base64url without padding, accept it anyway.
+		buf, err = base64.RawURLEncoding.DecodeString(strings.TrimRight(b64, "="))
+	case http.MethodPost:
+		if ct := r.Header.Get("Content-Type"); ct != dohMime {
+			http.Error(w, fmt.Sprintf("unsupported media type: %q", ct), http.StatusUnsupportedMediaType)
+			return
+		}
+		buf, err = ioutil.ReadAll(io.LimitReader(r.Body, dns.MaxMsgSize+1))
+		if len(buf) > dns.MaxMsgSize {
+			http.Error(w, "request too large", http.StatusRequestEntityTooLarge)
+			return
+		}
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf("bad request: %s", err), http.StatusBadRequest)
+		return
+	}
+	req := new(dns.Msg)
+	if err := req.Unpack(buf); err != nil || req.Response {
+		http.Error(w, "bad request: not a DNS query", http.StatusBadRequest)
+		return
+	}
+
+	remote := &net.TCPAddr{}
+	if host, port, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		remote.IP = net.ParseIP(host)
+		remote.Port, _ = strconv.Atoi(port)
+	}
+	dw := &msgWriter{local: d.local, remote: remote}
+	d.h.ServeDNS(dw, req)
+	if dw.msg == nil {
+		// Shed by the worker pool, or dropped for another reason.
+		http.Error(w, "no reply", http.StatusServiceUnavailable)
+		return
+	}
+	b, err := packPadded(dw.msg, d.padding)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("failure to pack the reply: %s", err), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", dohMime)
+	w.Header().Set("Cache-Control", fmt.Sprintf("max-age=%d", dohMaxAge(dw.msg)))
+	w.Write(b)
+}
+
+// dohMaxAge returns the freshness lifetime of the HTTP response holding m: the
+// smallest TTL of its records, RFC 8484, section 5.1. The TTL of the SOA of a
+// negative answer is its negative TTL. A reply without records is not cached.
+func dohMaxAge(m *dns.Msg) uint32 {
+	min, found := uint32(0), false
+	for _, section := range [][]dns.RR{m.Answer, m.Ns, m.Extra} {
+		for _, r := range section {
+			if r.Header().Rrtype == dns.TypeOPT {
+				continue
+			}
+			if ttl := r.Header().Ttl; !found || ttl < min {
+				min, found = ttl, true
+			}
+		}
+	}
+	return min
+}
+
+// runDoH starts the DNS-over-HTTPS endpoint on Config.DoHAddr, or on the metrics
+// listener, for the queries to be handled by h.
+func (s *server) runDoH(h dns.Handler) error {
+	if s.config.DoHAddr == DoHMetrics {
+		if metrics.Port == "" {
+			return fmt.Errorf("doh_addr is %q, but metrics are not enabled", DoHMetrics)
+		}
+		local, _ := net.ResolveTCPAddr("tcp", ":"+metrics.Port)
+		http.Handle(dohPath, &dohHandler{h: h, local: local, padding: s.config.PaddingBlock})
+		logf("ready for DNS-over-HTTPS queries on http://:%s%s", metrics.Port, dohPath)
+		return nil
+	}
+
+	local, err := net.ResolveTCPAddr("tcp", s.config.DoHAddr)
+	if err != nil {
+		return err
+	}
+	mux := http.NewServeMux()
+	mux.Handle(dohPath, &dohHandler{h: h, local: local, padding: s.config.PaddingBlock})
+	https := s.config.DoHCert != "" || s.cert != nil
+	l, err := net.Listen("tcp", s.config.DoHAddr)
+	if err != nil {
+		return err
+	}
+	l = s.proxyListener(ProxyDoH, l)
+	go func() {
+		var err error
+		switch {
+		case s.cert != nil:
+			srv := &http.Server{Handler: mux, TLSConfig: &tls.Config{GetCertificate: s.cert.get}}
+			err = srv.ServeTLS(l, "", "")
+		case https:
+			err = http.ServeTLS(l, mux, s.config.DoHCert, s.config.DoHKey)
+		default:
+			err = http.Serve(l, mux)
+		}
+		fatalf("%s", err)
+	}()
+	scheme := "http"
+	if https {
+		scheme = "https"
+	}
+	logf("ready for DNS-over-HTTPS queries on %s://%s%s", scheme, s.config.DoHAddr, dohPath)
+	return nil
+}
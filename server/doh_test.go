@@ -0,0 +1,115 @@
+// Copyright (c) 2014 The SkyDNS Authors. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package server
+
+import (
+	"bytes"
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/skynetservices/skydns/msg"
+
+	"github.com/miekg/dns"
+)
+
+func TestDoH(t *testing.T) {
+	s := newTestServer(t, false)
+	defer s.Stop()
+
+	serv := &msg.Service{Host: "10.0.18.1", Key: "www.doh.skydns.test.", Ttl: 120}
+	addService(t, s, serv.Key, 0, serv)
+	defer delService(t, s, serv.Key)
+
+	d := &dohHandler{h: s}
+	query := func(name string) []byte {
+		m := new(dns.Msg)
+		m.SetQuestion(name, dns.TypeA)
+		m.Id = 0
+		buf, _ := m.Pack()
+		return buf
+	}
+	do := func(r *http.Request) *httptest.ResponseRecorder {
+		r.RemoteAddr = "127.0.0.1:1234"
+		w := httptest.NewRecorder()
+		d.ServeHTTP(w, r)
+		return w
+	}
+
+	get := httptest.NewRequest("GET", dohPath+"?dns="+base64.RawURLEncoding.EncodeToString(query("www.doh.skydns.test.")), nil)
+	post := httptest.NewRequest("POST", dohPath, bytes.NewReader(query("www.doh.skydns.test.")))
+	post.Header.Set("Content-Type", dohMime)
+	for _, r := range []*http.Request{get, post} {
+		w := do(r)
+		if w.Code != http.StatusOK || w.Header().Get("Content-Type") != dohMime {
+			t.Fatalf("%s: expected a %s reply, got %d: %s", r.Method, dohMime, w.Code, w.Body)
+		}
+		if cc := w.Header().Get("Cache-Control"); cc != "max-age=120" {
+			t.Errorf("%s: expected max-age=120, got %q", r.Method, cc)
+		}
+		m := new(dns.Msg)
+		if err := m.Unpack(w.Body.Bytes()); err != nil {
+			t.Fatal(err)
+		}
+		if len(m.Answer) != 1 || m.Answer[0].(*dns.A).A.String() != "10.0.18.1" {
+			t.Errorf("%s: expected the A record of www.doh.skydns.test., got %s", r.Method, m)
+		}
+	}
+
+	// The max-age of a negative answer is the negative TTL.
+	w := do(httptest.NewRequest("GET", dohPath+"?dns="+base64.RawURLEncoding.EncodeToString(query("nx.doh.skydns.test.")), nil))
+	if cc := w.Header().Get("Cache-Control"); cc != "max-age=60" {
+		t.Errorf("expected max-age=60 for NXDOMAIN, got %q", cc)
+	}
+
+	bad := httptest.NewRequest("POST", dohPath, bytes.NewReader(query("www.doh.skydns.test.")))
+	bad.Header.Set("Content-Type", "text/plain")
+	tests := []struct {
+		r    *http.Request
+		code int
+	}{
+		{httptest.NewRequest("GET", dohPath, nil), http.StatusBadRequest},
+		{httptest.NewRequest("GET", dohPath+"?dns=AAAA", nil), http.StatusBadRequest},
+		{bad, http.StatusUnsupportedMediaType},
+		{httptest.NewRequest("PUT", dohPath, nil), http.StatusMethodNotAllowed},
+	}
+	for i, tc := range tests {
+		if w := do(tc.r); w.Code != tc.code {
+			t.Errorf("test %d: expected status %d, got %d", i, tc.code, w.Code)
+		}
+	}
+}
+
+func TestDoHPadding(t *testing.T) {
+	s := newTestServer(t, false)
+	defer s.Stop()
+
+	serv := &msg.Service{Host: "10.0.18.2", Key: "pad.doh.skydns.test."}
+	addService(t, s, serv.Key, 0, serv)
+	defer delService(t, s, serv.Key)
+
+	d := &dohHandler{h: s, padding: 468}
+	for _, edns := range []bool{true, false} {
+		m := new(dns.Msg)
+		m.SetQuestion("pad.doh.skydns.test.", dns.TypeA)
+		if edns {
+			m.SetEdns0(4096, false)
+		}
+		buf, _ := m.Pack()
+		r := httptest.NewRequest("POST", dohPath, bytes.NewReader(buf))
+		r.Header.Set("Content-Type", dohMime)
+		w := httptest.NewRecorder()
+		d.ServeHTTP(w, r)
+
+		if padded := w.Body.Len()%468 == 0; padded != edns {
+			t.Errorf("edns %t: expected padded %t, got a reply of %d bytes", edns, edns, w.Body.Len())
+		}
+		reply := new(dns.Msg)
+		if err := reply.Unpack(w.Body.Bytes()); err != nil || len(reply.Answer) != 1 {
+			t.Errorf("edns %t: expected an answer, got %v: %v", edns, reply, err)
+		}
+	}
+}
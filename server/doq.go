@@ -0,0 +1,175 @@
+// Copyright (c) 2014 The SkyDNS Authors. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/quic-go/quic-go"
+)
+
+const (
+	// doqALPN is the ALPN token of DNS over QUIC, RFC 9250, section 4.1.1.
+	doqALPN = "doq"
+	// doqIdleTimeout is how long a connection without streams is kept open.
+	doqIdleTimeout = 30 * time.Second
+)
+
+// The error codes of DNS over QUIC, RFC 9250, section 4.3.
+const (
+	doqInternalError quic.StreamErrorCode      = 0x1
+	doqProtocolError quic.ApplicationErrorCode = 0x2
+)
+
+// doqServer serves DNS queries over QUIC, as described in RFC 9250: every query
+// comes in on a stream of its own, prefixed with its length like over TCP, and
+// its reply is sent back on it. The queries are handed to h, like the ones over
+// TCP, so they are never truncated.
+type doqServer struct {
+	h       dns.Handler
+	timeout time.Duration // to read a query, Config.ReadTimeout
+	padding int           // see Config.PaddingBlock
+}
+
+// serve accepts the connections on l, until it is closed.
+func (d *doqServer) serve(l *quic.EarlyListener) error {
+	for {
+		conn, err := l.Accept(context.Background())
+		if err != nil {
+			return err
+		}
+		go d.serveConn(conn)
+	}
+}
+
+// serveConn serves the streams of conn, each in a goroutine of its own, so a slow
+// query doesn't hold up the others.
+func (d *doqServer) serveConn(conn quic.EarlyConnection) {
+	for {
+		str, err := conn.AcceptStream(context.Background())
+		if err != nil {
+			return
+		}
+		go d.serveStream(conn, str)
+	}
+}
+
+func (d *doqServer) serveStream(conn quic.EarlyConnection, str quic.Stream) {
+	req, err := readDoQ(str, d.timeout)
+	if err != nil {
+		// A malformed query is an error of the connection, RFC 9250, section 4.3.3.
+		conn.CloseWithError(doqProtocolError, err.Error())
+		return
+	}
+	// Queries sent in 0-RTT can be replayed, only those without side effects
+	// are handled before the handshake completes, RFC 9250, section 4.5.
+	if req.Opcode != dns.OpcodeQuery {
+		select {
+		case <-conn.HandshakeComplete():
+		case <-conn.Context().Done():
+			return
+		}
+	}
+
+	w := &msgWriter{local: streamAddr(conn.LocalAddr()), remote: streamAddr(conn.RemoteAddr())}
+	d.h.ServeDNS(w, req)
+	if w.msg == nil {
+		// Shed by the worker pool, or dropped for another reason.
+		str.CancelWrite(doqInternalError)
+		return
+	}
+	w.msg.Id = 0
+	b, err := packPadded(w.msg, d.padding)
+	if err != nil {
+		logf("failure to pack the reply: %s", err)
+		str.CancelWrite(doqInternalError)
+		return
+	}
+	out := make([]byte, 2+len(b))
+	binary.BigEndian.PutUint16(out, uint16(len(b)))
+	copy(out[2:], b)
+	if _, err := str.Write(out); err != nil {
+		logf("failure to return reply %q", err)
+		return
+	}
+	str.Close()
+}
+
+// readDoQ reads the query on str, a stream the client closed after sending it.
+// Its message ID must be 0, RFC 9250, section 4.2.1.
+func readDoQ(str quic.Stream, timeout time.Duration) (*dns.Msg, error) {
+	if timeout > 0 {
+		str.SetReadDeadline(time.Now().Add(timeout))
+	}
+	var l [2]byte
+	if _, err := io.ReadFull(str, l[:]); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, binary.BigEndian.Uint16(l[:]))
+	if _, err := io.ReadFull(str, buf); err != nil {
+		return nil, err
+	}
+	req := new(dns.Msg)
+	if err := req.Unpack(buf); err != nil {
+		return nil, err
+	}
+	if req.Response || req.Id != 0 {
+		return nil, errors.New("not a DNS over QUIC query")
+	}
+	return req, nil
+}
+
+// streamAddr returns a, the UDP address of a QUIC connection, as a TCP address:
+// the replies on its streams are not truncated, see isTCP.
+func streamAddr(a net.Addr) net.Addr {
+	if u, ok := a.(*net.UDPAddr); ok {
+		return &net.TCPAddr{IP: u.IP, Port: u.Port, Zone: u.Zone}
+	}
+	return a
+}
+
+// doqListen returns the DNS over QUIC listener on Config.DoQAddr. 0-RTT is only
+// accepted with Config.DoQ0RTT.
+func (s *server) doqListen() (*quic.EarlyListener, error) {
+	cert, err := tls.LoadX509KeyPair(s.config.DoQCert, s.config.DoQKey)
+	if err != nil {
+		return nil, err
+	}
+	pc, err := net.ListenPacket("udp", s.config.DoQAddr)
+	if err != nil {
+		return nil, err
+	}
+	tlsConfig := &tls.Config{Certificates: []tls.Certificate{cert}, NextProtos: []string{doqALPN}, MinVersion: tls.VersionTLS13}
+	l, err := quic.ListenEarly(pc, tlsConfig, &quic.Config{MaxIdleTimeout: doqIdleTimeout, Allow0RTT: s.config.DoQ0RTT})
+	if err != nil {
+		pc.Close()
+		return nil, err
+	}
+	return l, nil
+}
+
+// runDoQ starts the DNS over QUIC endpoint on Config.DoQAddr, for the queries
+// to be handled by h.
+func (s *server) runDoQ(h dns.Handler) error {
+	l, err := s.doqListen()
+	if err != nil {
+		return err
+	}
+	d := &doqServer{h: h, timeout: s.config.ReadTimeout, padding: s.config.PaddingBlock}
+	go func() {
+		if err := d.serve(l); err != nil {
+			fatalf("%s", err)
+		}
+	}()
+	logf("ready for queries over QUIC on quic://%s, 0-RTT %t", l.Addr(), s.config.DoQ0RTT)
+	return nil
+}
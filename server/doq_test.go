@@ -0,0 +1,143 @@
+// Copyright (c) 2014 The SkyDNS Authors. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package server
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/binary"
+	"encoding/pem"
+	"errors"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/quic-go/quic-go"
+)
+
+// writeTestCert writes a self-signed certificate for localhost and its key to
+// dir, and returns their files.
+func writeTestCert(t *testing.T, dir string) (cert, key string) {
+	k, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1), Subject: pkix.Name{CommonName: "localhost"},
+		DNSNames: []string{"localhost"}, NotBefore: time.Now(), NotAfter: time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, k.Public(), k)
+	if err != nil {
+		t.Fatal(err)
+	}
+	kb, err := x509.MarshalECPrivateKey(k)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, key = filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	ioutil.WriteFile(cert, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	ioutil.WriteFile(key, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: kb}), 0600)
+	return cert, key
+}
+
+func TestDoQ(t *testing.T) {
+	dir, err := ioutil.TempDir("", "skydns-doq")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	cert, key := writeTestCert(t, dir)
+
+	config := &Config{Domain: "skydns.test.", Nameservers: []string{"127.0.0.1:53"},
+		DoQAddr: "127.0.0.1:0", DoQCert: cert, DoQKey: key}
+	if err := SetDefaults(config); err != nil {
+		t.Fatal(err)
+	}
+	s := New(memBackend{"www.doq.skydns.test.": {Host: "10.0.21.1", Ttl: 60}}, config)
+	l, err := s.doqListen()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	d := &doqServer{h: s, timeout: time.Second}
+	go d.serve(l)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	conn, err := quic.DialAddr(ctx, l.Addr().String(), &tls.Config{InsecureSkipVerify: true, NextProtos: []string{doqALPN}}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.CloseWithError(0, "")
+
+	query := func(m *dns.Msg) (*dns.Msg, error) {
+		str, err := conn.OpenStreamSync(ctx)
+		if err != nil {
+			return nil, err
+		}
+		b, _ := m.Pack()
+		out := make([]byte, 2+len(b))
+		binary.BigEndian.PutUint16(out, uint16(len(b)))
+		copy(out[2:], b)
+		str.Write(out)
+		str.Close()
+		buf, err := ioutil.ReadAll(str)
+		if err != nil {
+			return nil, err
+		}
+		if len(buf) < 2 || int(binary.BigEndian.Uint16(buf)) != len(buf)-2 {
+			return nil, io.ErrUnexpectedEOF
+		}
+		resp := new(dns.Msg)
+		return resp, resp.Unpack(buf[2:])
+	}
+
+	// Two queries, each on a stream of its own.
+	for i := 0; i < 2; i++ {
+		m := new(dns.Msg)
+		m.SetQuestion("www.doq.skydns.test.", dns.TypeA)
+		m.Id = 0
+		resp, err := query(m)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.Id != 0 || len(resp.Answer) != 1 || resp.Answer[0].(*dns.A).A.String() != "10.0.21.1" {
+			t.Errorf("expected the A record of www.doq.skydns.test. with ID 0, got %s", resp)
+		}
+	}
+
+	// A query with a message ID is a protocol error, it closes the connection.
+	m := new(dns.Msg)
+	m.SetQuestion("www.doq.skydns.test.", dns.TypeA)
+	m.Id = 1
+	_, err = query(m)
+	var appErr *quic.ApplicationError
+	if !errors.As(err, &appErr) || appErr.ErrorCode != doqProtocolError {
+		t.Errorf("expected the connection closed with DOQ_PROTOCOL_ERROR, got %v", err)
+	}
+}
+
+func TestDoQConfig(t *testing.T) {
+	for i, config := range []*Config{
+		{DoQAddr: "127.0.0.1:853"},
+		{DoQAddr: "127.0.0.1:853", DoQCert: "cert.pem"},
+		{DoQ0RTT: true},
+	} {
+		config.Domain, config.Nameservers = "skydns.test.", []string{"127.0.0.1:53"}
+		if err := SetDefaults(config); err == nil {
+			t.Errorf("test %d: expected an error", i)
+		}
+	}
+}
@@ -0,0 +1,206 @@
+// Copyright (c) 2014 The SkyDNS Authors. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package server
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+
+	"github.com/miekg/dns"
+)
+
+// ClientSubnet is how the EDNS Client Subnet option (RFC 7871) is used. Queries
+// we forward carry the subnet of the client, the replies to them that only hold
+// for that subnet are cached for it. The ECS option of a query is echoed in our
+// reply, with the scope the answer holds for.
+type ClientSubnet struct {
+	// Trusted, networks (CIDR or single address) of the resolvers whose ECS
+	// option is taken as the client's address: to select views and policy
+	// answers, and to forward. The option of others is ignored and their own
+	// address used. Empty trusts none.
+	Trusted []string `json:"trusted,omitempty"`
+	// SourceV4 and SourceV6, the most bits of a client's address sent when
+	// forwarding. Default to 24 and 56.
+	SourceV4 int `json:"source_v4,omitempty"`
+	SourceV6 int `json:"source_v6,omitempty"`
+
+	// Trusted parsed.
+	trusted []*net.IPNet
+}
+
+// setClientSubnetDefaults checks the client subnet settings in config.
+func setClientSubnetDefaults(config *Config) error {
+	c := config.ClientSubnet
+	if c == nil {
+		return nil
+	}
+	if c.SourceV4 == 0 {
+		c.SourceV4 = 24
+	}
+	if c.SourceV6 == 0 {
+		c.SourceV6 = 56
+	}
+	if c.SourceV4 < 0 || c.SourceV4 > 32 {
+		return fmt.Errorf("client subnet: source_v4 must be between 1 and 32")
+	}
+	if c.SourceV6 < 0 || c.SourceV6 > 128 {
+		return fmt.Errorf("client subnet: source_v6 must be between 1 and 128")
+	}
+	c.trusted = nil
+	for _, a := range c.Trusted {
+		n, err := parseNet(a)
+		if err != nil {
+			return fmt.Errorf("invalid client subnet trusted entry: %s", err)
+		}
+		c.trusted = append(c.trusted, n)
+	}
+	return nil
+}
+
+// querySubnet returns the ECS option of req, or nil.
+func querySubnet(req *dns.Msg) *dns.EDNS0_SUBNET {
+	o := req.IsEdns0()
+	if o == nil {
+		return nil
+	}
+	for _, e := range o.Option {
+		if e, ok := e.(*dns.EDNS0_SUBNET); ok {
+			return e
+		}
+	}
+	return nil
+}
+
+// trustedSubnet returns the ECS option of req when the client on w is trusted
+// with it, and the option does not ask for its address not to be used.
+func (s *server) trustedSubnet(w dns.ResponseWriter, req *dns.Msg) *dns.EDNS0_SUBNET {
+	c := s.config.ClientSubnet
+	if c == nil || !inNets(c.trusted, w.RemoteAddr()) {
+		return nil
+	}
+	if e := querySubnet(req); e != nil && e.SourceNetmask > 0 {
+		return e
+	}
+	return nil
+}
+
+// clientIP returns the address answers are selected for: the one in a trusted
+// ECS option of req, otherwise the address of the client on w.
+func (s *server) clientIP(w dns.ResponseWriter, req *dns.Msg) net.IP {
+	if e := s.trustedSubnet(w, req); e != nil {
+		return e.Address
+	}
+	return remoteIP(w)
+}
+
+// clientSubnet returns the subnet of the client that sent req on w, sent when
+// forwarding req: from a trusted ECS option, otherwise from the client's address,
+// with at most SourceV4 or SourceV6 bits. It returns nil when ECS is not used, or
+// the ECS option of req has a source prefix length of 0, which asks for none.
+func (s *server) clientSubnet(w dns.ResponseWriter, req *dns.Msg) *dns.EDNS0_SUBNET {
+	c := s.config.ClientSubnet
+	if c == nil {
+		return nil
+	}
+	if e := querySubnet(req); e != nil && e.SourceNetmask == 0 {
+		return nil
+	}
+	ip, bits := remoteIP(w), 128
+	if e := s.trustedSubnet(w, req); e != nil {
+		ip, bits = e.Address, int(e.SourceNetmask)
+	}
+	if ip == nil {
+		return nil
+	}
+	sub := &dns.EDNS0_SUBNET{Code: dns.EDNS0SUBNET, Family: 2}
+	if ip4 := ip.To4(); ip4 != nil {
+		ip, sub.Family = ip4, 1
+		if bits > c.SourceV4 {
+			bits = c.SourceV4
+		}
+	} else if bits > c.SourceV6 {
+		bits = c.SourceV6
+	}
+	if bits > len(ip)*8 {
+		bits = len(ip) * 8
+	}
+	sub.SourceNetmask = uint8(bits)
+	sub.Address = ip.Mask(net.CIDRMask(bits, len(ip)*8))
+	return sub
+}
+
+// subnetKey returns sub as the subnet of a cache key, see cache.KeySubnet.
+func subnetKey(sub *dns.EDNS0_SUBNET) string {
+	return sub.Address.String() + "/" + strconv.Itoa(int(sub.SourceNetmask))
+}
+
+// withSubnet returns a copy of req, to forward, with sub as its ECS option.
+func withSubnet(req *dns.Msg, sub *dns.EDNS0_SUBNET) *dns.Msg {
+	r := req.Copy()
+	o := r.IsEdns0()
+	if o == nil {
+		// The client can only take the size of a reply without EDNS0.
+		o = &dns.OPT{Hdr: dns.RR_Header{Name: ".", Rrtype: dns.TypeOPT}}
+		o.SetUDPSize(dns.MinMsgSize)
+		r.Extra = append(r.Extra, o)
+	}
+	opts := o.Option[:0:0]
+	for _, e := range o.Option {
+		if e.Option() != dns.EDNS0SUBNET {
+			opts = append(opts, e)
+		}
+	}
+	o.Option = append(opts, sub)
+	return r
+}
+
+// replyScope returns the scope prefix length of the ECS option in the reply r,
+// 0 when it has none.
+func replyScope(r *dns.Msg) uint8 {
+	if e := querySubnet(r); e != nil {
+		return e.SourceScope
+	}
+	return 0
+}
+
+// setSubnet echoes the ECS option of req, if it has one, in m, our reply with an
+// OPT record (see setEdns). Scope is the scope prefix length of sub, the subnet
+// the reply was made for; it is 0 when the option is not within sub.
+func setSubnet(m, req *dns.Msg, sub *dns.EDNS0_SUBNET, scope uint8) {
+	e := querySubnet(req)
+	o := m.IsEdns0()
+	if e == nil || o == nil {
+		return
+	}
+	echo := *e
+	echo.SourceScope = 0
+	if sub != nil && scope > 0 && e.Family == sub.Family && e.SourceNetmask >= sub.SourceNetmask {
+		bits := 32
+		if e.Family == 2 {
+			bits = 128
+		}
+		if e.Address.Mask(net.CIDRMask(int(sub.SourceNetmask), bits)).Equal(sub.Address) {
+			echo.SourceScope = scope
+		}
+	}
+	o.Option = append(o.Option, &echo)
+}
+
+// unshared returns a client like c that doesn't share a reply between queries
+// for the same question, which differ in their ECS option.
+func unshared(c *dns.Client) *dns.Client {
+	return &dns.Client{Net: c.Net, UDPSize: c.UDPSize, TLSConfig: c.TLSConfig, Dialer: c.Dialer, Timeout: c.Timeout,
+		DialTimeout: c.DialTimeout, ReadTimeout: c.ReadTimeout, WriteTimeout: c.WriteTimeout}
+}
+
+// answerScope returns the scope prefix length of our own answers for the clients
+// in sub: they only differ per subnet with views.
+func (s *server) answerScope(sub *dns.EDNS0_SUBNET) uint8 {
+	if sub == nil || len(s.config.Views) == 0 {
+		return 0
+	}
+	return sub.SourceNetmask
+}
@@ -0,0 +1,91 @@
+// Copyright (c) 2014 The SkyDNS Authors. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package server
+
+import (
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestClientSubnet(t *testing.T) {
+	// The upstream answers with the subnet it got, for that subnet only.
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	received := make(chan *dns.EDNS0_SUBNET, 10)
+	upstream := &dns.Server{PacketConn: pc, Handler: dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+		e := querySubnet(req)
+		received <- e
+		m := new(dns.Msg)
+		m.SetReply(req)
+		a, _ := dns.NewRR(req.Question[0].Name + " 300 IN A 192.0.2.1")
+		m.Answer = []dns.RR{a}
+		if e != nil {
+			m.SetEdns0(dns.MinMsgSize, false)
+			echo := *e
+			echo.SourceScope = e.SourceNetmask
+			m.IsEdns0().Option = []dns.EDNS0{&echo}
+		}
+		w.WriteMsg(m)
+	})}
+	go upstream.ActivateAndServe()
+	defer upstream.Shutdown()
+
+	s := newTestServer(t, true, func(s *server) {
+		s.config.Nameservers = []string{pc.LocalAddr().String()}
+		s.config.ClientSubnet = &ClientSubnet{Trusted: []string{"127.0.0.1"}}
+		if err := setClientSubnetDefaults(s.config); err != nil {
+			t.Fatal(err)
+		}
+	})
+	defer s.Stop()
+
+	query := func(ip string, source uint8) (*dns.Msg, *dns.EDNS0_SUBNET) {
+		m := new(dns.Msg)
+		m.SetQuestion("ecs.example.net.", dns.TypeA)
+		m.SetEdns0(4096, false)
+		m.IsEdns0().Option = []dns.EDNS0{&dns.EDNS0_SUBNET{Code: dns.EDNS0SUBNET, Family: 1, SourceNetmask: source, Address: net.ParseIP(ip)}}
+		w := &testWriter{}
+		s.ServeDNS(w, m)
+		select {
+		case e := <-received:
+			return w.msg, e
+		default:
+			return w.msg, nil
+		}
+	}
+
+	resp, sent := query("10.1.2.3", 32)
+	if sent == nil || sent.SourceNetmask != 24 || !sent.Address.Equal(net.ParseIP("10.1.2.0")) {
+		t.Fatalf("expected 10.1.2.0/24 to be forwarded, got %v", sent)
+	}
+	if e := querySubnet(resp); e == nil || e.SourceNetmask != 32 || e.SourceScope != 24 || !e.Address.Equal(net.ParseIP("10.1.2.3")) {
+		t.Fatalf("expected the client's subnet echoed with scope 24, got %v", e)
+	}
+	if _, sent := query("10.1.2.4", 32); sent != nil {
+		t.Errorf("expected the cached reply for 10.1.2.0/24, got %v forwarded", sent)
+	}
+	if _, sent := query("10.9.9.9", 32); sent == nil || !sent.Address.Equal(net.ParseIP("10.9.9.0")) {
+		t.Errorf("expected 10.9.9.0/24 to be forwarded, got %v", sent)
+	}
+
+	// The subnet of an untrusted client is ignored, its own address is used.
+	s.config.ClientSubnet.trusted = nil
+	resp, sent = query("10.7.7.7", 32)
+	if sent == nil || !sent.Address.Equal(net.ParseIP("127.0.0.0")) {
+		t.Fatalf("expected 127.0.0.0/24 to be forwarded, got %v", sent)
+	}
+	if e := querySubnet(resp); e == nil || e.SourceScope != 0 {
+		t.Errorf("expected the client's subnet echoed with scope 0, got %v", e)
+	}
+
+	// A source prefix length of 0 asks for no address to be sent.
+	if resp, sent := query("0.0.0.0", 0); resp.Rcode != dns.RcodeSuccess || sent == nil || sent.SourceNetmask != 0 {
+		t.Errorf("expected no address to be forwarded, got %v", sent)
+	}
+}
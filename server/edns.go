@@ -0,0 +1,99 @@
+// Copyright (c) 2014 The SkyDNS Authors. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package server
+
+import "github.com/miekg/dns"
+
+// newOPT returns our OPT record: EDNS version 0, our UDP payload size and no
+// options, as we don't support any.
+func (s *server) newOPT(do bool) *dns.OPT {
+	o := &dns.OPT{Hdr: dns.RR_Header{Name: ".", Rrtype: dns.TypeOPT}}
+	o.SetUDPSize(uint16(s.config.EdnsUDPSize))
+	if do {
+		o.SetDo()
+	}
+	return o
+}
+
+// badVersion returns a BADVERS reply if req uses an EDNS version other than 0,
+// see RFC 6891, section 6.1.3. It returns nil otherwise.
+func (s *server) badVersion(req *dns.Msg) *dns.Msg {
+	o := req.IsEdns0()
+	if o == nil || o.Version() == 0 {
+		return nil
+	}
+	m := new(dns.Msg)
+	m.SetReply(req)
+	opt := s.newOPT(o.Do())
+	// BADVERS is 16: the lower 4 bits in the header are 0, the upper 8 go in the
+	// OPT's TTL. Set them by hand, dns.OPT.SetExtendedRcode gets this wrong.
+	opt.Hdr.Ttl |= uint32(dns.RcodeBadVers>>4) << 24
+	m.Extra = []dns.RR{opt}
+	return m
+}
+
+// setEdns makes the OPT record of m, the reply to a query with OPT record o,
+// conform to RFC 6891: m has none when o is nil, otherwise it has ours with the
+// DO bit copied from o. Options, ours or those from a forwarded reply, are never
+// echoed, except Extended DNS Errors with ExtendedErrors (see explain), and with
+// Cookies the cookie of o made by cookieHandler. An extended rcode already in
+// m's OPT record is kept.
+func (s *server) setEdns(m *dns.Msg, o *dns.OPT) {
+	var (
+		rcode uint32
+		ede   []dns.EDNS0
+	)
+	extra := m.Extra[:0]
+	for _, r := range m.Extra {
+		if opt, ok := r.(*dns.OPT); ok {
+			rcode = opt.Hdr.Ttl & 0xFF000000
+			for _, e := range opt.Option {
+				if e.Option() == edeCode && s.config.ExtendedErrors {
+					ede = append(ede, e)
+				}
+			}
+			continue
+		}
+		extra = append(extra, r)
+	}
+	m.Extra = extra
+	if o == nil {
+		return
+	}
+	opt := s.newOPT(o.Do())
+	opt.Hdr.Ttl |= rcode
+	opt.Option = ede
+	if s.config.Cookies != nil {
+		for _, e := range o.Option {
+			if isCookieEcho(e) {
+				opt.Option = append(opt.Option, e)
+			}
+		}
+	}
+	m.Extra = append(m.Extra, opt)
+}
+
+// packPadded packs m, our reply over an encrypted transport, padded with the
+// EDNS0 Padding option (RFC 7830) to a multiple of block bytes, see RFC 8467. A
+// reply without OPT record, to a query without EDNS0, or with a TSIG record is
+// not padded.
+func packPadded(m *dns.Msg, block int) ([]byte, error) {
+	b, err := m.Pack()
+	if err != nil || block <= 0 || m.IsEdns0() == nil || m.IsTsig() != nil {
+		return b, err
+	}
+	n := len(b) + 4 // option code and length
+	if n > dns.MaxMsgSize {
+		return b, nil
+	}
+	p := (block - n%block) % block
+	if n+p > dns.MaxMsgSize {
+		p = dns.MaxMsgSize - n
+	}
+	m = m.Copy()
+	o := m.IsEdns0()
+	o.Option = append(o.Option, &dns.EDNS0_PADDING{Padding: make([]byte, p)})
+	return m.Pack()
+}
@@ -0,0 +1,62 @@
+// Copyright (c) 2014 The SkyDNS Authors. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package server
+
+import (
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestEDNS(t *testing.T) {
+	s := newTestServer(t, false)
+	defer s.Stop()
+
+	c := new(dns.Client)
+
+	// No EDNS in the query, none in the reply.
+	m := new(dns.Msg)
+	m.SetQuestion("skydns.test.", dns.TypeSOA)
+	r, _, err := c.Exchange(m, "127.0.0.1:"+StrPort)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.IsEdns0() != nil {
+		t.Fatalf("expected no OPT RR, got %s", r.IsEdns0())
+	}
+
+	// Unknown options are ignored and not echoed.
+	m.SetEdns0(4096, true)
+	o := m.IsEdns0()
+	o.Option = append(o.Option, &dns.EDNS0_LOCAL{Code: dns.EDNS0LOCALSTART + 1, Data: []byte{1, 2}})
+	r, _, err = c.Exchange(m, "127.0.0.1:"+StrPort)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Rcode != dns.RcodeSuccess || len(r.Answer) != 1 {
+		t.Fatalf("expected an answer, got %s", r)
+	}
+	opt := r.IsEdns0()
+	if opt == nil || opt.Version() != 0 || !opt.Do() || len(opt.Option) != 0 {
+		t.Fatalf("expected a version 0 OPT RR with DO and without options, got %s", opt)
+	}
+
+	// Version 1 gets BADVERS.
+	o.SetVersion(1)
+	r, _, err = c.Exchange(m, "127.0.0.1:"+StrPort)
+	if err != nil {
+		t.Fatal(err)
+	}
+	opt = r.IsEdns0()
+	if opt == nil || opt.Version() != 0 {
+		t.Fatalf("expected a version 0 OPT RR, got %s", opt)
+	}
+	if rcode := int(opt.Hdr.Ttl>>24)<<4 | r.Rcode; rcode != dns.RcodeBadVers {
+		t.Fatalf("expected rcode %d, got %d", dns.RcodeBadVers, rcode)
+	}
+	if len(r.Answer) != 0 {
+		t.Fatalf("expected no answer, got %d records", len(r.Answer))
+	}
+}
@@ -14,6 +14,15 @@ func newExchangeMsg(name string, typ, bufsize uint16, dnssec bool) *dns.Msg {
 	return m
 }
 
+// exchange sends m to the nameserver ns, see exchangeCookie, with the case of the
+// query name randomized when Dns0x20 is set, see exchange0x20.
+func (s *server) exchange(c *dns.Client, m *dns.Msg, ns string) (*dns.Msg, error) {
+	if s.config.Dns0x20 {
+		return s.exchange0x20(c, m, ns)
+	}
+	return s.exchangeCookie(c, m, ns)
+}
+
 // exchangeWithRetry sends message m to server, but retries on ServerFailure.
 func exchangeWithRetry(c *dns.Client, m *dns.Msg, server string) (*dns.Msg, error) {
 	r, _, err := c.Exchange(m, server)
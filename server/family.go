@@ -0,0 +1,143 @@
+// Copyright (c) 2014 The SkyDNS Authors. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package server
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// Address policies, see AddressPolicy.
+const (
+	// PreferIPv6 drops the A records of names that have AAAA records.
+	PreferIPv6 = "prefer-ipv6"
+	// IPv6Only drops all A records.
+	IPv6Only = "ipv6-only"
+)
+
+// AddressPolicy sets the address records served for the names in a zone, for
+// networks moving to, or running on, IPv6 only.
+type AddressPolicy struct {
+	// Zone the policy applies to, defaults to Config.Domain. The policy of the most
+	// specific zone is used.
+	Zone string `json:"zone,omitempty"`
+	// Policy is prefer-ipv6 or ipv6-only.
+	Policy string `json:"policy"`
+}
+
+func setAddressPolicyDefaults(config *Config) error {
+	for i := range config.AddressPolicies {
+		p := &config.AddressPolicies[i]
+		if p.Zone == "" {
+			p.Zone = config.Domain
+		}
+		p.Zone = dns.Fqdn(strings.ToLower(p.Zone))
+		if _, ok := dns.IsDomainName(p.Zone); !ok {
+			return fmt.Errorf("address policy %d: invalid zone: %q", i, p.Zone)
+		}
+		switch p.Policy {
+		case PreferIPv6, IPv6Only:
+		default:
+			return fmt.Errorf("address policy %d: policy must be one of %q or %q", i, PreferIPv6, IPv6Only)
+		}
+	}
+	// Most specific zone first.
+	sort.SliceStable(config.AddressPolicies, func(i, j int) bool {
+		return dns.CountLabel(config.AddressPolicies[i].Zone) > dns.CountLabel(config.AddressPolicies[j].Zone)
+	})
+	return nil
+}
+
+// addressPolicy returns the address policy for name, or the empty string.
+func (c *Config) addressPolicy(name string) string {
+	for _, p := range c.AddressPolicies {
+		if dns.IsSubDomain(p.Zone, name) {
+			return p.Policy
+		}
+	}
+	return ""
+}
+
+// applyAddressPolicies drops the A records from m that the address policies of
+// their owner names leave out. For an A query for name with prefer-ipv6 they are
+// dropped when name has AAAA records.
+func (s *server) applyAddressPolicies(m *dns.Msg, q dns.Question, name string, bufsize uint16, dnssec bool) {
+	if len(s.config.AddressPolicies) == 0 {
+		return
+	}
+	if q.Qtype == dns.TypeA && s.config.addressPolicy(name) == PreferIPv6 && hasType(m.Answer, dns.TypeA) {
+		aaaa := dns.Question{Name: q.Name, Qtype: dns.TypeAAAA, Qclass: q.Qclass}
+		if records, err := s.AddressRecords(aaaa, name, nil, bufsize, dnssec, false); err == nil && hasType(records, dns.TypeAAAA) {
+			m.Answer = withoutType(m.Answer, dns.TypeA)
+		}
+	}
+	m.Answer = s.dropIPv4(m.Answer)
+	m.Extra = s.dropIPv4(m.Extra)
+}
+
+// dropIPv4 drops the A records from rrs whose owner has ipv6-only, or has
+// prefer-ipv6 and AAAA records in rrs.
+func (s *server) dropIPv4(rrs []dns.RR) []dns.RR {
+	ipv6 := make(map[string]bool) // owners with AAAA records
+	for _, r := range rrs {
+		if r.Header().Rrtype == dns.TypeAAAA {
+			ipv6[strings.ToLower(r.Header().Name)] = true
+		}
+	}
+	out := rrs[:0]
+	for _, r := range rrs {
+		if r.Header().Rrtype == dns.TypeA {
+			owner := strings.ToLower(r.Header().Name)
+			switch s.config.addressPolicy(owner) {
+			case IPv6Only:
+				continue
+			case PreferIPv6:
+				if ipv6[owner] {
+					continue
+				}
+			}
+		}
+		out = append(out, r)
+	}
+	return out
+}
+
+func hasType(rrs []dns.RR, t uint16) bool {
+	for _, r := range rrs {
+		if r.Header().Rrtype == t {
+			return true
+		}
+	}
+	return false
+}
+
+func withoutType(rrs []dns.RR, t uint16) []dns.RR {
+	out := rrs[:0]
+	for _, r := range rrs {
+		if r.Header().Rrtype != t {
+			out = append(out, r)
+		}
+	}
+	return out
+}
+
+// Loopback returns the loopback address SkyDNS listens on and finds etcd on by
+// default: 127.0.0.1, or ::1 on a host without IPv4.
+func Loopback() string {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return "127.0.0.1"
+	}
+	for _, a := range addrs {
+		if n, ok := a.(*net.IPNet); ok && n.IP.To4() != nil {
+			return "127.0.0.1"
+		}
+	}
+	return "::1"
+}
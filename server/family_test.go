@@ -0,0 +1,91 @@
+// Copyright (c) 2014 The SkyDNS Authors. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package server
+
+import (
+	"testing"
+
+	"github.com/skynetservices/skydns/msg"
+
+	"github.com/miekg/dns"
+)
+
+func TestAddressPolicies(t *testing.T) {
+	s := newTestServer(t, false, func(s *server) {
+		s.config.AddressPolicies = []AddressPolicy{
+			{Zone: "family.skydns.test", Policy: PreferIPv6},
+			{Zone: "only.family.skydns.test.", Policy: IPv6Only},
+		}
+		if err := setAddressPolicyDefaults(s.config); err != nil {
+			t.Fatal(err)
+		}
+	})
+	defer s.Stop()
+
+	for _, serv := range []*msg.Service{
+		{Key: "a.both.family.skydns.test.", Host: "10.0.3.1"},
+		{Key: "b.both.family.skydns.test.", Host: "2001::9:1"},
+		{Key: "a.v4.family.skydns.test.", Host: "10.0.3.2"},
+		{Key: "a.v4.only.family.skydns.test.", Host: "10.0.3.3"},
+		{Key: "a.both.dual.skydns.test.", Host: "10.0.3.4"},
+		{Key: "b.both.dual.skydns.test.", Host: "2001::9:4"},
+	} {
+		addService(t, s, serv.Key, 0, serv)
+		defer delService(t, s, serv.Key)
+	}
+
+	tests := []struct {
+		name  string
+		qtype uint16
+		rrs   []string
+	}{
+		{"both.family.skydns.test.", dns.TypeA, nil},
+		{"both.family.skydns.test.", dns.TypeAAAA, []string{"both.family.skydns.test.\t3600\tIN\tAAAA\t2001::9:1"}},
+		{"v4.family.skydns.test.", dns.TypeA, []string{"v4.family.skydns.test.\t3600\tIN\tA\t10.0.3.2"}},
+		{"v4.only.family.skydns.test.", dns.TypeA, nil},
+		{"both.dual.skydns.test.", dns.TypeA, []string{"both.dual.skydns.test.\t3600\tIN\tA\t10.0.3.4"}},
+	}
+	for i, tc := range tests {
+		m := new(dns.Msg)
+		m.SetQuestion(tc.name, tc.qtype)
+		w := &testWriter{}
+		s.ServeDNS(w, m)
+		if w.msg.Rcode != dns.RcodeSuccess {
+			t.Errorf("test %d: expected NOERROR, got %s", i, dns.RcodeToString[w.msg.Rcode])
+			continue
+		}
+		if len(w.msg.Answer) != len(tc.rrs) {
+			t.Errorf("test %d: expected %d answers, got %s", i, len(tc.rrs), w.msg)
+			continue
+		}
+		for j, r := range w.msg.Answer {
+			if r.String() != tc.rrs[j] {
+				t.Errorf("test %d: expected %s, got %s", i, tc.rrs[j], r)
+			}
+		}
+	}
+}
+
+func TestAddressPolicyConfig(t *testing.T) {
+	tests := []struct {
+		policy AddressPolicy
+		ok     bool
+	}{
+		{AddressPolicy{Policy: PreferIPv6}, true},
+		{AddressPolicy{Zone: "v6.skydns.test", Policy: IPv6Only}, true},
+		{AddressPolicy{Policy: "ipv4-only"}, false},
+		{AddressPolicy{Zone: "a..b", Policy: IPv6Only}, false},
+	}
+	for i, tc := range tests {
+		config := &Config{Domain: "skydns.test.", Nameservers: []string{"127.0.0.1:53"}, AddressPolicies: []AddressPolicy{tc.policy}}
+		if err := SetDefaults(config); tc.ok != (err == nil) {
+			t.Errorf("test %d: expected ok %t, got error %v", i, tc.ok, err)
+			continue
+		}
+		if tc.ok && config.addressPolicy("www.skydns.test.") == "" && tc.policy.Zone == "" {
+			t.Errorf("test %d: expected the policy to apply to the domain", i)
+		}
+	}
+}
@@ -0,0 +1,48 @@
+// Copyright (c) 2014 The SkyDNS Authors. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package server
+
+import (
+	"fmt"
+	"time"
+)
+
+// Faults configures the faults injected to test how SkyDNS copes with a slow or
+// failing backend and lossy networks. It is only honored by builds with the
+// faults build tag (go build -tags faults), other builds refuse to start with it.
+type Faults struct {
+	// BackendLatency is added to every backend lookup.
+	BackendLatency time.Duration `json:"backend_latency,omitempty"`
+	// BackendErrors, the fraction (0 to 1) of backend lookups that fail.
+	BackendErrors float64 `json:"backend_errors,omitempty"`
+	// WatchDrops, the fraction of events on the stub zone watch that are dropped,
+	// as if the watch broke.
+	WatchDrops float64 `json:"watch_drops,omitempty"`
+	// PacketLoss, the fraction of queries dropped without a reply.
+	PacketLoss float64 `json:"packet_loss,omitempty"`
+}
+
+// setFaultsDefaults checks the faults in config.
+func setFaultsDefaults(config *Config) error {
+	f := config.Faults
+	if f == nil {
+		return nil
+	}
+	if !faultsEnabled {
+		return fmt.Errorf("faults are only injected by a build with the faults build tag")
+	}
+	for _, p := range []float64{f.BackendErrors, f.WatchDrops, f.PacketLoss} {
+		if p < 0 || p > 1 {
+			return fmt.Errorf("faults must be fractions between 0 and 1: %v", p)
+		}
+	}
+	if f.BackendLatency < 0 {
+		return fmt.Errorf("faults: negative backend_latency: %s", f.BackendLatency)
+	}
+	return nil
+}
+
+// errFault is returned by backend lookups that fail by design.
+var errFault = fmt.Errorf("injected backend fault")
@@ -0,0 +1,19 @@
+// Copyright (c) 2014 The SkyDNS Authors. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+//go:build !faults
+// +build !faults
+
+package server
+
+import "github.com/miekg/dns"
+
+// faultsEnabled is true in builds that inject faults, see Faults.
+const faultsEnabled = false
+
+func faultBackend(b Backend, f *Faults) Backend         { return b }
+func faultHandler(h dns.Handler, f *Faults) dns.Handler { return h }
+
+// DropWatch returns true if an event on a watch should be dropped, see Faults.
+func (s *server) DropWatch() bool { return false }
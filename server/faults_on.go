@@ -0,0 +1,133 @@
+// Copyright (c) 2014 The SkyDNS Authors. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+//go:build faults
+// +build faults
+
+package server
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"time"
+
+	"github.com/skynetservices/skydns/msg"
+
+	"github.com/miekg/dns"
+)
+
+// faultsEnabled is true in builds that inject faults, see Faults.
+const faultsEnabled = true
+
+// faultBackend returns b with the faults of f injected in its lookups.
+func faultBackend(b Backend, f *Faults) Backend {
+	if f == nil || (f.BackendLatency == 0 && f.BackendErrors == 0) {
+		return b
+	}
+	return faultyBackend{b, f}
+}
+
+// faultHandler returns h dropping the fraction of queries f.PacketLoss.
+func faultHandler(h dns.Handler, f *Faults) dns.Handler {
+	if f == nil || f.PacketLoss == 0 {
+		return h
+	}
+	return dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+		if rand.Float64() < f.PacketLoss {
+			return
+		}
+		h.ServeDNS(w, req)
+	})
+}
+
+// DropWatch returns true if an event on a watch should be dropped, see Faults.
+func (s *server) DropWatch() bool {
+	f := s.config.Faults
+	return f != nil && rand.Float64() < f.WatchDrops
+}
+
+type faultyBackend struct {
+	Backend
+	f *Faults
+}
+
+func (b faultyBackend) fault() error {
+	time.Sleep(b.f.BackendLatency)
+	if rand.Float64() < b.f.BackendErrors {
+		return errFault
+	}
+	return nil
+}
+
+func (b faultyBackend) Records(name string, exact bool) ([]msg.Service, error) {
+	if err := b.fault(); err != nil {
+		return nil, err
+	}
+	return b.Backend.Records(name, exact)
+}
+
+func (b faultyBackend) ReverseRecord(name string) (*msg.Service, error) {
+	if err := b.fault(); err != nil {
+		return nil, err
+	}
+	return b.Backend.ReverseRecord(name)
+}
+
+// Revision passes Revisioner through, see server.serial.
+func (b faultyBackend) Revision(name string) (msg.Revision, error) {
+	r, ok := b.Backend.(Revisioner)
+	if !ok {
+		return msg.Revision{}, fmt.Errorf("backend has no revisions")
+	}
+	if err := b.fault(); err != nil {
+		return msg.Revision{}, err
+	}
+	return r.Revision(name)
+}
+
+// Quorum passes Quorumer through, a fault is a lost quorum.
+func (b faultyBackend) Quorum(ctx context.Context) error {
+	q, ok := b.Backend.(Quorumer)
+	if !ok {
+		return nil
+	}
+	if err := b.fault(); err != nil {
+		return err
+	}
+	return q.Quorum(ctx)
+}
+
+// Watch passes Watcher through.
+func (b faultyBackend) Watch(ctx context.Context, f func(msg.Change)) error {
+	w, ok := b.Backend.(Watcher)
+	if !ok {
+		return fmt.Errorf("backend can't watch")
+	}
+	return w.Watch(ctx, f)
+}
+
+// Put passes Writer through, a fault fails the write.
+func (b faultyBackend) Put(name, id string, serv *msg.Service) error {
+	w, ok := b.Backend.(Writer)
+	if !ok {
+		return fmt.Errorf("backend can't store services")
+	}
+	if err := b.fault(); err != nil {
+		return err
+	}
+	return w.Put(name, id, serv)
+}
+
+// Delete passes Writer through, a fault fails the write.
+func (b faultyBackend) Delete(key string) error {
+	w, ok := b.Backend.(Writer)
+	if !ok {
+		return fmt.Errorf("backend can't store services")
+	}
+	if err := b.fault(); err != nil {
+		return err
+	}
+	return w.Delete(key)
+}
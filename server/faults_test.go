@@ -0,0 +1,41 @@
+// Copyright (c) 2014 The SkyDNS Authors. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package server
+
+import (
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestFaults(t *testing.T) {
+	config := &Config{Domain: "skydns.test.", Nameservers: []string{"127.0.0.1:53"}, Faults: &Faults{PacketLoss: 1, BackendErrors: 1}}
+	if err := SetDefaults(config); faultsEnabled != (err == nil) {
+		t.Fatalf("expected faults to be accepted only with the faults build tag, got error %v", err)
+	}
+	if err := SetDefaults(&Config{Nameservers: []string{"127.0.0.1:53"}, Faults: &Faults{PacketLoss: 2}}); err == nil {
+		t.Fatal("expected an error for a packet loss over 1")
+	}
+	if !faultsEnabled {
+		return
+	}
+
+	s := newTestServer(t, false, func(s *server) {
+		s.config.Faults = config.Faults
+	})
+	defer s.Stop()
+
+	m := new(dns.Msg)
+	m.SetQuestion("100.server1.development.region1.skydns.test.", dns.TypeA)
+	w := &testWriter{}
+	faultHandler(s, s.config.Faults).ServeDNS(w, m)
+	if w.msg != nil {
+		t.Fatalf("expected the query to be dropped, got %s", w.msg)
+	}
+
+	if _, err := faultBackend(s.backend, s.config.Faults).Records("skydns.test.", false); err != errFault {
+		t.Fatalf("expected %q, got %v", errFault, err)
+	}
+}
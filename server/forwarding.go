@@ -6,16 +6,32 @@ package server
 
 import (
 	"fmt"
+	"net"
+	"time"
+
+	"github.com/skynetservices/skydns/metrics"
 
 	"github.com/miekg/dns"
 )
 
 // ServeDNSForward forwards a request to a nameservers and returns the response.
+// When we don't provide recursion to this client, the request is refused.
 func (s *server) ServeDNSForward(w dns.ResponseWriter, req *dns.Msg) *dns.Msg {
-	if s.config.NoRec {
-		m := s.ServerFailure(req)
+	m, _ := s.forward(w, req, s.clientSubnet(w, req))
+	return m
+}
+
+// forward is ServeDNSForward, sending sub as the client subnet when it is not nil.
+// It also returns the scope prefix length of the client subnet of the reply.
+func (s *server) forward(w dns.ResponseWriter, req *dns.Msg, sub *dns.EDNS0_SUBNET) (*dns.Msg, uint8) {
+	if !s.recursionAllowed(w, req) {
+		m := new(dns.Msg)
+		m.SetRcode(req, dns.RcodeRefused)
+		m.RecursionAvailable = false
+		s.explain(m, req, reasonRecursion)
+		s.setEdns(m, req.IsEdns0())
 		w.WriteMsg(m)
-		return m
+		return m, 0
 	}
 
 	if len(s.config.Nameservers) == 0 || dns.CountLabel(req.Question[0].Name) < s.config.Ndots {
@@ -28,28 +44,61 @@ func (s *server) ServeDNSForward(w dns.ResponseWriter, req *dns.Msg) *dns.Msg {
 		}
 		m := s.ServerFailure(req)
 		m.RecursionAvailable = true // this is still true
+		if len(s.config.Nameservers) == 0 {
+			s.explain(m, req, reasonNoNameservers)
+		} else {
+			s.explain(m, req, reasonNameTooShort)
+		}
+		s.setEdns(m, req.IsEdns0())
 		w.WriteMsg(m)
-		return m
+		return m, 0
+	}
+
+	option := req.IsEdns0()
+	if looped(req) {
+		return s.loopFailure(w, req, option, metrics.Rec), 0
 	}
+	markLoop(req)
 
 	var (
 		r   *dns.Msg
 		err error
 	)
+	fwd, udp, tcp := req, s.dnsUDPclient, s.dnsTCPclient
+	if sub != nil {
+		fwd = withSubnet(req, sub)
+		udp, tcp = unshared(udp), unshared(tcp)
+	}
+
+	c := udp
+	if isTCP(w) {
+		c = tcp
+	}
 
 	nsid := s.randomNameserverID(req.Id)
 	try := 0
 Redo:
-	if isTCP(w) {
-		r, err = exchangeWithRetry(s.dnsTCPclient, req, s.config.Nameservers[nsid])
-	} else {
-		r, err = exchangeWithRetry(s.dnsUDPclient, req, s.config.Nameservers[nsid])
+	ns := s.config.Nameservers[nsid]
+	next := s.config.Nameservers[(nsid+1)%len(s.config.Nameservers)]
+	switch {
+	case s.config.isSelf(ns):
+		err = errLoop
+	case s.config.RaceDelay > 0 && try+1 < len(s.config.Nameservers) && !s.config.isSelf(next):
+		// A shared client would join the query to next with the one to ns.
+		r, err = s.race(unshared(c), fwd, ns, next)
+		try++
+		nsid = (nsid + 1) % len(s.config.Nameservers)
+	default:
+		r, err = s.exchange(c, fwd, ns)
 	}
 	if err == nil {
+		scope := replyScope(r)
 		r.Compress = true
 		r.Id = req.Id
+		s.setEdns(r, option)
+		setSubnet(r, req, sub, scope)
 		w.WriteMsg(r)
-		return r
+		return r, scope
 	}
 	// Seen an error, this can only mean, "server not reached", try again
 	// but only if we have not exausted our nameservers.
@@ -59,11 +108,101 @@ Redo:
 		goto Redo
 	}
 
+	if err == errLoop {
+		return s.loopFailure(w, req, option, metrics.Rec), 0
+	}
 	logf("failure to forward request %q", err)
 	m := s.ServerFailure(req)
+	s.explain(m, req, reasonForwardFailed)
+	s.setEdns(m, option)
+	w.WriteMsg(m)
+	return m, 0
+}
+
+// race sends m to the nameserver ns and, when it has not answered after
+// Config.RaceDelay or failed, to the nameserver next too. The first reply that is
+// not SERVFAIL or REFUSED is returned and the other one is dropped. When both
+// fail, the last reply or error is returned.
+func (s *server) race(c *dns.Client, m *dns.Msg, ns, next string) (*dns.Msg, error) {
+	type reply struct {
+		r   *dns.Msg
+		err error
+	}
+	replies := make(chan reply, 2)
+	query := func(m *dns.Msg, ns string) {
+		r, err := s.exchange(c, m, ns)
+		replies <- reply{r, err}
+	}
+	// Packing m writes to it, copy it before it is sent.
+	m1 := m.Copy()
+	go query(m, ns)
+	stagger := time.NewTimer(time.Duration(s.config.RaceDelay) * time.Millisecond)
+	defer stagger.Stop()
+
+	raced, pending := false, 1
+	var last reply
+	for pending > 0 {
+		select {
+		case <-stagger.C:
+		case last = <-replies:
+			pending--
+			if last.err == nil && last.r.Rcode != dns.RcodeServerFailure && last.r.Rcode != dns.RcodeRefused {
+				return last.r, nil
+			}
+		}
+		if !raced {
+			raced = true
+			pending++
+			go query(m1, next)
+		}
+	}
+	return last.r, last.err
+}
+
+// loopFailure answers req, which we must not forward because it would loop back
+// to us, with SERVFAIL. Option is the OPT record req was received with.
+func (s *server) loopFailure(w dns.ResponseWriter, req *dns.Msg, option *dns.OPT, sys metrics.System) *dns.Msg {
+	logf("not forwarding request for %q, it would loop", req.Question[0].Name)
+	metrics.ReportLoopCount(sys)
+	m := s.ServerFailure(req)
+	m.RecursionAvailable = true
+	s.explain(m, req, reasonLoop)
+	s.setEdns(m, option)
+	w.WriteMsg(m)
 	return m
 }
 
+// recursionAllowed returns true if req, received on w, may be forwarded: recursion
+// is enabled, desired by the client and the client is in the recursion ACL.
+func (s *server) recursionAllowed(w dns.ResponseWriter, req *dns.Msg) bool {
+	if s.config.NoRec || !req.RecursionDesired {
+		return false
+	}
+	return len(s.config.recursionNets) == 0 || inNets(s.config.recursionNets, w.RemoteAddr())
+}
+
+// inNets returns true if the address of a is in one of nets.
+func inNets(nets []*net.IPNet, a net.Addr) bool {
+	var ip net.IP
+	switch a := a.(type) {
+	case *net.UDPAddr:
+		ip = a.IP
+	case *net.TCPAddr:
+		ip = a.IP
+	}
+	return containsIP(nets, ip)
+}
+
+// containsIP returns true if ip is in one of nets.
+func containsIP(nets []*net.IPNet, ip net.IP) bool {
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
 // ServeDNSReverse is the handler for DNS requests for the reverse zone. If nothing is found
 // locally the request is forwarded to the forwarder for resolution.
 func (s *server) ServeDNSReverse(w dns.ResponseWriter, req *dns.Msg) *dns.Msg {
@@ -76,6 +215,7 @@ func (s *server) ServeDNSReverse(w dns.ResponseWriter, req *dns.Msg) *dns.Msg {
 	if m.Answer, err = s.PTRRecords(req.Question[0]); err == nil {
 		// TODO(miek): Reverse DNSSEC. We should sign this, but requires a key....and more
 		// Probably not worth the hassle?
+		s.setEdns(m, req.IsEdns0())
 		if err := w.WriteMsg(m); err != nil {
 			logf("failure to return reply %q", err)
 		}
@@ -95,11 +235,21 @@ func (s *server) Lookup(n string, t, bufsize uint16, dnssec bool) (*dns.Msg, err
 		return nil, fmt.Errorf("name has fewer than %d labels", s.config.Ndots)
 	}
 	m := newExchangeMsg(n, t, bufsize, dnssec)
+	markLoop(m)
+
+	var (
+		r   *dns.Msg
+		err error
+	)
 
 	nsid := s.randomNameserverID(m.Id)
 	try := 0
 Redo:
-	r, err := exchangeWithRetry(s.dnsUDPclient, m, s.config.Nameservers[nsid])
+	if ns := s.config.Nameservers[nsid]; s.config.isSelf(ns) {
+		err = errLoop
+	} else {
+		r, err = exchangeWithRetry(s.dnsUDPclient, m, ns)
+	}
 	if err == nil {
 		if r.Rcode != dns.RcodeSuccess {
 			return nil, fmt.Errorf("rcode %d is not equal to success", r.Rcode)
@@ -121,5 +271,9 @@ Redo:
 		nsid = (nsid + 1) % len(s.config.Nameservers)
 		goto Redo
 	}
+	if err == errLoop {
+		metrics.ReportLoopCount(metrics.Rec)
+		return nil, fmt.Errorf("failure to lookup name: %s", err)
+	}
 	return nil, fmt.Errorf("failure to lookup name")
 }
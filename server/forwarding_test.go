@@ -0,0 +1,131 @@
+// Copyright (c) 2014 The SkyDNS Authors. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package server
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// upstream starts a nameserver that answers with an A record of addr after delay,
+// or with rcode when it is not zero.
+func upstream(t *testing.T, addr string, rcode int, delay time.Duration) (string, func()) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &dns.Server{PacketConn: pc, Handler: dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+		time.Sleep(delay)
+		m := new(dns.Msg)
+		m.SetRcode(req, rcode)
+		if rcode == dns.RcodeSuccess {
+			a, _ := dns.NewRR(req.Question[0].Name + " 300 IN A " + addr)
+			m.Answer = []dns.RR{a}
+		}
+		w.WriteMsg(m)
+	})}
+	go srv.ActivateAndServe()
+	return pc.LocalAddr().String(), func() { srv.Shutdown() }
+}
+
+func TestForwardRace(t *testing.T) {
+	slow, stop := upstream(t, "192.0.2.1", dns.RcodeSuccess, time.Second)
+	defer stop()
+	fast, stop := upstream(t, "192.0.2.2", dns.RcodeSuccess, 0)
+	defer stop()
+	failing, stop := upstream(t, "", dns.RcodeServerFailure, 0)
+	defer stop()
+
+	tests := []struct {
+		nameservers []string
+		addr        string
+	}{
+		{[]string{slow, fast}, "192.0.2.2"},
+		{[]string{failing, fast}, "192.0.2.2"},
+		{[]string{fast, slow}, "192.0.2.2"},
+		{[]string{failing, slow}, "192.0.2.1"},
+	}
+	for i, tc := range tests {
+		s := newTestServer(t, false, func(s *server) {
+			s.config.NSRotate = false
+			s.config.RaceDelay = 20
+			s.config.Nameservers = tc.nameservers
+		})
+		m := new(dns.Msg)
+		m.SetQuestion("race.example.net.", dns.TypeA)
+		w := &testWriter{}
+		start := time.Now()
+		s.ServeDNSForward(w, m)
+		s.Stop()
+		if len(w.msg.Answer) != 1 || w.msg.Answer[0].(*dns.A).A.String() != tc.addr {
+			t.Errorf("test %d: expected an answer with %s, got %s", i, tc.addr, w.msg)
+		}
+		if tc.addr == "192.0.2.2" && time.Since(start) > 500*time.Millisecond {
+			t.Errorf("test %d: expected the fast nameserver to win, took %s", i, time.Since(start))
+		}
+	}
+}
+
+func TestForward0x20(t *testing.T) {
+	// lower answers with the query name in lower case, like a spoofer that
+	// doesn't know the case would.
+	nameserver := func(lower bool) (string, chan string, func()) {
+		pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		names := make(chan string, 4)
+		srv := &dns.Server{PacketConn: pc, Handler: dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+			names <- req.Question[0].Name
+			m := new(dns.Msg)
+			m.SetReply(req)
+			if lower {
+				m.Question[0].Name = strings.ToLower(m.Question[0].Name)
+			}
+			a, _ := dns.NewRR(m.Question[0].Name + " 300 IN A 192.0.2.20")
+			m.Answer = []dns.RR{a}
+			w.WriteMsg(m)
+		})}
+		go srv.ActivateAndServe()
+		return pc.LocalAddr().String(), names, func() { srv.Shutdown() }
+	}
+	echo, names, stop := nameserver(false)
+	defer stop()
+	lower, _, stop := nameserver(true)
+	defer stop()
+
+	// forward returns the reply to m forwarded by a server to ns.
+	forward := func(ns string, m *dns.Msg) *testWriter {
+		s := newTestServer(t, false, func(s *server) {
+			s.config.Dns0x20 = true
+			s.config.NSRotate = false
+			s.config.Nameservers = []string{ns}
+		})
+		defer s.Stop()
+		w := &testWriter{}
+		s.ServeDNSForward(w, m)
+		return w
+	}
+	const name = "case.randomization.example.net."
+
+	m := new(dns.Msg)
+	m.SetQuestion(name, dns.TypeA)
+	w := forward(echo, m)
+	if sent := <-names; sent == name || !strings.EqualFold(sent, name) {
+		t.Errorf("expected %s in random case, got %s", name, sent)
+	}
+	if len(w.msg.Answer) != 1 || w.msg.Question[0].Name != name || w.msg.Answer[0].Header().Name != name {
+		t.Errorf("expected an answer for %s, got %s", name, w.msg)
+	}
+
+	w = forward(lower, m)
+	if w.msg.Rcode != dns.RcodeServerFailure {
+		t.Errorf("expected SERVFAIL for replies with another case, got %s", w.msg)
+	}
+}
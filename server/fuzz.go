@@ -0,0 +1,59 @@
+// Copyright (c) 2014 The SkyDNS Authors. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+//go:build gofuzz
+// +build gofuzz
+
+package server
+
+import (
+	"net"
+
+	"github.com/skynetservices/skydns/msg"
+
+	"github.com/miekg/dns"
+)
+
+// Fuzz is the entry point for go-fuzz, it feeds data to the query handling path
+// of a strict server. The corpus is in testdata/fuzz/corpus:
+//
+//	go-fuzz-build github.com/skynetservices/skydns/server
+//	go-fuzz -bin=server-fuzz.zip -workdir=server/testdata/fuzz
+func Fuzz(data []byte) int {
+	if !fuzzServer.strict.check(data, fuzzAddr, func([]byte) {}) {
+		return 0
+	}
+	req := new(dns.Msg)
+	if err := req.Unpack(data); err != nil {
+		// The check does not look into rdata, the dns package replies FORMERR.
+		return 0
+	}
+	fuzzHandler.ServeDNS(fuzzWriter{}, req)
+	return 1
+}
+
+var (
+	fuzzAddr    = &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 53}
+	fuzzServer  = newFuzzServer()
+	fuzzHandler = dns.Handler(fuzzServer)
+)
+
+func newFuzzServer() *server {
+	config := &Config{Domain: "skydns.test.", NoRec: true, Nameservers: []string{"127.0.0.1:53"}, Strict: true}
+	if err := SetDefaults(config); err != nil {
+		panic(err)
+	}
+	return New(fuzzBackend{}, config)
+}
+
+type fuzzBackend struct{}
+
+func (fuzzBackend) HasSynced() bool                             { return true }
+func (fuzzBackend) Records(string, bool) ([]msg.Service, error) { return nil, nil }
+func (fuzzBackend) ReverseRecord(string) (*msg.Service, error)  { return nil, nil }
+
+type fuzzWriter struct{ dns.ResponseWriter }
+
+func (fuzzWriter) WriteMsg(m *dns.Msg) error { _, err := m.Pack(); return err }
+func (fuzzWriter) RemoteAddr() net.Addr      { return fuzzAddr }
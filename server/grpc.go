@@ -0,0 +1,106 @@
+// Copyright (c) 2014 The SkyDNS Authors. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net"
+
+	"github.com/skynetservices/skydns/pb"
+
+	"github.com/miekg/dns"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+// grpcServer implements the DnsService of CoreDNS: the packed queries are handed
+// to h, like the ones over TCP, and the packed replies sent back.
+type grpcServer struct {
+	h       dns.Handler
+	local   net.Addr
+	padding int // see Config.PaddingBlock
+}
+
+func (g *grpcServer) Query(ctx context.Context, in *pb.DnsPacket) (*pb.DnsPacket, error) {
+	req := new(dns.Msg)
+	if err := req.Unpack(in.Msg); err != nil || req.Response {
+		return nil, status.Error(codes.InvalidArgument, "not a DNS query")
+	}
+	remote := &net.TCPAddr{}
+	if p, ok := peer.FromContext(ctx); ok {
+		if a, ok := p.Addr.(*net.TCPAddr); ok {
+			remote = a
+		}
+	}
+	w := &msgWriter{local: g.local, remote: remote}
+	g.h.ServeDNS(w, req)
+	if w.msg == nil {
+		// Shed by the worker pool, or dropped for another reason.
+		return nil, status.Error(codes.Unavailable, "no reply")
+	}
+	b, err := packPadded(w.msg, g.padding)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failure to pack the reply: %s", err)
+	}
+	return &pb.DnsPacket{Msg: b}, nil
+}
+
+// grpcCreds returns the TLS credentials of the gRPC endpoint. With a CA clients
+// must present a certificate signed by it.
+func grpcCreds(config *Config) (credentials.TransportCredentials, error) {
+	cert, err := tls.LoadX509KeyPair(config.GRPCCert, config.GRPCKey)
+	if err != nil {
+		return nil, err
+	}
+	c := &tls.Config{Certificates: []tls.Certificate{cert}}
+	if config.GRPCCA != "" {
+		pem, err := ioutil.ReadFile(config.GRPCCA)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates in %s", config.GRPCCA)
+		}
+		c.ClientCAs = pool
+		c.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return credentials.NewTLS(c), nil
+}
+
+// runGRPC starts the gRPC endpoint on Config.GRPCAddr, for the queries to be
+// handled by h.
+func (s *server) runGRPC(h dns.Handler) error {
+	var opts []grpc.ServerOption
+	scheme := "grpc"
+	if s.config.GRPCCert != "" {
+		creds, err := grpcCreds(s.config)
+		if err != nil {
+			return err
+		}
+		opts = append(opts, grpc.Creds(creds))
+		scheme = "grpcs"
+	}
+	l, err := net.Listen("tcp", s.config.GRPCAddr)
+	if err != nil {
+		return err
+	}
+	g := grpc.NewServer(opts...)
+	pb.RegisterDnsServiceServer(g, &grpcServer{h: h, local: l.Addr(), padding: s.config.PaddingBlock})
+	go func() {
+		if err := g.Serve(s.proxyListener(ProxyGRPC, l)); err != nil {
+			fatalf("%s", err)
+		}
+	}()
+	logf("ready for queries over gRPC on %s://%s", scheme, l.Addr())
+	return nil
+}
@@ -0,0 +1,67 @@
+// Copyright (c) 2014 The SkyDNS Authors. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package server
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/skynetservices/skydns/msg"
+	"github.com/skynetservices/skydns/pb"
+
+	"github.com/miekg/dns"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestGRPC(t *testing.T) {
+	s := newTestServer(t, false)
+	defer s.Stop()
+
+	serv := &msg.Service{Host: "10.0.19.1", Key: "www.grpc.skydns.test."}
+	addService(t, s, serv.Key, 0, serv)
+	defer delService(t, s, serv.Key)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	g := grpc.NewServer()
+	pb.RegisterDnsServiceServer(g, &grpcServer{h: s, local: l.Addr()})
+	go g.Serve(l)
+	defer g.Stop()
+
+	cc, err := grpc.Dial(l.Addr().String(), grpc.WithInsecure())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cc.Close()
+	client := pb.NewDnsServiceClient(cc)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	m := new(dns.Msg)
+	m.SetQuestion("www.grpc.skydns.test.", dns.TypeA)
+	buf, _ := m.Pack()
+	reply, err := client.Query(ctx, &pb.DnsPacket{Msg: buf})
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp := new(dns.Msg)
+	if err := resp.Unpack(reply.Msg); err != nil {
+		t.Fatal(err)
+	}
+	if resp.Id != m.Id || len(resp.Answer) != 1 || resp.Answer[0].(*dns.A).A.String() != "10.0.19.1" {
+		t.Errorf("expected the A record of www.grpc.skydns.test., got %s", resp)
+	}
+
+	_, err = client.Query(ctx, &pb.DnsPacket{Msg: []byte{1, 2, 3}})
+	if st, _ := status.FromError(err); st.Code() != codes.InvalidArgument {
+		t.Errorf("expected %s for a bad query, got %v", codes.InvalidArgument, err)
+	}
+}
@@ -0,0 +1,199 @@
+// Copyright (c) 2014 The SkyDNS Authors. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package server
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/skynetservices/skydns/metrics"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	// hostsReload is how often the hosts file is checked for changes.
+	hostsReload = 5 * time.Second
+	// hostsTtl is the TTL of the records from the hosts file, it is short so
+	// overrides take effect quickly in the caches of clients too.
+	hostsTtl = 30
+)
+
+// hosts holds the overrides from Config.HostsFile.
+type hosts struct {
+	file string
+
+	sync.RWMutex
+	names map[string][]net.IP // lowercased names
+	mtime time.Time
+	size  int64
+}
+
+func newHosts(file string) *hosts {
+	return &hosts{file: file}
+}
+
+// load reads the hosts file if it changed since it was last read. A missing file
+// has no overrides. It returns the number of names in it and true when it was
+// read.
+func (h *hosts) load() (int, bool, error) {
+	var (
+		names map[string][]net.IP
+		mtime time.Time
+		size  int64
+	)
+	fi, err := os.Stat(h.file)
+	switch {
+	case os.IsNotExist(err):
+	case err != nil:
+		return 0, false, err
+	default:
+		mtime, size = fi.ModTime(), fi.Size()
+	}
+
+	h.RLock()
+	same := h.mtime.Equal(mtime) && h.size == size
+	h.RUnlock()
+	if same {
+		return 0, false, nil
+	}
+
+	if !mtime.IsZero() {
+		f, err := os.Open(h.file)
+		if err != nil {
+			return 0, false, err
+		}
+		names, err = parseHosts(f)
+		f.Close()
+		if err != nil {
+			return 0, false, err
+		}
+	}
+
+	h.Lock()
+	h.names, h.mtime, h.size = names, mtime, size
+	h.Unlock()
+	return len(names), true, nil
+}
+
+// parseHosts parses a file in hosts(5) format: an address followed by the names
+// it is for on every line, comments start with #. Lines that don't parse are
+// skipped.
+func parseHosts(r io.Reader) (map[string][]net.IP, error) {
+	names := make(map[string][]net.IP)
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if i := strings.IndexByte(line, '#'); i >= 0 {
+			line = line[:i]
+		}
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+		ip := net.ParseIP(fields[0])
+		if ip == nil {
+			continue
+		}
+		for _, n := range fields[1:] {
+			n = dns.Fqdn(strings.ToLower(n))
+			if _, ok := dns.IsDomainName(n); !ok {
+				continue
+			}
+			names[n] = append(names[n], ip)
+		}
+	}
+	return names, scanner.Err()
+}
+
+// lookup returns the addresses of name, which is lowercased, and true if it has
+// an override.
+func (h *hosts) lookup(name string) ([]net.IP, bool) {
+	h.RLock()
+	ips, ok := h.names[name]
+	h.RUnlock()
+	return ips, ok
+}
+
+// blackholed returns true if ips are all unspecified, 0.0.0.0 or ::, which is how
+// a name is blocked in a hosts file.
+func blackholed(ips []net.IP) bool {
+	for _, ip := range ips {
+		if !ip.IsUnspecified() {
+			return false
+		}
+	}
+	return true
+}
+
+// runHosts loads the hosts file and checks it for changes every hostsReload.
+func (s *server) runHosts() {
+	reload := func() {
+		n, changed, err := s.hosts.load()
+		if err != nil {
+			logf("failure to load hosts file %s: %q", s.config.HostsFile, err)
+			return
+		}
+		if changed {
+			logf("loaded %d names from hosts file %s", n, s.config.HostsFile)
+		}
+	}
+	reload()
+	go func() {
+		for range time.Tick(hostsReload) {
+			reload()
+		}
+	}()
+}
+
+// hostsHandler answers the queries for the names in Config.HostsFile, before the
+// cache, the backend and forwarding are consulted. Names with only unspecified
+// addresses are blocked with NXDOMAIN, other types than A and AAAA get NODATA.
+func (s *server) hostsHandler(next dns.Handler) dns.Handler {
+	if s.hosts == nil {
+		return next
+	}
+	return dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+		if len(req.Question) != 1 || req.Opcode != dns.OpcodeQuery {
+			next.ServeDNS(w, req)
+			return
+		}
+		q := req.Question[0]
+		ips, ok := s.hosts.lookup(strings.ToLower(q.Name))
+		if !ok || q.Qclass != dns.ClassINET {
+			next.ServeDNS(w, req)
+			return
+		}
+		metrics.ReportRequestCount(req, metrics.Hosts)
+
+		m := s.newReply(req)
+		if blackholed(ips) {
+			m.Rcode = dns.RcodeNameError
+			s.explain(m, req, reasonHostsBlocked)
+		} else {
+			hdr := dns.RR_Header{Name: q.Name, Class: dns.ClassINET, Ttl: hostsTtl}
+			for _, ip := range ips {
+				switch ip4 := ip.To4(); {
+				case ip.IsUnspecified():
+				case ip4 != nil && (q.Qtype == dns.TypeA || q.Qtype == dns.TypeANY):
+					hdr.Rrtype = dns.TypeA
+					m.Answer = append(m.Answer, &dns.A{Hdr: hdr, A: ip4})
+				case ip4 == nil && (q.Qtype == dns.TypeAAAA || q.Qtype == dns.TypeANY):
+					hdr.Rrtype = dns.TypeAAAA
+					m.Answer = append(m.Answer, &dns.AAAA{Hdr: hdr, AAAA: ip})
+				}
+			}
+		}
+		s.setEdns(m, req.IsEdns0())
+		if err := w.WriteMsg(m); err != nil {
+			logf("failure to return reply %q", err)
+		}
+	})
+}
@@ -0,0 +1,123 @@
+// Copyright (c) 2014 The SkyDNS Authors. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package server
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestParseHosts(t *testing.T) {
+	names, err := parseHosts(strings.NewReader(`# overrides
+10.0.1.1	db.skydns.test. DB.Other.test # pinned
+2001::1	db.skydns.test.
+0.0.0.0 tracker.example.com
+not-an-address bad.skydns.test.
+10.0.1.2
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(names) != 3 {
+		t.Fatalf("expected 3 names, got %v", names)
+	}
+	if ips := names["db.skydns.test."]; len(ips) != 2 || ips[0].String() != "10.0.1.1" || ips[1].String() != "2001::1" {
+		t.Errorf("expected 2 addresses for db.skydns.test., got %v", ips)
+	}
+	if ips := names["db.other.test."]; len(ips) != 1 {
+		t.Errorf("expected 1 address for db.other.test., got %v", ips)
+	}
+	if !blackholed(names["tracker.example.com."]) || blackholed(names["db.skydns.test."]) {
+		t.Error("expected only tracker.example.com. to be blackholed")
+	}
+}
+
+func TestHosts(t *testing.T) {
+	dir, err := ioutil.TempDir("", "skydns")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "hosts")
+
+	config := &Config{Domain: "skydns.test.", Nameservers: []string{"127.0.0.1:53"}, HostsFile: file}
+	if err := SetDefaults(config); err != nil {
+		t.Fatal(err)
+	}
+	s := &server{config: config, hosts: newHosts(file)}
+	passed := false
+	h := s.hostsHandler(dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+		passed = true
+		w.WriteMsg(new(dns.Msg).SetReply(req))
+	}))
+	query := func(name string, qtype uint16) *dns.Msg {
+		passed = false
+		m := new(dns.Msg)
+		m.SetQuestion(name, qtype)
+		w := &testWriter{}
+		h.ServeDNS(w, m)
+		return w.msg
+	}
+
+	// No file yet, so no overrides.
+	if _, changed, err := s.hosts.load(); err != nil || changed {
+		t.Fatalf("expected no change without a file, got %t, %v", changed, err)
+	}
+	if query("db.skydns.test.", dns.TypeA); !passed {
+		t.Fatal("expected query to be passed on without overrides")
+	}
+
+	if err := ioutil.WriteFile(file, []byte("10.0.1.1 db.skydns.test.\n2001::1 db.skydns.test.\n0.0.0.0 tracker.example.com.\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if n, changed, err := s.hosts.load(); err != nil || !changed || n != 2 {
+		t.Fatalf("expected 2 names loaded, got %d, %t, %v", n, changed, err)
+	}
+
+	tests := []struct {
+		name  string
+		qtype uint16
+		rcode int
+		rrs   []string
+	}{
+		{"DB.skydns.test.", dns.TypeA, dns.RcodeSuccess, []string{"DB.skydns.test.\t30\tIN\tA\t10.0.1.1"}},
+		{"db.skydns.test.", dns.TypeAAAA, dns.RcodeSuccess, []string{"db.skydns.test.\t30\tIN\tAAAA\t2001::1"}},
+		{"db.skydns.test.", dns.TypeMX, dns.RcodeSuccess, nil},
+		{"tracker.example.com.", dns.TypeA, dns.RcodeNameError, nil},
+	}
+	for i, tc := range tests {
+		resp := query(tc.name, tc.qtype)
+		if passed {
+			t.Errorf("test %d: expected an answer from the hosts file", i)
+			continue
+		}
+		if resp.Rcode != tc.rcode || len(resp.Answer) != len(tc.rrs) {
+			t.Errorf("test %d: expected %s with %d answers, got %s", i, dns.RcodeToString[tc.rcode], len(tc.rrs), resp)
+			continue
+		}
+		for j, rr := range resp.Answer {
+			if rr.String() != tc.rrs[j] {
+				t.Errorf("test %d: expected %q, got %q", i, tc.rrs[j], rr.String())
+			}
+		}
+	}
+	if query("other.skydns.test.", dns.TypeA); !passed {
+		t.Error("expected query for a name not in the file to be passed on")
+	}
+
+	// Removing the file removes the overrides.
+	os.Remove(file)
+	if n, changed, err := s.hosts.load(); err != nil || !changed || n != 0 {
+		t.Fatalf("expected no names after removal, got %d, %t, %v", n, changed, err)
+	}
+	if query("db.skydns.test.", dns.TypeA); !passed {
+		t.Error("expected query to be passed on after removal")
+	}
+}
@@ -0,0 +1,175 @@
+// Copyright (c) 2014 The SkyDNS Authors. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package server
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/skynetservices/skydns/msg"
+
+	"github.com/miekg/dns"
+)
+
+// journalRetry is the time we wait before watching again after the watch failed.
+const journalRetry = 5 * time.Second
+
+// delta holds the records removed and added when the serial of our domain went
+// from from to to.
+type delta struct {
+	from, to uint32
+	removed  []dns.RR
+	added    []dns.RR
+}
+
+// journal keeps the last changes to our domain, for IXFR. The records are the
+// ones of a transfer at serial, the deltas lead up to them, oldest first.
+type journal struct {
+	sync.Mutex
+	size    int
+	serial  uint32
+	records map[string]dns.RR // nil until the first update
+	deltas  []delta
+}
+
+func newJournal(size int) *journal { return &journal{size: size} }
+
+// updateJournal adds the changes to our domain since the last update to the
+// journal, when its serial changed.
+func (s *server) updateJournal() error {
+	j := s.journal
+	j.Lock()
+	defer j.Unlock()
+
+	serial := s.serial()
+	if j.records != nil && serial == j.serial {
+		return nil
+	}
+	records, err := s.transferRecords()
+	if err != nil {
+		return err
+	}
+	next := make(map[string]dns.RR, len(records))
+	for _, r := range records {
+		next[strings.ToLower(r.String())] = r
+	}
+	if j.records != nil {
+		d := delta{from: j.serial, to: serial}
+		for k, r := range j.records {
+			if _, ok := next[k]; !ok {
+				d.removed = append(d.removed, r)
+			}
+		}
+		for k, r := range next {
+			if _, ok := j.records[k]; !ok {
+				d.added = append(d.added, r)
+			}
+		}
+		sortRRs(d.removed)
+		sortRRs(d.added)
+		j.deltas = append(j.deltas, d)
+		if len(j.deltas) > j.size {
+			j.deltas = j.deltas[len(j.deltas)-j.size:]
+		}
+	}
+	j.serial, j.records = serial, next
+	return nil
+}
+
+// sortRRs sorts rrs on their text, so the deltas have a stable order.
+func sortRRs(rrs []dns.RR) {
+	sort.Slice(rrs, func(i, j int) bool { return rrs[i].String() < rrs[j].String() })
+}
+
+// runJournal watches w and updates the journal after every change to our domain,
+// once the serial had the time to follow it.
+func (s *server) runJournal(w Watcher) {
+	if err := s.updateJournal(); err != nil {
+		logf("failure to fill the IXFR journal: %s", err)
+	}
+	changed := make(chan struct{}, 1)
+	go func() {
+		for range changed {
+			time.Sleep(serialCheck)
+			if err := s.updateJournal(); err != nil {
+				logf("failure to update the IXFR journal: %s", err)
+			}
+		}
+	}()
+	send := func(c msg.Change) {
+		if !dns.IsSubDomain(s.config.Domain, c.Name) {
+			return
+		}
+		select {
+		case changed <- struct{}{}:
+		default:
+		}
+	}
+	go func() {
+		for {
+			err := w.Watch(context.Background(), send)
+			logf("watch for the IXFR journal failed, retrying in %s: %s", journalRetry, err)
+			time.Sleep(journalRetry)
+		}
+	}()
+}
+
+// incremental returns the records of an IXFR answer for req: the deltas from the
+// serial of the SOA in its authority section up to ours, framed by our SOA, or
+// only our SOA when the client is up to date or asked over UDP, so it retries
+// over TCP. It returns nil when a full transfer must be sent instead, because
+// the changes since the client's serial are not in the journal.
+func (s *server) incremental(req *dns.Msg, udp bool) []dns.RR {
+	var client *dns.SOA
+	for _, r := range req.Ns {
+		if soa, ok := r.(*dns.SOA); ok {
+			client = soa
+			break
+		}
+	}
+	if s.journal == nil {
+		if udp {
+			return []dns.RR{s.NewSOA()}
+		}
+		return nil
+	}
+	if err := s.updateJournal(); err != nil {
+		logf("failure to update the IXFR journal: %s", err)
+	}
+
+	j := s.journal
+	j.Lock()
+	defer j.Unlock()
+	soa := func(serial uint32) dns.RR {
+		r := s.NewSOA().(*dns.SOA)
+		r.Serial = serial
+		return r
+	}
+	// Newer is RFC 1982 serial number arithmetic.
+	if udp || (client != nil && int32(client.Serial-j.serial) >= 0) {
+		return []dns.RR{soa(j.serial)}
+	}
+	if client == nil {
+		return nil
+	}
+	i := 0
+	for i < len(j.deltas) && j.deltas[i].from != client.Serial {
+		i++
+	}
+	if i == len(j.deltas) {
+		return nil
+	}
+	records := []dns.RR{soa(j.serial)}
+	for _, d := range j.deltas[i:] {
+		records = append(records, soa(d.from))
+		records = append(records, d.removed...)
+		records = append(records, soa(d.to))
+		records = append(records, d.added...)
+	}
+	return append(records, soa(j.serial))
+}
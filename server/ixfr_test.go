@@ -0,0 +1,83 @@
+// Copyright (c) 2014 The SkyDNS Authors. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package server
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/skynetservices/skydns/msg"
+
+	"github.com/miekg/dns"
+)
+
+func TestIncrementalTransfer(t *testing.T) {
+	_, n, _ := net.ParseCIDR("127.0.0.0/8")
+	// Not started, the journal is updated by the test instead of runJournal.
+	s := newUnstartedTestServer(t, false, func(s *server) {
+		s.config.transferNets = []*net.IPNet{n}
+		s.journal = newJournal(10)
+	})
+
+	// Forget when we last checked the serial, instead of waiting for serialCheck.
+	update := func() uint32 {
+		s.soa.checked = time.Time{}
+		if err := s.updateJournal(); err != nil {
+			t.Fatal(err)
+		}
+		return s.journal.serial
+	}
+	ixfr := func(w dns.ResponseWriter, serial uint32) (records []dns.RR) {
+		m := new(dns.Msg)
+		m.SetIxfr("skydns.test.", serial, "ns.dns.skydns.test.", "hostmaster.skydns.test.")
+		s.ServeDNS(w, m)
+		if tw, ok := w.(*transferWriter); ok {
+			for _, m := range tw.msgs {
+				records = append(records, m.Answer...)
+			}
+			return records
+		}
+		return w.(*testWriter).msg.Answer
+	}
+	serial := func(r dns.RR) uint32 {
+		soa, ok := r.(*dns.SOA)
+		if !ok {
+			t.Fatalf("expected a SOA, got %s", r)
+		}
+		return soa.Serial
+	}
+
+	s1 := update()
+	serv := &msg.Service{Host: "10.0.21.1", Key: "a.ixfr.skydns.test."}
+	addService(t, s, serv.Key, 0, serv)
+	defer delService(t, s, serv.Key)
+	s2 := update()
+	if s2 == s1 {
+		t.Fatalf("expected the serial to change, got %d", s2)
+	}
+
+	records := ixfr(&transferWriter{}, s1)
+	if len(records) != 5 || serial(records[0]) != s2 || serial(records[1]) != s1 || serial(records[2]) != s2 || serial(records[4]) != s2 {
+		t.Fatalf("expected the changes from %d to %d, got %v", s1, s2, records)
+	}
+	if a, ok := records[3].(*dns.A); !ok || a.Hdr.Name != serv.Key || a.A.String() != serv.Host {
+		t.Errorf("expected the A record of %s to be added, got %s", serv.Key, records[3])
+	}
+
+	if records := ixfr(&transferWriter{}, s2); len(records) != 1 || serial(records[0]) != s2 {
+		t.Errorf("expected only the SOA when up to date, got %v", records)
+	}
+	if records := ixfr(&testWriter{}, s1); len(records) != 1 || serial(records[0]) != s2 {
+		t.Errorf("expected only the SOA over UDP, got %v", records)
+	}
+	records = ixfr(&transferWriter{}, s1-1)
+	if len(records) < 3 || serial(records[0]) != s2 || serial(records[len(records)-1]) != s2 {
+		t.Fatalf("expected a full transfer for a serial that is not in the journal, got %v", records)
+	}
+	if _, ok := records[1].(*dns.SOA); ok {
+		t.Errorf("expected a full transfer for a serial that is not in the journal, got %v", records)
+	}
+}
@@ -0,0 +1,68 @@
+// Copyright (c) 2014 The SkyDNS Authors. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package server
+
+import (
+	"fmt"
+	"net"
+)
+
+// setInterfacesDefaults sets the addresses we listen on: DnsAddr, or every address
+// of the Interfaces at its port.
+func setInterfacesDefaults(config *Config) error {
+	config.listenAddrs = []string{config.DnsAddr}
+	config.selfAddrs = selfAddrs(config.DnsAddr)
+	if len(config.Interfaces) == 0 {
+		return nil
+	}
+	_, port, err := net.SplitHostPort(config.DnsAddr)
+	if err != nil {
+		return fmt.Errorf("invalid dns_addr: %s", err)
+	}
+	config.listenAddrs = nil
+	config.selfAddrs = make(map[string]bool)
+	for _, name := range config.Interfaces {
+		addrs, err := interfaceAddrs(name, port)
+		if err != nil {
+			return err
+		}
+		for _, a := range addrs {
+			config.listenAddrs = append(config.listenAddrs, a)
+			for self := range selfAddrs(a) {
+				config.selfAddrs[self] = true
+			}
+		}
+	}
+	return nil
+}
+
+// interfaceAddrs returns the addresses of the network interface name, joined with
+// port. IPv6 link-local addresses get the interface as zone.
+func interfaceAddrs(name, port string) ([]string, error) {
+	ifi, err := net.InterfaceByName(name)
+	if err != nil {
+		return nil, fmt.Errorf("invalid interface %q: %s", name, err)
+	}
+	addrs, err := ifi.Addrs()
+	if err != nil {
+		return nil, fmt.Errorf("invalid interface %q: %s", name, err)
+	}
+	var ret []string
+	for _, a := range addrs {
+		n, ok := a.(*net.IPNet)
+		if !ok {
+			continue
+		}
+		host := n.IP.String()
+		if n.IP.To4() == nil && n.IP.IsLinkLocalUnicast() {
+			host += "%" + ifi.Name
+		}
+		ret = append(ret, net.JoinHostPort(host, port))
+	}
+	if len(ret) == 0 {
+		return nil, fmt.Errorf("interface %q has no addresses", name)
+	}
+	return ret, nil
+}
@@ -0,0 +1,48 @@
+// Copyright (c) 2014 The SkyDNS Authors. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package server
+
+import (
+	"net"
+	"testing"
+)
+
+func TestInterfacesConfig(t *testing.T) {
+	var lo string
+	ifis, _ := net.Interfaces()
+	for _, ifi := range ifis {
+		if ifi.Flags&net.FlagLoopback != 0 {
+			lo = ifi.Name
+			break
+		}
+	}
+	if lo == "" {
+		t.Skip("no loopback interface")
+	}
+
+	config := &Config{DnsAddr: "127.0.0.1:1053", Interfaces: []string{lo}}
+	if err := setInterfacesDefaults(config); err != nil {
+		t.Fatal(err)
+	}
+	found := false
+	for _, a := range config.listenAddrs {
+		if a == "127.0.0.1:1053" {
+			found = true
+		}
+	}
+	if !found || !config.isSelf("127.0.0.1:1053") {
+		t.Errorf("expected to listen on 127.0.0.1:1053, got %v", config.listenAddrs)
+	}
+
+	config = &Config{DnsAddr: "127.0.0.1:1053"}
+	if err := setInterfacesDefaults(config); err != nil || len(config.listenAddrs) != 1 || config.listenAddrs[0] != "127.0.0.1:1053" {
+		t.Errorf("expected to listen on dns_addr, got %v: %v", config.listenAddrs, err)
+	}
+
+	config = &Config{DnsAddr: "127.0.0.1:1053", Interfaces: []string{"nonexistent0"}}
+	if err := setInterfacesDefaults(config); err == nil {
+		t.Errorf("expected an error for a nonexistent interface")
+	}
+}
@@ -0,0 +1,107 @@
+// Copyright (c) 2014 The SkyDNS Authors. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package server
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"net"
+
+	"github.com/miekg/dns"
+)
+
+// ednsLoopCode is the EDNS0 option carrying loopID.
+const ednsLoopCode = dns.EDNS0LOCALSTART + 11
+
+// loopID identifies this SkyDNS in the EDNS0 option we add to every query we
+// forward. When a query carrying it comes back to us, we are in a loop.
+var loopID = func() []byte {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return b
+}()
+
+var errLoop = errors.New("forwarding loop")
+
+// markLoop adds our loop option to m, a query we forward. Other SkyDNS servers
+// forwarding m add theirs, so a query collects the servers it passed.
+func markLoop(m *dns.Msg) {
+	o := m.IsEdns0()
+	if o == nil {
+		o = &dns.OPT{Hdr: dns.RR_Header{Name: ".", Rrtype: dns.TypeOPT}}
+		o.SetUDPSize(dns.MinMsgSize)
+		m.Extra = append(m.Extra, o)
+	}
+	for _, e := range o.Option {
+		if isLoopOption(e) {
+			return
+		}
+	}
+	o.Option = append(o.Option, &dns.EDNS0_LOCAL{Code: ednsLoopCode, Data: loopID})
+}
+
+// looped returns true if req was forwarded by us before.
+func looped(req *dns.Msg) bool {
+	o := req.IsEdns0()
+	if o == nil {
+		return false
+	}
+	for _, e := range o.Option {
+		if isLoopOption(e) {
+			return true
+		}
+	}
+	return false
+}
+
+func isLoopOption(e dns.EDNS0) bool {
+	l, ok := e.(*dns.EDNS0_LOCAL)
+	return ok && l.Code == ednsLoopCode && bytes.Equal(l.Data, loopID)
+}
+
+// selfAddrs returns the addresses, as host:port, we listen on with addr. An
+// unspecified address stands for those of all interfaces.
+func selfAddrs(addr string) map[string]bool {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil
+	}
+	var ips []net.IP
+	switch ip := net.ParseIP(host); {
+	case host == "" || ip != nil && ip.IsUnspecified():
+		addrs, _ := net.InterfaceAddrs()
+		for _, a := range addrs {
+			if n, ok := a.(*net.IPNet); ok {
+				ips = append(ips, n.IP)
+			}
+		}
+	case ip != nil:
+		ips = []net.IP{ip}
+	default:
+		ips, _ = net.LookupIP(host)
+	}
+	self := make(map[string]bool)
+	for _, ip := range ips {
+		self[net.JoinHostPort(ip.String(), port)] = true
+	}
+	return self
+}
+
+// isSelf returns true if forwarding to nameserver ns sends queries to ourselves.
+func (c *Config) isSelf(ns string) bool {
+	if len(c.selfAddrs) == 0 {
+		return false
+	}
+	host, port, err := net.SplitHostPort(ns)
+	if err != nil {
+		return false
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+	return c.selfAddrs[net.JoinHostPort(ip.String(), port)]
+}
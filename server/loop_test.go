@@ -0,0 +1,102 @@
+// Copyright (c) 2014 The SkyDNS Authors. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package server
+
+import (
+	"strconv"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestSelfAddrs(t *testing.T) {
+	c := &Config{selfAddrs: selfAddrs("127.0.0.1:1053")}
+	for ns, self := range map[string]bool{
+		"127.0.0.1:1053": true,
+		"127.0.0.1:53":   false,
+		"[::1]:1053":     false,
+		"8.8.8.8:1053":   false,
+		"not-an-address": false,
+	} {
+		if c.isSelf(ns) != self {
+			t.Errorf("expected %s to be ourselves %t, got %t", ns, self, !self)
+		}
+	}
+
+	// An unspecified address listens on all interfaces, the loopback one included.
+	c.selfAddrs = selfAddrs("0.0.0.0:1053")
+	if !c.isSelf("127.0.0.1:1053") {
+		t.Errorf("expected 127.0.0.1:1053 to be ourselves when listening on 0.0.0.0:1053")
+	}
+}
+
+func TestForwardLoop(t *testing.T) {
+	// Our own address as a nameserver.
+	s := newTestServer(t, false, func(s *server) {
+		s.config.ExtendedErrors = true
+		s.config.Nameservers = []string{s.config.DnsAddr}
+	})
+	defer s.Stop()
+
+	forward := func(looped bool) *dns.Msg {
+		m := new(dns.Msg)
+		m.SetQuestion("www.example.org.", dns.TypeA)
+		m.SetEdns0(4096, false)
+		if looped {
+			markLoop(m)
+		}
+		w := &testWriter{}
+		s.ServeDNS(w, m)
+		return w.msg
+	}
+	check := func(what string, m *dns.Msg) {
+		if m.Rcode != dns.RcodeServerFailure {
+			t.Fatalf("%s: expected SERVFAIL, got %s", what, dns.RcodeToString[m.Rcode])
+		}
+		if _, text, _ := extendedError(m); text != "forwarding-loop" {
+			t.Errorf("%s: expected extended error %q, got %q", what, "forwarding-loop", text)
+		}
+		if o := m.IsEdns0(); o != nil {
+			for _, e := range o.Option {
+				if e.Option() == ednsLoopCode {
+					t.Errorf("%s: expected our loop option not to be echoed", what)
+				}
+			}
+		}
+	}
+
+	// A query we forwarded before came back to us.
+	check("looped query", forward(true))
+
+	check("ourselves as nameserver", forward(false))
+}
+
+func TestForwardLoopServers(t *testing.T) {
+	// s1 and s2 forward to each other, s2 is started next on Port.
+	s1 := newTestServer(t, false, func(s *server) {
+		s.config.ExtendedErrors = true
+		s.config.Nameservers = []string{"127.0.0.1:" + strconv.Itoa(Port+10)}
+	})
+	defer s1.Stop()
+	s2 := newTestServer(t, false, func(s *server) {
+		s.config.ExtendedErrors = true
+		s.config.Nameservers = []string{s1.config.DnsAddr}
+	})
+	defer s2.Stop()
+
+	m := new(dns.Msg)
+	m.SetQuestion("www.example.org.", dns.TypeA)
+	m.SetEdns0(4096, false)
+	r, _, err := new(dns.Client).Exchange(m, s1.config.DnsAddr)
+	if err != nil {
+		t.Fatalf("expected an answer, got %s", err)
+	}
+	if r.Rcode != dns.RcodeServerFailure {
+		t.Fatalf("expected SERVFAIL, got %s", dns.RcodeToString[r.Rcode])
+	}
+	if _, text, _ := extendedError(r); text != "forwarding-loop" {
+		t.Errorf("expected extended error %q, got %q", "forwarding-loop", text)
+	}
+}
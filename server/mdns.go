@@ -0,0 +1,531 @@
+// Copyright (c) 2014 The SkyDNS Authors. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package server
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/skynetservices/skydns/msg"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	// mdnsTtl is the TTL of the address records we answer on the link with, the
+	// TTL RFC 6762, section 10, recommends for host names.
+	mdnsTtl = 120
+	// mdnsServiceTtl is the TTL of the other records of announced services, see
+	// RFC 6762, section 10.
+	mdnsServiceTtl = 4500
+	// mdnsRefresh is how often the services to announce are looked up in etcd.
+	mdnsRefresh = time.Minute
+	// mdnsLegacyTtl is the TTL in unicast replies to legacy resolvers, which
+	// don't see our updates, see RFC 6762, section 6.7.
+	mdnsLegacyTtl = 10
+	// mdnsCacheFlush is the top bit of the class of a record in a multicast reply:
+	// the record replaces earlier ones for its name and type. In a question it
+	// asks for a unicast reply.
+	mdnsCacheFlush = 1 << 15
+	mdnsDomain     = "local."
+	// mdnsMaxHosts is the most hosts learned on the link, and mdnsMaxAddrs the
+	// most addresses of each: the replies of others don't grow us without bound.
+	mdnsMaxHosts = 1024
+	mdnsMaxAddrs = 16
+)
+
+var (
+	mdnsGroup4 = &net.UDPAddr{IP: net.IPv4(224, 0, 0, 251), Port: 5353}
+	mdnsGroup6 = &net.UDPAddr{IP: net.ParseIP("ff02::fb"), Port: 5353}
+)
+
+// MDNS bridges SkyDNS and multicast DNS (RFC 6762) on a local link, so devices
+// that only speak mDNS can find services and be found.
+type MDNS struct {
+	// Export, a zone in our domain. Queries on the link for NAME.local. are
+	// answered with the addresses of NAME.<Export>.
+	Export string `json:"export,omitempty"`
+	// Import, a zone in our domain. The hosts announcing NAME.local. on the link
+	// are served as NAME.<Import>.
+	Import string `json:"import,omitempty"`
+	// Interface, the network interface of the link. Defaults to the one the
+	// system picks for multicast.
+	Interface string `json:"interface,omitempty"`
+	// Announce the services flagged with msg.Service.Mdns on the link, and
+	// answer the queries for them.
+	Announce bool `json:"announce,omitempty"`
+}
+
+func setMDNSDefaults(config *Config) error {
+	m := config.MDNS
+	if m == nil {
+		return nil
+	}
+	if m.Export == "" && m.Import == "" && !m.Announce {
+		return fmt.Errorf("mdns needs a zone to export, to import, or services to announce")
+	}
+	for _, zone := range []*string{&m.Export, &m.Import} {
+		if *zone == "" {
+			continue
+		}
+		*zone = dns.Fqdn(strings.ToLower(*zone))
+		if !dns.IsSubDomain(config.Domain, *zone) {
+			return fmt.Errorf("mdns zone %q is not in %q", *zone, config.Domain)
+		}
+	}
+	if m.Export != "" && m.Export == m.Import {
+		return fmt.Errorf("mdns can't export the zone it imports: %q", m.Export)
+	}
+	return nil
+}
+
+// mdnsHosts are the hosts learned on the link, with the expiration of each of
+// their addresses. Expired addresses are removed every mdnsRefresh, and no more
+// than mdnsMaxHosts are learned.
+type mdnsHosts struct {
+	zone string // Config.MDNS.Import
+
+	sync.Mutex
+	hosts  map[string]map[string]time.Time // NAME. without local.
+	expire time.Time                       // when expired addresses are removed next
+}
+
+func newMDNSHosts(zone string) *mdnsHosts {
+	return &mdnsHosts{zone: zone, hosts: make(map[string]map[string]time.Time)}
+}
+
+// learn adds the addresses in m, a multicast reply, to the hosts. A record with
+// the cache-flush bit replaces the addresses of its host of the same family, a
+// TTL of zero removes an address.
+func (h *mdnsHosts) learn(m *dns.Msg, now time.Time) int {
+	n := 0
+	flushed := make(map[string]bool)
+	h.Lock()
+	defer h.Unlock()
+	if !now.Before(h.expire) {
+		h.removeExpired(now)
+		h.expire = now.Add(mdnsRefresh)
+	}
+	for _, rrs := range [][]dns.RR{m.Answer, m.Extra} {
+		for _, r := range rrs {
+			hdr := r.Header()
+			if hdr.Class&^mdnsCacheFlush != dns.ClassINET {
+				continue
+			}
+			var ip net.IP
+			switch a := r.(type) {
+			case *dns.A:
+				ip = a.A
+			case *dns.AAAA:
+				ip = a.AAAA
+			default:
+				continue
+			}
+			name := strings.ToLower(hdr.Name)
+			if !strings.HasSuffix(name, "."+mdnsDomain) {
+				continue
+			}
+			host := strings.TrimSuffix(name, mdnsDomain)
+			if hdr.Class&mdnsCacheFlush != 0 && !flushed[host+strconv.Itoa(int(hdr.Rrtype))] {
+				flushed[host+strconv.Itoa(int(hdr.Rrtype))] = true
+				for a := range h.hosts[host] {
+					if (net.ParseIP(a).To4() != nil) == (hdr.Rrtype == dns.TypeA) {
+						delete(h.hosts[host], a)
+					}
+				}
+			}
+			if hdr.Ttl == 0 {
+				delete(h.hosts[host], ip.String())
+				continue
+			}
+			if h.hosts[host] == nil {
+				if len(h.hosts) >= mdnsMaxHosts {
+					continue
+				}
+				h.hosts[host] = make(map[string]time.Time)
+			}
+			if _, ok := h.hosts[host][ip.String()]; !ok && len(h.hosts[host]) >= mdnsMaxAddrs {
+				continue
+			}
+			h.hosts[host][ip.String()] = now.Add(time.Duration(hdr.Ttl) * time.Second)
+			n++
+		}
+	}
+	return n
+}
+
+// removeExpired removes the addresses that expired at now, and the hosts left
+// without any. It is called with h locked.
+func (h *mdnsHosts) removeExpired(now time.Time) {
+	for host, addrs := range h.hosts {
+		for a, exp := range addrs {
+			if !now.Before(exp) {
+				delete(addrs, a)
+			}
+		}
+		if len(addrs) == 0 {
+			delete(h.hosts, host)
+		}
+	}
+}
+
+// records returns the services for name, when it is in the import zone. Ok is
+// false for other names.
+func (h *mdnsHosts) records(name string, exact bool, now time.Time) (sx []msg.Service, ok bool) {
+	if !dns.IsSubDomain(h.zone, name) {
+		return nil, false
+	}
+	name = strings.TrimSuffix(name, h.zone)
+	h.Lock()
+	defer h.Unlock()
+	hosts := make([]string, 0, len(h.hosts))
+	for host := range h.hosts {
+		if host == name || !exact && (name == "" || strings.HasSuffix(host, "."+name)) {
+			hosts = append(hosts, host)
+		}
+	}
+	sort.Strings(hosts)
+	for _, host := range hosts {
+		addrs := make([]string, 0, len(h.hosts[host]))
+		for a, exp := range h.hosts[host] {
+			if !now.Before(exp) {
+				delete(h.hosts[host], a)
+				continue
+			}
+			addrs = append(addrs, a)
+		}
+		if len(addrs) == 0 {
+			delete(h.hosts, host)
+			continue
+		}
+		sort.Strings(addrs)
+		for i, a := range addrs {
+			ttl := uint32(h.hosts[host][a].Sub(now)/time.Second) + 1
+			key := msg.Path("mdns" + strconv.Itoa(i) + "." + host + h.zone)
+			sx = append(sx, msg.Service{Host: a, Ttl: ttl, Key: key})
+		}
+	}
+	return sx, true
+}
+
+// runMDNS joins the mDNS group on the link, over IPv4 and, when the link has it,
+// IPv6.
+func (s *server) runMDNS() error {
+	var ifi *net.Interface
+	if s.config.MDNS.Interface != "" {
+		var err error
+		if ifi, err = net.InterfaceByName(s.config.MDNS.Interface); err != nil {
+			return err
+		}
+	}
+	self := make(map[string]bool)
+	if addrs, err := net.InterfaceAddrs(); err == nil {
+		for _, a := range addrs {
+			if n, ok := a.(*net.IPNet); ok {
+				self[n.IP.String()] = true
+			}
+		}
+	}
+	conn, err := net.ListenMulticastUDP("udp4", ifi, mdnsGroup4)
+	if err != nil {
+		return fmt.Errorf("failure to join the mDNS group: %s", err)
+	}
+	go s.serveMDNS(conn, mdnsGroup4, self)
+	conn6, err := net.ListenMulticastUDP("udp6", ifi, mdnsGroup6)
+	if err == nil {
+		go s.serveMDNS(conn6, mdnsGroup6, self)
+	} else if s.config.Verbose {
+		logf("not bridging mDNS over IPv6: %s", err)
+	}
+	if s.announced != nil {
+		go s.announceMDNS(func(m *dns.Msg) {
+			b, err := m.Pack()
+			if err != nil {
+				logf("failure to pack mDNS announcement: %s", err)
+				return
+			}
+			conn.WriteToUDP(b, mdnsGroup4)
+			if conn6 != nil {
+				conn6.WriteToUDP(b, mdnsGroup6)
+			}
+		})
+	}
+	logf("bridging mDNS, exporting %q and importing into %q, announcing services %t", s.config.MDNS.Export, s.config.MDNS.Import, s.announced != nil)
+	return nil
+}
+
+// serveMDNS answers the queries on conn for exported names, and learns the hosts
+// in the replies of others.
+func (s *server) serveMDNS(conn *net.UDPConn, group *net.UDPAddr, self map[string]bool) {
+	buf := make([]byte, 9000) // the largest mDNS message, RFC 6762, section 17
+	for {
+		n, from, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			logf("failure to read mDNS: %q", err)
+			return
+		}
+		m := new(dns.Msg)
+		if m.Unpack(buf[:n]) != nil {
+			continue
+		}
+		if m.Response {
+			// Our own replies come back to us, they are not hosts on the link.
+			if s.mdns != nil && !self[from.IP.String()] {
+				s.mdns.learn(m, time.Now())
+			}
+			continue
+		}
+		if s.config.MDNS.Export == "" && s.announced == nil {
+			continue
+		}
+		resp, unicast := s.mdnsAnswer(m, from)
+		if resp == nil {
+			continue
+		}
+		b, err := resp.Pack()
+		if err != nil {
+			continue
+		}
+		to := group
+		if unicast {
+			to = from
+		}
+		if _, err := conn.WriteToUDP(b, to); err != nil {
+			logf("failure to return mDNS reply %q", err)
+		}
+	}
+}
+
+// mdnsAnswer returns the reply to req, an mDNS query from from, or nil when there
+// are no exported names or announced services in it, mDNS has no negative
+// replies. Unicast is true when the reply is sent to from only.
+func (s *server) mdnsAnswer(req *dns.Msg, from *net.UDPAddr) (m *dns.Msg, unicast bool) {
+	// A legacy resolver, not listening on the mDNS port, wants a unicast DNS reply.
+	legacy := from.Port != mdnsGroup4.Port
+	m = new(dns.Msg)
+	m.Response, m.Authoritative = true, true
+	if legacy {
+		m.Id, m.Question = req.Id, req.Question
+	}
+	unicast = legacy
+	for _, q := range req.Question {
+		if q.Qclass&mdnsCacheFlush != 0 {
+			unicast = true
+		}
+		if qclass := q.Qclass &^ mdnsCacheFlush; qclass != dns.ClassINET && qclass != dns.ClassANY {
+			continue
+		}
+		name := strings.ToLower(q.Name)
+		if !strings.HasSuffix(name, "."+mdnsDomain) {
+			continue
+		}
+		if s.announced != nil {
+			for _, r := range s.announced.lookup(name, q.Qtype) {
+				m.Answer = append(m.Answer, mdnsRecord(r, legacy))
+			}
+		}
+		var types []uint16
+		switch {
+		case s.config.MDNS.Export == "":
+		case q.Qtype == dns.TypeA, q.Qtype == dns.TypeAAAA:
+			types = []uint16{q.Qtype}
+		case q.Qtype == dns.TypeANY:
+			types = []uint16{dns.TypeA, dns.TypeAAAA}
+		}
+		target := strings.TrimSuffix(name, mdnsDomain) + s.config.MDNS.Export
+		for _, t := range types {
+			records, err := s.AddressRecords(dns.Question{Name: target, Qtype: t, Qclass: dns.ClassINET}, target, nil, 512, false, false)
+			if err != nil {
+				continue
+			}
+			for _, r := range records {
+				if r.Header().Rrtype != t {
+					continue
+				}
+				r.Header().Name = q.Name
+				r.Header().Ttl = mdnsTtl
+				if legacy {
+					r.Header().Ttl = mdnsLegacyTtl
+				} else {
+					r.Header().Class |= mdnsCacheFlush
+				}
+				m.Answer = append(m.Answer, r)
+			}
+		}
+	}
+	if len(m.Answer) == 0 {
+		return nil, false
+	}
+	return m, unicast
+}
+
+// mdnsServices are the records of the services we announce on the link, named
+// in local. and without the cache-flush bit, see mdnsRecord.
+type mdnsServices struct {
+	sync.RWMutex
+	records []dns.RR
+}
+
+// lookup returns the records for name, in lower case, of type qtype.
+func (ms *mdnsServices) lookup(name string, qtype uint16) []dns.RR {
+	ms.RLock()
+	defer ms.RUnlock()
+	var rrs []dns.RR
+	for _, r := range ms.records {
+		if r.Header().Name == name && (qtype == dns.TypeANY || r.Header().Rrtype == qtype) {
+			rrs = append(rrs, r)
+		}
+	}
+	return rrs
+}
+
+// mdnsRecord returns a copy of r, an announced record, to send on the link. It
+// has the cache-flush bit unless it is a shared PTR record, or a TTL of
+// mdnsLegacyTtl when it is for a legacy resolver.
+func mdnsRecord(r dns.RR, legacy bool) dns.RR {
+	r = dns.Copy(r)
+	switch {
+	case legacy:
+		r.Header().Ttl = mdnsLegacyTtl
+	case r.Header().Rrtype != dns.TypePTR:
+		r.Header().Class |= mdnsCacheFlush
+	}
+	return r
+}
+
+// mdnsServiceRecords returns the records announcing the services flagged with
+// Mdns that have an address as Host: for a service NAME (the first label of its
+// key) the address records of NAME.local. and, with Srv and Proto, the DNS-SD
+// records (RFC 6763) of the instance NAME._srv._proto.local.
+func (s *server) mdnsServiceRecords() ([]dns.RR, error) {
+	services, err := s.records(s.config.Domain, false)
+	if err != nil {
+		return nil, err
+	}
+	var records []dns.RR
+	seen := make(map[string]bool)
+	add := func(r dns.RR) {
+		if k := r.String(); !seen[k] {
+			seen[k] = true
+			records = append(records, r)
+		}
+	}
+	for _, serv := range services {
+		ip := net.ParseIP(serv.Host)
+		if !serv.Mdns || ip == nil {
+			continue
+		}
+		name := strings.ToLower(dns.SplitDomainName(msg.Domain(serv.Key))[0])
+		host := name + "." + mdnsDomain
+		if ip4 := ip.To4(); ip4 != nil {
+			a := serv.NewA(host, ip4)
+			a.Hdr.Ttl = mdnsTtl
+			add(a)
+		} else {
+			aaaa := serv.NewAAAA(host, ip)
+			aaaa.Hdr.Ttl = mdnsTtl
+			add(aaaa)
+		}
+		if serv.Srv == "" || serv.Proto == "" {
+			continue
+		}
+		typ := strings.ToLower("_" + serv.Srv + "._" + serv.Proto + "." + mdnsDomain)
+		instance := name + "." + typ
+		add(dnssdPTR(dnssdServices+mdnsDomain, typ, mdnsServiceTtl))
+		add(dnssdPTR(typ, instance, mdnsServiceTtl))
+		srv := serv.NewSRV(instance, uint16(serv.Weight))
+		srv.Hdr.Ttl, srv.Target = mdnsTtl, host
+		add(srv)
+		txt := serv.NewTXT(instance)
+		txt.Hdr.Ttl = mdnsServiceTtl
+		if len(txt.Txt) == 0 {
+			txt.Txt = []string{""} // RFC 6763, section 6.1
+		}
+		add(txt)
+	}
+	return records, nil
+}
+
+// announceMDNS looks up the services to announce every mdnsRefresh, and sends
+// the records with send when they change: twice, a second apart, as RFC 6762,
+// section 8.3 asks. Records that are gone are sent with a TTL of zero.
+func (s *server) announceMDNS(send func(*dns.Msg)) {
+	var last []dns.RR
+	repeat := false
+	for {
+		records, err := s.mdnsServiceRecords()
+		if err != nil {
+			logf("failure to look up the services to announce over mDNS: %s", err)
+			time.Sleep(mdnsRefresh)
+			continue
+		}
+		s.announced.Lock()
+		s.announced.records = records
+		s.announced.Unlock()
+
+		changed := repeat
+		now := make(map[string]bool)
+		for _, r := range records {
+			now[r.String()] = true
+		}
+		var announce []dns.RR
+		for _, r := range last {
+			if !now[r.String()] {
+				r = mdnsRecord(r, false)
+				r.Header().Ttl = 0
+				announce = append(announce, r)
+				changed = true
+			}
+		}
+		if len(records) != len(last) {
+			changed = true
+		}
+		if changed {
+			for _, r := range records {
+				announce = append(announce, mdnsRecord(r, false))
+			}
+			for _, m := range mdnsAnnouncements(announce) {
+				send(m)
+			}
+		}
+		last = records
+
+		// An announcement is repeated once, after a second.
+		repeat = changed && !repeat
+		if repeat {
+			time.Sleep(time.Second)
+			continue
+		}
+		time.Sleep(mdnsRefresh)
+	}
+}
+
+// mdnsAnnouncements returns the unsolicited replies that hold rrs, each small
+// enough not to be fragmented on an Ethernet link.
+func mdnsAnnouncements(rrs []dns.RR) []*dns.Msg {
+	var msgs []*dns.Msg
+	m := new(dns.Msg)
+	for _, r := range rrs {
+		m.Answer = append(m.Answer, r)
+		if len(m.Answer) > 1 && m.Len() > 1400 {
+			m.Answer = m.Answer[:len(m.Answer)-1]
+			msgs = append(msgs, m)
+			m = new(dns.Msg)
+			m.Answer = []dns.RR{r}
+		}
+	}
+	if len(m.Answer) > 0 {
+		msgs = append(msgs, m)
+	}
+	for _, m := range msgs {
+		m.Response, m.Authoritative = true, true
+	}
+	return msgs
+}
@@ -0,0 +1,248 @@
+// Copyright (c) 2014 The SkyDNS Authors. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package server
+
+import (
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/skynetservices/skydns/msg"
+
+	"github.com/miekg/dns"
+)
+
+func TestMDNSConfig(t *testing.T) {
+	tests := []struct {
+		mdns *MDNS
+		ok   bool
+	}{
+		{&MDNS{Export: "lab.skydns.test", Import: "Devices.skydns.test."}, true},
+		{&MDNS{Import: "devices.skydns.test."}, true},
+		{&MDNS{Announce: true}, true},
+		{&MDNS{}, false},
+		{&MDNS{Export: "lab.example.org."}, false},
+		{&MDNS{Export: "lab.skydns.test.", Import: "lab.skydns.test."}, false},
+	}
+	for i, tc := range tests {
+		config := &Config{Domain: "skydns.test.", Nameservers: []string{"127.0.0.1:53"}, MDNS: tc.mdns}
+		err := SetDefaults(config)
+		if tc.ok != (err == nil) {
+			t.Errorf("test %d: expected ok %t, got %v", i, tc.ok, err)
+		}
+	}
+	config := &Config{Domain: "skydns.test.", Nameservers: []string{"127.0.0.1:53"},
+		MDNS: &MDNS{Export: "lab.skydns.test", Import: "Devices.skydns.test."}}
+	SetDefaults(config)
+	if config.MDNS.Export != "lab.skydns.test." || config.MDNS.Import != "devices.skydns.test." {
+		t.Errorf("expected fully qualified, lowercased zones, got %+v", config.MDNS)
+	}
+}
+
+func mdnsReply(rrs ...string) *dns.Msg {
+	m := new(dns.Msg)
+	m.Response = true
+	for _, rr := range rrs {
+		r, _ := dns.NewRR(rr)
+		m.Answer = append(m.Answer, r)
+	}
+	return m
+}
+
+func TestMDNSImport(t *testing.T) {
+	config := &Config{Domain: "skydns.test.", Nameservers: []string{"127.0.0.1:53"}, MDNS: &MDNS{Import: "devices.skydns.test."}}
+	if err := SetDefaults(config); err != nil {
+		t.Fatal(err)
+	}
+	s := &server{config: config, mdns: newMDNSHosts(config.MDNS.Import)}
+	now := time.Now()
+
+	// CLASS32769 is IN with the cache-flush bit.
+	s.mdns.learn(mdnsReply(
+		"Printer.local. 120 IN A 192.168.1.10",
+		"printer.local. 120 IN AAAA fe80::10",
+		"scanner.lab.local. 60 IN A 192.168.1.11",
+		"printer.example.com. 120 IN A 192.168.1.12",
+		"printer.local. 120 IN TXT \"ignored\"",
+	), now)
+
+	lookup := func(name string, qtype uint16) []string {
+		q := dns.Question{Name: name, Qtype: qtype, Qclass: dns.ClassINET}
+		records, err := s.AddressRecords(q, name, nil, 512, false, false)
+		if err != nil {
+			t.Fatalf("%s: %s", name, err)
+		}
+		var addrs []string
+		for _, r := range records {
+			switch a := r.(type) {
+			case *dns.A:
+				addrs = append(addrs, a.A.String())
+			case *dns.AAAA:
+				addrs = append(addrs, a.AAAA.String())
+			}
+		}
+		return addrs
+	}
+	if addrs := lookup("printer.devices.skydns.test.", dns.TypeA); len(addrs) != 1 || addrs[0] != "192.168.1.10" {
+		t.Errorf("expected the address of the printer, got %v", addrs)
+	}
+	if addrs := lookup("printer.devices.skydns.test.", dns.TypeAAAA); len(addrs) != 1 || addrs[0] != "fe80::10" {
+		t.Errorf("expected the IPv6 address of the printer, got %v", addrs)
+	}
+	if addrs := lookup("scanner.lab.devices.skydns.test.", dns.TypeA); len(addrs) != 1 {
+		t.Errorf("expected the address of the scanner, got %v", addrs)
+	}
+	if sx, _ := s.mdns.records("devices.skydns.test.", false, now); len(sx) != 3 {
+		t.Errorf("expected 3 services in the zone, got %v", sx)
+	}
+	if _, ok := s.mdns.records("skydns.test.", false, now); ok {
+		t.Error("expected names outside the zone to go to the backend")
+	}
+
+	// Cache-flush replaces the addresses, a TTL of zero removes them.
+	s.mdns.learn(mdnsReply("printer.local. 120 CLASS32769 A 192.168.1.20"), now)
+	if addrs := lookup("printer.devices.skydns.test.", dns.TypeA); len(addrs) != 1 || addrs[0] != "192.168.1.20" {
+		t.Errorf("expected the new address of the printer, got %v", addrs)
+	}
+	s.mdns.learn(mdnsReply("printer.local. 0 IN AAAA fe80::10"), now)
+	if addrs := lookup("printer.devices.skydns.test.", dns.TypeAAAA); len(addrs) != 0 {
+		t.Errorf("expected the IPv6 address of the printer to be gone, got %v", addrs)
+	}
+
+	// Addresses expire with their TTL.
+	sx, _ := s.mdns.records("scanner.lab.devices.skydns.test.", true, now.Add(30*time.Second))
+	if len(sx) != 1 || sx[0].Ttl != 31 {
+		t.Errorf("expected the scanner with a TTL of 31, got %v", sx)
+	}
+	if sx, _ := s.mdns.records("scanner.lab.devices.skydns.test.", true, now.Add(time.Minute)); len(sx) != 0 {
+		t.Errorf("expected the scanner to be expired, got %v", sx)
+	}
+
+	// Hosts that are never looked up expire too, and no more than mdnsMaxHosts
+	// are learned.
+	s.mdns.learn(mdnsReply("camera.local. 60 IN A 192.168.1.30"), now.Add(time.Minute))
+	s.mdns.learn(mdnsReply("printer.local. 300 IN A 192.168.1.20"), now.Add(3*time.Minute))
+	if _, ok := s.mdns.hosts["camera."]; ok || len(s.mdns.hosts) != 1 {
+		t.Errorf("expected only the printer after expiry, got %v", s.mdns.hosts)
+	}
+	var rrs []string
+	for i := 0; i < mdnsMaxHosts+10; i++ {
+		rrs = append(rrs, fmt.Sprintf("host%d.local. 120 IN A 192.168.%d.%d", i, i/256, i%256))
+	}
+	s.mdns.learn(mdnsReply(rrs...), now.Add(3*time.Minute))
+	if len(s.mdns.hosts) != mdnsMaxHosts {
+		t.Errorf("expected %d hosts, got %d", mdnsMaxHosts, len(s.mdns.hosts))
+	}
+}
+
+func TestMDNSExport(t *testing.T) {
+	s := newUnstartedTestServer(t, false, func(s *server) {
+		s.config.MDNS = &MDNS{Export: "lab.skydns.test."}
+	})
+
+	serv := &msg.Service{Key: "a.nas.lab.skydns.test.", Host: "10.0.5.1"}
+	addService(t, s, serv.Key, 0, serv)
+	defer delService(t, s, serv.Key)
+
+	query := func(name string, qclass uint16, port int) (*dns.Msg, bool) {
+		m := new(dns.Msg)
+		m.Id = 0
+		m.Question = []dns.Question{{Name: name, Qtype: dns.TypeA, Qclass: qclass}}
+		return s.mdnsAnswer(m, &net.UDPAddr{IP: net.IPv4(192, 168, 1, 2), Port: port})
+	}
+
+	resp, unicast := query("NAS.local.", dns.ClassINET, 5353)
+	if resp == nil || unicast || len(resp.Answer) != 1 || len(resp.Question) != 0 {
+		t.Fatalf("expected a multicast reply with 1 answer, got %s", resp)
+	}
+	if a := resp.Answer[0].(*dns.A); a.Hdr.Name != "NAS.local." || a.Hdr.Ttl != mdnsTtl ||
+		a.Hdr.Class != dns.ClassINET|mdnsCacheFlush || a.A.String() != "10.0.5.1" {
+		t.Errorf("expected the address of nas with the cache-flush bit, got %s", a)
+	}
+
+	if resp, unicast := query("nas.local.", dns.ClassINET|mdnsCacheFlush, 5353); resp == nil || !unicast {
+		t.Errorf("expected a unicast reply for a QU question")
+	}
+
+	resp, unicast = query("nas.local.", dns.ClassINET, 40000)
+	if resp == nil || !unicast || len(resp.Question) != 1 || resp.Answer[0].Header().Ttl != mdnsLegacyTtl {
+		t.Errorf("expected a unicast DNS reply for a legacy query, got %s", resp)
+	}
+
+	if resp, _ := query("other.local.", dns.ClassINET, 5353); resp != nil {
+		t.Errorf("expected no reply for an unknown name, got %s", resp)
+	}
+	if resp, _ := query("nas.lab.skydns.test.", dns.ClassINET, 5353); resp != nil {
+		t.Errorf("expected no reply for a name not in local., got %s", resp)
+	}
+}
+
+func TestMDNSAnnounce(t *testing.T) {
+	s := newUnstartedTestServer(t, false, func(s *server) {
+		s.config.MDNS = &MDNS{Announce: true}
+		s.announced = new(mdnsServices)
+	})
+
+	for _, serv := range []*msg.Service{
+		{Key: "nas.announce.skydns.test.", Host: "10.0.6.1", Port: 445, Srv: "smb", Proto: "tcp", Mdns: true},
+		{Key: "printer.announce.skydns.test.", Host: "fe80::6", Mdns: true},
+		{Key: "hidden.announce.skydns.test.", Host: "10.0.6.3"},
+		{Key: "named.announce.skydns.test.", Host: "nas.announce.skydns.test.", Mdns: true},
+	} {
+		addService(t, s, serv.Key, 0, serv)
+		defer delService(t, s, serv.Key)
+	}
+
+	records, err := s.mdnsServiceRecords()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]bool{
+		"nas.local.\t120\tIN\tA\t10.0.6.1":                               true,
+		"printer.local.\t120\tIN\tAAAA\tfe80::6":                         true,
+		"_services._dns-sd._udp.local.\t4500\tIN\tPTR\t_smb._tcp.local.": true,
+		"_smb._tcp.local.\t4500\tIN\tPTR\tnas._smb._tcp.local.":          true,
+		"nas._smb._tcp.local.\t120\tIN\tSRV\t10 0 445 nas.local.":        true,
+		"nas._smb._tcp.local.\t4500\tIN\tTXT\t\"\"":                      true,
+	}
+	for _, r := range records {
+		if !want[r.String()] {
+			t.Errorf("unexpected record %s", r)
+		}
+		delete(want, r.String())
+	}
+	for r := range want {
+		t.Errorf("expected record %s", r)
+	}
+
+	s.announced.records = records
+	query := func(name string, qtype uint16, port int) *dns.Msg {
+		m := new(dns.Msg)
+		m.Question = []dns.Question{{Name: name, Qtype: qtype, Qclass: dns.ClassINET}}
+		resp, _ := s.mdnsAnswer(m, &net.UDPAddr{IP: net.IPv4(192, 168, 1, 2), Port: port})
+		return resp
+	}
+	resp := query("_smb._tcp.local.", dns.TypePTR, 5353)
+	if resp == nil || len(resp.Answer) != 1 || resp.Answer[0].Header().Class != dns.ClassINET {
+		t.Fatalf("expected a shared PTR record, got %s", resp)
+	}
+	resp = query("nas._smb._tcp.local.", dns.TypeANY, 5353)
+	if resp == nil || len(resp.Answer) != 2 || resp.Answer[0].Header().Class != dns.ClassINET|mdnsCacheFlush {
+		t.Fatalf("expected the SRV and TXT records with the cache-flush bit, got %s", resp)
+	}
+	resp = query("nas.local.", dns.TypeA, 40000)
+	if resp == nil || len(resp.Answer) != 1 || resp.Answer[0].Header().Ttl != mdnsLegacyTtl {
+		t.Errorf("expected the address for a legacy query, got %s", resp)
+	}
+	if resp := query("hidden.local.", dns.TypeA, 5353); resp != nil {
+		t.Errorf("expected no reply for a service that isn't announced, got %s", resp)
+	}
+
+	msgs := mdnsAnnouncements(records)
+	if len(msgs) != 1 || !msgs[0].Response || len(msgs[0].Answer) != len(records) {
+		t.Errorf("expected one announcement with all records, got %v", msgs)
+	}
+}
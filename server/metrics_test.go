@@ -9,7 +9,9 @@ import (
 	"io/ioutil"
 	"net/http"
 	"strconv"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/skynetservices/skydns/metrics"
 
@@ -58,14 +60,14 @@ func scrape(t *testing.T, key string) int {
 }
 
 func TestMetrics(t *testing.T) {
-	s := newTestServer(t, false)
-	defer s.Stop()
-
 	metrics.Port = "12300"
 	metrics.Subsystem = "test"
 	metrics.Namespace = "test"
 	metrics.Metrics()
 
+	s := newTestServer(t, false)
+	defer s.Stop()
+
 	query("miek.nl.", dns.TypeMX)
 	v0 := scrape(t, "test_test_dns_request_count_total{system=\"recursive\"}")
 	query("miek.nl.", dns.TypeMX)
@@ -75,3 +77,30 @@ func TestMetrics(t *testing.T) {
 		t.Fatalf("expecting %d, got %d", v0+1, v1)
 	}
 }
+
+func TestMetricsStageHook(t *testing.T) {
+	s := newTestServer(t, false)
+	defer s.Stop()
+
+	var mu sync.Mutex
+	seen := make(map[metrics.Stage]bool)
+	metrics.AddHook(func(st metrics.Stage, d time.Duration) {
+		mu.Lock()
+		seen[st] = true
+		mu.Unlock()
+	})
+
+	serv := services[0]
+	addService(t, s, serv.Key, 0, serv)
+	defer delService(t, s, serv.Key)
+
+	query(dnsTestCases[0].Qname, dnsTestCases[0].Qtype)
+
+	mu.Lock()
+	defer mu.Unlock()
+	for _, st := range []metrics.Stage{metrics.StageCache, metrics.StageBackend, metrics.StageGroup, metrics.StageWrite} {
+		if !seen[st] {
+			t.Errorf("expected stage %q to be reported", st)
+		}
+	}
+}
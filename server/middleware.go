@@ -0,0 +1,271 @@
+// Copyright (c) 2014 The SkyDNS Authors. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package server
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// Middleware is a stage of the query path: it returns a handler that does its part
+// and, unless it answers the query itself, passes the query on to next. Stages of
+// our own are built in, others are registered with RegisterMiddleware. A stage
+// that wraps the dns.ResponseWriter to see the reply must handle Write too: with
+// Config.PCacheTtl replies are written packed.
+type Middleware func(next dns.Handler) dns.Handler
+
+// DefaultMiddleware is the order of the stages, outermost first. The last ones
+// are the stages of the server itself, see serverMiddleware.
+var DefaultMiddleware = []string{"recover", "faults", "logging", "cookies", "acl", "hosts", "rewrite", "policy", "dns64", "cache", "dnssec"}
+
+// serverMiddleware are the stages of the server itself, in their order: they
+// are last in the chain, in front of the backend, and see its replies before the
+// other stages do. The cache answers from the response cache, dnssec signs the
+// answers from the backend.
+var serverMiddleware = []string{"cache", "dnssec"}
+
+// builtinMiddleware are our own stages, they do nothing unless configured.
+var builtinMiddleware = map[string]func(s *server, next dns.Handler) dns.Handler{
+	"recover": (*server).recoverHandler,
+	"faults":  func(s *server, next dns.Handler) dns.Handler { return faultHandler(next, s.config.Faults) },
+	"logging": (*server).logHandler,
+	"cookies": (*server).cookieHandler,
+	"acl":     (*server).aclHandler,
+	"hosts":   (*server).hostsHandler,
+	"rewrite": (*server).rewriteHandler,
+	"policy":  (*server).policyHandler,
+	"dns64":   (*server).dns64Handler,
+}
+
+var (
+	middlewareMu sync.Mutex
+	middlewares  = make(map[string]Middleware)
+)
+
+// RegisterMiddleware makes m available as a stage named name, to be added to
+// Config.Middleware. It panics when a stage with that name is registered twice.
+func RegisterMiddleware(name string, m Middleware) {
+	middlewareMu.Lock()
+	defer middlewareMu.Unlock()
+	if _, ok := builtinMiddleware[name]; ok {
+		panic("skydns: middleware registered twice: " + name)
+	}
+	if _, ok := middlewares[name]; ok {
+		panic("skydns: middleware registered twice: " + name)
+	}
+	middlewares[name] = m
+}
+
+func setMiddlewareDefaults(config *Config) error {
+	if len(config.Middleware) == 0 {
+		config.Middleware = append([]string(nil), DefaultMiddleware...)
+	}
+	middlewareMu.Lock()
+	defer middlewareMu.Unlock()
+	seen := make(map[string]bool)
+	for _, name := range config.Middleware {
+		if seen[name] {
+			return fmt.Errorf("middleware %q is in the chain twice", name)
+		}
+		seen[name] = true
+		if serverStage(name) >= 0 {
+			continue
+		}
+		if _, ok := builtinMiddleware[name]; ok {
+			continue
+		}
+		if _, ok := middlewares[name]; ok {
+			continue
+		}
+		names := make([]string, 0, len(builtinMiddleware)+len(middlewares))
+		for n := range builtinMiddleware {
+			names = append(names, n)
+		}
+		names = append(names, serverMiddleware...)
+		for n := range middlewares {
+			names = append(names, n)
+		}
+		sort.Strings(names)
+		return fmt.Errorf("unknown middleware %q, compiled in are: %q", name, names)
+	}
+	last := -1
+	for _, name := range config.Middleware {
+		i := serverStage(name)
+		if i < last {
+			return fmt.Errorf("middleware %q must come before %q, the stages of the server are last: %q", name, serverMiddleware[last], serverMiddleware)
+		}
+		if i >= 0 {
+			last = i
+		}
+	}
+	// Left out stages are disabled, but a configured policy, faults or a signed
+	// zone are not silently ignored.
+	for _, stage := range []struct {
+		name string
+		set  bool
+	}{
+		{"faults", config.Faults != nil && config.Faults.PacketLoss > 0},
+		{"policy", config.Policy != ""},
+		{"dnssec", config.DNSSEC != ""},
+	} {
+		if stage.set && !seen[stage.name] {
+			return fmt.Errorf("middleware %q is left out, but %s is configured", stage.name, stage.name)
+		}
+	}
+	config.queryNets = nil
+	for _, a := range config.QueryACL {
+		n, err := parseNet(a)
+		if err != nil {
+			return fmt.Errorf("invalid query_acl entry: %s", err)
+		}
+		config.queryNets = append(config.queryNets, n)
+	}
+	return nil
+}
+
+// serverStage returns the index of name in serverMiddleware, or -1 when it is
+// not a stage of the server.
+func serverStage(name string) int {
+	for i, n := range serverMiddleware {
+		if n == name {
+			return i
+		}
+	}
+	return -1
+}
+
+// chain returns h behind the stages in Config.Middleware, but those of the server
+// itself: h is the server, they are in front of its backend, see serverStages.
+func (s *server) chain(h dns.Handler) dns.Handler {
+	middlewareMu.Lock()
+	defer middlewareMu.Unlock()
+	for i := len(s.config.Middleware) - 1; i >= 0; i-- {
+		name := s.config.Middleware[i]
+		if serverStage(name) >= 0 {
+			continue
+		}
+		if m, ok := builtinMiddleware[name]; ok {
+			h = m(s, h)
+			continue
+		}
+		h = middlewares[name](h)
+	}
+	return h
+}
+
+// serverStages returns the backend behind the stages of the server itself. The
+// cache stage also fits the replies to the client, without "cache" in
+// Config.Middleware it does only that.
+func (s *server) serverStages() dns.Handler {
+	var h dns.Handler = dns.HandlerFunc(s.serveBackend)
+	cached := false
+	for _, name := range s.config.Middleware {
+		switch name {
+		case "dnssec":
+			h = s.dnssecHandler(h)
+		case "cache":
+			cached = true
+		}
+	}
+	return s.cacheHandler(h, cached)
+}
+
+// replyKind is what the backend replies to a query with, see setReply.
+type replyKind int
+
+const (
+	replyOther     replyKind = iota // written as is, and not cached
+	replyAnswer                     // an answer from our zone: signed, cached and fitted to the client
+	replyReferral                   // a referral, only its DS records are signed
+	replyForwarded                  // the reply of another nameserver, cached as is
+)
+
+// replyWriter is the writer of a stage of the server, see setReply.
+type replyWriter interface {
+	setReply(kind replyKind, scope uint8)
+}
+
+// setReply tells the stages of the server what the reply written to w next is.
+// A forwarded reply with a scope (see replyScope) is cached for the client's
+// subnet only.
+func setReply(w dns.ResponseWriter, kind replyKind, scope uint8) {
+	if rw, ok := w.(replyWriter); ok {
+		rw.setReply(kind, scope)
+	}
+}
+
+// recoverHandler protects next against panics when running strict.
+func (s *server) recoverHandler(next dns.Handler) dns.Handler {
+	if s.strict == nil {
+		return next
+	}
+	return recoverHandler{h: next, s: s}
+}
+
+// aclHandler refuses queries from clients outside Config.QueryACL.
+func (s *server) aclHandler(next dns.Handler) dns.Handler {
+	if len(s.config.queryNets) == 0 {
+		return next
+	}
+	return dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+		if inNets(s.config.queryNets, w.RemoteAddr()) {
+			next.ServeDNS(w, req)
+			return
+		}
+		m := new(dns.Msg)
+		m.SetRcode(req, dns.RcodeRefused)
+		if len(req.Question) > 0 {
+			s.explain(m, req, reasonQueryACL)
+		}
+		s.setEdns(m, req.IsEdns0())
+		w.WriteMsg(m)
+	})
+}
+
+// logHandler logs every query and its reply with Config.LogQueries.
+func (s *server) logHandler(next dns.Handler) dns.Handler {
+	if !s.config.LogQueries {
+		return next
+	}
+	return dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+		start := time.Now()
+		lw := &logWriter{ResponseWriter: w}
+		next.ServeDNS(lw, req)
+		if len(req.Question) == 0 {
+			return
+		}
+		q := req.Question[0]
+		if lw.msg == nil {
+			logf("query %s %s from %s: no reply in %s", q.Name, dns.TypeToString[q.Qtype], w.RemoteAddr(), time.Since(start))
+			return
+		}
+		logf("query %s %s from %s: %s with %d answers in %s", q.Name, dns.TypeToString[q.Qtype], w.RemoteAddr(),
+			dns.RcodeToString[lw.msg.Rcode], len(lw.msg.Answer), time.Since(start))
+	})
+}
+
+// logWriter remembers the reply written, for logHandler.
+type logWriter struct {
+	dns.ResponseWriter
+	msg *dns.Msg
+}
+
+func (w *logWriter) WriteMsg(m *dns.Msg) error {
+	w.msg = m
+	return w.ResponseWriter.WriteMsg(m)
+}
+
+// Write is used for replies from the packed cache.
+func (w *logWriter) Write(b []byte) (int, error) {
+	m := new(dns.Msg)
+	if m.Unpack(b) == nil {
+		w.msg = m
+	}
+	return w.ResponseWriter.Write(b)
+}
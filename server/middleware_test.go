@@ -0,0 +1,111 @@
+// Copyright (c) 2014 The SkyDNS Authors. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package server
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+// stages records the order the test stages ran in.
+var stages []string
+
+func testStage(name string) Middleware {
+	return func(next dns.Handler) dns.Handler {
+		return dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+			stages = append(stages, name)
+			next.ServeDNS(w, req)
+		})
+	}
+}
+
+func init() {
+	RegisterMiddleware("first", testStage("first"))
+	RegisterMiddleware("second", testStage("second"))
+}
+
+func TestMiddlewareChain(t *testing.T) {
+	reply := dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+		stages = append(stages, "server")
+		m := new(dns.Msg)
+		m.SetReply(req)
+		w.WriteMsg(m)
+	})
+
+	tests := []struct {
+		middleware []string
+		queryACL   []string
+		rcode      int
+		stages     []string
+	}{
+		{nil, nil, dns.RcodeSuccess, []string{"server"}},
+		{[]string{"first", "second"}, nil, dns.RcodeSuccess, []string{"first", "second", "server"}},
+		{[]string{"second", "logging", "first"}, nil, dns.RcodeSuccess, []string{"second", "first", "server"}},
+		{[]string{"first", "acl", "second"}, []string{"10.0.0.0/8"}, dns.RcodeRefused, []string{"first"}},
+		{[]string{"first", "acl", "second"}, []string{"127.0.0.1"}, dns.RcodeSuccess, []string{"first", "second", "server"}},
+		{[]string{"first", "second"}, []string{"10.0.0.0/8"}, dns.RcodeSuccess, []string{"first", "second", "server"}},
+	}
+	for i, tc := range tests {
+		config := &Config{Domain: "skydns.test.", Nameservers: []string{"127.0.0.1:53"},
+			Middleware: tc.middleware, QueryACL: tc.queryACL, LogQueries: true}
+		if err := SetDefaults(config); err != nil {
+			t.Fatalf("test %d: %s", i, err)
+		}
+		s := &server{config: config}
+
+		stages = nil
+		m := new(dns.Msg)
+		m.SetQuestion("www.skydns.test.", dns.TypeA)
+		w := &testWriter{}
+		s.handler(reply).ServeDNS(w, m)
+		if w.msg.Rcode != tc.rcode {
+			t.Errorf("test %d: expected rcode %d, got %d", i, tc.rcode, w.msg.Rcode)
+		}
+		if !reflect.DeepEqual(stages, tc.stages) {
+			t.Errorf("test %d: expected stages %v, got %v", i, tc.stages, stages)
+		}
+	}
+}
+
+func TestMiddlewareConfig(t *testing.T) {
+	tests := []struct {
+		middleware []string
+		ok         bool
+	}{
+		{nil, true},
+		{[]string{"acl", "first"}, true},
+		{[]string{"no-such-stage"}, false},
+		{[]string{"acl", "acl"}, false},
+		{[]string{"acl", "cache", "dnssec"}, true},
+		{[]string{"acl", "dnssec"}, true},
+		{[]string{"dnssec", "cache"}, false},
+		{[]string{"cache", "acl"}, false},
+	}
+	for i, tc := range tests {
+		config := &Config{Domain: "skydns.test.", Nameservers: []string{"127.0.0.1:53"}, Middleware: tc.middleware}
+		if err := SetDefaults(config); tc.ok != (err == nil) {
+			t.Errorf("test %d: expected ok %t, got error %v", i, tc.ok, err)
+		}
+	}
+
+	// Leaving out a stage that is configured is an error.
+	for i, config := range []*Config{
+		{Middleware: []string{"acl"}, Policy: "policy.json"},
+		{Middleware: []string{"acl"}, Faults: &Faults{PacketLoss: 0.1}},
+		{Middleware: []string{"acl", "cache"}, DNSSEC: "Kskydns.test.+005+49860"},
+	} {
+		if err := setMiddlewareDefaults(config); err == nil {
+			t.Errorf("test %d: expected an error for a left out stage", i)
+		}
+	}
+
+	config := &Config{Domain: "skydns.test.", Nameservers: []string{"127.0.0.1:53"}}
+	SetDefaults(config)
+	if !reflect.DeepEqual(config.Middleware, DefaultMiddleware) {
+		t.Errorf("expected middleware %v, got %v", DefaultMiddleware, config.Middleware)
+	}
+}
@@ -4,19 +4,40 @@
 
 package server
 
-import "github.com/miekg/dns"
-
-// Fit will make m fit the size. If a message is larger than size then entire
-// additional section is dropped. If it is still to large and the transport
-// is udp we return a truncated message.
-// If the transport is tcp we are going to drop RR from the answer section
-// until it fits. When this is case the returned bool is true.
+import (
+	"sort"
+
+	"github.com/miekg/dns"
+)
+
+// Fit will make m fit the size. If a message is larger than size then records
+// are dropped from the end of the additional section first, the OPT record is
+// always kept. If it is still too large and the transport is udp we return a
+// truncated message.
+// Answer RRs are dropped from the end until the message fits, the answer
+// section is never emptied completely. When this is case the returned bool
+// is true.
 func Fit(m *dns.Msg, size int, tcp bool) (*dns.Msg, bool) {
-	if m.Len() > size {
-		// Check for OPT Records at the end and keep those. TODO(miek)
-		m.Extra = nil
+	if m.Len() <= size {
+		return m, false
 	}
-	if m.Len() < size {
+
+	var extra, opt []dns.RR
+	for _, r := range m.Extra {
+		if r.Header().Rrtype == dns.TypeOPT {
+			opt = append(opt, r)
+			continue
+		}
+		extra = append(extra, r)
+	}
+	// Len takes compression into account, so search for the number of additional
+	// records that fits instead of computing it from the records' sizes.
+	n := sort.Search(len(extra), func(i int) bool {
+		m.Extra = append(extra[:i+1:i+1], opt...)
+		return m.Len() > size
+	})
+	m.Extra = append(extra[:n:n], opt...)
+	if n > 0 || m.Len() <= size {
 		return m, false
 	}
 
@@ -27,28 +48,15 @@ func Fit(m *dns.Msg, size int, tcp bool) (*dns.Msg, bool) {
 		// fit the udp buffer.
 	}
 
-	// Additional section is gone, binary search until we have length that fits.
-	min, max := 0, len(m.Answer)
-	original := make([]dns.RR, len(m.Answer))
-	copy(original, m.Answer)
-	for {
-		if min == max {
-			break
-		}
-
-		mid := (min + max) / 2
-		m.Answer = original[:mid]
-
-		if m.Len() < size {
-			min++
-			continue
-		}
-		max = mid
-
-	}
-	if max > 1 {
-		max--
+	// Additional section is gone, search for the largest number of answers that fits.
+	original := m.Answer
+	n = sort.Search(len(original), func(i int) bool {
+		m.Answer = original[:i+1]
+		return m.Len() > size
+	})
+	if n == 0 {
+		n = 1
 	}
-	m.Answer = m.Answer[:max]
+	m.Answer = original[:n]
 	return m, true
 }
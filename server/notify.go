@@ -0,0 +1,83 @@
+// Copyright (c) 2014 The SkyDNS Authors. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package server
+
+import (
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// ServeDNSNotify handles a NOTIFY (RFC 1996) for our domain, a zone below it or a
+// stub zone. The cached responses for names in the zone are removed, so the
+// following queries get fresh answers, from the backend or from the stub zone's
+// nameservers. Only clients in the notify ACL may send a NOTIFY.
+func (s *server) ServeDNSNotify(w dns.ResponseWriter, req *dns.Msg) *dns.Msg {
+	m := new(dns.Msg)
+	m.SetReply(req)
+	m.Authoritative = true
+	defer func() {
+		s.setEdns(m, req.IsEdns0())
+		w.WriteMsg(m)
+	}()
+
+	q := req.Question[0]
+	zone := strings.ToLower(q.Name)
+	switch {
+	case len(s.config.notifyNets) == 0 || !inNets(s.config.notifyNets, w.RemoteAddr()):
+		logf("refusing NOTIFY for %s from %s", zone, w.RemoteAddr())
+		m.SetRcode(req, dns.RcodeRefused)
+		s.explain(m, req, reasonNotifyACL)
+		return m
+	case s.config.tsigRequired["notify"] && !signed(w):
+		logf("refusing unsigned NOTIFY for %s from %s", zone, w.RemoteAddr())
+		m.SetRcode(req, dns.RcodeRefused)
+		s.explain(m, req, reasonTsigRequired)
+		return m
+	case q.Qtype != dns.TypeSOA || q.Qclass != dns.ClassINET:
+		m.SetRcode(req, dns.RcodeFormatError)
+		s.explain(m, req, reasonNotifyQuery)
+		return m
+	case !s.notifyZone(zone):
+		m.SetRcode(req, dns.RcodeNotAuth)
+		s.explain(m, req, reasonNotifyNotAuth)
+		return m
+	}
+
+	n := s.flushZone(zone)
+	if s.config.Verbose {
+		logf("NOTIFY for %s from %s, removed %d cached responses", zone, w.RemoteAddr(), n)
+	}
+	return m
+}
+
+// flushZone removes the cached responses for names in zone, it returns how many
+// there were in the response caches.
+func (s *server) flushZone(zone string) int {
+	inZone := func(c *dns.Msg) bool {
+		return len(c.Question) > 0 && dns.IsSubDomain(zone, strings.ToLower(c.Question[0].Name))
+	}
+	inZonePacked := func(name string) bool { return dns.IsSubDomain(zone, name) }
+	n := s.rcache.RemoveFunc(inZone)
+	if s.pcache != nil {
+		s.pcache.RemoveFunc(inZonePacked)
+	}
+	for _, v := range s.views {
+		n += v.rcache.RemoveFunc(inZone)
+		if v.pcache != nil {
+			v.pcache.RemoveFunc(inZonePacked)
+		}
+	}
+	return n
+}
+
+// notifyZone returns true if we accept a NOTIFY for zone.
+func (s *server) notifyZone(zone string) bool {
+	if dns.IsSubDomain(s.config.Domain, zone) {
+		return true
+	}
+	_, ok := (*s.config.stub)[zone]
+	return ok
+}
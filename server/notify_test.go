@@ -0,0 +1,79 @@
+// Copyright (c) 2014 The SkyDNS Authors. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package server
+
+import (
+	"net"
+	"testing"
+
+	"github.com/skynetservices/skydns/cache"
+
+	"github.com/miekg/dns"
+)
+
+func TestNotify(t *testing.T) {
+	s := newTestServer(t, true)
+	defer s.Stop()
+
+	for _, serv := range services {
+		addService(t, s, serv.Key, 0, serv)
+		defer delService(t, s, serv.Key)
+	}
+
+	notify := func(zone string) *dns.Msg {
+		m := new(dns.Msg)
+		m.SetNotify(zone)
+		w := &testWriter{}
+		s.ServeDNS(w, m)
+		return w.msg
+	}
+	q := dns.Question{Name: "a.ipaddr.skydns.test.", Qtype: dns.TypeA, Qclass: dns.ClassINET}
+	query := func() {
+		m := new(dns.Msg)
+		m.SetQuestion(q.Name, q.Qtype)
+		s.ServeDNS(&testWriter{}, m)
+		if s.rcache.Hit(q, false, false, 1) == nil {
+			t.Fatalf("expected %s to be cached", q.Name)
+		}
+	}
+
+	query()
+	if resp := notify("skydns.test."); resp.Rcode != dns.RcodeRefused {
+		t.Fatalf("expected REFUSED without a notify ACL, got %s", resp)
+	}
+
+	_, n, _ := net.ParseCIDR("127.0.0.0/8")
+	s.config.notifyNets = []*net.IPNet{n}
+	if resp := notify("example.org."); resp.Rcode != dns.RcodeNotAuth {
+		t.Fatalf("expected NOTAUTH for a zone that is not ours, got %s", resp)
+	}
+	if s.rcache.Hit(q, false, false, 1) == nil {
+		t.Fatalf("expected %s to be cached", q.Name)
+	}
+
+	resp := notify("ipaddr.skydns.test.")
+	if resp.Rcode != dns.RcodeSuccess || resp.Opcode != dns.OpcodeNotify || !resp.Authoritative {
+		t.Fatalf("expected an authoritative NOTIFY reply, got %s", resp)
+	}
+	if s.rcache.Hit(q, false, false, 1) != nil {
+		t.Fatalf("expected %s to be removed from the cache", q.Name)
+	}
+
+	// A NOTIFY for another zone leaves our cached responses.
+	query()
+	stub := dns.Question{Name: "stub.example.org.", Qtype: dns.TypeA, Qclass: dns.ClassINET}
+	s.rcache.InsertMessage(cache.Key(stub, false, false), new(dns.Msg).SetQuestion(stub.Name, stub.Qtype))
+	*s.config.stub = map[string][]string{"example.org.": {"127.0.0.1:53"}}
+	defer func() { *s.config.stub = map[string][]string{} }()
+	if resp := notify("example.org."); resp.Rcode != dns.RcodeSuccess {
+		t.Fatalf("expected NOERROR for a stub zone, got %s", resp)
+	}
+	if s.rcache.Hit(stub, false, false, 1) != nil {
+		t.Fatalf("expected %s to be removed from the cache", stub.Name)
+	}
+	if s.rcache.Hit(q, false, false, 1) == nil {
+		t.Fatalf("expected %s to be cached", q.Name)
+	}
+}
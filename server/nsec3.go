@@ -18,22 +18,24 @@ import (
 // Idem for source of synthesis.
 
 func (s *server) Denial(m *dns.Msg) {
+	// The name denied is the one at the end of a CNAME chain.
+	name := chainEnd(m)
 	if m.Rcode == dns.RcodeNameError {
 		// ce is qname minus the left label
-		idx := dns.Split(m.Question[0].Name)
-		ce := m.Question[0].Name[idx[1]:]
+		idx := dns.Split(name)
+		ce := name[idx[1]:]
 
 		nsec3ce, nsec3wildcard := newNSEC3CEandWildcard(s.config.Domain, ce, s.config.MinTtl)
 		// Add ce and wildcard
 		m.Ns = append(m.Ns, nsec3ce)
 		m.Ns = append(m.Ns, nsec3wildcard)
 		// Deny Qname nsec3
-		m.Ns = append(m.Ns, s.newNSEC3NameError(m.Question[0].Name))
+		m.Ns = append(m.Ns, s.newNSEC3NameError(name))
 	}
 	if m.Rcode == dns.RcodeSuccess && len(m.Ns) == 1 {
 		// NODATA
 		if _, ok := m.Ns[0].(*dns.SOA); ok {
-			m.Ns = append(m.Ns, s.newNSEC3NoData(m.Question[0].Name))
+			m.Ns = append(m.Ns, s.newNSEC3NoData(name))
 		}
 	}
 }
@@ -0,0 +1,169 @@
+// Copyright (c) 2014 The SkyDNS Authors. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/miekg/dns"
+)
+
+// Policy is a site-specific query policy, compiled into SkyDNS and selected with
+// Config.Policy. Register one with RegisterPolicy, from the init function of a
+// file added to the main package, and there is no need to fork the server.
+//
+// Both methods are called for every query, from many goroutines at once. Returning
+// an error refuses the query. The client's address is the one in its client subnet
+// option when it is trusted with it, see ClientSubnet.
+type Policy interface {
+	// Query is called with the client's address and the question before the query
+	// is resolved. It returns the name to resolve instead of name, or name itself.
+	Query(client net.IP, name string, qtype uint16) (string, error)
+	// Answer is called with the answer section of the reply, with names as the
+	// client asked for them. It returns the records to answer with. The records
+	// may be cached, copy one with dns.Copy before changing it.
+	Answer(client net.IP, name string, qtype uint16, answer []dns.RR) ([]dns.RR, error)
+}
+
+// ErrRefused may be returned by a Policy to refuse a query.
+var ErrRefused = errors.New("refused by policy")
+
+var (
+	policyMu sync.Mutex
+	policies = make(map[string]Policy)
+)
+
+// RegisterPolicy makes p available as Config.Policy name. It panics when a policy
+// with that name is registered twice.
+func RegisterPolicy(name string, p Policy) {
+	policyMu.Lock()
+	defer policyMu.Unlock()
+	if _, ok := policies[name]; ok {
+		panic("skydns: policy registered twice: " + name)
+	}
+	policies[name] = p
+}
+
+func setPolicyDefaults(config *Config) error {
+	config.policy = nil
+	if config.Policy == "" {
+		return nil
+	}
+	policyMu.Lock()
+	defer policyMu.Unlock()
+	p, ok := policies[config.Policy]
+	if !ok {
+		names := make([]string, 0, len(policies))
+		for n := range policies {
+			names = append(names, n)
+		}
+		sort.Strings(names)
+		return fmt.Errorf("unknown policy %q, compiled in are: %q", config.Policy, names)
+	}
+	config.policy = p
+	return nil
+}
+
+// policyHandler returns h with the configured policy applied to its queries, or h
+// itself when there is none.
+func (s *server) policyHandler(h dns.Handler) dns.Handler {
+	if s.config.policy == nil {
+		return h
+	}
+	return policyHandler{h: h, s: s, p: s.config.policy}
+}
+
+type policyHandler struct {
+	h dns.Handler
+	s *server
+	p Policy
+}
+
+func (ph policyHandler) ServeDNS(w dns.ResponseWriter, req *dns.Msg) {
+	if len(req.Question) != 1 {
+		ph.h.ServeDNS(w, req)
+		return
+	}
+	q := req.Question[0]
+	client := ph.s.clientIP(w, req)
+
+	name, err := ph.p.Query(client, q.Name, q.Qtype)
+	if err != nil {
+		ph.refuse(w, req, err)
+		return
+	}
+	pw := &policyWriter{ResponseWriter: w, ph: ph, client: client, req: req, name: dns.Fqdn(name)}
+	if strings.EqualFold(pw.name, q.Name) {
+		ph.h.ServeDNS(pw, req)
+		return
+	}
+	pw.rewritten = true
+	r := req.Copy()
+	r.Question[0].Name = pw.name
+	ph.h.ServeDNS(pw, r)
+}
+
+// refuse answers req with REFUSED, because the policy returned err.
+func (ph policyHandler) refuse(w dns.ResponseWriter, req *dns.Msg, err error) {
+	if ph.s.config.Verbose {
+		logf("policy refused %q from %s: %s", req.Question[0].Name, w.RemoteAddr(), err)
+	}
+	m := new(dns.Msg)
+	m.SetRcode(req, dns.RcodeRefused)
+	ph.s.explain(m, req, reasonPolicy)
+	ph.s.setEdns(m, req.IsEdns0())
+	w.WriteMsg(m)
+}
+
+// policyWriter hands the reply to the policy before writing it. When the question
+// was rewritten, the reply is given the client's question back. Replies may be
+// cached after they are written, so they are never changed in place.
+type policyWriter struct {
+	dns.ResponseWriter
+	ph        policyHandler
+	client    net.IP
+	req       *dns.Msg // as sent by the client
+	name      string   // resolved instead of the client's name
+	rewritten bool
+}
+
+func (w *policyWriter) WriteMsg(m *dns.Msg) error {
+	q := w.req.Question[0]
+	if w.rewritten {
+		m = renamed(m, w.req, func(owner string) string {
+			if strings.EqualFold(owner, w.name) {
+				return q.Name
+			}
+			return owner
+		})
+	} else {
+		c := *m
+		c.Answer = append([]dns.RR(nil), m.Answer...)
+		m = &c
+	}
+	answer, err := w.ph.p.Answer(w.client, q.Name, q.Qtype, m.Answer)
+	if err != nil {
+		w.ph.refuse(w.ResponseWriter, w.req, err)
+		return nil
+	}
+	m.Answer = answer
+	return w.ResponseWriter.WriteMsg(m)
+}
+
+// remoteIP returns the address of the client on w.
+func remoteIP(w dns.ResponseWriter) net.IP {
+	switch a := w.RemoteAddr().(type) {
+	case *net.UDPAddr:
+		return a.IP
+	case *net.TCPAddr:
+		return a.IP
+	}
+	return nil
+}
@@ -0,0 +1,114 @@
+// Copyright (c) 2014 The SkyDNS Authors. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package server
+
+import (
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+// testPolicy refuses blocked.example.org., resolves old.skydns.test. as
+// new.skydns.test. and drops 10.0.0.2 from answers for clients other than
+// 127.0.0.2.
+type testPolicy struct{}
+
+func (testPolicy) Query(client net.IP, name string, qtype uint16) (string, error) {
+	switch name {
+	case "blocked.example.org.":
+		return "", ErrRefused
+	case "old.skydns.test.":
+		return "new.skydns.test.", nil
+	}
+	return name, nil
+}
+
+func (testPolicy) Answer(client net.IP, name string, qtype uint16, answer []dns.RR) ([]dns.RR, error) {
+	if name == "hidden.skydns.test." {
+		return nil, ErrRefused
+	}
+	var rrs []dns.RR
+	for _, rr := range answer {
+		if a, ok := rr.(*dns.A); ok && a.A.Equal(net.IPv4(10, 0, 0, 2)) && !client.Equal(net.IPv4(127, 0, 0, 2)) {
+			continue
+		}
+		rrs = append(rrs, rr)
+	}
+	return rrs, nil
+}
+
+func init() { RegisterPolicy("test", testPolicy{}) }
+
+func TestPolicy(t *testing.T) {
+	config := &Config{Domain: "skydns.test.", Nameservers: []string{"127.0.0.1:53"}, Policy: "test"}
+	if err := SetDefaults(config); err != nil {
+		t.Fatal(err)
+	}
+	s := &server{config: config}
+
+	var asked string
+	h := s.policyHandler(dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+		asked = req.Question[0].Name
+		m := new(dns.Msg)
+		m.SetReply(req)
+		for _, ip := range []string{"10.0.0.1", "10.0.0.2"} {
+			m.Answer = append(m.Answer, &dns.A{
+				Hdr: dns.RR_Header{Name: req.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 3600},
+				A:   net.ParseIP(ip),
+			})
+		}
+		w.WriteMsg(m)
+	}))
+
+	tests := []struct {
+		name   string
+		asked  string // name the handler is asked, empty when it is not
+		rcode  int
+		answer int
+	}{
+		{"www.skydns.test.", "www.skydns.test.", dns.RcodeSuccess, 1},
+		{"old.skydns.test.", "new.skydns.test.", dns.RcodeSuccess, 1},
+		{"blocked.example.org.", "", dns.RcodeRefused, 0},
+		{"hidden.skydns.test.", "hidden.skydns.test.", dns.RcodeRefused, 0},
+	}
+	for i, tc := range tests {
+		asked = ""
+		m := new(dns.Msg)
+		m.SetQuestion(tc.name, dns.TypeA)
+		w := &testWriter{}
+		h.ServeDNS(w, m)
+		if asked != tc.asked {
+			t.Errorf("test %d: expected the handler to be asked %q, got %q", i, tc.asked, asked)
+		}
+		if w.msg.Rcode != tc.rcode {
+			t.Errorf("test %d: expected rcode %d, got %d", i, tc.rcode, w.msg.Rcode)
+			continue
+		}
+		if w.msg.Question[0].Name != tc.name {
+			t.Errorf("test %d: expected question %s, got %s", i, tc.name, w.msg.Question[0].Name)
+		}
+		if len(w.msg.Answer) != tc.answer {
+			t.Errorf("test %d: expected %d answers, got %d", i, tc.answer, len(w.msg.Answer))
+			continue
+		}
+		for _, rr := range w.msg.Answer {
+			if rr.Header().Name != tc.name {
+				t.Errorf("test %d: expected answer for %s, got %s", i, tc.name, rr)
+			}
+		}
+	}
+}
+
+func TestPolicyConfig(t *testing.T) {
+	config := &Config{Domain: "skydns.test.", Nameservers: []string{"127.0.0.1:53"}, Policy: "no-such-policy"}
+	if err := SetDefaults(config); err == nil {
+		t.Errorf("expected an error for an unknown policy")
+	}
+	config.Policy = ""
+	if err := SetDefaults(config); err != nil || config.policy != nil {
+		t.Errorf("expected no policy, got %v (%v)", config.policy, err)
+	}
+}
@@ -0,0 +1,104 @@
+// Copyright (c) 2014 The SkyDNS Authors. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package server
+
+import (
+	"github.com/skynetservices/skydns/metrics"
+
+	"github.com/miekg/dns"
+)
+
+// workerPool handles queries on a fixed number of goroutines. Queries wait in a
+// bounded queue for a free worker.
+type workerPool struct {
+	queue chan func()
+}
+
+func newWorkerPool(workers, queue int) *workerPool {
+	p := &workerPool{queue: make(chan func(), queue)}
+	for i := 0; i < workers; i++ {
+		go p.work()
+	}
+	return p
+}
+
+func (p *workerPool) work() {
+	for f := range p.queue {
+		f()
+	}
+}
+
+// submit queues f for the next free worker. If all workers are busy and the
+// queue is full, f is not queued and false is returned.
+func (p *workerPool) submit(f func()) bool {
+	select {
+	case p.queue <- f:
+		return true
+	default:
+		return false
+	}
+}
+
+// busy returns true when the queue is more than half full.
+func (p *workerPool) busy() bool {
+	return 2*len(p.queue) > cap(p.queue)
+}
+
+// poolHandler is a dns.Handler that hands queries to a workerPool. When the pool
+// is saturated queries are shed: they are refused or dropped.
+type poolHandler struct {
+	h    dns.Handler
+	pool *workerPool
+	drop bool
+	s    *server // explains why queries are refused
+}
+
+// ServeDNS queues the query in the worker pool and waits until it is handled.
+func (p *poolHandler) ServeDNS(w dns.ResponseWriter, req *dns.Msg) {
+	done := make(chan struct{})
+	if !p.pool.submit(func() { p.h.ServeDNS(w, req); close(done) }) {
+		p.shed(w, req)
+		return
+	}
+	<-done
+}
+
+// shed refuses req, or when drop is set, does not reply at all.
+func (p *poolHandler) shed(w dns.ResponseWriter, req *dns.Msg) {
+	metrics.ReportShedCount()
+	if p.drop {
+		return
+	}
+	m := new(dns.Msg)
+	m.SetRcode(req, dns.RcodeRefused)
+	if len(req.Question) > 0 {
+		p.s.explain(m, req, reasonOverloaded)
+	}
+	p.s.setEdns(m, req.IsEdns0())
+	w.WriteMsg(m)
+}
+
+// shedBatched sheds the packed query b.
+func (p *poolHandler) shedBatched(w dns.ResponseWriter, b []byte) {
+	if p.drop {
+		metrics.ReportShedCount()
+		return
+	}
+	req := new(dns.Msg)
+	if err := req.Unpack(b); err != nil || req.Response {
+		return
+	}
+	p.shed(w, req)
+}
+
+// handler returns h behind the middleware chain, wrapped in a poolHandler when a
+// worker pool is configured. The pool always comes first, see udp_linux.go.
+func (s *server) handler(h dns.Handler) dns.Handler {
+	h = s.chain(h)
+	if s.pool == nil {
+		return h
+	}
+	return &poolHandler{h: h, pool: s.pool, drop: s.config.ShedDrop, s: s}
+}
@@ -0,0 +1,82 @@
+// Copyright (c) 2014 The SkyDNS Authors. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package server
+
+import (
+	"net"
+	"runtime"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+type testWriter struct {
+	dns.ResponseWriter
+	msg *dns.Msg
+}
+
+func (w *testWriter) WriteMsg(m *dns.Msg) error { w.msg = m; return nil }
+func (w *testWriter) RemoteAddr() net.Addr      { return &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)} }
+func (w *testWriter) Write(b []byte) (int, error) {
+	w.msg = new(dns.Msg)
+	return len(b), w.msg.Unpack(b)
+}
+
+func TestWorkerPoolShed(t *testing.T) {
+	block := make(chan struct{})
+	busy := make(chan struct{})
+	h := dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+		busy <- struct{}{}
+		<-block
+		m := new(dns.Msg)
+		m.SetReply(req)
+		w.WriteMsg(m)
+	})
+
+	for _, drop := range []bool{false, true} {
+		p := &poolHandler{h: h, pool: newWorkerPool(1, 1), drop: drop, s: &server{config: &Config{ExtendedErrors: true}}}
+
+		req := new(dns.Msg)
+		req.SetQuestion("www.skydns.test.", dns.TypeA)
+		req.SetEdns0(4096, false)
+
+		var ws [2]*testWriter
+		var done [2]chan struct{}
+		for i := range ws {
+			ws[i], done[i] = &testWriter{}, make(chan struct{})
+			go func(i int) { p.ServeDNS(ws[i], req); close(done[i]) }(i)
+			if i == 0 {
+				<-busy
+			}
+		}
+		for len(p.pool.queue) == 0 {
+			runtime.Gosched()
+		}
+
+		// The only worker is busy and the queue is full, so this one is shed.
+		shed := &testWriter{}
+		p.ServeDNS(shed, req)
+		switch {
+		case drop && shed.msg != nil:
+			t.Errorf("expected shed query to be dropped, got %v", shed.msg)
+		case !drop && (shed.msg == nil || shed.msg.Rcode != dns.RcodeRefused):
+			t.Errorf("expected shed query to be refused, got %v", shed.msg)
+		case !drop:
+			if _, text, _ := extendedError(shed.msg); text != "overloaded" {
+				t.Errorf("expected shed query to be explained, got %q", text)
+			}
+		}
+
+		block <- struct{}{}
+		<-busy
+		block <- struct{}{}
+		for i := range ws {
+			<-done[i]
+			if ws[i].msg == nil || ws[i].msg.Rcode != dns.RcodeSuccess {
+				t.Errorf("expected query %d to be answered, got %v", i, ws[i].msg)
+			}
+		}
+	}
+}
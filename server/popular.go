@@ -0,0 +1,163 @@
+// Copyright (c) 2014 The SkyDNS Authors. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	// popularSave is how often the most popular questions are written to disk.
+	popularSave = time.Minute
+	// maxPopular is the number of questions we count, beyond that new questions
+	// are not counted until the next save.
+	maxPopular = 1 << 16
+)
+
+// popularity counts how often questions are asked. See Config.PopularFile.
+type popularity struct {
+	sync.Mutex
+	count map[dns.Question]uint64
+}
+
+func newPopularity() *popularity {
+	return &popularity{count: make(map[dns.Question]uint64)}
+}
+
+// add counts q.
+func (p *popularity) add(q dns.Question) {
+	q.Name = strings.ToLower(q.Name)
+	p.Lock()
+	if n, ok := p.count[q]; ok || len(p.count) < maxPopular {
+		p.count[q] = n + 1
+	}
+	p.Unlock()
+}
+
+// top returns the n most asked questions, most asked first. The counts are
+// halved, so older queries count less with every call.
+func (p *popularity) top(n int) []dns.Question {
+	p.Lock()
+	qs := make([]dns.Question, 0, len(p.count))
+	count := make(map[dns.Question]uint64, len(p.count))
+	for q, c := range p.count {
+		qs = append(qs, q)
+		count[q] = c
+		if c /= 2; c == 0 {
+			delete(p.count, q)
+		} else {
+			p.count[q] = c
+		}
+	}
+	p.Unlock()
+
+	sort.Slice(qs, func(i, j int) bool {
+		if count[qs[i]] != count[qs[j]] {
+			return count[qs[i]] > count[qs[j]]
+		}
+		return qs[i].Name < qs[j].Name || qs[i].Name == qs[j].Name && qs[i].Qtype < qs[j].Qtype
+	})
+	if len(qs) > n {
+		qs = qs[:n]
+	}
+	return qs
+}
+
+// writePopular writes the questions in qs to file, one "name type" per line.
+func writePopular(file string, qs []dns.Question) error {
+	var b bytes.Buffer
+	for _, q := range qs {
+		fmt.Fprintf(&b, "%s %s\n", q.Name, dns.TypeToString[q.Qtype])
+	}
+	// Write and rename, so a crash doesn't leave half a file.
+	tmp, err := ioutil.TempFile(filepath.Dir(file), filepath.Base(file))
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(b.Bytes()); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), file)
+}
+
+// readPopular reads the questions written by writePopular from file.
+func readPopular(file string) ([]dns.Question, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var qs []dns.Question
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 2 {
+			continue
+		}
+		qtype, ok := dns.StringToType[fields[1]]
+		if _, isName := dns.IsDomainName(fields[0]); !ok || !isName {
+			continue
+		}
+		qs = append(qs, dns.Question{Name: dns.Fqdn(fields[0]), Qtype: qtype, Qclass: dns.ClassINET})
+	}
+	return qs, scanner.Err()
+}
+
+// prewarm answers a query for each of the questions saved in the popular file,
+// so the response cache is warm before we start listening. It returns the number
+// of names that were queried.
+func (s *server) prewarm() (int, error) {
+	qs, err := readPopular(s.config.PopularFile)
+	if err != nil {
+		return 0, err
+	}
+	w := discardWriter()
+	for _, q := range qs {
+		req := new(dns.Msg)
+		req.SetQuestion(q.Name, q.Qtype)
+		s.ServeDNS(w, req)
+	}
+	return len(qs), nil
+}
+
+// runPopular prewarms the cache and logs the outcome, then it saves the most
+// popular questions every popularSave. Failing to prewarm is not fatal, there
+// is no file on our first start.
+func (s *server) runPopular() {
+	start := time.Now()
+	if n, err := s.prewarm(); err != nil {
+		if !os.IsNotExist(err) {
+			logf("failure to prewarm from %s: %q", s.config.PopularFile, err)
+		}
+	} else {
+		logf("prewarmed %d names in %s", n, time.Since(start))
+	}
+
+	go func() {
+		for range time.Tick(popularSave) {
+			if err := writePopular(s.config.PopularFile, s.popular.top(s.config.PopularCount)); err != nil {
+				logf("failure to save popular names to %s: %q", s.config.PopularFile, err)
+			}
+		}
+	}()
+}
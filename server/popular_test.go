@@ -0,0 +1,87 @@
+// Copyright (c) 2014 The SkyDNS Authors. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package server
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestPopular(t *testing.T) {
+	p := newPopularity()
+	q := func(name string, qtype uint16) dns.Question {
+		return dns.Question{Name: name, Qtype: qtype, Qclass: dns.ClassINET}
+	}
+	for i := 0; i < 3; i++ {
+		p.add(q("a.skydns.test.", dns.TypeA))
+	}
+	p.add(q("B.skydns.test.", dns.TypeSRV))
+	p.add(q("b.skydns.test.", dns.TypeSRV))
+	p.add(q("c.skydns.test.", dns.TypeAAAA))
+
+	expected := []dns.Question{q("a.skydns.test.", dns.TypeA), q("b.skydns.test.", dns.TypeSRV)}
+	top := p.top(2)
+	if !reflect.DeepEqual(top, expected) {
+		t.Fatalf("expected %v, got %v", expected, top)
+	}
+	// Counts are halved, c is forgotten.
+	if len(p.count) != 2 {
+		t.Fatalf("expected %d counted questions, got %d", 2, len(p.count))
+	}
+
+	dir, err := ioutil.TempDir("", "skydns")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "popular")
+	if err := writePopular(file, top); err != nil {
+		t.Fatal(err)
+	}
+	read, err := readPopular(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(read, expected) {
+		t.Fatalf("expected %v, got %v", expected, read)
+	}
+}
+
+func TestPrewarm(t *testing.T) {
+	s := newTestServer(t, true)
+	defer s.Stop()
+
+	for _, serv := range services[:5] {
+		addService(t, s, serv.Key, 0, serv)
+		defer delService(t, s, serv.Key)
+	}
+
+	dir, err := ioutil.TempDir("", "skydns")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	s.config.PopularFile = filepath.Join(dir, "popular")
+
+	q := dns.Question{Name: services[4].Key, Qtype: dns.TypeA, Qclass: dns.ClassINET}
+	if err := writePopular(s.config.PopularFile, []dns.Question{q}); err != nil {
+		t.Fatal(err)
+	}
+	n, err := s.prewarm()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 {
+		t.Fatalf("expected %d name to be prewarmed, got %d", 1, n)
+	}
+	if m := s.rcache.Hit(q, false, false, 1); m == nil {
+		t.Errorf("expected %s/%d to be cached", q.Name, q.Qtype)
+	}
+}
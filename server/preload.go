@@ -0,0 +1,72 @@
+// Copyright (c) 2014 The SkyDNS Authors. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package server
+
+import (
+	"net"
+	"time"
+
+	"github.com/skynetservices/skydns/msg"
+
+	"github.com/miekg/dns"
+)
+
+// preload scans all services in our domain and answers a query for each of them,
+// so the backend connection and the response cache are warm before we start
+// listening. It returns the number of names that were queried.
+func (s *server) preload() (int, error) {
+	services, err := s.backend.Records(s.config.Domain, false)
+	if err != nil {
+		return 0, err
+	}
+	services = expandHosts(services)
+
+	w := discardWriter()
+	seen := make(map[dns.Question]bool)
+	for _, serv := range services {
+		name := msg.Domain(serv.Key)
+		qtypes := []uint16{dns.TypeSRV}
+		if ip := net.ParseIP(serv.Host); ip != nil {
+			if ip.To4() != nil {
+				qtypes = append(qtypes, dns.TypeA)
+			} else {
+				qtypes = append(qtypes, dns.TypeAAAA)
+			}
+		}
+		for _, qtype := range qtypes {
+			q := dns.Question{Name: name, Qtype: qtype, Qclass: dns.ClassINET}
+			if seen[q] {
+				continue
+			}
+			seen[q] = true
+
+			req := new(dns.Msg)
+			req.SetQuestion(name, qtype)
+			s.ServeDNS(w, req)
+		}
+	}
+	return len(seen), nil
+}
+
+// discardWriter returns a writer that throws the replies away, ServeDNS only
+// needs to see a (non TCP) client.
+func discardWriter() dns.ResponseWriter {
+	return &batchWriter{
+		local:  &net.UDPAddr{IP: net.IPv4zero},
+		remote: &net.UDPAddr{IP: net.IPv4zero},
+		write:  func([]byte, net.Addr, []byte) {},
+	}
+}
+
+// runPreload runs preload and logs the outcome, failing to preload is not fatal.
+func (s *server) runPreload() {
+	start := time.Now()
+	n, err := s.preload()
+	if err != nil {
+		logf("failure to preload %s: %q", s.config.Domain, err)
+		return
+	}
+	logf("preloaded %d names in %s", n, time.Since(start))
+}
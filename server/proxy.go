@@ -0,0 +1,263 @@
+// Copyright (c) 2014 The SkyDNS Authors. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The listeners that can take the PROXY protocol, see ProxyProtocol.
+const (
+	ProxyTCP  = "tcp"
+	ProxyDoH  = "doh"
+	ProxyGRPC = "grpc"
+)
+
+// ProxyProtocol reads the PROXY protocol header (v1 and v2) that an L4 load
+// balancer puts in front of the connections it passes on, so the address of the
+// client, not that of the load balancer, is used for ACLs, rate limiting, ECS and
+// logging.
+type ProxyProtocol struct {
+	// Listeners that take the header: tcp, doh and grpc. Defaults to all of them.
+	Listeners []string `json:"listeners,omitempty"`
+	// From, the addresses or networks of the load balancers. Connections from them
+	// must start with a header, other connections are served as they are.
+	// Defaults to all addresses.
+	From []string `json:"from,omitempty"`
+
+	from []*net.IPNet
+}
+
+// proxyHeaderTimeout is how long a connection may take to send its header.
+const proxyHeaderTimeout = 5 * time.Second
+
+// proxyV2Sig starts a version 2 header.
+var proxyV2Sig = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+var errProxyHeader = errors.New("invalid PROXY protocol header")
+
+func setProxyProtocolDefaults(config *Config) error {
+	p := config.ProxyProtocol
+	if p == nil {
+		return nil
+	}
+	if len(p.Listeners) == 0 {
+		p.Listeners = []string{ProxyTCP, ProxyDoH, ProxyGRPC}
+	}
+	for _, l := range p.Listeners {
+		switch l {
+		case ProxyTCP, ProxyDoH, ProxyGRPC:
+		default:
+			return fmt.Errorf("proxy_protocol: listener must be %q, %q or %q, not %q", ProxyTCP, ProxyDoH, ProxyGRPC, l)
+		}
+	}
+	if len(p.From) == 0 {
+		p.From = []string{"0.0.0.0/0", "::/0"}
+	}
+	p.from = nil
+	for _, a := range p.From {
+		n, err := parseNet(a)
+		if err != nil {
+			return fmt.Errorf("proxy_protocol: invalid from entry: %s", err)
+		}
+		p.from = append(p.from, n)
+	}
+	return nil
+}
+
+// on returns true if the listener takes the header.
+func (p *ProxyProtocol) on(listener string) bool {
+	if p == nil {
+		return false
+	}
+	for _, l := range p.Listeners {
+		if l == listener {
+			return true
+		}
+	}
+	return false
+}
+
+// proxyListener returns l, reading the header of the connections it accepts from
+// the load balancers when listener takes the PROXY protocol.
+func (s *server) proxyListener(listener string, l net.Listener) net.Listener {
+	if !s.config.ProxyProtocol.on(listener) {
+		return l
+	}
+	return &proxyListener{Listener: l, from: s.config.ProxyProtocol.from}
+}
+
+type proxyListener struct {
+	net.Listener
+	from []*net.IPNet
+}
+
+// Accept doesn't read the header, a slow client would hold up the others. It is
+// read by the first Read or RemoteAddr of the connection.
+func (l *proxyListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	if a, ok := conn.RemoteAddr().(*net.TCPAddr); !ok || !containsIP(l.from, a.IP) {
+		return conn, nil
+	}
+	return &proxyConn{Conn: conn, r: bufio.NewReader(conn)}, nil
+}
+
+// proxyConn is a connection from a load balancer. Its RemoteAddr is the address
+// of the client in the header, or that of the load balancer when the header has
+// none, as it has for its health checks.
+type proxyConn struct {
+	net.Conn
+	r *bufio.Reader
+
+	once   sync.Once
+	remote net.Addr
+	err    error
+
+	sync.Mutex
+	deadline time.Time // read deadline set by the user of the connection
+}
+
+func (c *proxyConn) Read(b []byte) (int, error) {
+	c.once.Do(c.readHeader)
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.r.Read(b)
+}
+
+func (c *proxyConn) RemoteAddr() net.Addr {
+	c.once.Do(c.readHeader)
+	return c.remote
+}
+
+func (c *proxyConn) SetDeadline(t time.Time) error {
+	c.Lock()
+	c.deadline = t
+	c.Unlock()
+	return c.Conn.SetDeadline(t)
+}
+
+func (c *proxyConn) SetReadDeadline(t time.Time) error {
+	c.Lock()
+	c.deadline = t
+	c.Unlock()
+	return c.Conn.SetReadDeadline(t)
+}
+
+// readHeader reads the header within proxyHeaderTimeout, or the read deadline of
+// the connection when that is earlier. A connection with an invalid header fails
+// its reads.
+func (c *proxyConn) readHeader() {
+	c.remote = c.Conn.RemoteAddr()
+	c.Lock()
+	deadline := c.deadline
+	c.Unlock()
+	if t := time.Now().Add(proxyHeaderTimeout); deadline.IsZero() || t.Before(deadline) {
+		c.Conn.SetReadDeadline(t)
+	}
+	remote, err := readProxyHeader(c.r)
+	c.Conn.SetReadDeadline(deadline)
+	if err != nil {
+		logf("failure to read PROXY protocol header from %s: %s", c.remote, err)
+		c.err = err
+		return
+	}
+	if remote != nil {
+		c.remote = remote
+	}
+}
+
+// readProxyHeader reads a version 1 or 2 header from r and returns the address of
+// the client in it, nil when there is none.
+func readProxyHeader(r *bufio.Reader) (net.Addr, error) {
+	b, err := r.Peek(len(proxyV2Sig))
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case bytes.Equal(b, proxyV2Sig):
+		return readProxyV2(r)
+	case bytes.HasPrefix(b, []byte("PROXY ")):
+		return readProxyV1(r)
+	}
+	return nil, errProxyHeader
+}
+
+// readProxyV1 reads a version 1 header, a line of text such as
+// "PROXY TCP4 192.0.2.1 192.0.2.53 49152 53\r\n".
+func readProxyV1(r *bufio.Reader) (net.Addr, error) {
+	line, err := r.ReadSlice('\n')
+	if err != nil {
+		return nil, err
+	}
+	// The longest header is 107 bytes.
+	if len(line) > 107 || !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, errProxyHeader
+	}
+	f := strings.Fields(string(line[:len(line)-2]))
+	if len(f) >= 2 && f[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(f) != 6 || (f[1] != "TCP4" && f[1] != "TCP6") {
+		return nil, errProxyHeader
+	}
+	ip := net.ParseIP(f[2])
+	port, err := strconv.ParseUint(f[4], 10, 16)
+	if ip == nil || err != nil || (ip.To4() != nil) != (f[1] == "TCP4") {
+		return nil, errProxyHeader
+	}
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
+
+// readProxyV2 reads a binary version 2 header. Its TLVs are skipped.
+func readProxyV2(r *bufio.Reader) (net.Addr, error) {
+	h := make([]byte, 16)
+	if _, err := io.ReadFull(r, h); err != nil {
+		return nil, err
+	}
+	if h[12]>>4 != 2 {
+		return nil, errProxyHeader
+	}
+	b := make([]byte, binary.BigEndian.Uint16(h[14:]))
+	if _, err := io.ReadFull(r, b); err != nil {
+		return nil, err
+	}
+	switch h[12] & 0xf {
+	case 0:
+		// LOCAL, a connection of the load balancer itself.
+		return nil, nil
+	case 1:
+		// PROXY
+	default:
+		return nil, errProxyHeader
+	}
+	switch h[13] >> 4 {
+	case 1:
+		if len(b) < 12 {
+			return nil, errProxyHeader
+		}
+		return &net.TCPAddr{IP: net.IP(b[0:4]), Port: int(binary.BigEndian.Uint16(b[8:]))}, nil
+	case 2:
+		if len(b) < 36 {
+			return nil, errProxyHeader
+		}
+		return &net.TCPAddr{IP: net.IP(b[0:16]), Port: int(binary.BigEndian.Uint16(b[32:]))}, nil
+	}
+	// Unspecified or a Unix socket.
+	return nil, nil
+}
@@ -0,0 +1,110 @@
+// Copyright (c) 2014 The SkyDNS Authors. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"io/ioutil"
+	"net"
+	"testing"
+)
+
+func TestReadProxyHeader(t *testing.T) {
+	v2 := func(cmd, fam byte, addr ...byte) string {
+		b := append([]byte(nil), proxyV2Sig...)
+		b = append(b, 0x20|cmd, fam, 0, byte(len(addr)))
+		return string(append(b, addr...))
+	}
+	tests := []struct {
+		header string
+		remote string // empty: no address
+		ok     bool
+	}{
+		{"PROXY TCP4 192.0.2.1 192.0.2.53 49152 53\r\n", "192.0.2.1:49152", true},
+		{"PROXY TCP6 2001:db8::1 2001:db8::53 49152 53\r\n", "[2001:db8::1]:49152", true},
+		{"PROXY UNKNOWN\r\n", "", true},
+		{"PROXY TCP4 2001:db8::1 192.0.2.53 49152 53\r\n", "", false},
+		{"PROXY TCP4 192.0.2.1 192.0.2.53 65536 53\r\n", "", false},
+		{"PROXY TCP4 192.0.2.1\r\n", "", false},
+		{"GET / HTTP/1.1\r\n", "", false},
+		{v2(1, 0x11, 192, 0, 2, 1, 192, 0, 2, 53, 0xc0, 0, 0, 53), "192.0.2.1:49152", true},
+		{v2(1, 0x21, 0x20, 1, 0xd, 0xb8, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1,
+			0x20, 1, 0xd, 0xb8, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0x53, 0xc0, 0, 0, 53), "[2001:db8::1]:49152", true},
+		{v2(0, 0, 0, 0), "", true},
+		{v2(1, 0x11, 192, 0, 2, 1), "", false},
+		{v2(2, 0x11), "", false},
+	}
+	for i, tc := range tests {
+		r := bufio.NewReader(bytes.NewBufferString(tc.header + "query"))
+		remote, err := readProxyHeader(r)
+		if tc.ok != (err == nil) {
+			t.Errorf("test %d: expected ok %t, got error %v", i, tc.ok, err)
+			continue
+		}
+		if !tc.ok {
+			continue
+		}
+		if (remote == nil && tc.remote != "") || (remote != nil && remote.String() != tc.remote) {
+			t.Errorf("test %d: expected %q, got %v", i, tc.remote, remote)
+		}
+		if b, _ := ioutil.ReadAll(r); string(b) != "query" {
+			t.Errorf("test %d: expected the header to be read, got %q left", i, b)
+		}
+	}
+}
+
+func TestProxyListener(t *testing.T) {
+	config := &Config{ProxyProtocol: &ProxyProtocol{Listeners: []string{ProxyTCP}, From: []string{"127.0.0.1"}}}
+	if err := setProxyProtocolDefaults(config); err != nil {
+		t.Fatal(err)
+	}
+	s := &server{config: config}
+	if l := s.proxyListener(ProxyDoH, nil); l != nil {
+		t.Fatalf("expected no PROXY protocol on the DoH listener")
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	l = s.proxyListener(ProxyTCP, l)
+
+	for _, from := range []string{"127.0.0.1", "10.0.0.0/8"} {
+		config.ProxyProtocol.From = []string{from}
+		setProxyProtocolDefaults(config)
+		l.(*proxyListener).from = config.ProxyProtocol.from
+
+		c, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		c.Write([]byte("PROXY TCP4 192.0.2.1 192.0.2.53 49152 53\r\nquery"))
+		c.Close()
+
+		conn, err := l.Accept()
+		if err != nil {
+			t.Fatal(err)
+		}
+		remote := conn.RemoteAddr().(*net.TCPAddr)
+		b, _ := ioutil.ReadAll(conn)
+		conn.Close()
+		switch from {
+		case "127.0.0.1":
+			if remote.String() != "192.0.2.1:49152" || string(b) != "query" {
+				t.Errorf("expected the client address from the header, got %s and %q", remote, b)
+			}
+		default:
+			if !remote.IP.IsLoopback() {
+				t.Errorf("expected the address of the connection, got %s", remote)
+			}
+		}
+	}
+
+	if err := setProxyProtocolDefaults(&Config{ProxyProtocol: &ProxyProtocol{Listeners: []string{"udp"}}}); err == nil {
+		t.Errorf("expected an error for listener udp")
+	}
+}
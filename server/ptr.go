@@ -0,0 +1,100 @@
+// Copyright (c) 2014 The SkyDNS Authors. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package server
+
+import (
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/skynetservices/skydns/msg"
+
+	"github.com/miekg/dns"
+)
+
+// ptrReload is how often the reverse index is built again from the backend.
+const ptrReload = 30 * time.Second
+
+// reverseIndex holds the names of the services with an address, by the reverse
+// name of that address, see Config.SynthesizePTR.
+type reverseIndex struct {
+	sync.RWMutex
+	ptrs map[string][]*dns.PTR // lowercased reverse names
+}
+
+func newReverseIndex() *reverseIndex {
+	return &reverseIndex{}
+}
+
+// load builds the index from all services in our domain, sx. Services with a
+// wildcard in their name are left out, there is no single name to point to. It
+// returns the number of addresses in the index.
+func (r *reverseIndex) load(sx []msg.Service) int {
+	ptrs := make(map[string][]*dns.PTR)
+	seen := make(map[string]bool)
+	for _, serv := range expandHosts(sx) {
+		ip := net.ParseIP(serv.Host)
+		if ip == nil {
+			continue
+		}
+		name := msg.Domain(serv.Key)
+		if strings.Contains(name, "*") {
+			continue
+		}
+		rev, err := dns.ReverseAddr(ip.String())
+		if err != nil || seen[rev+" "+name] {
+			continue
+		}
+		seen[rev+" "+name] = true
+		hdr := dns.RR_Header{Name: rev, Rrtype: dns.TypePTR, Class: dns.ClassINET, Ttl: serv.Ttl}
+		ptrs[rev] = append(ptrs[rev], &dns.PTR{Hdr: hdr, Ptr: name})
+	}
+	for _, p := range ptrs {
+		sort.Slice(p, func(i, j int) bool { return p[i].Ptr < p[j].Ptr })
+	}
+
+	r.Lock()
+	r.ptrs = ptrs
+	r.Unlock()
+	return len(ptrs)
+}
+
+// lookup returns the PTR records for name, which is lowercased, with owner
+// qname.
+func (r *reverseIndex) lookup(qname, name string) (records []dns.RR) {
+	r.RLock()
+	ptrs := r.ptrs[name]
+	r.RUnlock()
+	for _, p := range ptrs {
+		p1 := *p
+		p1.Hdr.Name = qname
+		records = append(records, &p1)
+	}
+	return records
+}
+
+// runReverse builds the reverse index and builds it again every ptrReload, so
+// added and removed services are seen.
+func (s *server) runReverse() {
+	reload := func() {
+		services, err := s.backend.Records(s.config.Domain, false)
+		if err != nil && !isNameError(err, s) {
+			logf("failure to build the reverse index: %q", err)
+			return
+		}
+		n := s.reverse.load(msg.Dedup(active(services, time.Now())))
+		if s.config.Verbose {
+			logf("reverse index has %d addresses", n)
+		}
+	}
+	reload()
+	go func() {
+		for range time.Tick(ptrReload) {
+			reload()
+		}
+	}()
+}
@@ -0,0 +1,52 @@
+// Copyright (c) 2014 The SkyDNS Authors. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package server
+
+import (
+	"testing"
+
+	"github.com/skynetservices/skydns/msg"
+
+	"github.com/miekg/dns"
+)
+
+func TestSynthesizePTR(t *testing.T) {
+	s := newTestServer(t, false)
+	defer s.Stop()
+
+	for _, serv := range []*msg.Service{
+		{Host: "10.0.16.1", Key: "a.ptr.skydns.test."},
+		{Host: "10.0.16.1", Port: 80, Key: "b.ptr.skydns.test."},
+		{Host: "10.0.16.2", Hosts: []string{"2001::16"}, Key: "c.ptr.skydns.test."},
+	} {
+		addService(t, s, serv.Key, 0, serv)
+		defer delService(t, s, serv.Key)
+	}
+	s.reverse = newReverseIndex()
+	s.runReverse()
+
+	tests := []struct {
+		qname string
+		ptrs  []string
+	}{
+		{"1.16.0.10.in-addr.arpa.", []string{"a.ptr.skydns.test.", "b.ptr.skydns.test."}},
+		{"2.16.0.10.IN-ADDR.ARPA.", []string{"c.ptr.skydns.test."}},
+		{"6.1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.1.0.0.2.ip6.arpa.", []string{"c.ptr.skydns.test."}},
+		{"3.16.0.10.in-addr.arpa.", nil},
+	}
+	for _, tc := range tests {
+		records, _ := s.PTRRecords(dns.Question{Name: tc.qname, Qtype: dns.TypePTR, Qclass: dns.ClassINET})
+		if len(records) != len(tc.ptrs) {
+			t.Errorf("%s: expected %d PTR records, got %v", tc.qname, len(tc.ptrs), records)
+			continue
+		}
+		for i, rr := range records {
+			ptr := rr.(*dns.PTR)
+			if ptr.Hdr.Name != tc.qname || ptr.Ptr != tc.ptrs[i] {
+				t.Errorf("%s: expected PTR to %s, got %s", tc.qname, tc.ptrs[i], ptr)
+			}
+		}
+	}
+}
@@ -0,0 +1,210 @@
+// Copyright (c) 2014 The SkyDNS Authors. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package server
+
+import (
+	"strings"
+	"time"
+
+	"github.com/skynetservices/skydns/cache"
+	"github.com/skynetservices/skydns/metrics"
+
+	"github.com/miekg/dns"
+)
+
+// cacheHandler is the cache stage: it answers queries from the response cache,
+// and caches the replies of next. Answers from our zone are cached whole, and
+// fitted to each client: it gets no more than MaxAnswers, and those that fit.
+// When cached is false nothing is cached, the answers are still fitted.
+func (s *server) cacheHandler(next dns.Handler, cached bool) dns.Handler {
+	return dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+		q := req.Question[0]
+		if req.Opcode != dns.OpcodeQuery || q.Qtype == dns.TypeAXFR || q.Qtype == dns.TypeIXFR {
+			next.ServeDNS(w, req)
+			return
+		}
+		w = s.signReplies(w, req)
+		start := time.Now()
+		bufsize, dnssec := s.querySize(w, req)
+		tcp := isTCP(w)
+		name := strings.ToLower(q.Name)
+
+		if s.popular != nil {
+			s.popular.add(q)
+		}
+		if s.config.Verbose {
+			logf("received DNS Request for %q from %q with type %d", q.Name, w.RemoteAddr(), q.Qtype)
+		}
+
+		// The client subnet to forward with, and the replies for it are cached for.
+		subnet := s.clientSubnet(w, req)
+		cw := &cacheWriter{ResponseWriter: w, s: s, req: req, bufsize: bufsize, subnet: subnet, answerScope: s.answerScope(subnet)}
+
+		// An ACME challenge is never cached, so it is seen as soon as it is
+		// presented. Queries the backend refuses aren't either.
+		switch {
+		case !cached:
+		case s.challenges != nil && q.Qtype == dns.TypeTXT && strings.HasPrefix(name, acmeLabel):
+		case !s.backend.HasSynced():
+		case req.IsEdns0() != nil && req.IsEdns0().Version() != 0:
+		default:
+			if s.cacheHit(w, req, bufsize, dnssec, subnet, start) {
+				return
+			}
+			metrics.ReportCacheMiss(metrics.Response)
+			next.ServeDNS(cw, req)
+			if cw.msg != nil {
+				key := cache.Key(q, dnssec, tcp)
+				if cw.kind == replyForwarded && subnet != nil && cw.scope > 0 {
+					key = cache.KeySubnet(q, dnssec, tcp, subnetKey(subnet))
+				}
+				s.rcache.InsertMessage(key, cw.msg)
+			}
+			return
+		}
+		next.ServeDNS(cw, req)
+	})
+}
+
+// cacheHit writes the reply to req from the cache to w, it returns false when it
+// is not cached.
+func (s *server) cacheHit(w dns.ResponseWriter, req *dns.Msg, bufsize uint16, dnssec bool, subnet *dns.EDNS0_SUBNET, start time.Time) bool {
+	q := req.Question[0]
+	tcp := isTCP(w)
+
+	cached := time.Now()
+	var pkey string
+	// The ECS and COOKIE options of a query are echoed, packed replies have none.
+	if s.pcache != nil && packable(w) && (s.config.ClientSubnet == nil || querySubnet(req) == nil) &&
+		(s.config.Cookies == nil || queryCookie(req) == nil) {
+		pkey = cache.PackedKey(req, bufsize, tcp)
+		if b := s.pcache.Hit(pkey, req.Id); b != nil {
+			metrics.ReportStage(metrics.StageCache, cached)
+			metrics.ReportRequestCount(req, metrics.Cache)
+			written := time.Now()
+			if _, err := w.Write(b); err != nil {
+				logf("failure to return reply %q", err)
+			}
+			metrics.ReportStage(metrics.StageWrite, written)
+			return true
+		}
+	}
+	var (
+		m     *dns.Msg
+		scope = s.answerScope(subnet)
+		stale uint32
+	)
+	if s.degraded() {
+		stale = staleTTL
+	}
+	if subnet != nil {
+		// A reply that only holds for the client's subnet, it is not packed for others.
+		if m = s.rcache.HitSubnet(q, dnssec, tcp, subnetKey(subnet), req.Id, stale); m != nil {
+			scope, pkey = subnet.SourceNetmask, ""
+		}
+	}
+	if m == nil {
+		if stale > 0 {
+			m = s.rcache.HitStale(q, dnssec, tcp, req.Id, stale)
+		} else {
+			m = s.rcache.Hit(q, dnssec, tcp, req.Id)
+		}
+	}
+	metrics.ReportStage(metrics.StageCache, cached)
+	if m == nil {
+		return false
+	}
+	metrics.ReportRequestCount(req, metrics.Cache)
+
+	// The cached header is from an earlier query, use this client's bits.
+	m.RecursionDesired = req.RecursionDesired
+	m.CheckingDisabled = req.CheckingDisabled
+	if dns.IsSubDomain(s.config.Domain, strings.ToLower(q.Name)) {
+		s.setAD(m, req, dnssec)
+	}
+	s.setEdns(m, req.IsEdns0())
+	setSubnet(m, req, subnet, scope)
+
+	if l := s.limitAnswers(m); l != m {
+		// A random subset is picked again for the next client.
+		m = l
+		if s.config.AnswerSubset == SubsetRandom {
+			pkey = ""
+		}
+	}
+	if send := s.overflowOrTruncated(w, m, int(bufsize), metrics.Cache); send {
+		return true
+	}
+
+	// Still round-robin even with hits from the cache.
+	// Only shuffle A and AAAA records with each other.
+	if q.Qtype == dns.TypeA || q.Qtype == dns.TypeAAAA {
+		s.RoundRobin(m.Answer)
+	}
+
+	metrics.ReportCompression(m, metrics.Cache)
+	written := time.Now()
+	if err := s.writePacked(w, m, pkey); err != nil {
+		logf("failure to return reply %q", err)
+	}
+	metrics.ReportStage(metrics.StageWrite, written)
+
+	metrics.ReportDuration(m, start, metrics.Cache)
+	metrics.ReportErrorCount(m, metrics.Cache)
+	return true
+}
+
+// cacheWriter is the writer of the cache stage. It fits the answers from our
+// zone to the client, and keeps the replies to cache.
+type cacheWriter struct {
+	dns.ResponseWriter
+	s           *server
+	req         *dns.Msg
+	bufsize     uint16
+	subnet      *dns.EDNS0_SUBNET
+	answerScope uint8 // of our answers for subnet, see answerScope
+
+	kind  replyKind
+	scope uint8    // of a forwarded reply, see setReply
+	msg   *dns.Msg // the reply to cache, nil when there is none
+}
+
+func (w *cacheWriter) setReply(kind replyKind, scope uint8) { w.kind, w.scope = kind, scope }
+
+func (w *cacheWriter) WriteMsg(m *dns.Msg) error {
+	s, req := w.s, w.req
+	switch w.kind {
+	case replyForwarded:
+		w.msg = m
+		return w.ResponseWriter.WriteMsg(m)
+	case replyAnswer, replyReferral:
+	default:
+		return w.ResponseWriter.WriteMsg(m)
+	}
+
+	s.setEdns(m, req.IsEdns0())
+	if m.Rcode == dns.RcodeServerFailure {
+		return w.ResponseWriter.WriteMsg(m)
+	}
+	setSubnet(m, req, w.subnet, w.answerScope)
+
+	// The cache keeps all records, a client gets no more than MaxAnswers or
+	// those that fit.
+	out := s.limitAnswers(m)
+	if out == m && s.dropOverflow(m) {
+		c := *m
+		out = &c
+	}
+	if send := s.overflowOrTruncated(w.ResponseWriter, out, int(w.bufsize), metrics.Auth); send {
+		return nil
+	}
+	w.msg = m
+
+	metrics.ReportCompression(out, metrics.Auth)
+	written := time.Now()
+	err := w.ResponseWriter.WriteMsg(out)
+	metrics.ReportStage(metrics.StageWrite, written)
+	return err
+}
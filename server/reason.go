@@ -0,0 +1,127 @@
+// Copyright (c) 2014 The SkyDNS Authors. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package server
+
+import (
+	"context"
+	"encoding/binary"
+	"net"
+
+	"github.com/skynetservices/skydns/msg"
+
+	"github.com/miekg/dns"
+)
+
+// edeCode is the EDNS0 option code of an Extended DNS Error (RFC 8914), our
+// version of miekg/dns predates it.
+const edeCode = 15
+
+// Extended DNS Error INFO-CODEs (RFC 8914) we use.
+const (
+	edeOther                = 0
+	edeRRSIGsMissing        = 10
+	edeBlocked              = 15
+	edeNotReady             = 14
+	edeFiltered             = 17
+	edeProhibited           = 18
+	edeNotAuthoritative     = 20
+	edeNotSupported         = 21
+	edeNoReachableAuthority = 22
+	edeNetworkError         = 23
+)
+
+// reason is the machine-readable explanation of a response that is not NOERROR.
+type reason struct {
+	code uint16 // INFO-CODE of the Extended DNS Error
+	text string // EXTRA-TEXT of the Extended DNS Error
+}
+
+var (
+	reasonNoSuchName     = reason{edeOther, "no-such-name"}
+	reasonNotActive      = reason{edeFiltered, "no-active-service"}
+	reasonNotSynced      = reason{edeNotReady, "backend-not-synced"}
+	reasonBackendTimeout = reason{edeNetworkError, "backend-timeout"}
+	reasonBackendError   = reason{edeNetworkError, "backend-error"}
+	reasonBackendDown    = reason{edeNetworkError, "backend-unreachable"}
+	reasonBadVersion     = reason{edeOther, "bad-edns-version"}
+	reasonChaos          = reason{edeNotSupported, "unknown-chaos-name"}
+	reasonChaosRefused   = reason{edeProhibited, "chaos-refused"}
+	reasonRecursion      = reason{edeProhibited, "recursion-refused"}
+	reasonNoNameservers  = reason{edeNotReady, "no-nameservers"}
+	reasonNameTooShort   = reason{edeProhibited, "name-too-short"}
+	reasonForwardFailed  = reason{edeNoReachableAuthority, "forward-failed"}
+	reasonStubFailed     = reason{edeNoReachableAuthority, "stub-forward-failed"}
+	reasonLoop           = reason{edeOther, "forwarding-loop"}
+	reasonPolicy         = reason{edeBlocked, "policy-refused"}
+	reasonHostsBlocked   = reason{edeBlocked, "hosts-blocked"}
+	reasonQueryACL       = reason{edeProhibited, "query-acl"}
+	reasonTenantACL      = reason{edeProhibited, "tenant-acl"}
+	reasonTenantQPS      = reason{edeOther, "tenant-qps"}
+	reasonTenantQuota    = reason{edeProhibited, "tenant-quota"}
+	reasonNotifyACL      = reason{edeProhibited, "notify-acl"}
+	reasonNotifyQuery    = reason{edeOther, "notify-not-soa"}
+	reasonNotifyNotAuth  = reason{edeNotAuthoritative, "notify-unknown-zone"}
+	reasonTransferACL    = reason{edeProhibited, "transfer-acl"}
+	reasonTransferUDP    = reason{edeOther, "transfer-not-tcp"}
+	reasonTransferZone   = reason{edeNotAuthoritative, "transfer-unknown-zone"}
+	reasonUpdateTsig     = reason{edeProhibited, "update-not-authorized"}
+	reasonUpdateZone     = reason{edeNotAuthoritative, "update-unknown-zone"}
+	reasonUpdatePrereq   = reason{edeOther, "update-prerequisite"}
+	reasonUpdateType     = reason{edeNotSupported, "update-not-supported"}
+	reasonDegraded       = reason{edeNotReady, "degraded"}
+	reasonTsigRequired   = reason{edeProhibited, "tsig-required"}
+	reasonCookie         = reason{edeProhibited, "cookie-required"}
+	reasonDnameLoop      = reason{edeOther, "dname-loop"}
+	reasonDnameTooLong   = reason{edeOther, "dname-too-long"}
+	reasonCNAMELoop      = reason{edeOther, "cname-loop"}
+	reasonCNAMEDepth     = reason{edeOther, "cname-too-long"}
+	reasonSignFailed     = reason{edeRRSIGsMissing, "signing-failed"}
+	reasonTooLarge       = reason{edeOther, "reply-too-large"}
+	reasonOverloaded     = reason{edeOther, "overloaded"}
+	reasonPanic          = reason{edeOther, "internal-error"}
+)
+
+// backendReason returns the reason for a failure of the backend with err.
+func backendReason(err error) reason {
+	if err == context.DeadlineExceeded {
+		return reasonBackendTimeout
+	}
+	if e, ok := err.(net.Error); ok && e.Timeout() {
+		return reasonBackendTimeout
+	}
+	if _, ok := err.(*msg.UnavailableError); ok {
+		return reasonBackendDown
+	}
+	return reasonBackendError
+}
+
+// explain records why m, the reply to req, is not NOERROR. With Verbose the
+// reason is logged. With ExtendedErrors, and when req has an OPT record, it is
+// added to m's OPT record as an Extended DNS Error, see setEdns.
+func (s *server) explain(m, req *dns.Msg, r reason) {
+	if s.config.Verbose {
+		logf("answering %s for %q: %s", dns.RcodeToString[m.Rcode], req.Question[0].Name, r.text)
+	}
+	o := req.IsEdns0()
+	if !s.config.ExtendedErrors || o == nil {
+		return
+	}
+	opt := m.IsEdns0()
+	if opt == nil {
+		opt = s.newOPT(o.Do())
+		m.Extra = append(m.Extra, opt)
+	}
+	data := make([]byte, 2, 2+len(r.text))
+	binary.BigEndian.PutUint16(data, r.code)
+	data = append(data, r.text...)
+
+	options := opt.Option[:0]
+	for _, e := range opt.Option {
+		if e.Option() != edeCode {
+			options = append(options, e)
+		}
+	}
+	opt.Option = append(options, &dns.EDNS0_LOCAL{Code: edeCode, Data: data})
+}
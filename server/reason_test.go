@@ -0,0 +1,140 @@
+// Copyright (c) 2014 The SkyDNS Authors. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package server
+
+import (
+	"context"
+	"crypto"
+	"encoding/binary"
+	"errors"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/skynetservices/skydns/msg"
+
+	"github.com/miekg/dns"
+)
+
+// extendedError returns the INFO-CODE and EXTRA-TEXT of the Extended DNS Error in
+// m, ok is false if there is none.
+func extendedError(m *dns.Msg) (code uint16, text string, ok bool) {
+	opt := m.IsEdns0()
+	if opt == nil {
+		return 0, "", false
+	}
+	for _, e := range opt.Option {
+		if l, isLocal := e.(*dns.EDNS0_LOCAL); isLocal && l.Code == edeCode && len(l.Data) >= 2 {
+			return binary.BigEndian.Uint16(l.Data), string(l.Data[2:]), true
+		}
+	}
+	return 0, "", false
+}
+
+func TestExtendedErrors(t *testing.T) {
+	s := newTestServer(t, false, func(s *server) {
+		s.config.ExtendedErrors = true
+	})
+	defer s.Stop()
+
+	addService(t, s, "old.reason.skydns.test.", 0, &msg.Service{Host: "10.0.0.1", ActiveUntil: inTime(-time.Hour)})
+	defer delService(t, s, "old.reason.skydns.test.")
+
+	tests := []struct {
+		name  string
+		class uint16
+		edns  bool
+		rcode int
+		code  uint16
+		text  string
+	}{
+		{"none.reason.skydns.test.", dns.ClassINET, true, dns.RcodeNameError, edeOther, "no-such-name"},
+		{"old.reason.skydns.test.", dns.ClassINET, true, dns.RcodeNameError, edeFiltered, "no-active-service"},
+		{"unknown.", dns.ClassCHAOS, true, dns.RcodeServerFailure, edeNotSupported, "unknown-chaos-name"},
+		{"none.reason.skydns.test.", dns.ClassINET, false, dns.RcodeNameError, 0, ""},
+	}
+	for i, tc := range tests {
+		m := new(dns.Msg)
+		m.SetQuestion(tc.name, dns.TypeA)
+		m.Question[0].Qclass = tc.class
+		if tc.edns {
+			m.SetEdns0(4096, false)
+		}
+		w := &testWriter{}
+		s.ServeDNS(w, m)
+		if w.msg.Rcode != tc.rcode {
+			t.Errorf("test %d: expected rcode %d, got %d", i, tc.rcode, w.msg.Rcode)
+			continue
+		}
+		code, text, ok := extendedError(w.msg)
+		if ok != tc.edns {
+			t.Errorf("test %d: expected an extended error %t, got %t", i, tc.edns, ok)
+			continue
+		}
+		if code != tc.code || text != tc.text {
+			t.Errorf("test %d: expected extended error %d %q, got %d %q", i, tc.code, tc.text, code, text)
+		}
+		if !tc.edns && w.msg.IsEdns0() != nil {
+			t.Errorf("test %d: expected no OPT record, got %s", i, w.msg)
+		}
+	}
+
+	// Without ExtendedErrors the reason is not sent.
+	s.config.ExtendedErrors = false
+	m := new(dns.Msg)
+	m.SetQuestion("nothere.reason.skydns.test.", dns.TypeA)
+	m.SetEdns0(4096, false)
+	w := &testWriter{}
+	s.ServeDNS(w, m)
+	if _, _, ok := extendedError(w.msg); ok {
+		t.Errorf("expected no extended error, got %s", w.msg)
+	}
+}
+
+// failingSigner is a DNSSEC key that can't sign.
+type failingSigner struct{ crypto.Signer }
+
+func (failingSigner) Sign(io.Reader, []byte, crypto.SignerOpts) ([]byte, error) {
+	return nil, errors.New("no signing today")
+}
+
+func TestExtendedErrorsSigning(t *testing.T) {
+	s := newTestServerDNSSEC(t, false, func(s *server) {
+		s.config.ExtendedErrors = true
+		s.config.PrivKey = failingSigner{s.config.PrivKey}
+	})
+	defer s.Stop()
+
+	addService(t, s, "signed.reason.skydns.test.", 0, &msg.Service{Host: "10.0.0.1"})
+	defer delService(t, s, "signed.reason.skydns.test.")
+
+	m := new(dns.Msg)
+	m.SetQuestion("signed.reason.skydns.test.", dns.TypeA)
+	m.SetEdns0(4096, true)
+	w := &testWriter{}
+	s.ServeDNS(w, m)
+	if w.msg.Rcode != dns.RcodeServerFailure {
+		t.Fatalf("expected SERVFAIL, got %s", w.msg)
+	}
+	if code, text, _ := extendedError(w.msg); code != edeRRSIGsMissing || text != "signing-failed" {
+		t.Errorf("expected extended error %d %q, got %d %q", edeRRSIGsMissing, "signing-failed", code, text)
+	}
+}
+
+func TestBackendReason(t *testing.T) {
+	tests := []struct {
+		err  error
+		text string
+	}{
+		{context.DeadlineExceeded, "backend-timeout"},
+		{&msg.UnavailableError{Err: errors.New("connection refused")}, "backend-unreachable"},
+		{errors.New("boom"), "backend-error"},
+	}
+	for i, tc := range tests {
+		if r := backendReason(tc.err); r.text != tc.text {
+			t.Errorf("test %d: expected %q, got %q", i, tc.text, r.text)
+		}
+	}
+}
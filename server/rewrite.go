@@ -0,0 +1,193 @@
+// Copyright (c) 2014 The SkyDNS Authors. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package server
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// Types of rewrite rules.
+const (
+	RewriteExact  = "exact"
+	RewriteSuffix = "suffix"
+	RewriteRegex  = "regex"
+)
+
+// Rewrite is a rule to resolve names as other names, for instance to keep old names
+// working when a zone is renamed. The reply is given the client's names back.
+type Rewrite struct {
+	// Type is exact, suffix or regex.
+	Type string `json:"type"`
+	// From is the name (exact), the domain (suffix) or the regular expression
+	// (regex) the query's name is matched against.
+	From string `json:"from"`
+	// To is the name or domain to resolve instead. For regex it is the replacement,
+	// with $1 for the first submatch and so on.
+	To string `json:"to"`
+
+	re *regexp.Regexp
+}
+
+func setRewriteDefaults(config *Config) error {
+	for i := range config.Rewrites {
+		r := &config.Rewrites[i]
+		switch r.Type {
+		case RewriteExact, RewriteSuffix:
+			r.From = dns.Fqdn(strings.ToLower(r.From))
+			r.To = dns.Fqdn(strings.ToLower(r.To))
+			if _, ok := dns.IsDomainName(r.From); !ok {
+				return fmt.Errorf("rewrite %d: invalid from: %q", i, r.From)
+			}
+			if _, ok := dns.IsDomainName(r.To); !ok {
+				return fmt.Errorf("rewrite %d: invalid to: %q", i, r.To)
+			}
+		case RewriteRegex:
+			re, err := regexp.Compile(r.From)
+			if err != nil {
+				return fmt.Errorf("rewrite %d: %s", i, err)
+			}
+			r.re = re
+		default:
+			return fmt.Errorf("rewrite %d: type must be one of %q, %q or %q", i, RewriteExact, RewriteSuffix, RewriteRegex)
+		}
+	}
+	return nil
+}
+
+// rewrite returns the name to resolve instead of name, which is lowercased. Ok is
+// false when r doesn't match name.
+func (r *Rewrite) rewrite(name string) (string, bool) {
+	switch r.Type {
+	case RewriteExact:
+		return r.To, name == r.From
+	case RewriteSuffix:
+		if name == r.From {
+			return r.To, true
+		}
+		if strings.HasSuffix(name, "."+r.From) {
+			return strings.TrimSuffix(name, r.From) + r.To, true
+		}
+	case RewriteRegex:
+		if r.re.MatchString(name) {
+			to := dns.Fqdn(r.re.ReplaceAllString(name, r.To))
+			_, ok := dns.IsDomainName(to)
+			return to, ok
+		}
+	}
+	return "", false
+}
+
+// reverse returns the owner name a client, that asked for name, sees for owner. The
+// rewritten name becomes name, and with a suffix rule every name in To is put back
+// in From.
+func (r *Rewrite) reverse(owner, name, rewritten string) string {
+	o := strings.ToLower(owner)
+	if o == rewritten {
+		return name
+	}
+	if r.Type == RewriteSuffix && strings.HasSuffix(o, "."+r.To) {
+		return owner[:len(owner)-len(r.To)] + r.From
+	}
+	if r.Type == RewriteSuffix && o == r.To {
+		return r.From
+	}
+	return owner
+}
+
+// rewriteHandler resolves names matching a rule in Config.Rewrites as the names the
+// first matching rule gives.
+func (s *server) rewriteHandler(next dns.Handler) dns.Handler {
+	if len(s.config.Rewrites) == 0 {
+		return next
+	}
+	return dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+		if len(req.Question) != 1 {
+			next.ServeDNS(w, req)
+			return
+		}
+		name := strings.ToLower(req.Question[0].Name)
+		for i := range s.config.Rewrites {
+			r := &s.config.Rewrites[i]
+			to, ok := r.rewrite(name)
+			if !ok || to == name {
+				continue
+			}
+			if s.config.Verbose {
+				logf("rewriting %q to %q", req.Question[0].Name, to)
+			}
+			rw := &renameWriter{ResponseWriter: w, req: req, rename: func(owner string) string {
+				return r.reverse(owner, req.Question[0].Name, to)
+			}}
+			rreq := req.Copy()
+			rreq.Question[0].Name = to
+			next.ServeDNS(rw, rreq)
+			return
+		}
+		next.ServeDNS(w, req)
+	})
+}
+
+// renameWriter writes replies to a query that was resolved for another name, see
+// renamed.
+type renameWriter struct {
+	dns.ResponseWriter
+	req    *dns.Msg // as sent by the client
+	rename func(owner string) string
+}
+
+func (w *renameWriter) WriteMsg(m *dns.Msg) error {
+	return w.ResponseWriter.WriteMsg(renamed(m, w.req, w.rename))
+}
+
+// renamed returns m, the reply to a query resolved for another name than req's,
+// with req's question put back and the names in it renamed: the owner names and
+// the names in the data of the records, so a CNAME chain still leads to the
+// records of its target. The signatures no longer match the renamed records, so
+// RRSIG, NSEC and NSEC3 records are left out and AD is cleared. It is a copy, as
+// m may be cached.
+func renamed(m, req *dns.Msg, rename func(owner string) string) *dns.Msg {
+	m = m.Copy()
+	m.Question = req.Question
+	m.AuthenticatedData = false
+	m.Answer = renameRRs(m.Answer, rename)
+	m.Ns = renameRRs(m.Ns, rename)
+	m.Extra = renameRRs(m.Extra, rename)
+	return m
+}
+
+// renameRRs renames the names in rrs, in place, see renamed.
+func renameRRs(rrs []dns.RR, rename func(owner string) string) []dns.RR {
+	ret := rrs[:0]
+	for _, rr := range rrs {
+		switch rr := rr.(type) {
+		case *dns.OPT:
+			ret = append(ret, rr)
+			continue
+		case *dns.RRSIG, *dns.NSEC, *dns.NSEC3:
+			continue
+		case *dns.CNAME:
+			rr.Target = rename(rr.Target)
+		case *dns.DNAME:
+			rr.Target = rename(rr.Target)
+		case *dns.SRV:
+			rr.Target = rename(rr.Target)
+		case *dns.MX:
+			rr.Mx = rename(rr.Mx)
+		case *dns.NS:
+			rr.Ns = rename(rr.Ns)
+		case *dns.PTR:
+			rr.Ptr = rename(rr.Ptr)
+		case *dns.SOA:
+			rr.Ns, rr.Mbox = rename(rr.Ns), rename(rr.Mbox)
+		}
+		rr.Header().Name = rename(rr.Header().Name)
+		ret = append(ret, rr)
+	}
+	return ret
+}
@@ -0,0 +1,110 @@
+// Copyright (c) 2014 The SkyDNS Authors. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package server
+
+import (
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestRewrite(t *testing.T) {
+	config := &Config{Domain: "skydns.test.", Nameservers: []string{"127.0.0.1:53"}, Rewrites: []Rewrite{
+		{Type: RewriteExact, From: "db.skydns.test", To: "postgres.skydns.test"},
+		{Type: RewriteSuffix, From: "old.test.", To: "skydns.test."},
+		{Type: RewriteRegex, From: `^(.*)\.legacy\.test\.$`, To: "$1.region1.skydns.test."},
+	}}
+	if err := SetDefaults(config); err != nil {
+		t.Fatal(err)
+	}
+	s := &server{config: config}
+
+	// The server answers with a signed CNAME to target.<name> and its address,
+	// and an SRV record for target.<name>.
+	var asked string
+	h := s.handler(dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+		asked = req.Question[0].Name
+		m := new(dns.Msg)
+		m.SetReply(req)
+		m.AuthenticatedData = true
+		target := "target." + asked
+		m.Answer = []dns.RR{
+			newCNAME(asked + " 3600 CNAME " + target),
+			newRRSIG(asked + " 3600 RRSIG CNAME 8 3 3600 20300101000000 20200101000000 12345 skydns.test. c2lnbmF0dXJl"),
+			newA(target + " 3600 A 10.0.0.1"),
+		}
+		m.Extra = []dns.RR{newSRV(asked + " 3600 SRV 10 10 80 " + target)}
+		w.WriteMsg(m)
+	}))
+
+	tests := []struct {
+		name   string
+		asked  string
+		target string // owner name of the A record the client sees
+	}{
+		{"db.skydns.test.", "postgres.skydns.test.", "target.postgres.skydns.test."},
+		{"www.old.test.", "www.skydns.test.", "target.www.old.test."},
+		{"WWW.Old.Test.", "www.skydns.test.", "target.www.old.test."},
+		{"web.legacy.test.", "web.region1.skydns.test.", "target.web.region1.skydns.test."},
+		{"www.skydns.test.", "www.skydns.test.", "target.www.skydns.test."},
+	}
+	for i, tc := range tests {
+		m := new(dns.Msg)
+		m.SetQuestion(tc.name, dns.TypeA)
+		w := &testWriter{}
+		h.ServeDNS(w, m)
+		if asked != tc.asked {
+			t.Errorf("test %d: expected the server to be asked %q, got %q", i, tc.asked, asked)
+		}
+		if w.msg.Question[0].Name != tc.name {
+			t.Errorf("test %d: expected question %s, got %s", i, tc.name, w.msg.Question[0].Name)
+		}
+		// The RRSIG is left out of a rewritten reply.
+		answers := 2
+		if tc.name == tc.asked {
+			answers = 3
+		}
+		if len(w.msg.Answer) != answers {
+			t.Fatalf("test %d: expected %d answers, got %d", i, answers, len(w.msg.Answer))
+		}
+		if owner := w.msg.Answer[0].Header().Name; owner != tc.name {
+			t.Errorf("test %d: expected CNAME owner %s, got %s", i, tc.name, owner)
+		}
+		if owner := w.msg.Answer[answers-1].Header().Name; owner != tc.target {
+			t.Errorf("test %d: expected A owner %s, got %s", i, tc.target, owner)
+		}
+		// The CNAME chain leads to the A record, and the SRV record to the same
+		// target.
+		if cname, ok := w.msg.Answer[0].(*dns.CNAME); !ok || cname.Target != tc.target {
+			t.Errorf("test %d: expected CNAME target %s, got %s", i, tc.target, w.msg.Answer[0])
+		}
+		if srv := w.msg.Extra[0].(*dns.SRV); srv.Target != tc.target {
+			t.Errorf("test %d: expected SRV target %s, got %s", i, tc.target, srv.Target)
+		}
+		if w.msg.AuthenticatedData && tc.name != tc.asked {
+			t.Errorf("test %d: expected AD to be cleared on a rewritten reply", i)
+		}
+	}
+}
+
+func TestRewriteConfig(t *testing.T) {
+	tests := []struct {
+		rewrite Rewrite
+		ok      bool
+	}{
+		{Rewrite{Type: RewriteExact, From: "a.skydns.test.", To: "b.skydns.test."}, true},
+		{Rewrite{Type: RewriteSuffix, From: "old.test", To: "skydns.test"}, true},
+		{Rewrite{Type: RewriteRegex, From: `^(.*)\.old\.$`, To: "$1.new."}, true},
+		{Rewrite{Type: RewriteRegex, From: `(`, To: "new."}, false},
+		{Rewrite{Type: "prefix", From: "a.", To: "b."}, false},
+		{Rewrite{Type: RewriteExact, From: "a..b", To: "b."}, false},
+	}
+	for i, tc := range tests {
+		config := &Config{Domain: "skydns.test.", Nameservers: []string{"127.0.0.1:53"}, Rewrites: []Rewrite{tc.rewrite}}
+		if err := SetDefaults(config); tc.ok != (err == nil) {
+			t.Errorf("test %d: expected ok %t, got error %v", i, tc.ok, err)
+		}
+	}
+}
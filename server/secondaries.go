@@ -0,0 +1,134 @@
+// Copyright (c) 2014 The SkyDNS Authors. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package server
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/skynetservices/skydns/msg"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	// notifyRetries is the number of times a NOTIFY is sent to a secondary before
+	// giving up.
+	notifyRetries = 5
+	// notifyBackoff is the time we wait before sending a NOTIFY again, it doubles
+	// after every attempt.
+	notifyBackoff = time.Second
+	// notifyRetry is the time we wait before watching again after the watch failed.
+	notifyRetry = 5 * time.Second
+)
+
+// secondaries sends a NOTIFY (RFC 1996) to the secondaries of our domain when its
+// serial changes, so they transfer it without waiting for the SOA refresh.
+type secondaries struct {
+	client *dns.Client
+	// key signs the NOTIFYs, when it has a name.
+	key    TsigKey
+	serial uint32
+	// gen is increased for every serial we notify about, retries for an
+	// older serial stop.
+	gen uint32
+}
+
+func newSecondaries(timeout time.Duration, key TsigKey) *secondaries {
+	c := &dns.Client{Net: "udp", ReadTimeout: timeout, WriteTimeout: timeout}
+	if key.Name != "" {
+		c.TsigSecret = map[string]string{key.Name: key.Secret}
+	}
+	return &secondaries{client: c, key: key}
+}
+
+// runSecondaries watches w and, after every change to our domain, notifies the
+// secondaries when the serial changed.
+func (s *server) runSecondaries(w Watcher) {
+	changed := make(chan struct{}, 1)
+	go func() {
+		for range changed {
+			time.Sleep(serialCheck)
+			if s.journal != nil {
+				// The secondaries should find the change in the journal.
+				if err := s.updateJournal(); err != nil {
+					logf("failure to update the IXFR journal: %s", err)
+				}
+			}
+			if serial := s.serial(); serial != s.secondaries.serial {
+				s.secondaries.serial = serial
+				s.notifySecondaries(serial)
+			}
+		}
+	}()
+	send := func(c msg.Change) {
+		if !dns.IsSubDomain(s.config.Domain, c.Name) {
+			return
+		}
+		select {
+		case changed <- struct{}{}:
+		default:
+		}
+	}
+	s.secondaries.serial = s.serial()
+	go func() {
+		for {
+			err := w.Watch(context.Background(), send)
+			logf("watch for notifying secondaries failed, retrying in %s: %s", notifyRetry, err)
+			time.Sleep(notifyRetry)
+		}
+	}()
+}
+
+// notifySecondaries sends a NOTIFY for serial to every secondary, in the
+// background.
+func (s *server) notifySecondaries(serial uint32) {
+	gen := atomic.AddUint32(&s.secondaries.gen, 1)
+	for _, addr := range s.config.Secondaries {
+		go func(addr string) {
+			if err := s.notify(addr, serial, gen); err != nil {
+				logf("failure to notify %s of serial %d: %s", addr, serial, err)
+			}
+		}(addr)
+	}
+}
+
+// notify sends a NOTIFY for serial to addr until it is acknowledged, or we tried
+// notifyRetries times. It stops early when a newer serial is being notified.
+func (s *server) notify(addr string, serial, gen uint32) error {
+	m := new(dns.Msg)
+	m.SetNotify(s.config.Domain)
+	soa := s.NewSOA().(*dns.SOA)
+	soa.Serial = serial
+	m.Answer = []dns.RR{soa}
+
+	var err error
+	backoff := notifyBackoff
+	for i := 0; i < notifyRetries; i++ {
+		if atomic.LoadUint32(&s.secondaries.gen) != gen {
+			return nil
+		}
+		if k := s.secondaries.key; k.Name != "" {
+			m.Extra = nil
+			m.SetTsig(k.Name, k.Algorithm, 300, time.Now().Unix())
+		}
+		var r *dns.Msg
+		r, _, err = s.secondaries.client.Exchange(m, addr)
+		if err == nil {
+			if r.Opcode == dns.OpcodeNotify && r.Rcode == dns.RcodeSuccess {
+				if s.config.Verbose {
+					logf("notified %s of serial %d", addr, serial)
+				}
+				return nil
+			}
+			err = fmt.Errorf("%s", dns.RcodeToString[r.Rcode])
+		}
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+	return err
+}
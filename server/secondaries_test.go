@@ -0,0 +1,60 @@
+// Copyright (c) 2014 The SkyDNS Authors. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package server
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestNotifySecondaries(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	notified := make(chan *dns.Msg, 10)
+	tries := 0
+	secondary := &dns.Server{PacketConn: pc, Handler: dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+		notified <- req
+		m := new(dns.Msg)
+		m.SetReply(req)
+		// The first NOTIFY fails, so it is sent again.
+		if tries++; tries == 1 {
+			m.Rcode = dns.RcodeServerFailure
+		}
+		w.WriteMsg(m)
+	})}
+	go secondary.ActivateAndServe()
+	defer secondary.Shutdown()
+
+	// Not started, so the NOTIFY below is the only one the secondary gets.
+	s := newUnstartedTestServer(t, false, func(s *server) {
+		s.config.Secondaries = []string{pc.LocalAddr().String()}
+		s.secondaries = newSecondaries(time.Second, TsigKey{})
+	})
+	s.notifySecondaries(42)
+
+	for i := 0; i < 2; i++ {
+		select {
+		case req := <-notified:
+			if req.Opcode != dns.OpcodeNotify || req.Question[0].Name != "skydns.test." {
+				t.Fatalf("expected a NOTIFY for skydns.test., got %s", req)
+			}
+			if soa, ok := req.Answer[0].(*dns.SOA); !ok || soa.Serial != 42 {
+				t.Fatalf("expected the SOA with serial 42, got %s", req)
+			}
+		case <-time.After(3 * time.Second):
+			t.Fatalf("expected NOTIFY %d", i+1)
+		}
+	}
+	select {
+	case req := <-notified:
+		t.Fatalf("expected no NOTIFY after it was acknowledged, got %s", req)
+	case <-time.After(1500 * time.Millisecond):
+	}
+}
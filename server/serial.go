@@ -0,0 +1,55 @@
+// Copyright (c) 2014 The SkyDNS Authors. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package server
+
+import (
+	"sync"
+	"time"
+
+	"github.com/skynetservices/skydns/msg"
+)
+
+// serialCheck is how often the backend is asked whether our zone changed.
+const serialCheck = time.Second
+
+// soaSerial holds the SOA serial and the revision of the zone it was derived from.
+type soaSerial struct {
+	sync.Mutex
+	serial  uint32
+	rev     msg.Revision
+	checked time.Time
+}
+
+// serial returns the SOA serial of our zone. When the backend is a Revisioner
+// the serial is the revision of the store at the moment we noticed the zone's
+// content changed, so it only increases when the zone changes and once when
+// we start. Otherwise the current time, truncated to the hour, is used.
+func (s *server) serial() uint32 {
+	r, ok := s.backend.(Revisioner)
+	if !ok {
+		return uint32(time.Now().Truncate(time.Hour).Unix())
+	}
+
+	s.soa.Lock()
+	defer s.soa.Unlock()
+	if s.soa.serial != 0 && time.Since(s.soa.checked) < serialCheck {
+		return s.soa.serial
+	}
+	s.soa.checked = time.Now()
+
+	rev, err := r.Revision(s.config.Domain)
+	if err != nil {
+		if s.soa.serial == 0 {
+			return uint32(time.Now().Truncate(time.Hour).Unix())
+		}
+		logf("failure to get the revision of %s: %s", s.config.Domain, err)
+		return s.soa.serial
+	}
+	if s.soa.serial == 0 || rev.Modified != s.soa.rev.Modified || rev.Keys != s.soa.rev.Keys {
+		s.soa.serial = uint32(rev.Current)
+		s.soa.rev = rev
+	}
+	return s.soa.serial
+}
@@ -0,0 +1,50 @@
+// Copyright (c) 2014 The SkyDNS Authors. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package server
+
+import (
+	"testing"
+	"time"
+
+	"github.com/skynetservices/skydns/msg"
+)
+
+func TestSerial(t *testing.T) {
+	s := newTestServer(t, false)
+	defer s.Stop()
+
+	addService(t, s, "a.serial.skydns.test.", 0, &msg.Service{Host: "10.0.0.1"})
+	defer delService(t, s, "a.serial.skydns.test.")
+
+	// Forget when we last checked, instead of waiting for serialCheck.
+	serial := func() uint32 {
+		s.soa.checked = time.Time{}
+		return s.serial()
+	}
+
+	s1 := serial()
+	if s2 := serial(); s2 != s1 {
+		t.Fatalf("expected serial to stay %d without changes, got %d", s1, s2)
+	}
+
+	addService(t, s, "b.serial.skydns.test.", 0, &msg.Service{Host: "10.0.0.2"})
+	s2 := serial()
+	if s2 <= s1 {
+		t.Fatalf("expected serial to increase after an addition, got %d after %d", s2, s1)
+	}
+
+	delService(t, s, "b.serial.skydns.test.")
+	s3 := serial()
+	if s3 <= s2 {
+		t.Fatalf("expected serial to increase after a deletion, got %d after %d", s3, s2)
+	}
+
+	// Outside our zone.
+	addService(t, s, "b.serial.skydns.local.", 0, &msg.Service{Host: "10.0.0.2"})
+	defer delService(t, s, "b.serial.skydns.local.")
+	if s4 := serial(); s4 != s3 {
+		t.Fatalf("expected serial to stay %d after a change outside the zone, got %d", s3, s4)
+	}
+}
@@ -5,6 +5,7 @@
 package server
 
 import (
+	"errors"
 	"fmt"
 	"math"
 	"net"
@@ -17,7 +18,6 @@ import (
 	"github.com/skynetservices/skydns/metrics"
 	"github.com/skynetservices/skydns/msg"
 
-	etcd "github.com/coreos/etcd/client"
 	"github.com/coreos/go-systemd/activation"
 	"github.com/miekg/dns"
 )
@@ -33,26 +33,200 @@ type server struct {
 	dnsTCPclient *dns.Client // used for forwarding queries
 	scache       *cache.Cache
 	rcache       *cache.Cache
+	pcache       *cache.Packed     // nil when replies are not cached packed
+	acache       *cache.Cache      // addresses of alias targets, nil when not cached
+	pool         *workerPool       // nil when every query gets its own goroutine
+	strict       *strictChecker    // nil when queries are not checked strictly
+	popular      *popularity       // nil when we don't save popular names
+	challenges   *challenges       // nil without an ACME API or certificate
+	cert         *certificate      // nil when the DoH certificate is not obtained with ACME
+	hosts        *hosts            // nil without a hosts file
+	mdns         *mdnsHosts        // nil when not importing hosts from mDNS
+	announced    *mdnsServices     // nil when not announcing services over mDNS
+	reverse      *reverseIndex     // nil when PTRs are not synthesized
+	weights      *weightController // nil without adaptive weights
+	journal      *journal          // nil when IXFR is answered with full transfers
+	secondaries  *secondaries      // nil without secondaries to notify
+	cookies      *cookieJar        // nil without DNS cookies
+	soa          soaSerial
+	tenants      []*tenant
+	views        []*view
+	noQuorum     *int32      // 1 when in degraded mode, see degraded
+	updateMu     sync.Mutex  // serializes dynamic updates, see ServeDNSUpdate
+	stages       dns.Handler // the stages of the server itself, see ServeDNS
 }
 
 // New returns a new SkyDNS server.
 func New(backend Backend, config *Config) *server {
-	return &server{
-		backend: backend,
+	var pool *workerPool
+	if config.Workers > 0 {
+		pool = newWorkerPool(config.Workers, config.WorkerQueue)
+	}
+	var strict *strictChecker
+	if config.Strict {
+		strict = newStrictChecker(config.FormErrRate)
+	}
+	var popular *popularity
+	if config.PopularFile != "" {
+		popular = newPopularity()
+	}
+	var ch *challenges
+	if config.AcmeAddr != "" || config.AcmeDirectory != "" {
+		ch = newChallenges(backend)
+	}
+	var h *hosts
+	if config.HostsFile != "" {
+		h = newHosts(config.HostsFile)
+	}
+	var mdns *mdnsHosts
+	if config.MDNS != nil && config.MDNS.Import != "" {
+		mdns = newMDNSHosts(config.MDNS.Import)
+	}
+	var announced *mdnsServices
+	if config.MDNS != nil && config.MDNS.Announce {
+		announced = new(mdnsServices)
+	}
+	var reverse *reverseIndex
+	if config.SynthesizePTR {
+		reverse = newReverseIndex()
+	}
+	var weights *weightController
+	if config.AdaptiveWeights != nil {
+		weights = newWeightController(config.AdaptiveWeights)
+	}
+	var j *journal
+	if config.IxfrJournal > 0 {
+		j = newJournal(config.IxfrJournal)
+	}
+	var sec *secondaries
+	if len(config.Secondaries) > 0 {
+		sec = newSecondaries(config.ReadTimeout, config.tsigKeys[config.SecondariesKey])
+	}
+	var jar *cookieJar
+	if config.Cookies != nil {
+		jar = newCookieJar()
+	}
+	var pcache *cache.Packed
+	if config.PCacheTtl > 0 {
+		pcache = cache.NewPacked(config.RCache, config.PCacheTtl, config.RCacheShards)
+	}
+	s := &server{
+		backend: faultBackend(backend, config.Faults),
 		config:  config,
 
 		group:        new(sync.WaitGroup),
 		scache:       cache.New(config.SCache, 0),
-		rcache:       cache.New(config.RCache, config.RCacheTtl),
+		rcache:       cache.NewSharded(config.RCache, config.RCacheTtl, config.RCacheShards),
+		pcache:       pcache,
+		acache:       cache.New(aliasCapacity, aliasTtl),
 		dnsUDPclient: &dns.Client{Net: "udp", ReadTimeout: config.ReadTimeout, WriteTimeout: config.ReadTimeout, SingleInflight: true},
 		dnsTCPclient: &dns.Client{Net: "tcp", ReadTimeout: config.ReadTimeout, WriteTimeout: config.ReadTimeout, SingleInflight: true},
+		pool:         pool,
+		strict:       strict,
+		popular:      popular,
+		challenges:   ch,
+		hosts:        h,
+		mdns:         mdns,
+		announced:    announced,
+		reverse:      reverse,
+		weights:      weights,
+		journal:      j,
+		secondaries:  sec,
+		cookies:      jar,
+		noQuorum:     new(int32),
 	}
+	s.stages = s.serverStages()
+	return s
 }
 
 // Run is a blocking operation that starts the server listening on the DNS ports.
 func (s *server) Run() error {
+	if s.config.Preload {
+		s.runPreload()
+	}
+	if s.popular != nil {
+		s.runPopular()
+	}
+	if s.config.AcmeAddr != "" {
+		s.runAcme()
+	}
+	if s.config.AcmeDirectory != "" {
+		if err := s.runCertificate(); err != nil {
+			return err
+		}
+	}
+	if s.hosts != nil {
+		s.runHosts()
+	}
+	if s.reverse != nil {
+		s.runReverse()
+	}
+	if s.weights != nil {
+		s.runWeights()
+	}
+	if s.config.MDNS != nil {
+		if err := s.runMDNS(); err != nil {
+			return err
+		}
+	}
+	if q, ok := s.backend.(Quorumer); ok && s.noQuorum != nil {
+		s.runQuorum(q)
+	}
+	if len(s.config.Webhooks) > 0 {
+		w, ok := s.backend.(Watcher)
+		if !ok {
+			return fmt.Errorf("webhooks need a backend that can watch for changes")
+		}
+		s.runWebhooks(w)
+	}
+	if s.journal != nil {
+		w, ok := s.backend.(Watcher)
+		if !ok {
+			return fmt.Errorf("the IXFR journal needs a backend that can watch for changes")
+		}
+		s.runJournal(w)
+	}
+	if s.secondaries != nil {
+		w, ok := s.backend.(Watcher)
+		if !ok {
+			return fmt.Errorf("notifying secondaries needs a backend that can watch for changes")
+		}
+		s.runSecondaries(w)
+	}
+	for _, ns := range s.config.Nameservers {
+		if s.config.isSelf(ns) {
+			logf("nameserver %s is our own address, not forwarding to it", ns)
+		}
+	}
+
 	mux := dns.NewServeMux()
-	mux.Handle(".", s)
+	if len(s.views) > 0 {
+		mux.Handle(".", viewHandler{s})
+	} else {
+		mux.Handle(".", s)
+	}
+	for _, t := range s.tenants {
+		mux.Handle(t.config.Domain, t)
+	}
+	if s.config.CatalogZone != "" {
+		mux.Handle(s.config.CatalogZone, dns.HandlerFunc(s.ServeDNSCatalog))
+	}
+	h := s.handler(mux)
+	if s.config.DoHAddr != "" {
+		if err := s.runDoH(h); err != nil {
+			return err
+		}
+	}
+	if s.config.GRPCAddr != "" {
+		if err := s.runGRPC(h); err != nil {
+			return err
+		}
+	}
+	if s.config.DoQAddr != "" {
+		if err := s.runDoQ(h); err != nil {
+			return err
+		}
+	}
 
 	dnsReadyMsg := func(addr, net string) {
 		if s.config.DNSSEC == "" {
@@ -79,7 +253,7 @@ func (s *server) Run() error {
 				s.group.Add(1)
 				go func() {
 					defer s.group.Done()
-					if err := dns.ActivateAndServe(nil, u, mux); err != nil {
+					if err := s.serveUDP(u, h); err != nil {
 						fatalf("%s", err)
 					}
 				}()
@@ -91,7 +265,7 @@ func (s *server) Run() error {
 				s.group.Add(1)
 				go func() {
 					defer s.group.Done()
-					if err := dns.ActivateAndServe(t, nil, mux); err != nil {
+					if err := s.serveTCP(t, h); err != nil {
 						fatalf("%s", err)
 					}
 				}()
@@ -99,57 +273,103 @@ func (s *server) Run() error {
 			}
 		}
 	} else {
-		s.group.Add(1)
-		go func() {
-			defer s.group.Done()
-			if err := dns.ListenAndServe(s.config.DnsAddr, "tcp", mux); err != nil {
-				fatalf("%s", err)
-			}
-		}()
-		dnsReadyMsg(s.config.DnsAddr, "tcp")
-		s.group.Add(1)
-		go func() {
-			defer s.group.Done()
-			if err := dns.ListenAndServe(s.config.DnsAddr, "udp", mux); err != nil {
-				fatalf("%s", err)
-			}
-		}()
-		dnsReadyMsg(s.config.DnsAddr, "udp")
+		for _, addr := range s.config.listenAddrs {
+			s.group.Add(1)
+			go func(addr string) {
+				defer s.group.Done()
+				if err := s.listenAndServeTCP(addr, h); err != nil {
+					fatalf("%s", err)
+				}
+			}(addr)
+			dnsReadyMsg(addr, "tcp")
+			s.group.Add(1)
+			go func(addr string) {
+				defer s.group.Done()
+				if err := s.listenAndServeUDP(addr, h); err != nil {
+					fatalf("%s", err)
+				}
+			}(addr)
+			dnsReadyMsg(addr, "udp")
+		}
 	}
 
 	s.group.Wait()
 	return nil
 }
 
+// newReply returns an authoritative reply to req.
+func (s *server) newReply(req *dns.Msg) *dns.Msg {
+	m := new(dns.Msg)
+	m.SetReply(req)
+	m.Authoritative = true
+	m.RecursionAvailable = true
+	m.Compress = true
+	return m
+}
+
+// setAD sets the AD bit of m, our reply to req. Data from our own zone is
+// authentic when the zone is signed, referrals are not ours and never are.
+// AD is only set when the client asked for DNSSEC with DO or signalled with AD
+// that it understands the bit, see RFC 6840, section 5.7. CD does not change
+// this, we don't validate, and signing still happens when DO is set.
+func (s *server) setAD(m, req *dns.Msg, dnssec bool) {
+	m.AuthenticatedData = s.config.PubKey != nil && m.Authoritative &&
+		(m.Rcode == dns.RcodeSuccess || m.Rcode == dns.RcodeNameError) &&
+		(dnssec || req.AuthenticatedData)
+}
+
+// querySize returns the size of the reply to req that the client on w takes, and
+// whether it asked for DNSSEC records with DO.
+func (s *server) querySize(w dns.ResponseWriter, req *dns.Msg) (bufsize uint16, dnssec bool) {
+	bufsize = 512
+	if o := req.IsEdns0(); o != nil {
+		bufsize = o.UDPSize()
+		dnssec = o.Do()
+	}
+	if bufsize < 512 {
+		bufsize = 512
+	}
+	if s.config.MaxUDPSize != 0 && int(bufsize) > s.config.MaxUDPSize {
+		bufsize = uint16(s.config.MaxUDPSize)
+	}
+	// with TCP we can send 64K
+	if isTCP(w) {
+		bufsize = dns.MaxMsgSize - 1
+	}
+	return bufsize, dnssec
+}
+
 // Stop stops a server.
 func (s *server) Stop() {
 	// TODO(miek)
 	//s.group.Add(-2)
 }
 
-// ServeDNS is the handler for DNS requests, responsible for parsing DNS request, possibly forwarding
-// it to a real dns server and returning a response.
+// ServeDNS is the handler for DNS requests, the end of the chain: the stages of
+// the server itself (see serverMiddleware) answer queries from the cache, or pass
+// them to the backend, serveBackend, and sign its answers.
 func (s *server) ServeDNS(w dns.ResponseWriter, req *dns.Msg) {
-	m := new(dns.Msg)
-	m.SetReply(req)
-	m.Authoritative = true
-	m.RecursionAvailable = true
-	m.Compress = true
+	s.stages.ServeDNS(w, req)
+}
 
-	bufsize := uint16(512)
-	dnssec := false
-	tcp := false
+// serveBackend is responsible for parsing DNS request, possibly forwarding it to
+// a real dns server and returning a response. It tells the stages of the server
+// what its reply is, see setReply.
+func (s *server) serveBackend(w dns.ResponseWriter, req *dns.Msg) {
+	w = s.signReplies(w, req)
+	m := s.newReply(req)
 	start := time.Now()
 
 	q := req.Question[0]
 	name := strings.ToLower(q.Name)
 
-	if q.Qtype == dns.TypeANY || !s.backend.HasSynced() {
+	if !s.backend.HasSynced() {
 		m.Authoritative = false
 		m.Rcode = dns.RcodeRefused
 		m.RecursionAvailable = false
 		m.RecursionDesired = false
 		m.Compress = false
+		s.explain(m, req, reasonNotSynced)
 		w.WriteMsg(m)
 
 		metrics.ReportRequestCount(m, metrics.Auth)
@@ -159,54 +379,64 @@ func (s *server) ServeDNS(w dns.ResponseWriter, req *dns.Msg) {
 		return
 	}
 
-	if o := req.IsEdns0(); o != nil {
-		bufsize = o.UDPSize()
-		dnssec = o.Do()
-	}
-	if bufsize < 512 {
-		bufsize = 512
-	}
-	// with TCP we can send 64K
-	if tcp = isTCP(w); tcp {
-		bufsize = dns.MaxMsgSize - 1
+	if m := s.badVersion(req); m != nil {
+		s.explain(m, req, reasonBadVersion)
+		w.WriteMsg(m)
+
+		metrics.ReportRequestCount(req, metrics.Auth)
+		metrics.ReportDuration(m, start, metrics.Auth)
+		metrics.ReportErrorCount(m, metrics.Auth)
+
+		return
 	}
 
-	if s.config.Verbose {
-		logf("received DNS Request for %q from %q with type %d", q.Name, w.RemoteAddr(), q.Qtype)
+	if req.Opcode == dns.OpcodeNotify {
+		metrics.ReportRequestCount(req, metrics.Notify)
+
+		resp := s.ServeDNSNotify(w, req)
+
+		metrics.ReportDuration(resp, start, metrics.Notify)
+		metrics.ReportErrorCount(resp, metrics.Notify)
+		return
 	}
 
-	// Check cache first.
-	m1 := s.rcache.Hit(q, dnssec, tcp, m.Id)
-	if m1 != nil {
-		metrics.ReportRequestCount(req, metrics.Cache)
+	if req.Opcode == dns.OpcodeUpdate {
+		metrics.ReportRequestCount(req, metrics.Update)
 
-		if send := s.overflowOrTruncated(w, m1, int(bufsize), metrics.Cache); send {
-			return
-		}
+		resp := s.ServeDNSUpdate(w, req)
 
-		// Still round-robin even with hits from the cache.
-		// Only shuffle A and AAAA records with each other.
-		if q.Qtype == dns.TypeA || q.Qtype == dns.TypeAAAA {
-			s.RoundRobin(m1.Answer)
-		}
+		metrics.ReportDuration(resp, start, metrics.Update)
+		metrics.ReportErrorCount(resp, metrics.Update)
+		return
+	}
 
-		if err := w.WriteMsg(m1); err != nil {
-			logf("failure to return reply %q", err)
-		}
+	if q.Qtype == dns.TypeAXFR || q.Qtype == dns.TypeIXFR {
+		metrics.ReportRequestCount(req, metrics.Transfer)
 
-		metrics.ReportDuration(m1, start, metrics.Cache)
-		metrics.ReportErrorCount(m1, metrics.Cache)
+		resp := s.ServeDNSTransfer(w, req)
+
+		metrics.ReportDuration(resp, start, metrics.Transfer)
+		metrics.ReportErrorCount(resp, metrics.Transfer)
 		return
 	}
 
+	bufsize, dnssec := s.querySize(w, req)
+
+	if s.challenges != nil && q.Qtype == dns.TypeTXT && strings.HasPrefix(name, acmeLabel) {
+		if resp := s.ServeDNSChallenge(w, req, dnssec, bufsize); resp != nil {
+			metrics.ReportRequestCount(req, metrics.Auth)
+			metrics.ReportDuration(resp, start, metrics.Auth)
+			metrics.ReportErrorCount(resp, metrics.Auth)
+			return
+		}
+	}
+
 	for zone, ns := range *s.config.stub {
 		if strings.HasSuffix(name, "."+zone) || name == zone {
 			metrics.ReportRequestCount(req, metrics.Stub)
 
+			setReply(w, replyForwarded, 0)
 			resp := s.ServeDNSStubForward(w, req, ns)
-			if resp != nil {
-				s.rcache.InsertMessage(cache.Key(q, dnssec, tcp), resp)
-			}
 
 			metrics.ReportDuration(resp, start, metrics.Stub)
 			metrics.ReportErrorCount(resp, metrics.Stub)
@@ -222,10 +452,8 @@ func (s *server) ServeDNS(w dns.ResponseWriter, req *dns.Msg) {
 	if q.Qtype == dns.TypePTR && strings.HasSuffix(name, ".in-addr.arpa.") || strings.HasSuffix(name, ".ip6.arpa.") {
 		metrics.ReportRequestCount(req, metrics.Reverse)
 
+		setReply(w, replyForwarded, 0)
 		resp := s.ServeDNSReverse(w, req)
-		if resp != nil {
-			s.rcache.InsertMessage(cache.Key(q, dnssec, tcp), resp)
-		}
 
 		metrics.ReportDuration(resp, start, metrics.Reverse)
 		metrics.ReportErrorCount(resp, metrics.Reverse)
@@ -235,58 +463,50 @@ func (s *server) ServeDNS(w dns.ResponseWriter, req *dns.Msg) {
 	if q.Qclass != dns.ClassCHAOS && !strings.HasSuffix(name, "."+s.config.Domain) && name != s.config.Domain {
 		metrics.ReportRequestCount(req, metrics.Rec)
 
-		resp := s.ServeDNSForward(w, req)
-		if resp != nil {
-			s.rcache.InsertMessage(cache.Key(q, dnssec, tcp), resp)
-		}
+		// The client subnet to forward with, the reply is cached for it when the
+		// nameserver says it only holds for that subnet.
+		setReply(w, replyForwarded, 0)
+		resp, scope := s.forward(w, req, s.clientSubnet(w, req))
+		setReply(w, replyForwarded, scope)
 
 		metrics.ReportDuration(resp, start, metrics.Rec)
 		metrics.ReportErrorCount(resp, metrics.Rec)
 		return
 	}
 
-	metrics.ReportCacheMiss(metrics.Response)
-
 	defer func() {
+		// Nothing found here, maybe the name is delegated to other nameservers.
+		reply := replyAnswer
+		if len(m.Answer) == 0 && (m.Rcode == dns.RcodeSuccess || m.Rcode == dns.RcodeNameError) {
+			if r := s.Referral(req, name); r != nil {
+				m, reply = r, replyReferral
+			}
+		}
+
 		metrics.ReportRequestCount(req, metrics.Auth)
 		metrics.ReportDuration(m, start, metrics.Auth)
 		metrics.ReportErrorCount(m, metrics.Auth)
 
-		if m.Rcode == dns.RcodeServerFailure {
-			if err := w.WriteMsg(m); err != nil {
-				logf("failure to return reply %q", err)
-			}
-			return
-		}
-		// Set TTL to the minimum of the RRset and dedup the message, i.e. remove identical RRs.
-		m = s.dedup(m)
+		if m.Rcode != dns.RcodeServerFailure {
+			// Set TTL to the minimum of the RRset and dedup the message, i.e. remove identical RRs.
+			m = s.dedup(m)
 
-		minttl := s.config.Ttl
-		if len(m.Answer) > 1 {
-			for _, r := range m.Answer {
-				if r.Header().Ttl < minttl {
-					minttl = r.Header().Ttl
+			minttl := s.config.Ttl
+			if len(m.Answer) > 1 {
+				for _, r := range m.Answer {
+					if r.Header().Ttl < minttl {
+						minttl = r.Header().Ttl
+					}
+				}
+				for _, r := range m.Answer {
+					r.Header().Ttl = minttl
 				}
-			}
-			for _, r := range m.Answer {
-				r.Header().Ttl = minttl
-			}
-		}
-
-		if dnssec {
-			if s.config.PubKey != nil {
-				m.AuthenticatedData = true
-				s.Denial(m)
-				s.Sign(m, bufsize)
 			}
 		}
 
-		if send := s.overflowOrTruncated(w, m, int(bufsize), metrics.Auth); send {
-			return
-		}
-
-		s.rcache.InsertMessage(cache.Key(q, dnssec, tcp), m)
-
+		// The dnssec stage signs the reply, the cache stage caches it and fits it
+		// to the client.
+		setReply(w, reply, 0)
 		if err := w.WriteMsg(m); err != nil {
 			logf("failure to return reply %q", err)
 		}
@@ -305,6 +525,11 @@ func (s *server) ServeDNS(w dns.ResponseWriter, req *dns.Msg) {
 		}
 	}
 	if q.Qclass == dns.ClassCHAOS {
+		if s.config.NoChaos {
+			m.SetRcode(req, dns.RcodeRefused)
+			s.explain(m, req, reasonChaosRefused)
+			return
+		}
 		if q.Qtype == dns.TypeTXT {
 			switch name {
 			case "authors.bind.":
@@ -328,62 +553,180 @@ func (s *server) ServeDNS(w dns.ResponseWriter, req *dns.Msg) {
 				fallthrough
 			case "version.server.":
 				hdr := dns.RR_Header{Name: q.Name, Rrtype: dns.TypeTXT, Class: dns.ClassCHAOS, Ttl: 0}
-				m.Answer = []dns.RR{&dns.TXT{Hdr: hdr, Txt: []string{Version}}}
+				m.Answer = []dns.RR{&dns.TXT{Hdr: hdr, Txt: []string{s.config.ChaosVersion}}}
 				return
 			case "hostname.bind.":
-				fallthrough
+				hdr := dns.RR_Header{Name: q.Name, Rrtype: dns.TypeTXT, Class: dns.ClassCHAOS, Ttl: 0}
+				m.Answer = []dns.RR{&dns.TXT{Hdr: hdr, Txt: []string{s.config.ChaosHostname}}}
+				return
 			case "id.server.":
-				// TODO(miek): machine name to return
 				hdr := dns.RR_Header{Name: q.Name, Rrtype: dns.TypeTXT, Class: dns.ClassCHAOS, Ttl: 0}
-				m.Answer = []dns.RR{&dns.TXT{Hdr: hdr, Txt: []string{"localhost"}}}
+				m.Answer = []dns.RR{&dns.TXT{Hdr: hdr, Txt: []string{s.config.ChaosID}}}
 				return
 			}
 		}
 		// still here, fail
 		m.SetReply(req)
 		m.SetRcode(req, dns.RcodeServerFailure)
+		s.explain(m, req, reasonChaos)
 		return
 	}
 
+	m = s.answer(m, req, q, name, bufsize, dnssec)
+	if m.Rcode == dns.RcodeNameError && len(m.Answer) == 0 {
+		// RFC 6672, the names below a DNAME are synthesized from it.
+		if m1 := s.dnameAnswer(req, q, name, bufsize, dnssec); m1 != nil {
+			m = m1
+			return
+		}
+		// RFC 4592, synthesize an answer from the wildcard at the closest encloser.
+		if wildcard := s.wildcard(name); wildcard != "" {
+			m = s.answer(s.newReply(req), req, q, wildcard, bufsize, dnssec)
+		}
+	}
+}
+
+// answer adds the records for name to m, q.Name is used as the owner name. It
+// returns m, or a new message if name does not exist or the backend failed.
+func (s *server) answer(m, req *dns.Msg, q dns.Question, name string, bufsize uint16, dnssec bool) *dns.Msg {
+	// RFC 2782 names may exist only through the services of their parent, see
+	// srvServices, so a name error from other lookups is not final for them.
+	_, _, _, _, srvName := splitSrvName(name)
+	nameError := func(err error) *dns.Msg {
+		m := s.NameError(req)
+		if err == errNotActive {
+			s.explain(m, req, reasonNotActive)
+		} else {
+			s.explain(m, req, reasonNoSuchName)
+		}
+		return m
+	}
 	switch q.Qtype {
 	case dns.TypeNS:
 		if name != s.config.Domain {
 			break
 		}
-		// Lookup s.config.DnsDomain
+		// Lookup s.config.DnsDomain, and add the nameservers from the config.
 		records, extra, err := s.NSRecords(q, s.config.dnsDomain)
-		if isEtcdNameError(err, s) {
-			m = s.NameError(req)
-			return
+		records = append(records, s.configNS(q)...)
+		if len(records) == 0 && isNameError(err, s) {
+			return nameError(err)
 		}
 		m.Answer = append(m.Answer, records...)
 		m.Extra = append(m.Extra, extra...)
 	case dns.TypeA, dns.TypeAAAA:
+		if name == s.config.Domain {
+			// The addresses of the apex live in s.config.apexDomain, if there are any.
+			records, err := s.AddressRecords(q, s.config.apexDomain, nil, bufsize, dnssec, false)
+			if err == nil && len(records) > 0 {
+				m.Answer = append(m.Answer, records...)
+				break
+			}
+		}
 		records, err := s.AddressRecords(q, name, nil, bufsize, dnssec, false)
-		if isEtcdNameError(err, s) {
-			m = s.NameError(req)
-			return
+		switch err {
+		case errCNAMELoop:
+			m := s.ServerFailure(req)
+			s.explain(m, req, reasonCNAMELoop)
+			return m
+		case errCNAMEDepth:
+			m := s.ServerFailure(req)
+			s.explain(m, req, reasonCNAMEDepth)
+			return m
+		}
+		if isNameError(err, s) && !srvName {
+			return nameError(err)
 		}
 		m.Answer = append(m.Answer, records...)
+	case dns.TypeANY:
+		policy := s.config.anyPolicy(name)
+		if policy == AnyHINFO {
+			// RFC 8482, for names that don't exist we return NXDOMAIN below.
+			if s.nameExists(name) {
+				m.Answer = []dns.RR{s.anyHINFO(q.Name)}
+			}
+			break
+		}
+		records, extra, err := s.AnyRecords(q, name, bufsize, dnssec)
+		if isNameError(err, s) && !srvName {
+			return nameError(err)
+		}
+		if policy == AnyRRset {
+			// The additional records are for the other RRsets too, leave them out.
+			records, extra = firstRRset(records), nil
+		}
+		m.Answer = append(m.Answer, records...)
+		m.Extra = append(m.Extra, extra...)
 	case dns.TypeTXT:
 		records, err := s.TXTRecords(q, name)
-		if isEtcdNameError(err, s) {
-			m = s.NameError(req)
-			return
+		if isNameError(err, s) && !srvName {
+			return nameError(err)
+		}
+		m.Answer = append(m.Answer, records...)
+	case dns.TypePTR:
+		records, err := s.DNSSDRecords(q, name)
+		if isNameError(err, s) && !srvName {
+			return nameError(err)
 		}
 		m.Answer = append(m.Answer, records...)
 	case dns.TypeCNAME:
 		records, err := s.CNAMERecords(q, name)
-		if isEtcdNameError(err, s) {
-			m = s.NameError(req)
-			return
+		if isNameError(err, s) && !srvName {
+			return nameError(err)
 		}
 		m.Answer = append(m.Answer, records...)
 	case dns.TypeMX:
 		records, extra, err := s.MXRecords(q, name, bufsize, dnssec)
-		if isEtcdNameError(err, s) {
-			m = s.NameError(req)
-			return
+		if isNameError(err, s) && !srvName {
+			return nameError(err)
+		}
+		m.Answer = append(m.Answer, records...)
+		m.Extra = append(m.Extra, extra...)
+	case dns.TypeNAPTR:
+		records, extra, err := s.NAPTRRecords(q, name, bufsize, dnssec)
+		if isNameError(err, s) && !srvName {
+			return nameError(err)
+		}
+		m.Answer = append(m.Answer, records...)
+		m.Extra = append(m.Extra, extra...)
+	case dns.TypeCAA:
+		records, err := s.CAARecords(q, name)
+		if isNameError(err, s) && !srvName {
+			return nameError(err)
+		}
+		m.Answer = append(m.Answer, records...)
+	case dns.TypeURI:
+		records, err := s.URIRecords(q, name)
+		if isNameError(err, s) && !srvName {
+			return nameError(err)
+		}
+		m.Answer = append(m.Answer, records...)
+	case dns.TypeTLSA:
+		records, err := s.TLSARecords(q, name)
+		if isNameError(err, s) && !srvName {
+			return nameError(err)
+		}
+		m.Answer = append(m.Answer, records...)
+	case dns.TypeDNAME:
+		records, err := s.DNAMERecords(q, name)
+		if isNameError(err, s) && !srvName {
+			return nameError(err)
+		}
+		m.Answer = append(m.Answer, records...)
+	case dns.TypeDS:
+		// The DS records of a delegated zone are on our side of the cut, without
+		// them it is NODATA or NXDOMAIN, see below.
+		records, err := s.DSRecords(q, name)
+		if err != nil && !isNameError(err, s) {
+			m := s.ServerFailure(req)
+			s.explain(m, req, backendReason(err))
+			return m
+		}
+		m.Answer = append(m.Answer, records...)
+	case msg.TypeSVCB, msg.TypeHTTPS:
+		records, extra, err := s.SVCBRecords(q, name, bufsize, dnssec)
+		if isNameError(err, s) && !srvName {
+			return nameError(err)
 		}
 		m.Answer = append(m.Answer, records...)
 		m.Extra = append(m.Extra, extra...)
@@ -392,14 +735,14 @@ func (s *server) ServeDNS(w dns.ResponseWriter, req *dns.Msg) {
 	case dns.TypeSRV:
 		records, extra, err := s.SRVRecords(q, name, bufsize, dnssec)
 		if err != nil {
-			if isEtcdNameError(err, s) {
-				m = s.NameError(req)
-				return
+			if isNameError(err, s) {
+				return nameError(err)
 			}
 			logf("got error from backend: %s", err)
 			if q.Qtype == dns.TypeSRV { // Otherwise NODATA
-				m = s.ServerFailure(req)
-				return
+				m := s.ServerFailure(req)
+				s.explain(m, req, backendReason(err))
+				return m
 			}
 		}
 		// if we are here again, check the types, because an answer may only
@@ -409,61 +752,122 @@ func (s *server) ServeDNS(w dns.ResponseWriter, req *dns.Msg) {
 		if q.Qtype == dns.TypeSRV {
 			m.Answer = append(m.Answer, records...)
 			m.Extra = append(m.Extra, extra...)
+			break
 		}
+		// The types we don't synthesize may be in the Raw field of services.
+		m.Answer = append(m.Answer, s.RawRecords(q, name)...)
 	}
+	s.applyAddressPolicies(m, q, name, bufsize, dnssec)
 
-	if len(m.Answer) == 0 { // NODATA response
+	if len(m.Answer) == 0 { // NODATA response, if the name exists.
+		if !s.nameExists(name) {
+			return nameError(nil)
+		}
 		m.Ns = []dns.RR{s.NewSOA()}
 		m.Ns[0].Header().Ttl = s.config.MinTtl
+		return m
+	}
+	// A CNAME chain that ends in our domain without an answer, RFC 2308, section
+	// 2: the rcode and the SOA are those of the name at the end of the chain.
+	if end := chainEnd(m); !owns(m.Answer, end) && q.Qtype != dns.TypeCNAME && q.Qtype != dns.TypeANY &&
+		dns.IsSubDomain(s.config.Domain, end) {
+		if !s.nameExists(strings.ToLower(end)) {
+			m.Rcode = dns.RcodeNameError
+			s.explain(m, req, reasonNoSuchName)
+		}
+		m.Ns = []dns.RR{s.NewSOA()}
+		m.Ns[0].Header().Ttl = s.config.MinTtl
+	}
+	return m
+}
+
+// chainEnd returns the name at the end of the CNAMEs in the answer of m, that
+// start at the query name. It is the name a negative reply is about.
+func chainEnd(m *dns.Msg) string {
+	name := m.Question[0].Name
+	for range m.Answer {
+		next := ""
+		for _, r := range m.Answer {
+			if cname, ok := r.(*dns.CNAME); ok && strings.EqualFold(cname.Hdr.Name, name) {
+				next = cname.Target
+				break
+			}
+		}
+		if next == "" {
+			break
+		}
+		name = next
 	}
+	return name
+}
+
+// owns returns true if one of rrs has name as its owner name.
+func owns(rrs []dns.RR, name string) bool {
+	for _, r := range rrs {
+		if strings.EqualFold(r.Header().Name, name) {
+			return true
+		}
+	}
+	return false
 }
 
 func (s *server) AddressRecords(q dns.Question, name string, previousRecords []dns.RR, bufsize uint16, dnssec, both bool) (records []dns.RR, err error) {
-	services, err := s.backend.Records(name, false)
+	services, err := s.records(name, false)
 	if err != nil {
 		return nil, err
 	}
 
-	services = msg.Group(services)
+	services = s.failover(group(services))
 
 	for _, serv := range services {
 		ip := net.ParseIP(serv.Host)
 		switch {
+		case ip == nil && serv.Alias:
+			records = append(records, s.aliasRecords(q, serv, previousRecords, bufsize, dnssec, both)...)
+		case serv.Host == "":
+			// Only data, TXT for instance, the name has no addresses.
 		case ip == nil:
 			// Try to resolve as CNAME if it's not an IP, but only if we don't create loops.
-			if q.Name == dns.Fqdn(serv.Host) {
+			if name == msg.Target(serv.Host) {
+				// x CNAME x is a direct loop.
 				logf("CNAME loop detected: %q -> %q", q.Name, q.Name)
-				// x CNAME x is a direct loop, don't add those
-				continue
+				return nil, errCNAMELoop
 			}
 
-			newRecord := serv.NewCNAME(q.Name, dns.Fqdn(serv.Host))
-			if len(previousRecords) > 7 {
-				logf("CNAME lookup limit of 8 exceeded for %s", newRecord)
-				// don't add it, and just continue
-				continue
+			newRecord := serv.NewCNAME(q.Name, msg.Target(serv.Host))
+			if len(previousRecords) >= s.config.CNAMEDepth {
+				logf("CNAME lookup limit of %d exceeded for %s", s.config.CNAMEDepth, newRecord)
+				return nil, errCNAMEDepth
 			}
 			if s.isDuplicateCNAME(newRecord, previousRecords) {
 				logf("CNAME loop detected for record %s", newRecord)
-				continue
+				return nil, errCNAMELoop
 			}
 
-			nextRecords, err := s.AddressRecords(dns.Question{Name: dns.Fqdn(serv.Host), Qtype: q.Qtype, Qclass: q.Qclass},
-				strings.ToLower(dns.Fqdn(serv.Host)), append(previousRecords, newRecord), bufsize, dnssec, both)
-			if err == nil {
+			target := newRecord.Target
+			if dns.IsSubDomain(s.config.Domain, target) {
+				// Resolve the rest of the chain ourselves, if we can not complete it
+				// there is no point in asking elsewhere.
+				nextRecords, err := s.AddressRecords(dns.Question{Name: target, Qtype: q.Qtype, Qclass: q.Qclass},
+					target, append(previousRecords, newRecord), bufsize, dnssec, both)
+				if err == errCNAMELoop || err == errCNAMEDepth {
+					return nil, err
+				}
 				// Only have we found something we should add the CNAME and the IP addresses.
-				if len(nextRecords) > 0 {
+				if err == nil && len(nextRecords) > 0 {
 					records = append(records, newRecord)
 					records = append(records, nextRecords...)
+					continue
+				}
+				// A chain that ends in our domain without addresses is still the
+				// answer when the CNAME is alone, the end of the chain decides
+				// between NODATA and NXDOMAIN, see chainEnd.
+				if len(services) == 1 && !both && (err == nil || isNameError(err, s)) {
+					records = append(records, newRecord)
 				}
 				continue
 			}
-			// This means we can not complete the CNAME, try to look else where.
-			target := newRecord.Target
-			if dns.IsSubDomain(s.config.Domain, target) {
-				// We should already have found it
-				continue
-			}
+			// The chain leaves our zone, only now ask the upstream nameservers.
 			m1, e1 := s.Lookup(target, q.Qtype, bufsize, dnssec)
 			if e1 != nil {
 				logf("incomplete CNAME chain from %q: %s", target, e1)
@@ -483,20 +887,28 @@ func (s *server) AddressRecords(q dns.Question, name string, previousRecords []d
 	return records, nil
 }
 
+// errCNAMELoop and errCNAMEDepth are returned by AddressRecords when the chain
+// of CNAMEs in our domain loops, or is longer than CNAMEDepth.
+var (
+	errCNAMELoop  = errors.New("CNAME loop")
+	errCNAMEDepth = errors.New("CNAME chain too long")
+)
+
 // NSRecords returns NS records from etcd.
 func (s *server) NSRecords(q dns.Question, name string) (records []dns.RR, extra []dns.RR, err error) {
-	services, err := s.backend.Records(name, false)
+	services, err := s.records(name, false)
 	if err != nil {
 		return nil, nil, err
 	}
 
-	services = msg.Group(services)
+	services = group(services)
 
 	for _, serv := range services {
 		ip := net.ParseIP(serv.Host)
 		switch {
 		case ip == nil:
-			return nil, nil, fmt.Errorf("NS record must be an IP address")
+			// A nameserver out of our domain, it has no glue.
+			records = append(records, serv.NewNS(q.Name, msg.Target(serv.Host)))
 		case ip.To4() != nil:
 			serv.Host = msg.Domain(serv.Key)
 			records = append(records, serv.NewNS(q.Name, serv.Host))
@@ -512,36 +924,32 @@ func (s *server) NSRecords(q dns.Question, name string) (records []dns.RR, extra
 
 // SRVRecords returns SRV records from etcd.
 // If the Target is not a name but an IP address, a name is created.
+// RFC 2782 names (_service._proto.name) are resolved with srvServices.
 func (s *server) SRVRecords(q dns.Question, name string, bufsize uint16, dnssec bool) (records []dns.RR, extra []dns.RR, err error) {
-	services, err := s.backend.Records(name, false)
+	services, err := s.srvServices(name)
 	if err != nil {
 		return nil, nil, err
 	}
 
-	services = msg.Group(services)
+	services = group(services)
 
 	// Looping twice to get the right weight vs priority
-	w := make(map[int]int)
-	for _, serv := range services {
-		weight := 100
+	weights := make([]float64, len(services))
+	w := make(map[int]float64)
+	now := time.Now()
+	for i, serv := range services {
+		weights[i] = 100
 		if serv.Weight != 0 {
-			weight = serv.Weight
+			weights[i] = float64(serv.Weight)
 		}
-		if _, ok := w[serv.Priority]; !ok {
-			w[serv.Priority] = weight
-			continue
+		if s.weights != nil {
+			weights[i] *= s.weights.factor(endpoint(serv), now)
 		}
-		w[serv.Priority] += weight
+		w[serv.Priority] += weights[i]
 	}
 	lookup := make(map[string]bool)
-	for _, serv := range services {
-		w1 := 100.0 / float64(w[serv.Priority])
-		if serv.Weight == 0 {
-			w1 *= 100
-		} else {
-			w1 *= float64(serv.Weight)
-		}
-		weight := uint16(math.Floor(w1))
+	for i, serv := range services {
+		weight := uint16(math.Floor(100.0 / w[serv.Priority] * weights[i]))
 		ip := net.ParseIP(serv.Host)
 		switch {
 		case ip == nil:
@@ -553,43 +961,23 @@ func (s *server) SRVRecords(q dns.Question, name string, bufsize uint16, dnssec
 			}
 
 			lookup[srv.Target] = true
-
-			if !dns.IsSubDomain(s.config.Domain, srv.Target) {
-				m1, e1 := s.Lookup(srv.Target, dns.TypeA, bufsize, dnssec)
-				if e1 == nil {
-					extra = append(extra, m1.Answer...)
-				}
-				m1, e1 = s.Lookup(srv.Target, dns.TypeAAAA, bufsize, dnssec)
-				if e1 == nil {
-					// If we have seen CNAME's we *assume* that they are already added.
-					for _, a := range m1.Answer {
-						if _, ok := a.(*dns.CNAME); !ok {
-							extra = append(extra, a)
-						}
-					}
-				}
-				break
-			}
-			// Internal name, we should have some info on them, either v4 or v6
-			// Clients expect a complete answer, because we are a recursor in their
-			// view.
-			addr, e1 := s.AddressRecords(dns.Question{srv.Target, dns.ClassINET, dns.TypeA},
-				srv.Target, nil, bufsize, dnssec, true)
-			if e1 == nil {
-				extra = append(extra, addr...)
-			}
+			extra = append(extra, s.targetRecords(srv.Target, bufsize, dnssec)...)
 		case ip.To4() != nil:
 			serv.Host = msg.Domain(serv.Key)
 			srv := serv.NewSRV(q.Name, weight)
 
 			records = append(records, srv)
-			extra = append(extra, serv.NewA(srv.Target, ip.To4()))
+			if s.config.Additional != AdditionalNone {
+				extra = append(extra, serv.NewA(srv.Target, ip.To4()))
+			}
 		case ip.To4() == nil:
 			serv.Host = msg.Domain(serv.Key)
 			srv := serv.NewSRV(q.Name, weight)
 
 			records = append(records, srv)
-			extra = append(extra, serv.NewAAAA(srv.Target, ip.To16()))
+			if s.config.Additional != AdditionalNone {
+				extra = append(extra, serv.NewAAAA(srv.Target, ip.To16()))
+			}
 		}
 	}
 	return records, extra, nil
@@ -598,7 +986,7 @@ func (s *server) SRVRecords(q dns.Question, name string, bufsize uint16, dnssec
 // MXRecords returns MX records from etcd.
 // If the Target is not a name but an IP address, a name is created.
 func (s *server) MXRecords(q dns.Question, name string, bufsize uint16, dnssec bool) (records []dns.RR, extra []dns.RR, err error) {
-	services, err := s.backend.Records(name, false)
+	services, err := s.records(name, false)
 	if err != nil {
 		return nil, nil, err
 	}
@@ -618,69 +1006,330 @@ func (s *server) MXRecords(q dns.Question, name string, bufsize uint16, dnssec b
 			}
 
 			lookup[mx.Mx] = true
-
-			if !dns.IsSubDomain(s.config.Domain, mx.Mx) {
-				m1, e1 := s.Lookup(mx.Mx, dns.TypeA, bufsize, dnssec)
-				if e1 == nil {
-					extra = append(extra, m1.Answer...)
-				}
-				m1, e1 = s.Lookup(mx.Mx, dns.TypeAAAA, bufsize, dnssec)
-				if e1 == nil {
-					// If we have seen CNAME's we *assume* that they are already added.
-					for _, a := range m1.Answer {
-						if _, ok := a.(*dns.CNAME); !ok {
-							extra = append(extra, a)
-						}
-					}
-				}
-				break
-			}
-			// Internal name
-			addr, e1 := s.AddressRecords(dns.Question{mx.Mx, dns.ClassINET, dns.TypeA},
-				mx.Mx, nil, bufsize, dnssec, true)
-			if e1 == nil {
-				extra = append(extra, addr...)
-			}
+			extra = append(extra, s.targetRecords(mx.Mx, bufsize, dnssec)...)
 		case ip.To4() != nil:
 			serv.Host = msg.Domain(serv.Key)
 			records = append(records, serv.NewMX(q.Name))
-			extra = append(extra, serv.NewA(serv.Host, ip.To4()))
+			if s.config.Additional != AdditionalNone {
+				extra = append(extra, serv.NewA(serv.Host, ip.To4()))
+			}
 		case ip.To4() == nil:
 			serv.Host = msg.Domain(serv.Key)
 			records = append(records, serv.NewMX(q.Name))
-			extra = append(extra, serv.NewAAAA(serv.Host, ip.To16()))
+			if s.config.Additional != AdditionalNone {
+				extra = append(extra, serv.NewAAAA(serv.Host, ip.To16()))
+			}
+		}
+	}
+	return records, extra, nil
+}
+
+// NAPTRRecords returns NAPTR records from etcd. For a terminal NAPTR record in
+// our domain, with an "s" or "a" flag, the SRV or address records of its
+// Replacement are added to the additional section, see RFC 3403, section 4.2.
+func (s *server) NAPTRRecords(q dns.Question, name string, bufsize uint16, dnssec bool) (records []dns.RR, extra []dns.RR, err error) {
+	services, err := s.records(name, false)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	lookup := make(map[string]bool)
+	for _, serv := range services {
+		if serv.Naptr == nil {
+			continue
+		}
+		naptr := serv.NewNAPTR(q.Name)
+		records = append(records, naptr)
+		if naptr.Replacement == "." || lookup[naptr.Replacement] || s.config.Additional == AdditionalNone {
+			continue
+		}
+		lookup[naptr.Replacement] = true
+		switch strings.ToLower(naptr.Flags) {
+		case "s":
+			if !dns.IsSubDomain(s.config.Domain, naptr.Replacement) {
+				break
+			}
+			srvq := dns.Question{Name: naptr.Replacement, Qtype: dns.TypeSRV, Qclass: dns.ClassINET}
+			srv, srvExtra, err := s.SRVRecords(srvq, naptr.Replacement, bufsize, dnssec)
+			if err != nil {
+				break
+			}
+			extra = append(extra, srv...)
+			extra = append(extra, srvExtra...)
+		case "a":
+			extra = append(extra, s.targetRecords(naptr.Replacement, bufsize, dnssec)...)
+		}
+	}
+	return records, extra, nil
+}
+
+// CAARecords returns the CAA records of name from etcd. Unlike other types, CAA
+// records deeper down do not belong to name: certificate authorities climb the
+// tree themselves, a restriction for a subdomain must not apply to name. So only
+// the services stored at name, or as its direct children, are used.
+func (s *server) CAARecords(q dns.Question, name string) (records []dns.RR, err error) {
+	services, err := s.records(name, false)
+	if err != nil {
+		return nil, err
+	}
+
+	labels := dns.CountLabel(name)
+	for _, serv := range services {
+		if serv.Caa == nil || serv.Caa.Tag == "" {
+			continue
+		}
+		if dns.CountLabel(msg.Domain(serv.Key))-labels > 1 {
+			continue
+		}
+		records = append(records, serv.NewCAA(q.Name))
+	}
+	return records, nil
+}
+
+// URIRecords returns the URI records of name from etcd. Like SRV records, they
+// are looked up with srvServices, so _http._tcp.<name> has the URI records of
+// the services with that Srv and Proto under name.
+func (s *server) URIRecords(q dns.Question, name string) (records []dns.RR, err error) {
+	services, err := s.srvServices(name)
+	if err != nil {
+		return nil, err
+	}
+
+	services = group(services)
+
+	for _, serv := range services {
+		if serv.Uri == "" {
+			continue
+		}
+		records = append(records, serv.NewURI(q.Name))
+	}
+	return records, nil
+}
+
+// TLSARecords returns the TLSA records of name from etcd: those of the services
+// stored under name, or else the ones synthesized for a DANE name, see
+// tlsaServices.
+func (s *server) TLSARecords(q dns.Question, name string) (records []dns.RR, err error) {
+	services, err := s.records(name, false)
+	if err != nil || len(services) == 0 {
+		services, err = s.tlsaServices(name)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	for _, serv := range services {
+		if serv.Tlsa == nil {
+			continue
+		}
+		records = append(records, serv.NewTLSA(q.Name))
+	}
+	return records, nil
+}
+
+// SVCBRecords returns the SVCB or HTTPS records, depending on q.Qtype, of name
+// from etcd. Like for SRV records, the addresses of the targets are added to the
+// additional section.
+func (s *server) SVCBRecords(q dns.Question, name string, bufsize uint16, dnssec bool) (records []dns.RR, extra []dns.RR, err error) {
+	services, err := s.records(name, false)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	services = group(services)
+
+	lookup := make(map[string]bool)
+	for _, serv := range services {
+		if serv.Svcb == nil {
+			continue
+		}
+		svcb := serv.NewSVCB(q.Name, q.Qtype)
+		if svcb == nil {
+			logf("invalid SVCB target name for %s", serv.Key)
+			continue
+		}
+		records = append(records, svcb)
+
+		ip := net.ParseIP(serv.Host)
+		switch {
+		case serv.Svcb.TargetName != "" || ip == nil:
+			target := msg.Target(serv.Svcb.TargetName)
+			if serv.Svcb.TargetName == "" {
+				target = msg.Target(serv.Host)
+			}
+			if target == "." || lookup[target] {
+				break
+			}
+			lookup[target] = true
+			extra = append(extra, s.targetRecords(target, bufsize, dnssec)...)
+		case s.config.Additional == AdditionalNone:
+		case ip.To4() != nil:
+			extra = append(extra, serv.NewA(msg.Domain(serv.Key), ip.To4()))
+		default:
+			extra = append(extra, serv.NewAAAA(msg.Domain(serv.Key), ip.To16()))
 		}
 	}
 	return records, extra, nil
 }
 
+// RawRecords returns the records of type q.Qtype, or all for ANY, that are
+// stored in the Raw field of the services of name.
+func (s *server) RawRecords(q dns.Question, name string) (records []dns.RR) {
+	services, err := s.records(name, false)
+	if err != nil {
+		return nil
+	}
+
+	for _, serv := range services {
+		if serv.Raw == "" {
+			continue
+		}
+		rr, err := serv.NewRaw(q.Name)
+		if err != nil {
+			logf("invalid raw record in %s: %s", serv.Key, err)
+			continue
+		}
+		if q.Qtype == dns.TypeANY || rr.Header().Rrtype == q.Qtype {
+			records = append(records, rr)
+		}
+	}
+	return records
+}
+
+// AnyRecords returns all records we have for name: a CNAME record, or the SRV,
+// A, AAAA, TXT, MX, NAPTR, CAA, URI and raw records.
+func (s *server) AnyRecords(q dns.Question, name string, bufsize uint16, dnssec bool) (records []dns.RR, extra []dns.RR, err error) {
+	// A CNAME can not have other data.
+	records, err = s.CNAMERecords(q, name)
+	if err != nil || len(records) > 0 {
+		return records, nil, err
+	}
+
+	services, err := s.records(name, false)
+	if err != nil {
+		return nil, nil, err
+	}
+	services = s.failover(group(services))
+	for _, serv := range services {
+		ip := net.ParseIP(serv.Host)
+		switch {
+		case ip == nil && serv.Alias:
+			records = append(records, s.aliasRecords(q, serv, nil, bufsize, dnssec, true)...)
+		case ip == nil:
+		case ip.To4() != nil:
+			records = append(records, serv.NewA(q.Name, ip.To4()))
+		default:
+			records = append(records, serv.NewAAAA(q.Name, ip.To16()))
+		}
+	}
+
+	srv, srvExtra, err := s.SRVRecords(q, name, bufsize, dnssec)
+	if err != nil {
+		return nil, nil, err
+	}
+	records = append(records, srv...)
+	extra = append(extra, srvExtra...)
+
+	txt, err := s.TXTRecords(q, name)
+	if err != nil {
+		return nil, nil, err
+	}
+	records = append(records, txt...)
+
+	mx, mxExtra, err := s.MXRecords(q, name, bufsize, dnssec)
+	if err != nil {
+		return nil, nil, err
+	}
+	records = append(records, mx...)
+	extra = append(extra, mxExtra...)
+
+	naptr, naptrExtra, err := s.NAPTRRecords(q, name, bufsize, dnssec)
+	if err != nil {
+		return nil, nil, err
+	}
+	records = append(records, naptr...)
+	extra = append(extra, naptrExtra...)
+
+	caa, err := s.CAARecords(q, name)
+	if err != nil {
+		return nil, nil, err
+	}
+	records = append(records, caa...)
+
+	uri, err := s.URIRecords(q, name)
+	if err != nil {
+		return nil, nil, err
+	}
+	records = append(records, uri...)
+
+	records = append(records, s.RawRecords(q, name)...)
+	return records, extra, nil
+}
+
+// targetRecords returns the address records for the SRV or MX target, to be
+// added to the additional section. Which targets are looked up depends on
+// s.config.Additional.
+func (s *server) targetRecords(target string, bufsize uint16, dnssec bool) (extra []dns.RR) {
+	if s.config.Additional == AdditionalNone {
+		return nil
+	}
+	if !dns.IsSubDomain(s.config.Domain, target) {
+		if s.config.Additional != AdditionalAll {
+			return nil
+		}
+		m1, e1 := s.Lookup(target, dns.TypeA, bufsize, dnssec)
+		if e1 == nil {
+			extra = append(extra, m1.Answer...)
+		}
+		m1, e1 = s.Lookup(target, dns.TypeAAAA, bufsize, dnssec)
+		if e1 == nil {
+			// If we have seen CNAME's we *assume* that they are already added.
+			for _, a := range m1.Answer {
+				if _, ok := a.(*dns.CNAME); !ok {
+					extra = append(extra, a)
+				}
+			}
+		}
+		return extra
+	}
+	// Internal name, we should have some info on them, either v4 or v6
+	// Clients expect a complete answer, because we are a recursor in their
+	// view.
+	addr, e1 := s.AddressRecords(dns.Question{target, dns.ClassINET, dns.TypeA},
+		target, nil, bufsize, dnssec, true)
+	if e1 == nil {
+		extra = append(extra, addr...)
+	}
+	return extra
+}
+
 func (s *server) CNAMERecords(q dns.Question, name string) (records []dns.RR, err error) {
-	services, err := s.backend.Records(name, true)
+	services, err := s.records(name, true)
 	if err != nil {
 		return nil, err
 	}
 
-	services = msg.Group(services)
+	services = group(services)
 
 	if len(services) > 0 {
 		serv := services[0]
-		if ip := net.ParseIP(serv.Host); ip == nil {
-			records = append(records, serv.NewCNAME(q.Name, dns.Fqdn(serv.Host)))
+		if ip := net.ParseIP(serv.Host); ip == nil && !serv.Alias && serv.Host != "" {
+			records = append(records, serv.NewCNAME(q.Name, msg.Target(serv.Host)))
 		}
 	}
 	return records, nil
 }
 
 func (s *server) TXTRecords(q dns.Question, name string) (records []dns.RR, err error) {
-	services, err := s.backend.Records(name, false)
+	services, err := s.srvServices(name)
 	if err != nil {
 		return nil, err
 	}
 
-	services = msg.Group(services)
+	services = group(services)
 
 	for _, serv := range services {
-		if serv.Text == "" {
+		if serv.Text == "" && len(serv.Meta) == 0 {
 			continue
 		}
 		records = append(records, serv.NewTXT(q.Name))
@@ -690,10 +1339,19 @@ func (s *server) TXTRecords(q dns.Question, name string) (records []dns.RR, err
 
 func (s *server) PTRRecords(q dns.Question) (records []dns.RR, err error) {
 	name := strings.ToLower(q.Name)
-	serv, err := s.backend.ReverseRecord(name)
+	serv, err := s.reverseRecord(name)
+	if (err != nil || serv == nil) && s.reverse != nil {
+		if records = s.reverse.lookup(q.Name, name); len(records) > 0 {
+			return records, nil
+		}
+	}
 	if err != nil {
 		return nil, err
 	}
+	if serv == nil {
+		// FirstBackend returns no record and no error when no backend has one.
+		return nil, fmt.Errorf("no reverse record for %s", name)
+	}
 
 	records = append(records, serv.NewPTR(q.Name, serv.Ttl))
 	return records, nil
@@ -702,12 +1360,12 @@ func (s *server) PTRRecords(q dns.Question) (records []dns.RR, err error) {
 // SOA returns a SOA record for this SkyDNS instance.
 func (s *server) NewSOA() dns.RR {
 	return &dns.SOA{Hdr: dns.RR_Header{Name: s.config.Domain, Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: s.config.Ttl},
-		Ns:      appendDomain("ns.dns", s.config.Domain),
+		Ns:      s.config.SOA.Mname,
 		Mbox:    s.config.Hostmaster,
-		Serial:  uint32(time.Now().Truncate(time.Hour).Unix()),
-		Refresh: 28800,
-		Retry:   7200,
-		Expire:  604800,
+		Serial:  s.serial(),
+		Refresh: s.config.SOA.Refresh,
+		Retry:   s.config.SOA.Retry,
+		Expire:  s.config.SOA.Expire,
 		Minttl:  s.config.MinTtl,
 	}
 }
@@ -724,13 +1382,41 @@ func (s *server) isDuplicateCNAME(r *dns.CNAME, records []dns.RR) bool {
 }
 
 func (s *server) NameError(req *dns.Msg) *dns.Msg {
-	m := new(dns.Msg)
-	m.SetRcode(req, dns.RcodeNameError)
+	m := s.newReply(req)
+	m.Rcode = dns.RcodeNameError
 	m.Ns = []dns.RR{s.NewSOA()}
 	m.Ns[0].Header().Ttl = s.config.MinTtl
 	return m
 }
 
+// nameExists returns true if there are services at or below name. Backend errors
+// other than "key not found" count as existing, we rather return NODATA than a
+// wrong NXDOMAIN, which is negatively cached by clients for the whole name.
+func (s *server) nameExists(name string) bool {
+	if name == s.config.Domain {
+		return true
+	}
+	if isWildcard(name) {
+		return s.wildcardExists(name)
+	}
+	services, err := s.srvServices(name)
+	if err == nil && len(services) > 0 {
+		return true
+	}
+	// A DANE name exists when it has TLSA records, see tlsaServices.
+	if tlsa, _ := s.tlsaServices(name); len(tlsa) > 0 {
+		return true
+	}
+	// A delegated zone only has nameservers, see Referral.
+	if err == nil && s.delegated(name) {
+		return true
+	}
+	if err != nil {
+		return !isNameError(err, s)
+	}
+	return false
+}
+
 func (s *server) ServerFailure(req *dns.Msg) *dns.Msg {
 	m := new(dns.Msg)
 	m.SetRcode(req, dns.RcodeServerFailure)
@@ -856,12 +1542,24 @@ func (s *server) overflowOrTruncated(w dns.ResponseWriter, m *dns.Msg, bufsize i
 		if _, overflow := Fit(m, dns.MaxMsgSize, true); overflow {
 			metrics.ReportErrorCount(m, sy)
 			msgFail := s.ServerFailure(m)
+			s.explain(msgFail, m, reasonTooLarge)
+			s.setEdns(msgFail, m.IsEdns0())
 			w.WriteMsg(msgFail)
 			return true
 		}
 	case false:
-		// Overflow with udp always results in TC.
-		Fit(m, bufsize, false)
+		// Overflow with udp results in TC, unless the zone's policy is to drop the
+		// records that don't fit.
+		if m.Len() > bufsize {
+			s.pickAnswers(m)
+		}
+		if s.dropOverflow(m) {
+			if Fit(m, bufsize, true); m.Len() > bufsize {
+				m.Truncated = true
+			}
+		} else {
+			Fit(m, bufsize, false)
+		}
 		metrics.ReportErrorCount(m, sy)
 		if m.Truncated {
 			w.WriteMsg(m)
@@ -871,16 +1569,42 @@ func (s *server) overflowOrTruncated(w dns.ResponseWriter, m *dns.Msg, bufsize i
 	return false
 }
 
+// writePacked writes m to w. With a key for the packed cache, m is packed here and
+// inserted in it.
+func (s *server) writePacked(w dns.ResponseWriter, m *dns.Msg, pkey string) error {
+	if pkey == "" {
+		return w.WriteMsg(m)
+	}
+	b, err := m.Pack()
+	if err != nil {
+		return w.WriteMsg(m)
+	}
+	s.pcache.Insert(pkey, b)
+	_, err = w.Write(b)
+	return err
+}
+
+// packable returns true if replies may be written to w packed. Rewrites, the
+// policy and DNS64 change the replies written to their writers, and need them
+// unpacked, as does signing them with a TSIG.
+func packable(w dns.ResponseWriter) bool {
+	switch w.(type) {
+	case *renameWriter, *policyWriter, *dns64Writer, *tsigWriter:
+		return false
+	}
+	return true
+}
+
 // isTCP returns true if the client is connecting over TCP.
 func isTCP(w dns.ResponseWriter) bool {
 	_, ok := w.RemoteAddr().(*net.TCPAddr)
 	return ok
 }
 
-// etcNameError return a NameError to the client if the error
-// returned from etcd has ErrorCode == 100.
-func isEtcdNameError(err error, s *server) bool {
-	if e, ok := err.(etcd.Error); ok && e.Code == etcd.ErrorCodeKeyNotFound {
+// isNameError returns true if err, from the backend, means the name doesn't
+// exist and a NameError is returned to the client.
+func isNameError(err error, s *server) bool {
+	if err == msg.ErrNotFound || err == errNotActive || err == errNoTag {
 		return true
 	}
 	if err != nil {
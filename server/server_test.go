@@ -9,6 +9,7 @@ package server
 import (
 	"crypto/rsa"
 	"encoding/json"
+	"reflect"
 	"sort"
 	"strconv"
 	"strings"
@@ -55,7 +56,18 @@ func delService(t *testing.T, s *server, k string) {
 	}
 }
 
-func newTestServer(t *testing.T, c bool) *server {
+// newTestServer returns a started server for the tests, with its cache if c is
+// true. The fx are called before the server starts, to change its config.
+func newTestServer(t *testing.T, c bool, fx ...func(s *server)) *server {
+	s := newUnstartedTestServer(t, c, fx...)
+	go s.Run()
+	time.Sleep(500 * time.Millisecond) // Yeah, yeah, should do a proper fix
+	return s
+}
+
+// newUnstartedTestServer returns the server of newTestServer without starting
+// it, for the tests of parts that must not run, like the mDNS bridge.
+func newUnstartedTestServer(t *testing.T, c bool, fx ...func(s *server)) *server {
 	Port += 10
 	StrPort = strconv.Itoa(Port)
 	s := new(server)
@@ -90,18 +102,19 @@ func newTestServer(t *testing.T, c bool) *server {
 		Ttl:      s.config.Ttl,
 		Priority: s.config.Priority,
 	})
-
-	go s.Run()
-	time.Sleep(500 * time.Millisecond) // Yeah, yeah, should do a proper fix
+	for _, f := range fx {
+		f(s)
+	}
+	s.stages = s.serverStages()
 	return s
 }
 
-func newTestServerDNSSEC(t *testing.T, cache bool) *server {
-	var err error
-	s := newTestServer(t, cache)
-	s.config.PubKey = newDNSKEY("skydns.test. IN DNSKEY 256 3 5 AwEAAaXfO+DOBMJsQ5H4TfiabwSpqE4cGL0Qlvh5hrQumrjr9eNSdIOjIHJJKCe56qBU5mH+iBlXP29SVf6UiiMjIrAPDVhClLeWFe0PC+XlWseAyRgiLHdQ8r95+AfkhO5aZgnCwYf9FGGSaT0+CRYN+PyDbXBTLK5FN+j5b6bb7z+d")
-	s.config.KeyTag = s.config.PubKey.KeyTag()
-	privKey, err := s.config.PubKey.ReadPrivateKey(strings.NewReader(`Private-key-format: v1.3
+func newTestServerDNSSEC(t *testing.T, cache bool, fx ...func(s *server)) *server {
+	dnssec := func(s *server) {
+		var err error
+		s.config.PubKey = newDNSKEY("skydns.test. IN DNSKEY 256 3 5 AwEAAaXfO+DOBMJsQ5H4TfiabwSpqE4cGL0Qlvh5hrQumrjr9eNSdIOjIHJJKCe56qBU5mH+iBlXP29SVf6UiiMjIrAPDVhClLeWFe0PC+XlWseAyRgiLHdQ8r95+AfkhO5aZgnCwYf9FGGSaT0+CRYN+PyDbXBTLK5FN+j5b6bb7z+d")
+		s.config.KeyTag = s.config.PubKey.KeyTag()
+		privKey, err := s.config.PubKey.ReadPrivateKey(strings.NewReader(`Private-key-format: v1.3
 Algorithm: 5 (RSASHA1)
 Modulus: pd874M4EwmxDkfhN+JpvBKmoThwYvRCW+HmGtC6auOv141J0g6MgckkoJ7nqoFTmYf6IGVc/b1JV/pSKIyMisA8NWEKUt5YV7Q8L5eVax4DJGCIsd1Dyv3n4B+SE7lpmCcLBh/0UYZJpPT4JFg34/INtcFMsrkU36PlvptvvP50=
 PublicExponent: AQAB
@@ -112,11 +125,12 @@ Exponent1: wkdTngUcIiau67YMmSFBoFOq9Lldy9HvpVzK/R0e5vDsnS8ZKTb4QJJ7BaG2ADpno7pIS
 Exponent2: YrC8OglEXIGkV3tm2494vf9ozPL6+cBkFsPPg9dXbvVCyyuW0pGHDeplvfUqs4nZp87z8PsoUL+LAUqdldnwcQ==
 Coefficient: mMFr4+rDY5V24HZU3Oa5NEb55iQ56ZNa182GnNhWqX7UqWjcUUGjnkCy40BqeFAQ7lp52xKHvP5Zon56mwuQRw==
 `), "stdin")
-	s.config.PrivKey = privKey.(*rsa.PrivateKey)
-	if err != nil {
-		t.Fatal(err)
+		s.config.PrivKey = privKey.(*rsa.PrivateKey)
+		if err != nil {
+			t.Fatal(err)
+		}
 	}
-	return s
+	return newTestServer(t, cache, append([]func(s *server){dnssec}, fx...)...)
 }
 
 func TestDNSForward(t *testing.T) {
@@ -154,8 +168,87 @@ func TestDNSForward(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
-	if resp.Rcode != dns.RcodeServerFailure {
-		t.Fatal("answer expected to have rcode equal to RcodeFailure")
+	if resp.Rcode != dns.RcodeRefused || resp.RecursionAvailable {
+		t.Fatal("answer expected to have rcode equal to RcodeRefused and RA clear")
+	}
+}
+
+func TestRecursionRefused(t *testing.T) {
+	s := newTestServer(t, false, func(s *server) {
+		s.config.Nameservers = []string{"127.0.0.1:1"}
+	})
+	defer s.Stop()
+
+	c := new(dns.Client)
+	m := new(dns.Msg)
+	m.SetQuestion("www.example.com.", dns.TypeA)
+	m.RecursionDesired = false
+	resp, _, err := c.Exchange(m, "127.0.0.1:"+StrPort)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Rcode != dns.RcodeRefused || resp.RecursionAvailable {
+		t.Fatalf("expected REFUSED with RA clear for recursion not desired, got %s", resp)
+	}
+
+	// Outside the recursion ACL.
+	acl := newTestServer(t, false, func(s *server) {
+		s.config.Nameservers = []string{"127.0.0.1:1"}
+		s.config.RecursionACL = []string{"192.0.2.0/24", "2001:db8::1"}
+		if err := SetDefaults(s.config); err != nil {
+			t.Fatal(err)
+		}
+	})
+	defer acl.Stop()
+	m.RecursionDesired = true
+	resp, _, err = c.Exchange(m, acl.config.DnsAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Rcode != dns.RcodeRefused || resp.RecursionAvailable {
+		t.Fatalf("expected REFUSED with RA clear outside the recursion ACL, got %s", resp)
+	}
+
+	// Our own domain is still served.
+	m.SetQuestion("skydns.test.", dns.TypeSOA)
+	resp, _, err = c.Exchange(m, acl.config.DnsAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Rcode != dns.RcodeSuccess || len(resp.Answer) == 0 {
+		t.Fatalf("expected an answer for our domain, got %s", resp)
+	}
+}
+
+func TestChaos(t *testing.T) {
+	s := newTestServer(t, false, func(s *server) {
+		s.config.ChaosHostname, s.config.ChaosID = "dns1.example.net", "ams-1"
+	})
+	defer s.Stop()
+
+	query := func(name string) *dns.Msg {
+		m := new(dns.Msg)
+		m.SetQuestion(name, dns.TypeTXT)
+		m.Question[0].Qclass = dns.ClassCHAOS
+		w := &testWriter{}
+		s.ServeDNS(w, m)
+		return w.msg
+	}
+	for name, txt := range map[string]string{
+		"version.bind.":   Version,
+		"version.server.": Version,
+		"hostname.bind.":  "dns1.example.net",
+		"id.server.":      "ams-1",
+	} {
+		resp := query(name)
+		if len(resp.Answer) != 1 || resp.Answer[0].(*dns.TXT).Txt[0] != txt {
+			t.Errorf("expected %q for %s, got %s", txt, name, resp)
+		}
+	}
+
+	s.config.NoChaos = true
+	if resp := query("version.bind."); resp.Rcode != dns.RcodeRefused || len(resp.Answer) != 0 {
+		t.Errorf("expected REFUSED with no_chaos, got %s", resp)
 	}
 }
 
@@ -508,6 +601,12 @@ func TestDNS(t *testing.T) {
 					fatal = true
 					t.Fatalf("NS nameserver should be %q, but is %q", x.Ns, tt.Ns)
 				}
+			case *dns.DS:
+				tt := tc.Ns[i].(*dns.DS)
+				if x.KeyTag != tt.KeyTag || !strings.EqualFold(x.Digest, tt.Digest) {
+					fatal = true
+					t.Fatalf("DS should be %s, but is %s", tt, x)
+				}
 			case *dns.NSEC3:
 				tt := tc.Ns[i].(*dns.NSEC3)
 				if x.NextDomain != tt.NextDomain {
@@ -597,6 +696,27 @@ var services = []*msg.Service{
 	{Host: "172.16.1.1", Key: "a.ipaddr2.skydns.test."},
 	{Host: "2001::8:8:8:8", Key: "b.ipaddr2.skydns.test."},
 	{Host: "ipaddr2.skydns.test", Key: "both.v4v6.test.skydns.test."},
+	{Host: "b.chain.skydns.test", Key: "a.chain.skydns.test."},
+	{Host: "c.chain.skydns.test", Key: "b.chain.skydns.test."},
+	{Host: "10.0.0.3", Key: "c.chain.skydns.test."},
+	{Host: "10.0.0.53", Key: "ns1.ns.dns.delegated.skydns.test."},
+	{Host: "ns1.example.net", Key: "ns1.ns.dns.named.skydns.test."},
+	{Host: "10.0.0.54", Key: "ns1.ns.dns.signed.skydns.test."},
+	{Ds: &msg.DS{KeyTag: 60485, Algorithm: 5, DigestType: 1, Digest: "2bb183af5f22588179a53b0a98631fad1a292118"}, Key: "key1.ds.dns.signed.skydns.test."},
+	{Host: "10.0.0.99", Key: `\*.wild.skydns.test.`},
+	{Host: "10.0.0.100", Key: "exact.wild.skydns.test."},
+	{Host: "10.0.0.101", Key: "host.ent.wild.skydns.test."},
+	{Host: "10.0.0.102", Key: `sub.\*.ent2.wild.skydns.test.`},
+	{Host: "10.0.0.80", Port: 80, Text: "path=/", Srv: "http", Proto: "tcp", Key: "web.rfc2782.skydns.test."},
+	{Host: "10.0.0.81", Port: 53, Srv: "domain", Proto: "udp", Key: "dns.rfc2782.skydns.test."},
+	{Host: "10.0.0.82", Port: 8080, Key: "_http._tcp.keyed.rfc2782.skydns.test."},
+	{Host: "10.0.0.83", Port: 389, Key: "ldap1._ldap._tcp.tree.rfc2782.skydns.test."},
+	{Host: "10.0.0.84", Port: 389, Key: "ldap2._ldap._tcp.tree.rfc2782.skydns.test."},
+	// activation windows: active, no longer active and not yet active
+	{Host: "10.0.1.1", Key: "a.window.skydns.test.", ActiveFrom: inTime(-time.Hour), ActiveUntil: inTime(24 * time.Hour)},
+	{Host: "10.0.1.2", Key: "b.window.skydns.test.", ActiveUntil: inTime(-time.Hour)},
+	{Host: "10.0.1.3", Key: "c.window.skydns.test.", ActiveFrom: inTime(time.Hour)},
+	{Host: "10.0.1.4", Key: "d.window.skydns.test.", Expires: &msg.Time{Time: time.Now().Add(-time.Minute)}},
 
 	// A name: bar.skydns.test with 2 ports open and points to one ip: 192.168.0.1
 	{Host: "192.168.0.1", Port: 80, Key: "x.bar.skydns.test.", TargetStrip: 1},
@@ -673,6 +793,11 @@ var dnsTestCases = []dnsTestCase{
 		Qname: "104.server1.development.region1.skydns.test.", Qtype: dns.TypeA,
 		Answer: []dns.RR{newA("104.server1.development.region1.skydns.test. 3600 A 10.0.0.1")},
 	},
+	// Mixed Case A Record Test
+	{
+		Qname: "104.Server1.DEVELOPMENT.region1.SkyDNS.test.", Qtype: dns.TypeA,
+		Answer: []dns.RR{newA("104.Server1.DEVELOPMENT.region1.SkyDNS.test. 3600 A 10.0.0.1")},
+	},
 	// Multiple A Record Test
 	{
 		Qname: "ipaddr.skydns.test.", Qtype: dns.TypeA,
@@ -725,17 +850,209 @@ var dnsTestCases = []dnsTestCase{
 			newCNAME("1.cname.skydns.test. 3600 CNAME 104.server1.development.region1.skydns.test."),
 		},
 	},
-	// CNAME (unresolvable internal name)
+	// CNAME (unresolvable internal name), NODATA for the end of the chain.
 	{
 		Qname: "2.cname.skydns.test.", Qtype: dns.TypeA,
-		Answer: []dns.RR{},
+		Answer: []dns.RR{newCNAME("2.cname.skydns.test. 3600 CNAME 100.server1.development.region1.skydns.test.")},
 		Ns:     []dns.RR{newSOA("skydns.test. 60 SOA ns.dns.skydns.test. hostmaster.skydns.test. 1407441600 28800 7200 604800 60")},
 	},
 	// CNAME loop detection
 	{
 		Qname: "3.cname.skydns.test.", Qtype: dns.TypeA,
-		Answer: []dns.RR{},
-		Ns:     []dns.RR{newSOA("skydns.test. 60 SOA ns.dns.skydns.test. hostmaster.skydns.test. 1407441600 28800 7200 604800 60")},
+		Rcode: dns.RcodeServerFailure,
+	},
+	// CNAME chain that is resolved internally.
+	{
+		Qname: "a.chain.skydns.test.", Qtype: dns.TypeA,
+		Answer: []dns.RR{
+			newCNAME("a.chain.skydns.test. 3600 CNAME b.chain.skydns.test."),
+			newCNAME("b.chain.skydns.test. 3600 CNAME c.chain.skydns.test."),
+			newA("c.chain.skydns.test. 3600 A 10.0.0.3"),
+		},
+	},
+	// Referral for a delegated zone.
+	{
+		Qname: "www.delegated.skydns.test.", Qtype: dns.TypeA,
+		Ns:    []dns.RR{newNS("delegated.skydns.test. 3600 NS ns1.ns.dns.delegated.skydns.test.")},
+		Extra: []dns.RR{newA("ns1.ns.dns.delegated.skydns.test. 3600 A 10.0.0.53")},
+	},
+	{
+		Qname: "delegated.skydns.test.", Qtype: dns.TypeNS,
+		Ns:    []dns.RR{newNS("delegated.skydns.test. 3600 NS ns1.ns.dns.delegated.skydns.test.")},
+		Extra: []dns.RR{newA("ns1.ns.dns.delegated.skydns.test. 3600 A 10.0.0.53")},
+	},
+	// The nameservers of a delegated zone are not its addresses.
+	{
+		Qname: "delegated.skydns.test.", Qtype: dns.TypeA,
+		Ns:    []dns.RR{newNS("delegated.skydns.test. 3600 NS ns1.ns.dns.delegated.skydns.test.")},
+		Extra: []dns.RR{newA("ns1.ns.dns.delegated.skydns.test. 3600 A 10.0.0.53")},
+	},
+	// A zone delegated to a nameserver out of our domain has no glue.
+	{
+		Qname: "www.named.skydns.test.", Qtype: dns.TypeA,
+		Ns: []dns.RR{newNS("named.skydns.test. 3600 NS ns1.example.net.")},
+	},
+	// A signed delegated zone has DS records in its referral, only they are signed.
+	{
+		Qname: "www.signed.skydns.test.", Qtype: dns.TypeA,
+		Ns: []dns.RR{
+			newDS("signed.skydns.test. 3600 DS 60485 5 1 2BB183AF5F22588179A53B0A98631FAD1A292118"),
+			newNS("signed.skydns.test. 3600 NS ns1.ns.dns.signed.skydns.test."),
+		},
+		Extra: []dns.RR{newA("ns1.ns.dns.signed.skydns.test. 3600 A 10.0.0.54")},
+	},
+	{
+		Qname: "www.signed.skydns.test.", Qtype: dns.TypeA,
+		dnssec: true,
+		Ns: []dns.RR{
+			newDS("signed.skydns.test. 3600 DS 60485 5 1 2BB183AF5F22588179A53B0A98631FAD1A292118"),
+			newNS("signed.skydns.test. 3600 NS ns1.ns.dns.signed.skydns.test."),
+			newRRSIG("signed.skydns.test. 3600 RRSIG DS 5 3 3600 0 0 51945 skydns.test. deadbeaf"),
+		},
+		Extra: []dns.RR{
+			new(dns.OPT),
+			newA("ns1.ns.dns.signed.skydns.test. 3600 A 10.0.0.54"),
+		},
+	},
+	// The DS records are ours, a DS query for the zone gets no referral.
+	{
+		Qname: "signed.skydns.test.", Qtype: dns.TypeDS,
+		Answer: []dns.RR{newDS("signed.skydns.test. 3600 DS 60485 5 1 2BB183AF5F22588179A53B0A98631FAD1A292118")},
+	},
+	{
+		Qname: "delegated.skydns.test.", Qtype: dns.TypeDS,
+		Ns: []dns.RR{newSOA("skydns.test. 60 SOA ns.dns.skydns.test. hostmaster.skydns.test. 1407441600 28800 7200 604800 60")},
+	},
+	// RFC 4592 wildcards, the owner name is the query name.
+	{
+		Qname: "foo.wild.skydns.test.", Qtype: dns.TypeA,
+		Answer: []dns.RR{newA("foo.wild.skydns.test. 3600 A 10.0.0.99")},
+	},
+	{
+		Qname: "a.b.wild.skydns.test.", Qtype: dns.TypeA,
+		Answer: []dns.RR{newA("a.b.wild.skydns.test. 3600 A 10.0.0.99")},
+	},
+	// An existing name shadows the wildcard.
+	{
+		Qname: "exact.wild.skydns.test.", Qtype: dns.TypeA,
+		Answer: []dns.RR{newA("exact.wild.skydns.test. 3600 A 10.0.0.100")},
+	},
+	// Existing name, other type: NODATA, the wildcard is not used.
+	{
+		Qname: "exact.wild.skydns.test.", Qtype: dns.TypeTXT,
+		Ns: []dns.RR{newSOA("skydns.test. 3600 SOA ns.dns.skydns.test. hostmaster.skydns.test. 0 0 0 0 0")},
+	},
+	// The closest encloser is exact.wild.skydns.test., which has no wildcard.
+	{
+		Qname: "foo.exact.wild.skydns.test.", Qtype: dns.TypeA,
+		Rcode: dns.RcodeNameError,
+		Ns:    []dns.RR{newSOA("skydns.test. 3600 SOA ns.dns.skydns.test. hostmaster.skydns.test. 0 0 0 0 0")},
+	},
+	// An empty non-terminal is a closest encloser too, the wildcard above it is
+	// not used.
+	{
+		Qname: "foo.ent.wild.skydns.test.", Qtype: dns.TypeA,
+		Rcode: dns.RcodeNameError,
+		Ns:    []dns.RR{newSOA("skydns.test. 3600 SOA ns.dns.skydns.test. hostmaster.skydns.test. 0 0 0 0 0")},
+	},
+	// A wildcard that is an empty non-terminal matches, with NODATA.
+	{
+		Qname: "foo.ent2.wild.skydns.test.", Qtype: dns.TypeA,
+		Ns: []dns.RR{newSOA("skydns.test. 3600 SOA ns.dns.skydns.test. hostmaster.skydns.test. 0 0 0 0 0")},
+	},
+	{
+		Qname: "sub.foo.ent2.wild.skydns.test.", Qtype: dns.TypeA,
+		Ns: []dns.RR{newSOA("skydns.test. 3600 SOA ns.dns.skydns.test. hostmaster.skydns.test. 0 0 0 0 0")},
+	},
+	// The wildcard matches, but it has no records of the type: NODATA.
+	{
+		Qname: "foo.wild.skydns.test.", Qtype: dns.TypeTXT,
+		Ns: []dns.RR{newSOA("skydns.test. 3600 SOA ns.dns.skydns.test. hostmaster.skydns.test. 0 0 0 0 0")},
+	},
+	// Services outside their activation window are not served.
+	{
+		Qname: "window.skydns.test.", Qtype: dns.TypeA,
+		Answer: []dns.RR{newA("window.skydns.test. 3600 A 10.0.1.1")},
+	},
+	{
+		Qname: "b.window.skydns.test.", Qtype: dns.TypeA,
+		Rcode: dns.RcodeNameError,
+		Ns:    []dns.RR{newSOA("skydns.test. 3600 SOA ns.dns.skydns.test. hostmaster.skydns.test. 0 0 0 0 0")},
+	},
+	// Expired, but the key is still there.
+	{
+		Qname: "d.window.skydns.test.", Qtype: dns.TypeA,
+		Rcode: dns.RcodeNameError,
+		Ns:    []dns.RR{newSOA("skydns.test. 3600 SOA ns.dns.skydns.test. hostmaster.skydns.test. 0 0 0 0 0")},
+	},
+	// RFC 2782 names, matched on the Srv and Proto fields.
+	{
+		Qname: "_http._tcp.rfc2782.skydns.test.", Qtype: dns.TypeSRV,
+		Answer: []dns.RR{newSRV("_http._tcp.rfc2782.skydns.test. 3600 SRV 10 100 80 web.rfc2782.skydns.test.")},
+		Extra:  []dns.RR{newA("web.rfc2782.skydns.test. 3600 A 10.0.0.80")},
+	},
+	{
+		Qname: "_domain._udp.rfc2782.skydns.test.", Qtype: dns.TypeSRV,
+		Answer: []dns.RR{newSRV("_domain._udp.rfc2782.skydns.test. 3600 SRV 10 100 53 dns.rfc2782.skydns.test.")},
+		Extra:  []dns.RR{newA("dns.rfc2782.skydns.test. 3600 A 10.0.0.81")},
+	},
+	{
+		Qname: "_http._udp.rfc2782.skydns.test.", Qtype: dns.TypeSRV,
+		Rcode: dns.RcodeNameError,
+		Ns:    []dns.RR{newSOA("skydns.test. 3600 SOA ns.dns.skydns.test. hostmaster.skydns.test. 0 0 0 0 0")},
+	},
+	{
+		Qname: "_http._tcp.rfc2782.skydns.test.", Qtype: dns.TypeA,
+		Ns: []dns.RR{newSOA("skydns.test. 3600 SOA ns.dns.skydns.test. hostmaster.skydns.test. 0 0 0 0 0")},
+	},
+	// DNS-SD browsing.
+	{
+		Qname: "_services._dns-sd._udp.rfc2782.skydns.test.", Qtype: dns.TypePTR,
+		Answer: []dns.RR{
+			newPTR("_services._dns-sd._udp.rfc2782.skydns.test. 3600 PTR _domain._udp.rfc2782.skydns.test."),
+			newPTR("_services._dns-sd._udp.rfc2782.skydns.test. 3600 PTR _http._tcp.rfc2782.skydns.test."),
+		},
+	},
+	{
+		Qname: "_http._tcp.rfc2782.skydns.test.", Qtype: dns.TypePTR,
+		Answer: []dns.RR{newPTR("_http._tcp.rfc2782.skydns.test. 3600 PTR web._http._tcp.rfc2782.skydns.test.")},
+	},
+	{
+		Qname: "web._http._tcp.rfc2782.skydns.test.", Qtype: dns.TypeSRV,
+		Answer: []dns.RR{newSRV("web._http._tcp.rfc2782.skydns.test. 3600 SRV 10 100 80 web.rfc2782.skydns.test.")},
+		Extra:  []dns.RR{newA("web.rfc2782.skydns.test. 3600 A 10.0.0.80")},
+	},
+	{
+		Qname: "web._http._tcp.rfc2782.skydns.test.", Qtype: dns.TypeTXT,
+		Answer: []dns.RR{newTXT("web._http._tcp.rfc2782.skydns.test. 3600 TXT \"path=/\"")},
+	},
+	{
+		Qname: "dns._http._tcp.rfc2782.skydns.test.", Qtype: dns.TypeSRV,
+		Rcode: dns.RcodeNameError,
+		Ns:    []dns.RR{newSOA("skydns.test. 3600 SOA ns.dns.skydns.test. hostmaster.skydns.test. 0 0 0 0 0")},
+	},
+	{
+		Qname: "_http._tcp.keyed.rfc2782.skydns.test.", Qtype: dns.TypePTR,
+		Ns: []dns.RR{newSOA("skydns.test. 3600 SOA ns.dns.skydns.test. hostmaster.skydns.test. 0 0 0 0 0")},
+	},
+	// DNS-SD browsing of services stored under RFC 2782 names.
+	{
+		Qname: "_ldap._tcp.tree.rfc2782.skydns.test.", Qtype: dns.TypePTR,
+		Answer: []dns.RR{
+			newPTR("_ldap._tcp.tree.rfc2782.skydns.test. 3600 PTR ldap1._ldap._tcp.tree.rfc2782.skydns.test."),
+			newPTR("_ldap._tcp.tree.rfc2782.skydns.test. 3600 PTR ldap2._ldap._tcp.tree.rfc2782.skydns.test."),
+		},
+	},
+	{
+		Qname: "ldap1._ldap._tcp.tree.rfc2782.skydns.test.", Qtype: dns.TypeSRV,
+		Answer: []dns.RR{newSRV("ldap1._ldap._tcp.tree.rfc2782.skydns.test. 3600 SRV 10 100 389 ldap1._ldap._tcp.tree.rfc2782.skydns.test.")},
+		Extra:  []dns.RR{newA("ldap1._ldap._tcp.tree.rfc2782.skydns.test. 3600 A 10.0.0.83")},
+	},
+	// RFC 2782 names stored as keys are used as is.
+	{
+		Qname: "_http._tcp.keyed.rfc2782.skydns.test.", Qtype: dns.TypeSRV,
+		Answer: []dns.RR{newSRV("_http._tcp.keyed.rfc2782.skydns.test. 3600 SRV 10 100 8080 _http._tcp.keyed.rfc2782.skydns.test.")},
+		Extra:  []dns.RR{newA("_http._tcp.keyed.rfc2782.skydns.test. 3600 A 10.0.0.82")},
 	},
 	// CNAME (resolvable external name)
 	{
@@ -819,6 +1136,27 @@ var dnsTestCases = []dnsTestCase{
 		Rcode: dns.RcodeSuccess,
 		Ns:    []dns.RR{newSOA("skydns.test. 3600 SOA ns.dns.skydns.test. hostmaster.skydns.test. 0 0 0 0 0")},
 	},
+	// NODATA Test 3, the name exists, but not at the apex, so no NS records.
+	{
+		Qname: "100.server1.development.region1.skydns.test.", Qtype: dns.TypeNS,
+		Ns: []dns.RR{newSOA("skydns.test. 3600 SOA ns.dns.skydns.test. hostmaster.skydns.test. 0 0 0 0 0")},
+	},
+	// NODATA Test 4, empty non-terminal.
+	{
+		Qname: "development.region1.skydns.test.", Qtype: dns.TypeTXT,
+		Ns: []dns.RR{newSOA("skydns.test. 3600 SOA ns.dns.skydns.test. hostmaster.skydns.test. 0 0 0 0 0")},
+	},
+	// NXDOMAIN Test 2, the name does not exist, whatever the type.
+	{
+		Qname: "doesnotexist.skydns.test.", Qtype: dns.TypeNS,
+		Rcode: dns.RcodeNameError,
+		Ns:    []dns.RR{newSOA("skydns.test. 3600 SOA ns.dns.skydns.test. hostmaster.skydns.test. 0 0 0 0 0")},
+	},
+	{
+		Qname: "doesnotexist.skydns.test.", Qtype: dns.TypeHINFO,
+		Rcode: dns.RcodeNameError,
+		Ns:    []dns.RR{newSOA("skydns.test. 3600 SOA ns.dns.skydns.test. hostmaster.skydns.test. 0 0 0 0 0")},
+	},
 	// CNAME Test that targets multiple A records (hits a directory in etcd)
 	{
 		Qname: "1.backend.in.skydns.test.", Qtype: dns.TypeA,
@@ -1128,12 +1466,16 @@ var dnsTestCases = []dnsTestCase{
 	},
 }
 
+// inTime returns a pointer to the time d from now.
+func inTime(d time.Duration) *time.Time { t := time.Now().Add(d); return &t }
+
 func newA(rr string) *dns.A           { r, _ := dns.NewRR(rr); return r.(*dns.A) }
 func newAAAA(rr string) *dns.AAAA     { r, _ := dns.NewRR(rr); return r.(*dns.AAAA) }
 func newCNAME(rr string) *dns.CNAME   { r, _ := dns.NewRR(rr); return r.(*dns.CNAME) }
 func newSRV(rr string) *dns.SRV       { r, _ := dns.NewRR(rr); return r.(*dns.SRV) }
 func newSOA(rr string) *dns.SOA       { r, _ := dns.NewRR(rr); return r.(*dns.SOA) }
 func newNS(rr string) *dns.NS         { r, _ := dns.NewRR(rr); return r.(*dns.NS) }
+func newDS(rr string) *dns.DS         { r, _ := dns.NewRR(rr); return r.(*dns.DS) }
 func newDNSKEY(rr string) *dns.DNSKEY { r, _ := dns.NewRR(rr); return r.(*dns.DNSKEY) }
 func newRRSIG(rr string) *dns.RRSIG   { r, _ := dns.NewRR(rr); return r.(*dns.RRSIG) }
 func newNSEC3(rr string) *dns.NSEC3   { r, _ := dns.NewRR(rr); return r.(*dns.NSEC3) }
@@ -1206,6 +1548,616 @@ func TestTargetStripAdditional(t *testing.T) {
 	}
 }
 
+func TestAdditional(t *testing.T) {
+	s := newTestServer(t, false)
+	defer s.Stop()
+
+	for _, serv := range services {
+		if strings.HasSuffix(serv.Key, ".cname.skydns.test.") || strings.HasSuffix(serv.Key, ".region1.skydns.test.") {
+			addService(t, s, serv.Key, 0, serv)
+			defer delService(t, s, serv.Key)
+		}
+	}
+
+	m := new(dns.Msg)
+	m.SetQuestion("1.cname.skydns.test.", dns.TypeSRV)
+
+	// Queried in the test's goroutine, so the config can change in between.
+	for _, tc := range []struct {
+		additional string
+		extra      int
+	}{
+		{AdditionalAll, 1},
+		{AdditionalInternal, 1},
+		{AdditionalNone, 0},
+	} {
+		s.config.Additional = tc.additional
+		w := &testWriter{}
+		s.ServeDNS(w, m)
+		resp := w.msg
+		if len(resp.Answer) != 1 || len(resp.Extra) != tc.extra {
+			t.Errorf("additional %q: expected 1 answer and %d extra, got %d and %d", tc.additional, tc.extra, len(resp.Answer), len(resp.Extra))
+		}
+	}
+}
+
+func TestAny(t *testing.T) {
+	s := newTestServer(t, false)
+	defer s.Stop()
+
+	anyServices := []*msg.Service{
+		{Host: "10.0.0.1", Text: "text", Key: "a.anytype.skydns.test."},
+		{Host: "10.0.0.2", Mail: true, Key: "b.anytype.skydns.test."},
+		{Host: "server1.anytype.skydns.test", Key: "c.anytype.skydns.test."},
+	}
+	for _, serv := range anyServices {
+		addService(t, s, serv.Key, 0, serv)
+		defer delService(t, s, serv.Key)
+	}
+
+	types := func(rrs []dns.RR) map[uint16]int {
+		t := make(map[uint16]int)
+		for _, r := range rrs {
+			t[r.Header().Rrtype]++
+		}
+		return t
+	}
+	// Queried in the test's goroutine, so the config can change in between.
+	query := func(m *dns.Msg) *dns.Msg {
+		w := &testWriter{}
+		s.ServeDNS(w, m)
+		return w.msg
+	}
+
+	for _, tc := range []struct {
+		qname   string
+		minimal bool
+		rcode   int
+		answer  map[uint16]int
+	}{
+		{"a.anytype.skydns.test.", false, dns.RcodeSuccess, map[uint16]int{dns.TypeA: 1, dns.TypeSRV: 1, dns.TypeTXT: 1}},
+		{"b.anytype.skydns.test.", false, dns.RcodeSuccess, map[uint16]int{dns.TypeA: 1, dns.TypeSRV: 1, dns.TypeMX: 1}},
+		{"c.anytype.skydns.test.", false, dns.RcodeSuccess, map[uint16]int{dns.TypeCNAME: 1}},
+		{"anytype.skydns.test.", false, dns.RcodeSuccess, map[uint16]int{dns.TypeA: 2, dns.TypeSRV: 3, dns.TypeTXT: 1, dns.TypeMX: 1}},
+		{"doesnotexist.anytype.skydns.test.", false, dns.RcodeNameError, map[uint16]int{}},
+		{"a.anytype.skydns.test.", true, dns.RcodeSuccess, map[uint16]int{dns.TypeHINFO: 1}},
+		{"doesnotexist.anytype.skydns.test.", true, dns.RcodeNameError, map[uint16]int{}},
+	} {
+		s.config.MinimalAny = tc.minimal
+
+		m := new(dns.Msg)
+		m.SetQuestion(tc.qname, dns.TypeANY)
+		resp := query(m)
+		if resp.Rcode != tc.rcode {
+			t.Errorf("ANY %s (minimal %t): expected rcode %d, got %d", tc.qname, tc.minimal, tc.rcode, resp.Rcode)
+		}
+		if got := types(resp.Answer); !reflect.DeepEqual(got, tc.answer) {
+			t.Errorf("ANY %s (minimal %t): expected %v, got %v", tc.qname, tc.minimal, tc.answer, got)
+		}
+	}
+
+	// The policy of the most specific zone is used, instead of MinimalAny.
+	s.config.MinimalAny = true
+	s.config.AnyPolicies = []AnyPolicy{{Zone: "anytype.skydns.test.", Answer: AnyRRset}, {Zone: "a.anytype.skydns.test.", Answer: AnyAll}}
+	if err := setAnyPolicyDefaults(s.config); err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		qname  string
+		answer map[uint16]int
+	}{
+		{"a.anytype.skydns.test.", map[uint16]int{dns.TypeA: 1, dns.TypeSRV: 1, dns.TypeTXT: 1}},
+		{"b.anytype.skydns.test.", map[uint16]int{dns.TypeA: 1}},
+		{"c.anytype.skydns.test.", map[uint16]int{dns.TypeCNAME: 1}},
+		{"anytype.skydns.test.", map[uint16]int{dns.TypeA: 2}},
+	} {
+		m := new(dns.Msg)
+		m.SetQuestion(tc.qname, dns.TypeANY)
+		resp := query(m)
+		if got := types(resp.Answer); !reflect.DeepEqual(got, tc.answer) || len(resp.Extra) != 0 && tc.qname != "a.anytype.skydns.test." {
+			t.Errorf("ANY %s: expected %v, got %s", tc.qname, tc.answer, resp)
+		}
+	}
+}
+
+func TestNAPTR(t *testing.T) {
+	s := newTestServer(t, false)
+	defer s.Stop()
+
+	naptrServices := []*msg.Service{
+		{Naptr: &msg.NAPTR{Order: 100, Preference: 10, Flags: "u", Service: "E2U+sip", Regexp: "!^.*$!sip:info@skydns.test!"}, Key: "a.4.3.2.1.e164.skydns.test."},
+		{Naptr: &msg.NAPTR{Order: 100, Preference: 20, Flags: "s", Service: "SIP+D2U", Replacement: "_sip._udp.voip.skydns.test."}, Key: "a.5.3.2.1.e164.skydns.test."},
+		{Host: "10.0.7.1", Port: 5060, Key: "a._sip._udp.voip.skydns.test."},
+	}
+	for _, serv := range naptrServices {
+		addService(t, s, serv.Key, 0, serv)
+		defer delService(t, s, serv.Key)
+	}
+
+	for _, tc := range []struct {
+		qname  string
+		answer string
+		extra  int
+	}{
+		{"4.3.2.1.e164.skydns.test.", "4.3.2.1.e164.skydns.test.\t3600\tIN\tNAPTR\t100 10 \"u\" \"E2U+sip\" \"!^.*$!sip:info@skydns.test!\" .", 0},
+		// The SRV record of the replacement and the address of its target.
+		{"5.3.2.1.e164.skydns.test.", "5.3.2.1.e164.skydns.test.\t3600\tIN\tNAPTR\t100 20 \"s\" \"SIP+D2U\" \"\" _sip._udp.voip.skydns.test.", 2},
+	} {
+		m := new(dns.Msg)
+		m.SetQuestion(tc.qname, dns.TypeNAPTR)
+		resp, err := dns.Exchange(m, "127.0.0.1:"+StrPort)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(resp.Answer) != 1 || resp.Answer[0].String() != tc.answer {
+			t.Errorf("NAPTR %s: expected %q, got %v", tc.qname, tc.answer, resp.Answer)
+		}
+		if len(resp.Extra) != tc.extra {
+			t.Errorf("NAPTR %s: expected %d extra records, got %v", tc.qname, tc.extra, resp.Extra)
+		}
+	}
+
+	m := new(dns.Msg)
+	m.SetQuestion("a._sip._udp.voip.skydns.test.", dns.TypeNAPTR)
+	resp, err := dns.Exchange(m, "127.0.0.1:"+StrPort)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Rcode != dns.RcodeSuccess || len(resp.Answer) != 0 {
+		t.Errorf("expected NODATA for a service without NAPTR, got %s", resp)
+	}
+}
+
+func TestCAA(t *testing.T) {
+	s := newTestServer(t, false)
+	defer s.Stop()
+
+	caaServices := []*msg.Service{
+		{Caa: &msg.CAA{Tag: "issue", Value: "letsencrypt.org"}, Key: "a.caa.skydns.test."},
+		{Caa: &msg.CAA{Tag: "iodef", Value: "mailto:security@skydns.test"}, Key: "b.caa.skydns.test."},
+		{Caa: &msg.CAA{Flag: 128, Tag: "issue", Value: ";"}, Key: "a.internal.caa.skydns.test."},
+	}
+	for _, serv := range caaServices {
+		addService(t, s, serv.Key, 0, serv)
+		defer delService(t, s, serv.Key)
+	}
+
+	for _, tc := range []struct {
+		qname  string
+		values []string
+	}{
+		// The record of internal.caa.skydns.test. does not apply to its parent.
+		{"caa.skydns.test.", []string{"letsencrypt.org", "mailto:security@skydns.test"}},
+		{"internal.caa.skydns.test.", []string{";"}},
+	} {
+		m := new(dns.Msg)
+		m.SetQuestion(tc.qname, dns.TypeCAA)
+		resp, err := dns.Exchange(m, "127.0.0.1:"+StrPort)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var values []string
+		for _, rr := range resp.Answer {
+			values = append(values, rr.(*dns.CAA).Value)
+		}
+		sort.Strings(values)
+		if !reflect.DeepEqual(values, tc.values) {
+			t.Errorf("CAA %s: expected %v, got %v", tc.qname, tc.values, values)
+		}
+	}
+}
+
+func TestSOAConfig(t *testing.T) {
+	s := newTestServer(t, false, func(s *server) {
+		s.config.SOA = &SOA{Mname: "NS1.example.net", Refresh: 3600, NS: []string{"ns1.example.net", "ns2.example.org."}}
+		if err := setSOADefaults(s.config); err != nil {
+			t.Fatal(err)
+		}
+	})
+	defer s.Stop()
+
+	m := new(dns.Msg)
+	m.SetQuestion("skydns.test.", dns.TypeSOA)
+	w := &testWriter{}
+	s.ServeDNS(w, m)
+	if len(w.msg.Answer) != 1 {
+		t.Fatalf("expected a SOA record, got %s", w.msg)
+	}
+	soa := w.msg.Answer[0].(*dns.SOA)
+	if soa.Ns != "ns1.example.net." || soa.Refresh != 3600 || soa.Retry != 7200 || soa.Expire != 604800 {
+		t.Errorf("expected the configured SOA parameters, got %s", soa)
+	}
+
+	m.SetQuestion("skydns.test.", dns.TypeNS)
+	w = &testWriter{}
+	s.ServeDNS(w, m)
+	if len(w.msg.Answer) != 2 || w.msg.Answer[1].(*dns.NS).Ns != "ns2.example.org." {
+		t.Errorf("expected the 2 configured NS records, got %s", w.msg)
+	}
+
+	s.config.SOA = &SOA{NS: []string{"ns.skydns.test."}}
+	if err := setSOADefaults(s.config); err == nil {
+		t.Error("expected an error for a nameserver in our domain")
+	}
+}
+
+func TestNegativeAnswers(t *testing.T) {
+	s := newTestServer(t, false)
+	defer s.Stop()
+
+	for _, serv := range []*msg.Service{
+		{Key: "a.negative.skydns.test.", Host: "10.0.17.1"},
+		{Key: "txt.negative.skydns.test.", Text: "only text"},
+		{Key: "x.ent.negative.skydns.test.", Host: "10.0.17.2"},
+		{Key: "dangling.negative.skydns.test.", Host: "missing.negative.skydns.test."},
+		{Key: "nodata.negative.skydns.test.", Host: "txt.negative.skydns.test."},
+	} {
+		addService(t, s, serv.Key, 0, serv)
+		defer delService(t, s, serv.Key)
+	}
+
+	tests := []struct {
+		name   string
+		qtype  uint16
+		rcode  int
+		answer int
+	}{
+		{"a.negative.skydns.test.", dns.TypeAAAA, dns.RcodeSuccess, 0},
+		{"a.negative.skydns.test.", dns.TypeMX, dns.RcodeSuccess, 0},
+		{"txt.negative.skydns.test.", dns.TypeA, dns.RcodeSuccess, 0},
+		{"txt.negative.skydns.test.", dns.TypeCNAME, dns.RcodeSuccess, 0},
+		{"ent.negative.skydns.test.", dns.TypeTXT, dns.RcodeSuccess, 0},
+		{"missing.negative.skydns.test.", dns.TypeA, dns.RcodeNameError, 0},
+		{"missing.negative.skydns.test.", dns.TypeTXT, dns.RcodeNameError, 0},
+		{"x.a.negative.skydns.test.", dns.TypeA, dns.RcodeNameError, 0},
+		// The end of the CNAME chain decides.
+		{"dangling.negative.skydns.test.", dns.TypeA, dns.RcodeNameError, 1},
+		{"nodata.negative.skydns.test.", dns.TypeA, dns.RcodeSuccess, 1},
+	}
+	for _, tc := range tests {
+		m := new(dns.Msg)
+		m.SetQuestion(tc.name, tc.qtype)
+		w := &testWriter{}
+		s.ServeDNS(w, m)
+		if w.msg.Rcode != tc.rcode || len(w.msg.Answer) != tc.answer {
+			t.Errorf("%s %s: expected %s with %d answers, got %s", tc.name, dns.TypeToString[tc.qtype],
+				dns.RcodeToString[tc.rcode], tc.answer, w.msg)
+			continue
+		}
+		if len(w.msg.Ns) != 1 {
+			t.Errorf("%s %s: expected the SOA in the authority section, got %s", tc.name, dns.TypeToString[tc.qtype], w.msg)
+			continue
+		}
+		soa, ok := w.msg.Ns[0].(*dns.SOA)
+		if !ok || soa.Hdr.Name != "skydns.test." || soa.Hdr.Ttl != s.config.MinTtl || soa.Minttl != s.config.MinTtl {
+			t.Errorf("%s %s: expected the SOA with TTL %d, got %s", tc.name, dns.TypeToString[tc.qtype], s.config.MinTtl, w.msg.Ns[0])
+		}
+	}
+}
+
+func TestURI(t *testing.T) {
+	s := newTestServer(t, false)
+	defer s.Stop()
+
+	uriServices := []*msg.Service{
+		{Uri: "https://a.example.com/api", Priority: 10, Srv: "http", Proto: "tcp", Key: "a.uri.skydns.test."},
+		{Uri: "https://b.example.com/api", Priority: 20, Weight: 5, Srv: "http", Proto: "tcp", Key: "b.uri.skydns.test."},
+		{Uri: "ftp://c.example.com/", Key: "c.uri.skydns.test."},
+	}
+	for _, serv := range uriServices {
+		addService(t, s, serv.Key, 0, serv)
+		defer delService(t, s, serv.Key)
+	}
+
+	for _, tc := range []struct {
+		qname string
+		uris  []string
+	}{
+		{"uri.skydns.test.", []string{"10 100 \"ftp://c.example.com/\"", "10 100 \"https://a.example.com/api\"", "20 5 \"https://b.example.com/api\""}},
+		{"_http._tcp.uri.skydns.test.", []string{"10 100 \"https://a.example.com/api\"", "20 5 \"https://b.example.com/api\""}},
+		{"c.uri.skydns.test.", []string{"10 100 \"ftp://c.example.com/\""}},
+	} {
+		m := new(dns.Msg)
+		m.SetQuestion(tc.qname, dns.TypeURI)
+		resp, err := dns.Exchange(m, "127.0.0.1:"+StrPort)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var uris []string
+		for _, rr := range resp.Answer {
+			uris = append(uris, strings.TrimPrefix(rr.String(), rr.Header().String()))
+		}
+		sort.Strings(uris)
+		if !reflect.DeepEqual(uris, tc.uris) {
+			t.Errorf("URI %s: expected %v, got %v", tc.qname, tc.uris, uris)
+		}
+	}
+}
+
+func TestTLSA(t *testing.T) {
+	s := newTestServer(t, false)
+	defer s.Stop()
+
+	tlsa := &msg.TLSA{Usage: 3, Selector: 1, MatchingType: 1, Certificate: "0c72ac70"}
+	tlsaServices := []*msg.Service{
+		{Host: "10.0.8.1", Port: 8443, Tlsa: tlsa, Key: "a.dane.skydns.test."},
+		{Host: "10.0.8.2", Tlsa: tlsa, Key: "b.dane.skydns.test."},
+		{Host: "10.0.8.3", Port: 8443, Key: "c.dane.skydns.test."},
+	}
+	for _, serv := range tlsaServices {
+		addService(t, s, serv.Key, 0, serv)
+		defer delService(t, s, serv.Key)
+	}
+
+	for _, tc := range []struct {
+		qname  string
+		qtype  uint16
+		rcode  int
+		answer int
+	}{
+		{"_8443._tcp.dane.skydns.test.", dns.TypeTLSA, dns.RcodeSuccess, 1},
+		// The port of the SRV target of a.dane.skydns.test.
+		{"_8443._tcp.a.dane.skydns.test.", dns.TypeTLSA, dns.RcodeSuccess, 1},
+		// Without a port, 443.
+		{"_443._tcp.b.dane.skydns.test.", dns.TypeTLSA, dns.RcodeSuccess, 1},
+		{"_8443._tcp.b.dane.skydns.test.", dns.TypeTLSA, dns.RcodeNameError, 0},
+		{"_8443._udp.a.dane.skydns.test.", dns.TypeTLSA, dns.RcodeNameError, 0},
+		{"_8443._tcp.c.dane.skydns.test.", dns.TypeTLSA, dns.RcodeNameError, 0},
+		// The name exists, it has a TLSA record.
+		{"_8443._tcp.a.dane.skydns.test.", dns.TypeA, dns.RcodeSuccess, 0},
+	} {
+		m := new(dns.Msg)
+		m.SetQuestion(tc.qname, tc.qtype)
+		resp, err := dns.Exchange(m, "127.0.0.1:"+StrPort)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.Rcode != tc.rcode || len(resp.Answer) != tc.answer {
+			t.Errorf("%s %s: expected %s with %d answers, got %s", tc.qname, dns.TypeToString[tc.qtype], dns.RcodeToString[tc.rcode], tc.answer, resp)
+		}
+	}
+}
+
+func TestSVCB(t *testing.T) {
+	s := newTestServer(t, false)
+	defer s.Stop()
+
+	svcbServices := []*msg.Service{
+		{Host: "10.0.9.1", Svcb: &msg.SVCB{SvcPriority: 1, SvcParams: msg.SvcParams{Alpn: []string{"h2"}}}, Key: "a.svcb.skydns.test."},
+		{Host: "10.0.9.2", Key: "b.svcb.skydns.test."},
+	}
+	for _, serv := range svcbServices {
+		addService(t, s, serv.Key, 0, serv)
+		defer delService(t, s, serv.Key)
+	}
+
+	for _, qtype := range []uint16{msg.TypeHTTPS, msg.TypeSVCB} {
+		m := new(dns.Msg)
+		m.SetQuestion("svcb.skydns.test.", qtype)
+		resp, err := dns.Exchange(m, "127.0.0.1:"+StrPort)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(resp.Answer) != 1 || resp.Answer[0].Header().Rrtype != qtype {
+			t.Fatalf("expected 1 record of type %d, got %s", qtype, resp)
+		}
+		if len(resp.Extra) != 1 || resp.Extra[0].String() != "a.svcb.skydns.test.\t3600\tIN\tA\t10.0.9.1" {
+			t.Errorf("expected the address of the target in the additional section, got %v", resp.Extra)
+		}
+	}
+}
+
+func TestMultipleHosts(t *testing.T) {
+	s := newTestServer(t, false)
+	defer s.Stop()
+
+	serv := &msg.Service{Host: "10.0.10.1", Hosts: []string{"10.0.10.2", "2001::10", "10.0.10.1"}, Port: 80, Key: "a.multihost.skydns.test."}
+	addService(t, s, serv.Key, 0, serv)
+	defer delService(t, s, serv.Key)
+
+	for _, tc := range []struct {
+		qtype         uint16
+		answer, extra int
+	}{
+		{dns.TypeA, 2, 0},
+		{dns.TypeAAAA, 1, 0},
+		// One SRV record for the key, with all its addresses.
+		{dns.TypeSRV, 1, 3},
+	} {
+		m := new(dns.Msg)
+		m.SetQuestion("a.multihost.skydns.test.", tc.qtype)
+		resp, err := dns.Exchange(m, "127.0.0.1:"+StrPort)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(resp.Answer) != tc.answer || len(resp.Extra) != tc.extra {
+			t.Errorf("%s: expected %d answers and %d extra, got %s", dns.TypeToString[tc.qtype], tc.answer, tc.extra, resp)
+		}
+	}
+}
+
+func TestPriorityFailover(t *testing.T) {
+	s := newTestServer(t, false, func(s *server) {
+		s.config.PriorityFailover = true
+	})
+	defer s.Stop()
+
+	failoverServices := []*msg.Service{
+		{Host: "10.0.14.1", Priority: 10, Key: "a.failover.skydns.test."},
+		{Host: "10.0.14.2", Priority: 10, Key: "b.failover.skydns.test."},
+		{Host: "10.0.14.3", Priority: 20, Key: "c.failover.skydns.test."},
+		{Text: "no address", Priority: 1, Key: "d.failover.skydns.test."},
+	}
+	for _, serv := range failoverServices {
+		addService(t, s, serv.Key, 0, serv)
+	}
+	defer delService(t, s, "c.failover.skydns.test.")
+	defer delService(t, s, "d.failover.skydns.test.")
+
+	query := func() []string {
+		m := new(dns.Msg)
+		m.SetQuestion("failover.skydns.test.", dns.TypeA)
+		w := &testWriter{}
+		s.ServeDNS(w, m)
+		var ips []string
+		for _, rr := range w.msg.Answer {
+			ips = append(ips, rr.(*dns.A).A.String())
+		}
+		sort.Strings(ips)
+		return ips
+	}
+
+	if ips := query(); strings.Join(ips, " ") != "10.0.14.1 10.0.14.2" {
+		t.Errorf("expected the addresses with priority 10, got %v", ips)
+	}
+	// The TXT record has no address, it is not a standby.
+	sx := s.failover([]msg.Service{
+		{Host: "10.0.14.1", Priority: 10},
+		{Host: "10.0.14.3", Priority: 20},
+		{Text: "no address", Priority: 30},
+	})
+	if len(sx) != 2 || sx[0].Host != "10.0.14.1" || sx[1].Text != "no address" {
+		t.Errorf("expected the address with priority 10 and the TXT record, got %v", sx)
+	}
+	delService(t, s, "a.failover.skydns.test.")
+	delService(t, s, "b.failover.skydns.test.")
+	if ips := query(); strings.Join(ips, " ") != "10.0.14.3" {
+		t.Errorf("expected the standby address with priority 20, got %v", ips)
+	}
+}
+
+func TestCNAMEDepth(t *testing.T) {
+	s := newTestServer(t, false, func(s *server) {
+		s.config.CNAMEDepth = 2
+	})
+	defer s.Stop()
+
+	for _, serv := range []*msg.Service{
+		{Host: "b.cnamedepth.skydns.test.", Key: "a.cnamedepth.skydns.test."},
+		{Host: "c.cnamedepth.skydns.test.", Key: "b.cnamedepth.skydns.test."},
+		{Host: "d.cnamedepth.skydns.test.", Key: "c.cnamedepth.skydns.test."},
+		{Host: "10.0.15.1", Key: "d.cnamedepth.skydns.test."},
+	} {
+		addService(t, s, serv.Key, 0, serv)
+		defer delService(t, s, serv.Key)
+	}
+
+	for _, tc := range []struct {
+		qname  string
+		rcode  int
+		answer int
+	}{
+		{"b.cnamedepth.skydns.test.", dns.RcodeSuccess, 3},
+		{"a.cnamedepth.skydns.test.", dns.RcodeServerFailure, 0},
+	} {
+		m := new(dns.Msg)
+		m.SetQuestion(tc.qname, dns.TypeA)
+		w := &testWriter{}
+		s.ServeDNS(w, m)
+		if w.msg.Rcode != tc.rcode || len(w.msg.Answer) != tc.answer {
+			t.Errorf("%s: expected %s with %d answers, got %s", tc.qname, dns.RcodeToString[tc.rcode], tc.answer, w.msg)
+		}
+	}
+}
+
+func TestTags(t *testing.T) {
+	s := newTestServer(t, false)
+	defer s.Stop()
+
+	for _, serv := range []*msg.Service{
+		{Host: "10.0.17.1", Tags: []string{"dc1", "V2"}, Key: "a.tags.skydns.test."},
+		{Host: "10.0.17.2", Tags: []string{"dc2", "v2"}, Key: "b.tags.skydns.test."},
+		{Host: "10.0.17.3", Key: "c.tags.skydns.test."},
+	} {
+		addService(t, s, serv.Key, 0, serv)
+		defer delService(t, s, serv.Key)
+	}
+
+	for _, tc := range []struct {
+		qname  string
+		qtype  uint16
+		rcode  int
+		answer int
+	}{
+		{"tags.skydns.test.", dns.TypeA, dns.RcodeSuccess, 3},
+		{"_tag.v2.tags.skydns.test.", dns.TypeA, dns.RcodeSuccess, 2},
+		{"_tag.dc1.tags.skydns.test.", dns.TypeSRV, dns.RcodeSuccess, 1},
+		{"_tag.dc2.b.tags.skydns.test.", dns.TypeA, dns.RcodeSuccess, 1},
+		{"_tag.dc3.tags.skydns.test.", dns.TypeA, dns.RcodeNameError, 0},
+	} {
+		m := new(dns.Msg)
+		m.SetQuestion(tc.qname, tc.qtype)
+		w := &testWriter{}
+		s.ServeDNS(w, m)
+		if w.msg.Rcode != tc.rcode || len(w.msg.Answer) != tc.answer {
+			t.Errorf("%s: expected %s with %d answers, got %s", tc.qname, dns.RcodeToString[tc.rcode], tc.answer, w.msg)
+		}
+	}
+}
+
+func TestRaw(t *testing.T) {
+	s := newTestServer(t, false)
+	defer s.Stop()
+
+	rawServices := []*msg.Service{
+		{Host: "10.0.11.1", Raw: `HINFO "amd64" "linux"`, Key: "a.raw.skydns.test."},
+		{Raw: `RP mbox.skydns.test. txt.skydns.test.`, Key: "b.raw.skydns.test."},
+	}
+	for _, serv := range rawServices {
+		addService(t, s, serv.Key, 0, serv)
+		defer delService(t, s, serv.Key)
+	}
+
+	for _, tc := range []struct {
+		qname  string
+		qtype  uint16
+		answer int
+	}{
+		{"a.raw.skydns.test.", dns.TypeHINFO, 1},
+		{"raw.skydns.test.", dns.TypeHINFO, 1},
+		{"b.raw.skydns.test.", dns.TypeRP, 1},
+		{"b.raw.skydns.test.", dns.TypeHINFO, 0},
+	} {
+		m := new(dns.Msg)
+		m.SetQuestion(tc.qname, tc.qtype)
+		resp, err := dns.Exchange(m, "127.0.0.1:"+StrPort)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.Rcode != dns.RcodeSuccess || len(resp.Answer) != tc.answer {
+			t.Errorf("%s %s: expected %d answers, got %s", tc.qname, dns.TypeToString[tc.qtype], tc.answer, resp)
+			continue
+		}
+		for _, rr := range resp.Answer {
+			if rr.Header().Name != tc.qname || rr.Header().Rrtype != tc.qtype {
+				t.Errorf("%s %s: expected the record for the query, got %s", tc.qname, dns.TypeToString[tc.qtype], rr)
+			}
+		}
+	}
+}
+
+func TestTtlOverrides(t *testing.T) {
+	s := newTestServer(t, false)
+	defer s.Stop()
+
+	serv := &msg.Service{Host: "10.0.12.1", Port: 80, TtlA: 30, TtlSRV: 600, Key: "a.ttltype.skydns.test."}
+	addService(t, s, serv.Key, 0, serv)
+	defer delService(t, s, serv.Key)
+
+	m := new(dns.Msg)
+	m.SetQuestion("a.ttltype.skydns.test.", dns.TypeSRV)
+	resp, err := dns.Exchange(m, "127.0.0.1:"+StrPort)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Answer) != 1 || resp.Answer[0].Header().Ttl != 600 {
+		t.Fatalf("expected an SRV record with TTL 600, got %s", resp)
+	}
+	if len(resp.Extra) != 1 || resp.Extra[0].Header().Ttl != 30 {
+		t.Fatalf("expected an A record with TTL 30, got %s", resp)
+	}
+}
+
 func TestMsgOverflow(t *testing.T) {
 	if testing.Short() {
 		t.Skip("skipping test in short mode.")
@@ -0,0 +1,57 @@
+// Copyright (c) 2014 The SkyDNS Authors. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package server
+
+import "github.com/miekg/dns"
+
+// dnssecHandler is the dnssec stage: it signs the answers from our zone that next
+// writes, for clients that ask for DNSSEC with DO, and sets their AD bit, see
+// setAD. Of a referral only the DS records are ours to sign.
+func (s *server) dnssecHandler(next dns.Handler) dns.Handler {
+	return dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+		if s.config.PubKey == nil || req.Opcode != dns.OpcodeQuery {
+			next.ServeDNS(w, req)
+			return
+		}
+		next.ServeDNS(&signWriter{ResponseWriter: w, s: s, req: req}, req)
+	})
+}
+
+// signWriter is the writer of the dnssec stage.
+type signWriter struct {
+	dns.ResponseWriter
+	s    *server
+	req  *dns.Msg
+	kind replyKind
+}
+
+func (w *signWriter) setReply(kind replyKind, scope uint8) {
+	w.kind = kind
+	setReply(w.ResponseWriter, kind, scope)
+}
+
+func (w *signWriter) WriteMsg(m *dns.Msg) error {
+	s, req := w.s, w.req
+	if (w.kind != replyAnswer && w.kind != replyReferral) || m.Rcode == dns.RcodeServerFailure {
+		return w.ResponseWriter.WriteMsg(m)
+	}
+	bufsize, dnssec := s.querySize(w, req)
+	switch {
+	case !dnssec:
+	case w.kind == replyReferral:
+		s.signReferral(m, bufsize)
+	default:
+		s.Denial(m)
+		if err := s.Sign(m, bufsize); err != nil {
+			// Validators take an answer without all its RRSIGs as bogus,
+			// fail instead, and don't cache that.
+			m = s.ServerFailure(req)
+			s.explain(m, req, reasonSignFailed)
+			return w.ResponseWriter.WriteMsg(m)
+		}
+	}
+	s.setAD(m, req, dnssec)
+	return w.ResponseWriter.WriteMsg(m)
+}
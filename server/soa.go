@@ -0,0 +1,66 @@
+// Copyright (c) 2014 The SkyDNS Authors. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package server
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// SOA holds the parameters of the SOA record of a zone, our domain or a tenant's,
+// and the nameservers of the zone that are not in the backend. The RNAME is
+// Config.Hostmaster and the minimum is Config.MinTtl.
+type SOA struct {
+	// Mname, the primary nameserver of the zone. Defaults to ns.dns.<domain>.
+	Mname string `json:"mname,omitempty"`
+	// Refresh, Retry and Expire, in seconds, default to 28800, 7200 and 604800.
+	Refresh uint32 `json:"refresh,omitempty"`
+	Retry   uint32 `json:"retry,omitempty"`
+	Expire  uint32 `json:"expire,omitempty"`
+	// NS, names of nameservers of the zone added to those stored under
+	// ns.dns.<domain>, for instance secondaries at another provider. Nameservers
+	// in the zone need glue and must be stored in the backend.
+	NS []string `json:"ns,omitempty"`
+}
+
+func setSOADefaults(config *Config) error {
+	if config.SOA == nil {
+		config.SOA = &SOA{}
+	}
+	soa := config.SOA
+	if soa.Mname == "" {
+		soa.Mname = appendDomain("ns.dns", config.Domain)
+	}
+	soa.Mname = dns.Fqdn(strings.ToLower(soa.Mname))
+	if soa.Refresh == 0 {
+		soa.Refresh = 28800
+	}
+	if soa.Retry == 0 {
+		soa.Retry = 7200
+	}
+	if soa.Expire == 0 {
+		soa.Expire = 604800
+	}
+	for i, ns := range soa.NS {
+		ns = dns.Fqdn(strings.ToLower(ns))
+		if _, ok := dns.IsDomainName(ns); !ok || dns.IsSubDomain(config.Domain, ns) {
+			return fmt.Errorf("invalid soa nameserver, it must be a name out of %s: %q", config.Domain, soa.NS[i])
+		}
+		soa.NS[i] = ns
+	}
+	return nil
+}
+
+// configNS returns the NS records for the nameservers in SOA.NS, with owner
+// q.Name.
+func (s *server) configNS(q dns.Question) (records []dns.RR) {
+	for _, ns := range s.config.SOA.NS {
+		hdr := dns.RR_Header{Name: q.Name, Rrtype: dns.TypeNS, Class: dns.ClassINET, Ttl: s.config.Ttl}
+		records = append(records, &dns.NS{Hdr: hdr, Ns: ns})
+	}
+	return records
+}
@@ -0,0 +1,102 @@
+// Copyright (c) 2014 The SkyDNS Authors. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package server
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/skynetservices/skydns/msg"
+
+	"github.com/miekg/dns"
+)
+
+// srvServices returns the services for name, honouring RFC 2782 style names.
+// The name is looked up as is first, so services stored under a key such as
+// /skydns/local/skydns/myservice/_tcp/_http keep working. When that yields
+// nothing and name starts with _service._proto labels, the services stored
+// under the remaining name with matching Srv and Proto fields are returned.
+// A leading DNS-SD instance label, see DNSSDRecords, selects the service whose
+// key starts with that label.
+func (s *server) srvServices(name string) ([]msg.Service, error) {
+	services, err := s.records(name, false)
+	if err == nil && len(services) > 0 {
+		return services, nil
+	}
+	instance, srv, proto, base, ok := splitSrvName(name)
+	if !ok || !dns.IsSubDomain(s.config.Domain, base) {
+		return services, err
+	}
+	sx, err1 := s.records(base, false)
+	if err1 != nil {
+		return services, err
+	}
+	matched := sx[:0]
+	for _, serv := range sx {
+		if !strings.EqualFold(serv.Srv, srv) || !strings.EqualFold(serv.Proto, proto) {
+			continue
+		}
+		if instance != "" && !strings.EqualFold(dns.SplitDomainName(msg.Domain(serv.Key))[0], instance) {
+			continue
+		}
+		matched = append(matched, serv)
+	}
+	if len(matched) == 0 {
+		return services, err
+	}
+	return matched, nil
+}
+
+// tlsaServices returns the services with a TLSA record for name, a DANE name
+// _port._proto.base (RFC 6698): the services of base with that Port, 443 when
+// not set, and Proto, tcp when not set. So the TLSA records line up with the
+// SRV records of base.
+func (s *server) tlsaServices(name string) ([]msg.Service, error) {
+	instance, srv, proto, base, ok := splitSrvName(name)
+	if !ok || instance != "" || !dns.IsSubDomain(s.config.Domain, base) {
+		return nil, nil
+	}
+	port, err := strconv.Atoi(srv)
+	if err != nil {
+		return nil, nil
+	}
+	services, err := s.records(base, false)
+	if err != nil {
+		return nil, err
+	}
+	var sx []msg.Service
+	for _, serv := range services {
+		if serv.Tlsa == nil {
+			continue
+		}
+		sport, sproto := serv.Port, serv.Proto
+		if sport == 0 {
+			sport = 443
+		}
+		if sproto == "" {
+			sproto = "tcp"
+		}
+		if sport == port && strings.EqualFold(sproto, proto) {
+			sx = append(sx, serv)
+		}
+	}
+	return sx, nil
+}
+
+// splitSrvName splits [instance.]_service._proto.base into its parts, the
+// service and protocol name are returned without underscores. It returns
+// false if name has no such labels.
+func splitSrvName(name string) (instance, srv, proto, base string, ok bool) {
+	labels := dns.SplitDomainName(name)
+	if len(labels) > 0 && !isSrvLabel(labels[0]) {
+		instance, labels = labels[0], labels[1:]
+	}
+	if len(labels) < 3 || !isSrvLabel(labels[0]) || !isSrvLabel(labels[1]) {
+		return "", "", "", "", false
+	}
+	return instance, labels[0][1:], labels[1][1:], dns.Fqdn(strings.Join(labels[2:], ".")), true
+}
+
+func isSrvLabel(l string) bool { return len(l) > 1 && l[0] == '_' }
@@ -0,0 +1,350 @@
+// Copyright (c) 2014 The SkyDNS Authors. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package server
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	headerSize = 12
+	// maxSources is the number of sources we track FORMERR replies for in a
+	// second, beyond that new sources get no reply.
+	maxSources = 1 << 16
+)
+
+var (
+	errShort       = errors.New("message too short")
+	errResponse    = errors.New("message is a response")
+	errOpcode      = errors.New("opcode not implemented")
+	errZ           = errors.New("z bit set")
+	errTruncated   = errors.New("query is truncated")
+	errCounts      = errors.New("bad section counts")
+	errName        = errors.New("bad domain name")
+	errPointer     = errors.New("compression pointer does not point backwards")
+	errQuestion    = errors.New("bad question type or class")
+	errOPT         = errors.New("bad OPT record")
+	errAnswer      = errors.New("unexpected record in the answer section")
+	errAuthority   = errors.New("unexpected record in the authority section")
+	errAdditional  = errors.New("unexpected record in the additional section")
+	errTrailing    = errors.New("trailing data after the last record")
+	errRecordShort = errors.New("record overflows message")
+	errRejected    = errors.New("query rejected")
+)
+
+// checkQuery strictly validates the raw query in b before it is unpacked. It
+// must be a QUERY with a single question and nothing else, but an OPT and a TSIG
+// record in the additional section. A NOTIFY may also carry an SOA record in the
+// answer section, an IXFR the SOA of the client's version in the authority
+// section. An UPDATE may carry any records in its prerequisite and update
+// sections. Names must be well formed and compression pointers may only point
+// backwards, with the limit on the name's length this rules out loops.
+func checkQuery(b []byte) error {
+	if len(b) < headerSize {
+		return errShort
+	}
+	if b[2]&0x80 != 0 {
+		return errResponse
+	}
+	opcode := int(b[2] >> 3 & 0xF)
+	if opcode != dns.OpcodeQuery && opcode != dns.OpcodeNotify && opcode != dns.OpcodeUpdate {
+		return errOpcode
+	}
+	update := opcode == dns.OpcodeUpdate
+	if b[2]&0x02 != 0 {
+		return errTruncated
+	}
+	if b[3]&0x40 != 0 {
+		return errZ
+	}
+	qd, an, ns, ar := binary.BigEndian.Uint16(b[4:]), binary.BigEndian.Uint16(b[6:]), binary.BigEndian.Uint16(b[8:]), binary.BigEndian.Uint16(b[10:])
+	if qd != 1 || ar > 2 || !update && (an > 1 || an == 1 && opcode != dns.OpcodeNotify || ns > 1) {
+		return errCounts
+	}
+
+	off, err := checkName(b, headerSize)
+	if err != nil {
+		return err
+	}
+	if off+4 > len(b) {
+		return errShort
+	}
+	qtype, qclass := binary.BigEndian.Uint16(b[off:]), binary.BigEndian.Uint16(b[off+2:])
+	if qtype == 0 || qtype == dns.TypeOPT {
+		return errQuestion
+	}
+	if qclass != dns.ClassINET && qclass != dns.ClassCHAOS && qclass != dns.ClassANY {
+		return errQuestion
+	}
+	if ns == 1 && qtype != dns.TypeIXFR && !update {
+		return errCounts
+	}
+	off += 4
+
+	opt := false
+	for i := 0; i < int(an)+int(ns)+int(ar); i++ {
+		start := off
+		if off, err = checkName(b, off); err != nil {
+			return err
+		}
+		if off+10 > len(b) {
+			return errRecordShort
+		}
+		rrtype := binary.BigEndian.Uint16(b[off:])
+		switch {
+		case i < int(an):
+			if rrtype != dns.TypeSOA && !update {
+				return errAnswer
+			}
+		case i < int(an)+int(ns):
+			if rrtype != dns.TypeSOA && !update {
+				return errAuthority
+			}
+		case rrtype != dns.TypeOPT && rrtype != dns.TypeTSIG:
+			return errAdditional
+		}
+		isOPT := rrtype == dns.TypeOPT
+		if isOPT {
+			if opt || off != start+1 { // only one, owned by the root
+				return errOPT
+			}
+			opt = true
+		}
+		rdlen := int(binary.BigEndian.Uint16(b[off+8:]))
+		off += 10
+		if off+rdlen > len(b) {
+			return errRecordShort
+		}
+		if isOPT {
+			if err := checkOptions(b[off : off+rdlen]); err != nil {
+				return err
+			}
+		}
+		off += rdlen
+	}
+	if off != len(b) {
+		return errTrailing
+	}
+	return nil
+}
+
+// checkOptions checks that the EDNS0 options in the rdata of an OPT record
+// exactly fill it.
+func checkOptions(b []byte) error {
+	for len(b) > 0 {
+		if len(b) < 4 {
+			return errOPT
+		}
+		l := 4 + int(binary.BigEndian.Uint16(b[2:]))
+		if l > len(b) {
+			return errOPT
+		}
+		b = b[l:]
+	}
+	return nil
+}
+
+// checkName checks the domain name in b at off and returns the offset just
+// after it.
+func checkName(b []byte, off int) (int, error) {
+	end := -1 // offset after the name, set when we follow the first pointer
+	n := 0    // length of the name in wire format
+	for {
+		if off >= len(b) {
+			return 0, errShort
+		}
+		c := int(b[off])
+		switch c & 0xC0 {
+		case 0x00:
+			if c == 0 {
+				if end == -1 {
+					end = off + 1
+				}
+				return end, nil
+			}
+			n += c + 1
+			if n > 254 {
+				return 0, errName
+			}
+			off += c + 1
+		case 0xC0:
+			if off+1 >= len(b) {
+				return 0, errShort
+			}
+			ptr := int(binary.BigEndian.Uint16(b[off:]) & 0x3FFF)
+			if ptr < headerSize || ptr >= off {
+				return 0, errPointer
+			}
+			if end == -1 {
+				end = off + 2
+			}
+			off = ptr
+		default:
+			return 0, errName
+		}
+	}
+}
+
+// strictChecker rejects queries that fail checkQuery, rate limiting the error
+// replies per source. See Config.Strict.
+type strictChecker struct {
+	rate int
+
+	sync.Mutex
+	window time.Time
+	sent   map[string]int
+}
+
+func newStrictChecker(rate int) *strictChecker {
+	return &strictChecker{rate: rate, sent: make(map[string]int)}
+}
+
+// check returns true if the query in b from remote may be handled. Otherwise
+// reply is called with a FORMERR (or NOTIMP) reply, unless the rate limit for
+// remote is reached or b is not even worth replying to.
+func (c *strictChecker) check(b []byte, remote net.Addr, reply func([]byte)) bool {
+	err := checkQuery(b)
+	if err == nil {
+		return true
+	}
+	if err == errShort && len(b) < headerSize || err == errResponse {
+		return false
+	}
+	if !c.allow(remote) {
+		return false
+	}
+	rcode := dns.RcodeFormatError
+	if err == errOpcode {
+		rcode = dns.RcodeNotImplemented
+	}
+	m := make([]byte, headerSize)
+	copy(m, b[:2])
+	m[2] = 0x80 | b[2]&0x79 // QR, opcode and RD
+	m[3] = byte(rcode)
+	reply(m)
+	return false
+}
+
+// allow returns true if we may send another error reply to remote in this second.
+func (c *strictChecker) allow(remote net.Addr) bool {
+	var ip string
+	switch a := remote.(type) {
+	case *net.UDPAddr:
+		ip = a.IP.String()
+	case *net.TCPAddr:
+		ip = a.IP.String()
+	default:
+		ip = remote.String()
+	}
+
+	c.Lock()
+	defer c.Unlock()
+	if now := time.Now(); now.Sub(c.window) >= time.Second {
+		c.window = now
+		c.sent = make(map[string]int)
+	}
+	n, ok := c.sent[ip]
+	if n >= c.rate || !ok && len(c.sent) >= maxSources {
+		return false
+	}
+	c.sent[ip] = n + 1
+	return true
+}
+
+// reader is a dns.DecorateReader that checks the queries read from r.
+func (c *strictChecker) reader(r dns.Reader) dns.Reader { return &strictReader{r, c} }
+
+type strictReader struct {
+	dns.Reader
+	c *strictChecker
+}
+
+// ReadTCP returns an error for bad queries, which closes the connection.
+func (r *strictReader) ReadTCP(conn net.Conn, timeout time.Duration) ([]byte, error) {
+	b, err := r.Reader.ReadTCP(conn, timeout)
+	if err != nil {
+		return b, err
+	}
+	reply := func(m []byte) {
+		l := make([]byte, 2, 2+len(m))
+		binary.BigEndian.PutUint16(l, uint16(len(m)))
+		conn.Write(append(l, m...))
+	}
+	if !r.c.check(b, conn.RemoteAddr(), reply) {
+		return nil, errRejected
+	}
+	return b, nil
+}
+
+// ReadUDP returns an empty message for bad queries, which the dns package ignores.
+func (r *strictReader) ReadUDP(conn *net.UDPConn, timeout time.Duration) ([]byte, *dns.SessionUDP, error) {
+	b, s, err := r.Reader.ReadUDP(conn, timeout)
+	if err != nil {
+		return b, s, err
+	}
+	reply := func(m []byte) { dns.WriteToSessionUDP(conn, m, s) }
+	if !r.c.check(b, s.RemoteAddr(), reply) {
+		return b[:0], s, nil
+	}
+	return b, s, nil
+}
+
+// recoverHandler replies with SERVFAIL instead of crashing when h panics.
+type recoverHandler struct {
+	h dns.Handler
+	s *server
+}
+
+func (r recoverHandler) ServeDNS(w dns.ResponseWriter, req *dns.Msg) {
+	defer func() {
+		if rec := recover(); rec != nil {
+			logf("recovered from panic handling query from %s: %v", w.RemoteAddr(), rec)
+			m := new(dns.Msg)
+			m.SetRcode(req, dns.RcodeServerFailure)
+			if len(req.Question) > 0 {
+				r.s.explain(m, req, reasonPanic)
+			}
+			r.s.setEdns(m, req.IsEdns0())
+			w.WriteMsg(m)
+		}
+	}()
+	r.h.ServeDNS(w, req)
+}
+
+// reader is the dns.DecorateReader of our servers: queries are checked when
+// running strict, and the TSIG of requests is verified, see tsigReader.
+func (s *server) reader(r dns.Reader) dns.Reader {
+	if s.strict != nil {
+		r = s.strict.reader(r)
+	}
+	if s.config.tsigKeys != nil {
+		r = &tsigReader{r, s.config.tsigKeys}
+	}
+	return r
+}
+
+// listenAndServe is dns.ListenAndServe, checking queries when running strict.
+func (s *server) listenAndServe(addr, network string, h dns.Handler) error {
+	srv := &dns.Server{Addr: addr, Net: network, Handler: h}
+	if s.strict != nil || s.config.tsigKeys != nil {
+		srv.DecorateReader = s.reader
+	}
+	return srv.ListenAndServe()
+}
+
+// activateAndServe is dns.ActivateAndServe, checking queries when running strict.
+func (s *server) activateAndServe(l net.Listener, p net.PacketConn, h dns.Handler) error {
+	srv := &dns.Server{Listener: l, PacketConn: p, Handler: h}
+	if s.strict != nil || s.config.tsigKeys != nil {
+		srv.DecorateReader = s.reader
+	}
+	return srv.ActivateAndServe()
+}
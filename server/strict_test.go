@@ -0,0 +1,101 @@
+// Copyright (c) 2014 The SkyDNS Authors. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package server
+
+import (
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+// The fuzz corpus holds valid queries, prefixed with "query-", and malformed ones.
+const corpus = "testdata/fuzz/corpus"
+
+func readCorpus(t *testing.T) map[string][]byte {
+	files, err := ioutil.ReadDir(corpus)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := make(map[string][]byte)
+	for _, f := range files {
+		b, err := ioutil.ReadFile(filepath.Join(corpus, f.Name()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		c[f.Name()] = b
+	}
+	return c
+}
+
+func TestCheckQuery(t *testing.T) {
+	for name, b := range readCorpus(t) {
+		err := checkQuery(b)
+		if valid := strings.HasPrefix(name, "query-"); valid != (err == nil) {
+			t.Errorf("%s: expected valid %t, got error %v", name, valid, err)
+		}
+	}
+}
+
+func TestStrictCheckerRate(t *testing.T) {
+	c := newStrictChecker(2)
+	remote := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)}
+	bad := []byte{0x12, 0x34, 0x01, 0x00, 0, 2, 0, 0, 0, 0, 0, 0} // two questions, none present
+
+	replies := 0
+	for i := 0; i < 5; i++ {
+		if c.check(bad, remote, func(m []byte) {
+			replies++
+			r := new(dns.Msg)
+			if err := r.Unpack(m); err != nil {
+				t.Fatal(err)
+			}
+			if r.Id != 0x1234 || r.Rcode != dns.RcodeFormatError || !r.Response || !r.RecursionDesired {
+				t.Fatalf("expected a FORMERR reply, got %s", r)
+			}
+		}) {
+			t.Fatal("expected bad query to be rejected")
+		}
+	}
+	if replies != 2 {
+		t.Fatalf("expected %d replies, got %d", 2, replies)
+	}
+}
+
+// TestStrictCorpus feeds the fuzz corpus to the query handling entry point, like Fuzz.
+func TestStrictCorpus(t *testing.T) {
+	s := newTestServer(t, false, func(s *server) {
+		s.config.NoRec = true
+		s.strict = newStrictChecker(1000) // all bad queries in the corpus come from the same source
+	})
+	defer s.Stop()
+
+	mux := dns.NewServeMux()
+	mux.Handle(".", s)
+	h := s.handler(mux)
+
+	for name, b := range readCorpus(t) {
+		w := &testWriter{}
+		replied := false
+		if !s.strict.check(b, w.RemoteAddr(), func([]byte) { replied = true }) {
+			if !replied && len(b) >= headerSize && b[2]&0x80 == 0 {
+				t.Errorf("%s: expected an error reply", name)
+			}
+			continue
+		}
+		req := new(dns.Msg)
+		if err := req.Unpack(b); err != nil {
+			t.Errorf("%s: passed the check, but does not unpack: %s", name, err)
+			continue
+		}
+		h.ServeDNS(w, req)
+		if w.msg == nil {
+			t.Errorf("%s: expected a reply", name)
+		}
+	}
+}
@@ -10,31 +10,21 @@ import (
 	"strings"
 
 	"github.com/miekg/dns"
+	"github.com/skynetservices/skydns/metrics"
 	"github.com/skynetservices/skydns/msg"
 )
 
+// ednsStubCode is the EDNS0 option we add to stub queries. Queries which have this option
+// are not forwarded again.
 const ednsStubCode = dns.EDNS0LOCALSTART + 10
 
-// ednsStub is the EDNS0 record we add to stub queries. Queries which have this record are
-// not forwarded again.
-var ednsStub = func() *dns.OPT {
-	o := new(dns.OPT)
-	o.Hdr.Name = "."
-	o.Hdr.Rrtype = dns.TypeOPT
-	e := new(dns.EDNS0_LOCAL)
-	e.Code = ednsStubCode
-	e.Data = []byte{1}
-	o.Option = append(o.Option, e)
-	return o
-}()
-
 // Look in .../dns/stub/<domain>/xx for msg.Services. Loop through them
 // extract <domain> and add them as forwarders (ip:port-combos) for
 // the stub zones. Only numeric (i.e. IP address) hosts are used.
 func (s *server) UpdateStubZones() {
 	stubmap := make(map[string][]string)
 
-	services, err := s.backend.Records("stub.dns."+s.config.Domain, false)
+	services, err := s.records("stub.dns."+s.config.Domain, false)
 	if err != nil {
 		logf("stub zone update failed: %s", err)
 		return
@@ -68,7 +58,7 @@ func (s *server) UpdateStubZones() {
 
 // ServeDNSStubForward forwards a request to a nameservers and returns the response.
 func (s *server) ServeDNSStubForward(w dns.ResponseWriter, req *dns.Msg, ns []string) *dns.Msg {
-	// Check EDNS0 Stub option, if set drop the packet.
+	// Check EDNS0 Stub option, if set the request is not forwarded again.
 	option := req.IsEdns0()
 	if option != nil {
 		for _, o := range option.Option {
@@ -76,18 +66,19 @@ func (s *server) ServeDNSStubForward(w dns.ResponseWriter, req *dns.Msg, ns []st
 				o.(*dns.EDNS0_LOCAL).Data[0] == 1 {
 				// Maybe log source IP here?
 				logf("not fowarding stub request to another stub")
-				return nil
+				return s.loopFailure(w, req, option, metrics.Stub)
 			}
 		}
 	}
+	if looped(req) {
+		return s.loopFailure(w, req, option, metrics.Stub)
+	}
 
 	// Add a custom EDNS0 option to the packet, so we can detect loops
 	// when 2 stubs are forwarding to each other.
-	if option != nil {
-		option.Option = append(option.Option, &dns.EDNS0_LOCAL{ednsStubCode, []byte{1}})
-	} else {
-		req.Extra = append(req.Extra, ednsStub)
-	}
+	markLoop(req)
+	o := req.IsEdns0()
+	o.Option = append(o.Option, &dns.EDNS0_LOCAL{ednsStubCode, []byte{1}})
 
 	var (
 		r   *dns.Msg
@@ -98,14 +89,18 @@ func (s *server) ServeDNSStubForward(w dns.ResponseWriter, req *dns.Msg, ns []st
 	nsid := int(req.Id) % len(ns)
 	try := 0
 Redo:
-	if isTCP(w) {
-		r, err = exchangeWithRetry(s.dnsTCPclient, req, ns[nsid])
-	} else {
-		r, err = exchangeWithRetry(s.dnsUDPclient, req, ns[nsid])
+	switch {
+	case s.config.isSelf(ns[nsid]):
+		err = errLoop
+	case isTCP(w):
+		r, err = s.exchange(s.dnsTCPclient, req, ns[nsid])
+	default:
+		r, err = s.exchange(s.dnsUDPclient, req, ns[nsid])
 	}
 	if err == nil || err == dns.ErrTruncated {
 		r.Compress = true
 		r.Id = req.Id
+		s.setEdns(r, option)
 		w.WriteMsg(r)
 		return r
 	}
@@ -117,8 +112,13 @@ Redo:
 		goto Redo
 	}
 
+	if err == errLoop {
+		return s.loopFailure(w, req, option, metrics.Stub)
+	}
 	logf("failure to forward stub request %q", err)
 	m := s.ServerFailure(req)
+	s.explain(m, req, reasonStubFailed)
+	s.setEdns(m, option)
 	w.WriteMsg(m)
 	return m
 }
@@ -0,0 +1,150 @@
+// Copyright (c) 2014 The SkyDNS Authors. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package server
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// tcpIdleTimeout is how long a TCP connection is kept open without queries, like
+// the dns package does.
+const tcpIdleTimeout = 8 * time.Second
+
+// listenAndServeTCP listens on addr and serves DNS over TCP. With TCPPipeline the
+// queries on a connection are handled concurrently, see serveTCPPipelined.
+func (s *server) listenAndServeTCP(addr string, h dns.Handler) error {
+	if s.config.TCPPipeline <= 1 && !s.config.ProxyProtocol.on(ProxyTCP) {
+		return s.listenAndServe(addr, "tcp", h)
+	}
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	return s.serveTCP(l, h)
+}
+
+// serveTCP serves DNS over the already opened TCP listener l.
+func (s *server) serveTCP(l net.Listener, h dns.Handler) error {
+	l = s.proxyListener(ProxyTCP, l)
+	if s.config.TCPPipeline <= 1 {
+		return s.activateAndServe(l, nil, h)
+	}
+	return s.serveTCPPipelined(l, h)
+}
+
+// serveTCPPipelined serves DNS over TCP on l. Up to s.config.TCPPipeline queries
+// of a connection are handled at the same time, and their replies are written as
+// soon as they are done, out of order (RFC 7766, section 6.2.1.1). The dns
+// package reads the next query only after the previous one is answered.
+func (s *server) serveTCPPipelined(l net.Listener, h dns.Handler) error {
+	defer l.Close()
+	var r dns.Reader = tcpReader{}
+	if s.strict != nil || s.config.tsigKeys != nil {
+		r = s.reader(r)
+	}
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if e, ok := err.(net.Error); ok && e.Temporary() {
+				continue
+			}
+			return err
+		}
+		go s.serveTCPConn(conn, r, h)
+	}
+}
+
+// serveTCPConn reads the queries on conn and hands each to h in its own
+// goroutine. It closes conn when the client is idle or closes it, after the
+// queries that are in flight are answered.
+func (s *server) serveTCPConn(conn net.Conn, r dns.Reader, h dns.Handler) {
+	var wg sync.WaitGroup
+	defer func() {
+		wg.Wait()
+		conn.Close()
+	}()
+	inflight := make(chan struct{}, s.config.TCPPipeline)
+	w := &tcpWriter{conn: conn}
+	timeout := s.config.ReadTimeout
+	for {
+		b, err := r.ReadTCP(conn, timeout)
+		if err != nil {
+			return
+		}
+		timeout = tcpIdleTimeout
+		inflight <- struct{}{}
+		wg.Add(1)
+		go func() {
+			defer func() {
+				<-inflight
+				wg.Done()
+			}()
+			serveBytes(h, w, b)
+		}()
+	}
+}
+
+// tcpReader reads queries from TCP connections for serveTCPPipelined, it can be
+// decorated like the reader of the dns package. It doesn't read UDP.
+type tcpReader struct {
+	dns.Reader
+}
+
+func (tcpReader) ReadTCP(conn net.Conn, timeout time.Duration) ([]byte, error) {
+	conn.SetReadDeadline(time.Now().Add(timeout))
+	l := make([]byte, 2)
+	if _, err := io.ReadFull(conn, l); err != nil {
+		return nil, err
+	}
+	b := make([]byte, binary.BigEndian.Uint16(l))
+	if _, err := io.ReadFull(conn, b); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// tcpWriter is the dns.ResponseWriter of pipelined TCP, shared by the queries of
+// a connection. Every reply is written with a single Write, which the net
+// package doesn't interleave with the writes of other goroutines.
+type tcpWriter struct {
+	conn net.Conn
+}
+
+func (w *tcpWriter) LocalAddr() net.Addr  { return w.conn.LocalAddr() }
+func (w *tcpWriter) RemoteAddr() net.Addr { return w.conn.RemoteAddr() }
+func (w *tcpWriter) Close() error         { return w.conn.Close() }
+func (w *tcpWriter) TsigTimersOnly(bool)  {}
+func (w *tcpWriter) Hijack()              {}
+
+// TsigStatus is nil, like for the dns package: with TSIG keys, requests that
+// don't verify are rejected by the tsigReader.
+func (w *tcpWriter) TsigStatus() error { return nil }
+
+func (w *tcpWriter) WriteMsg(m *dns.Msg) error {
+	b, err := m.Pack()
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(b)
+	return err
+}
+
+func (w *tcpWriter) Write(b []byte) (int, error) {
+	if len(b) > dns.MaxMsgSize {
+		return 0, dns.ErrBuf
+	}
+	l := make([]byte, 2, 2+len(b))
+	binary.BigEndian.PutUint16(l, uint16(len(b)))
+	if _, err := w.conn.Write(append(l, b...)); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
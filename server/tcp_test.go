@@ -0,0 +1,75 @@
+// Copyright (c) 2014 The SkyDNS Authors. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package server
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/skynetservices/skydns/msg"
+
+	"github.com/miekg/dns"
+)
+
+func TestTCPPipeline(t *testing.T) {
+	s := newTestServer(t, false, func(s *server) {
+		s.config.TCPPipeline = 4
+	})
+	defer s.Stop()
+
+	serv := &msg.Service{Host: "10.0.0.9", Key: "pipeline.skydns.test."}
+	addService(t, s, serv.Key, 0, serv)
+	defer delService(t, s, serv.Key)
+
+	// Queries for slow. are answered after the others that follow them.
+	h := dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+		if req.Question[0].Name == "slow." {
+			time.Sleep(200 * time.Millisecond)
+		}
+		s.ServeDNS(w, req)
+	})
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.serveTCPPipelined(l, h)
+
+	co, err := dns.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer co.Close()
+	slow := new(dns.Msg)
+	slow.SetQuestion("slow.", dns.TypeA)
+	slow.RecursionDesired = false
+	if err := co.WriteMsg(slow); err != nil {
+		t.Fatal(err)
+	}
+	var ids []uint16
+	for i := 0; i < 3; i++ {
+		m := new(dns.Msg)
+		m.SetQuestion("pipeline.skydns.test.", dns.TypeA)
+		if err := co.WriteMsg(m); err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, m.Id)
+	}
+	for i := 0; i < 4; i++ {
+		resp, err := co.ReadMsg()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if i < 3 {
+			if resp.Id == slow.Id || len(resp.Answer) != 1 || resp.Answer[0].(*dns.A).A.String() != "10.0.0.9" {
+				t.Errorf("reply %d: expected an answer before the slow query's, got %s", i, resp)
+			}
+			continue
+		}
+		if resp.Id != slow.Id {
+			t.Errorf("expected the reply to the slow query last, got %s", resp)
+		}
+	}
+}
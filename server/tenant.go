@@ -0,0 +1,305 @@
+// Copyright (c) 2014 The SkyDNS Authors. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/skynetservices/skydns/metrics"
+	"github.com/skynetservices/skydns/msg"
+
+	"github.com/miekg/dns"
+)
+
+// Tenant is a zone served next to our own domain, with its data stored under its
+// own root in the backend: /<path-prefix>-<name>. Access to that root can be
+// limited to the tenant with the backend's own authentication.
+type Tenant struct {
+	// Name of the tenant, lower case letters, digits and dashes.
+	Name string `json:"name"`
+	// Domain the tenant is authoritative for.
+	Domain string `json:"domain"`
+	// Networks (CIDR or single address) of clients that may query the tenant's
+	// zone, others get REFUSED. Empty allows everyone.
+	ACL []string `json:"acl,omitempty"`
+	// MaxRecords, the most services stored in the tenant's zone: dynamic updates
+	// and ACME challenges that add more are refused. Zero is no limit.
+	MaxRecords int `json:"max_records,omitempty"`
+	// MaxQPS, the most queries per second answered for the tenant's zone, others
+	// get REFUSED. Zero is no limit.
+	MaxQPS int `json:"max_qps,omitempty"`
+	// Hostmaster and SOA, the RNAME and the other parameters of the SOA record
+	// of the tenant's zone, and more nameservers for it, see Config.
+	Hostmaster string `json:"hostmaster,omitempty"`
+	SOA        *SOA   `json:"soa,omitempty"`
+	// TsigKeys, names of the keys in Config.TsigKeys that are the tenant's: they
+	// sign dynamic updates of the tenant's zone only, and are the credentials of
+	// the ACME API for challenges in it. Keys of no tenant can be used for every
+	// zone.
+	TsigKeys []string `json:"tsig_keys,omitempty"`
+
+	// ACL parsed.
+	nets []*net.IPNet
+}
+
+// PathPrefix returns the root the tenant's data is stored under.
+func (t Tenant) PathPrefix() string {
+	return msg.PathPrefix + "-" + t.Name
+}
+
+// setTenantDefaults checks the tenants in config.
+func setTenantDefaults(config *Config) error {
+	config.tenantKeys = nil
+	names := make(map[string]bool)
+	domains := map[string]bool{config.Domain: true}
+	for i := range config.Tenants {
+		t := &config.Tenants[i]
+		if !validName(t.Name) {
+			return fmt.Errorf("invalid tenant name: %q", t.Name)
+		}
+		if names[t.Name] {
+			return fmt.Errorf("duplicate tenant name: %q", t.Name)
+		}
+		names[t.Name] = true
+
+		if _, ok := dns.IsDomainName(t.Domain); !ok || t.Domain == "" || t.Domain == "." {
+			return fmt.Errorf("invalid domain for tenant %q: %q", t.Name, t.Domain)
+		}
+		t.Domain = dns.Fqdn(strings.ToLower(t.Domain))
+		if domains[t.Domain] {
+			return fmt.Errorf("domain of tenant %q is already served: %q", t.Name, t.Domain)
+		}
+		domains[t.Domain] = true
+
+		t.nets = nil
+		for _, a := range t.ACL {
+			n, err := parseNet(a)
+			if err != nil {
+				return fmt.Errorf("invalid acl entry for tenant %q: %s", t.Name, err)
+			}
+			t.nets = append(t.nets, n)
+		}
+
+		for j, k := range t.TsigKeys {
+			k = dns.Fqdn(strings.ToLower(k))
+			if _, ok := config.tsigKeys[k]; !ok {
+				return fmt.Errorf("tsig key of tenant %q is not one of tsig_keys: %q", t.Name, t.TsigKeys[j])
+			}
+			if owner, ok := config.tenantKeys[k]; ok {
+				return fmt.Errorf("tsig key of tenant %q is already the key of tenant %q: %q", t.Name, owner, t.TsigKeys[j])
+			}
+			if config.tenantKeys == nil {
+				config.tenantKeys = make(map[string]string)
+			}
+			config.tenantKeys[k] = t.Name
+			t.TsigKeys[j] = k
+		}
+	}
+	return nil
+}
+
+// ownKey returns true if the TSIG key named key may change our zone: keys of a
+// tenant only change the tenant's zone.
+func (c *Config) ownKey(key string) bool {
+	owner, ok := c.tenantKeys[strings.ToLower(key)]
+	return !ok || owner == c.tenant
+}
+
+// validName returns true if name is a valid tenant or view name.
+func validName(name string) bool {
+	return name != "" && strings.Trim(name, "abcdefghijklmnopqrstuvwxyz0123456789-") == ""
+}
+
+// tenant serves a tenant's zone with a server of its own.
+type tenant struct {
+	*server
+	Tenant
+
+	sync.Mutex
+	window time.Time
+	n      int // queries answered in the current window
+}
+
+// AddTenant serves the zone of t, one of the Config's Tenants, from backend. It
+// must be called before Run.
+func (s *server) AddTenant(t Tenant, backend Backend) error {
+	config := *s.config
+	config.Domain = t.Domain
+	config.Hostmaster = t.Hostmaster
+	config.SOA = t.SOA
+	config.Local = ""
+	config.DNSSEC, config.PubKey, config.PrivKey = "", nil, nil
+	config.NoRec = true
+	config.Preload = false
+	config.AcmeAddr, config.AcmeDirectory = "", ""
+	config.Tenants = nil
+	config.CatalogZone = ""
+	config.MDNS = nil
+	if err := SetDefaults(&config); err != nil {
+		return err
+	}
+	config.tenant, config.tenantKeys = t.Name, s.config.tenantKeys
+	if t.MaxRecords > 0 {
+		backend = newQuotaBackend(backend, t.Name, t.Domain, t.MaxRecords)
+	}
+	ts := &tenant{server: New(backend, &config), Tenant: t}
+	// Handling (and recovering from panics) happens in s.
+	ts.pool, ts.strict, ts.popular = nil, nil, nil
+	if s.config.AcmeAddr != "" {
+		ts.challenges = newChallenges(backend)
+	}
+	ts.noQuorum = s.noQuorum
+	ts.weights = s.weights
+	s.tenants = append(s.tenants, ts)
+	return nil
+}
+
+// ServeDNS refuses queries from clients outside the tenant's ACL and over its
+// query rate, others are handled by the tenant's server.
+func (t *tenant) ServeDNS(w dns.ResponseWriter, req *dns.Msg) {
+	metrics.ReportTenantRequestCount(t.Name)
+
+	cause, why := metrics.Cause(""), reason{}
+	switch {
+	case len(t.nets) > 0 && !inNets(t.nets, w.RemoteAddr()):
+		cause, why = metrics.ACL, reasonTenantACL
+	case !t.allow():
+		cause, why = metrics.QPS, reasonTenantQPS
+	}
+	if cause != "" {
+		metrics.ReportTenantQuotaCount(t.Name, cause)
+
+		m := new(dns.Msg)
+		m.SetRcode(req, dns.RcodeRefused)
+		t.explain(m, req, why)
+		t.setEdns(m, req.IsEdns0())
+		w.WriteMsg(m)
+		return
+	}
+	t.server.ServeDNS(w, req)
+}
+
+// allow returns true if another query may be answered in this second.
+func (t *tenant) allow() bool {
+	if t.MaxQPS <= 0 {
+		return true
+	}
+	t.Lock()
+	defer t.Unlock()
+	if now := time.Now(); now.Sub(t.window) >= time.Second {
+		t.window = now
+		t.n = 0
+	}
+	if t.n >= t.MaxQPS {
+		return false
+	}
+	t.n++
+	return true
+}
+
+// errQuota is returned when a service is stored in a tenant's zone that already
+// has Tenant.MaxRecords services.
+var errQuota = errors.New("the tenant's max_records is reached")
+
+// quotaBackend stores at most max services in the zone of a tenant, domain.
+// Services stored in the backend by others are not limited, but counted.
+type quotaBackend struct {
+	Backend
+	tenant string
+	domain string
+	max    int
+}
+
+// newQuotaBackend returns b with at most max services in the zone domain of the
+// tenant. Watcher and Quorumer are passed through when b implements them, so
+// the checks on those in server.Run still hold for the tenant's backend.
+func newQuotaBackend(b Backend, tenant, domain string, max int) Backend {
+	q := quotaBackend{b, tenant, domain, max}
+	_, watches := b.(Watcher)
+	_, quorums := b.(Quorumer)
+	switch {
+	case watches && quorums:
+		return quotaWatchQuorumer{quotaWatcher{q}}
+	case watches:
+		return quotaWatcher{q}
+	case quorums:
+		return quotaQuorumer{q}
+	}
+	return q
+}
+
+// quotaWatcher is a quotaBackend of a backend that implements Watcher.
+type quotaWatcher struct{ quotaBackend }
+
+// Watch passes Watcher through.
+func (q quotaWatcher) Watch(ctx context.Context, f func(msg.Change)) error {
+	return q.Backend.(Watcher).Watch(ctx, f)
+}
+
+// quotaQuorumer is a quotaBackend of a backend that implements Quorumer.
+type quotaQuorumer struct{ quotaBackend }
+
+// Quorum passes Quorumer through.
+func (q quotaQuorumer) Quorum(ctx context.Context) error {
+	return q.Backend.(Quorumer).Quorum(ctx)
+}
+
+// quotaWatchQuorumer is a quotaBackend of a backend that implements both.
+type quotaWatchQuorumer struct{ quotaWatcher }
+
+// Quorum passes Quorumer through.
+func (q quotaWatchQuorumer) Quorum(ctx context.Context) error {
+	return q.Backend.(Quorumer).Quorum(ctx)
+}
+
+// Revision passes Revisioner through, see server.serial.
+func (q quotaBackend) Revision(name string) (msg.Revision, error) {
+	r, ok := q.Backend.(Revisioner)
+	if !ok {
+		return msg.Revision{}, fmt.Errorf("backend has no revisions")
+	}
+	return r.Revision(name)
+}
+
+// Put passes Writer through, see server.ServeDNSUpdate, when the service
+// replaces one or there are less than max services in the zone.
+func (q quotaBackend) Put(name, id string, serv *msg.Service) error {
+	w, ok := q.Backend.(Writer)
+	if !ok {
+		return fmt.Errorf("backend can't store services")
+	}
+	sx, err := q.Backend.Records(q.domain, false)
+	if err != nil && err != msg.ErrNotFound {
+		return err
+	}
+	owner := id + "." + name
+	replaces := false
+	for _, stored := range sx {
+		if msg.Domain(stored.Key) == owner {
+			replaces = true
+			break
+		}
+	}
+	if !replaces && len(sx) >= q.max {
+		metrics.ReportTenantQuotaCount(q.tenant, metrics.Records)
+		return errQuota
+	}
+	return w.Put(name, id, serv)
+}
+
+// Delete passes Writer through, see server.ServeDNSUpdate.
+func (q quotaBackend) Delete(key string) error {
+	w, ok := q.Backend.(Writer)
+	if !ok {
+		return fmt.Errorf("backend can't store services")
+	}
+	return w.Delete(key)
+}
@@ -0,0 +1,204 @@
+// Copyright (c) 2014 The SkyDNS Authors. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	backendetcd "github.com/skynetservices/skydns/backends/etcd"
+	"github.com/skynetservices/skydns/msg"
+
+	etcd "github.com/coreos/etcd/client"
+	"github.com/miekg/dns"
+)
+
+func TestTenantConfig(t *testing.T) {
+	tests := []struct {
+		tenants []Tenant
+		ok      bool
+	}{
+		{[]Tenant{{Name: "team", Domain: "Team.Test"}}, true},
+		{[]Tenant{{Name: "team", Domain: "team.test.", ACL: []string{"10.0.0.0/8", "192.168.1.1"}}}, true},
+		{[]Tenant{{Name: "", Domain: "team.test."}}, false},
+		{[]Tenant{{Name: "Team/x", Domain: "team.test."}}, false},
+		{[]Tenant{{Name: "team", Domain: ""}}, false},
+		{[]Tenant{{Name: "team", Domain: "skydns.test."}}, false},
+		{[]Tenant{{Name: "team", Domain: "team.test."}, {Name: "team", Domain: "other.test."}}, false},
+		{[]Tenant{{Name: "team", Domain: "team.test."}, {Name: "other", Domain: "team.test."}}, false},
+		{[]Tenant{{Name: "team", Domain: "team.test.", ACL: []string{"10.0.0.0/33"}}}, false},
+		{[]Tenant{{Name: "team", Domain: "team.test.", TsigKeys: []string{"Team.Key"}}}, true},
+		{[]Tenant{{Name: "team", Domain: "team.test.", TsigKeys: []string{"other.key."}}}, false},
+		{[]Tenant{{Name: "team", Domain: "team.test.", TsigKeys: []string{"team.key."}}, {Name: "other", Domain: "other.test.", TsigKeys: []string{"team.key."}}}, false},
+	}
+	for i, tc := range tests {
+		config := &Config{Domain: "skydns.test.", Nameservers: []string{"127.0.0.1:53"}, Tenants: tc.tenants,
+			TsigKeys: []TsigKey{{Name: "team.key.", Algorithm: dns.HmacSHA256, Secret: "c2VjcmV0"}}}
+		err := SetDefaults(config)
+		if tc.ok != (err == nil) {
+			t.Errorf("test %d: expected ok %t, got error %v", i, tc.ok, err)
+		}
+	}
+}
+
+func TestTenant(t *testing.T) {
+	client, _ := etcd.New(etcd.Config{
+		Endpoints: []string{"http://127.0.0.1:2379/"},
+		Transport: etcd.DefaultTransport,
+	})
+	kapi := etcd.NewKeysAPI(client)
+
+	config := &Config{
+		Domain:      "skydns.test.",
+		Nameservers: []string{"127.0.0.1:53"},
+		Tenants: []Tenant{
+			{Name: "team", Domain: "team.test.", MaxRecords: 3, TsigKeys: []string{"team.key."}},
+			{Name: "acl", Domain: "acl.test.", ACL: []string{"10.0.0.0/8"}},
+			{Name: "qps", Domain: "qps.test.", MaxQPS: 1},
+		},
+		// Our certificate is not the tenants'.
+		DoHAddr:       "127.0.0.1:0",
+		AcmeDirectory: "https://acme.test/directory",
+		AcmeNames:     []string{"doh.skydns.test"},
+		AcmeAddr:      "127.0.0.1:0",
+		TsigKeys:      []TsigKey{{Name: "team.key.", Algorithm: dns.HmacSHA256, Secret: "c2VjcmV0IGtleSBvZiB0aGUgdGVhbQ=="}},
+	}
+	if err := SetDefaults(config); err != nil {
+		t.Fatal(err)
+	}
+	s := New(backendetcd.NewBackend(kapi, ctx, &backendetcd.Config{Ttl: config.Ttl, Priority: 10}), config)
+	for _, tn := range config.Tenants {
+		b := backendetcd.NewBackend(kapi, ctx, &backendetcd.Config{Ttl: config.Ttl, Priority: 10, PathPrefix: tn.PathPrefix()})
+		if err := s.AddTenant(tn, b); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// The tenant with a quota still watches and checks the quorum of its backend.
+	if _, ok := s.tenants[0].backend.(Watcher); !ok {
+		t.Fatal("expected the backend of a tenant with max_records to be a Watcher")
+	}
+	if _, ok := s.tenants[0].backend.(Quorumer); !ok {
+		t.Fatal("expected the backend of a tenant with max_records to be a Quorumer")
+	}
+
+	set := func(prefix, name, host string) {
+		b, _ := json.Marshal(&msg.Service{Host: host})
+		path := msg.PathIn(prefix, name)
+		if _, err := kapi.Set(ctx, path, string(b), nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	set("skydns-team", "a.web.team.test.", "10.0.0.1")
+	set("skydns-team", "b.web.team.test.", "10.0.0.2")
+	set("skydns-acl", "web.acl.test.", "10.0.0.3")
+	set("skydns-qps", "web.qps.test.", "10.0.0.4")
+	// Data of the tenant under our own root is not seen by the tenant.
+	set("skydns", "web.team.test.", "10.0.0.5")
+	defer func() {
+		for _, p := range []string{"/skydns-team", "/skydns-acl", "/skydns-qps", "/skydns/test/team"} {
+			kapi.Delete(ctx, p, &etcd.DeleteOptions{Recursive: true, Dir: true})
+		}
+	}()
+
+	query := func(tenant int, name string) *dns.Msg {
+		m := new(dns.Msg)
+		m.SetQuestion(name, dns.TypeA)
+		w := &testWriter{}
+		s.tenants[tenant].ServeDNS(w, m)
+		return w.msg
+	}
+
+	resp := query(0, "web.team.test.")
+	if resp.Rcode != dns.RcodeSuccess || len(resp.Answer) != 2 {
+		t.Fatalf("expected both answers from the tenant's root, got %s", resp)
+	}
+	for _, rr := range resp.Answer {
+		if a := rr.(*dns.A).A.String(); a != "10.0.0.1" && a != "10.0.0.2" {
+			t.Fatalf("expected the answers from the tenant's root, got %s", a)
+		}
+	}
+	if resp := query(0, "team.test."); resp.Rcode != dns.RcodeSuccess || !resp.Authoritative {
+		t.Fatalf("expected an authoritative reply for the tenant's apex, got %s", resp)
+	}
+
+	if resp := query(1, "web.acl.test."); resp.Rcode != dns.RcodeRefused {
+		t.Fatalf("expected REFUSED for a client outside the tenant's acl, got %s", resp)
+	}
+
+	if resp := query(2, "web.qps.test."); resp.Rcode != dns.RcodeSuccess || len(resp.Answer) != 1 {
+		t.Fatalf("expected an answer, got %s", resp)
+	}
+	if resp := query(2, "web.qps.test."); resp.Rcode != dns.RcodeRefused {
+		t.Fatalf("expected REFUSED over the tenant's max_qps, got %s", resp)
+	}
+
+	// The tenant's key places challenges in the tenant's zone only, without it
+	// none can be placed there.
+	key := config.tsigKeys["team.key."]
+	acme := func(fqdn string, auth bool) int {
+		r := httptest.NewRequest("POST", "/present", strings.NewReader(`{"fqdn": "`+fqdn+`", "value": "x"}`))
+		r.RemoteAddr = "127.0.0.1:1234"
+		if auth {
+			r.SetBasicAuth(key.Name, key.Secret)
+		}
+		w := httptest.NewRecorder()
+		s.serveAcme(w, r)
+		return w.Code
+	}
+	if code := acme("_acme-challenge.www.team.test.", false); code != http.StatusUnauthorized {
+		t.Fatalf("expected status %d without the tenant's key, got %d", http.StatusUnauthorized, code)
+	}
+	if code := acme("_acme-challenge.www.skydns.test.", true); code != http.StatusUnauthorized {
+		t.Fatalf("expected status %d for the tenant's key outside its zone, got %d", http.StatusUnauthorized, code)
+	}
+	if code := acme("_acme-challenge.www.team.test.", true); code != http.StatusOK {
+		t.Fatalf("expected status %d, got %d", http.StatusOK, code)
+	}
+
+	// The zone has max_records services after this update, so adding another
+	// one is refused, and the tenant's key doesn't update our own zone.
+	update := func(target interface {
+		ServeDNSUpdate(dns.ResponseWriter, *dns.Msg) *dns.Msg
+	}, zone, rr string) *dns.Msg {
+		m := new(dns.Msg)
+		m.SetUpdate(zone)
+		a, _ := dns.NewRR(rr)
+		m.Insert([]dns.RR{a})
+		w := &testWriter{}
+		target.ServeDNSUpdate(&tsigWriter{ResponseWriter: w, key: key}, m)
+		return w.msg
+	}
+	if resp := update(s.tenants[0], "team.test.", "c.web.team.test. 300 IN A 10.0.0.6"); resp.Rcode != dns.RcodeSuccess {
+		t.Fatalf("expected NOERROR for an update, got %s", resp)
+	}
+	if resp := update(s.tenants[0], "team.test.", "d.web.team.test. 300 IN A 10.0.0.7"); resp.Rcode != dns.RcodeRefused {
+		t.Fatalf("expected REFUSED over the tenant's max_records, got %s", resp)
+	}
+	if resp := query(0, "d.web.team.test."); resp.Rcode != dns.RcodeNameError {
+		t.Fatalf("expected no record for the refused update, got %s", resp)
+	}
+	if code := acme("_acme-challenge.web.team.test.", true); code != http.StatusForbidden {
+		t.Fatalf("expected status %d over the tenant's max_records, got %d", http.StatusForbidden, code)
+	}
+	if resp := update(s, "skydns.test.", "c.web.skydns.test. 300 IN A 10.0.0.6"); resp.Rcode != dns.RcodeRefused {
+		t.Fatalf("expected REFUSED for the tenant's key in our own zone, got %s", resp)
+	}
+}
+
+func TestQuotaBackend(t *testing.T) {
+	b := newQuotaBackend(memBackend{}, "team", "team.test.", 1)
+	if _, ok := b.(Writer); !ok {
+		t.Fatal("expected a Writer")
+	}
+	if _, ok := b.(Watcher); ok {
+		t.Fatal("expected no Watcher for a backend that doesn't watch")
+	}
+	if _, ok := b.(Quorumer); ok {
+		t.Fatal("expected no Quorumer for a backend without a quorum")
+	}
+}
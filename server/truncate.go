@@ -0,0 +1,169 @@
+// Copyright (c) 2014 The SkyDNS Authors. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package server
+
+import (
+	"fmt"
+	"math/rand"
+	"sort"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// The records kept when a reply has too many, see Config.AnswerSubset.
+const (
+	// SubsetRandom keeps a random subset, a different one for every reply.
+	SubsetRandom = "random"
+	// SubsetFirst keeps the same records every time: SRV records with the lowest
+	// priority and highest weight, other records in the order of their text.
+	SubsetFirst = "first"
+)
+
+// What happens to replies too large for UDP, see TruncationPolicy.
+const (
+	// OverflowTruncate sets TC, so the client retries over TCP.
+	OverflowTruncate = "truncate"
+	// OverflowDrop leaves out the records that don't fit, without setting TC.
+	OverflowDrop = "drop"
+)
+
+// TruncationPolicy sets what happens to the replies for the names in a zone that
+// are too large for UDP, after the additional section is left out.
+type TruncationPolicy struct {
+	// Zone the policy applies to, defaults to Config.Domain. The policy of the most
+	// specific zone is used.
+	Zone string `json:"zone,omitempty"`
+	// Overflow is truncate or drop.
+	Overflow string `json:"overflow"`
+}
+
+func setTruncationDefaults(config *Config) error {
+	if config.MaxAnswers < 0 {
+		config.MaxAnswers = 0
+	}
+	switch config.AnswerSubset {
+	case "":
+		config.AnswerSubset = SubsetRandom
+	case SubsetRandom, SubsetFirst:
+	default:
+		return fmt.Errorf("answer_subset must be one of %q or %q", SubsetRandom, SubsetFirst)
+	}
+	for i := range config.TruncationPolicies {
+		p := &config.TruncationPolicies[i]
+		if p.Zone == "" {
+			p.Zone = config.Domain
+		}
+		p.Zone = dns.Fqdn(strings.ToLower(p.Zone))
+		if _, ok := dns.IsDomainName(p.Zone); !ok {
+			return fmt.Errorf("truncation policy %d: invalid zone: %q", i, p.Zone)
+		}
+		switch p.Overflow {
+		case OverflowTruncate, OverflowDrop:
+		default:
+			return fmt.Errorf("truncation policy %d: overflow must be one of %q or %q", i, OverflowTruncate, OverflowDrop)
+		}
+	}
+	// Most specific zone first.
+	sort.SliceStable(config.TruncationPolicies, func(i, j int) bool {
+		return dns.CountLabel(config.TruncationPolicies[i].Zone) > dns.CountLabel(config.TruncationPolicies[j].Zone)
+	})
+	return nil
+}
+
+// overflowPolicy returns what happens to replies for name that are too large for
+// UDP, by the policy of its zone, otherwise they are truncated.
+func (c *Config) overflowPolicy(name string) string {
+	for _, p := range c.TruncationPolicies {
+		if dns.IsSubDomain(p.Zone, name) {
+			return p.Overflow
+		}
+	}
+	return OverflowTruncate
+}
+
+// dropOverflow returns true if the records of m that don't fit in a UDP reply are
+// left out without setting TC. Signed answers are always truncated.
+func (s *server) dropOverflow(m *dns.Msg) bool {
+	if len(m.Question) == 0 || hasType(m.Answer, dns.TypeRRSIG) {
+		return false
+	}
+	return s.config.overflowPolicy(strings.ToLower(m.Question[0].Name)) == OverflowDrop
+}
+
+// limitAnswers returns m with no more than Config.MaxAnswers records of the queried
+// type, picked by Config.AnswerSubset. When records are left out it is a copy, m
+// may be cached. Replies for names outside our domain and signed answers, of
+// which a subset would not validate, are returned as is.
+func (s *server) limitAnswers(m *dns.Msg) *dns.Msg {
+	if s.config.MaxAnswers == 0 || len(m.Answer) <= s.config.MaxAnswers || !s.ownAnswer(m) {
+		return m
+	}
+	others, set := splitAnswer(m)
+	if len(set) <= s.config.MaxAnswers {
+		return m
+	}
+	set = append([]dns.RR(nil), set...)
+	s.orderAnswers(set)
+	c := *m
+	c.Answer = append(others, set[:s.config.MaxAnswers]...)
+	return &c
+}
+
+// pickAnswers orders the records of the queried type in m by Config.AnswerSubset,
+// so those kept when Fit has to leave some out come first: Fit drops records
+// from the end of the answer section.
+func (s *server) pickAnswers(m *dns.Msg) {
+	if !s.ownAnswer(m) {
+		return
+	}
+	others, set := splitAnswer(m)
+	if len(set) < 2 {
+		return
+	}
+	s.orderAnswers(set)
+	m.Answer = append(others, set...)
+}
+
+// ownAnswer returns true if m is an unsigned answer for a name in our domain.
+func (s *server) ownAnswer(m *dns.Msg) bool {
+	if len(m.Question) == 0 || !dns.IsSubDomain(s.config.Domain, strings.ToLower(m.Question[0].Name)) {
+		return false
+	}
+	return !hasType(m.Answer, dns.TypeRRSIG)
+}
+
+// splitAnswer returns the records in the answer section of m that are not of
+// the queried type, such as the CNAMEs leading to them, and those that are.
+func splitAnswer(m *dns.Msg) (others, set []dns.RR) {
+	qtype := m.Question[0].Qtype
+	for _, r := range m.Answer {
+		if r.Header().Rrtype == qtype {
+			set = append(set, r)
+			continue
+		}
+		others = append(others, r)
+	}
+	return others, set
+}
+
+// orderAnswers orders set, the records to keep first, see Config.AnswerSubset.
+func (s *server) orderAnswers(set []dns.RR) {
+	if s.config.AnswerSubset == SubsetRandom {
+		rand.Shuffle(len(set), func(i, j int) { set[i], set[j] = set[j], set[i] })
+		return
+	}
+	sort.SliceStable(set, func(i, j int) bool {
+		a, aok := set[i].(*dns.SRV)
+		b, bok := set[j].(*dns.SRV)
+		if aok && bok && a.Priority != b.Priority {
+			return a.Priority < b.Priority
+		}
+		if aok && bok && a.Weight != b.Weight {
+			return a.Weight > b.Weight
+		}
+		return set[i].String() < set[j].String()
+	})
+}
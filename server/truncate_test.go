@@ -0,0 +1,91 @@
+// Copyright (c) 2014 The SkyDNS Authors. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package server
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/skynetservices/skydns/msg"
+
+	"github.com/miekg/dns"
+)
+
+func TestTruncation(t *testing.T) {
+	s := newTestServer(t, false)
+	defer s.Stop()
+
+	// 30 SRV records don't fit in 512 bytes, the first 3 have the lowest priority.
+	for i := 0; i < 30; i++ {
+		serv := &msg.Service{Host: fmt.Sprintf("10.0.9.%d", i), Port: 80, Priority: 20}
+		if i < 3 {
+			serv.Priority = 10
+		}
+		serv.Key = fmt.Sprintf("x%d.large.trunc.skydns.test.", i)
+		addService(t, s, serv.Key, 0, serv)
+		defer delService(t, s, serv.Key)
+	}
+
+	query := func(name string) *dns.Msg {
+		m := new(dns.Msg)
+		m.SetQuestion(name, dns.TypeSRV)
+		w := &testWriter{}
+		s.ServeDNS(w, m)
+		return w.msg
+	}
+
+	if resp := query("large.trunc.skydns.test."); !resp.Truncated {
+		t.Errorf("expected a truncated reply, got %s", resp)
+	}
+
+	s.config.TruncationPolicies = []TruncationPolicy{{Zone: "trunc.skydns.test.", Overflow: OverflowDrop}}
+	if resp := query("large.trunc.skydns.test."); resp.Truncated || len(resp.Answer) == 0 || len(resp.Answer) == 30 || resp.Len() > dns.MinMsgSize {
+		t.Errorf("expected some of the records without TC, got %s", resp)
+	}
+
+	s.config.TruncationPolicies = nil
+	s.config.MaxAnswers, s.config.AnswerSubset = 3, SubsetFirst
+	resp := query("large.trunc.skydns.test.")
+	if resp.Truncated || len(resp.Answer) != 3 {
+		t.Fatalf("expected 3 records, got %s", resp)
+	}
+	for _, r := range resp.Answer {
+		if r.(*dns.SRV).Priority != 10 {
+			t.Errorf("expected the records with the lowest priority, got %s", r)
+		}
+	}
+
+	s.config.AnswerSubset = SubsetRandom
+	if resp := query("large.trunc.skydns.test."); len(resp.Answer) != 3 {
+		t.Errorf("expected 3 records, got %s", resp)
+	}
+}
+
+func TestTruncationConfig(t *testing.T) {
+	tests := []struct {
+		subset string
+		policy TruncationPolicy
+		ok     bool
+	}{
+		{"", TruncationPolicy{Overflow: OverflowDrop}, true},
+		{SubsetFirst, TruncationPolicy{Zone: "svc.skydns.test", Overflow: OverflowTruncate}, true},
+		{"sorted", TruncationPolicy{Overflow: OverflowDrop}, false},
+		{SubsetRandom, TruncationPolicy{Overflow: "tc"}, false},
+		{SubsetRandom, TruncationPolicy{Zone: "a..b", Overflow: OverflowDrop}, false},
+	}
+	for i, tc := range tests {
+		config := &Config{Domain: "skydns.test.", Nameservers: []string{"127.0.0.1:53"}, AnswerSubset: tc.subset, TruncationPolicies: []TruncationPolicy{tc.policy}}
+		if err := SetDefaults(config); tc.ok != (err == nil) {
+			t.Errorf("test %d: expected ok %t, got error %v", i, tc.ok, err)
+			continue
+		}
+		if tc.ok && config.overflowPolicy("www.svc.skydns.test.") != tc.policy.Overflow {
+			t.Errorf("test %d: expected the policy to apply to the zone", i)
+		}
+	}
+	if p := (&Config{}).overflowPolicy("www.skydns.test."); p != OverflowTruncate {
+		t.Errorf("expected %s without a policy, got %s", OverflowTruncate, p)
+	}
+}
@@ -0,0 +1,213 @@
+// Copyright (c) 2014 The SkyDNS Authors. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package server
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// TsigKey is a key requests may be signed with (RFC 8945).
+type TsigKey struct {
+	// Name of the key, as it is in the TSIG record.
+	Name string `json:"name"`
+	// Algorithm, one of hmac-md5.sig-alg.reg.int., hmac-sha1., hmac-sha256. and
+	// hmac-sha512. Defaults to hmac-sha256.
+	Algorithm string `json:"algorithm,omitempty"`
+	// Secret, the key in base64.
+	Secret string `json:"secret"`
+}
+
+// tsigAlgorithms are the algorithms the dns package can sign with.
+var tsigAlgorithms = map[string]bool{dns.HmacMD5: true, dns.HmacSHA1: true, dns.HmacSHA256: true, dns.HmacSHA512: true}
+
+// tsigOperations are the operations that can be in Config.TsigRequired.
+var tsigOperations = map[string]bool{"transfer": true, "notify": true}
+
+// errTsigUnchecked is the TSIG status of transports that don't read their
+// messages with tsigReader: the UDP batches and DNS over HTTPS and gRPC. Signed
+// requests on them are handled as unsigned.
+var errTsigUnchecked = errors.New("tsig is not checked")
+
+// setTsigDefaults checks the TSIG keys in config and the operations that must
+// be signed.
+func setTsigDefaults(config *Config) error {
+	config.tsigKeys = nil
+	for i := range config.TsigKeys {
+		k := &config.TsigKeys[i]
+		if _, ok := dns.IsDomainName(k.Name); !ok || k.Name == "" || k.Name == "." {
+			return fmt.Errorf("invalid tsig key name: %q", k.Name)
+		}
+		k.Name = dns.Fqdn(strings.ToLower(k.Name))
+		if k.Algorithm == "" {
+			k.Algorithm = dns.HmacSHA256
+		}
+		k.Algorithm = dns.Fqdn(strings.ToLower(k.Algorithm))
+		if !tsigAlgorithms[k.Algorithm] {
+			return fmt.Errorf("invalid algorithm for tsig key %q: %q", k.Name, k.Algorithm)
+		}
+		if _, err := base64.StdEncoding.DecodeString(k.Secret); err != nil || k.Secret == "" {
+			return fmt.Errorf("invalid secret for tsig key %q", k.Name)
+		}
+		if config.tsigKeys == nil {
+			config.tsigKeys = make(map[string]TsigKey)
+		}
+		if _, ok := config.tsigKeys[k.Name]; ok {
+			return fmt.Errorf("duplicate tsig key name: %q", k.Name)
+		}
+		config.tsigKeys[k.Name] = *k
+	}
+
+	config.tsigRequired = nil
+	for _, op := range config.TsigRequired {
+		if !tsigOperations[op] {
+			return fmt.Errorf("invalid tsig_required operation: %q", op)
+		}
+		if config.tsigKeys == nil {
+			return fmt.Errorf("tsig_required %q needs tsig_keys", op)
+		}
+		if config.tsigRequired == nil {
+			config.tsigRequired = make(map[string]bool)
+		}
+		config.tsigRequired[op] = true
+	}
+
+	if config.SecondariesKey != "" {
+		config.SecondariesKey = dns.Fqdn(strings.ToLower(config.SecondariesKey))
+		if _, ok := config.tsigKeys[config.SecondariesKey]; !ok {
+			return fmt.Errorf("secondaries_key is not one of tsig_keys: %q", config.SecondariesKey)
+		}
+	}
+	return nil
+}
+
+// tsigReader verifies the TSIG of the requests it reads, with the keys of
+// Config.TsigKeys. The dns package can't do this itself, it verifies after it
+// dropped the message. Requests with a TSIG that does not verify get NOTAUTH and
+// are not handled.
+type tsigReader struct {
+	dns.Reader
+	keys map[string]TsigKey
+}
+
+// ReadTCP returns an error for requests that don't verify, which closes the
+// connection.
+func (r *tsigReader) ReadTCP(conn net.Conn, timeout time.Duration) ([]byte, error) {
+	b, err := r.Reader.ReadTCP(conn, timeout)
+	if err != nil || verifyTsig(b, r.keys) {
+		return b, err
+	}
+	m := notAuth(b)
+	l := make([]byte, 2, 2+len(m))
+	binary.BigEndian.PutUint16(l, uint16(len(m)))
+	conn.Write(append(l, m...))
+	return nil, errRejected
+}
+
+// ReadUDP returns an empty message for requests that don't verify, which the dns
+// package ignores.
+func (r *tsigReader) ReadUDP(conn *net.UDPConn, timeout time.Duration) ([]byte, *dns.SessionUDP, error) {
+	b, s, err := r.Reader.ReadUDP(conn, timeout)
+	if err != nil || verifyTsig(b, r.keys) {
+		return b, s, err
+	}
+	dns.WriteToSessionUDP(conn, notAuth(b), s)
+	return b[:0], s, nil
+}
+
+// verifyTsig returns false if b is a request with a TSIG that does not verify
+// with the key it names.
+func verifyTsig(b []byte, keys map[string]TsigKey) bool {
+	if len(b) < headerSize || b[2]&0x80 != 0 {
+		return true
+	}
+	m := new(dns.Msg)
+	if err := m.Unpack(b); err != nil {
+		return true // the dns package replies with FORMERR
+	}
+	t := m.IsTsig()
+	if t == nil {
+		return true
+	}
+	key, ok := keys[strings.ToLower(t.Hdr.Name)]
+	if !ok || strings.ToLower(t.Algorithm) != key.Algorithm {
+		return false
+	}
+	// TsigVerify changes the message it verifies, it is handled after this.
+	return dns.TsigVerify(append([]byte(nil), b...), key.Secret, "", false) == nil
+}
+
+// notAuth returns a NOTAUTH reply without records for the message in b.
+func notAuth(b []byte) []byte {
+	m := make([]byte, headerSize)
+	copy(m, b[:2])
+	m[2] = 0x80 | b[2]&0x79 // QR, opcode and RD
+	m[3] = byte(dns.RcodeNotAuth)
+	return m
+}
+
+// tsigWriter signs the replies to a request with a TSIG that was verified, with
+// the same key. Every message of a zone transfer is signed.
+type tsigWriter struct {
+	dns.ResponseWriter
+	key   TsigKey
+	fudge uint16
+	// mac is the MAC of the request, then of the last message written.
+	mac string
+}
+
+// WriteMsg signs a copy of m, the reply may be cached.
+func (w *tsigWriter) WriteMsg(m *dns.Msg) error {
+	m = m.Copy()
+	if m.IsTsig() != nil {
+		m.Extra = m.Extra[:len(m.Extra)-1]
+	}
+	m.SetTsig(w.key.Name, w.key.Algorithm, w.fudge, time.Now().Unix())
+	b, mac, err := dns.TsigGenerate(m, w.key.Secret, w.mac, false)
+	if err != nil {
+		return err
+	}
+	w.mac = mac
+	_, err = w.ResponseWriter.Write(b)
+	return err
+}
+
+// signReplies returns w signing the replies to req when req has a TSIG verified
+// by tsigReader. The TSIG is removed from req, so it is not forwarded.
+func (s *server) signReplies(w dns.ResponseWriter, req *dns.Msg) dns.ResponseWriter {
+	t := req.IsTsig()
+	if t == nil || w.TsigStatus() != nil {
+		return w
+	}
+	key, ok := s.config.tsigKeys[strings.ToLower(t.Hdr.Name)]
+	if !ok {
+		return w
+	}
+	req.Extra = req.Extra[:len(req.Extra)-1]
+	return &tsigWriter{ResponseWriter: w, key: key, fudge: t.Fudge, mac: t.MAC}
+}
+
+// signed returns true if the request w replies to was signed with one of our
+// TSIG keys.
+func signed(w dns.ResponseWriter) bool {
+	_, ok := w.(*tsigWriter)
+	return ok
+}
+
+// signer returns the name of the TSIG key the request w replies to was signed
+// with, or the empty string.
+func signer(w dns.ResponseWriter) string {
+	if t, ok := w.(*tsigWriter); ok {
+		return t.key.Name
+	}
+	return ""
+}
@@ -0,0 +1,137 @@
+// Copyright (c) 2014 The SkyDNS Authors. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package server
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/skynetservices/skydns/cache"
+	"github.com/skynetservices/skydns/msg"
+
+	"github.com/miekg/dns"
+)
+
+func TestTsigDefaults(t *testing.T) {
+	const secret = "c2VjcmV0"
+	tests := []struct {
+		keys     []TsigKey
+		required []string
+		key      string
+		ok       bool
+	}{
+		{keys: []TsigKey{{Name: "a.key", Secret: secret}}, ok: true},
+		{keys: []TsigKey{{Name: "a.key", Algorithm: "hmac-sha512", Secret: secret}}, required: []string{"transfer", "notify"}, key: "A.key", ok: true},
+		{keys: []TsigKey{{Name: "a.key", Algorithm: "hmac-sha384", Secret: secret}}},
+		{keys: []TsigKey{{Name: "a.key", Secret: "not base64"}}},
+		{keys: []TsigKey{{Name: "a.key", Secret: secret}, {Name: "A.key.", Secret: secret}}},
+		{keys: []TsigKey{{Name: "a.key", Secret: secret}}, required: []string{"query"}},
+		{required: []string{"transfer"}},
+		{keys: []TsigKey{{Name: "a.key", Secret: secret}}, key: "b.key"},
+	}
+	for i, tc := range tests {
+		config := &Config{Domain: "skydns.test.", Nameservers: []string{"127.0.0.1:53"}, TsigKeys: tc.keys, TsigRequired: tc.required, SecondariesKey: tc.key}
+		err := SetDefaults(config)
+		if tc.ok != (err == nil) {
+			t.Errorf("test %d: expected ok %t, got error %v", i, tc.ok, err)
+		}
+	}
+}
+
+func TestTsig(t *testing.T) {
+	const key = "xfr.key."
+	const secret = "c2VjcmV0IGtleSBmb3IgdHJhbnNmZXJz"
+	_, n, _ := net.ParseCIDR("127.0.0.0/8")
+	s := newTestServer(t, false, func(s *server) {
+		s.config.tsigKeys = map[string]TsigKey{key: {Name: key, Algorithm: dns.HmacSHA256, Secret: secret}}
+		s.config.tsigRequired = map[string]bool{"transfer": true}
+		s.config.transferNets = []*net.IPNet{n}
+		// Replies from the caches are signed too, see below.
+		s.rcache = cache.New(100, 60)
+		s.pcache = cache.NewPacked(100, 60, 1)
+	})
+	defer s.Stop()
+	serv := &msg.Service{Host: "10.0.23.1", Key: "a.tsig.skydns.test."}
+	addService(t, s, serv.Key, 0, serv)
+	defer delService(t, s, serv.Key)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	started := make(chan struct{})
+	srv := &dns.Server{Listener: l, Handler: s, DecorateReader: s.reader, NotifyStartedFunc: func() { close(started) }}
+	go srv.ActivateAndServe()
+	defer srv.Shutdown()
+	<-started
+
+	exchange := func(m *dns.Msg, secret string) *dns.Msg {
+		c := &dns.Client{Net: "tcp"}
+		if secret != "" {
+			m.SetTsig(key, dns.HmacSHA256, 300, time.Now().Unix())
+			c.TsigSecret = map[string]string{key: secret}
+		}
+		// The client verifies the TSIG of the reply.
+		r, _, err := c.Exchange(m, l.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		return r
+	}
+
+	// Replies from the caches are signed too, the second is packed and the
+	// third comes from the packed cache.
+	for i := 0; i < 3; i++ {
+		m := new(dns.Msg)
+		m.SetQuestion("a.tsig.skydns.test.", dns.TypeA)
+		if r := exchange(m, secret); len(r.Answer) != 1 || r.IsTsig() == nil {
+			t.Fatalf("expected a signed answer to query %d, got %s", i, r)
+		}
+	}
+	m := new(dns.Msg)
+	m.SetQuestion("a.tsig.skydns.test.", dns.TypeA)
+	if r := exchange(m, ""); len(r.Answer) != 1 || r.IsTsig() != nil {
+		t.Fatalf("expected an unsigned answer, got %s", r)
+	}
+
+	m = new(dns.Msg)
+	m.SetAxfr("skydns.test.")
+	if r := exchange(m, ""); r.Rcode != dns.RcodeRefused {
+		t.Fatalf("expected REFUSED for an unsigned transfer, got %s", dns.RcodeToString[r.Rcode])
+	}
+
+	m = new(dns.Msg)
+	m.SetAxfr("skydns.test.")
+	m.SetTsig(key, dns.HmacSHA256, 300, time.Now().Unix())
+	tr := &dns.Transfer{TsigSecret: map[string]string{key: "d3Jvbmc="}}
+	env, err := tr.In(m, l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e := <-env; e.Error == nil {
+		t.Fatalf("expected an error for a transfer with a bad signature, got %v", e.RR)
+	}
+
+	m = new(dns.Msg)
+	m.SetAxfr("skydns.test.")
+	m.SetTsig(key, dns.HmacSHA256, 300, time.Now().Unix())
+	tr = &dns.Transfer{TsigSecret: map[string]string{key: secret}}
+	if env, err = tr.In(m, l.Addr().String()); err != nil {
+		t.Fatal(err)
+	}
+	found := false
+	for e := range env {
+		if e.Error != nil {
+			t.Fatalf("expected a signed transfer, got %s", e.Error)
+		}
+		for _, r := range e.RR {
+			found = found || r.Header().Name == serv.Key
+		}
+	}
+	if !found {
+		t.Errorf("expected %s in the transfer", serv.Key)
+	}
+}
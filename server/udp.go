@@ -0,0 +1,89 @@
+// Copyright (c) 2014 The SkyDNS Authors. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package server
+
+import (
+	"net"
+	"time"
+
+	"github.com/skynetservices/skydns/metrics"
+
+	"github.com/miekg/dns"
+)
+
+// listenAndServeUDP listens on addr and serves DNS over UDP. When batching is
+// enabled packets are read and written in batches, see serveUDPBatch.
+func (s *server) listenAndServeUDP(addr string, h dns.Handler) error {
+	if s.config.UDPBatch <= 1 {
+		return s.listenAndServe(addr, "udp", h)
+	}
+	a, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return err
+	}
+	conn, err := net.ListenUDP("udp", a)
+	if err != nil {
+		return err
+	}
+	return s.serveUDPBatch(conn, h)
+}
+
+// serveUDP serves DNS over the already opened UDP connection conn.
+func (s *server) serveUDP(conn *net.UDPConn, h dns.Handler) error {
+	if s.config.UDPBatch <= 1 {
+		return s.activateAndServe(nil, conn, h)
+	}
+	return s.serveUDPBatch(conn, h)
+}
+
+// batchWriter is the dns.ResponseWriter used for batched UDP. Replies are not
+// written directly, but handed to a function that queues them for the next batch.
+type batchWriter struct {
+	local  net.Addr
+	remote net.Addr
+	// oob sets the source address of the reply, see replyControl.
+	oob   []byte
+	write func(b []byte, remote net.Addr, oob []byte)
+}
+
+func (w *batchWriter) LocalAddr() net.Addr  { return w.local }
+func (w *batchWriter) RemoteAddr() net.Addr { return w.remote }
+func (w *batchWriter) Close() error         { return nil }
+func (w *batchWriter) TsigStatus() error    { return errTsigUnchecked }
+func (w *batchWriter) TsigTimersOnly(bool)  {}
+func (w *batchWriter) Hijack()              {}
+
+func (w *batchWriter) WriteMsg(m *dns.Msg) error {
+	b, err := m.Pack()
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(b)
+	return err
+}
+
+func (w *batchWriter) Write(b []byte) (int, error) {
+	w.write(b, w.remote, w.oob)
+	return len(b), nil
+}
+
+// serveBytes unpacks the query in b and hands it to h, like the dns package does
+// for the queries it reads itself. Batched UDP and pipelined TCP use it.
+func serveBytes(h dns.Handler, w dns.ResponseWriter, b []byte) {
+	req := new(dns.Msg)
+	parsed := time.Now()
+	err := req.Unpack(b)
+	metrics.ReportStage(metrics.StageParse, parsed)
+	if err != nil {
+		m := new(dns.Msg)
+		m.SetRcodeFormatError(req)
+		w.WriteMsg(m)
+		return
+	}
+	if req.Response {
+		return
+	}
+	h.ServeDNS(w, req)
+}
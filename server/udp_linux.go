@@ -0,0 +1,168 @@
+// Copyright (c) 2014 The SkyDNS Authors. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+//go:build linux
+// +build linux
+
+package server
+
+import (
+	"net"
+
+	"github.com/miekg/dns"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+// batchConn is implemented by both ipv4.PacketConn and ipv6.PacketConn.
+type batchConn interface {
+	ReadBatch(ms []ipv4.Message, flags int) (int, error)
+	WriteBatch(ms []ipv4.Message, flags int) (int, error)
+}
+
+func newBatchConn(conn *net.UDPConn) batchConn {
+	if a, ok := conn.LocalAddr().(*net.UDPAddr); ok && a.IP != nil && a.IP.To4() == nil {
+		p := ipv6.NewPacketConn(conn)
+		p.SetControlMessage(ipv6.FlagDst|ipv6.FlagInterface, true)
+		return p
+	}
+	p := ipv4.NewPacketConn(conn)
+	p.SetControlMessage(ipv4.FlagDst|ipv4.FlagInterface, true)
+	return p
+}
+
+// oobSize fits the control message of a packet of either family.
+var oobSize = func() int {
+	oob4 := ipv4.NewControlMessage(ipv4.FlagDst | ipv4.FlagInterface)
+	oob6 := ipv6.NewControlMessage(ipv6.FlagDst | ipv6.FlagInterface)
+	if len(oob4) > len(oob6) {
+		return len(oob4)
+	}
+	return len(oob6)
+}()
+
+// replyControl returns the address a packet was sent to, from its control message
+// oob, and the control message that makes the reply leave from that address
+// (IP_PKTINFO or IPV6_PKTINFO). On a host with more than one address on the
+// network, the kernel would otherwise pick the source of a reply from a
+// wildcard socket by its route, and clients drop replies from an address they
+// didn't query. Both are nil when oob has no address.
+func replyControl(oob []byte) (net.IP, []byte) {
+	cm6 := new(ipv6.ControlMessage)
+	if cm6.Parse(oob) == nil && cm6.Dst != nil && cm6.Dst.To4() == nil {
+		reply := &ipv6.ControlMessage{Src: cm6.Dst}
+		if cm6.Dst.IsLinkLocalUnicast() {
+			// The address is only unique on the interface.
+			reply.IfIndex = cm6.IfIndex
+		}
+		return cm6.Dst, reply.Marshal()
+	}
+	cm4 := new(ipv4.ControlMessage)
+	if cm4.Parse(oob) == nil && cm4.Dst != nil {
+		return cm4.Dst, (&ipv4.ControlMessage{Src: cm4.Dst}).Marshal()
+	}
+	if cm6.Dst != nil {
+		// An IPv4 packet on an IPv6 socket.
+		return cm6.Dst, (&ipv4.ControlMessage{Src: cm6.Dst}).Marshal()
+	}
+	return nil, nil
+}
+
+// serveUDPBatch serves DNS over UDP on conn. Up to s.config.UDPBatch packets
+// are read with one recvmmsg(2) call, and replies are collected and written
+// with sendmmsg(2). Every query is handled in its own goroutine, unless h is a
+// poolHandler, then queries are handed to its worker pool directly.
+func (s *server) serveUDPBatch(conn *net.UDPConn, h dns.Handler) error {
+	n := s.config.UDPBatch
+	bc := newBatchConn(conn)
+
+	// Replies of queries still in flight when reading fails are dropped, the
+	// writer is stopped with done before we return.
+	out := make(chan ipv4.Message, n)
+	done, stopped := make(chan struct{}), make(chan struct{})
+	go func() {
+		writeBatches(bc, out, done, n)
+		close(stopped)
+	}()
+	defer func() {
+		close(done)
+		<-stopped
+	}()
+	write := func(b []byte, remote net.Addr, oob []byte) {
+		select {
+		case out <- ipv4.Message{Buffers: [][]byte{b}, OOB: oob, Addr: remote}:
+		case <-done:
+		}
+	}
+
+	ms := make([]ipv4.Message, n)
+	for i := range ms {
+		ms[i].Buffers = [][]byte{make([]byte, dns.DefaultMsgSize)}
+		ms[i].OOB = make([]byte, oobSize)
+	}
+	port := 0
+	if a, ok := conn.LocalAddr().(*net.UDPAddr); ok {
+		port = a.Port
+	}
+	for {
+		k, err := bc.ReadBatch(ms, 0)
+		if err != nil {
+			if e, ok := err.(net.Error); ok && e.Temporary() {
+				continue
+			}
+			return err
+		}
+		for i := 0; i < k; i++ {
+			b := make([]byte, ms[i].N)
+			copy(b, ms[i].Buffers[0])
+			w := &batchWriter{local: conn.LocalAddr(), remote: ms[i].Addr, write: write}
+			if dst, oob := replyControl(ms[i].OOB[:ms[i].NN]); dst != nil {
+				w.local, w.oob = &net.UDPAddr{IP: dst, Port: port}, oob
+			}
+			if s.strict != nil && !s.strict.check(b, w.remote, func(m []byte) { w.Write(m) }) {
+				continue
+			}
+			if p, ok := h.(*poolHandler); ok {
+				if !p.pool.submit(func() { serveBytes(p.h, w, b) }) {
+					p.shedBatched(w, b)
+				}
+				continue
+			}
+			go serveBytes(h, w, b)
+		}
+	}
+}
+
+// writeBatches writes the replies from out to bc, until done is closed.
+// Everything that is queued when a reply comes in is written in the same batch,
+// with a maximum of n.
+func writeBatches(bc batchConn, out <-chan ipv4.Message, done <-chan struct{}, n int) {
+	ms := make([]ipv4.Message, 0, n)
+	for {
+		var m ipv4.Message
+		select {
+		case m = <-out:
+		case <-done:
+			return
+		}
+		ms = append(ms[:0], m)
+	Fill:
+		for len(ms) < n {
+			select {
+			case m := <-out:
+				ms = append(ms, m)
+			default:
+				break Fill
+			}
+		}
+		for i := 0; i < len(ms); {
+			k, err := bc.WriteBatch(ms[i:], 0)
+			if err != nil {
+				logf("failure to return %d replies %q", len(ms)-i, err)
+				break
+			}
+			i += k
+		}
+	}
+}
@@ -0,0 +1,20 @@
+// Copyright (c) 2014 The SkyDNS Authors. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+//go:build !linux
+// +build !linux
+
+package server
+
+import (
+	"net"
+
+	"github.com/miekg/dns"
+)
+
+// serveUDPBatch serves DNS over UDP on conn. Batched reads and writes are only
+// supported on Linux, elsewhere this is the same as non batched serving.
+func (s *server) serveUDPBatch(conn *net.UDPConn, h dns.Handler) error {
+	return s.activateAndServe(nil, conn, h)
+}
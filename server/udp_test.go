@@ -0,0 +1,112 @@
+// Copyright (c) 2014 The SkyDNS Authors. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package server
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/skynetservices/skydns/msg"
+
+	"github.com/miekg/dns"
+)
+
+func TestUDPBatch(t *testing.T) {
+	s := newTestServer(t, false, func(s *server) {
+		s.config.UDPBatch = 8
+	})
+	defer s.Stop()
+
+	serv := &msg.Service{Host: "10.0.0.8", Key: "batch.skydns.test."}
+	addService(t, s, serv.Key, 0, serv)
+	defer delService(t, s, serv.Key)
+
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("127.0.0.1")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	go s.serveUDPBatch(conn, s)
+
+	c := new(dns.Client)
+	for i := 0; i < 16; i++ {
+		m := new(dns.Msg)
+		m.SetQuestion("batch.skydns.test.", dns.TypeA)
+		resp, _, err := c.Exchange(m, conn.LocalAddr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.Id != m.Id || len(resp.Answer) != 1 {
+			t.Fatalf("failure to get batched reply: %s", resp)
+		}
+		if resp.Answer[0].(*dns.A).A.String() != "10.0.0.8" {
+			t.Fatalf("expected %s, got %s", "10.0.0.8", resp.Answer[0])
+		}
+	}
+}
+
+func TestUDPBatchSource(t *testing.T) {
+	s := newTestServer(t, false, func(s *server) {
+		s.config.UDPBatch = 8
+	})
+	defer s.Stop()
+
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4zero})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	go s.serveUDPBatch(conn, s)
+
+	// The route to the client at 127.0.0.1 would pick 127.0.0.1 as source.
+	client, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.ParseIP("127.0.0.1")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	m := new(dns.Msg)
+	m.SetQuestion("skydns.test.", dns.TypeSOA)
+	b, _ := m.Pack()
+	to := &net.UDPAddr{IP: net.ParseIP("127.0.0.2"), Port: conn.LocalAddr().(*net.UDPAddr).Port}
+	if _, err := client.WriteTo(b, to); err != nil {
+		t.Skipf("no 127.0.0.2: %s", err)
+	}
+	client.SetReadDeadline(time.Now().Add(2 * time.Second))
+	_, from, err := client.ReadFrom(make([]byte, dns.MaxMsgSize))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !from.(*net.UDPAddr).IP.Equal(to.IP) {
+		t.Errorf("expected the reply from %s, got it from %s", to.IP, from)
+	}
+}
+
+func TestUDPBatchClose(t *testing.T) {
+	s := newTestServer(t, false, func(s *server) {
+		s.config.UDPBatch = 8
+	})
+	defer s.Stop()
+
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("127.0.0.1")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	served := make(chan error)
+	go func() { served <- s.serveUDPBatch(conn, s) }()
+
+	m := new(dns.Msg)
+	m.SetQuestion("skydns.test.", dns.TypeSOA)
+	if _, _, err := new(dns.Client).Exchange(m, conn.LocalAddr().String()); err != nil {
+		t.Fatal(err)
+	}
+	// Closing the connection stops the reader, and the writer with it.
+	conn.Close()
+	select {
+	case <-served:
+	case <-time.After(2 * time.Second):
+		t.Fatal("expected serveUDPBatch to return after its connection is closed")
+	}
+}
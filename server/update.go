@@ -0,0 +1,403 @@
+// Copyright (c) 2014 The SkyDNS Authors. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package server
+
+import (
+	"fmt"
+	"hash/fnv"
+	"strings"
+
+	"github.com/skynetservices/skydns/msg"
+
+	"github.com/miekg/dns"
+)
+
+// updatePrefix starts the label of the keys the services added by dynamic
+// updates are stored in, below the key of their name. It can't start with an
+// underscore, etcd v2 hides those keys.
+const updatePrefix = "update-"
+
+// updateRecord is a record at a name that is updated, and the key and service
+// it comes from.
+type updateRecord struct {
+	rr   dns.RR
+	key  string
+	serv msg.Service
+}
+
+// ServeDNSUpdate handles a dynamic update (RFC 2136) of our domain, or a zone
+// below it: the prerequisites are checked against the records of the services
+// in the backend, and the records added and deleted are written to it. Only
+// updates signed with a key in Config.TsigKeys are accepted, see signReplies, and
+// the keys of a tenant only for the tenant's zone. In degraded mode updates are
+// refused, the backend can't store them.
+//
+// An update is atomic, RFC 2136, section 3.4.2: the update section is checked
+// before anything is written, and when a write fails the changes made before
+// it are rolled back. Updates are serialized, so no other update changes the
+// records between checking the prerequisites and writing. Writes to the backend
+// by others, or by another SkyDNS, are not.
+func (s *server) ServeDNSUpdate(w dns.ResponseWriter, req *dns.Msg) *dns.Msg {
+	m := new(dns.Msg)
+	m.SetReply(req)
+	defer func() {
+		s.setEdns(m, req.IsEdns0())
+		w.WriteMsg(m)
+	}()
+
+	q := req.Question[0]
+	zone := strings.ToLower(q.Name)
+	switch {
+	case s.degraded():
+		logf("refusing UPDATE for %s from %s in degraded mode", zone, w.RemoteAddr())
+		m.SetRcode(req, dns.RcodeRefused)
+		s.explain(m, req, reasonDegraded)
+		return m
+	case !signed(w) || !s.config.ownKey(signer(w)):
+		logf("refusing UPDATE for %s from %s", zone, w.RemoteAddr())
+		m.SetRcode(req, dns.RcodeRefused)
+		s.explain(m, req, reasonUpdateTsig)
+		return m
+	case q.Qtype != dns.TypeSOA || q.Qclass != dns.ClassINET:
+		m.SetRcode(req, dns.RcodeFormatError)
+		return m
+	case !dns.IsSubDomain(s.config.Domain, zone):
+		m.SetRcode(req, dns.RcodeNotAuth)
+		s.explain(m, req, reasonUpdateZone)
+		return m
+	}
+
+	s.updateMu.Lock()
+	defer s.updateMu.Unlock()
+
+	rcode, err := s.prerequisites(zone, req.Answer)
+	if err != nil {
+		logf("failure to check the prerequisites of an UPDATE for %s: %s", zone, err)
+		m.SetRcode(req, dns.RcodeServerFailure)
+		s.explain(m, req, backendReason(err))
+		return m
+	}
+	if rcode != dns.RcodeSuccess {
+		m.SetRcode(req, rcode)
+		s.explain(m, req, reasonUpdatePrereq)
+		return m
+	}
+
+	services := make([]*msg.Service, len(req.Ns))
+	for i, r := range req.Ns {
+		hdr := r.Header()
+		if !dns.IsSubDomain(zone, strings.ToLower(hdr.Name)) {
+			m.SetRcode(req, dns.RcodeNotZone)
+			return m
+		}
+		if reservedName(strings.ToLower(hdr.Name)) {
+			m.SetRcode(req, dns.RcodeRefused)
+			s.explain(m, req, reasonUpdateType)
+			return m
+		}
+		switch hdr.Class {
+		case dns.ClassINET:
+			serv, err := msg.FromRR(r)
+			if err != nil {
+				logf("refusing UPDATE for %s: %s", zone, err)
+				m.SetRcode(req, dns.RcodeRefused)
+				s.explain(m, req, reasonUpdateType)
+				return m
+			}
+			services[i] = serv
+		case dns.ClassANY, dns.ClassNONE:
+			if hdr.Ttl != 0 || (hdr.Class == dns.ClassNONE && hdr.Rrtype == dns.TypeANY) {
+				m.SetRcode(req, dns.RcodeFormatError)
+				return m
+			}
+		default:
+			m.SetRcode(req, dns.RcodeFormatError)
+			return m
+		}
+		switch hdr.Rrtype {
+		case dns.TypeAXFR, dns.TypeIXFR, dns.TypeMAILA, dns.TypeMAILB:
+			m.SetRcode(req, dns.RcodeFormatError)
+			return m
+		}
+	}
+
+	var undo []func() error
+	for i, r := range req.Ns {
+		u, err := s.update(r, services[i])
+		undo = append(undo, u...)
+		if err != nil {
+			logf("failure to update %s: %s", r.Header().Name, err)
+			rollback(undo)
+			if err == errQuota {
+				m.SetRcode(req, dns.RcodeRefused)
+				s.explain(m, req, reasonTenantQuota)
+				break
+			}
+			m.SetRcode(req, dns.RcodeServerFailure)
+			s.explain(m, req, backendReason(err))
+			break
+		}
+	}
+	s.flushZone(zone)
+	if s.config.Verbose {
+		logf("UPDATE for %s from %s, %d records", zone, w.RemoteAddr(), len(req.Ns))
+	}
+	return m
+}
+
+// prerequisites checks the prerequisites of an update of zone, RFC 2136, section
+// 3.2, and returns the rcode for the first one that failed.
+func (s *server) prerequisites(zone string, prereqs []dns.RR) (int, error) {
+	// The records that must exist, per name and type.
+	sets := make(map[string][]dns.RR)
+	for _, r := range prereqs {
+		hdr := r.Header()
+		name := strings.ToLower(hdr.Name)
+		if hdr.Ttl != 0 {
+			return dns.RcodeFormatError, nil
+		}
+		if !dns.IsSubDomain(zone, name) {
+			return dns.RcodeNotZone, nil
+		}
+		records, err := s.updateRecords(name)
+		if err != nil {
+			return 0, err
+		}
+		switch hdr.Class {
+		case dns.ClassANY:
+			if hdr.Rrtype == dns.TypeANY && len(records) == 0 {
+				return dns.RcodeNameError, nil
+			}
+			if hdr.Rrtype != dns.TypeANY && len(ofType(records, hdr.Rrtype)) == 0 {
+				return dns.RcodeNXRrset, nil
+			}
+		case dns.ClassNONE:
+			if hdr.Rrtype == dns.TypeANY && len(records) > 0 {
+				return dns.RcodeYXDomain, nil
+			}
+			if hdr.Rrtype != dns.TypeANY && len(ofType(records, hdr.Rrtype)) > 0 {
+				return dns.RcodeYXRrset, nil
+			}
+		case dns.ClassINET:
+			k := name + "/" + dns.TypeToString[hdr.Rrtype]
+			sets[k] = append(sets[k], r)
+		default:
+			return dns.RcodeFormatError, nil
+		}
+	}
+	for _, set := range sets {
+		records, err := s.updateRecords(strings.ToLower(set[0].Header().Name))
+		if err != nil {
+			return 0, err
+		}
+		have := ofType(records, set[0].Header().Rrtype)
+		for _, r := range set {
+			if len(matching(have, r)) == 0 {
+				return dns.RcodeNXRrset, nil
+			}
+		}
+		for _, h := range have {
+			found := false
+			for _, r := range set {
+				found = found || sameRR(h.rr, r)
+			}
+			if !found {
+				return dns.RcodeNXRrset, nil
+			}
+		}
+	}
+	return dns.RcodeSuccess, nil
+}
+
+// update makes the change of a record in the update section in the backend. For
+// an addition serv is the service for the record. It returns what undoes the
+// writes it made, also when one of them failed.
+func (s *server) update(r dns.RR, serv *msg.Service) (undo []func() error, err error) {
+	wr, ok := s.backend.(Writer)
+	if !ok {
+		return nil, fmt.Errorf("backend can't store services")
+	}
+	hdr := r.Header()
+	name := strings.ToLower(hdr.Name)
+	records, err := s.updateRecords(name)
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		remove []updateRecord
+		id     = updateID(r)
+	)
+	switch hdr.Class {
+	case dns.ClassINET:
+		// A CNAME can not have other data, RFC 2136, section 3.4.2.2.
+		cnames := ofType(records, dns.TypeCNAME)
+		if hdr.Rrtype == dns.TypeCNAME && len(cnames) < len(records) {
+			return nil, nil
+		}
+		if hdr.Rrtype != dns.TypeCNAME && len(cnames) > 0 {
+			return nil, nil
+		}
+		if hdr.Rrtype == dns.TypeCNAME {
+			remove = cnames
+		}
+		if err := wr.Put(name, id, serv); err != nil {
+			return nil, err
+		}
+		undo = append(undo, s.unput(wr, name, id, records))
+	case dns.ClassANY:
+		remove = records
+		if hdr.Rrtype != dns.TypeANY {
+			remove = ofType(records, hdr.Rrtype)
+		}
+	case dns.ClassNONE:
+		remove = matching(records, r)
+	}
+
+	deleted := make(map[string]bool)
+	for _, u := range remove {
+		// A CNAME that is added again is already stored.
+		if deleted[u.key] || hdr.Class == dns.ClassINET && strings.HasSuffix(u.key, "/"+id) {
+			continue
+		}
+		deleted[u.key] = true
+		if err := wr.Delete(u.key); err != nil {
+			return undo, err
+		}
+		undo = append(undo, restore(wr, u))
+	}
+	return undo, nil
+}
+
+// unput returns what undoes storing a service in the key id below name, which had
+// records before: the service that was there is stored again, or the key is
+// deleted.
+func (s *server) unput(wr Writer, name, id string, records []updateRecord) func() error {
+	for _, u := range records {
+		if strings.HasSuffix(u.key, "/"+id) {
+			return restore(wr, u)
+		}
+	}
+	return func() error {
+		records, err := s.updateRecords(name)
+		if err != nil {
+			return err
+		}
+		for _, u := range records {
+			if strings.HasSuffix(u.key, "/"+id) {
+				return wr.Delete(u.key)
+			}
+		}
+		return nil
+	}
+}
+
+// restore returns what undoes deleting the key of u: its service is stored there
+// again.
+func restore(wr Writer, u updateRecord) func() error {
+	labels := strings.SplitN(msg.Domain(u.key), ".", 2)
+	serv := u.serv
+	return func() error {
+		if len(labels) != 2 {
+			return fmt.Errorf("can't restore key %s", u.key)
+		}
+		return wr.Put(labels[1], labels[0], &serv)
+	}
+}
+
+// rollback undoes the writes of an update that failed, the last one first.
+func rollback(undo []func() error) {
+	for i := len(undo) - 1; i >= 0; i-- {
+		if err := undo[i](); err != nil {
+			logf("failure to roll back an UPDATE: %s", err)
+		}
+	}
+}
+
+// updateRecords returns the records at name, as they are transferred, with the
+// keys of their services. These are the services stored at name and the ones
+// added by dynamic updates, in keys of their own below it.
+func (s *server) updateRecords(name string) ([]updateRecord, error) {
+	services, err := s.backend.Records(name, false)
+	if err != nil && !isNameError(err, s) {
+		return nil, err
+	}
+	// A service with Hosts is restored as a whole, see restore.
+	stored := make(map[string]msg.Service, len(services))
+	for _, serv := range services {
+		stored[serv.Key] = serv
+	}
+	var records []updateRecord
+	for _, serv := range expandHosts(services) {
+		owner := msg.Domain(serv.Key)
+		if owner != name && !(strings.HasPrefix(owner, updatePrefix) && strings.SplitN(owner, ".", 2)[1] == name) {
+			continue
+		}
+		for _, r := range s.serviceRecords(serv) {
+			if !strings.EqualFold(r.Header().Name, owner) {
+				continue
+			}
+			r.Header().Name = name
+			records = append(records, updateRecord{rr: r, key: serv.Key, serv: stored[serv.Key]})
+		}
+	}
+	return records, nil
+}
+
+// updateID returns the label of the key the service for r is stored in, the same
+// for the same record.
+func updateID(r dns.RR) string {
+	h := fnv.New64a()
+	h.Write([]byte(rrKey(r)))
+	return fmt.Sprintf("%s%016x", updatePrefix, h.Sum64())
+}
+
+// rrKey returns r as text without its TTL, in lower case, to compare records.
+func rrKey(r dns.RR) string {
+	c := dns.Copy(r)
+	c.Header().Ttl = 0
+	c.Header().Class = dns.ClassINET
+	return strings.ToLower(c.String())
+}
+
+func sameRR(a, b dns.RR) bool { return rrKey(a) == rrKey(b) }
+
+// ofType returns the records in records of type t.
+func ofType(records []updateRecord, t uint16) (rs []updateRecord) {
+	for _, u := range records {
+		if u.rr.Header().Rrtype == t {
+			rs = append(rs, u)
+		}
+	}
+	return rs
+}
+
+// matching returns the records in records that are r, but for the TTL.
+func matching(records []updateRecord, r dns.RR) (rs []updateRecord) {
+	for _, u := range records {
+		if sameRR(u.rr, r) {
+			rs = append(rs, u)
+		}
+	}
+	return rs
+}
+
+// reservedName returns true if records can't be added to or deleted from name
+// with an update: the nameservers and DS records of zones, and names with a
+// label that is a wildcard in the paths of the backend.
+func reservedName(name string) bool {
+	if _, ok := belowLabels(name, "ns.dns"); ok {
+		return true
+	}
+	if _, ok := belowLabels(name, "ds.dns"); ok {
+		return true
+	}
+	for _, l := range dns.SplitDomainName(name) {
+		if l == "*" || l == "any" {
+			return true
+		}
+	}
+	return false
+}
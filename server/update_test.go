@@ -0,0 +1,171 @@
+// Copyright (c) 2014 The SkyDNS Authors. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package server
+
+import (
+	"fmt"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	backendetcd "github.com/skynetservices/skydns/backends/etcd"
+	"github.com/skynetservices/skydns/msg"
+
+	etcd "github.com/coreos/etcd/client"
+	"github.com/miekg/dns"
+)
+
+func TestUpdate(t *testing.T) {
+	const key = "update.key."
+	const secret = "c2VjcmV0IGtleSBmb3IgdXBkYXRlcw=="
+	s := newTestServer(t, false, func(s *server) {
+		s.config.tsigKeys = map[string]TsigKey{key: {Name: key, Algorithm: dns.HmacSHA256, Secret: secret}}
+		// Storing c.update.skydns.test. fails, see the rollback below.
+		s.backend = failWriter{Backend: s.backend, fail: "c.update.skydns.test."}
+		s.noQuorum = new(int32)
+	})
+	defer s.Stop()
+	path, _ := msg.PathWithWildcard("update.skydns.test.")
+	defer s.backend.(failWriter).Backend.(*backendetcd.Backend).Client().Delete(ctx, path, &etcd.DeleteOptions{Recursive: true})
+
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	started := make(chan struct{})
+	srv := &dns.Server{PacketConn: pc, Handler: s, DecorateReader: s.reader, NotifyStartedFunc: func() { close(started) }}
+	go srv.ActivateAndServe()
+	defer srv.Shutdown()
+	<-started
+
+	update := func(secret string, f func(m *dns.Msg)) int {
+		m := new(dns.Msg)
+		m.SetUpdate("skydns.test.")
+		f(m)
+		c := new(dns.Client)
+		if secret != "" {
+			m.SetTsig(key, dns.HmacSHA256, 300, time.Now().Unix())
+			c.TsigSecret = map[string]string{key: secret}
+		}
+		r, _, err := c.Exchange(m, pc.LocalAddr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		return r.Rcode
+	}
+	lookup := func(name string, qtype uint16) []dns.RR {
+		m := new(dns.Msg)
+		m.SetQuestion(name, qtype)
+		w := &testWriter{}
+		s.ServeDNS(w, m)
+		return w.msg.Answer
+	}
+
+	a, _ := dns.NewRR("a.update.skydns.test. 300 IN A 10.0.22.1")
+	txt, _ := dns.NewRR(`a.update.skydns.test. 300 IN TXT "hello"`)
+	if rcode := update("", func(m *dns.Msg) { m.Insert([]dns.RR{a}) }); rcode != dns.RcodeRefused {
+		t.Fatalf("expected REFUSED for an unsigned update, got %s", dns.RcodeToString[rcode])
+	}
+	if rcode := update("d3Jvbmc=", func(m *dns.Msg) { m.Insert([]dns.RR{a}) }); rcode != dns.RcodeNotAuth {
+		t.Fatalf("expected NOTAUTH for an update with a bad signature, got %s", dns.RcodeToString[rcode])
+	}
+	if rcode := update(secret, func(m *dns.Msg) { m.Insert([]dns.RR{a, txt}) }); rcode != dns.RcodeSuccess {
+		t.Fatalf("expected NOERROR for an update, got %s", dns.RcodeToString[rcode])
+	}
+	if rrs := lookup("a.update.skydns.test.", dns.TypeA); len(rrs) != 1 || rrs[0].(*dns.A).A.String() != "10.0.22.1" {
+		t.Fatalf("expected the added A record, got %v", rrs)
+	}
+
+	if rcode := update(secret, func(m *dns.Msg) { m.NameNotUsed([]dns.RR{a}) }); rcode != dns.RcodeYXDomain {
+		t.Errorf("expected YXDOMAIN for a name that is used, got %s", dns.RcodeToString[rcode])
+	}
+	// The helpers of dns.Msg change the records they are given.
+	other, _ := dns.NewRR("a.update.skydns.test. 0 IN A 10.0.22.2")
+	used, _ := dns.NewRR("a.update.skydns.test. 0 IN A 10.0.22.1")
+	if rcode := update(secret, func(m *dns.Msg) { m.Used([]dns.RR{other}); m.Remove([]dns.RR{dns.Copy(a)}) }); rcode != dns.RcodeNXRrset {
+		t.Errorf("expected NXRRSET for an RRset that differs, got %s", dns.RcodeToString[rcode])
+	}
+	if rcode := update(secret, func(m *dns.Msg) { m.Used([]dns.RR{used}); m.Remove([]dns.RR{dns.Copy(a)}) }); rcode != dns.RcodeSuccess {
+		t.Fatalf("expected NOERROR for a removal, got %s", dns.RcodeToString[rcode])
+	}
+	if rrs := lookup("a.update.skydns.test.", dns.TypeA); len(rrs) != 0 {
+		t.Fatalf("expected the A record to be removed, got %v", rrs)
+	}
+	if rrs := lookup("a.update.skydns.test.", dns.TypeTXT); len(rrs) != 1 {
+		t.Fatalf("expected the TXT record to stay, got %v", rrs)
+	}
+
+	if rcode := update(secret, func(m *dns.Msg) { m.RemoveName([]dns.RR{txt}) }); rcode != dns.RcodeSuccess {
+		t.Fatalf("expected NOERROR for removing a name, got %s", dns.RcodeToString[rcode])
+	}
+	if rrs := lookup("a.update.skydns.test.", dns.TypeTXT); len(rrs) != 0 {
+		t.Fatalf("expected the TXT record to be removed, got %v", rrs)
+	}
+
+	// An update that fails halfway is rolled back.
+	b, _ := dns.NewRR("b.update.skydns.test. 300 IN A 10.0.22.3")
+	c, _ := dns.NewRR("c.update.skydns.test. 300 IN A 10.0.22.4")
+	d, _ := dns.NewRR("d.update.skydns.test. 300 IN A 10.0.22.5")
+	if rcode := update(secret, func(m *dns.Msg) { m.Insert([]dns.RR{dns.Copy(b)}) }); rcode != dns.RcodeSuccess {
+		t.Fatalf("expected NOERROR for an update, got %s", dns.RcodeToString[rcode])
+	}
+	if rcode := update(secret, func(m *dns.Msg) {
+		m.Remove([]dns.RR{dns.Copy(b)})
+		m.Insert([]dns.RR{dns.Copy(d), dns.Copy(c)})
+	}); rcode != dns.RcodeServerFailure {
+		t.Errorf("expected SERVFAIL for an update that failed, got %s", dns.RcodeToString[rcode])
+	}
+	if rrs := lookup("b.update.skydns.test.", dns.TypeA); len(rrs) != 1 || rrs[0].(*dns.A).A.String() != "10.0.22.3" {
+		t.Errorf("expected the removed A record to be restored, got %v", rrs)
+	}
+	if rrs := lookup("d.update.skydns.test.", dns.TypeA); len(rrs) != 0 {
+		t.Errorf("expected the added A record to be removed again, got %v", rrs)
+	}
+
+	atomic.StoreInt32(s.noQuorum, 1)
+	if rcode := update(secret, func(m *dns.Msg) { m.Insert([]dns.RR{dns.Copy(a)}) }); rcode != dns.RcodeRefused {
+		t.Errorf("expected REFUSED for an update in degraded mode, got %s", dns.RcodeToString[rcode])
+	}
+	if rrs := lookup("a.update.skydns.test.", dns.TypeA); len(rrs) != 0 {
+		t.Fatalf("expected no A record after an update in degraded mode, got %v", rrs)
+	}
+	atomic.StoreInt32(s.noQuorum, 0)
+
+	// The nameservers and DS records of zones can't be deleted either.
+	ns, _ := dns.NewRR("ns1.ns.dns.skydns.test. 0 IN A 10.0.22.53")
+	ds, _ := dns.NewRR("sub.ds.dns.skydns.test. 0 IN DS 1 8 2 0102")
+	for _, f := range []func(m *dns.Msg){
+		func(m *dns.Msg) { m.RemoveRRset([]dns.RR{dns.Copy(ns)}) },
+		func(m *dns.Msg) { m.RemoveName([]dns.RR{dns.Copy(ns)}) },
+		func(m *dns.Msg) { m.Remove([]dns.RR{dns.Copy(ns)}) },
+		func(m *dns.Msg) { m.RemoveRRset([]dns.RR{dns.Copy(ds)}) },
+		func(m *dns.Msg) { m.Remove([]dns.RR{dns.Copy(ds)}) },
+	} {
+		if rcode := update(secret, f); rcode != dns.RcodeRefused {
+			t.Errorf("expected REFUSED for a delete of a reserved name, got %s", dns.RcodeToString[rcode])
+		}
+	}
+
+	out, _ := dns.NewRR("a.example.org. 300 IN A 10.0.22.1")
+	if rcode := update(secret, func(m *dns.Msg) { m.Insert([]dns.RR{out}) }); rcode != dns.RcodeNotZone {
+		t.Errorf("expected NOTZONE for a record outside the zone, got %s", dns.RcodeToString[rcode])
+	}
+}
+
+// failWriter fails to store services at the name fail.
+type failWriter struct {
+	Backend
+	fail string
+}
+
+func (f failWriter) Put(name, id string, serv *msg.Service) error {
+	if name == f.fail {
+		return fmt.Errorf("failure to store %s", name)
+	}
+	return f.Backend.(Writer).Put(name, id, serv)
+}
+
+func (f failWriter) Delete(key string) error { return f.Backend.(Writer).Delete(key) }
@@ -0,0 +1,102 @@
+// Copyright (c) 2014 The SkyDNS Authors. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package server
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/skynetservices/skydns/msg"
+
+	"github.com/miekg/dns"
+)
+
+// View is a split-horizon view on our domain: clients in its networks get the
+// services stored under the view's root in the backend, /<path-prefix>@<name>.
+// Names the view has no services for are looked up as usual.
+type View struct {
+	// Name of the view, lower case letters, digits and dashes.
+	Name string `json:"name"`
+	// Networks (CIDR or single address) of the clients that get this view.
+	Networks []string `json:"networks"`
+
+	// Networks parsed.
+	nets []*net.IPNet
+}
+
+// PathPrefix returns the root the view's services are stored under.
+func (v View) PathPrefix() string {
+	return msg.PathPrefix + "@" + v.Name
+}
+
+// setViewDefaults checks the views in config.
+func setViewDefaults(config *Config) error {
+	names := make(map[string]bool)
+	for i := range config.Views {
+		v := &config.Views[i]
+		if !validName(v.Name) {
+			return fmt.Errorf("invalid view name: %q", v.Name)
+		}
+		if names[v.Name] {
+			return fmt.Errorf("duplicate view name: %q", v.Name)
+		}
+		names[v.Name] = true
+		if len(v.Networks) == 0 {
+			return fmt.Errorf("view %q has no networks", v.Name)
+		}
+
+		v.nets = nil
+		for _, a := range v.Networks {
+			n, err := parseNet(a)
+			if err != nil {
+				return fmt.Errorf("invalid network for view %q: %s", v.Name, err)
+			}
+			v.nets = append(v.nets, n)
+		}
+	}
+	return nil
+}
+
+// view answers the queries of the clients in a view with a server of its own,
+// so answers are cached per view.
+type view struct {
+	*server
+	View
+}
+
+// AddView serves v, one of the Config's Views, from backend and falls back to
+// our own backend for names backend has no services for. Views are tried in the
+// order they are added, clients in none of them get our own answers. It must be
+// called before Run.
+func (s *server) AddView(v View, backend Backend) {
+	vs := &view{server: New(FirstBackend{backend, s.backend}, s.config), View: v}
+	// Handling (and recovering from panics) happens in s.
+	vs.pool, vs.strict, vs.popular = nil, nil, nil
+	vs.noQuorum = s.noQuorum
+	vs.challenges = s.challenges
+	vs.mdns = s.mdns
+	vs.weights = s.weights
+	s.views = append(s.views, vs)
+}
+
+// viewHandler selects the view for the client, by its address or a trusted client
+// subnet (see ClientSubnet), and answers with the view's server, or with s itself
+// when the client is in none of them.
+type viewHandler struct{ *server }
+
+func (h viewHandler) ServeDNS(w dns.ResponseWriter, req *dns.Msg) {
+	if req.Opcode == dns.OpcodeNotify { // flushes the caches of all views
+		h.server.ServeDNS(w, req)
+		return
+	}
+	client := h.clientIP(w, req)
+	for _, v := range h.views {
+		if containsIP(v.nets, client) {
+			v.ServeDNS(w, req)
+			return
+		}
+	}
+	h.server.ServeDNS(w, req)
+}
@@ -0,0 +1,84 @@
+// Copyright (c) 2014 The SkyDNS Authors. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package server
+
+import (
+	"encoding/json"
+	"testing"
+
+	backendetcd "github.com/skynetservices/skydns/backends/etcd"
+	"github.com/skynetservices/skydns/msg"
+
+	etcd "github.com/coreos/etcd/client"
+	"github.com/miekg/dns"
+)
+
+func TestView(t *testing.T) {
+	client, _ := etcd.New(etcd.Config{
+		Endpoints: []string{"http://127.0.0.1:2379/"},
+		Transport: etcd.DefaultTransport,
+	})
+	kapi := etcd.NewKeysAPI(client)
+
+	config := &Config{
+		Domain:      "skydns.test.",
+		Nameservers: []string{"127.0.0.1:53"},
+		Views: []View{
+			{Name: "external", Networks: []string{"10.0.0.0/8"}},
+			{Name: "internal", Networks: []string{"127.0.0.0/8", "::1"}},
+		},
+	}
+	if err := SetDefaults(config); err != nil {
+		t.Fatal(err)
+	}
+	s := New(backendetcd.NewBackend(kapi, ctx, &backendetcd.Config{Ttl: config.Ttl, Priority: 10}), config)
+	for _, v := range config.Views {
+		s.AddView(v, backendetcd.NewBackend(kapi, ctx, &backendetcd.Config{Ttl: config.Ttl, Priority: 10, PathPrefix: v.PathPrefix()}))
+	}
+
+	set := func(prefix, name, host string) {
+		b, _ := json.Marshal(&msg.Service{Host: host})
+		if _, err := kapi.Set(ctx, msg.PathIn(prefix, name), string(b), nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	set("skydns", "web.view.skydns.test.", "192.0.2.1")
+	set("skydns", "db.view.skydns.test.", "192.0.2.2")
+	set("skydns@external", "web.view.skydns.test.", "10.1.1.1")
+	set("skydns@internal", "web.view.skydns.test.", "127.1.1.1")
+	defer func() {
+		for _, p := range []string{"/skydns/test/skydns/view", "/skydns@external", "/skydns@internal"} {
+			kapi.Delete(ctx, p, &etcd.DeleteOptions{Recursive: true, Dir: true})
+		}
+	}()
+
+	tests := []struct {
+		name, addr string
+	}{
+		{"web.view.skydns.test.", "127.1.1.1"}, // testWriter's client is in the internal view
+		{"db.view.skydns.test.", "192.0.2.2"},  // not in the view, so our own
+	}
+	for _, tc := range tests {
+		m := new(dns.Msg)
+		m.SetQuestion(tc.name, dns.TypeA)
+		w := &testWriter{}
+		viewHandler{s}.ServeDNS(w, m)
+		if len(w.msg.Answer) != 1 {
+			t.Fatalf("expected a single answer for %s, got %s", tc.name, w.msg)
+		}
+		if a := w.msg.Answer[0].(*dns.A).A.String(); a != tc.addr {
+			t.Errorf("expected %s for %s, got %s", tc.addr, tc.name, a)
+		}
+	}
+
+	// Clients in no view get our own answers.
+	m := new(dns.Msg)
+	m.SetQuestion("web.view.skydns.test.", dns.TypeA)
+	w := &testWriter{}
+	s.ServeDNS(w, m)
+	if len(w.msg.Answer) != 1 || w.msg.Answer[0].(*dns.A).A.String() != "192.0.2.1" {
+		t.Fatalf("expected %s, got %s", "192.0.2.1", w.msg)
+	}
+}
@@ -0,0 +1,129 @@
+// Copyright (c) 2014 The SkyDNS Authors. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/skynetservices/skydns/msg"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	// webhookQueue is the number of changes queued for a webhook, when it falls
+	// further behind changes are dropped.
+	webhookQueue = 1024
+	// webhookTimeout is the timeout for delivering a change to a webhook.
+	webhookTimeout = 5 * time.Second
+	// webhookRetry is the time we wait before watching again after the watch failed.
+	webhookRetry = 5 * time.Second
+)
+
+// Webhook is a URL that is POSTed a msg.Change as JSON for every service added,
+// changed or removed in the backend.
+type Webhook struct {
+	URL string `json:"url"`
+	// Zones limits the changes sent to the ones for names in these zones. Empty
+	// sends all changes.
+	Zones []string `json:"zones,omitempty"`
+}
+
+// setWebhookDefaults checks the webhooks in config.
+func setWebhookDefaults(config *Config) error {
+	for i := range config.Webhooks {
+		h := &config.Webhooks[i]
+		u, err := url.Parse(h.URL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("invalid webhook url: %q", h.URL)
+		}
+		for j, z := range h.Zones {
+			if _, ok := dns.IsDomainName(z); !ok || z == "" {
+				return fmt.Errorf("invalid zone for webhook %q: %q", h.URL, z)
+			}
+			h.Zones[j] = dns.Fqdn(strings.ToLower(z))
+		}
+	}
+	return nil
+}
+
+// webhook delivers the changes queued for it, one at a time, so they are seen in
+// order.
+type webhook struct {
+	Webhook
+	queue  chan msg.Change
+	client *http.Client
+}
+
+// runWebhooks watches w and sends the changes to the webhooks in the config.
+func (s *server) runWebhooks(w Watcher) {
+	hooks := make([]*webhook, len(s.config.Webhooks))
+	for i, h := range s.config.Webhooks {
+		hooks[i] = &webhook{Webhook: h, queue: make(chan msg.Change, webhookQueue), client: &http.Client{Timeout: webhookTimeout}}
+		go hooks[i].deliver()
+	}
+	send := func(c msg.Change) {
+		for _, h := range hooks {
+			h.send(c)
+		}
+	}
+	go func() {
+		for {
+			err := w.Watch(context.Background(), send)
+			logf("watch for webhooks failed, retrying in %s: %s", webhookRetry, err)
+			time.Sleep(webhookRetry)
+		}
+	}()
+}
+
+// send queues c, if it is for a name in one of the webhook's zones.
+func (h *webhook) send(c msg.Change) {
+	if len(h.Zones) > 0 {
+		in := false
+		for _, z := range h.Zones {
+			if dns.IsSubDomain(z, c.Name) {
+				in = true
+				break
+			}
+		}
+		if !in {
+			return
+		}
+	}
+	select {
+	case h.queue <- c:
+	default:
+		logf("webhook %s is behind, dropping change for %s", h.URL, c.Name)
+	}
+}
+
+func (h *webhook) deliver() {
+	for c := range h.queue {
+		b, err := json.Marshal(c)
+		if err != nil {
+			logf("failure to encode change for %s: %s", c.Name, err)
+			continue
+		}
+		resp, err := h.client.Post(h.URL, "application/json", bytes.NewReader(b))
+		if err != nil {
+			logf("failure to send change for %s to webhook: %s", c.Name, err)
+			continue
+		}
+		io.Copy(ioutil.Discard, resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode/100 != 2 {
+			logf("failure to send change for %s to webhook %s: %s", c.Name, h.URL, resp.Status)
+		}
+	}
+}
@@ -0,0 +1,87 @@
+// Copyright (c) 2014 The SkyDNS Authors. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/skynetservices/skydns/msg"
+)
+
+func TestWebhook(t *testing.T) {
+	changes := make(chan msg.Change, 10)
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c := msg.Change{}
+		if err := json.NewDecoder(r.Body).Decode(&c); err != nil {
+			t.Error(err)
+		}
+		changes <- c
+	}))
+	defer hook.Close()
+
+	// The webhooks are run by the server.
+	s := newTestServer(t, false, func(s *server) {
+		s.config.Webhooks = []Webhook{{URL: hook.URL, Zones: []string{"Hook.skydns.test"}}}
+		if err := SetDefaults(s.config); err != nil {
+			t.Fatal(err)
+		}
+	})
+	defer s.Stop()
+
+	addService(t, s, "other.skydns.test.", 0, &msg.Service{Host: "10.0.0.1"})
+	defer delService(t, s, "other.skydns.test.")
+	addService(t, s, "a.hook.skydns.test.", 0, &msg.Service{Host: "10.0.0.2"})
+	addService(t, s, "a.hook.skydns.test.", 0, &msg.Service{Host: "10.0.0.3"})
+	delService(t, s, "a.hook.skydns.test.")
+
+	tests := []struct {
+		typ  msg.ChangeType
+		host string
+	}{
+		{msg.Added, "10.0.0.2"},
+		{msg.Changed, "10.0.0.3"},
+		{msg.Removed, ""},
+	}
+	for i, tc := range tests {
+		select {
+		case c := <-changes:
+			if c.Type != tc.typ || c.Name != "a.hook.skydns.test." {
+				t.Fatalf("test %d: expected %s of a.hook.skydns.test., got %s of %s", i, tc.typ, c.Type, c.Name)
+			}
+			host := ""
+			if c.Service != nil {
+				host = c.Service.Host
+			}
+			if host != tc.host {
+				t.Fatalf("test %d: expected host %q, got %q", i, tc.host, host)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("test %d: expected a change for a.hook.skydns.test.", i)
+		}
+	}
+}
+
+func TestWebhookConfig(t *testing.T) {
+	tests := []struct {
+		hook Webhook
+		ok   bool
+	}{
+		{Webhook{URL: "http://127.0.0.1:8080/changes"}, true},
+		{Webhook{URL: "https://example.org/changes", Zones: []string{"skydns.test."}}, true},
+		{Webhook{URL: "ftp://example.org/changes"}, false},
+		{Webhook{URL: "/changes"}, false},
+		{Webhook{URL: "http://example.org/", Zones: []string{""}}, false},
+	}
+	for i, tc := range tests {
+		config := &Config{Domain: "skydns.test.", Nameservers: []string{"127.0.0.1:53"}, Webhooks: []Webhook{tc.hook}}
+		if err := SetDefaults(config); tc.ok != (err == nil) {
+			t.Errorf("test %d: expected ok %t, got error %v", i, tc.ok, err)
+		}
+	}
+}
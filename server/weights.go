@@ -0,0 +1,349 @@
+// Copyright (c) 2014 The SkyDNS Authors. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/skynetservices/skydns/metrics"
+	"github.com/skynetservices/skydns/msg"
+)
+
+const (
+	// weightsAlpha is how much a new observation of an endpoint counts in its
+	// error rate and latency, older ones count less with every observation.
+	weightsAlpha = 0.2
+	// weightsForget is how long an endpoint is kept after it was last in an
+	// answer or reported on.
+	weightsForget = 10 * time.Minute
+	// checkTimeout is the timeout of a health check.
+	checkTimeout = 2 * time.Second
+)
+
+// AdaptiveWeights lowers the weights of the endpoints in SRV answers that fail or
+// are slow, as seen by health checks and reported by clients. The weight of an
+// endpoint is multiplied with a factor between MinFactor and MaxFactor.
+type AdaptiveWeights struct {
+	// Addr, address of the HTTP API clients report their telemetry to, with a
+	// POST to /report, and that explains the factors on /explain. Empty disables
+	// the API.
+	Addr string `json:"addr,omitempty"`
+	// ACL, networks of clients allowed to use the API. Defaults to 127.0.0.1 and ::1.
+	ACL []string `json:"acl,omitempty"`
+	// CheckInterval, seconds between the health checks, TCP connects, of the
+	// endpoints in SRV answers. Zero disables health checks.
+	CheckInterval int `json:"check_interval,omitempty"`
+	// Latency, in milliseconds, endpoints slower than this get a lower factor.
+	// Defaults to 100.
+	Latency int `json:"latency,omitempty"`
+	// MinFactor and MaxFactor bound the factor, they default to 0.1 and 1.
+	MinFactor float64 `json:"min_factor,omitempty"`
+	MaxFactor float64 `json:"max_factor,omitempty"`
+
+	nets []*net.IPNet
+}
+
+func setAdaptiveWeightsDefaults(config *Config) error {
+	a := config.AdaptiveWeights
+	if a == nil {
+		return nil
+	}
+	if a.Latency <= 0 {
+		a.Latency = 100
+	}
+	if a.MinFactor == 0 {
+		a.MinFactor = 0.1
+	}
+	if a.MaxFactor == 0 {
+		a.MaxFactor = 1
+	}
+	if a.MinFactor < 0 || a.MinFactor > a.MaxFactor {
+		return fmt.Errorf("adaptive weights: min_factor must be between 0 and max_factor")
+	}
+	if a.CheckInterval < 0 {
+		a.CheckInterval = 0
+	}
+	if len(a.ACL) == 0 {
+		a.ACL = []string{"127.0.0.1", "::1"}
+	}
+	a.nets = nil
+	for _, n := range a.ACL {
+		ipnet, err := parseNet(n)
+		if err != nil {
+			return fmt.Errorf("invalid adaptive weights acl entry: %s", err)
+		}
+		a.nets = append(a.nets, ipnet)
+	}
+	return nil
+}
+
+// endpointStats is what we know about an endpoint, host:port.
+type endpointStats struct {
+	errors  float64 // moving average of the error rate, 0 to 1
+	latency float64 // moving average of the latency in milliseconds, 0 when unknown
+	factor  float64
+
+	checks, reports uint64
+	seen, updated   time.Time
+}
+
+// weightController keeps the factors of the endpoints up to date.
+type weightController struct {
+	config *AdaptiveWeights
+
+	sync.Mutex
+	endpoints map[string]*endpointStats
+}
+
+func newWeightController(config *AdaptiveWeights) *weightController {
+	return &weightController{config: config, endpoints: make(map[string]*endpointStats)}
+}
+
+// endpoint returns the endpoint of serv, an SRV target.
+func endpoint(serv msg.Service) string {
+	return net.JoinHostPort(strings.ToLower(serv.Host), strconv.Itoa(serv.Port))
+}
+
+// factor returns the factor for the weight of endpoint, which is in an answer, so
+// it is health checked from now on.
+func (c *weightController) factor(endpoint string, now time.Time) float64 {
+	c.Lock()
+	defer c.Unlock()
+	e, ok := c.endpoints[endpoint]
+	if !ok {
+		e = &endpointStats{factor: c.config.MaxFactor}
+		c.endpoints[endpoint] = e
+	}
+	e.seen = now
+	return e.factor
+}
+
+// observe adds the outcome of requests to endpoint, errors of them failed,
+// latency is their average latency or zero when not known. Reports of clients
+// are only taken for the endpoints in our answers, each is a label of the
+// dns_srv_weight_factor metric; observe returns false for other endpoints.
+func (c *weightController) observe(endpoint string, requests, errors int, latency time.Duration, check bool, now time.Time) bool {
+	if requests <= 0 {
+		return false
+	}
+	if errors > requests {
+		errors = requests
+	}
+	c.Lock()
+	e, ok := c.endpoints[endpoint]
+	if !ok {
+		if !check {
+			c.Unlock()
+			return false
+		}
+		e = &endpointStats{}
+		c.endpoints[endpoint] = e
+	}
+	rate := float64(errors) / float64(requests)
+	if e.updated.IsZero() {
+		e.errors = rate
+	} else {
+		e.errors += weightsAlpha * (rate - e.errors)
+	}
+	if ms := float64(latency) / float64(time.Millisecond); ms > 0 {
+		if e.latency == 0 {
+			e.latency = ms
+		} else {
+			e.latency += weightsAlpha * (ms - e.latency)
+		}
+	}
+	if check {
+		e.checks++
+	} else {
+		e.reports++
+	}
+	e.updated = now
+	e.factor = c.compute(e)
+	f := e.factor
+	c.Unlock()
+
+	metrics.ReportWeightFactor(endpoint, f)
+	return true
+}
+
+// compute returns the factor for e: MaxFactor for a healthy endpoint, lowered by
+// its error rate and by how much it is slower than Latency.
+func (c *weightController) compute(e *endpointStats) float64 {
+	f := c.config.MaxFactor * (1 - e.errors)
+	if target := float64(c.config.Latency); e.latency > target {
+		f *= target / e.latency
+	}
+	if f < c.config.MinFactor {
+		f = c.config.MinFactor
+	}
+	return f
+}
+
+// forget removes the endpoints that were not in an answer or reported on for
+// weightsForget.
+func (c *weightController) forget(now time.Time) {
+	c.Lock()
+	var gone []string
+	for ep, e := range c.endpoints {
+		if now.Sub(e.seen) > weightsForget && now.Sub(e.updated) > weightsForget {
+			delete(c.endpoints, ep)
+			gone = append(gone, ep)
+		}
+	}
+	c.Unlock()
+	for _, ep := range gone {
+		metrics.ReportWeightFactor(ep, -1)
+	}
+}
+
+// check health checks all endpoints at once, with a TCP connect.
+func (c *weightController) check() {
+	c.Lock()
+	eps := make([]string, 0, len(c.endpoints))
+	for ep := range c.endpoints {
+		eps = append(eps, ep)
+	}
+	c.Unlock()
+
+	var wg sync.WaitGroup
+	for _, ep := range eps {
+		wg.Add(1)
+		go func(ep string) {
+			defer wg.Done()
+			start := time.Now()
+			conn, err := net.DialTimeout("tcp", ep, checkTimeout)
+			if err != nil {
+				c.observe(ep, 1, 1, 0, true, time.Now())
+				return
+			}
+			conn.Close()
+			c.observe(ep, 1, 0, time.Since(start), true, time.Now())
+		}(ep)
+	}
+	wg.Wait()
+}
+
+// endpointExplain is an endpoint on /explain.
+type endpointExplain struct {
+	Endpoint  string  `json:"endpoint"`
+	Factor    float64 `json:"factor"`
+	ErrorRate float64 `json:"error_rate"`
+	Latency   float64 `json:"latency_ms"`
+	Checks    uint64  `json:"checks"`
+	Reports   uint64  `json:"reports"`
+	Reason    string  `json:"reason"`
+}
+
+// explain returns the factors of the endpoints, and why they have them.
+func (c *weightController) explain() []endpointExplain {
+	c.Lock()
+	defer c.Unlock()
+	ex := make([]endpointExplain, 0, len(c.endpoints))
+	for ep, e := range c.endpoints {
+		var why []string
+		if e.errors > 0 {
+			why = append(why, fmt.Sprintf("error rate %.2f", e.errors))
+		}
+		if e.latency > float64(c.config.Latency) {
+			why = append(why, fmt.Sprintf("latency %.0fms over %dms", e.latency, c.config.Latency))
+		}
+		if e.factor == c.config.MinFactor && len(why) > 0 {
+			why = append(why, "at min_factor")
+		}
+		reason := "healthy"
+		switch {
+		case e.updated.IsZero():
+			reason = "no telemetry yet"
+		case len(why) > 0:
+			reason = strings.Join(why, ", ")
+		}
+		ex = append(ex, endpointExplain{Endpoint: ep, Factor: e.factor, ErrorRate: e.errors,
+			Latency: e.latency, Checks: e.checks, Reports: e.reports, Reason: reason})
+	}
+	sort.Slice(ex, func(i, j int) bool { return ex[i].Endpoint < ex[j].Endpoint })
+	return ex
+}
+
+// weightsReport is the body of a POST to /report: the outcome of requests a
+// client made to an endpoint.
+type weightsReport struct {
+	Endpoint string  `json:"endpoint"`
+	Requests int     `json:"requests"`
+	Errors   int     `json:"errors"`
+	Latency  float64 `json:"latency_ms"`
+}
+
+// handle implements the API: a POST to /report adds a client's telemetry, a GET
+// of /explain returns the endpoints as JSON.
+func (c *weightController) handle(w http.ResponseWriter, r *http.Request) {
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err != nil || !inNets(c.config.nets, &net.TCPAddr{IP: net.ParseIP(host)}) {
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return
+	}
+	switch r.URL.Path {
+	case "/explain":
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(c.explain())
+	case "/report":
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		req := weightsReport{}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, fmt.Sprintf("bad request: %s", err), http.StatusBadRequest)
+			return
+		}
+		host, port, err := net.SplitHostPort(req.Endpoint)
+		if err != nil || req.Requests <= 0 || req.Errors < 0 || req.Latency < 0 {
+			http.Error(w, "bad request: need an endpoint host:port and a number of requests", http.StatusBadRequest)
+			return
+		}
+		ep := net.JoinHostPort(strings.ToLower(host), port)
+		if !c.observe(ep, req.Requests, req.Errors, time.Duration(req.Latency*float64(time.Millisecond)), false, time.Now()) {
+			http.Error(w, "unknown endpoint: not in an SRV answer", http.StatusNotFound)
+		}
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// runWeights starts the health checks and the API of the adaptive weights.
+func (s *server) runWeights() {
+	config := s.config.AdaptiveWeights
+	go func() {
+		tick := time.Minute
+		if config.CheckInterval > 0 {
+			tick = time.Duration(config.CheckInterval) * time.Second
+		}
+		for range time.Tick(tick) {
+			if config.CheckInterval > 0 {
+				s.weights.check()
+			}
+			s.weights.forget(time.Now())
+		}
+	}()
+	if config.Addr == "" {
+		return
+	}
+	go func() {
+		if err := http.ListenAndServe(config.Addr, http.HandlerFunc(s.weights.handle)); err != nil {
+			fatalf("%s", err)
+		}
+	}()
+	logf("ready for endpoint telemetry on http://%s", config.Addr)
+}
@@ -0,0 +1,178 @@
+// Copyright (c) 2014 The SkyDNS Authors. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package server
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/skynetservices/skydns/msg"
+
+	"github.com/miekg/dns"
+)
+
+func TestAdaptiveWeightsConfig(t *testing.T) {
+	config := &Config{Domain: "skydns.test.", Nameservers: []string{"127.0.0.1:53"}, AdaptiveWeights: &AdaptiveWeights{}}
+	if err := SetDefaults(config); err != nil {
+		t.Fatal(err)
+	}
+	a := config.AdaptiveWeights
+	if a.Latency != 100 || a.MinFactor != 0.1 || a.MaxFactor != 1 || len(a.nets) != 2 {
+		t.Errorf("expected defaults, got %+v", a)
+	}
+
+	config.AdaptiveWeights = &AdaptiveWeights{MinFactor: 2, MaxFactor: 1}
+	if err := SetDefaults(config); err == nil {
+		t.Error("expected an error for min_factor above max_factor")
+	}
+}
+
+func TestWeightController(t *testing.T) {
+	c := newWeightController(&AdaptiveWeights{Latency: 100, MinFactor: 0.1, MaxFactor: 1})
+	now := time.Now()
+
+	if f := c.factor("10.0.0.1:80", now); f != 1 {
+		t.Fatalf("expected factor 1 for a new endpoint, got %f", f)
+	}
+	c.observe("10.0.0.1:80", 10, 5, 0, false, now)
+	if f := c.factor("10.0.0.1:80", now); f != 0.5 {
+		t.Fatalf("expected factor 0.5 for half the requests failing, got %f", f)
+	}
+	// A healthy observation moves the error rate back, not all the way.
+	c.observe("10.0.0.1:80", 10, 0, 0, true, now)
+	if f := c.factor("10.0.0.1:80", now); f <= 0.5 || f >= 1 {
+		t.Fatalf("expected factor between 0.5 and 1, got %f", f)
+	}
+
+	c.observe("10.0.0.2:80", 1, 0, 400*time.Millisecond, true, now)
+	if f := c.factor("10.0.0.2:80", now); f != 0.25 {
+		t.Fatalf("expected factor 0.25 for 4 times the latency, got %f", f)
+	}
+	c.observe("10.0.0.3:80", 1, 1, 0, true, now)
+	if f := c.factor("10.0.0.3:80", now); f != 0.1 {
+		t.Fatalf("expected factor min_factor for a failing endpoint, got %f", f)
+	}
+
+	ex := c.explain()
+	if len(ex) != 3 || ex[1].Endpoint != "10.0.0.2:80" || !strings.Contains(ex[1].Reason, "latency 400ms") {
+		t.Fatalf("expected 3 endpoints explained, got %+v", ex)
+	}
+	if !strings.Contains(ex[2].Reason, "at min_factor") {
+		t.Errorf("expected a reason with min_factor, got %q", ex[2].Reason)
+	}
+
+	c.forget(now.Add(weightsForget + time.Second))
+	if len(c.explain()) != 0 {
+		t.Error("expected endpoints to be forgotten")
+	}
+}
+
+func TestWeightsHealthCheck(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	up := l.Addr().String()
+	l.Close()
+	l, _ = net.Listen("tcp", "127.0.0.1:0")
+	defer l.Close()
+	down := up
+	up = l.Addr().String()
+
+	c := newWeightController(&AdaptiveWeights{Latency: 1000, MinFactor: 0.1, MaxFactor: 1})
+	c.factor(up, time.Now())
+	c.factor(down, time.Now())
+	c.check()
+	if f := c.factor(up, time.Now()); f != 1 {
+		t.Errorf("expected factor 1 for %s, got %f", up, f)
+	}
+	if f := c.factor(down, time.Now()); f != 0.1 {
+		t.Errorf("expected factor 0.1 for %s, got %f", down, f)
+	}
+}
+
+func TestWeightsAPI(t *testing.T) {
+	config := &Config{Domain: "skydns.test.", Nameservers: []string{"127.0.0.1:53"}, AdaptiveWeights: &AdaptiveWeights{}}
+	if err := SetDefaults(config); err != nil {
+		t.Fatal(err)
+	}
+	c := newWeightController(config.AdaptiveWeights)
+	c.factor("db.skydns.test:5432", time.Now())
+
+	do := func(method, path, body, remote string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, path, strings.NewReader(body))
+		r.RemoteAddr = remote
+		w := httptest.NewRecorder()
+		c.handle(w, r)
+		return w
+	}
+
+	tests := []struct {
+		method, path, body, remote string
+		code                       int
+	}{
+		{"POST", "/report", `{"endpoint": "DB.skydns.test:5432", "requests": 4, "errors": 1, "latency_ms": 10}`, "127.0.0.1:1234", http.StatusOK},
+		{"POST", "/report", `{"endpoint": "db.skydns.test:5432", "requests": 4}`, "10.0.0.1:1234", http.StatusForbidden},
+		{"POST", "/report", `{"endpoint": "db.skydns.test", "requests": 4}`, "127.0.0.1:1234", http.StatusBadRequest},
+		{"POST", "/report", `{"endpoint": "db.skydns.test:5432"}`, "127.0.0.1:1234", http.StatusBadRequest},
+		{"POST", "/report", `{"endpoint": "unknown.skydns.test:5432", "requests": 4}`, "127.0.0.1:1234", http.StatusNotFound},
+		{"GET", "/report", "", "127.0.0.1:1234", http.StatusMethodNotAllowed},
+		{"GET", "/other", "", "127.0.0.1:1234", http.StatusNotFound},
+	}
+	for i, tc := range tests {
+		if w := do(tc.method, tc.path, tc.body, tc.remote); w.Code != tc.code {
+			t.Errorf("test %d: expected status %d, got %d: %s", i, tc.code, w.Code, w.Body)
+		}
+	}
+
+	w := do("GET", "/explain", "", "[::1]:1234")
+	var ex []endpointExplain
+	if err := json.NewDecoder(w.Body).Decode(&ex); err != nil {
+		t.Fatal(err)
+	}
+	if len(ex) != 1 || ex[0].Endpoint != "db.skydns.test:5432" || ex[0].Factor != 0.75 || ex[0].Reports != 1 {
+		t.Errorf("expected db.skydns.test:5432 with factor 0.75, got %+v", ex)
+	}
+}
+
+func TestSRVAdaptiveWeights(t *testing.T) {
+	s := newTestServer(t, false, func(s *server) {
+		s.config.AdaptiveWeights = &AdaptiveWeights{}
+		setAdaptiveWeightsDefaults(s.config)
+		s.weights = newWeightController(s.config.AdaptiveWeights)
+	})
+	defer s.Stop()
+
+	for _, serv := range []*msg.Service{
+		{Key: "a.adaptive.skydns.test.", Host: "10.0.6.1", Port: 80},
+		{Key: "b.adaptive.skydns.test.", Host: "10.0.6.2", Port: 80},
+	} {
+		addService(t, s, serv.Key, 0, serv)
+		defer delService(t, s, serv.Key)
+	}
+	s.weights.observe("10.0.6.2:80", 10, 10, 0, true, time.Now())
+
+	m := new(dns.Msg)
+	m.SetQuestion("adaptive.skydns.test.", dns.TypeSRV)
+	w := &testWriter{}
+	s.ServeDNS(w, m)
+	if len(w.msg.Answer) != 2 {
+		t.Fatalf("expected 2 SRV records, got %s", w.msg)
+	}
+	weights := make(map[string]uint16)
+	for _, rr := range w.msg.Answer {
+		srv := rr.(*dns.SRV)
+		weights[srv.Target] = srv.Weight
+	}
+	// 100 and 10 (min_factor) of 110.
+	if weights["a.adaptive.skydns.test."] != 90 || weights["b.adaptive.skydns.test."] != 9 {
+		t.Errorf("expected weights 90 and 9, got %v", weights)
+	}
+}
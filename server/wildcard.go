@@ -0,0 +1,67 @@
+// Copyright (c) 2014 The SkyDNS Authors. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package server
+
+import (
+	"strings"
+	"time"
+
+	"github.com/skynetservices/skydns/msg"
+
+	"github.com/miekg/dns"
+)
+
+// wildcard returns the name of the wildcard that covers name, as described in
+// RFC 4592, or the empty string when there is none. It should only be called for
+// names that do not exist. The wildcard is stored under the key "*" directly
+// below the closest encloser, the nearest ancestor of name that does exist.
+// Wildcards only exist in the backend, a "*" in a query is still a search
+// pattern. The returned name uses msg.Wildcard, so it can be passed to
+// s.records like any other name.
+func (s *server) wildcard(name string) string {
+	if name == s.config.Domain || !dns.IsSubDomain(s.config.Domain, name) {
+		return ""
+	}
+	for off, end := dns.NextLabel(name, 0); !end; off, end = dns.NextLabel(name, off) {
+		ce := name[off:]
+		if !s.nameExists(ce) {
+			continue
+		}
+		wildcard := msg.Wildcard + "." + ce
+		if s.wildcardExists(wildcard) {
+			return wildcard
+		}
+		return ""
+	}
+	return ""
+}
+
+// isWildcard returns true if name is a wildcard as returned by wildcard, a
+// leftmost label "*" in the backend.
+func isWildcard(name string) bool {
+	return strings.HasPrefix(name, msg.Wildcard+".")
+}
+
+// wildcardExists returns true if there are services at or below wildcard. When
+// there are only services below it, with keys like sub.*.<parent>, the wildcard
+// is an empty non-terminal: it still matches, but the answer is NODATA (RFC 4592,
+// section 2.2.1).
+func (s *server) wildcardExists(wildcard string) bool {
+	services, err := s.backend.Records(wildcard, false)
+	return err == nil && len(active(s.withoutNameservers(services), time.Now())) > 0
+}
+
+// atWildcard filters the services of wildcard in sx, in place. Services below the
+// wildcard belong to other names and don't make up its answers.
+func atWildcard(sx []msg.Service, wildcard string) []msg.Service {
+	owner := "*" + wildcard[len(msg.Wildcard):]
+	ret := sx[:0]
+	for _, serv := range sx {
+		if strings.EqualFold(msg.Domain(serv.Key), owner) {
+			ret = append(ret, serv)
+		}
+	}
+	return ret
+}
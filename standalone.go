@@ -0,0 +1,79 @@
+// Copyright (c) 2014 The SkyDNS Authors. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/coreos/etcd/embed"
+)
+
+// standaloneTimeout is how long we wait for the embedded etcd to be ready, this
+// includes finding the peers of a new cluster.
+const standaloneTimeout = 60 * time.Second
+
+// startEtcd starts the etcd embedded in SkyDNS with -standalone, serving clients,
+// SkyDNS itself and those registering services, on machines. With
+// -standalone-cluster the etcd is a member of a cluster, usually of standalone
+// SkyDNS servers, and talks to the other members on -standalone-peers.
+func startEtcd(machines []string) error {
+	cfg := embed.NewConfig()
+	cfg.Name = standaloneName
+	cfg.Dir = standaloneDir
+	clients, err := parseURLs(machines)
+	if err != nil {
+		return err
+	}
+	cfg.LCUrls, cfg.ACUrls = clients, clients
+	if standalonePeers != "" {
+		peers, err := parseURLs(strings.Split(standalonePeers, ","))
+		if err != nil {
+			return err
+		}
+		cfg.LPUrls, cfg.APUrls = peers, peers
+	}
+	cfg.InitialCluster = standaloneCluster
+	if cfg.InitialCluster == "" {
+		cfg.InitialCluster = cfg.InitialClusterFromName(cfg.Name)
+	}
+	cfg.ClusterState = standaloneState
+
+	e, err := embed.StartEtcd(cfg)
+	if err != nil {
+		return err
+	}
+	select {
+	case <-e.Server.ReadyNotify():
+		log.Printf("skydns: embedded etcd %s ready for clients on %s, data in %s", cfg.Name, strings.Join(machines, ","), cfg.Dir)
+	case <-time.After(standaloneTimeout):
+		e.Close()
+		return fmt.Errorf("embedded etcd not ready after %s", standaloneTimeout)
+	}
+	go func() {
+		log.Fatalf("skydns: embedded etcd failed: %s", <-e.Err())
+	}()
+	return nil
+}
+
+// parseURLs parses the URLs the embedded etcd listens on. These are plain http, the
+// etcd client certificates are not used for them.
+func parseURLs(s []string) ([]url.URL, error) {
+	urls := make([]url.URL, 0, len(s))
+	for _, u := range s {
+		p, err := url.Parse(strings.TrimSpace(u))
+		if err != nil {
+			return nil, err
+		}
+		if p.Scheme != "http" {
+			return nil, fmt.Errorf("embedded etcd only listens on http URLs, not: %q", u)
+		}
+		urls = append(urls, *p)
+	}
+	return urls, nil
+}